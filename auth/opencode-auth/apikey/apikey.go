@@ -3,9 +3,14 @@ package apikey
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net/http"
 	"time"
 )
@@ -32,6 +37,9 @@ func NewClient(baseURL, jwtToken string) *Client {
 type CreateRequest struct {
 	Description   string `json:"description"`
 	ExpiresInDays int    `json:"expires_in_days,omitempty"`
+	// Project and ExpiresInHours are set for project keys (see CreateProject)
+	Project        string `json:"project,omitempty"`
+	ExpiresInHours int    `json:"expires_in_hours,omitempty"`
 }
 
 // APIKey represents a created API key (includes the full key, shown only once).
@@ -42,16 +50,42 @@ type APIKey struct {
 	Status      string `json:"status"`
 	CreatedAt   string `json:"created_at"`
 	ExpiresAt   string `json:"expires_at"`
+	// ExpiresIn is the lifetime in seconds (exchanged and project keys only)
+	ExpiresIn int    `json:"expires_in,omitempty"`
+	Project   string `json:"project,omitempty"`
 }
 
 // APIKeySummary represents an API key in list responses (never includes full key).
 type APIKeySummary struct {
-	KeyPrefix  string  `json:"key_prefix"`
+	KeyPrefix   string  `json:"key_prefix"`
+	Description string  `json:"description"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"created_at"`
+	ExpiresAt   string  `json:"expires_at"`
+	LastUsedAt  *string `json:"last_used_at"`
+	Project     string  `json:"project,omitempty"`
+}
+
+// KeyDetails is one API key's full metadata (never the key itself). Keys
+// created before the router recorded a field leave it empty.
+type KeyDetails struct {
+	KeyPrefix   string `json:"key_prefix"`
 	Description string `json:"description"`
 	Status      string `json:"status"`
 	CreatedAt   string `json:"created_at"`
-	ExpiresAt   string `json:"expires_at"`
-	LastUsedAt  *string `json:"last_used_at"`
+	// CreatedIP is the address the key was created from, as the router saw it
+	CreatedIP string `json:"created_ip"`
+	// CreatedBy is the user's email, or "<issuer>: <subject>" for exchanged keys
+	CreatedBy    string   `json:"created_by"`
+	ExpiresAt    string   `json:"expires_at"`
+	RevokedAt    *string  `json:"revoked_at"`
+	LastUsedAt   *string  `json:"last_used_at"`
+	LastUsedIP   string   `json:"last_used_ip"`
+	RequestCount int64    `json:"request_count"`
+	Scopes       []string `json:"scopes"`
+	Project      string   `json:"project,omitempty"`
+	// FederatedIssuer is the CI issuer of a key from 'apikey exchange'
+	FederatedIssuer string `json:"federated_issuer,omitempty"`
 }
 
 // ListResponse is the response from listing API keys.
@@ -70,44 +104,153 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-// Create creates a new API key.
-func (c *Client) Create(description string, expiresInDays int) (*APIKey, error) {
-	reqBody := CreateRequest{
-		Description:   description,
-		ExpiresInDays: expiresInDays,
+// Errors an *APIError unwraps to, by status code.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// APIError is an unexpected response from the API. Use errors.Is with
+// ErrUnauthorized, ErrForbidden, ErrNotFound, or ErrRateLimited to check
+// the kind of failure.
+type APIError struct {
+	StatusCode int
+	// Message is the API's error message, empty if the body had none
+	Message string
+	Body    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("API error (%d): %s", e.StatusCode, e.Message)
 	}
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
 
-	data, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// apiError builds an *APIError from a failed response.
+func apiError(statusCode int, body []byte) error {
+	var errResp ErrorResponse
+	json.Unmarshal(body, &errResp)
+	return &APIError{StatusCode: statusCode, Message: errResp.Error, Body: string(body)}
+}
+
+// Transient failures, connection errors and the load balancer's 502, 503 and
+// 504 while the router restarts, are retried up to MaxAttempts times. List
+// and Revoke are safe to repeat; Create sends an idempotency token so a
+// repeat returns the key the first attempt created.
+const (
+	MaxAttempts    = 3
+	retryBaseDelay = 300 * time.Millisecond
+)
+
+// IdempotencyHeader carries Create's idempotency token. The router derives
+// the new key from it, so every attempt with the same token yields one key.
+const IdempotencyHeader = "Idempotency-Key"
+
+// retryDelay is the pause before retry n (from 1): exponential, with half
+// of it random so clients that failed together do not retry together.
+// Replaced in tests.
+var retryDelay = func(n int) time.Duration {
+	d := retryBaseDelay << (n - 1)
+	return d/2 + time.Duration(mathrand.Int63n(int64(d/2)+1))
+}
+
+// transient reports whether a status is worth retrying.
+func transient(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// do sends a request, retrying transient failures, and returns the last
+// response's status and body, and the number of attempts made.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, header http.Header) (status int, respBody []byte, attempts int, err error) {
+	for attempt := 1; ; attempt++ {
+		status, respBody, err = c.send(ctx, method, path, body, header)
+		if attempt == MaxAttempts || ctx.Err() != nil || (err == nil && !transient(status)) {
+			return status, respBody, attempt, err
+		}
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-ctx.Done():
+			return status, respBody, attempt, err
+		}
 	}
+}
 
-	req, err := http.NewRequest("POST", c.baseURL+"/v1/api-keys", bytes.NewReader(data))
+// send makes one attempt of a request.
+func (c *Client) send(ctx context.Context, method, path string, body []byte, header http.Header) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
 	}
 	if c.jwtToken != "" {
 		req.Header.Set("Authorization", "Bearer "+c.jwtToken)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return 0, nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return 0, nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	return resp.StatusCode, respBody, nil
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		var errResp ErrorResponse
-		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
-			return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, errResp.Error)
-		}
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+// Create creates a new API key.
+func (c *Client) Create(ctx context.Context, description string, expiresInDays int) (*APIKey, error) {
+	return c.create(ctx, CreateRequest{
+		Description:   description,
+		ExpiresInDays: expiresInDays,
+	})
+}
+
+func (c *Client) create(ctx context.Context, reqBody CreateRequest) (*APIKey, error) {
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate idempotency token: %w", err)
+	}
+	header := http.Header{IdempotencyHeader: {base64.RawURLEncoding.EncodeToString(token)}}
+
+	status, body, _, err := c.do(ctx, "POST", "/v1/api-keys", data, header)
+	if err != nil {
+		return nil, err
+	}
+	// 200 is a repeat the router recognized by the idempotency token
+	if status != http.StatusCreated && status != http.StatusOK {
+		return nil, apiError(status, body)
 	}
 
 	var apiKey APIKey
@@ -119,32 +262,13 @@ func (c *Client) Create(description string, expiresInDays int) (*APIKey, error)
 }
 
 // List returns all API keys for the authenticated user.
-func (c *Client) List() (*ListResponse, error) {
-	req, err := http.NewRequest("GET", c.baseURL+"/v1/api-keys", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	if c.jwtToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.jwtToken)
-	}
-
-	resp, err := c.httpClient.Do(req)
+func (c *Client) List(ctx context.Context) (*ListResponse, error) {
+	status, body, _, err := c.do(ctx, "GET", "/v1/api-keys", nil, nil)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		var errResp ErrorResponse
-		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
-			return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, errResp.Error)
-		}
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	if status != http.StatusOK {
+		return nil, apiError(status, body)
 	}
 
 	var listResp ListResponse
@@ -155,33 +279,36 @@ func (c *Client) List() (*ListResponse, error) {
 	return &listResp, nil
 }
 
-// Revoke revokes an API key by its prefix.
-func (c *Client) Revoke(keyPrefix string) (*RevokeResponse, error) {
-	req, err := http.NewRequest("DELETE", c.baseURL+"/v1/api-keys/"+keyPrefix, nil)
+// Get returns the full metadata of the API key with keyPrefix.
+func (c *Client) Get(ctx context.Context, keyPrefix string) (*KeyDetails, error) {
+	status, body, _, err := c.do(ctx, "GET", "/v1/api-keys/"+keyPrefix, nil, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
-	if c.jwtToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.jwtToken)
+	if status != http.StatusOK {
+		return nil, apiError(status, body)
 	}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+	var details KeyDetails
+	if err := json.Unmarshal(body, &details); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	return &details, nil
+}
+
+// Revoke revokes an API key by its prefix.
+func (c *Client) Revoke(ctx context.Context, keyPrefix string) (*RevokeResponse, error) {
+	status, body, attempts, err := c.do(ctx, "DELETE", "/v1/api-keys/"+keyPrefix, nil, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		var errResp ErrorResponse
-		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
-			return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, errResp.Error)
-		}
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	// A retry finds the key revoked when an earlier attempt got through
+	if status == http.StatusConflict && attempts > 1 {
+		return &RevokeResponse{Status: "revoked", KeyPrefix: keyPrefix}, nil
+	}
+	if status != http.StatusOK {
+		return nil, apiError(status, body)
 	}
 
 	var revokeResp RevokeResponse
@@ -0,0 +1,101 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	defer func(orig func(int) time.Duration) { retryDelay = orig }(retryDelay)
+	retryDelay = func(int) time.Duration { return time.Millisecond }
+
+	// Each test serves the statuses in order, then 500
+	serve := func(statuses ...int) (*Client, *[]*http.Request) {
+		var reqs []*http.Request
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqs = append(reqs, r)
+			status := http.StatusInternalServerError
+			if len(reqs) <= len(statuses) {
+				status = statuses[len(reqs)-1]
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(`{"key":"oc_abc","key_prefix":"oc_abc","status":"revoked","keys":[]}`))
+		}))
+		t.Cleanup(srv.Close)
+		return NewClient(srv.URL, "jwt"), &reqs
+	}
+	ctx := context.Background()
+
+	// A create retried after a 502 sends the same idempotency token
+	client, reqs := serve(http.StatusBadGateway, http.StatusOK)
+	if key, err := client.Create(ctx, "ci", 30); err != nil || key.Key != "oc_abc" {
+		t.Fatalf("Create() = %+v, %v", key, err)
+	}
+	if len(*reqs) != 2 {
+		t.Fatalf("Create() made %d attempts, want 2", len(*reqs))
+	}
+	first, second := (*reqs)[0].Header.Get(IdempotencyHeader), (*reqs)[1].Header.Get(IdempotencyHeader)
+	if len(first) != 43 || first != second {
+		t.Errorf("idempotency tokens = %q, %q", first, second)
+	}
+
+	// Attempts are bounded
+	client, reqs = serve(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+	var apiErr *APIError
+	if _, err := client.List(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || len(*reqs) != MaxAttempts {
+		t.Errorf("List() after %d attempts: %v", len(*reqs), err)
+	}
+
+	// Other failures are not retried
+	client, reqs = serve(http.StatusForbidden)
+	if _, err := client.List(ctx); !errors.Is(err, ErrForbidden) || len(*reqs) != 1 {
+		t.Errorf("List() after %d attempts: %v", len(*reqs), err)
+	}
+
+	// A revoke whose first attempt got through finds the key revoked
+	client, _ = serve(http.StatusGatewayTimeout, http.StatusConflict)
+	if resp, err := client.Revoke(ctx, "oc_abc"); err != nil || resp.Status != "revoked" {
+		t.Errorf("Revoke() = %+v, %v", resp, err)
+	}
+	client, _ = serve(http.StatusConflict)
+	if _, err := client.Revoke(ctx, "oc_abc"); err == nil {
+		t.Error("Revoke() of a revoked key succeeded")
+	}
+
+	// A cancelled request is not retried
+	client = NewClient("http://127.0.0.1:1", "")
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.List(cctx); err == nil {
+		t.Error("List() succeeded without a server")
+	}
+}
+
+func TestGet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.Header.Get("Authorization") != "Bearer jwt" {
+			t.Errorf("%s %s, Authorization %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		}
+		if r.URL.Path != "/v1/api-keys/oc_abcdefg" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"API key not found"}`))
+			return
+		}
+		w.Write([]byte(`{"key_prefix":"oc_abcdefg","status":"active","created_ip":"203.0.113.7","created_by":"jane@example.com",
+			"last_used_at":null,"request_count":42,"scopes":["inference"]}`))
+	}))
+	defer srv.Close()
+	client := NewClient(srv.URL, "jwt")
+
+	key, err := client.Get(context.Background(), "oc_abcdefg")
+	if err != nil || key.CreatedIP != "203.0.113.7" || key.RequestCount != 42 || key.LastUsedAt != nil || len(key.Scopes) != 1 {
+		t.Errorf("Get() = %+v, %v", key, err)
+	}
+	if _, err := client.Get(context.Background(), "oc_missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of an unknown key: %v", err)
+	}
+}
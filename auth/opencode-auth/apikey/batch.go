@@ -0,0 +1,97 @@
+package apikey
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultRevokeConcurrency is the number of parallel revoke requests used by RevokeMany.
+const DefaultRevokeConcurrency = 4
+
+// RevokeResult is the outcome of revoking a single key in a batch.
+type RevokeResult struct {
+	KeyPrefix string
+	Err       error
+}
+
+// Selector chooses keys for batch revocation from a list response.
+type Selector struct {
+	// Prefixes selects keys by exact prefix.
+	Prefixes []string
+	// AllExpired selects active keys whose expiry is in the past.
+	AllExpired bool
+	// OlderThan selects active keys created more than this long ago (0 disables).
+	OlderThan time.Duration
+}
+
+// Select returns the keys matched by any of the selector's criteria.
+// Already-revoked keys are never selected. Order follows keys.
+func (s Selector) Select(keys []APIKeySummary, now time.Time) []APIKeySummary {
+	wanted := make(map[string]bool, len(s.Prefixes))
+	for _, p := range s.Prefixes {
+		wanted[p] = true
+	}
+
+	var selected []APIKeySummary
+	for _, k := range keys {
+		if k.Status == "revoked" {
+			continue
+		}
+		match := wanted[k.KeyPrefix]
+		if !match && s.AllExpired {
+			if expires, err := ParseTimestamp(k.ExpiresAt); err == nil && expires.Before(now) {
+				match = true
+			}
+		}
+		if !match && s.OlderThan > 0 {
+			if created, err := ParseTimestamp(k.CreatedAt); err == nil && now.Sub(created) > s.OlderThan {
+				match = true
+			}
+		}
+		if match {
+			selected = append(selected, k)
+		}
+	}
+	return selected
+}
+
+// RevokeMany revokes the given prefixes with at most concurrency requests in
+// flight. Results are returned in the same order as prefixes.
+func (c *Client) RevokeMany(ctx context.Context, prefixes []string, concurrency int) []RevokeResult {
+	if concurrency <= 0 {
+		concurrency = DefaultRevokeConcurrency
+	}
+
+	results := make([]RevokeResult, len(prefixes))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, prefix := range prefixes {
+		wg.Add(1)
+		go func(i int, prefix string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = RevokeResult{KeyPrefix: prefix, Err: ctx.Err()}
+				return
+			}
+			_, err := c.Revoke(ctx, prefix)
+			results[i] = RevokeResult{KeyPrefix: prefix, Err: err}
+		}(i, prefix)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// ParseTimestamp parses the router's ISO timestamps, which may omit the timezone.
+func ParseTimestamp(ts string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		t, err = time.Parse("2006-01-02T15:04:05.999999", ts)
+	}
+	return t, err
+}
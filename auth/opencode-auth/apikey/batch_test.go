@@ -0,0 +1,90 @@
+package apikey
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSelectorSelect(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	keys := []APIKeySummary{
+		{KeyPrefix: "oc_fresh", Status: "active", CreatedAt: "2026-05-30T00:00:00Z", ExpiresAt: "2026-08-01T00:00:00Z"},
+		{KeyPrefix: "oc_expired", Status: "active", CreatedAt: "2026-05-01T00:00:00Z", ExpiresAt: "2026-05-15T00:00:00.000000"},
+		{KeyPrefix: "oc_old", Status: "active", CreatedAt: "2025-12-01T00:00:00Z", ExpiresAt: "2026-12-01T00:00:00Z"},
+		{KeyPrefix: "oc_revoked", Status: "revoked", CreatedAt: "2025-01-01T00:00:00Z", ExpiresAt: "2025-02-01T00:00:00Z"},
+	}
+
+	tests := []struct {
+		name     string
+		selector Selector
+		want     []string
+	}{
+		{"prefix", Selector{Prefixes: []string{"oc_fresh"}}, []string{"oc_fresh"}},
+		{"all expired", Selector{AllExpired: true}, []string{"oc_expired"}},
+		{"older than 90d", Selector{OlderThan: 90 * 24 * time.Hour}, []string{"oc_old"}},
+		{"combined", Selector{Prefixes: []string{"oc_fresh"}, AllExpired: true}, []string{"oc_fresh", "oc_expired"}},
+		{"revoked never selected", Selector{Prefixes: []string{"oc_revoked"}, AllExpired: true}, []string{"oc_expired"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.selector.Select(keys, now)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Select() returned %d keys, want %d", len(got), len(tt.want))
+			}
+			for i, k := range got {
+				if k.KeyPrefix != tt.want[i] {
+					t.Errorf("Select()[%d] = %s, want %s", i, k.KeyPrefix, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRevokeMany(t *testing.T) {
+	var inFlight, maxInFlight int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/api-keys/")
+		if prefix == "oc_missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "API key not found"}`))
+			return
+		}
+		w.Write([]byte(`{"status": "revoked", "key_prefix": "` + prefix + `"}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL, "")
+	prefixes := []string{"oc_a", "oc_b", "oc_missing", "oc_c", "oc_d"}
+	results := client.RevokeMany(context.Background(), prefixes, 2)
+
+	if len(results) != len(prefixes) {
+		t.Fatalf("RevokeMany() returned %d results, want %d", len(results), len(prefixes))
+	}
+	for i, r := range results {
+		if r.KeyPrefix != prefixes[i] {
+			t.Errorf("results[%d].KeyPrefix = %s, want %s", i, r.KeyPrefix, prefixes[i])
+		}
+		if wantErr := prefixes[i] == "oc_missing"; (r.Err != nil) != wantErr {
+			t.Errorf("results[%d].Err = %v, wantErr %v", i, r.Err, wantErr)
+		}
+	}
+	if maxInFlight > 2 {
+		t.Errorf("max concurrent requests = %d, want <= 2", maxInFlight)
+	}
+}
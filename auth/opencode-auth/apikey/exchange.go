@@ -0,0 +1,149 @@
+package apikey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Token exchange grant (RFC 8693) used to trade a CI-issued OIDC token for a
+// short-lived API key.
+const (
+	TokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	JWTTokenType       = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// GitHubActionsToken is the --federated-token value that requests an OIDC
+// token from the GitHub Actions runner instead of taking one literally.
+const GitHubActionsToken = "github-actions"
+
+// ExchangeRequest is the request body for POST /v1/api-keys/exchange.
+type ExchangeRequest struct {
+	GrantType        string `json:"grant_type"`
+	SubjectToken     string `json:"subject_token"`
+	SubjectTokenType string `json:"subject_token_type"`
+	Description      string `json:"description,omitempty"`
+	ExpiresIn        int    `json:"expires_in,omitempty"` // seconds
+}
+
+// Exchange trades a federated OIDC token (e.g. from GitHub Actions) for a
+// short-lived API key. It needs no login: the router verifies the token
+// against its trusted CI issuers, so c is normally created with an empty JWT
+// and the router's base URL rather than the local proxy.
+func (c *Client) Exchange(ctx context.Context, subjectToken, description string, expiresIn time.Duration) (*APIKey, error) {
+	data, err := json.Marshal(ExchangeRequest{
+		GrantType:        TokenExchangeGrant,
+		SubjectToken:     subjectToken,
+		SubjectTokenType: JWTTokenType,
+		Description:      description,
+		ExpiresIn:        int(expiresIn.Seconds()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/api-keys/exchange", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, apiError(resp.StatusCode, body)
+	}
+
+	var apiKey APIKey
+	if err := json.Unmarshal(body, &apiKey); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &apiKey, nil
+}
+
+// ReadFederatedToken resolves a --federated-token value: "github-actions"
+// requests a token for audience from the Actions runner, "@path" reads a
+// file (keeping the token out of the process list), "-" reads stdin, and
+// anything else is the JWT itself.
+func ReadFederatedToken(ctx context.Context, spec, audience string) (string, error) {
+	var raw []byte
+	var err error
+	switch {
+	case spec == GitHubActionsToken:
+		return githubActionsToken(ctx, audience)
+	case spec == "-":
+		raw, err = io.ReadAll(io.LimitReader(os.Stdin, 64<<10))
+	case strings.HasPrefix(spec, "@"):
+		raw, err = os.ReadFile(spec[1:])
+	default:
+		raw = []byte(spec)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read federated token: %w", err)
+	}
+	token := strings.TrimSpace(string(raw))
+	if strings.Count(token, ".") != 2 {
+		return "", fmt.Errorf("federated token is not a JWT")
+	}
+	return token, nil
+}
+
+// githubActionsToken requests an OIDC token from the GitHub Actions runner.
+// The job needs `permissions: id-token: write`.
+func githubActionsToken(ctx context.Context, audience string) (string, error) {
+	requestURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	requestToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if requestURL == "" || requestToken == "" {
+		return "", fmt.Errorf("ACTIONS_ID_TOKEN_REQUEST_URL is not set; run inside GitHub Actions with 'permissions: id-token: write'")
+	}
+
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid ACTIONS_ID_TOKEN_REQUEST_URL: %w", err)
+	}
+	if audience != "" {
+		q := u.Query()
+		q.Set("audience", audience)
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+requestToken)
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GitHub Actions token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("GitHub Actions token request: unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.Value == "" {
+		return "", fmt.Errorf("GitHub Actions token request: no token in response")
+	}
+	return out.Value, nil
+}
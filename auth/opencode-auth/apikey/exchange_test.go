@@ -0,0 +1,89 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJWT = "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJyZXBvOngifQ.c2ln"
+
+func TestExchange(t *testing.T) {
+	var got ExchangeRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/api-keys/exchange" || r.Method != "POST" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("exchange sent Authorization %q", auth)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		if got.SubjectToken != testJWT {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid token signature"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"key":"oc_abc","key_prefix":"oc_abc","expires_at":"2026-10-17T10:00:00+00:00","expires_in":1800}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL, "")
+	key, err := client.Exchange(context.Background(), testJWT, "ci", 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Key != "oc_abc" || key.ExpiresIn != 1800 {
+		t.Errorf("key = %+v", key)
+	}
+	if got.GrantType != TokenExchangeGrant || got.SubjectTokenType != JWTTokenType || got.ExpiresIn != 1800 {
+		t.Errorf("request = %+v", got)
+	}
+
+	_, err = client.Exchange(context.Background(), "a.b.c", "", 0)
+	if err == nil || !strings.Contains(err.Error(), "invalid token signature") {
+		t.Errorf("rejected token: err = %v", err)
+	}
+	if !errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrForbidden) {
+		t.Errorf("rejected token: err = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestReadFederatedToken(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte(testJWT+"\n"), 0600)
+	if tok, err := ReadFederatedToken(ctx, "@"+path, ""); err != nil || tok != testJWT {
+		t.Errorf("@file = %q, %v", tok, err)
+	}
+	if _, err := ReadFederatedToken(ctx, "not-a-jwt", ""); err == nil {
+		t.Error("expected an error for a value that is not a JWT")
+	}
+
+	runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer runner-secret" || r.URL.Query().Get("audience") != "opencode" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": testJWT})
+	}))
+	defer runner.Close()
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", runner.URL+"/token?api-version=2.0")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "runner-secret")
+	if tok, err := ReadFederatedToken(ctx, GitHubActionsToken, "opencode"); err != nil || tok != testJWT {
+		t.Errorf("github-actions = %q, %v", tok, err)
+	}
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "")
+	if _, err := ReadFederatedToken(ctx, GitHubActionsToken, "opencode"); err == nil {
+		t.Error("expected an error outside GitHub Actions")
+	}
+}
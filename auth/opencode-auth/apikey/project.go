@@ -0,0 +1,81 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MaxProjectKeyTTL is the longest lifetime the router gives a project key.
+const MaxProjectKeyTTL = 24 * time.Hour
+
+// CreateProject creates a short-lived key labelled with project, for a
+// repository's hooks and scripts. ttl is rounded up to whole hours.
+func (c *Client) CreateProject(ctx context.Context, project, description string, ttl time.Duration) (*APIKey, error) {
+	if ttl <= 0 || ttl > MaxProjectKeyTTL {
+		return nil, fmt.Errorf("project key lifetime must be between 1h and %s", MaxProjectKeyTTL)
+	}
+	return c.create(ctx, CreateRequest{
+		Description:    description,
+		Project:        project,
+		ExpiresInHours: int((ttl + time.Hour - 1) / time.Hour),
+	})
+}
+
+// ProjectKey is a project key kept for reuse, so running a hook does not
+// mint a new key every time.
+type ProjectKey struct {
+	Key       string    `json:"key"`
+	KeyPrefix string    `json:"key_prefix"`
+	Project   string    `json:"project"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoadProjectKey returns the key cached at path for the project in dir if it
+// is valid for at least minRemaining, or nil.
+func LoadProjectKey(path, dir string, minRemaining time.Duration, now time.Time) *ProjectKey {
+	keys := readProjectKeys(path)
+	k, ok := keys[dir]
+	if !ok || k.ExpiresAt.Sub(now) < minRemaining {
+		return nil
+	}
+	return &k
+}
+
+// SaveProjectKey caches k for the project in dir, dropping expired keys.
+// The file holds live keys, so it is written with mode 0600.
+func SaveProjectKey(path, dir string, k ProjectKey, now time.Time) error {
+	keys := readProjectKeys(path)
+	for d, old := range keys {
+		if !old.ExpiresAt.After(now) {
+			delete(keys, d)
+		}
+	}
+	keys[dir] = k
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// readProjectKeys returns the cached keys by project directory. A missing or
+// unreadable cache is empty.
+func readProjectKeys(path string) map[string]ProjectKey {
+	keys := make(map[string]ProjectKey)
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &keys)
+	}
+	return keys
+}
@@ -0,0 +1,75 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateProject(t *testing.T) {
+	var got CreateRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"key":"oc_abc","key_prefix":"oc_abc","project":"app","expires_at":"2026-10-17T18:00:00+00:00","expires_in":28800}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL, "")
+	key, err := client.CreateProject(context.Background(), "app", "hooks", 90*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Project != "app" || got.ExpiresInHours != 2 || got.ExpiresInDays != 0 || got.Description != "hooks" {
+		t.Errorf("request = %+v", got)
+	}
+	if key.Project != "app" || key.ExpiresIn != 28800 {
+		t.Errorf("key = %+v", key)
+	}
+	if _, err := client.CreateProject(context.Background(), "app", "", 25*time.Hour); err == nil {
+		t.Error("CreateProject() accepted a lifetime over the maximum")
+	}
+}
+
+func TestProjectKeyCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "project-keys.json")
+	now := time.Now()
+
+	if k := LoadProjectKey(path, "/src/app", 0, now); k != nil {
+		t.Errorf("LoadProjectKey() without a cache = %+v", k)
+	}
+	app := ProjectKey{Key: "oc_app", Project: "app", ExpiresAt: now.Add(4 * time.Hour)}
+	if err := SaveProjectKey(path, "/src/app", app, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveProjectKey(path, "/src/old", ProjectKey{Key: "oc_old", ExpiresAt: now.Add(time.Minute)}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if k := LoadProjectKey(path, "/src/app", 2*time.Hour, now); k == nil || k.Key != "oc_app" {
+		t.Errorf("LoadProjectKey() = %+v", k)
+	}
+	if k := LoadProjectKey(path, "/src/app", 5*time.Hour, now); k != nil {
+		t.Errorf("LoadProjectKey() returned a key expiring too soon: %+v", k)
+	}
+	if k := LoadProjectKey(path, "/src/other", 0, now); k != nil {
+		t.Errorf("LoadProjectKey() for another project = %+v", k)
+	}
+
+	// Saving later drops the expired key
+	later := now.Add(time.Hour)
+	if err := SaveProjectKey(path, "/src/app", app, later); err != nil {
+		t.Fatal(err)
+	}
+	if keys := readProjectKeys(path); len(keys) != 1 {
+		t.Errorf("cache after expiry = %+v", keys)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("cache mode = %v, %v", info.Mode(), err)
+	}
+}
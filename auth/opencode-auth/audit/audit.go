@@ -0,0 +1,136 @@
+// Package audit records which local processes obtain credentials from
+// 'opencode-auth token', so unexpected consumers can be spotted.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// FileName is the audit log inside the config directory
+	FileName = "token-audit.jsonl"
+
+	// maxLogSize is the size at which the log is rotated to FileName.1
+	maxLogSize = 1024 * 1024
+)
+
+// Process identifies a local process.
+type Process struct {
+	PID     int    `json:"pid"`
+	Name    string `json:"name"`
+	Path    string `json:"path,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+// Entry is one credential handed out.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Caller Process   `json:"caller"`
+}
+
+// Consumer aggregates the entries for one executable.
+type Consumer struct {
+	Name  string
+	Path  string
+	Calls int
+	First time.Time
+	Last  time.Time
+}
+
+// Path returns the audit log path for the given config directory.
+func Path(configDir string) string {
+	return filepath.Join(configDir, FileName)
+}
+
+// Record appends an entry for caller to the log at path, rotating the log
+// once it exceeds maxLogSize.
+func Record(path string, caller Process) error {
+	if info, err := os.Stat(path); err == nil && info.Size() >= maxLogSize {
+		os.Rename(path, path+".1")
+	}
+
+	data, err := json.Marshal(Entry{Time: time.Now().UTC(), Caller: caller})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Load reads the rotated and current logs at path, oldest first. Missing
+// files yield no entries; malformed lines are skipped.
+func Load(path string) ([]Entry, error) {
+	var entries []Entry
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading audit log: %w", err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e Entry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				entries = append(entries, e)
+			}
+		}
+		f.Close()
+	}
+	return entries, nil
+}
+
+// Summarize groups entries by executable path (or name when the path is
+// unknown), most recently seen first.
+func Summarize(entries []Entry) []Consumer {
+	byKey := make(map[string]*Consumer)
+	for _, e := range entries {
+		key := e.Caller.Path
+		if key == "" {
+			key = e.Caller.Name
+		}
+		c, ok := byKey[key]
+		if !ok {
+			c = &Consumer{Name: e.Caller.Name, Path: e.Caller.Path, First: e.Time}
+			byKey[key] = c
+		}
+		c.Calls++
+		if e.Time.Before(c.First) {
+			c.First = e.Time
+		}
+		if e.Time.After(c.Last) {
+			c.Last = e.Time
+		}
+	}
+
+	consumers := make([]Consumer, 0, len(byKey))
+	for _, c := range byKey {
+		consumers = append(consumers, *c)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].Last.After(consumers[j].Last) })
+	return consumers
+}
+
+// Clear removes the audit log and its rotated copy.
+func Clear(path string) error {
+	for _, p := range []string{path, path + ".1"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
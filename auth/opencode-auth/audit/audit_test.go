@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	path := Path(t.TempDir())
+
+	if entries, err := Load(path); err != nil || len(entries) != 0 {
+		t.Fatalf("Load() on missing log = %v, %v; want empty", entries, err)
+	}
+
+	Record(path, Process{PID: 10, Name: "bash", Path: "/bin/bash"})
+	Record(path, Process{PID: 11, Name: "python3", Path: "/usr/bin/python3", Command: "python3 steal.py"})
+
+	entries, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Caller.Command != "python3 steal.py" {
+		t.Fatalf("entries = %+v", entries)
+	}
+
+	info, _ := os.Stat(path)
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("audit log mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestRecord_Rotates(t *testing.T) {
+	path := Path(t.TempDir())
+	os.WriteFile(path, []byte(strings.Repeat("x", maxLogSize)+"\n"), 0600)
+
+	if err := Record(path, Process{Name: "bash"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected rotated log: %v", err)
+	}
+	entries, _ := Load(path)
+	if len(entries) != 1 {
+		t.Errorf("got %d entries, want 1 (malformed lines skipped)", len(entries))
+	}
+
+	if err := Clear(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Error("Clear() left the rotated log")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: t0, Caller: Process{Name: "node", Path: "/usr/bin/node"}},
+		{Time: t0.Add(time.Hour), Caller: Process{Name: "bash", Path: "/bin/bash"}},
+		{Time: t0.Add(2 * time.Hour), Caller: Process{Name: "node", Path: "/usr/bin/node"}},
+		{Time: t0.Add(30 * time.Minute), Caller: Process{Name: "unknown"}},
+	}
+
+	consumers := Summarize(entries)
+	if len(consumers) != 3 {
+		t.Fatalf("got %d consumers, want 3", len(consumers))
+	}
+	node := consumers[0]
+	if node.Path != "/usr/bin/node" || node.Calls != 2 || !node.First.Equal(t0) || !node.Last.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("most recent consumer = %+v, want node with 2 calls", node)
+	}
+}
+
+func TestParent(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("process lookup not supported")
+	}
+	p, err := Parent()
+	if err != nil {
+		t.Fatalf("Parent() error = %v", err)
+	}
+	if p.PID != os.Getppid() || p.Name == "" || p.Path == "" {
+		t.Errorf("Parent() = %+v", p)
+	}
+}
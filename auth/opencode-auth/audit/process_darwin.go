@@ -0,0 +1,31 @@
+//go:build darwin
+
+package audit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Parent describes the process that started this one, using ps.
+func Parent() (Process, error) {
+	pid := os.Getppid()
+	p := Process{PID: pid}
+
+	// comm is the full executable path on macOS
+	out, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return p, fmt.Errorf("ps failed for PID %d: %w", pid, err)
+	}
+	p.Path = strings.TrimSpace(string(out))
+	p.Name = filepath.Base(p.Path)
+
+	if out, err := exec.Command("ps", "-o", "args=", "-p", strconv.Itoa(pid)).Output(); err == nil {
+		p.Command = strings.TrimSpace(string(out))
+	}
+	return p, nil
+}
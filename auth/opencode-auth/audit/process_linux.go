@@ -0,0 +1,28 @@
+//go:build linux
+
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Parent describes the process that started this one, from /proc.
+func Parent() (Process, error) {
+	pid := os.Getppid()
+	p := Process{PID: pid}
+
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return p, fmt.Errorf("reading executable of PID %d: %w", pid, err)
+	}
+	p.Path = exe
+	p.Name = filepath.Base(exe)
+
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		p.Command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	return p, nil
+}
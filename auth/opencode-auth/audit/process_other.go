@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package audit
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Parent returns only the parent PID; process names are not looked up on
+// this platform.
+func Parent() (Process, error) {
+	pid := os.Getppid()
+	return Process{PID: pid, Name: "unknown"}, fmt.Errorf("process lookup not supported on %s", runtime.GOOS)
+}
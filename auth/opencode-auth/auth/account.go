@@ -0,0 +1,35 @@
+// Package auth provides authentication functionality for the OpenCode credential helper.
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// VerifyAccount checks the email of a new sign-in against the expected
+// account: cfg.LoginHint when set, and cfg.LoginEmailDomains. The IdP treats
+// login_hint as a suggestion, so the user may still have picked another
+// account. Errors wrap ErrWrongAccount.
+func VerifyAccount(cfg *config.Config, email string) error {
+	if cfg.LoginHint == "" && len(cfg.LoginEmailDomains) == 0 {
+		return nil
+	}
+	if email == "" {
+		return fmt.Errorf("%w: the identity provider returned no email to check", ErrWrongAccount)
+	}
+	if cfg.LoginHint != "" && !strings.EqualFold(email, cfg.LoginHint) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrWrongAccount, cfg.LoginHint, email)
+	}
+	if len(cfg.LoginEmailDomains) > 0 {
+		domain := email[strings.LastIndex(email, "@")+1:]
+		for _, d := range cfg.LoginEmailDomains {
+			if strings.EqualFold(domain, strings.TrimPrefix(d, "@")) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not in an allowed domain (%s)", ErrWrongAccount, email, strings.Join(cfg.LoginEmailDomains, ", "))
+	}
+	return nil
+}
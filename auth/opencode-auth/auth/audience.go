@@ -0,0 +1,66 @@
+// Package auth provides per-audience access tokens for RFC 8707 resource
+// indicators.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// AudienceToken is an access token issued for one resource indicator.
+type AudienceToken struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IsExpired checks if the audience token has expired, with the same 30-second
+// buffer as TokenData.IsExpired.
+func (a AudienceToken) IsExpired() bool {
+	return time.Now().Add(30 * time.Second).After(a.ExpiresAt)
+}
+
+// TokenFor returns the unexpired access token stored for resource.
+func (t *TokenData) TokenFor(resource string) (string, bool) {
+	at, ok := t.AudienceTokens[resource]
+	if !ok || at.AccessToken == "" || at.IsExpired() {
+		return "", false
+	}
+	return at.AccessToken, true
+}
+
+// AcquireAudienceTokens obtains an access token for each configured resource
+// indicator using the refresh token grant. It returns the tokens keyed by
+// resource and the most recent refresh token, since the IdP may rotate it on
+// every grant.
+func AcquireAudienceTokens(ctx context.Context, cfg *config.Config, refreshToken string) (map[string]AudienceToken, string, error) {
+	resources := cfg.Resources()
+	if len(resources) == 0 {
+		return nil, refreshToken, nil
+	}
+
+	tokens := make(map[string]AudienceToken, len(resources))
+	for _, resource := range resources {
+		resp, err := RefreshTokensForResource(ctx, cfg, refreshToken, resource)
+		if err != nil {
+			return nil, refreshToken, fmt.Errorf("token for resource %s: %w", resource, err)
+		}
+		if resp.AccessToken == "" {
+			return nil, refreshToken, fmt.Errorf("token for resource %s: no access token in response", resource)
+		}
+		if resp.RefreshToken != "" {
+			refreshToken = resp.RefreshToken
+		}
+
+		expiresAt, err := GetExpiryFromIDToken(resp.AccessToken)
+		if err != nil {
+			// Opaque access token: fall back to expires_in
+			expiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+		}
+		tokens[resource] = AudienceToken{AccessToken: resp.AccessToken, ExpiresAt: expiresAt}
+	}
+
+	return tokens, refreshToken, nil
+}
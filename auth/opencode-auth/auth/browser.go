@@ -18,7 +18,14 @@ func OpenBrowser(url string) error {
 	case "windows":
 		cmd = exec.Command("cmd", "/c", "start", url)
 	case "linux":
-		cmd = exec.Command("xdg-open", url)
+		// Try xdg-open first, then common browsers
+		if _, err := exec.LookPath("xdg-open"); err == nil {
+			cmd = exec.Command("xdg-open", url)
+		} else if _, err := exec.LookPath("sensible-browser"); err == nil {
+			cmd = exec.Command("sensible-browser", url)
+		} else {
+			return fmt.Errorf("no browser command found")
+		}
 	default:
 		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
 	}
@@ -3,14 +3,17 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
-// acquireFileLock acquires an exclusive lock on the specified file
-func acquireFileLock(path string) (*FileLock, error) {
+// acquireFileLock acquires an exclusive lock on the specified file, waiting
+// at most timeout for another holder to release it
+func acquireFileLock(path string, timeout time.Duration) (*FileLock, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -22,13 +25,23 @@ func acquireFileLock(path string) (*FileLock, error) {
 		return nil, fmt.Errorf("failed to open lock file: %w", err)
 	}
 
-	// Try to acquire exclusive lock (blocks until available)
-	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	// Poll with a non-blocking lock so a stuck holder can't hang us forever
+	deadline := time.Now().Add(timeout)
+	for delay := time.Millisecond; ; delay = min(2*delay, 10*time.Millisecond) {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &FileLock{path: path, file: file}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			file.Close()
+			return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(delay)
 	}
-
-	return &FileLock{path: path, file: file}, nil
 }
 
 // releaseFileLock releases the file lock
@@ -39,3 +52,13 @@ func releaseFileLock(lock *FileLock) {
 	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
 	lock.file.Close()
 }
+
+// syncDir flushes the directory entry of a renamed file to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
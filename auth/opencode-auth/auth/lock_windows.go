@@ -3,10 +3,12 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -19,10 +21,13 @@ var (
 const (
 	lockfileExclusiveLock = 0x00000002
 	lockfileFailImmediately = 0x00000001
+
+	errorLockViolation = syscall.Errno(33) // ERROR_LOCK_VIOLATION
 )
 
-// acquireFileLock acquires an exclusive lock on the specified file
-func acquireFileLock(path string) (*FileLock, error) {
+// acquireFileLock acquires an exclusive lock on the specified file, waiting
+// at most timeout for another holder to release it
+func acquireFileLock(path string, timeout time.Duration) (*FileLock, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -34,22 +39,32 @@ func acquireFileLock(path string) (*FileLock, error) {
 		return nil, fmt.Errorf("failed to open lock file: %w", err)
 	}
 
-	// Lock the file using Windows LockFileEx
-	var overlapped syscall.Overlapped
-	r1, _, err := procLockFileEx.Call(
-		file.Fd(),
-		lockfileExclusiveLock,
-		0,
-		1,
-		0,
-		uintptr(unsafe.Pointer(&overlapped)),
-	)
-	if r1 == 0 {
-		file.Close()
-		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	// Lock the file using Windows LockFileEx, polling so a stuck holder
+	// can't hang us forever
+	deadline := time.Now().Add(timeout)
+	for delay := time.Millisecond; ; delay = min(2*delay, 10*time.Millisecond) {
+		var overlapped syscall.Overlapped
+		r1, _, err := procLockFileEx.Call(
+			file.Fd(),
+			lockfileExclusiveLock|lockfileFailImmediately,
+			0,
+			1,
+			0,
+			uintptr(unsafe.Pointer(&overlapped)),
+		)
+		if r1 != 0 {
+			return &FileLock{path: path, file: file}, nil
+		}
+		if !errors.Is(err, errorLockViolation) {
+			file.Close()
+			return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(delay)
 	}
-
-	return &FileLock{path: path, file: file}, nil
 }
 
 // releaseFileLock releases the file lock
@@ -68,3 +83,9 @@ func releaseFileLock(lock *FileLock) {
 	)
 	lock.file.Close()
 }
+
+// syncDir is a no-op on Windows, where a directory can't be opened for
+// syncing
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,179 @@
+// Package auth provides authentication functionality for the OpenCode credential helper.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// LoginsFile records recent login attempts inside the config directory
+	LoginsFile = "logins.jsonl"
+
+	// maxLoginAttempts is the number of attempts kept
+	maxLoginAttempts = 50
+)
+
+// Login attempt outcomes.
+const (
+	LoginSucceeded      = "success"
+	LoginIdPError       = "idp_error"       // the IdP redirected back with an error
+	LoginStateMismatch  = "state_mismatch"  // callback state did not match the request
+	LoginTimedOut       = "timeout"         // no callback before the deadline
+	LoginCancelled      = "cancelled"       // interrupted, e.g. Ctrl+C or proxy shutdown
+	LoginExchangeFailed = "exchange_failed" // the token endpoint rejected the code
+	LoginWrongAccount   = "wrong_account"   // signed in with an unexpected account
+	LoginFailed         = "error"           // anything else
+)
+
+var (
+	// ErrStateMismatch is returned for a callback whose state parameter does
+	// not match the authorization request.
+	ErrStateMismatch = errors.New("state mismatch: possible CSRF attack")
+	// ErrCallbackTimeout is returned when no callback arrives in time.
+	ErrCallbackTimeout = errors.New("timeout waiting for callback")
+	// ErrTokenExchange wraps failures exchanging the authorization code.
+	ErrTokenExchange = errors.New("token exchange failed")
+	// ErrWrongAccount is returned when the user signed in with an account
+	// other than the expected one.
+	ErrWrongAccount = errors.New("signed in with the wrong account")
+)
+
+// IdPError is an error the identity provider returned on the callback.
+type IdPError struct {
+	Code        string
+	Description string
+}
+
+func (e *IdPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// LoginAttempt records one browser login, from 'login' or proxy re-auth.
+// It never holds codes, verifiers, or tokens.
+type LoginAttempt struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"` // "login" or "proxy"
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// LoginOutcome classifies the error a login attempt ended with.
+func LoginOutcome(err error) string {
+	var idpErr *IdPError
+	switch {
+	case err == nil:
+		return LoginSucceeded
+	case errors.As(err, &idpErr):
+		return LoginIdPError
+	case errors.Is(err, ErrStateMismatch):
+		return LoginStateMismatch
+	case errors.Is(err, ErrCallbackTimeout), errors.Is(err, context.DeadlineExceeded):
+		return LoginTimedOut
+	case errors.Is(err, context.Canceled):
+		return LoginCancelled
+	case errors.Is(err, ErrTokenExchange):
+		return LoginExchangeFailed
+	case errors.Is(err, ErrWrongAccount):
+		return LoginWrongAccount
+	default:
+		return LoginFailed
+	}
+}
+
+// LoginsPath returns the login attempt log for the given config directory.
+func LoginsPath(configDir string) string {
+	return filepath.Join(configDir, LoginsFile)
+}
+
+// NewLoginAttempt builds the record of an attempt that started at start and
+// ended with err.
+func NewLoginAttempt(source string, start time.Time, email string, err error) LoginAttempt {
+	a := LoginAttempt{
+		Time:       start.UTC(),
+		Source:     source,
+		Outcome:    LoginOutcome(err),
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	} else {
+		a.Email = email
+	}
+	return a
+}
+
+// RecordLogin appends a to the log at path, keeping the newest
+// maxLoginAttempts entries.
+func RecordLogin(path string, a LoginAttempt) error {
+	attempts, err := LoadLogins(path)
+	if err != nil {
+		return err
+	}
+	attempts = append(attempts, a)
+	if len(attempts) > maxLoginAttempts {
+		attempts = attempts[len(attempts)-maxLoginAttempts:]
+	}
+
+	var data []byte
+	for _, a := range attempts {
+		line, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// 'login' and the proxy may record at the same time; each writes its
+	// own temp file and the last rename wins
+	tmp, err := os.CreateTemp(filepath.Dir(path), LoginsFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("writing login log: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing login log: %w", err)
+	}
+	return nil
+}
+
+// LoadLogins returns the recorded login attempts, oldest first. A missing
+// file yields no entries; malformed lines are skipped.
+func LoadLogins(path string) ([]LoginAttempt, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening login log: %w", err)
+	}
+	defer f.Close()
+
+	var attempts []LoginAttempt
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var a LoginAttempt
+		if json.Unmarshal(scanner.Bytes(), &a) == nil {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, scanner.Err()
+}
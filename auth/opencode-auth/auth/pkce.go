@@ -5,12 +5,25 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"sync"
 )
 
+// ErrVerifierUsed is returned when a PKCE verifier is used a second time.
+var ErrVerifierUsed = errors.New("PKCE verifier already used")
+
 // PKCE holds the PKCE verifier and challenge for OAuth 2.0 PKCE flow.
+//
+// The verifier is single-use: ExchangeCodeForTokens takes it once and wipes
+// it afterwards, so a second exchange with the same PKCE fails locally. The
+// verifier is kept as bytes so it can be zeroed; the copy in the request
+// body is garbage like any other Go string and is not under our control.
 type PKCE struct {
-	Verifier  string
 	Challenge string
+
+	mu       sync.Mutex
+	verifier []byte
+	used     bool
 }
 
 // GeneratePKCE generates a new PKCE verifier and challenge pair.
@@ -32,12 +45,40 @@ func GeneratePKCE() (*PKCE, error) {
 	// Base64url encode the hash (without padding)
 	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
 
+	wipe(verifierBytes)
 	return &PKCE{
-		Verifier:  verifier,
 		Challenge: challenge,
+		verifier:  []byte(verifier),
 	}, nil
 }
 
+// useVerifier returns the verifier for the token exchange. It succeeds once.
+func (p *PKCE) useVerifier() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.used {
+		return "", ErrVerifierUsed
+	}
+	p.used = true
+	return string(p.verifier), nil
+}
+
+// Wipe zeroes the verifier. The PKCE can no longer be used for an exchange.
+func (p *PKCE) Wipe() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wipe(p.verifier)
+	p.verifier = nil
+	p.used = true
+}
+
+// wipe zeroes b.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // GenerateState generates a random state parameter for OAuth 2.0.
 func GenerateState() (string, error) {
 	stateBytes := make([]byte, 16)
@@ -3,49 +3,100 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/urlscheme"
 )
 
 // CallbackResult represents the result of the OAuth callback.
 type CallbackResult struct {
-	Code  string
-	State string
-	Error string
+	Code string
+	// Err is an *IdPError, ErrStateMismatch, or another callback failure
+	Err error
 }
 
-// CallbackServer handles the OAuth callback from the browser.
+// CallbackServer handles the OAuth callback from the browser. It accepts a
+// single callback: the state is checked and forgotten on first use, and
+// later callbacks (a reload, a replayed URL) are refused. A private-use scheme
+// redirect URI is received over the urlscheme socket instead of HTTP.
 type CallbackServer struct {
-	config   *config.Config
-	server   *http.Server
-	listener net.Listener
-	result   chan CallbackResult
+	config      *config.Config
+	server      *http.Server
+	listener    net.Listener
+	socket      net.Listener
+	redirectURI string
+	result      chan CallbackResult
+
+	mu    sync.Mutex
+	state string
+	used  bool
 }
 
-// NewCallbackServer creates a new callback server.
-func NewCallbackServer(cfg *config.Config) (*CallbackServer, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.CallbackPort))
-	if err != nil {
-		return nil, fmt.Errorf("failed to start callback server: %w", err)
+// NewCallbackServer creates a new callback server expecting the given state
+// parameter on the callback. It listens on the first of cfg.CallbackURLs()
+// whose port is free, or whose scheme is registered and has no other login
+// waiting; RedirectURI returns the one chosen.
+func NewCallbackServer(cfg *config.Config, state string) (*CallbackServer, error) {
+	cs := &CallbackServer{
+		config: cfg,
+		result: make(chan CallbackResult, 1),
+		state:  state,
 	}
 
-	cs := &CallbackServer{
-		config:   cfg,
-		listener: listener,
-		result:   make(chan CallbackResult, 1),
+	var redirect *url.URL
+	var tried []string
+	for _, candidate := range cfg.CallbackURLs() {
+		if scheme := urlscheme.Scheme(candidate); scheme != "" {
+			if _, err := urlscheme.Handler(scheme); errors.Is(err, urlscheme.ErrNotRegistered) || errors.Is(err, urlscheme.ErrUnsupported) {
+				tried = append(tried, fmt.Sprintf("%s (%v; run 'opencode-auth url-scheme register')", candidate, err))
+				continue
+			}
+			l, err := urlscheme.Listen(urlscheme.SocketPath(cfg.ConfigDir))
+			if err != nil {
+				tried = append(tried, fmt.Sprintf("%s (%v)", candidate, err))
+				continue
+			}
+			cs.socket, cs.redirectURI = l, candidate
+			break
+		}
+		u, addr, err := loopbackAddr(candidate)
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s (%v)", candidate, err))
+			continue
+		}
+		cs.listener, redirect, cs.redirectURI = l, u, u.String()
+		break
+	}
+	if cs.socket != nil {
+		return cs, nil
+	}
+	if cs.listener == nil {
+		return nil, fmt.Errorf("failed to start callback server, no callback port is free: %s", strings.Join(tried, "; "))
 	}
 
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/callback", cs.handleCallback)
+	mux.HandleFunc(path, cs.handleCallback)
 
 	cs.server = &http.Server{
 		Handler:      mux,
@@ -56,54 +107,141 @@ func NewCallbackServer(cfg *config.Config) (*CallbackServer, error) {
 	return cs, nil
 }
 
+// loopbackAddr checks that a redirect URI is an http URI on this machine
+// with a port, and returns the address to listen on for it.
+func loopbackAddr(redirectURI string) (*url.URL, string, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil || u.Scheme != "http" || u.Port() == "" {
+		return nil, "", fmt.Errorf("redirect URI %q must be http://<loopback host>:<port>/<path>, or use a private-use scheme such as opencode-auth://callback", redirectURI)
+	}
+	switch u.Hostname() {
+	case "localhost":
+		// Browsers may resolve localhost to IPv4 or IPv6; accept both
+		return u, ":" + u.Port(), nil
+	case "127.0.0.1", "::1":
+		return u, net.JoinHostPort(u.Hostname(), u.Port()), nil
+	}
+	return nil, "", fmt.Errorf("redirect URI %q is not a loopback address", redirectURI)
+}
+
+// RedirectURI returns the redirect URI the server listens on. The authorize
+// request and the token exchange must both send it.
+func (cs *CallbackServer) RedirectURI() string {
+	return cs.redirectURI
+}
+
 // Start starts the callback server in a goroutine.
 func (cs *CallbackServer) Start() {
+	if cs.socket != nil {
+		go urlscheme.Serve(cs.socket, cs.handleSchemeRedirect)
+		return
+	}
 	go func() {
 		if err := cs.server.Serve(cs.listener); err != http.ErrServerClosed {
-			cs.result <- CallbackResult{Error: err.Error()}
+			select {
+			case cs.result <- CallbackResult{Err: err}:
+			default:
+			}
 		}
 	}()
 }
 
 // WaitForCallback waits for the OAuth callback with a timeout.
-func (cs *CallbackServer) WaitForCallback(timeout time.Duration) (CallbackResult, error) {
+// It returns early with the context error if ctx is cancelled (e.g. Ctrl+C).
+func (cs *CallbackServer) WaitForCallback(ctx context.Context, timeout time.Duration) (CallbackResult, error) {
 	select {
 	case result := <-cs.result:
 		return result, nil
+	case <-ctx.Done():
+		return CallbackResult{}, fmt.Errorf("cancelled waiting for callback: %w", ctx.Err())
 	case <-time.After(timeout):
-		return CallbackResult{}, fmt.Errorf("timeout waiting for callback")
+		return CallbackResult{}, ErrCallbackTimeout
 	}
 }
 
 // Shutdown gracefully shuts down the callback server.
 func (cs *CallbackServer) Shutdown(ctx context.Context) error {
+	if cs.socket != nil {
+		// Closing also removes the socket file
+		return cs.socket.Close()
+	}
 	return cs.server.Shutdown(ctx)
 }
 
 // handleCallback handles the OAuth callback request.
 func (cs *CallbackServer) handleCallback(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
+	if title, message := cs.callback(r.URL.Query()); title != "" {
+		cs.renderError(w, title, message)
+		return
+	}
+	cs.renderSuccess(w)
+}
+
+// handleSchemeRedirect handles a private-use scheme redirect forwarded by
+// 'opencode-auth url-scheme handle'. It returns the error to report, or "".
+func (cs *CallbackServer) handleSchemeRedirect(u *url.URL) string {
+	expected, _ := url.Parse(cs.redirectURI)
+	if !strings.EqualFold(u.Scheme, expected.Scheme) || u.Host != expected.Host || strings.TrimSuffix(u.Path, "/") != strings.TrimSuffix(expected.Path, "/") {
+		// The query is left out: it holds the code
+		return fmt.Sprintf("%s://%s%s is not this sign-in's redirect URI (%s)", u.Scheme, u.Host, u.Path, cs.redirectURI)
+	}
+	if title, message := cs.callback(u.Query()); title != "" {
+		return title + ": " + message
+	}
+	return ""
+}
+
+// Paste completes the sign-in with the address a browser was redirected to,
+// for a sign-in on another device, e.g. a phone, whose redirect cannot reach
+// this machine.
+func (cs *CallbackServer) Paste(address string) error {
+	u, err := url.Parse(strings.TrimSpace(address))
+	if err != nil {
+		return errors.New("not a web address")
+	}
+	query := u.Query()
+	if query.Get("state") == "" && query.Get("error") == "" {
+		return errors.New("not the address of a sign-in response")
+	}
+	if title, message := cs.callback(query); title != "" {
+		return fmt.Errorf("%s: %s", title, message)
+	}
+	return nil
+}
+
+// callback checks a callback's query and sends its result. It returns the
+// title and message of the error to show, or "" when the sign-in succeeded.
+func (cs *CallbackServer) callback(query url.Values) (title, message string) {
+	// The state is single-use: take it, so a second callback cannot match
+	cs.mu.Lock()
+	used, expected := cs.used, cs.state
+	cs.used, cs.state = true, ""
+	cs.mu.Unlock()
+	if used {
+		return "Already Used", "This sign-in response was already received. Return to your terminal."
+	}
 
 	// Check for errors
 	if errMsg := query.Get("error"); errMsg != "" {
 		errDesc := query.Get("error_description")
-		cs.result <- CallbackResult{Error: fmt.Sprintf("%s: %s", errMsg, errDesc)}
-		cs.renderError(w, errMsg, errDesc)
-		return
+		cs.result <- CallbackResult{Err: &IdPError{Code: errMsg, Description: errDesc}}
+		return errMsg, errDesc
+	}
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(expected)) != 1 || expected == "" {
+		cs.result <- CallbackResult{Err: ErrStateMismatch}
+		return "State Mismatch", "The sign-in response does not belong to this login. Start the login again."
 	}
 
 	// Extract authorization code
 	code := query.Get("code")
-	state := query.Get("state")
-
 	if code == "" {
-		cs.result <- CallbackResult{Error: "no authorization code received"}
-		cs.renderError(w, "No Code", "No authorization code was received")
-		return
+		cs.result <- CallbackResult{Err: fmt.Errorf("no authorization code received")}
+		return "No Code", "No authorization code was received"
 	}
 
-	cs.result <- CallbackResult{Code: code, State: state}
-	cs.renderSuccess(w)
+	cs.result <- CallbackResult{Code: code}
+	return "", ""
 }
 
 // renderSuccess renders a success page to the browser.
@@ -199,17 +337,67 @@ func (cs *CallbackServer) renderError(w http.ResponseWriter, errType, errDesc st
 </html>`, safeErrType, safeErrDesc)
 }
 
+// AuthURL builds the authorization URL for the PKCE flow, with the callback
+// server's redirect URI.
+func AuthURL(cfg *config.Config, redirectURI string, pkce *PKCE, state string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"code_challenge":        {pkce.Challenge},
+		"code_challenge_method": {"S256"},
+	}
+	if resources := cfg.Resources(); len(resources) > 0 {
+		params["resource"] = resources
+	}
+	if cfg.LoginHint != "" {
+		params.Set("login_hint", cfg.LoginHint)
+	}
+	return cfg.AuthorizeEndpoint + "?" + params.Encode()
+}
+
+// StepUpAuthURL builds the authorization URL for a step-up sign-in (RFC
+// 9470): the IdP is asked to authenticate the user again to the level in
+// acrValues, with a login no older than maxAge if it is set.
+func StepUpAuthURL(cfg *config.Config, redirectURI string, pkce *PKCE, state, acrValues string, maxAge time.Duration) string {
+	u, err := url.Parse(AuthURL(cfg, redirectURI, pkce, state))
+	if err != nil {
+		return AuthURL(cfg, redirectURI, pkce, state)
+	}
+	params := u.Query()
+	params.Set("acr_values", acrValues)
+	params.Set("prompt", "login")
+	if maxAge > 0 {
+		params.Set("max_age", strconv.Itoa(int(maxAge/time.Second)))
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
 // ExchangeCodeForTokens exchanges an authorization code for tokens.
-func ExchangeCodeForTokens(cfg *config.Config, code string, pkce *PKCE) (*TokenResponse, error) {
+// redirectURI must be the one the authorization URL was built with.
+// The PKCE verifier is used once and wiped when the exchange returns,
+// whether or not it succeeded.
+func ExchangeCodeForTokens(ctx context.Context, cfg *config.Config, code, redirectURI string, pkce *PKCE) (*TokenResponse, error) {
+	defer pkce.Wipe()
+	verifier, err := pkce.useVerifier()
+	if err != nil {
+		return nil, err
+	}
 	data := url.Values{
 		"grant_type":    {"authorization_code"},
 		"client_id":     {cfg.ClientID},
 		"code":          {code},
-		"redirect_uri":  {cfg.CallbackURL()},
-		"code_verifier": {pkce.Verifier},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	if resources := cfg.Resources(); len(resources) > 0 {
+		data["resource"] = resources
 	}
 
-	req, err := http.NewRequest("POST", cfg.TokenEndpoint, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.TokenEndpoint, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create token request: %w", err)
 	}
@@ -229,12 +417,12 @@ func ExchangeCodeForTokens(cfg *config.Config, code string, pkce *PKCE) (*TokenR
 	}
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		return nil, fmt.Errorf("rate limit exceeded: identity provider is rate limiting requests. Please wait 1-2 minutes and try again")
+		return nil, errRateLimited
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		if strings.Contains(string(body), "Rate exceeded") {
-			return nil, fmt.Errorf("rate limit exceeded: identity provider is rate limiting requests. Please wait 1-2 minutes and try again")
+			return nil, errRateLimited
 		}
 		return nil, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
 	}
@@ -247,15 +435,53 @@ func ExchangeCodeForTokens(cfg *config.Config, code string, pkce *PKCE) (*TokenR
 	return &tokenResp, nil
 }
 
+var (
+	// ErrRefreshTokenInvalid is returned when the identity provider rejects a
+	// refresh token as expired, revoked, or unknown. Retrying cannot help;
+	// the user has to sign in again.
+	ErrRefreshTokenInvalid = errors.New("refresh token rejected")
+	// ErrRateLimited is returned when the identity provider is rate limiting
+	// token requests. It is worth retrying after a pause.
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	errRateLimited = fmt.Errorf("%w: identity provider is rate limiting requests. Please wait 1-2 minutes and try again", ErrRateLimited)
+)
+
+// isRefreshTokenRejection reports whether a token endpoint error body says
+// the refresh token itself is no good, as opposed to a transient failure.
+func isRefreshTokenRejection(body []byte) bool {
+	var oauthErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error == "invalid_grant" {
+		return true
+	}
+	// Not every identity provider sends an OAuth error code
+	lower := strings.ToLower(string(body))
+	return strings.Contains(lower, "invalid_grant") ||
+		strings.Contains(lower, "invalid refresh token") ||
+		strings.Contains(lower, "user not found")
+}
+
 // RefreshTokens uses a refresh token to get new access and ID tokens.
-func RefreshTokens(cfg *config.Config, refreshToken string) (*TokenResponse, error) {
+func RefreshTokens(ctx context.Context, cfg *config.Config, refreshToken string) (*TokenResponse, error) {
+	return RefreshTokensForResource(ctx, cfg, refreshToken, "")
+}
+
+// RefreshTokensForResource is like RefreshTokens but requests an access token
+// for a single RFC 8707 resource indicator. An empty resource requests the
+// default audience.
+func RefreshTokensForResource(ctx context.Context, cfg *config.Config, refreshToken, resource string) (*TokenResponse, error) {
 	data := url.Values{
 		"grant_type":    {"refresh_token"},
 		"client_id":     {cfg.ClientID},
 		"refresh_token": {refreshToken},
 	}
+	if resource != "" {
+		data.Set("resource", resource)
+	}
 
-	req, err := http.NewRequest("POST", cfg.TokenEndpoint, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.TokenEndpoint, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create refresh request: %w", err)
 	}
@@ -275,12 +501,15 @@ func RefreshTokens(cfg *config.Config, refreshToken string) (*TokenResponse, err
 	}
 
 	if resp.StatusCode == http.StatusTooManyRequests {
-		return nil, fmt.Errorf("rate limit exceeded: identity provider is rate limiting requests. Please wait 1-2 minutes and try again")
+		return nil, errRateLimited
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		if strings.Contains(string(body), "Rate exceeded") {
-			return nil, fmt.Errorf("rate limit exceeded: identity provider is rate limiting requests. Please wait 1-2 minutes and try again")
+			return nil, errRateLimited
+		}
+		if isRefreshTokenRejection(body) {
+			return nil, fmt.Errorf("%w: refresh request failed with status %d: %s", ErrRefreshTokenInvalid, resp.StatusCode, string(body))
 		}
 		return nil, fmt.Errorf("refresh request failed with status %d: %s", resp.StatusCode, string(body))
 	}
@@ -0,0 +1,172 @@
+// Package auth provides authentication functionality for the OpenCode credential helper.
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// SkewWarnThreshold is the clock skew above which a warning is shown.
+	SkewWarnThreshold = 30 * time.Second
+
+	// SkewBlockThreshold is the clock skew above which we refuse to start,
+	// since the router will reject our JWTs as not-yet-valid or expired.
+	SkewBlockThreshold = 5 * time.Minute
+
+	// SkewCacheFile holds the last clock skew measurement inside the config
+	// directory
+	SkewCacheFile = "clock-skew.json"
+
+	// SkewCacheTTL is how long a measurement below SkewWarnThreshold is
+	// trusted, so launches don't wait for the IdP each time
+	SkewCacheTTL = 12 * time.Hour
+)
+
+// skewMeasurement is the content of SkewCacheFile.
+type skewMeasurement struct {
+	Endpoint   string        `json:"endpoint"`
+	Skew       time.Duration `json:"skew"`
+	MeasuredAt time.Time     `json:"measured_at"`
+}
+
+// CachedClockSkew returns the skew measured against endpoint within the
+// last SkewCacheTTL, if it was below SkewWarnThreshold. A larger skew is
+// not reused, so the next check sees a clock that was fixed.
+func CachedClockSkew(configDir, endpoint string, now time.Time) (time.Duration, bool) {
+	data, err := os.ReadFile(filepath.Join(configDir, SkewCacheFile))
+	if err != nil {
+		return 0, false
+	}
+	var m skewMeasurement
+	if json.Unmarshal(data, &m) != nil || m.Endpoint != endpoint {
+		return 0, false
+	}
+	// A clock that moved back past the measurement has changed since
+	if age := now.Sub(m.MeasuredAt); age < 0 || age > SkewCacheTTL {
+		return 0, false
+	}
+	if m.Skew > SkewWarnThreshold || m.Skew < -SkewWarnThreshold {
+		return 0, false
+	}
+	return m.Skew, true
+}
+
+// SaveClockSkew records a measurement for CachedClockSkew. Failures only
+// cost a measurement next time.
+func SaveClockSkew(configDir, endpoint string, skew time.Duration, at time.Time) {
+	data, err := json.MarshalIndent(skewMeasurement{Endpoint: endpoint, Skew: skew, MeasuredAt: at}, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(configDir, 0700)
+	os.WriteFile(filepath.Join(configDir, SkewCacheFile), data, 0600)
+}
+
+// GetIssuedAtFromIDToken extracts the iat (issued at) time from an ID token.
+func GetIssuedAtFromIDToken(idToken string) (time.Time, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("invalid ID token format")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		payload, err = base64.StdEncoding.DecodeString(addPadding(parts[1]))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to decode token payload: %w", err)
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse token claims: %w", err)
+	}
+
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("iat claim not found in token")
+	}
+
+	return time.Unix(int64(iat), 0), nil
+}
+
+// SkewFromIDToken estimates clock skew from a freshly issued ID token by
+// comparing its iat claim with the local time the token was received.
+// A positive result means the local clock is ahead of the IdP.
+func SkewFromIDToken(idToken string, receivedAt time.Time) (time.Duration, error) {
+	iat, err := GetIssuedAtFromIDToken(idToken)
+	if err != nil {
+		return 0, err
+	}
+	return receivedAt.Sub(iat), nil
+}
+
+// MeasureClockSkew estimates clock skew by comparing the Date header of a
+// response from endpoint with local time. The response status is ignored.
+// A positive result means the local clock is ahead of the server.
+func MeasureClockSkew(ctx context.Context, endpoint string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", endpoint, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create skew request: %w", err)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("skew request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	received := time.Now()
+
+	dateHeader := resp.Header.Get("Date")
+	if dateHeader == "" {
+		return 0, fmt.Errorf("no Date header in response from %s", endpoint)
+	}
+	serverTime, err := http.ParseTime(dateHeader)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Date header %q: %w", dateHeader, err)
+	}
+
+	// Compare against the midpoint of the round trip
+	local := sent.Add(received.Sub(sent) / 2)
+	return local.Sub(serverTime), nil
+}
+
+// CheckClockSkew classifies a measured skew. It returns a non-empty warning
+// above SkewWarnThreshold and an error with fix instructions above
+// SkewBlockThreshold.
+func CheckClockSkew(skew time.Duration) (warning string, err error) {
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+
+	direction := "ahead of"
+	if skew < 0 {
+		direction = "behind"
+	}
+
+	if abs > SkewBlockThreshold {
+		return "", fmt.Errorf("local clock is %s %s the identity provider (limit %s); tokens will be rejected.\n"+
+			"Sync your clock and try again:\n"+
+			"  macOS:   sudo sntp -sS time.apple.com\n"+
+			"  Linux:   sudo timedatectl set-ntp true\n"+
+			"  Windows: w32tm /resync", abs.Round(time.Second), direction, SkewBlockThreshold)
+	}
+
+	if abs > SkewWarnThreshold {
+		return fmt.Sprintf("local clock is %s %s the identity provider; authentication may fail intermittently",
+			abs.Round(time.Second), direction), nil
+	}
+
+	return "", nil
+}
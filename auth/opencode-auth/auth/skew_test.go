@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckClockSkew(t *testing.T) {
+	for _, tt := range []struct {
+		skew  time.Duration
+		warn  string // in the warning, "" for none
+		block string // in the error, "" for none
+	}{
+		{skew: 0},
+		{skew: SkewWarnThreshold},
+		{skew: -SkewWarnThreshold},
+		{skew: SkewWarnThreshold + time.Second, warn: "31s ahead of"},
+		{skew: -SkewWarnThreshold - time.Second, warn: "31s behind"},
+		{skew: SkewBlockThreshold, warn: "5m0s ahead of"},
+		{skew: -SkewBlockThreshold, warn: "5m0s behind"},
+		{skew: SkewBlockThreshold + time.Second, block: "5m1s ahead of"},
+		{skew: -SkewBlockThreshold - time.Second, block: "5m1s behind"},
+		{skew: -time.Hour, block: "1h0m0s behind"},
+	} {
+		warning, err := CheckClockSkew(tt.skew)
+		switch {
+		case tt.block != "":
+			if err == nil || !strings.Contains(err.Error(), tt.block) || warning != "" {
+				t.Errorf("CheckClockSkew(%v) = %q, %v; want an error saying %q", tt.skew, warning, err, tt.block)
+			}
+		case tt.warn != "":
+			if err != nil || !strings.Contains(warning, tt.warn) {
+				t.Errorf("CheckClockSkew(%v) = %q, %v; want a warning saying %q", tt.skew, warning, err, tt.warn)
+			}
+		default:
+			if err != nil || warning != "" {
+				t.Errorf("CheckClockSkew(%v) = %q, %v; want neither", tt.skew, warning, err)
+			}
+		}
+	}
+}
+
+func TestSkewFromIDToken(t *testing.T) {
+	issued := time.Unix(1750000000, 0)
+	token := func(payload string) string {
+		return "header." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+	}
+
+	for _, tt := range []struct {
+		name       string
+		token      string
+		receivedAt time.Time
+		want       time.Duration
+		wantErr    bool
+	}{
+		{name: "local clock ahead", token: token(`{"iat":1750000000}`), receivedAt: issued.Add(2 * time.Minute), want: 2 * time.Minute},
+		{name: "local clock behind", token: token(`{"iat":1750000000}`), receivedAt: issued.Add(-10 * time.Minute), want: -10 * time.Minute},
+		{name: "padded base64", token: "header." + base64.URLEncoding.EncodeToString([]byte(`{"iat":1750000000}`)) + ".signature", receivedAt: issued, want: 0},
+		{name: "iat missing", token: token(`{"sub":"user"}`), wantErr: true},
+		{name: "iat not a number", token: token(`{"iat":"yesterday"}`), wantErr: true},
+		{name: "payload not JSON", token: token(`iat=1750000000`), wantErr: true},
+		{name: "payload not base64", token: "header.!!!.signature", wantErr: true},
+		{name: "not a JWT", token: "opaque-token", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SkewFromIDToken(tt.token, tt.receivedAt)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("SkewFromIDToken() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("SkewFromIDToken() = %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedClockSkew(t *testing.T) {
+	measured := time.Date(2025, 6, 1, 9, 0, 0, 0, time.UTC)
+	const endpoint = "https://idp.example.com/oauth2/token"
+
+	for _, tt := range []struct {
+		name     string
+		skew     time.Duration
+		endpoint string        // asked for; defaults to the measured one
+		age      time.Duration // of the measurement when asked
+		ok       bool
+	}{
+		{name: "fresh", skew: 10 * time.Second, age: time.Hour, ok: true},
+		{name: "fresh, clock behind", skew: -10 * time.Second, age: time.Hour, ok: true},
+		{name: "at the TTL", skew: time.Second, age: SkewCacheTTL, ok: true},
+		{name: "past the TTL", skew: time.Second, age: SkewCacheTTL + time.Second},
+		{name: "clock moved back past the measurement", skew: time.Second, age: -time.Minute},
+		{name: "endpoint changed", skew: time.Second, endpoint: "https://other-idp.example.com/oauth2/token", age: time.Minute},
+		// A skew worth a warning is measured again every time
+		{name: "above the warning threshold", skew: SkewWarnThreshold + time.Second, age: time.Minute},
+		{name: "below minus the warning threshold", skew: -SkewWarnThreshold - time.Second, age: time.Minute},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			SaveClockSkew(dir, endpoint, tt.skew, measured)
+			asked := tt.endpoint
+			if asked == "" {
+				asked = endpoint
+			}
+			got, ok := CachedClockSkew(dir, asked, measured.Add(tt.age))
+			if ok != tt.ok || (ok && got != tt.skew) {
+				t.Errorf("CachedClockSkew() = %v, %v; want %v, %v", got, ok, tt.skew, tt.ok)
+			}
+		})
+	}
+
+	// No measurement, or an unreadable one, is a miss
+	dir := t.TempDir()
+	if _, ok := CachedClockSkew(dir, endpoint, measured); ok {
+		t.Error("CachedClockSkew() hit without a measurement")
+	}
+	os.WriteFile(filepath.Join(dir, SkewCacheFile), []byte("{"), 0600)
+	if _, ok := CachedClockSkew(dir, endpoint, measured); ok {
+		t.Error("CachedClockSkew() hit on a malformed file")
+	}
+}
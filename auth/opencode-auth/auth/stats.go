@@ -0,0 +1,267 @@
+// Package auth provides authentication functionality for the OpenCode credential helper.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// AuthStatsFile records token refreshes inside the config directory
+	AuthStatsFile = "auth-stats.jsonl"
+
+	// AuthStatsRetention is how long refresh records are kept
+	AuthStatsRetention = 30 * 24 * time.Hour
+)
+
+// Token refresh outcomes. Unlike the login log, refresh records keep no
+// error text, only its class.
+const (
+	RefreshSucceeded   = "success"
+	RefreshRejected    = "rejected"     // the IdP refused the refresh token
+	RefreshRateLimited = "rate_limited" // the IdP returned 429
+	RefreshNetwork     = "network"      // the IdP could not be reached
+	RefreshCancelled   = "cancelled"    // the proxy stopped mid-refresh
+	RefreshIdPError    = "idp_error"    // any other failed response
+)
+
+// RefreshStat is one token refresh against the IdP. It holds no identity or
+// token, so the file can be shared to tune refresh timing.
+type RefreshStat struct {
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	// LatencyMS is how long the IdP took to answer
+	LatencyMS int64 `json:"latency_ms"`
+	// RemainingS is how long the old ID token had left when it was refreshed
+	RemainingS int64 `json:"remaining_s"`
+	// LifetimeS is the lifetime of the new ID token (successes only)
+	LifetimeS int64 `json:"lifetime_s,omitempty"`
+	// ThresholdS is the refresh threshold in effect
+	ThresholdS int64 `json:"threshold_s"`
+}
+
+// RefreshOutcome classifies the error a token refresh ended with.
+func RefreshOutcome(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return RefreshSucceeded
+	case errors.Is(err, ErrRefreshTokenInvalid):
+		return RefreshRejected
+	case errors.Is(err, ErrRateLimited):
+		return RefreshRateLimited
+	case errors.Is(err, context.Canceled):
+		return RefreshCancelled
+	case errors.As(err, &netErr):
+		return RefreshNetwork
+	default:
+		return RefreshIdPError
+	}
+}
+
+// AuthStatsPath returns the refresh record file for the given config directory.
+func AuthStatsPath(configDir string) string {
+	return filepath.Join(configDir, AuthStatsFile)
+}
+
+// RecordRefresh appends s to the file at path. Records older than
+// AuthStatsRetention are dropped once a day's worth has piled up.
+func RecordRefresh(path string, s RefreshStat) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("writing auth stats: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("writing auth stats: %w", err)
+	}
+
+	if first, ok := firstRefreshStat(path); ok && s.Time.Sub(first.Time) > AuthStatsRetention+24*time.Hour {
+		return compactRefreshStats(path, s.Time.Add(-AuthStatsRetention))
+	}
+	return nil
+}
+
+// LoadRefreshStats returns the records at path since the given time, oldest
+// first. A missing file yields no records; malformed lines are skipped.
+func LoadRefreshStats(path string, since time.Time) ([]RefreshStat, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening auth stats: %w", err)
+	}
+	defer f.Close()
+
+	var stats []RefreshStat
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s RefreshStat
+		if json.Unmarshal(scanner.Bytes(), &s) == nil && !s.Time.Before(since) {
+			stats = append(stats, s)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// firstRefreshStat returns the oldest record at path.
+func firstRefreshStat(path string) (RefreshStat, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return RefreshStat{}, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var s RefreshStat
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &s) != nil {
+		return RefreshStat{}, false
+	}
+	return s, true
+}
+
+// compactRefreshStats rewrites path without the records before since.
+func compactRefreshStats(path string, since time.Time) error {
+	stats, err := LoadRefreshStats(path, since)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, s := range stats {
+		line, _ := json.Marshal(s)
+		data = append(append(data, line...), '\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), AuthStatsFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("compacting auth stats: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("compacting auth stats: %w", err)
+	}
+	return nil
+}
+
+// Distribution summarizes a set of durations.
+type Distribution struct {
+	Count int
+	Min   time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	Max   time.Duration
+}
+
+// MarshalJSON writes the durations in milliseconds, for aggregating reports
+// from many machines.
+func (d Distribution) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int64{
+		"count":  int64(d.Count),
+		"min_ms": d.Min.Milliseconds(),
+		"p50_ms": d.P50.Milliseconds(),
+		"p95_ms": d.P95.Milliseconds(),
+		"max_ms": d.Max.Milliseconds(),
+	})
+}
+
+// NewDistribution summarizes values; it is zero when values is empty.
+func NewDistribution(values []time.Duration) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1)+0.5)]
+	}
+	return Distribution{Count: len(sorted), Min: sorted[0], P50: at(0.5), P95: at(0.95), Max: sorted[len(sorted)-1]}
+}
+
+// AuthReport summarizes refreshes and logins over a period.
+type AuthReport struct {
+	Since     time.Time      `json:"since"`
+	Refreshes int            `json:"refreshes"`
+	Outcomes  map[string]int `json:"refresh_outcomes"`
+	// ErrorRate is the share of refreshes the IdP failed, ignoring cancelled ones
+	ErrorRate float64      `json:"refresh_error_rate"`
+	Latency   Distribution `json:"refresh_latency"`
+	Lifetime  Distribution `json:"token_lifetime"`
+	Remaining Distribution `json:"remaining_at_refresh"`
+	// Late counts refreshes that started with less than 5 minutes left
+	Late     int            `json:"late_refreshes"`
+	Logins   int            `json:"logins"`
+	LoginsBy map[string]int `json:"login_outcomes"`
+	// ThresholdS is the newest refresh threshold in effect, in seconds
+	ThresholdS int64 `json:"threshold_s"`
+}
+
+// lateRefresh is how little token lifetime left makes a refresh late.
+const lateRefresh = 5 * time.Minute
+
+// NewAuthReport summarizes refresh records and login attempts since the
+// given time.
+func NewAuthReport(stats []RefreshStat, logins []LoginAttempt, since time.Time) AuthReport {
+	rep := AuthReport{Since: since, Outcomes: map[string]int{}, LoginsBy: map[string]int{}}
+	var latency, lifetime, remaining []time.Duration
+	failed, attempted := 0, 0
+	for _, s := range stats {
+		if s.Time.Before(since) {
+			continue
+		}
+		rep.Refreshes++
+		rep.Outcomes[s.Outcome]++
+		rep.ThresholdS = s.ThresholdS
+		if s.Outcome == RefreshCancelled {
+			continue
+		}
+		attempted++
+		latency = append(latency, time.Duration(s.LatencyMS)*time.Millisecond)
+		if s.Outcome != RefreshSucceeded {
+			failed++
+			continue
+		}
+		lifetime = append(lifetime, time.Duration(s.LifetimeS)*time.Second)
+		left := time.Duration(s.RemainingS) * time.Second
+		remaining = append(remaining, left)
+		if left < lateRefresh {
+			rep.Late++
+		}
+	}
+	if attempted > 0 {
+		rep.ErrorRate = float64(failed) / float64(attempted)
+	}
+	rep.Latency = NewDistribution(latency)
+	rep.Lifetime = NewDistribution(lifetime)
+	rep.Remaining = NewDistribution(remaining)
+
+	for _, a := range logins {
+		if a.Time.Before(since) {
+			continue
+		}
+		rep.Logins++
+		rep.LoginsBy[a.Outcome]++
+	}
+	return rep
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordRefresh_Compaction(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	for _, tt := range []struct {
+		name string
+		ages []time.Duration // of the records already in the file, oldest first
+		want int             // records left after recording one more now
+	}{
+		{name: "empty file", want: 1},
+		{name: "within retention", ages: []time.Duration{10 * day, day}, want: 3},
+		// Old records are only dropped once a day's worth has piled up
+		{name: "less than a day past retention", ages: []time.Duration{30*day + 12*time.Hour, day}, want: 3},
+		{name: "more than a day past retention", ages: []time.Duration{32 * day, 31 * day, 29 * day}, want: 2},
+		{name: "all but the new one expired", ages: []time.Duration{40 * day, 35 * day}, want: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := AuthStatsPath(filepath.Join(t.TempDir(), "config"))
+			for _, age := range tt.ages {
+				if err := RecordRefresh(path, RefreshStat{Time: now.Add(-age), Outcome: RefreshSucceeded}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := RecordRefresh(path, RefreshStat{Time: now, Outcome: RefreshSucceeded}); err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := LoadRefreshStats(path, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != tt.want {
+				t.Fatalf("%d records left, want %d", len(stats), tt.want)
+			}
+			if !stats[len(stats)-1].Time.Equal(now) {
+				t.Errorf("newest record = %v, want %v", stats[len(stats)-1].Time, now)
+			}
+		})
+	}
+}
+
+func TestNewDistribution(t *testing.T) {
+	ms := func(values ...int) []time.Duration {
+		d := make([]time.Duration, len(values))
+		for i, v := range values {
+			d[i] = time.Duration(v) * time.Millisecond
+		}
+		return d
+	}
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = 100 - i // unsorted
+	}
+
+	for _, tt := range []struct {
+		name   string
+		values []time.Duration
+		want   Distribution
+	}{
+		{name: "empty", want: Distribution{}},
+		{name: "one sample", values: ms(250), want: Distribution{Count: 1, Min: 250 * time.Millisecond, P50: 250 * time.Millisecond, P95: 250 * time.Millisecond, Max: 250 * time.Millisecond}},
+		{name: "two samples", values: ms(300, 100), want: Distribution{Count: 2, Min: 100 * time.Millisecond, P50: 300 * time.Millisecond, P95: 300 * time.Millisecond, Max: 300 * time.Millisecond}},
+		{name: "odd count", values: ms(5, 1, 3), want: Distribution{Count: 3, Min: time.Millisecond, P50: 3 * time.Millisecond, P95: 5 * time.Millisecond, Max: 5 * time.Millisecond}},
+		{name: "hundred samples", values: ms(hundred...), want: Distribution{Count: 100, Min: time.Millisecond, P50: 51 * time.Millisecond, P95: 95 * time.Millisecond, Max: 100 * time.Millisecond}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in := append([]time.Duration(nil), tt.values...)
+			if got := NewDistribution(tt.values); got != tt.want {
+				t.Errorf("NewDistribution() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(in, tt.values) {
+				t.Error("NewDistribution() reordered its input")
+			}
+		})
+	}
+}
+
+func TestNewAuthReport(t *testing.T) {
+	since := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := since.Add(time.Hour)
+	refresh := func(outcome string, remaining time.Duration) RefreshStat {
+		return RefreshStat{Time: at, Outcome: outcome, LatencyMS: 200, RemainingS: int64(remaining / time.Second), LifetimeS: 3600, ThresholdS: 3000}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		stats     []RefreshStat
+		attempts  []LoginAttempt
+		refreshes int
+		errorRate float64
+		late      int
+		latencies int // refreshes with a latency
+		successes int // refreshes with a lifetime and time remaining
+		loginsBy  map[string]int
+	}{
+		{name: "nothing recorded", loginsBy: map[string]int{}},
+		{
+			name:      "all succeeded",
+			stats:     []RefreshStat{refresh(RefreshSucceeded, 50*time.Minute), refresh(RefreshSucceeded, 45*time.Minute)},
+			refreshes: 2, latencies: 2, successes: 2,
+			loginsBy: map[string]int{},
+		},
+		{
+			// Cancelled refreshes count as refreshes but not as attempts
+			name:      "cancelled ignored in the error rate",
+			stats:     []RefreshStat{refresh(RefreshSucceeded, 50*time.Minute), refresh(RefreshRejected, 50*time.Minute), refresh(RefreshCancelled, 50*time.Minute)},
+			refreshes: 3, errorRate: 0.5, latencies: 2, successes: 1,
+			loginsBy: map[string]int{},
+		},
+		{
+			name:      "only failures",
+			stats:     []RefreshStat{refresh(RefreshNetwork, time.Minute), refresh(RefreshRateLimited, time.Minute)},
+			refreshes: 2, errorRate: 1, latencies: 2,
+			loginsBy: map[string]int{},
+		},
+		{
+			// Only successful refreshes with under 5 minutes left are late
+			name:      "late refreshes",
+			stats:     []RefreshStat{refresh(RefreshSucceeded, 4*time.Minute), refresh(RefreshSucceeded, 5*time.Minute), refresh(RefreshSucceeded, 0), refresh(RefreshIdPError, time.Minute)},
+			refreshes: 4, errorRate: 0.25, late: 2, latencies: 4, successes: 3,
+			loginsBy: map[string]int{},
+		},
+		{
+			name:      "records and logins before since are left out",
+			stats:     []RefreshStat{{Time: since.Add(-time.Minute), Outcome: RefreshRejected}, refresh(RefreshSucceeded, time.Minute)},
+			attempts:  []LoginAttempt{{Time: since.Add(-time.Minute), Outcome: LoginFailed}, {Time: at, Outcome: LoginSucceeded}, {Time: at, Outcome: LoginCancelled}, {Time: at, Outcome: LoginSucceeded}},
+			refreshes: 1, late: 1, latencies: 1, successes: 1,
+			loginsBy: map[string]int{LoginSucceeded: 2, LoginCancelled: 1},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rep := NewAuthReport(tt.stats, tt.attempts, since)
+			if rep.Refreshes != tt.refreshes || rep.ErrorRate != tt.errorRate || rep.Late != tt.late {
+				t.Errorf("refreshes %d, error rate %v, late %d; want %d, %v, %d", rep.Refreshes, rep.ErrorRate, rep.Late, tt.refreshes, tt.errorRate, tt.late)
+			}
+			if rep.Latency.Count != tt.latencies || rep.Remaining.Count != tt.successes || rep.Lifetime.Count != tt.successes {
+				t.Errorf("latency %d, remaining %d, lifetime %d samples; want %d, %d, %d",
+					rep.Latency.Count, rep.Remaining.Count, rep.Lifetime.Count, tt.latencies, tt.successes, tt.successes)
+			}
+			logins := 0
+			for _, n := range tt.loginsBy {
+				logins += n
+			}
+			if rep.Logins != logins || !reflect.DeepEqual(rep.LoginsBy, tt.loginsBy) {
+				t.Errorf("logins %d %v, want %v", rep.Logins, rep.LoginsBy, tt.loginsBy)
+			}
+			// The threshold is the newest record's since the given time
+			wantThreshold := int64(0)
+			if tt.refreshes > 0 {
+				wantThreshold = 3000
+			}
+			if rep.ThresholdS != wantThreshold {
+				t.Errorf("threshold = %d, want %d", rep.ThresholdS, wantThreshold)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TokenStore keeps the tokens somewhere other than the tokens file, for
+// token_storage "memory". See UseTokenStore.
+type TokenStore interface {
+	// Load returns the tokens, or an error wrapping ErrNotLoggedIn
+	Load() (*TokenData, error)
+	Save(tokens *TokenData) error
+	Delete() error
+}
+
+var (
+	storeMu sync.Mutex
+	store   TokenStore
+)
+
+// UseTokenStore makes LoadTokens, SaveTokens, UpdateTokens and DeleteTokens
+// use s instead of the file at the path they are given. nil goes back to
+// the file.
+func UseTokenStore(s TokenStore) {
+	storeMu.Lock()
+	store = s
+	storeMu.Unlock()
+}
+
+// currentStore returns the store in use, or nil for the tokens file.
+func currentStore() TokenStore {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return store
+}
+
+// TokensInMemory reports whether a TokenStore replaces the tokens file.
+func TokensInMemory() bool {
+	return currentStore() != nil
+}
+
+// TokensModTime returns when the tokens were last saved.
+func TokensModTime(path string) (time.Time, error) {
+	if s, ok := currentStore().(*MemoryTokens); ok {
+		return s.modTime()
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// MemoryTokens keeps the tokens in this process's memory only, so they are
+// never written to disk and are gone when the process exits. The proxy
+// uses it and serves the tokens to other processes.
+type MemoryTokens struct {
+	mu      sync.Mutex
+	tokens  *TokenData
+	savedAt time.Time
+}
+
+func (m *MemoryTokens) Load() (*TokenData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		return nil, fmt.Errorf("%w: tokens are kept in memory and none have been saved", ErrNotLoggedIn)
+	}
+	return m.tokens.clone(), nil
+}
+
+func (m *MemoryTokens) Save(tokens *TokenData) error {
+	if tokens.SchemaVersion < TokenSchemaVersion {
+		tokens.SchemaVersion = TokenSchemaVersion
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens, m.savedAt = tokens.clone(), time.Now()
+	return nil
+}
+
+func (m *MemoryTokens) Delete() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens, m.savedAt = nil, time.Now()
+	return nil
+}
+
+func (m *MemoryTokens) modTime() (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		return time.Time{}, os.ErrNotExist
+	}
+	return m.savedAt, nil
+}
+
+// clone copies t, so callers can change what they load or save without
+// changing the stored tokens.
+func (t *TokenData) clone() *TokenData {
+	c := *t
+	if t.AudienceTokens != nil {
+		c.AudienceTokens = make(map[string]AudienceToken, len(t.AudienceTokens))
+		for resource, at := range t.AudienceTokens {
+			c.AudienceTokens[resource] = at
+		}
+	}
+	return &c
+}
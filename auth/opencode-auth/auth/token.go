@@ -4,20 +4,48 @@ package auth
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// TokenSchemaVersion is the tokens.json schema this build writes. Files
+// without schema_version are version 0.
+const TokenSchemaVersion = 1
+
+// tokenUpgrades convert a decoded tokens.json object from schema version i to
+// i+1, so tokenUpgrades[TokenSchemaVersion-1] produces the current schema.
+var tokenUpgrades = []func(obj map[string]json.RawMessage) error{
+	// 0 -> 1: schema_version was added; the layout is unchanged
+	func(obj map[string]json.RawMessage) error { return nil },
+}
+
 // TokenData represents the stored OAuth tokens.
+//
+// Files written by newer versions may use a higher schema version and carry
+// fields this build doesn't know. Those fields are kept in memory and written
+// back on save, so an older proxy refreshing the token during a rolling
+// upgrade doesn't strip data the newer version depends on.
 type TokenData struct {
-	IDToken      string    `json:"id_token"`
-	AccessToken  string    `json:"access_token"`
-	RefreshToken string    `json:"refresh_token"`
-	ExpiresAt    time.Time `json:"expires_at"`
-	Email        string    `json:"email"`
+	SchemaVersion int       `json:"schema_version"`
+	IDToken       string    `json:"id_token"`
+	AccessToken   string    `json:"access_token"`
+	RefreshToken  string    `json:"refresh_token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Email         string    `json:"email"`
+
+	// AudienceTokens holds access tokens issued for specific RFC 8707
+	// resource indicators, keyed by resource.
+	AudienceTokens map[string]AudienceToken `json:"audience_tokens,omitempty"`
+
+	// unknown holds fields from newer schema versions, keyed by JSON name
+	unknown map[string]json.RawMessage
 }
 
 // TokenResponse represents the response from the token endpoint.
@@ -29,9 +57,16 @@ type TokenResponse struct {
 	TokenType    string `json:"token_type"`
 }
 
-// LoadTokens loads tokens from the specified file path.
+// LoadTokens loads tokens from the specified file path, or from the
+// TokenStore in use.
 func LoadTokens(path string) (*TokenData, error) {
+	if s := currentStore(); s != nil {
+		return s.Load()
+	}
 	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %w", ErrNotLoggedIn, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read tokens file: %w", err)
 	}
@@ -52,31 +87,127 @@ type FileLock struct {
 
 // acquireFileLock and releaseFileLock are implemented in lock_unix.go and lock_windows.go
 
+// TokenLockTimeout bounds how long SaveTokens and UpdateTokens wait for
+// another writer, in this or another process, to release the token lock.
+var TokenLockTimeout = 10 * time.Second
+
+// ErrLockTimeout is returned when the token lock is not released within
+// TokenLockTimeout.
+var ErrLockTimeout = errors.New("timed out waiting for token lock")
+
+var (
+	// ErrNotLoggedIn is returned by LoadTokens when no tokens have been saved.
+	ErrNotLoggedIn = errors.New("not logged in")
+	// ErrTokenExpired is returned for saved tokens that have expired and
+	// cannot be used until they are refreshed.
+	ErrTokenExpired = errors.New("token expired")
+)
+
 // SaveTokens saves tokens to the specified file path with secure permissions.
 // Uses file locking and atomic write (write to temp file, then rename) to prevent race conditions.
 func SaveTokens(path string, tokens *TokenData) error {
+	if s := currentStore(); s != nil {
+		storeWriters.Lock()
+		defer storeWriters.Unlock()
+		return s.Save(tokens)
+	}
+	unlock, err := lockTokens(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeTokens(path, tokens)
+}
+
+// UpdateTokens applies update to the tokens currently on disk and saves the
+// result, holding the token lock throughout. Use it instead of LoadTokens
+// followed by SaveTokens when only some fields change, so a refresh token
+// rotated by another writer in between is not overwritten with a stale one.
+// If update returns an error, the file is left unchanged.
+func UpdateTokens(path string, update func(tokens *TokenData) error) error {
+	if s := currentStore(); s != nil {
+		storeWriters.Lock()
+		defer storeWriters.Unlock()
+		tokens, err := s.Load()
+		if err != nil {
+			return err
+		}
+		if err := update(tokens); err != nil {
+			return err
+		}
+		return s.Save(tokens)
+	}
+	unlock, err := lockTokens(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		return err
+	}
+	if err := update(tokens); err != nil {
+		return err
+	}
+	return writeTokens(path, tokens)
+}
+
+// storeWriters serializes the writers of a TokenStore in this process, as
+// the token lock does for the file.
+var storeWriters sync.Mutex
+
+// tokenWriters holds a one-slot semaphore per token path. Writers in this
+// process queue on it before polling the file lock, which on its own would
+// let a busy writer starve the others.
+var tokenWriters sync.Map // path -> chan struct{}
+
+// lockTokens takes the locks that serialize writers of the tokens file and
+// returns the function that releases them.
+func lockTokens(path string) (func(), error) {
 	// Ensure directory exists
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	deadline := time.Now().Add(TokenLockTimeout)
+	sem, _ := tokenWriters.LoadOrStore(path, make(chan struct{}, 1))
+	timer := time.NewTimer(TokenLockTimeout)
+	defer timer.Stop()
+	select {
+	case sem.(chan struct{}) <- struct{}{}:
+	case <-timer.C:
+		return nil, fmt.Errorf("failed to acquire token lock: %w", ErrLockTimeout)
 	}
 
-	// Acquire file lock
-	lockPath := path + ".lock"
-	lock, err := acquireFileLock(lockPath)
+	lock, err := acquireFileLock(path+".lock", time.Until(deadline))
 	if err != nil {
-		return fmt.Errorf("failed to acquire token lock: %w", err)
+		<-sem.(chan struct{})
+		return nil, fmt.Errorf("failed to acquire token lock: %w", err)
+	}
+	return func() {
+		releaseFileLock(lock)
+		<-sem.(chan struct{})
+	}, nil
+}
+
+// writeTokens writes tokens to path. Callers hold the token lock.
+func writeTokens(path string, tokens *TokenData) error {
+	if tokens.SchemaVersion < TokenSchemaVersion {
+		tokens.SchemaVersion = TokenSchemaVersion
 	}
-	defer releaseFileLock(lock)
 
 	data, err := json.MarshalIndent(tokens, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal tokens: %w", err)
 	}
 
-	// Write to temporary file first (atomic write pattern)
+	// Write to temporary file first (atomic write pattern). The data is
+	// synced before the rename so a crash can't leave an empty tokens file.
 	tmpPath := path + ".tmp"
-	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+	if err := writeFileSync(tmpPath, data, 0600); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to write temp tokens file: %w", err)
 	}
 
@@ -86,11 +217,121 @@ func SaveTokens(path string, tokens *TokenData) error {
 		return fmt.Errorf("failed to rename tokens file: %w", err)
 	}
 
+	// Persist the rename itself; the new file is already in place for readers
+	_ = syncDir(filepath.Dir(path))
+
 	return nil
 }
 
-// DeleteTokens removes the tokens file.
+// writeFileSync is os.WriteFile followed by an fsync.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// tokenFields is the TokenData type without its JSON methods.
+type tokenFields TokenData
+
+// UnmarshalJSON decodes tokens.json, upgrading older schema versions and
+// keeping fields it doesn't know.
+func (t *TokenData) UnmarshalJSON(data []byte) error {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	var version int
+	if raw, ok := obj["schema_version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return fmt.Errorf("invalid schema_version: %w", err)
+		}
+	}
+	for v := version; v < TokenSchemaVersion; v++ {
+		if err := tokenUpgrades[v](obj); err != nil {
+			return fmt.Errorf("upgrading tokens from schema version %d: %w", v, err)
+		}
+	}
+	if version < TokenSchemaVersion {
+		version = TokenSchemaVersion
+		obj["schema_version"] = json.RawMessage(strconv.Itoa(version))
+	}
+
+	upgraded, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	var fields tokenFields
+	if err := json.Unmarshal(upgraded, &fields); err != nil {
+		return err
+	}
+	*t = TokenData(fields)
+
+	for _, name := range knownTokenFields() {
+		delete(obj, name)
+	}
+	if len(obj) > 0 {
+		t.unknown = obj
+	}
+	return nil
+}
+
+// MarshalJSON encodes the tokens along with any fields from a newer schema.
+func (t TokenData) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(tokenFields(t))
+	if err != nil || len(t.unknown) == 0 {
+		return data, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	for name, raw := range t.unknown {
+		if _, known := obj[name]; !known {
+			obj[name] = raw
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// PreserveUnknown carries fields from a newer schema over from prev, the
+// tokens being replaced, so a refresh by this version keeps them.
+func (t *TokenData) PreserveUnknown(prev *TokenData) {
+	if prev == nil || len(prev.unknown) == 0 {
+		return
+	}
+	t.unknown = prev.unknown
+	if prev.SchemaVersion > t.SchemaVersion {
+		t.SchemaVersion = prev.SchemaVersion
+	}
+}
+
+// knownTokenFields returns the JSON names of TokenData's fields.
+func knownTokenFields() []string {
+	typ := reflect.TypeOf(tokenFields{})
+	names := make([]string, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		if name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ","); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// DeleteTokens removes the tokens file, or the tokens in the TokenStore in
+// use.
 func DeleteTokens(path string) error {
+	if s := currentStore(); s != nil {
+		return s.Delete()
+	}
 	err := os.Remove(path)
 	if os.IsNotExist(err) {
 		return nil // Already deleted
@@ -109,6 +350,52 @@ func (t *TokenData) IsExpiringSoon(within time.Duration) bool {
 	return time.Now().Add(within).After(t.ExpiresAt)
 }
 
+// BearerToken returns the token sent as the Authorization bearer: the ID
+// token when the provider issued one, otherwise the access token. Plain OAuth
+// providers (no OIDC) only issue access tokens.
+func (t *TokenData) BearerToken() string {
+	if t.IDToken != "" {
+		return t.IDToken
+	}
+	return t.AccessToken
+}
+
+// defaultTokenLifetime is assumed when a token response carries neither a
+// JWT exp claim nor expires_in.
+const defaultTokenLifetime = time.Hour
+
+// ExpiresAt determines when the tokens in the response expire. The ID token's
+// exp claim is preferred, then expires_in, then the exp claim of a JWT access
+// token.
+func (r *TokenResponse) ExpiresAt(now time.Time) time.Time {
+	if r.IDToken != "" {
+		if exp, err := GetExpiryFromIDToken(r.IDToken); err == nil {
+			return exp
+		}
+	}
+	if r.ExpiresIn > 0 {
+		return now.Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	if exp, err := GetExpiryFromIDToken(r.AccessToken); err == nil {
+		return exp
+	}
+	return now.Add(defaultTokenLifetime)
+}
+
+// Email returns the email claim from the ID token, or from a JWT access token
+// when there is no ID token. Returns "unknown" when neither carries one.
+func (r *TokenResponse) Email() string {
+	for _, token := range []string{r.IDToken, r.AccessToken} {
+		if token == "" {
+			continue
+		}
+		if email, err := ExtractEmailFromIDToken(token); err == nil {
+			return email
+		}
+	}
+	return "unknown"
+}
+
 // ExtractEmailFromIDToken extracts the email claim from an ID token.
 func ExtractEmailFromIDToken(idToken string) (string, error) {
 	parts := strings.Split(idToken, ".")
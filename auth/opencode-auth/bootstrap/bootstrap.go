@@ -0,0 +1,248 @@
+// Package bootstrap fetches and verifies the signed onboarding config that
+// 'opencode-auth init --from' and 'profile import' install: the IdP client
+// ID and issuer, the API endpoints, policies, and the model catalog.
+// Administrators publish it once, so new users don't copy IDs by hand. A
+// document with a profile name is an org profile a team lead can share.
+package bootstrap
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is the bootstrap format this client understands.
+const Version = 1
+
+// maxSize bounds the document fetched from the bootstrap URL
+const maxSize = 1 << 20
+
+// ErrSignature means no trusted key signed the document.
+var ErrSignature = errors.New("bootstrap config signature does not verify with a trusted key")
+
+// credentialKeys may not be distributed in a bootstrap config: a document
+// every new user downloads must not carry anyone's credentials.
+var credentialKeys = map[string]bool{
+	"api_key":     true,
+	"api_key_ref": true,
+	"api_key_cmd": true,
+}
+
+// profileName is the syntax of Config.Profile, as for workspaces.
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Envelope is the document served at the bootstrap URL. The payload is
+// signed as the exact bytes it decodes to, so no JSON canonicalization is
+// needed to verify it.
+type Envelope struct {
+	// Payload is the base64-encoded Config JSON
+	Payload string `json:"payload"`
+	// Signature is the base64-encoded Ed25519 signature of the payload bytes
+	Signature string `json:"signature"`
+}
+
+// Config is the signed content of a bootstrap document.
+type Config struct {
+	Version   int        `json:"version"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Profile names an org profile, e.g. "team-x", which config patches can
+	// target; required by 'profile import'
+	Profile     string `json:"profile,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Config holds config.json keys, e.g. client_id, issuer, api_endpoint,
+	// alternate_endpoints and version_check_url
+	Config map[string]interface{} `json:"config"`
+
+	// Models is the model catalog for opencode.json, keyed by model ID as in
+	// provider.<provider>.models
+	Models map[string]interface{} `json:"models,omitempty"`
+	// DefaultModel is the model ID opencode selects, one of Models
+	DefaultModel string `json:"default_model,omitempty"`
+	// Provider is the opencode provider the models belong to
+	Provider string `json:"provider,omitempty"`
+}
+
+// ParseKey decodes a base64 (standard or URL) Ed25519 public key.
+func ParseKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	var raw []byte
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if raw, err = enc.DecodeString(s); err == nil {
+			break
+		}
+	}
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid bootstrap key %q: want a base64 Ed25519 public key", s)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// GenerateKey returns a new signing key pair, base64-encoded.
+func GenerateKey() (publicKey, privateKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+// Sign validates c and wraps it in a signed envelope. privateKey is the
+// base64 key from GenerateKey.
+func Sign(c *Config, privateKey string) (*Envelope, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid signing key: want a base64 Ed25519 private key")
+	}
+	if c.Version == 0 {
+		c.Version = Version
+	}
+	if c.IssuedAt.IsZero() {
+		c.IssuedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	if err := c.validate(c.IssuedAt); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(raw), payload)),
+	}, nil
+}
+
+// Verify checks the signature against keys and returns the validated
+// config.
+func (e *Envelope) Verify(keys []ed25519.PublicKey, now time.Time) (*Config, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted bootstrap key; pass the key your administrator published with --key")
+	}
+	payload, err := base64.StdEncoding.DecodeString(e.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap payload: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap signature: %w", err)
+	}
+	verified := false
+	for _, key := range keys {
+		verified = verified || ed25519.Verify(key, payload, sig)
+	}
+	if !verified {
+		return nil, ErrSignature
+	}
+
+	var c Config
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("invalid bootstrap config: %w", err)
+	}
+	if err := c.validate(now); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// validate checks what a signature cannot: the format version, expiry, the
+// settings a working install needs, and that no credentials are included.
+func (c *Config) validate(now time.Time) error {
+	if c.Version != Version {
+		return fmt.Errorf("bootstrap config version %d is not supported (want %d); update opencode-auth", c.Version, Version)
+	}
+	if c.ExpiresAt != nil && now.After(*c.ExpiresAt) {
+		return fmt.Errorf("bootstrap config expired at %s; ask your administrator to republish it", c.ExpiresAt.Format(time.RFC3339))
+	}
+	for _, key := range []string{"client_id", "api_endpoint"} {
+		if s, _ := c.Config[key].(string); s == "" {
+			return fmt.Errorf("bootstrap config has no %s", key)
+		}
+	}
+	if c.Profile != "" && !profileName.MatchString(c.Profile) {
+		return fmt.Errorf("profile %q must be 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit", c.Profile)
+	}
+	if _, ok := c.Config["profile"]; ok {
+		return fmt.Errorf("bootstrap config may not set profile in config; use the profile field")
+	}
+	var creds []string
+	for key := range c.Config {
+		if credentialKeys[key] {
+			creds = append(creds, key)
+		}
+	}
+	if len(creds) > 0 {
+		sort.Strings(creds)
+		return fmt.Errorf("bootstrap config may not contain credentials (%s)", strings.Join(creds, ", "))
+	}
+	if c.DefaultModel != "" {
+		if _, ok := c.Models[c.DefaultModel]; !ok {
+			return fmt.Errorf("default_model %q is not in models", c.DefaultModel)
+		}
+	}
+	return nil
+}
+
+// CheckURL accepts https URLs, and http ones on a loopback address for
+// testing.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid bootstrap URL: %w", err)
+	}
+	switch {
+	case u.Scheme == "https" && u.Host != "":
+		return nil
+	case u.Scheme == "http" && (u.Hostname() == "localhost" || net.ParseIP(u.Hostname()).IsLoopback()):
+		return nil
+	}
+	return fmt.Errorf("bootstrap URL %q must use https", rawURL)
+}
+
+// Fetch downloads the envelope at rawURL.
+func Fetch(ctx context.Context, rawURL string) (*Envelope, error) {
+	if err := CheckURL(rawURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching bootstrap config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching bootstrap config: %s returned %s", rawURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching bootstrap config: %w", err)
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("bootstrap config is larger than %d bytes", maxSize)
+	}
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil || e.Payload == "" || e.Signature == "" {
+		return nil, fmt.Errorf("%s is not a signed bootstrap config", rawURL)
+	}
+	return &e, nil
+}
@@ -0,0 +1,167 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Config: map[string]interface{}{
+			"client_id":    "abc123",
+			"issuer":       "https://idp.example.com",
+			"api_endpoint": "https://oc.example.com/v1",
+		},
+		Models:       map[string]interface{}{"claude-sonnet": map[string]interface{}{"name": "Claude Sonnet"}},
+		DefaultModel: "claude-sonnet",
+	}
+}
+
+func testKeys(t *testing.T) (ed25519.PublicKey, string) {
+	t.Helper()
+	pub, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, priv
+}
+
+func TestSignVerify(t *testing.T) {
+	key, priv := testKeys(t)
+	e, err := Sign(testConfig(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := e.Verify([]ed25519.PublicKey{key}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != Version || c.IssuedAt.IsZero() || c.Config["client_id"] != "abc123" || c.DefaultModel != "claude-sonnet" {
+		t.Errorf("verified config = %+v", c)
+	}
+
+	other, _ := testKeys(t)
+	if _, err := e.Verify([]ed25519.PublicKey{other}, time.Now()); !errors.Is(err, ErrSignature) {
+		t.Errorf("Verify() with another key = %v, want ErrSignature", err)
+	}
+	if _, err := e.Verify([]ed25519.PublicKey{other, key}, time.Now()); err != nil {
+		t.Errorf("Verify() with the key second = %v", err)
+	}
+	if _, err := e.Verify(nil, time.Now()); err == nil {
+		t.Error("Verify() without keys succeeded")
+	}
+
+	// Changing the payload breaks the signature
+	tampered := *e
+	tampered.Payload = strings.Replace(e.Payload, e.Payload[10:14], "AAAA", 1)
+	if _, err := tampered.Verify([]ed25519.PublicKey{key}, time.Now()); err == nil {
+		t.Error("tampered payload verified")
+	}
+}
+
+func TestSign_Invalid(t *testing.T) {
+	_, priv := testKeys(t)
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"no client id", func(c *Config) { delete(c.Config, "client_id") }, "client_id"},
+		{"no endpoint", func(c *Config) { c.Config["api_endpoint"] = "" }, "api_endpoint"},
+		{"credentials", func(c *Config) { c.Config["api_key"] = "oc_secret" }, "credentials (api_key)"},
+		{"unknown default", func(c *Config) { c.DefaultModel = "gpt" }, "not in models"},
+		{"future version", func(c *Config) { c.Version = Version + 1 }, "not supported"},
+		{"bad profile", func(c *Config) { c.Profile = "team x" }, "profile \"team x\""},
+		{"profile in config", func(c *Config) { c.Config["profile"] = "team-x" }, "use the profile field"},
+	}
+	for _, tt := range tests {
+		c := testConfig()
+		tt.modify(c)
+		if _, err := Sign(c, priv); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Sign() = %v, want error containing %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := Sign(testConfig(), "not-a-key"); err == nil {
+		t.Error("Sign() accepted an invalid key")
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	key, priv := testKeys(t)
+	c := testConfig()
+	expires := time.Now().Add(time.Hour)
+	c.ExpiresAt = &expires
+	e, err := Sign(c, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Verify([]ed25519.PublicKey{key}, time.Now()); err != nil {
+		t.Errorf("Verify() before expiry = %v", err)
+	}
+	if _, err := e.Verify([]ed25519.PublicKey{key}, time.Now().Add(2*time.Hour)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Verify() after expiry = %v", err)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://config.corp.example/opencode.json", true},
+		{"http://127.0.0.1:8080/bootstrap.json", true},
+		{"http://localhost/bootstrap.json", true},
+		{"http://config.corp.example/opencode.json", false},
+		{"file:///etc/passwd", false},
+		{"https:///opencode.json", false},
+	}
+	for _, tt := range tests {
+		if err := CheckURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("CheckURL(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	key, priv := testKeys(t)
+	e, err := Sign(testConfig(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bootstrap.json":
+			json.NewEncoder(w).Encode(e)
+		case "/plain.json":
+			w.Write([]byte(`{"client_id":"abc123"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	got, err := Fetch(context.Background(), server.URL+"/bootstrap.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := got.Verify([]ed25519.PublicKey{key}, time.Now()); err != nil {
+		t.Errorf("fetched envelope does not verify: %v", err)
+	}
+	if _, err := Fetch(context.Background(), server.URL+"/plain.json"); err == nil || !strings.Contains(err.Error(), "not a signed") {
+		t.Errorf("Fetch() of an unsigned config = %v", err)
+	}
+	if _, err := Fetch(context.Background(), server.URL+"/missing.json"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Fetch() of a missing file = %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+// Package bundle builds the support bundle: a zip of logs, config, proxy
+// health, refresh history, and system details that users attach to a
+// support ticket. Everything is redacted before it is shown or written, and
+// the user reviews the contents first.
+package bundle
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxLogBytes is how much of the end of each log file goes into the bundle.
+const MaxLogBytes = 512 << 10
+
+// Item is one file in the bundle.
+type Item struct {
+	Name string // path inside the zip
+	Data []byte
+}
+
+var (
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	bearerPattern = regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	// Quoted values of keys named like secrets, in JSON and key=value text
+	secretPattern = regexp.MustCompile(`(?i)("?[a-z0-9_-]*(?:token|secret|password|passwd|api[_-]?key|authorization|credential|cookie)"?\s*[:=]\s*)"[^"]*"`)
+	emailPattern  = regexp.MustCompile(`\b([A-Za-z0-9])[A-Za-z0-9._%+-]*@([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,})\b`)
+)
+
+// Redact masks tokens, keys, secret-named values, and the local part of
+// email addresses, and replaces home with "~" so the user name in paths is
+// not shared.
+func Redact(data []byte, home string) []byte {
+	data = jwtPattern.ReplaceAll(data, []byte("[REDACTED JWT]"))
+	data = bearerPattern.ReplaceAll(data, []byte("${1}[REDACTED]"))
+	data = secretPattern.ReplaceAll(data, []byte(`${1}"[REDACTED]"`))
+	data = emailPattern.ReplaceAll(data, []byte("${1}***@${2}"))
+	if home != "" && home != "/" {
+		data = bytes.ReplaceAll(data, []byte(home), []byte("~"))
+	}
+	return data
+}
+
+// Tail returns up to max bytes from the end of the file at path, starting
+// at a line boundary.
+func Tail(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= max {
+		return io.ReadAll(f)
+	}
+	if _, err := f.Seek(info.Size()-max, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return append([]byte(fmt.Sprintf("[first %d bytes omitted]\n", info.Size()-int64(len(data)))), data...), nil
+}
+
+// SystemInfo describes the client build and the operating system.
+func SystemInfo(ctx context.Context, clientVersion string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "opencode-auth: %s\n", clientVersion)
+	fmt.Fprintf(&b, "go: %s\n", runtime.Version())
+	fmt.Fprintf(&b, "platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "cpus: %d\n", runtime.NumCPU())
+	if release := osRelease(ctx); release != "" {
+		fmt.Fprintf(&b, "os: %s\n", release)
+	}
+	fmt.Fprintf(&b, "time: %s\n", time.Now().Format(time.RFC3339))
+	return []byte(b.String())
+}
+
+// osRelease returns the OS name and version, or "" if unknown.
+func osRelease(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	run := func(name string, args ...string) string {
+		out, err := exec.CommandContext(ctx, name, args...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.Join(strings.Fields(string(out)), " ")
+	}
+	switch runtime.GOOS {
+	case "linux":
+		data, err := os.ReadFile("/etc/os-release")
+		if err != nil {
+			return run("uname", "-sr")
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if v, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+				if s, err := strconv.Unquote(v); err == nil {
+					v = s
+				}
+				return v + " (kernel " + run("uname", "-r") + ")"
+			}
+		}
+		return run("uname", "-sr")
+	case "darwin":
+		return "macOS " + run("sw_vers", "-productVersion")
+	case "windows":
+		return run("cmd", "/c", "ver")
+	}
+	return ""
+}
+
+// Review lists items on out and lets the user view or drop them before the
+// bundle is written. It returns the items to write, or false if the user
+// quit.
+func Review(in io.Reader, out io.Writer, items []Item) ([]Item, bool) {
+	dropped := make([]bool, len(items))
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprintln(out, "Support bundle contents (tokens, secrets, and email addresses are masked):")
+		for i, item := range items {
+			mark := " "
+			if dropped[i] {
+				mark = "-"
+			}
+			fmt.Fprintf(out, " %s%2d  %-32s %s\n", mark, i+1, item.Name, formatSize(len(item.Data)))
+		}
+		fmt.Fprint(out, "\nEnter a number to view an item, -N to leave it out (+N to put it back), w to write, q to quit: ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return nil, false
+		}
+		answer := strings.TrimSpace(scanner.Text())
+		switch {
+		case answer == "w" || answer == "W":
+			var kept []Item
+			for i, item := range items {
+				if !dropped[i] {
+					kept = append(kept, item)
+				}
+			}
+			return kept, true
+		case answer == "q" || answer == "Q":
+			return nil, false
+		case answer == "":
+			continue
+		}
+		drop, restore := strings.HasPrefix(answer, "-"), strings.HasPrefix(answer, "+")
+		n, err := strconv.Atoi(strings.TrimLeft(answer, "-+"))
+		if err != nil || n < 1 || n > len(items) {
+			fmt.Fprintf(out, "Unknown answer %q\n\n", answer)
+			continue
+		}
+		switch {
+		case drop:
+			dropped[n-1] = true
+		case restore:
+			dropped[n-1] = false
+		default:
+			fmt.Fprintf(out, "\n----- %s -----\n%s", items[n-1].Name, items[n-1].Data)
+			if len(items[n-1].Data) > 0 && !bytes.HasSuffix(items[n-1].Data, []byte("\n")) {
+				fmt.Fprintln(out)
+			}
+			fmt.Fprintf(out, "----- end of %s -----\n", items[n-1].Name)
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+// Write writes items to a zip file at path, readable only by the user. The
+// file appears only once complete.
+func Write(path string, items []Item) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	zw := zip.NewWriter(f)
+	now := time.Now()
+	for _, item := range items {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.ToSlash(item.Name), Method: zip.Deflate, Modified: now})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := w.Write(item.Data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
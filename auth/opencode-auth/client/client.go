@@ -0,0 +1,309 @@
+// Package client is the library API of the OpenCode credential helper, for
+// Go tools that want the same sign-in and tokens as 'opencode-auth':
+//
+//	cfg, err := config.Load()
+//	...
+//	token, err := client.New(cfg).EnsureToken(ctx)
+//
+// Tokens are shared with the CLI and the local proxy through the token file,
+// so a tool embedding the client and a running 'oc' session see the same
+// sign-in.
+//
+// This package is part of the module's stable API; see docs/LOCAL-PROXY.md
+// ("Embedding in Go tools").
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/progress"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxy"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxyctl"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/qrcode"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
+)
+
+// DefaultLoginTimeout bounds a browser sign-in when LoginOptions sets none.
+const DefaultLoginTimeout = 5 * time.Minute
+
+// expiryMargin is how close to expiry EnsureToken refreshes a token.
+const expiryMargin = 5 * time.Minute
+
+var (
+	// ErrLoginRequired means there is no usable token and the user has to
+	// sign in, with Login or 'opencode-auth login'.
+	ErrLoginRequired = errors.New("login required")
+	// ErrProxyNotRunning means the token needs a refresh but no proxy is
+	// running to do it. Refreshes go through the proxy so that only one
+	// process rotates the refresh token.
+	ErrProxyNotRunning = proxy.ErrNotRunning
+)
+
+// Client signs in and hands out tokens for one configuration.
+type Client struct {
+	cfg *config.Config
+
+	// Out receives progress messages, such as the sign-in URL. It defaults
+	// to io.Discard.
+	Out io.Writer
+}
+
+// New returns a client for cfg, usually from config.Load.
+func New(cfg *config.Config) *Client {
+	return &Client{cfg: cfg, Out: io.Discard}
+}
+
+// LoginOptions controls Login.
+type LoginOptions struct {
+	// Timeout bounds the whole flow: discovery, browser callback, and token
+	// exchange. Zero means DefaultLoginTimeout.
+	Timeout time.Duration
+	// NoBrowser prints the sign-in URL to Out instead of opening a browser,
+	// with a QR code for a phone to scan when Out is a terminal
+	NoBrowser bool
+	// Paste, with NoBrowser, is read for the address a browser on another
+	// device ends on after signing in, one per line. Its redirect to this
+	// machine's callback fails there, so the user pastes it instead. The
+	// reader is left blocked in a goroutine when the login ends.
+	Paste io.Reader
+	// Source labels the attempt in 'opencode-auth status --logins'
+	// (default "login")
+	Source string
+}
+
+// Login runs the browser sign-in (authorization code with PKCE), saves the
+// tokens, and returns them.
+func (c *Client) Login(ctx context.Context, opts LoginOptions) (tokens *auth.TokenData, err error) {
+	cfg := c.cfg
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultLoginTimeout
+	}
+	source := opts.Source
+	if source == "" {
+		source = "login"
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Record the outcome for 'status --logins'
+	start := time.Now()
+	defer func() {
+		var email string
+		if tokens != nil {
+			email = tokens.Email
+		}
+		if recErr := auth.RecordLogin(auth.LoginsPath(cfg.ConfigDir), auth.NewLoginAttempt(source, start, email, err)); recErr != nil {
+			fmt.Fprintf(c.Out, "Warning: could not record login attempt: %v\n", recErr)
+		}
+	}()
+
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("client ID not set. Use --client-id or set OPENCODE_CLIENT_ID environment variable")
+	}
+
+	// Auto-discover OIDC endpoints from issuer if needed
+	if err := cfg.DiscoverEndpoints(ctx); err != nil {
+		return nil, fmt.Errorf("OIDC endpoint discovery failed: %w", err)
+	}
+
+	if cfg.AuthorizeEndpoint == "" || cfg.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC endpoints not configured. Set --issuer for auto-discovery or provide --authorize-endpoint and --token-endpoint")
+	}
+
+	// Generate PKCE verifier and challenge
+	pkce, err := auth.GeneratePKCE()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PKCE: %w", err)
+	}
+
+	// Generate state for CSRF protection
+	state, err := auth.GenerateState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate state: %w", err)
+	}
+
+	// Start callback server
+	server, err := auth.NewCallbackServer(cfg, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start callback server: %w", err)
+	}
+	server.Start()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	authURL := auth.AuthURL(cfg, server.RedirectURI(), pkce, state)
+	if opts.NoBrowser {
+		fmt.Fprintf(c.Out, "Open this URL in your browser:\n\n%s\n\n", authURL)
+		if progress.Enabled(c.Out) {
+			if code, err := qrcode.Encode(authURL); err == nil {
+				fmt.Fprintf(c.Out, "Or scan this code with your phone:\n\n%s\n", code.Terminal())
+			}
+		}
+		if opts.Paste != nil {
+			fmt.Fprintf(c.Out, "Signing in on another device? Its browser then fails to load a %s page;\npaste that page's address here and press Enter.\n\n", server.RedirectURI())
+			go c.readPaste(opts.Paste, server)
+		}
+	} else {
+		fmt.Fprintf(c.Out, "Opening browser for authentication...\n")
+		if err := auth.OpenBrowser(authURL); err != nil {
+			fmt.Fprintf(c.Out, "Failed to open browser. Please open this URL manually:\n\n%s\n\n", authURL)
+		}
+	}
+
+	// Wait for callback
+	spinnerOut := c.Out
+	if opts.NoBrowser && opts.Paste != nil {
+		// A redrawn spinner would garble the address being pasted
+		fmt.Fprintf(c.Out, "Waiting for authentication callback...\n")
+		spinnerOut = io.Discard
+	}
+	spinner := progress.StartSpinner(spinnerOut, "Waiting for authentication callback", timeout)
+	result, err := server.WaitForCallback(ctx, timeout)
+	spinner.Stop("")
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	// The callback server checked the state
+	if result.Err != nil {
+		return nil, fmt.Errorf("authentication error: %w", result.Err)
+	}
+
+	fmt.Fprintf(c.Out, "Exchanging authorization code for tokens...\n")
+
+	// Exchange code for tokens
+	tokenResp, err := auth.ExchangeCodeForTokens(ctx, cfg, result.Code, server.RedirectURI(), pkce)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", auth.ErrTokenExchange, err)
+	}
+
+	// A freshly issued token's iat is the IdP's idea of "now" — refuse to
+	// continue if the local clock disagrees enough for JWT validation to fail
+	if skew, err := auth.SkewFromIDToken(tokenResp.IDToken, time.Now()); err == nil {
+		warning, err := auth.CheckClockSkew(skew)
+		if err != nil {
+			return nil, err
+		}
+		if warning != "" {
+			fmt.Fprintf(c.Out, "Warning: %s\n", warning)
+		}
+	}
+
+	// Providers without OIDC return no ID token; expiry and email then come
+	// from expires_in and the access token.
+	issued := &auth.TokenData{
+		IDToken:      tokenResp.IDToken,
+		AccessToken:  tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+		ExpiresAt:    tokenResp.ExpiresAt(time.Now()),
+		Email:        tokenResp.Email(),
+	}
+
+	// The tokens are dropped, not saved, when they belong to another account
+	if err := auth.VerifyAccount(cfg, issued.Email); err != nil {
+		return nil, err
+	}
+
+	// Obtain a token per configured resource indicator (RFC 8707)
+	if len(cfg.Audiences) > 0 {
+		audienceTokens, refreshToken, err := auth.AcquireAudienceTokens(ctx, cfg, issued.RefreshToken)
+		if err != nil {
+			fmt.Fprintf(c.Out, "Warning: failed to obtain audience tokens: %v\n", err)
+			fmt.Fprintf(c.Out, "The proxy will retry when a request needs them.\n")
+		} else {
+			issued.AudienceTokens = audienceTokens
+			issued.RefreshToken = refreshToken
+		}
+	}
+
+	if err := auth.SaveTokens(cfg.TokenPath, issued); err != nil {
+		return nil, fmt.Errorf("failed to save tokens: %w", err)
+	}
+	return issued, nil
+}
+
+// readPaste hands pasted addresses to server until one completes the
+// sign-in or in runs out.
+func (c *Client) readPaste(in io.Reader, server *auth.CallbackServer) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 4096), 64*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		err := server.Paste(line)
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(c.Out, "Could not use that address: %v\n", err)
+	}
+}
+
+// Tokens returns the saved tokens, or ErrLoginRequired if there are none.
+// They may be expired.
+func (c *Client) Tokens() (*auth.TokenData, error) {
+	tokens, err := auth.LoadTokens(c.cfg.TokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLoginRequired, err)
+	}
+	return tokens, nil
+}
+
+// EnsureToken returns a bearer token valid for at least a few more minutes.
+// A token close to expiry is refreshed by the running proxy. It returns
+// ErrLoginRequired when the user has to sign in again, and
+// ErrProxyNotRunning when a refresh is needed but no proxy is running (see
+// proxyctl.Ensure).
+func (c *Client) EnsureToken(ctx context.Context) (string, error) {
+	tokens, err := c.Tokens()
+	if err != nil {
+		return "", err
+	}
+	if !tokens.IsExpiringSoon(expiryMargin) {
+		tracelog.Printf("token: no refresh, expires %s (in %s)", tokens.ExpiresAt.Format(time.RFC3339), time.Until(tokens.ExpiresAt).Round(time.Second))
+		return tokens.BearerToken(), nil
+	}
+
+	// Delegate refresh to proxy if running (prevents multiple processes from refreshing)
+	proxyURL, err := proxy.GetProxyURL(c.cfg)
+	if err != nil {
+		tracelog.Printf("token: refresh needed (expires %s) but no proxy is running: %v", tokens.ExpiresAt.Format(time.RFC3339), err)
+		return "", fmt.Errorf("token expiring and %w", ErrProxyNotRunning)
+	}
+	tracelog.Printf("token: expires %s, within %s; asking the proxy at %s to refresh", tokens.ExpiresAt.Format(time.RFC3339), expiryMargin, proxyURL)
+	ensureResp, err := proxyctl.EnsureAuth(ctx, proxyURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to communicate with proxy: %w", err)
+	}
+	tracelog.Printf("token: proxy answered %s", ensureResp.Status)
+	if ensureResp.Status == proxyctl.StatusReauthRequired || ensureResp.Status == proxyctl.StatusReauthInProgress {
+		return "", fmt.Errorf("%w: re-authentication required", ErrLoginRequired)
+	}
+
+	// Reload tokens after proxy refresh
+	tokens, err = auth.LoadTokens(c.cfg.TokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load tokens after refresh: %w", err)
+	}
+	return tokens.BearerToken(), nil
+}
+
+// Logout removes the saved tokens.
+func (c *Client) Logout() error {
+	if err := auth.DeleteTokens(c.cfg.TokenPath); err != nil {
+		return fmt.Errorf("failed to delete tokens: %w", err)
+	}
+	return nil
+}
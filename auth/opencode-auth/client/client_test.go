@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxy"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	dir := t.TempDir()
+	return &config.Config{ConfigDir: dir, TokenPath: filepath.Join(dir, "tokens.json")}
+}
+
+// fakeProxy registers a proxy in cfg's proxy.json that answers
+// /api/auth/ensure with status, after running refresh.
+func fakeProxy(t *testing.T, cfg *config.Config, status string, refresh func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth/ensure" {
+			if refresh != nil {
+				refresh()
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": status})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	if err := proxy.SaveProxyConfig(cfg, &proxy.ProxyConfig{Port: port, PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureToken(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no tokens", func(t *testing.T) {
+		_, err := New(testConfig(t)).EnsureToken(ctx)
+		if !errors.Is(err, ErrLoginRequired) {
+			t.Errorf("err = %v, want ErrLoginRequired", err)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		cfg := testConfig(t)
+		auth.SaveTokens(cfg.TokenPath, &auth.TokenData{IDToken: "id", ExpiresAt: time.Now().Add(time.Hour)})
+		if token, err := New(cfg).EnsureToken(ctx); err != nil || token != "id" {
+			t.Errorf("EnsureToken = %q, %v", token, err)
+		}
+	})
+
+	t.Run("expiring without proxy", func(t *testing.T) {
+		cfg := testConfig(t)
+		auth.SaveTokens(cfg.TokenPath, &auth.TokenData{IDToken: "id", ExpiresAt: time.Now().Add(time.Minute)})
+		if _, err := New(cfg).EnsureToken(ctx); !errors.Is(err, ErrProxyNotRunning) {
+			t.Errorf("err = %v, want ErrProxyNotRunning", err)
+		}
+	})
+
+	t.Run("refreshed by proxy", func(t *testing.T) {
+		cfg := testConfig(t)
+		auth.SaveTokens(cfg.TokenPath, &auth.TokenData{IDToken: "old", ExpiresAt: time.Now().Add(-time.Minute)})
+		fakeProxy(t, cfg, "ok", func() {
+			auth.SaveTokens(cfg.TokenPath, &auth.TokenData{IDToken: "new", ExpiresAt: time.Now().Add(time.Hour)})
+		})
+		if token, err := New(cfg).EnsureToken(ctx); err != nil || token != "new" {
+			t.Errorf("EnsureToken = %q, %v", token, err)
+		}
+	})
+
+	t.Run("proxy needs reauth", func(t *testing.T) {
+		cfg := testConfig(t)
+		auth.SaveTokens(cfg.TokenPath, &auth.TokenData{IDToken: "old", ExpiresAt: time.Now().Add(-time.Minute)})
+		fakeProxy(t, cfg, "reauth_required", nil)
+		if _, err := New(cfg).EnsureToken(ctx); !errors.Is(err, ErrLoginRequired) {
+			t.Errorf("err = %v, want ErrLoginRequired", err)
+		}
+	})
+}
+
+func TestLogout(t *testing.T) {
+	cfg := testConfig(t)
+	auth.SaveTokens(cfg.TokenPath, &auth.TokenData{IDToken: "id", ExpiresAt: time.Now().Add(time.Hour)})
+	c := New(cfg)
+	if err := c.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Tokens(); !errors.Is(err, ErrLoginRequired) {
+		t.Errorf("Tokens after logout: err = %v", err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the login and the test to share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLoginPaste(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "the-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id_token": "id", "access_token": "access", "expires_in": 3600})
+	}))
+	defer idp.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cfg := testConfig(t)
+	cfg.ClientID = "client"
+	cfg.AuthorizeEndpoint = idp.URL + "/authorize"
+	cfg.TokenEndpoint = idp.URL + "/token"
+	cfg.RedirectURIs = []string{fmt.Sprintf("http://127.0.0.1:%d/callback", port)}
+
+	out := &syncBuffer{}
+	paste, pasted := io.Pipe()
+	c := New(cfg)
+	c.Out = out
+	go func() {
+		// Answer like a user who signed in on a phone
+		var authURL *url.URL
+		for authURL == nil {
+			time.Sleep(10 * time.Millisecond)
+			for _, line := range strings.Split(out.String(), "\n") {
+				if strings.HasPrefix(line, cfg.AuthorizeEndpoint) {
+					authURL, _ = url.Parse(line)
+				}
+			}
+		}
+		fmt.Fprintln(pasted, "not an address")
+		fmt.Fprintf(pasted, "%s?code=the-code&state=%s\n", cfg.RedirectURIs[0], authURL.Query().Get("state"))
+	}()
+
+	tokens, err := c.Login(context.Background(), LoginOptions{Timeout: 5 * time.Second, NoBrowser: true, Paste: paste})
+	if err != nil || tokens.IDToken != "id" {
+		t.Fatalf("Login() = %+v, %v\n%s", tokens, err, out)
+	}
+	if !strings.Contains(out.String(), "Could not use that address") {
+		t.Errorf("invalid paste not reported:\n%s", out)
+	}
+}
@@ -2,13 +2,21 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/secret"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tlspolicy"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
 )
 
 // Config holds the OIDC configuration for authentication.
@@ -24,49 +32,638 @@ type Config struct {
 	ClientID string
 	// Local callback port
 	CallbackPort int
+	// Loopback redirect URIs registered with the IdP, tried in order
+	RedirectURIs []string
+	// Callback ports tried in order, as http://localhost:<port>/callback
+	CallbackPorts []int
 	// Token storage path
 	TokenPath string
 	// Config directory path
 	ConfigDir string
 	// API endpoint for proxy target
 	APIEndpoint string
+	// The same API deployed in other regions, probed by 'opencode-auth ping'
+	AlternateEndpoints []string
+	// Host names pinned to other addresses (host to IP or host[:port]) for
+	// networks whose DNS answer is unreachable
+	HostOverrides map[string]string
+	// Minimum TLS version and cipher suites for the API and identity
+	// provider; nil keeps Go's defaults
+	TLSPolicy *tlspolicy.Policy
 	// API key for programmatic access (alternative to JWT)
 	APIKey string
+	// Secret reference for the API key (e.g. "keychain:api-key"), resolved at proxy startup
+	APIKeyRef string
+	// How the user authenticates: AuthModeOIDC (default) or AuthModeStatic
+	AuthMode string
+	// Bearer token sent with auth_mode static, or a secret reference to it
+	StaticToken    string
+	StaticTokenRef string
+	// Where tokens are kept: TokenStorageFile (default) or TokenStorageMemory
+	TokenStorage string
+	// External command that prints the API key, resolved at proxy startup
+	APIKeyCmd string
 	// Version check URL for update notifications
 	VersionCheckURL string
+	// Mirror of the installer and of the config patch, for networks
+	// without internet egress; see the mirror package
+	UpdateDownloadBase string
+	ConfigPatchURL     string
 	// Client version string (injected from main.version for proxy header)
 	ClientVersion string
+	// Executable names allowed to use the proxy (empty disables peer checks)
+	AllowedProcesses []string
+	// RFC 8707 resource indicators requested at login, with the proxy routes
+	// that use each audience's access token
+	Audiences []Audience
+	// Proxy routes that take credentials in a header other than
+	// Authorization: Bearer
+	AuthHeaders []AuthHeader
+	// Account the IdP should preselect (login_hint); sign-in fails if
+	// another account is used
+	LoginHint string
+	// Email domains sign-in is restricted to (empty allows any)
+	LoginEmailDomains []string
+	// Bypass peer process checks (debugging only)
+	NoPeerCheck bool
+
+	// Tunables. Zero means "not set": flags and env vars fill these first,
+	// then the config file, then the built-in defaults apply.
+
+	// How long before expiry the proxy refreshes tokens
+	RefreshThreshold time.Duration
+	// How often the proxy checks token expiry
+	CheckInterval time.Duration
+	// Local proxy port
+	ProxyPort int
+	// How long the proxy waits for upstream response headers
+	HTTPTimeout time.Duration
+	// Sign the user out after this long without proxied requests (0 disables)
+	SessionIdleTimeout time.Duration
+	// Limits the proxy enforces on chat completion requests
+	Guardrails Guardrails
+	// Soft daily token budget the proxy notifies about but never enforces
+	// (0 disables)
+	UsageBudget int
+	// Workspace the proxy bills requests to with X-OpenCode-Workspace
+	// (empty sends none)
+	Workspace string
+	// Org profile installed with 'profile import', matched by the profiles
+	// condition of config patches (empty matches none)
+	Profile string
+	// Warn when an upstream rate limit or quota has less than this percent
+	// left (0 uses the default, negative never warns)
+	QuotaWarnPercent int
+	// Models chat completions may use, as path.Match patterns (empty allows any)
+	AllowedModels []string
+	// Model names clients use, mapped to the upstream models they stand for
+	ModelAliases map[string]string
+	// How often the proxy polls for proxy-scoped config patches (0 disables)
+	ConfigPollInterval time.Duration
+	// Resource limits the proxy's watchdog checks
+	Watchdog Watchdog
+	// How the proxy signs X-Device-Assertion: "request" (default), "session" or "off"
+	DeviceAssertion string
+	// What the proxy does with a request when the token has expired and
+	// can't be refreshed: "reject" (default) or "forward"
+	ExpiredTokens string
+	// Answer identical non-streaming chat completions sent within this
+	// window with the first one's response (0 disables)
+	DedupWindow time.Duration
+	// How long a re-authentication the proxy starts on its own waits for
+	// consent before opening the browser (negative never opens it)
+	ReauthAutoOpen time.Duration
+	// End upstream responses that send no data for this long (0 disables)
+	StreamIdleTimeout time.Duration
+	// Windows in which the proxy opens no browser and shows no sign-in
+	// notification
+	DoNotDisturb []QuietWindow
+	// Model experiments: a share of chat completions for one model is sent
+	// to another
+	Experiments []Experiment
+	// Headers and body fields added to every chat completion; nil adds none
+	Annotations *RequestAnnotations
+	// How long an elevated (step-up) token is used at most
+	StepUpTTL time.Duration
+	// Upstream timeouts for matching requests; the first match applies
+	RouteTimeouts []RouteTimeout
+
+	// Accept-Encoding sent upstream ("" passes the client's header through)
+	AcceptEncoding string
+	// Decompress gzip responses before returning them to the client
+	Decompress bool
+	// X-Forwarded-* headers sent upstream: "strip" (default) or "set"
+	ForwardedHeaders string
+	// Client headers forwarded upstream beyond the built-in allowlist, per
+	// route
+	ClientHeaders []ClientHeaders
+	// Record the parent process each time 'token' prints a credential
+	TokenAudit bool
+	// Where new device keys are kept: "auto" (default), "software" or
+	// "hardware"
+	DeviceKeyStore string
+	// Keep a local history of the last proxied requests
+	RequestHistory bool
+	// OTLP/HTTP collector the proxy exports request traces to ("" disables)
+	OTelEndpoint string
+	// Headers sent with each trace export, e.g. collector credentials
+	OTelHeaders map[string]string
+	// Address the proxy serves its redacted status feed on for a telemetry
+	// collector ("" disables)
+	ObserverListen string
+	// Bearer token the collector must send to read the status feed
+	ObserverToken string
+	// Commands 'run' executes before opencode starts and after it exits
+	Hooks Hooks
+	// Explicit opencode executable for 'run' ("" searches PATH)
+	OpenCodePath string
 	// Debug mode for verbose logging
 	Debug bool
 }
 
+// Hooks lists shell commands 'run' executes around an opencode session. A
+// failing pre_launch command stops the launch; post_exit failures are only
+// reported. Timeout applies to each command (Go duration syntax).
+type Hooks struct {
+	PreLaunch []string `json:"pre_launch,omitempty"`
+	PostExit  []string `json:"post_exit,omitempty"`
+	Timeout   string   `json:"timeout,omitempty"`
+}
+
+// Audience maps an RFC 8707 resource indicator to the proxied requests that
+// must carry a token issued for it. A request matches when its path starts
+// with PathPrefix and, if Host is set, the target host equals Host.
+type Audience struct {
+	Resource   string `json:"resource"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Host       string `json:"host,omitempty"`
+}
+
+// Resources returns the configured resource indicators.
+func (c *Config) Resources() []string {
+	var resources []string
+	for _, a := range c.Audiences {
+		if a.Resource != "" {
+			resources = append(resources, a.Resource)
+		}
+	}
+	return resources
+}
+
+// AudienceFor returns the resource indicator whose route matches host and
+// path, preferring the longest PathPrefix, or "" if none match.
+func (c *Config) AudienceFor(host, path string) string {
+	best, bestLen := "", -1
+	for _, a := range c.Audiences {
+		if a.Host != "" && a.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(path, a.PathPrefix) {
+			continue
+		}
+		if len(a.PathPrefix) > bestLen {
+			best, bestLen = a.Resource, len(a.PathPrefix)
+		}
+	}
+	return best
+}
+
+// AuthHeader sets how the proxy presents credentials on matching requests,
+// for upstreams that expect e.g. x-amzn-oidc-data instead of
+// Authorization: Bearer. Requests match like Audience routes. Format is a
+// Go template over the proxy's credentials, e.g. "Bearer {{.IDToken}}" or
+// "{{.APIKey}}"; see proxy.AuthHeaderData.
+type AuthHeader struct {
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Name       string `json:"name"`
+	Format     string `json:"format"`
+}
+
+// AuthHeaderFor returns the auth header route matching host and path,
+// preferring the longest PathPrefix, or nil if none match.
+func (c *Config) AuthHeaderFor(host, path string) *AuthHeader {
+	return MatchAuthHeader(c.AuthHeaders, host, path)
+}
+
+// MatchAuthHeader is AuthHeaderFor over a list of routes.
+func MatchAuthHeader(headers []AuthHeader, host, path string) *AuthHeader {
+	var best *AuthHeader
+	for i, h := range headers {
+		if h.Host != "" && h.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(path, h.PathPrefix) {
+			continue
+		}
+		if best == nil || len(h.PathPrefix) > len(best.PathPrefix) {
+			best = &headers[i]
+		}
+	}
+	return best
+}
+
+// ClientHeaders chooses which client headers the proxy forwards upstream on
+// matching requests, on top of its built-in allowlist; the rest are dropped.
+// Requests match like AuthHeader routes. Names are case-insensitive, a
+// trailing "*" matches a prefix ("X-Stainless-*"), and "*" alone in Allow
+// forwards every header. Deny wins over Allow and the built-in allowlist.
+type ClientHeaders struct {
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	Host       string   `json:"host,omitempty"`
+	Allow      []string `json:"allow,omitempty"`
+	Deny       []string `json:"deny,omitempty"`
+}
+
+// MatchClientHeaders returns the client header route matching host and
+// path, preferring the longest PathPrefix, or nil if none match.
+func MatchClientHeaders(routes []ClientHeaders, host, path string) *ClientHeaders {
+	var best *ClientHeaders
+	for i, r := range routes {
+		if r.Host != "" && r.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(path, r.PathPrefix) {
+			continue
+		}
+		if best == nil || len(r.PathPrefix) > len(best.PathPrefix) {
+			best = &routes[i]
+		}
+	}
+	return best
+}
+
+// Guardrails limit what chat completion requests may cost. Zero fields are
+// not enforced. Context length is estimated from the request size, at about
+// four bytes per token.
+type Guardrails struct {
+	// MaxTokens caps max_tokens (and max_completion_tokens) per request
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// MaxContextTokens rejects requests whose estimated input is larger
+	MaxContextTokens int `json:"max_context_tokens,omitempty"`
+	// DailyTokenBudget rejects requests once today's reported usage
+	// (prompt plus completion tokens) reaches it
+	DailyTokenBudget int `json:"daily_token_budget,omitempty"`
+}
+
+// Watchdog sets the resource limits the proxy watches in itself. Zero fields
+// use the proxy's defaults.
+type Watchdog struct {
+	MaxGoroutines int `json:"max_goroutines,omitempty"`
+	MaxHeapMB     int `json:"max_heap_mb,omitempty"`
+	MaxOpenFiles  int `json:"max_open_files,omitempty"`
+	// Restart stops the proxy and starts a fresh one when a limit stays
+	// exceeded, instead of only logging it
+	Restart bool `json:"restart,omitempty"`
+}
+
+// RouteTimeout overrides the upstream timeouts for matching requests.
+// Durations use Go syntax ("5m"); unset ones keep the global setting.
+type RouteTimeout struct {
+	// Path is a path.Match pattern for the request path ("" matches any)
+	Path string `json:"path,omitempty"`
+	// Model is a path.Match pattern for the model of a chat completion
+	// ("" matches any request)
+	Model string `json:"model,omitempty"`
+	// HeaderTimeout is how long to wait for the response headers
+	HeaderTimeout string `json:"header_timeout,omitempty"`
+	// StreamIdleTimeout ends a response that sends no data for this long
+	StreamIdleTimeout string `json:"stream_idle_timeout,omitempty"`
+}
+
+// validate checks the patterns and durations of rt.
+func (rt RouteTimeout) validate() error {
+	for _, p := range []string{rt.Path, rt.Model} {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", p)
+		}
+	}
+	for _, d := range []string{rt.HeaderTimeout, rt.StreamIdleTimeout} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("%q is not a positive duration", d)
+		}
+	}
+	if rt.HeaderTimeout == "" && rt.StreamIdleTimeout == "" {
+		return fmt.Errorf("sets no timeout")
+	}
+	return nil
+}
+
+// Experiment sends Percent of the chat completions for Model to Candidate,
+// so the two can be compared before switching.
+type Experiment struct {
+	// Name tags responses in X-OpenCode-Experiment, e.g. "haiku-trial"
+	Name      string `json:"name"`
+	Model     string `json:"model"`     // as clients request it (control)
+	Candidate string `json:"candidate"` // sent instead
+	Percent   int    `json:"percent"`   // 1-100
+}
+
+// validate checks the fields of e.
+func (e Experiment) validate() error {
+	if !workspaceName.MatchString(e.Name) {
+		return fmt.Errorf("name %q must be 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit", e.Name)
+	}
+	if e.Model == "" || e.Candidate == "" {
+		return fmt.Errorf("needs a model and a candidate")
+	}
+	if e.Model == e.Candidate {
+		return fmt.Errorf("candidate is the model itself")
+	}
+	if e.Percent < 1 || e.Percent > 100 {
+		return fmt.Errorf("percent %d is not between 1 and 100", e.Percent)
+	}
+	return nil
+}
+
+// RequestAnnotations are added to every chat completion the proxy forwards,
+// so the router can attribute, experiment and route on them without each
+// developer's opencode config setting them. Headers are set, replacing a
+// client's value. Body maps dotted paths, e.g. "metadata.team", to JSON
+// values set in the request body, creating objects along the way. Object
+// values are merged field by field, so {"metadata": {"team": "payments"}}
+// is the same as "metadata.team", and a client's other metadata is kept.
+type RequestAnnotations struct {
+	Headers map[string]string      `json:"headers,omitempty"`
+	Body    map[string]interface{} `json:"body,omitempty"`
+}
+
+// headerName matches an HTTP header field name (RFC 9110 token).
+var headerName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// reservedBodyFields say what a chat completion asks for, and the model
+// policy and guardrails check or set them, so annotations may not change
+// them.
+var reservedBodyFields = map[string]bool{
+	"model":                 true,
+	"messages":              true,
+	"stream":                true,
+	"stream_options":        true,
+	"max_tokens":            true,
+	"max_completion_tokens": true,
+}
+
+// ReservedBodyPath reports whether an annotation body path would change a
+// field annotations may not set.
+func ReservedBodyPath(path string) bool {
+	first, _, _ := strings.Cut(path, ".")
+	return reservedBodyFields[first]
+}
+
+// validate checks the fields of a.
+func (a RequestAnnotations) validate() error {
+	if len(a.Headers) == 0 && len(a.Body) == 0 {
+		return fmt.Errorf("sets no headers and no body fields")
+	}
+	for name, value := range a.Headers {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("%q is not a header name", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %s has a line break in its value", name)
+		}
+	}
+	for path := range a.Body {
+		segments := strings.Split(path, ".")
+		for _, seg := range segments {
+			if seg == "" {
+				return fmt.Errorf("body path %q has an empty segment", path)
+			}
+		}
+		if ReservedBodyPath(path) {
+			return fmt.Errorf("body path %q would change the request's %s", path, segments[0])
+		}
+	}
+	return nil
+}
+
+// QuietWindow is a daily do-not-disturb window in local time, e.g. 09:00 to
+// 11:00. A window whose end is before its start ends the next day.
+type QuietWindow struct {
+	Start string `json:"start"` // "15:04"
+	End   string `json:"end"`
+	// Days the window starts on, e.g. ["mon", "tue"] (empty is every day)
+	Days []string `json:"days,omitempty"`
+}
+
+// weekdays are the names QuietWindow.Days accepts.
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// validate checks the times and days of w.
+func (w QuietWindow) validate() error {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return fmt.Errorf("start %q is not a time like 09:00", w.Start)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return fmt.Errorf("end %q is not a time like 11:00", w.End)
+	}
+	if start.Equal(end) {
+		return fmt.Errorf("starts and ends at %s", w.Start)
+	}
+	for _, d := range w.Days {
+		known := false
+		for _, name := range weekdays {
+			known = known || strings.EqualFold(d, name)
+		}
+		if !known {
+			return fmt.Errorf("day %q is not one of %s", d, strings.Join(weekdays, ", "))
+		}
+	}
+	return nil
+}
+
+// Bounds returns when w starts on the day of t, in t's location, and when
+// it ends. ok is false if w does not start on that day.
+func (w QuietWindow) Bounds(t time.Time) (start, end time.Time, ok bool) {
+	if len(w.Days) > 0 {
+		day := weekdays[t.Weekday()]
+		for _, d := range w.Days {
+			ok = ok || strings.EqualFold(d, day)
+		}
+		if !ok {
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	s, err1 := time.Parse("15:04", w.Start)
+	e, err2 := time.Parse("15:04", w.End)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	y, m, d := t.Date()
+	start = time.Date(y, m, d, s.Hour(), s.Minute(), 0, 0, t.Location())
+	end = time.Date(y, m, d, e.Hour(), e.Minute(), 0, 0, t.Location())
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, true
+}
+
 // Default configuration values
 const (
 	DefaultCallbackPort = 19876 // High port to avoid conflicts with common dev servers
+	DefaultProxyPort    = 18080 // Static port for proxy - hardcoded in opencode.json
+	DefaultHTTPTimeout  = 30 * time.Second
+)
+
+// checkModelAliases checks that every alias names a model, and that no
+// alias stands for another alias, which would make the rewrite depend on
+// the order it is applied in.
+func checkModelAliases(aliases map[string]string) error {
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	for _, alias := range names {
+		model := aliases[alias]
+		if alias == "" || model == "" {
+			return fmt.Errorf("%q -> %q: alias and model must not be empty", alias, model)
+		}
+		if alias == model {
+			return fmt.Errorf("%q is an alias for itself", alias)
+		}
+		if _, ok := aliases[model]; ok {
+			return fmt.Errorf("%q stands for %q, which is an alias too", alias, model)
+		}
+	}
+	return nil
+}
+
+// Auth modes.
+const (
+	// AuthModeOIDC signs in with the IdP and refreshes tokens
+	AuthModeOIDC = "oidc"
+	// AuthModeStatic sends a configured bearer token to a router that has
+	// no IdP, e.g. in an air-gapped pilot; there is no login or refresh
+	AuthModeStatic = "static"
+)
+
+// Token storage.
+const (
+	// TokenStorageFile keeps tokens in TokenPath
+	TokenStorageFile = "file"
+	// TokenStorageMemory keeps tokens in the proxy's memory only, so they
+	// never reach the disk, e.g. of a cloud dev environment that is
+	// snapshotted; a proxy restart needs a new sign-in
+	TokenStorageMemory = "memory"
 )
 
 // DefaultConfig returns the default configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		Issuer:            os.Getenv("OPENCODE_ISSUER"),
-		AuthorizeEndpoint: os.Getenv("OPENCODE_AUTHORIZE_ENDPOINT"),
-		TokenEndpoint:     os.Getenv("OPENCODE_TOKEN_ENDPOINT"),
-		ClientID:          os.Getenv("OPENCODE_CLIENT_ID"),
-		CallbackPort:      DefaultCallbackPort,
-		TokenPath:         defaultTokenPath(),
-		ConfigDir:         defaultConfigDir(),
-		APIEndpoint:       os.Getenv("OPENAI_BASE_URL"),
-		Debug:             os.Getenv("OPENCODE_AUTH_DEBUG") == "1",
+		Issuer:             os.Getenv("OPENCODE_ISSUER"),
+		AuthorizeEndpoint:  os.Getenv("OPENCODE_AUTHORIZE_ENDPOINT"),
+		TokenEndpoint:      os.Getenv("OPENCODE_TOKEN_ENDPOINT"),
+		ClientID:           os.Getenv("OPENCODE_CLIENT_ID"),
+		CallbackPort:       envInt("OPENCODE_CALLBACK_PORT"),
+		ProxyPort:          envInt("OPENCODE_PROXY_PORT"),
+		RefreshThreshold:   envDuration("PROXY_REFRESH_THRESHOLD"),
+		CheckInterval:      envDuration("PROXY_CHECK_INTERVAL"),
+		HTTPTimeout:        envDuration("OPENCODE_HTTP_TIMEOUT"),
+		TokenPath:          defaultTokenPath(),
+		ConfigDir:          defaultConfigDir(),
+		APIEndpoint:        os.Getenv("OPENAI_BASE_URL"),
+		NoPeerCheck:        os.Getenv("OPENCODE_AUTH_NO_PEER_CHECK") == "1",
+		TokenAudit:         os.Getenv("OPENCODE_TOKEN_AUDIT") == "1",
+		RequestHistory:     os.Getenv("OPENCODE_PROXY_HISTORY") == "1",
+		OTelEndpoint:       os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		Debug:              os.Getenv("OPENCODE_AUTH_DEBUG") == "1",
+		VersionCheckURL:    os.Getenv("OPENCODE_VERSION_CHECK_URL"),
+		UpdateDownloadBase: os.Getenv("OPENCODE_UPDATE_DOWNLOAD_BASE"),
+		ConfigPatchURL:     os.Getenv("OPENCODE_CONFIG_PATCH_URL"),
+		TokenStorage:       os.Getenv("OPENCODE_TOKEN_STORAGE"),
 	}
 }
 
-// defaultConfigDir returns the default configuration directory path.
-func defaultConfigDir() string {
+// envInt returns the integer value of an environment variable, or 0 if it is
+// unset or invalid.
+func envInt(name string) int {
+	n, _ := strconv.Atoi(os.Getenv(name))
+	return n
+}
+
+// envDuration returns the duration value of an environment variable, or 0 if
+// it is unset or invalid.
+func envDuration(name string) time.Duration {
+	d, _ := time.ParseDuration(os.Getenv(name))
+	return d
+}
+
+// GetCallbackPort returns the local callback port, or the default if unset.
+func (c *Config) GetCallbackPort() int {
+	if c.CallbackPort > 0 {
+		return c.CallbackPort
+	}
+	return DefaultCallbackPort
+}
+
+// GetProxyPort returns the local proxy port, or the default if unset.
+func (c *Config) GetProxyPort() int {
+	if c.ProxyPort > 0 {
+		return c.ProxyPort
+	}
+	return DefaultProxyPort
+}
+
+// GetHTTPTimeout returns the upstream response header timeout, or the
+// default if unset.
+func (c *Config) GetHTTPTimeout() time.Duration {
+	if c.HTTPTimeout > 0 {
+		return c.HTTPTimeout
+	}
+	return DefaultHTTPTimeout
+}
+
+// StateDirEnv overrides the directory holding config.json, the tokens, and
+// the proxy's state, for CI runners and containers whose home directory is
+// unset or read-only. --state-dir sets it for the process and its children.
+const StateDirEnv = "OPENCODE_STATE_DIR"
+
+// StateDir returns the directory holding the user's config.json, the tokens,
+// and the proxy's state: $OPENCODE_STATE_DIR, or ~/.opencode.
+func StateDir() (string, error) {
+	if dir := os.Getenv(StateDirEnv); dir != "" {
+		return filepath.Abs(dir)
+	}
 	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("the home directory is unknown (%v); set %s or pass --state-dir", err, StateDirEnv)
+	}
+	return filepath.Join(home, ".opencode"), nil
+}
+
+// CheckStateDir creates the state directory if needed, checks that it is
+// writable, and returns it.
+func CheckStateDir() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("state directory %s can't be created (%v); set %s or pass --state-dir to use another", dir, err, StateDirEnv)
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return "", fmt.Errorf("state directory %s is not writable (%v); set %s or pass --state-dir to use another", dir, err, StateDirEnv)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return dir, nil
+}
+
+// defaultConfigDir returns the default configuration directory path. The
+// relative fallback is only reached by commands that skip CheckStateDir.
+func defaultConfigDir() string {
+	dir, err := StateDir()
 	if err != nil {
 		return ".opencode"
 	}
-	return filepath.Join(home, ".opencode")
+	return dir
 }
 
 // defaultTokenPath returns the default token storage path.
@@ -76,58 +673,88 @@ func defaultTokenPath() string {
 
 // CallbackURL returns the local callback URL.
 func (c *Config) CallbackURL() string {
-	return fmt.Sprintf("http://localhost:%d/callback", c.CallbackPort)
+	return fmt.Sprintf("http://localhost:%d/callback", c.GetCallbackPort())
 }
 
-// DiscoverEndpoints uses OIDC Discovery to populate AuthorizeEndpoint and
-// TokenEndpoint from the Issuer's .well-known/openid-configuration endpoint.
-// It only fetches if AuthorizeEndpoint or TokenEndpoint are not already set.
-func (c *Config) DiscoverEndpoints() error {
-	if c.Issuer == "" {
-		return nil // Nothing to discover from
+// CallbackURLs returns the redirect URIs to try for the login callback, in
+// order: the callback port, redirect_uris, then callback_ports. Without any
+// of them it is just CallbackURL.
+func (c *Config) CallbackURLs() []string {
+	var urls []string
+	add := func(u string) {
+		for _, existing := range urls {
+			if existing == u {
+				return
+			}
+		}
+		urls = append(urls, u)
 	}
-
-	if c.AuthorizeEndpoint != "" && c.TokenEndpoint != "" {
-		return nil // Already configured
+	if c.CallbackPort > 0 {
+		add(c.CallbackURL())
 	}
+	for _, u := range c.RedirectURIs {
+		add(u)
+	}
+	for _, port := range c.CallbackPorts {
+		add(fmt.Sprintf("http://localhost:%d/callback", port))
+	}
+	if len(urls) == 0 {
+		add(c.CallbackURL())
+	}
+	return urls
+}
 
-	discoveryURL := c.Issuer + "/.well-known/openid-configuration"
+// ResolveAPIKey populates APIKey from APIKeyCmd or APIKeyRef when no plaintext
+// key is configured. It is a no-op if APIKey is already set or neither source
+// is configured.
+func (c *Config) ResolveAPIKey(ctx context.Context) error {
+	if c.APIKey != "" {
+		return nil
+	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(discoveryURL)
+	var (
+		key string
+		err error
+	)
+	switch {
+	case c.APIKeyCmd != "":
+		key, err = secret.RunCommand(ctx, c.APIKeyCmd)
+	case c.APIKeyRef != "":
+		key, err = secret.Resolve(ctx, c.APIKeyRef)
+	default:
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("OIDC discovery failed for %s: %w", discoveryURL, err)
+		return fmt.Errorf("failed to resolve API key: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("OIDC discovery returned status %d: %s", resp.StatusCode, string(body))
-	}
+	c.APIKey = key
+	return nil
+}
 
-	var discovery struct {
-		AuthorizationEndpoint string `json:"authorization_endpoint"`
-		TokenEndpoint         string `json:"token_endpoint"`
-	}
+// MemoryTokens reports whether tokens are kept in the proxy's memory only.
+func (c *Config) MemoryTokens() bool {
+	return c.TokenStorage == TokenStorageMemory
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
-		return fmt.Errorf("failed to parse OIDC discovery response: %w", err)
-	}
+// StaticAuth reports whether the configured auth mode is AuthModeStatic.
+func (c *Config) StaticAuth() bool {
+	return c.AuthMode == AuthModeStatic
+}
 
-	if c.AuthorizeEndpoint == "" {
-		if discovery.AuthorizationEndpoint == "" {
-			return fmt.Errorf("OIDC discovery response missing authorization_endpoint")
+// ResolveStaticToken populates StaticToken from StaticTokenRef when no
+// plaintext token is configured, and fails if there is no token at all.
+func (c *Config) ResolveStaticToken(ctx context.Context) error {
+	if c.StaticToken == "" && c.StaticTokenRef != "" {
+		token, err := secret.Resolve(ctx, c.StaticTokenRef)
+		if err != nil {
+			return fmt.Errorf("failed to resolve static token: %w", err)
 		}
-		c.AuthorizeEndpoint = discovery.AuthorizationEndpoint
+		c.StaticToken = token
 	}
-
-	if c.TokenEndpoint == "" {
-		if discovery.TokenEndpoint == "" {
-			return fmt.Errorf("OIDC discovery response missing token_endpoint")
-		}
-		c.TokenEndpoint = discovery.TokenEndpoint
+	if c.StaticToken == "" {
+		return fmt.Errorf("auth_mode is static but neither static_token nor static_token_ref is set")
 	}
-
 	return nil
 }
 
@@ -139,12 +766,413 @@ type OpenCodeConfig struct {
 	TokenEndpoint     string `json:"token_endpoint,omitempty"`
 	Issuer            string `json:"issuer,omitempty"`
 	APIKey            string `json:"api_key,omitempty"`
+	APIKeyRef         string `json:"api_key_ref,omitempty"`
+	APIKeyCmd         string `json:"api_key_cmd,omitempty"`
 	VersionCheckURL   string `json:"version_check_url,omitempty"`
+
+	// UpdateDownloadBase is a mirror directory holding the installer, and
+	// ConfigPatchURL a mirror of the config patch, either https:// or
+	// file://. Set, they replace the presigned download and the proxy's
+	// /v1/update/config.
+	UpdateDownloadBase string `json:"update_download_base,omitempty"`
+	ConfigPatchURL     string `json:"config_patch_url,omitempty"`
+
+	// AuthMode is "oidc" (the default) or "static". With "static" there is
+	// no IdP: client_id is not needed, login and refresh are disabled, and
+	// the proxy sends StaticToken (or the secret StaticTokenRef names, e.g.
+	// "keychain:static-token") as the bearer token.
+	AuthMode       string `json:"auth_mode,omitempty"`
+	StaticToken    string `json:"static_token,omitempty"`
+	StaticTokenRef string `json:"static_token_ref,omitempty"`
+
+	// TokenStorage is "file" (the default) or "memory"; see
+	// TokenStorageMemory.
+	TokenStorage string `json:"token_storage,omitempty"`
+
+	// ConfigRecipient is the public key api_key is encrypted to when saved,
+	// set by 'config encrypt'. The private key is in the OS keychain, and an
+	// encrypted api_key ("enc:v1:...") is decrypted on load.
+	ConfigRecipient string `json:"config_recipient,omitempty"`
+
+	// AlternateEndpoints lists the API deployed in other regions, so 'ping'
+	// can recommend one that is faster from this machine.
+	AlternateEndpoints []string `json:"alternate_endpoints,omitempty"`
+
+	// HostOverrides pins host names to other addresses, e.g.
+	// {"api.example.com": "10.20.0.15"}, for split-horizon networks whose
+	// DNS returns an unreachable public IP. It applies to the proxy and the
+	// sign-in without touching /etc/hosts.
+	HostOverrides map[string]string `json:"host_overrides,omitempty"`
+
+	// TLSMinVersion ("1.2" or "1.3") and TLSCipherSuites (crypto/tls
+	// names, TLS 1.2 suites only) restrict the connections to the API and
+	// identity provider, e.g. for a TLS 1.3-only mandate.
+	TLSMinVersion   string   `json:"tls_min_version,omitempty"`
+	TLSCipherSuites []string `json:"tls_cipher_suites,omitempty"`
+
+	// ProxyAllowedProcesses lists executable names (e.g. "opencode", "curl")
+	// allowed to connect to the proxy. Empty allows any local process.
+	ProxyAllowedProcesses []string `json:"proxy_allowed_processes,omitempty"`
+
+	// TokenAudiences lists RFC 8707 resource indicators to request at login
+	// and the routes that use each audience's token.
+	TokenAudiences []Audience `json:"token_audiences,omitempty"`
+
+	// ProxyAuthHeaders lists routes whose upstream expects credentials in a
+	// custom header or format.
+	ProxyAuthHeaders []AuthHeader `json:"proxy_auth_headers,omitempty"`
+
+	// LoginHint is the account the IdP preselects at sign-in, e.g.
+	// "user@example.com". Saved by 'login --hint ... --save-hint'.
+	LoginHint string `json:"login_hint,omitempty"`
+	// LoginEmailDomains rejects sign-ins with accounts outside these
+	// domains, e.g. ["example.com"].
+	LoginEmailDomains []string `json:"login_email_domains,omitempty"`
+
+	// ProxyAcceptEncoding overrides the Accept-Encoding sent upstream, e.g.
+	// "identity" to disable compression. Empty passes the client's through.
+	ProxyAcceptEncoding string `json:"proxy_accept_encoding,omitempty"`
+	// ProxyDecompress makes the proxy return uncompressed responses.
+	ProxyDecompress bool `json:"proxy_decompress,omitempty"`
+	// ProxyForwardedHeaders is "set" to send X-Forwarded-For/Proto/Host
+	// describing the local hop; the default, "strip", sends none.
+	ProxyForwardedHeaders string `json:"proxy_forwarded_headers,omitempty"`
+	// ProxyClientHeaders lists, per route, the client headers to forward
+	// upstream beyond the built-in allowlist, and headers never to forward.
+	ProxyClientHeaders []ClientHeaders `json:"proxy_client_headers,omitempty"`
+
+	// TokenAudit records which processes call 'opencode-auth token'.
+	TokenAudit bool `json:"token_audit,omitempty"`
+
+	// DeviceKeyStore is where new device keys are created: "auto" (default)
+	// uses the TPM where there is one, "software" keeps the key in
+	// device.json, "hardware" refuses to create a key without a TPM.
+	DeviceKeyStore string `json:"device_key_store,omitempty"`
+
+	// ProxyHistory keeps the last requests the proxy handled (time, path,
+	// model, status, latency, bytes) for 'opencode-auth proxy history'.
+	ProxyHistory bool `json:"proxy_history,omitempty"`
+
+	// OTelEndpoint is an OTLP/HTTP collector (e.g. "http://localhost:4318")
+	// that receives proxy request traces. OTelHeaders are sent with each
+	// export.
+	OTelEndpoint string            `json:"otel_endpoint,omitempty"`
+	OTelHeaders  map[string]string `json:"otel_headers,omitempty"`
+
+	// ProxyObserverListen is an address, e.g. ":18090", where the proxy
+	// serves a read-only status feed without credentials to an org telemetry
+	// collector. ProxyObserverToken is the bearer token the collector sends;
+	// it is required unless the address is loopback.
+	ProxyObserverListen string `json:"proxy_observer_listen,omitempty"`
+	ProxyObserverToken  string `json:"proxy_observer_token,omitempty"`
+
+	// Hooks run around opencode by 'run'.
+	Hooks *Hooks `json:"hooks,omitempty"`
+
+	// OpenCodePath is the opencode executable 'run' launches, for installs
+	// that the PATH search cannot find or verify.
+	OpenCodePath string `json:"opencode_path,omitempty"`
+
+	// Tunables written by the installer. Durations use Go syntax ("50m").
+	RefreshThreshold string `json:"refresh_threshold,omitempty"`
+	CheckInterval    string `json:"check_interval,omitempty"`
+	CallbackPort     int    `json:"callback_port,omitempty"`
+	ProxyPort        int    `json:"proxy_port,omitempty"`
+	HTTPTimeout      string `json:"http_timeout,omitempty"`
+
+	// RedirectURIs and CallbackPorts list the login callbacks the IdP
+	// accepts, for IdPs that only allow specific ports. The first one whose
+	// port is free is used.
+	RedirectURIs  []string `json:"redirect_uris,omitempty"`
+	CallbackPorts []int    `json:"callback_ports,omitempty"`
+
+	// SessionIdleTimeout signs the user out after this long without
+	// requests through the proxy, e.g. "8h". Usually set in the system layer.
+	SessionIdleTimeout string `json:"session_idle_timeout,omitempty"`
+
+	// ProxyGuardrails limits chat completion requests through the proxy.
+	// Usually delivered by a config patch.
+	ProxyGuardrails *Guardrails `json:"proxy_guardrails,omitempty"`
+	// UsageBudget is a soft daily token budget: the proxy shows a desktop
+	// notification when today's usage reaches 80% and 100% of it, but
+	// refuses nothing. Set with 'opencode-auth usage budget set'.
+	UsageBudget int `json:"usage_budget,omitempty"`
+	// Profile is the org profile last imported with 'opencode-auth profile
+	// import'. Config patches can target it with a profiles condition.
+	Profile *Profile `json:"profile,omitempty"`
+	// Workspaces lists the workspaces the user can bill usage to. When set,
+	// workspace must be one of them. Usually set in the system layer.
+	Workspaces []Workspace `json:"workspaces,omitempty"`
+	// Workspace is the active workspace, sent by the proxy as
+	// X-OpenCode-Workspace so the router attributes usage to it. Set with
+	// 'opencode-auth workspace use'.
+	Workspace string `json:"workspace,omitempty"`
+	// ProxyAllowedModels restricts chat completions to these models, e.g.
+	// ["anthropic.claude-*"]. Usually delivered by a config patch.
+	ProxyAllowedModels []string `json:"proxy_allowed_models,omitempty"`
+	// ProxyModelAliases maps the model names clients use to the upstream
+	// models they stand for, e.g. {"team-default": "claude-sonnet-4"}. The
+	// proxy rewrites the model of chat completions and lists the upstream
+	// models under their aliases in /v1/models.
+	ProxyModelAliases map[string]string `json:"proxy_model_aliases,omitempty"`
+	// ProxyConfigPollInterval makes the proxy fetch proxy-scoped config
+	// patches itself this often, e.g. "5m", instead of waiting for 'oc'.
+	ProxyConfigPollInterval string `json:"proxy_config_poll_interval,omitempty"`
+	// ProxyWatchdog overrides the proxy's goroutine, heap, and open file
+	// limits, and can make it restart itself when one stays exceeded.
+	ProxyWatchdog *Watchdog `json:"proxy_watchdog,omitempty"`
+	// ProxyDeviceAssertion is how the proxy signs X-Device-Assertion with a
+	// registered device key: "request" (default) signs each request,
+	// "session" reuses one assertion for up to an hour, "off" sends none.
+	ProxyDeviceAssertion string `json:"proxy_device_assertion,omitempty"`
+	// ProxyExpiredTokens is what the proxy does with a request when the
+	// token has expired and can't be refreshed: "reject" (default) answers
+	// it with a local 401 and starts re-authentication, "forward" sends it
+	// upstream with the expired token.
+	ProxyExpiredTokens string `json:"proxy_expired_tokens,omitempty"`
+	// ProxyDedupWindow makes the proxy answer a non-streaming chat completion
+	// identical to one sent within this window, e.g. "10s", with the first
+	// one's response instead of sending it upstream again.
+	ProxyDedupWindow string `json:"proxy_dedup_window,omitempty"`
+	// ProxyReauthAutoOpen is how long the proxy waits, after notifying that
+	// the session expired, before opening the browser to sign in unasked,
+	// e.g. "2m" (the default), or "never".
+	ProxyReauthAutoOpen string `json:"proxy_reauth_auto_open,omitempty"`
+	// ProxyStreamIdleTimeout ends an upstream response, e.g. a stream, that
+	// sends no data for this long, e.g. "2m". http_timeout only bounds the
+	// wait for the response headers.
+	ProxyStreamIdleTimeout string `json:"proxy_stream_idle_timeout,omitempty"`
+	// ProxyRouteTimeouts overrides http_timeout and proxy_stream_idle_timeout
+	// for matching requests, e.g. a longer header timeout for reasoning
+	// models. Usually delivered by a config patch.
+	ProxyRouteTimeouts []RouteTimeout `json:"proxy_route_timeouts,omitempty"`
+	// ProxyStepUpTTL is how long the proxy keeps using a token from a
+	// step-up sign-in, e.g. "10m" (the default). The token's own expiry
+	// still applies.
+	ProxyStepUpTTL string `json:"proxy_step_up_ttl,omitempty"`
+	// ProxyDoNotDisturb lists daily windows, e.g. while presenting, in which
+	// the proxy opens no browser to sign in and holds its sign-in
+	// notification until the window ends. It refreshes ahead of a window
+	// the token would expire in.
+	ProxyDoNotDisturb []QuietWindow `json:"proxy_do_not_disturb,omitempty"`
+	// ProxyExperiments sends a share of the chat completions for a model to
+	// a candidate model and tracks latency, tokens and errors for each, so
+	// a model switch can be evaluated first.
+	ProxyExperiments []Experiment `json:"proxy_experiments,omitempty"`
+	// ProxyRequestAnnotations adds static headers and body fields, e.g.
+	// {"body": {"metadata.team": "payments"}}, to every chat completion, so
+	// a config patch can tag a team's requests for the router.
+	ProxyRequestAnnotations *RequestAnnotations `json:"proxy_request_annotations,omitempty"`
+	// ProxyQuotaWarnPercent makes the proxy log a warning when an upstream
+	// x-ratelimit-* or x-quota-* limit has less than this percent left,
+	// e.g. 20. The default is 10; -1 never warns.
+	ProxyQuotaWarnPercent int `json:"proxy_quota_warn_percent,omitempty"`
+}
+
+// Profile records the org profile 'opencode-auth profile import' installed.
+type Profile struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Source      string    `json:"source"` // URL it was imported from
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// Workspace is a workspace usage can be billed to.
+type Workspace struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// workspaceName is the syntax the router accepts in X-OpenCode-Workspace.
+var workspaceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// CheckWorkspace returns an error if name is not a valid workspace name, or
+// is not listed in workspaces when the list is set.
+func (oc *OpenCodeConfig) CheckWorkspace(name string) error {
+	if !workspaceName.MatchString(name) {
+		return fmt.Errorf("workspace %q must be 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit", name)
+	}
+	if len(oc.Workspaces) == 0 {
+		return nil
+	}
+	for _, w := range oc.Workspaces {
+		if w.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("workspace %q is not one of the configured workspaces", name)
+}
+
+// ApplyTunables fills tunables in c that were not set by flags or env vars
+// from the config file. Invalid durations are reported and skipped.
+func (oc *OpenCodeConfig) ApplyTunables(c *Config) error {
+	var errs []string
+	setDuration := func(dst *time.Duration, name, val string) {
+		if *dst != 0 || val == "" {
+			return
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s %q is not a positive duration", name, val))
+			return
+		}
+		*dst = d
+	}
+
+	setDuration(&c.RefreshThreshold, "refresh_threshold", oc.RefreshThreshold)
+	setDuration(&c.CheckInterval, "check_interval", oc.CheckInterval)
+	setDuration(&c.HTTPTimeout, "http_timeout", oc.HTTPTimeout)
+	setDuration(&c.SessionIdleTimeout, "session_idle_timeout", oc.SessionIdleTimeout)
+	setDuration(&c.ConfigPollInterval, "proxy_config_poll_interval", oc.ProxyConfigPollInterval)
+	setDuration(&c.DedupWindow, "proxy_dedup_window", oc.ProxyDedupWindow)
+	setDuration(&c.StreamIdleTimeout, "proxy_stream_idle_timeout", oc.ProxyStreamIdleTimeout)
+	setDuration(&c.StepUpTTL, "proxy_step_up_ttl", oc.ProxyStepUpTTL)
+	if len(c.RouteTimeouts) == 0 {
+		for i, rt := range oc.ProxyRouteTimeouts {
+			if err := rt.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("proxy_route_timeouts[%d]: %v", i, err))
+				continue
+			}
+			c.RouteTimeouts = append(c.RouteTimeouts, rt)
+		}
+	}
+	if len(c.DoNotDisturb) == 0 {
+		for i, w := range oc.ProxyDoNotDisturb {
+			if err := w.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("proxy_do_not_disturb[%d]: %v", i, err))
+				continue
+			}
+			c.DoNotDisturb = append(c.DoNotDisturb, w)
+		}
+	}
+	if len(c.Experiments) == 0 {
+		seen := map[string]bool{}
+		for i, e := range oc.ProxyExperiments {
+			err := e.validate()
+			if err == nil && (seen["name "+e.Name] || seen["model "+e.Model]) {
+				err = fmt.Errorf("another experiment has the name %q or the model %q", e.Name, e.Model)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("proxy_experiments[%d]: %v", i, err))
+				continue
+			}
+			seen["name "+e.Name], seen["model "+e.Model] = true, true
+			c.Experiments = append(c.Experiments, e)
+		}
+	}
+	if c.Annotations == nil && oc.ProxyRequestAnnotations != nil {
+		if err := oc.ProxyRequestAnnotations.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("proxy_request_annotations: %v", err))
+		} else {
+			c.Annotations = oc.ProxyRequestAnnotations
+		}
+	}
+	if oc.ProxyReauthAutoOpen == "never" {
+		if c.ReauthAutoOpen == 0 {
+			c.ReauthAutoOpen = -1
+		}
+	} else {
+		setDuration(&c.ReauthAutoOpen, "proxy_reauth_auto_open", oc.ProxyReauthAutoOpen)
+	}
+	if c.TLSPolicy == nil {
+		if p, err := tlspolicy.New(oc.TLSMinVersion, oc.TLSCipherSuites); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			c.TLSPolicy = p
+		}
+	}
+	if c.CallbackPort == 0 {
+		c.CallbackPort = oc.CallbackPort
+	}
+	if len(c.RedirectURIs) == 0 {
+		c.RedirectURIs = oc.RedirectURIs
+	}
+	if len(c.CallbackPorts) == 0 {
+		c.CallbackPorts = oc.CallbackPorts
+	}
+	if c.ProxyPort == 0 {
+		c.ProxyPort = oc.ProxyPort
+	}
+	if len(c.AllowedModels) == 0 {
+		c.AllowedModels = oc.ProxyAllowedModels
+	}
+	if len(c.ModelAliases) == 0 && len(oc.ProxyModelAliases) > 0 {
+		if err := checkModelAliases(oc.ProxyModelAliases); err != nil {
+			errs = append(errs, fmt.Sprintf("proxy_model_aliases: %v", err))
+		} else {
+			c.ModelAliases = oc.ProxyModelAliases
+		}
+	}
+	if c.Guardrails == (Guardrails{}) && oc.ProxyGuardrails != nil {
+		g := *oc.ProxyGuardrails
+		if g.MaxTokens < 0 || g.MaxContextTokens < 0 || g.DailyTokenBudget < 0 {
+			errs = append(errs, "proxy_guardrails limits must not be negative")
+		} else {
+			c.Guardrails = g
+		}
+	}
+	if c.UsageBudget == 0 {
+		if oc.UsageBudget < 0 {
+			errs = append(errs, "usage_budget must not be negative")
+		} else {
+			c.UsageBudget = oc.UsageBudget
+		}
+	}
+	if c.QuotaWarnPercent == 0 {
+		if oc.ProxyQuotaWarnPercent > 100 {
+			errs = append(errs, "proxy_quota_warn_percent must be at most 100")
+		} else {
+			c.QuotaWarnPercent = oc.ProxyQuotaWarnPercent
+		}
+	}
+	if c.Workspace == "" && oc.Workspace != "" {
+		if err := oc.CheckWorkspace(oc.Workspace); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			c.Workspace = oc.Workspace
+		}
+	}
+	if c.Watchdog == (Watchdog{}) && oc.ProxyWatchdog != nil {
+		w := *oc.ProxyWatchdog
+		if w.MaxGoroutines < 0 || w.MaxHeapMB < 0 || w.MaxOpenFiles < 0 {
+			errs = append(errs, "proxy_watchdog limits must not be negative")
+		} else {
+			c.Watchdog = w
+		}
+	}
+	if c.DeviceAssertion == "" {
+		switch oc.ProxyDeviceAssertion {
+		case "", "request", "session", "off":
+			c.DeviceAssertion = oc.ProxyDeviceAssertion
+		default:
+			errs = append(errs, fmt.Sprintf("proxy_device_assertion %q is not request, session or off", oc.ProxyDeviceAssertion))
+		}
+	}
+	if c.ExpiredTokens == "" {
+		switch oc.ProxyExpiredTokens {
+		case "", "reject", "forward":
+			c.ExpiredTokens = oc.ProxyExpiredTokens
+		default:
+			errs = append(errs, fmt.Sprintf("proxy_expired_tokens %q is not reject or forward", oc.ProxyExpiredTokens))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-// SaveOpenCodeConfig writes the config back to ~/.opencode/config.json.
+// SaveOpenCodeConfig writes the config to ~/.opencode/config.json. Callers
+// editing the config should start from LoadUserConfig so that system and
+// project settings are not copied into the user layer. A plaintext api_key
+// is encrypted when ConfigRecipient is set.
 func SaveOpenCodeConfig(cfg *OpenCodeConfig) error {
 	configPath := ConfigPath()
+	cfg, err := cfg.sealSecrets()
+	if err != nil {
+		return err
+	}
 
 	dir := filepath.Dir(configPath)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -165,29 +1193,188 @@ func SaveOpenCodeConfig(cfg *OpenCodeConfig) error {
 
 // ConfigPath returns the path to the opencode config file.
 func ConfigPath() string {
-	home, err := os.UserHomeDir()
+	return filepath.Join(defaultConfigDir(), "config.json")
+}
+
+// Apply fills fields of c that were not set by flags or env vars from the
+// config file. Invalid tunables are skipped and reported in the error; the
+// other values are applied regardless.
+func (oc *OpenCodeConfig) Apply(c *Config) error {
+	if c.ClientID == "" {
+		c.ClientID = oc.ClientID
+	}
+	if c.APIEndpoint == "" {
+		c.APIEndpoint = oc.APIEndpoint
+	}
+	if c.APIKey == "" {
+		c.APIKey = oc.APIKey
+	}
+	if c.APIKeyRef == "" {
+		c.APIKeyRef = oc.APIKeyRef
+	}
+	if c.APIKeyCmd == "" {
+		c.APIKeyCmd = oc.APIKeyCmd
+	}
+	if c.AuthMode == "" {
+		c.AuthMode = oc.AuthMode
+	}
+	if c.StaticToken == "" {
+		c.StaticToken = oc.StaticToken
+	}
+	if c.StaticTokenRef == "" {
+		c.StaticTokenRef = oc.StaticTokenRef
+	}
+	if c.TokenStorage == "" {
+		c.TokenStorage = oc.TokenStorage
+	}
+	if c.Issuer == "" {
+		c.Issuer = oc.Issuer
+	}
+	if c.AuthorizeEndpoint == "" {
+		c.AuthorizeEndpoint = oc.AuthorizeEndpoint
+	}
+	if c.TokenEndpoint == "" {
+		c.TokenEndpoint = oc.TokenEndpoint
+	}
+	if c.VersionCheckURL == "" {
+		c.VersionCheckURL = oc.VersionCheckURL
+	}
+	if c.UpdateDownloadBase == "" {
+		c.UpdateDownloadBase = oc.UpdateDownloadBase
+	}
+	if c.ConfigPatchURL == "" {
+		c.ConfigPatchURL = oc.ConfigPatchURL
+	}
+	if c.Profile == "" && oc.Profile != nil {
+		c.Profile = oc.Profile.Name
+	}
+	if len(c.AllowedProcesses) == 0 {
+		c.AllowedProcesses = oc.ProxyAllowedProcesses
+	}
+	if len(c.Audiences) == 0 {
+		c.Audiences = oc.TokenAudiences
+	}
+	if len(c.AuthHeaders) == 0 {
+		c.AuthHeaders = oc.ProxyAuthHeaders
+	}
+	if c.LoginHint == "" {
+		c.LoginHint = oc.LoginHint
+	}
+	if len(c.LoginEmailDomains) == 0 {
+		c.LoginEmailDomains = oc.LoginEmailDomains
+	}
+	if len(c.AlternateEndpoints) == 0 {
+		c.AlternateEndpoints = oc.AlternateEndpoints
+	}
+	if len(c.HostOverrides) == 0 {
+		c.HostOverrides = oc.HostOverrides
+	}
+	if c.AcceptEncoding == "" {
+		c.AcceptEncoding = oc.ProxyAcceptEncoding
+	}
+	if !c.Decompress {
+		c.Decompress = oc.ProxyDecompress
+	}
+	if c.ForwardedHeaders == "" {
+		c.ForwardedHeaders = oc.ProxyForwardedHeaders
+	}
+	if len(c.ClientHeaders) == 0 {
+		c.ClientHeaders = oc.ProxyClientHeaders
+	}
+	if !c.TokenAudit {
+		c.TokenAudit = oc.TokenAudit
+	}
+	if c.DeviceKeyStore == "" {
+		c.DeviceKeyStore = oc.DeviceKeyStore
+	}
+	if !c.RequestHistory {
+		c.RequestHistory = oc.ProxyHistory
+	}
+	if c.OTelEndpoint == "" {
+		c.OTelEndpoint = oc.OTelEndpoint
+	}
+	if len(c.OTelHeaders) == 0 {
+		c.OTelHeaders = oc.OTelHeaders
+	}
+	if c.ObserverListen == "" {
+		c.ObserverListen = oc.ProxyObserverListen
+	}
+	if c.ObserverToken == "" {
+		c.ObserverToken = oc.ProxyObserverToken
+	}
+	if oc.Hooks != nil && len(c.Hooks.PreLaunch) == 0 && len(c.Hooks.PostExit) == 0 {
+		c.Hooks = *oc.Hooks
+	}
+	if c.OpenCodePath == "" {
+		c.OpenCodePath = oc.OpenCodePath
+	}
+	return oc.ApplyTunables(c)
+}
+
+// Load returns the configuration the CLI runs with when no flags are given:
+// environment variables, then the installer config layers. When only
+// tunables are invalid, Load returns the config along with the error.
+func Load() (*Config, error) {
+	c := DefaultConfig()
+	oc, err := LoadOpenCodeConfig()
 	if err != nil {
-		return ".opencode/config.json"
+		return nil, err
 	}
-	return filepath.Join(home, ".opencode", "config.json")
+	return c, oc.Apply(c)
 }
 
-// LoadOpenCodeConfig loads the installer config from ~/.opencode/config.json.
+// LoadOpenCodeConfig loads the installer config, merging the system,
+// user (~/.opencode/config.json), and project (.opencode/config.json in or
+// above the working directory) layers in increasing precedence.
 func LoadOpenCodeConfig() (*OpenCodeConfig, error) {
-	configPath := ConfigPath()
-
-	data, err := os.ReadFile(configPath)
+	merged, layers, sources, err := loadLayers()
 	if err != nil {
-		return nil, fmt.Errorf("config not found at %s: %w", configPath, err)
+		return nil, err
+	}
+	found := false
+	for _, l := range layers {
+		found = found || l.Found
+		traceLayer(l)
+	}
+	if tracelog.Enabled() {
+		keys := make([]string, 0, len(sources))
+		for key := range sources {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			tracelog.Printf("config: %s from the %s layer", key, sources[key])
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("config not found at %s", ConfigPath())
 	}
 
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
 	var config OpenCodeConfig
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
-	if config.ClientID == "" {
-		return nil, fmt.Errorf("client_id not set in config")
+	switch config.AuthMode {
+	case "", AuthModeOIDC:
+		if config.ClientID == "" {
+			return nil, fmt.Errorf("client_id not set in config")
+		}
+	case AuthModeStatic:
+	default:
+		return nil, fmt.Errorf("auth_mode %q is not one of %q or %q", config.AuthMode, AuthModeOIDC, AuthModeStatic)
+	}
+	switch config.TokenStorage {
+	case "", TokenStorageFile, TokenStorageMemory:
+	default:
+		return nil, fmt.Errorf("token_storage %q is not one of %q or %q", config.TokenStorage, TokenStorageFile, TokenStorageMemory)
+	}
+	if err := config.openSecrets(); err != nil {
+		return nil, err
 	}
 
 	return &config, nil
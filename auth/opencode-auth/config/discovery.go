@@ -0,0 +1,256 @@
+// Package config provides OIDC discovery with bounded retries: each attempt
+// has its own timeout, connection failures are retried over IPv4 and then
+// IPv6 in case one of them is broken, and a failure says whether DNS, the
+// connection, TLS, or the issuer's answer was the problem.
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
+)
+
+const (
+	// discoveryAttempts bounds the requests DiscoverEndpoints makes
+	discoveryAttempts = 3
+
+	// discoveryAttemptTimeout bounds each request
+	discoveryAttemptTimeout = 4 * time.Second
+)
+
+// discoveryBackoff is the wait before the second attempt; it doubles after
+// each further one. A variable so tests don't wait.
+var discoveryBackoff = 500 * time.Millisecond
+
+// Kinds of DiscoveryError.
+const (
+	DiscoveryDNS      = "dns"      // the issuer's host did not resolve
+	DiscoveryConnect  = "connect"  // no connection to the issuer
+	DiscoveryTLS      = "tls"      // TLS handshake or certificate failed
+	DiscoveryTimeout  = "timeout"  // no answer within an attempt's timeout
+	DiscoveryHTTP     = "http"     // the issuer answered with an error status
+	DiscoveryResponse = "response" // the answer is not a usable discovery document
+)
+
+// DiscoveryError is a failed OIDC discovery.
+type DiscoveryError struct {
+	URL      string
+	Kind     string // one of the Discovery* kinds
+	Status   int    // for DiscoveryHTTP
+	Attempts int
+	Err      error
+}
+
+func (e *DiscoveryError) Error() string {
+	var hint string
+	switch e.Kind {
+	case DiscoveryDNS:
+		hint = "the issuer's host name did not resolve; check issuer in config.json, your network and VPN"
+	case DiscoveryConnect:
+		hint = "could not connect to the issuer; check your network, firewall, or HTTPS_PROXY"
+	case DiscoveryTLS:
+		hint = "the TLS handshake with the issuer failed; a proxy that inspects TLS needs its CA in the system trust store"
+	case DiscoveryTimeout:
+		hint = "the issuer did not answer in time"
+	case DiscoveryHTTP:
+		hint = fmt.Sprintf("the issuer answered HTTP %d; check issuer in config.json", e.Status)
+	default:
+		hint = "the issuer's answer is not a usable discovery document"
+	}
+	attempts := ""
+	if e.Attempts > 1 {
+		attempts = fmt.Sprintf(", %d attempts", e.Attempts)
+	}
+	// The URL is given once
+	cause := e.Err
+	var urlErr *url.Error
+	if errors.As(cause, &urlErr) {
+		cause = urlErr.Err
+	}
+	return fmt.Sprintf("%s (GET %s%s: %v)", hint, e.URL, attempts, cause)
+}
+
+func (e *DiscoveryError) Unwrap() error { return e.Err }
+
+// Retryable reports whether the same discovery may succeed later.
+func (e *DiscoveryError) Retryable() bool {
+	switch e.Kind {
+	case DiscoveryDNS, DiscoveryConnect, DiscoveryTimeout:
+		return true
+	case DiscoveryHTTP:
+		return e.Status == http.StatusTooManyRequests || e.Status >= 500
+	}
+	return false
+}
+
+// discoveryErrorKind classifies the error of a request that got no answer.
+func discoveryErrorKind(err error) string {
+	var (
+		dnsErr      *net.DNSError
+		certErr     *tls.CertificateVerificationError
+		unknownCA   x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+		recordErr   tls.RecordHeaderError
+		netErr      net.Error
+		opErr       *net.OpError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return DiscoveryDNS
+	case errors.As(err, &certErr), errors.As(err, &unknownCA), errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr), errors.As(err, &recordErr):
+		return DiscoveryTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return DiscoveryTimeout
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		return DiscoveryTLS
+	default:
+		return DiscoveryConnect
+	}
+}
+
+// discoveryNetwork returns the network of an attempt: both families at
+// first, then only IPv4 and only IPv6 after the connection failed, in case
+// one of them is broken on this network.
+func discoveryNetwork(attempt int, lastKind string) string {
+	if lastKind != DiscoveryConnect && lastKind != DiscoveryTimeout {
+		return "tcp"
+	}
+	if attempt%2 == 0 {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// DiscoverEndpoints uses OIDC Discovery to populate AuthorizeEndpoint and
+// TokenEndpoint from the Issuer's .well-known/openid-configuration endpoint.
+// It only fetches if AuthorizeEndpoint or TokenEndpoint are not already set.
+// Failures are returned as *DiscoveryError; ones that may pass are retried
+// up to discoveryAttempts times.
+func (c *Config) DiscoverEndpoints(ctx context.Context) error {
+	if c.Issuer == "" {
+		tracelog.Printf("discovery: skipped, no issuer")
+		return nil // Nothing to discover from
+	}
+
+	if c.AuthorizeEndpoint != "" && c.TokenEndpoint != "" {
+		tracelog.Printf("discovery: skipped, authorize and token endpoints are configured")
+		return nil // Already configured
+	}
+
+	discoveryURL := c.Issuer + "/.well-known/openid-configuration"
+
+	var last *DiscoveryError
+	backoff := discoveryBackoff
+	for attempt := 1; attempt <= discoveryAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return last
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		network := "tcp"
+		if last != nil {
+			network = discoveryNetwork(attempt, last.Kind)
+		}
+
+		tracelog.Printf("discovery: attempt %d over %s", attempt, network)
+		discovery, err := fetchDiscovery(ctx, discoveryURL, network)
+		if err == nil {
+			return c.applyDiscovery(discovery)
+		}
+		var derr *DiscoveryError
+		if !errors.As(err, &derr) {
+			return err
+		}
+		// A host without addresses of the family tried says nothing new
+		// about the problem
+		var addrErr *net.AddrError
+		if last != nil && network != "tcp" && (derr.Kind == DiscoveryDNS || errors.As(err, &addrErr)) {
+			derr = last
+		}
+		derr.Attempts = attempt
+		last = derr
+		if !derr.Retryable() || ctx.Err() != nil {
+			tracelog.Printf("discovery: giving up after %s failure: %v", derr.Kind, err)
+			break
+		}
+		tracelog.Printf("discovery: %s failure, retrying: %v", derr.Kind, err)
+	}
+	return last
+}
+
+// discoveryDocument is the part of the discovery document that is used.
+type discoveryDocument struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// fetchDiscovery makes one discovery request over network ("tcp", "tcp4" or
+// "tcp6").
+func fetchDiscovery(ctx context.Context, discoveryURL, network string) (*discoveryDocument, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryAttemptTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", discoveryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery request: %w", err)
+	}
+
+	dialer := &net.Dialer{}
+	transport := tracelog.Unwrap(http.DefaultTransport).(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: tracelog.Wrap(transport)}).Do(req)
+	if err != nil {
+		return nil, &DiscoveryError{URL: discoveryURL, Kind: discoveryErrorKind(err), Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &DiscoveryError{URL: discoveryURL, Kind: DiscoveryHTTP, Status: resp.StatusCode,
+			Err: fmt.Errorf("status %d: %s", resp.StatusCode, string(body))}
+	}
+
+	var discovery discoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, &DiscoveryError{URL: discoveryURL, Kind: DiscoveryResponse, Err: fmt.Errorf("failed to parse OIDC discovery response: %w", err)}
+	}
+	return &discovery, nil
+}
+
+// applyDiscovery sets the endpoints that are not configured from discovery.
+func (c *Config) applyDiscovery(discovery *discoveryDocument) error {
+	if c.AuthorizeEndpoint == "" {
+		if discovery.AuthorizationEndpoint == "" {
+			return fmt.Errorf("OIDC discovery response missing authorization_endpoint")
+		}
+		c.AuthorizeEndpoint = discovery.AuthorizationEndpoint
+	}
+
+	if c.TokenEndpoint == "" {
+		if discovery.TokenEndpoint == "" {
+			return fmt.Errorf("OIDC discovery response missing token_endpoint")
+		}
+		c.TokenEndpoint = discovery.TokenEndpoint
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiscoverEndpoints(t *testing.T) {
+	discoveryBackoff = time.Millisecond
+	defer func() { discoveryBackoff = 500 * time.Millisecond }()
+
+	for _, tc := range []struct {
+		name     string
+		handler  func(n int32, w http.ResponseWriter)
+		kind     string
+		requests int32
+	}{
+		{"retried until it succeeds", func(n int32, w http.ResponseWriter) {
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"authorization_endpoint":"https://idp/authorize","token_endpoint":"https://idp/token"}`)
+		}, "", 2},
+		{"server errors", func(n int32, w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }, DiscoveryHTTP, discoveryAttempts},
+		{"wrong issuer", func(n int32, w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) }, DiscoveryHTTP, 1},
+		{"not a discovery document", func(n int32, w http.ResponseWriter) { fmt.Fprint(w, "<html>") }, DiscoveryResponse, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.handler(atomic.AddInt32(&requests, 1), w)
+			}))
+			defer idp.Close()
+
+			c := &Config{Issuer: idp.URL}
+			err := c.DiscoverEndpoints(context.Background())
+			var derr *DiscoveryError
+			if tc.kind == "" {
+				if err != nil || c.TokenEndpoint != "https://idp/token" {
+					t.Errorf("DiscoverEndpoints() = %v, token endpoint %q", err, c.TokenEndpoint)
+				}
+			} else if !errors.As(err, &derr) || derr.Kind != tc.kind {
+				t.Errorf("DiscoverEndpoints() = %v, want a %s error", err, tc.kind)
+			}
+			if got := atomic.LoadInt32(&requests); got != tc.requests {
+				t.Errorf("%d requests, want %d", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestDiscoverEndpoints_Network(t *testing.T) {
+	discoveryBackoff = time.Millisecond
+	defer func() { discoveryBackoff = 500 * time.Millisecond }()
+
+	// An untrusted certificate is not retried
+	idp := httptest.NewTLSServer(http.NotFoundHandler())
+	c := &Config{Issuer: idp.URL}
+	var derr *DiscoveryError
+	if err := c.DiscoverEndpoints(context.Background()); !errors.As(err, &derr) || derr.Kind != DiscoveryTLS || derr.Attempts != 1 {
+		t.Errorf("DiscoverEndpoints() with an untrusted certificate = %v", err)
+	}
+	idp.Close()
+
+	// Nothing listening: retried, also over each address family
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &Config{Issuer: "http://" + l.Addr().String()}
+	l.Close()
+	if err := c.DiscoverEndpoints(context.Background()); !errors.As(err, &derr) || derr.Kind != DiscoveryConnect || derr.Attempts != discoveryAttempts {
+		t.Errorf("DiscoverEndpoints() with nothing listening = %v", err)
+	}
+	if got := discoveryNetwork(2, DiscoveryConnect) + "," + discoveryNetwork(3, DiscoveryTimeout) + "," + discoveryNetwork(2, DiscoveryHTTP); got != "tcp4,tcp6,tcp" {
+		t.Errorf("networks = %s", got)
+	}
+
+	if kind := discoveryErrorKind(fmt.Errorf("Get: %w", &net.DNSError{Err: "no such host", Name: "idp.invalid", IsNotFound: true})); kind != DiscoveryDNS {
+		t.Errorf("DNS error classified as %s", kind)
+	}
+}
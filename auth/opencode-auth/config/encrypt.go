@@ -0,0 +1,51 @@
+// Package config provides encryption of the API key in config.json, enabled
+// with 'opencode-auth config encrypt'.
+package config
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/secret"
+)
+
+// keychainTimeout bounds the keychain lookup for the config key.
+const keychainTimeout = 10 * time.Second
+
+// openSecrets decrypts an encrypted api_key with the config key from the
+// keychain.
+func (oc *OpenCodeConfig) openSecrets() error {
+	if !secret.IsSealed(oc.APIKey) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keychainTimeout)
+	defer cancel()
+	key, err := secret.ConfigKey(ctx)
+	if err != nil {
+		return fmt.Errorf("api_key is encrypted but the config key is unavailable: %w", err)
+	}
+	apiKey, err := secret.Open(key, "api_key", oc.APIKey)
+	if err != nil {
+		return err
+	}
+	oc.APIKey = apiKey
+	return nil
+}
+
+// sealSecrets returns a copy of oc with a plaintext api_key encrypted to
+// ConfigRecipient, or oc itself when there is nothing to encrypt.
+func (oc *OpenCodeConfig) sealSecrets() (*OpenCodeConfig, error) {
+	if oc.ConfigRecipient == "" || oc.APIKey == "" || secret.IsSealed(oc.APIKey) {
+		return oc, nil
+	}
+	recipient, err := secret.DecodePublicKey(oc.ConfigRecipient)
+	if err != nil {
+		return nil, fmt.Errorf("config_recipient: %w", err)
+	}
+	sealed := *oc
+	if sealed.APIKey, err = secret.Seal(recipient, "api_key", oc.APIKey); err != nil {
+		return nil, fmt.Errorf("failed to encrypt api_key: %w", err)
+	}
+	return &sealed, nil
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
+)
+
+// Config layers, lowest precedence first. Each layer's keys override the
+// same keys from the layers before it.
+const (
+	LayerSystem  = "system"
+	LayerUser    = "user"
+	LayerProject = "project"
+)
+
+// projectKeys are the config.json keys a project layer may set. A checked-out
+// repository is not trusted with credentials, commands, or auth endpoints;
+// api_endpoint is further restricted by trustedEndpoint. alternate_endpoints
+// is what makes an endpoint trusted, so a project may not set it.
+var projectKeys = map[string]bool{
+	"api_endpoint":          true,
+	"proxy_accept_encoding": true,
+	"proxy_decompress":      true,
+	"http_timeout":          true,
+}
+
+// Layer describes one config.json in the lookup chain.
+type Layer struct {
+	Name  string
+	Path  string
+	Found bool
+	// Keys the layer sets that take part in the merge
+	Keys []string
+	// Ignored maps keys the layer may not set to the reason
+	Ignored map[string]string
+}
+
+// SystemConfigPath returns the machine-wide config path, overridable with
+// OPENCODE_SYSTEM_CONFIG.
+func SystemConfigPath() string {
+	if p := os.Getenv("OPENCODE_SYSTEM_CONFIG"); p != "" {
+		return p
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "opencode", "config.json")
+	}
+	return "/etc/opencode/config.json"
+}
+
+// ProjectDir returns the nearest directory at or above the working directory
+// that contains .opencode/config.json, or "" if there is none. The search
+// stops before the home directory, whose .opencode is the user layer.
+// OPENCODE_PROJECT_DIR pins the project directory (the background proxy is
+// started with it so it sees the same layers as the command that launched it).
+func ProjectDir() string {
+	if dir := os.Getenv("OPENCODE_PROJECT_DIR"); dir != "" {
+		return dir
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	home, _ := os.UserHomeDir()
+	stateDir, _ := StateDir()
+	for {
+		if dir == home {
+			return ""
+		}
+		// A state directory named .opencode is the user layer, not a project's
+		if filepath.Join(dir, ".opencode") == stateDir {
+			return ""
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".opencode", "config.json")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// layerPaths returns the config files to merge, lowest precedence first.
+func layerPaths() []Layer {
+	layers := []Layer{
+		{Name: LayerSystem, Path: SystemConfigPath()},
+		{Name: LayerUser, Path: ConfigPath()},
+	}
+	if dir := ProjectDir(); dir != "" {
+		layers = append(layers, Layer{Name: LayerProject, Path: filepath.Join(dir, ".opencode", "config.json")})
+	}
+	return layers
+}
+
+// ConfigPaths returns every config file that can contribute settings, for
+// change detection.
+func ConfigPaths() []string {
+	var paths []string
+	for _, l := range layerPaths() {
+		paths = append(paths, l.Path)
+	}
+	return paths
+}
+
+// loadLayers reads and merges the config layers. It returns the merged raw
+// keys, the layers as read, and which layer each merged key came from.
+func loadLayers() (map[string]json.RawMessage, []Layer, map[string]string, error) {
+	merged := make(map[string]json.RawMessage)
+	sources := make(map[string]string)
+	layers := layerPaths()
+
+	for i := range layers {
+		l := &layers[i]
+		data, err := os.ReadFile(l.Path)
+		if err != nil {
+			continue
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to parse %s config %s: %w", l.Name, l.Path, err)
+		}
+		l.Found = true
+
+		// The endpoints a project may choose from are those of the system
+		// and user layers, fixed before any project key is merged
+		var trusted map[string]json.RawMessage
+		if l.Name == LayerProject {
+			trusted = map[string]json.RawMessage{
+				"api_endpoint":        merged["api_endpoint"],
+				"alternate_endpoints": merged["alternate_endpoints"],
+			}
+		}
+		for key, val := range raw {
+			if l.Name == LayerProject {
+				if reason := projectRejects(key, val, trusted); reason != "" {
+					if l.Ignored == nil {
+						l.Ignored = make(map[string]string)
+					}
+					l.Ignored[key] = reason
+					continue
+				}
+			}
+			merged[key] = val
+			sources[key] = l.Name
+			l.Keys = append(l.Keys, key)
+		}
+		sort.Strings(l.Keys)
+	}
+
+	return merged, layers, sources, nil
+}
+
+// traceLayer writes where a layer was looked for, and the keys it may not
+// set, to the trace.
+func traceLayer(l Layer) {
+	if !l.Found {
+		tracelog.Printf("config: %s layer %s not found", l.Name, l.Path)
+		return
+	}
+	tracelog.Printf("config: %s layer %s sets %d keys", l.Name, l.Path, len(l.Keys))
+	for key, reason := range l.Ignored {
+		tracelog.Printf("config: %s layer's %s ignored: %s", l.Name, key, reason)
+	}
+}
+
+// projectRejects returns why a project layer may not set key, or "".
+func projectRejects(key string, val json.RawMessage, trusted map[string]json.RawMessage) string {
+	if !projectKeys[key] {
+		return "not allowed in project config"
+	}
+	if key == "api_endpoint" {
+		var endpoint string
+		json.Unmarshal(val, &endpoint)
+		if !trustedEndpoint(endpoint, trusted) {
+			return "must match api_endpoint or alternate_endpoints from the user or system config"
+		}
+	}
+	return ""
+}
+
+// trustedEndpoint reports whether endpoint is the api_endpoint or one of the
+// alternate_endpoints configured outside the project. Tokens are sent to the
+// endpoint, so a repository may only choose among endpoints the user trusts.
+func trustedEndpoint(endpoint string, trusted map[string]json.RawMessage) bool {
+	var current string
+	var alternates []string
+	json.Unmarshal(trusted["api_endpoint"], &current)
+	json.Unmarshal(trusted["alternate_endpoints"], &alternates)
+
+	if endpoint == current {
+		return true
+	}
+	for _, alt := range alternates {
+		if endpoint == alt {
+			return true
+		}
+	}
+	return false
+}
+
+// Setting is an effective config.json key and the layer it comes from.
+type Setting struct {
+	Key   string
+	Layer string
+	Value json.RawMessage
+}
+
+// ConfigLayers returns the config layers with what each contributes, and the
+// effective settings sorted by key.
+func ConfigLayers() ([]Layer, []Setting, error) {
+	merged, layers, sources, err := loadLayers()
+	if err != nil {
+		return nil, nil, err
+	}
+	settings := make([]Setting, 0, len(merged))
+	for key, val := range merged {
+		settings = append(settings, Setting{Key: key, Layer: sources[key], Value: val})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return layers, settings, nil
+}
+
+// LoadUserConfig loads only ~/.opencode/config.json, for commands that edit
+// and save it. A missing file yields an empty config.
+func LoadUserConfig() (*OpenCodeConfig, error) {
+	var config OpenCodeConfig
+	data, err := os.ReadFile(ConfigPath())
+	if os.IsNotExist(err) {
+		return &config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	return &config, nil
+}
+
+// CheckFile checks one config layer file on its own: that it parses and
+// that its tunables are valid. Config patches are rolled back when they
+// make it fail.
+func CheckFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config OpenCodeConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	// An empty Config, so no environment variable shadows a file value
+	return config.ApplyTunables(&Config{})
+}
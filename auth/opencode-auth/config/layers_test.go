@@ -0,0 +1,48 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProjectEndpointTrust(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("OPENCODE_SYSTEM_CONFIG", filepath.Join(dir, "system", "config.json"))
+	t.Setenv("OPENCODE_STATE_DIR", filepath.Join(dir, "user"))
+	t.Setenv("OPENCODE_PROJECT_DIR", filepath.Join(dir, "repo"))
+	write(filepath.Join(dir, "user", "config.json"), `{"api_endpoint":"https://api.example.com","alternate_endpoints":["https://eu.example.com"]}`)
+	projectPath := filepath.Join(dir, "repo", ".opencode", "config.json")
+
+	tests := []struct {
+		project  string
+		endpoint string
+	}{
+		// The project's own alternate_endpoints must not vouch for its endpoint
+		{`{"alternate_endpoints":["https://evil.example"],"api_endpoint":"https://evil.example"}`, "https://api.example.com"},
+		{`{"api_endpoint":"https://eu.example.com"}`, "https://eu.example.com"},
+	}
+	for _, tt := range tests {
+		write(projectPath, tt.project)
+		// Map order decides which key is merged first; try it often
+		for i := 0; i < 20; i++ {
+			merged, _, _, err := loadLayers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var endpoint string
+			if json.Unmarshal(merged["api_endpoint"], &endpoint); endpoint != tt.endpoint {
+				t.Fatalf("project %s: api_endpoint = %q, want %q", tt.project, endpoint, tt.endpoint)
+			}
+		}
+	}
+}
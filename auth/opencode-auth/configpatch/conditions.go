@@ -0,0 +1,81 @@
+package configpatch
+
+import (
+	"fmt"
+
+	versionpkg "github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/version"
+)
+
+// Conditions restrict a PatchSpec to matching clients, so a change for one
+// platform or client range doesn't reach the others. Each non-empty field
+// must match; a spec without conditions applies everywhere.
+type Conditions struct {
+	// OS and Arch list GOOS and GOARCH values (e.g. "darwin", "arm64").
+	OS   []string `json:"os,omitempty"`
+	Arch []string `json:"arch,omitempty"`
+
+	// MinVersion and MaxVersion bound the client version, inclusive.
+	// Development builds satisfy any bound.
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+
+	// Profiles lists profile names. A client without a profile never
+	// matches a profiles condition.
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// Target describes the client a patch is evaluated for.
+type Target struct {
+	OS            string
+	Arch          string
+	ClientVersion string
+	Profile       string
+}
+
+// Match reports whether t satisfies the conditions and, if not, why. A nil
+// *Conditions matches every client.
+func (c *Conditions) Match(t Target) (bool, string) {
+	if c == nil {
+		return true, ""
+	}
+	if len(c.OS) > 0 && !contains(c.OS, t.OS) {
+		return false, fmt.Sprintf("os %s not in %v", t.OS, c.OS)
+	}
+	if len(c.Arch) > 0 && !contains(c.Arch, t.Arch) {
+		return false, fmt.Sprintf("arch %s not in %v", t.Arch, c.Arch)
+	}
+	if len(c.Profiles) > 0 && !contains(c.Profiles, t.Profile) {
+		return false, fmt.Sprintf("profile %q not in %v", t.Profile, c.Profiles)
+	}
+	if versionpkg.IsDev(t.ClientVersion) {
+		return true, ""
+	}
+	if c.MinVersion != "" {
+		cmp, err := versionpkg.Compare(t.ClientVersion, c.MinVersion)
+		if err != nil {
+			return false, fmt.Sprintf("cannot compare version with min_version: %v", err)
+		}
+		if cmp < 0 {
+			return false, fmt.Sprintf("version %s below min_version %s", t.ClientVersion, c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		cmp, err := versionpkg.Compare(t.ClientVersion, c.MaxVersion)
+		if err != nil {
+			return false, fmt.Sprintf("cannot compare version with max_version: %v", err)
+		}
+		if cmp > 0 {
+			return false, fmt.Sprintf("version %s above max_version %s", t.ClientVersion, c.MaxVersion)
+		}
+	}
+	return true, ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
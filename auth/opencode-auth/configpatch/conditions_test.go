@@ -0,0 +1,51 @@
+package configpatch
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConditionsMatch(t *testing.T) {
+	mac := Target{OS: "darwin", Arch: "arm64", ClientVersion: "1.4.0"}
+	tests := []struct {
+		name  string
+		cond  *Conditions
+		t     Target
+		match bool
+	}{
+		{"nil", nil, mac, true},
+		{"os match", &Conditions{OS: []string{"darwin"}}, mac, true},
+		{"os mismatch", &Conditions{OS: []string{"linux", "windows"}}, mac, false},
+		{"arch mismatch", &Conditions{Arch: []string{"amd64"}}, mac, false},
+		{"in version range", &Conditions{MinVersion: "1.4.0", MaxVersion: "1.5.2"}, mac, true},
+		{"below min", &Conditions{MinVersion: "1.4.1"}, mac, false},
+		{"above max", &Conditions{MaxVersion: "1.3.9"}, mac, false},
+		{"invalid bound", &Conditions{MinVersion: "latest"}, mac, false},
+		{"dev build ignores bounds", &Conditions{MinVersion: "9.0.0"}, Target{OS: "darwin", ClientVersion: "dev"}, true},
+		{"dev build still checks os", &Conditions{OS: []string{"linux"}}, Target{OS: "darwin", ClientVersion: "dev"}, false},
+		{"profile match", &Conditions{Profiles: []string{"team-x"}}, Target{Profile: "team-x", ClientVersion: "1.0.0"}, true},
+		{"no profile", &Conditions{Profiles: []string{"team-x"}}, mac, false},
+	}
+	for _, tt := range tests {
+		if got, reason := tt.cond.Match(tt.t); got != tt.match {
+			t.Errorf("%s: Match() = %v (%s), want %v", tt.name, got, reason, tt.match)
+		}
+	}
+}
+
+func TestPatchSpec_ConditionsJSON(t *testing.T) {
+	var p PatchResponse
+	body := `{"config_version":7,"patches":{
+		"opencode.json":{"set":{"k":"v"},"conditions":{"os":["darwin"],"min_version":"1.2.0"}},
+		"config.json":{"set":{"k":"v"}}}}`
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		t.Fatal(err)
+	}
+	c := p.Patches["opencode.json"].Conditions
+	if c == nil || len(c.OS) != 1 || c.OS[0] != "darwin" || c.MinVersion != "1.2.0" {
+		t.Errorf("conditions = %+v", c)
+	}
+	if p.Patches["config.json"].Conditions != nil {
+		t.Error("expected nil conditions when absent")
+	}
+}
@@ -0,0 +1,196 @@
+// Package configpatch provides the patch history of a config file: the value
+// each key had before the first patch that changed it, so the keys patches
+// manage can be reverted, e.g. by 'opencode-auth uninstall'.
+package configpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// historyEntry is one key a patch changed, as path segments, and its value
+// before the first patch that changed it.
+type historyEntry struct {
+	Path   []string        `json:"path"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Absent bool            `json:"absent,omitempty"` // the key did not exist
+}
+
+// history is the file at HistoryPath.
+type history struct {
+	Keys []historyEntry `json:"keys"`
+}
+
+// HistoryPath returns the patch history of filePath.
+func HistoryPath(filePath string) string {
+	return filePath + ".patch-history.json"
+}
+
+func loadHistory(filePath string) (*history, error) {
+	data, err := os.ReadFile(HistoryPath(filePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return &history{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var h history
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", HistoryPath(filePath), err)
+	}
+	return &h, nil
+}
+
+// recordOriginals adds the keys spec changes in obj, before it is applied,
+// to filePath's history. Keys already in the history keep their first
+// value. A deep path below a missing object is recorded as that object,
+// since setDeep creates it.
+func recordOriginals(filePath string, obj map[string]interface{}, spec PatchSpec) error {
+	var paths [][]string
+	for key := range spec.Set {
+		paths = append(paths, []string{key})
+	}
+	for path := range spec.SetDeep {
+		paths = append(paths, strings.Split(path, "."))
+	}
+	for _, key := range spec.Remove {
+		paths = append(paths, []string{key})
+	}
+	for _, path := range spec.RemoveDeep {
+		paths = append(paths, strings.Split(path, "."))
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	h, err := loadHistory(filePath)
+	if err != nil {
+		return err
+	}
+	added := false
+	for _, path := range paths {
+		entry := original(obj, path)
+		if entry.Absent && removes(spec, path) {
+			continue // removing a missing key changes nothing
+		}
+		if h.covers(entry.Path) {
+			continue
+		}
+		h.Keys = append(h.Keys, entry)
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	out, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(HistoryPath(filePath), append(out, '\n'), 0600)
+}
+
+// original returns the history entry for path in obj.
+func original(obj map[string]interface{}, path []string) historyEntry {
+	current := obj
+	for i, part := range path {
+		val, ok := current[part]
+		if !ok {
+			return historyEntry{Path: path[:i+1], Absent: true}
+		}
+		if i == len(path)-1 {
+			raw, _ := json.Marshal(val)
+			return historyEntry{Path: path, Value: raw}
+		}
+		next, ok := val.(map[string]interface{})
+		if !ok {
+			// setDeep replaces a non-object with one
+			raw, _ := json.Marshal(val)
+			return historyEntry{Path: path[:i+1], Value: raw}
+		}
+		current = next
+	}
+	return historyEntry{Path: path, Absent: true}
+}
+
+// removes reports whether spec removes path.
+func removes(spec PatchSpec, path []string) bool {
+	joined := strings.Join(path, ".")
+	for _, key := range spec.Remove {
+		if len(path) == 1 && key == path[0] {
+			return true
+		}
+	}
+	for _, p := range spec.RemoveDeep {
+		if p == joined {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the history has path or one of its parents.
+func (h *history) covers(path []string) bool {
+	for _, e := range h.Keys {
+		if len(e.Path) <= len(path) && strings.Join(e.Path, "\x00") == strings.Join(path[:len(e.Path)], "\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+// Revert restores the keys in filePath's patch history to their values
+// before the first patch, removing keys that did not exist, and deletes the
+// history. Other keys, including ones added by hand, are left alone. It
+// returns the number of keys reverted; 0 without a history.
+func Revert(filePath string) (int, error) {
+	h, err := loadHistory(filePath)
+	if err != nil || len(h.Keys) == 0 {
+		return 0, err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %w", filePath, err)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", filePath, err)
+	}
+
+	// Latest first, so the earliest recorded value of a key wins
+	for i := len(h.Keys) - 1; i >= 0; i-- {
+		e := h.Keys[i]
+		path := strings.Join(e.Path, ".")
+		if e.Absent {
+			if len(e.Path) == 1 {
+				delete(obj, e.Path[0])
+			} else {
+				removeDeep(obj, path)
+			}
+			continue
+		}
+		var val interface{}
+		if err := json.Unmarshal(e.Value, &val); err != nil {
+			return 0, fmt.Errorf("parsing %s: %w", HistoryPath(filePath), err)
+		}
+		if len(e.Path) == 1 {
+			obj[e.Path[0]] = val
+		} else {
+			setDeep(obj, path, val)
+		}
+	}
+
+	out, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("marshaling %s: %w", filePath, err)
+	}
+	if err := os.WriteFile(filePath, append(out, '\n'), 0600); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(HistoryPath(filePath)); err != nil {
+		return len(h.Keys), err
+	}
+	return len(h.Keys), nil
+}
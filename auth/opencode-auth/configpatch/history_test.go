@@ -0,0 +1,68 @@
+package configpatch
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRevert(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "opencode.json")
+	original := map[string]interface{}{
+		"model":    "old-model",
+		"theme":    "dark",
+		"obsolete": true,
+		"provider": map[string]interface{}{
+			"bedrock": map[string]interface{}{"name": "Bedrock"},
+		},
+	}
+	writeJSON(t, path, original)
+
+	if n, err := Revert(path); n != 0 || err != nil {
+		t.Fatalf("Revert() without history = %d, %v", n, err)
+	}
+
+	patches := []PatchSpec{
+		{
+			Set:     map[string]interface{}{"model": "new-model", "small_model": "haiku"},
+			SetDeep: map[string]interface{}{"provider.bedrock.models.sonnet": map[string]interface{}{"name": "Sonnet"}, "mcp.docs.enabled": true},
+			Remove:  []string{"obsolete", "never-there"},
+		},
+		// A later patch keeps the first recorded value
+		{Set: map[string]interface{}{"model": "newer-model"}},
+	}
+	for _, spec := range patches {
+		if err := Apply(path, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Changed by hand after the patches: kept, as it is not managed
+	result := readJSON(t, path)
+	result["theme"] = "light"
+	writeJSON(t, path, result)
+
+	n, err := Revert(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("Revert() reverted %d keys, want 5", n)
+	}
+	want := map[string]interface{}{
+		"model":    "old-model",
+		"theme":    "light",
+		"obsolete": true,
+		"provider": map[string]interface{}{
+			"bedrock": map[string]interface{}{"name": "Bedrock"},
+		},
+	}
+	if got := readJSON(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("after Revert() = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(HistoryPath(path)); !os.IsNotExist(err) {
+		t.Error("the patch history was not removed")
+	}
+}
@@ -0,0 +1,152 @@
+package configpatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultProvider is the opencode provider the installer configures to talk
+// to the local proxy.
+const DefaultProvider = "bedrock"
+
+// ModelsResponse is the response from the /v1/models endpoint.
+type ModelsResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// FetchModels fetches the router's model catalog via the proxy and returns
+// the model IDs, sorted and without the "<provider>/" aliases the router
+// also accepts.
+func FetchModels(ctx context.Context, proxyURL, provider string) ([]string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", proxyURL+"/v1/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating models request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching models: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("models returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var catalog ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("parsing models: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, m := range catalog.Data {
+		id := strings.TrimPrefix(m.ID, provider+"/")
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ModelsSync is the result of comparing the catalog with opencode.json.
+type ModelsSync struct {
+	Added   []string
+	Removed []string
+	// Kept lists models missing from the catalog that were not removed:
+	// all of them without prune, or the configured default model.
+	Kept []string
+
+	// Spec applies the change; it is empty when nothing changed.
+	Spec PatchSpec
+}
+
+// SyncModels compares the model IDs with provider.<provider>.models in the
+// opencode.json at filePath. New models are added with a display name;
+// existing entries are left as they are, so names, limits, and options set
+// by the installer or the user survive. With prune, models missing from the
+// catalog are removed, except the one selected as opencode's "model".
+//
+// The whole models map is set at once rather than one set_deep path per
+// model, because model IDs may contain dots.
+func SyncModels(filePath, provider string, ids []string, prune bool) (*ModelsSync, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filePath, err)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filePath, err)
+	}
+
+	current := map[string]interface{}{}
+	if providers, ok := obj["provider"].(map[string]interface{}); ok {
+		if p, ok := providers[provider].(map[string]interface{}); ok {
+			if models, ok := p["models"].(map[string]interface{}); ok {
+				current = models
+			}
+		}
+	}
+	selected, _ := obj["model"].(string)
+
+	result := &ModelsSync{}
+	inCatalog := make(map[string]bool, len(ids))
+	models := make(map[string]interface{}, len(current)+len(ids))
+	for _, id := range ids {
+		inCatalog[id] = true
+		if def, ok := current[id]; ok {
+			models[id] = def
+			continue
+		}
+		models[id] = map[string]interface{}{"name": ModelDisplayName(id)}
+		result.Added = append(result.Added, id)
+	}
+
+	var missing []string
+	for id := range current {
+		if !inCatalog[id] {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		if prune && selected != provider+"/"+id {
+			result.Removed = append(result.Removed, id)
+			continue
+		}
+		models[id] = current[id]
+		result.Kept = append(result.Kept, id)
+	}
+
+	if len(result.Added) > 0 || len(result.Removed) > 0 {
+		result.Spec = PatchSpec{
+			SetDeep: map[string]interface{}{"provider." + provider + ".models": models},
+		}
+	}
+	return result, nil
+}
+
+// ModelDisplayName derives a display name from a model ID, e.g.
+// "qwen3-coder" becomes "Qwen3 Coder".
+func ModelDisplayName(id string) string {
+	words := strings.FieldsFunc(id, func(r rune) bool { return r == '-' || r == '_' })
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
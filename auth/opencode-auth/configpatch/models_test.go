@@ -0,0 +1,97 @@
+package configpatch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFetchModels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"object":"list","data":[
+			{"id":"claude-sonnet","object":"model"},
+			{"id":"bedrock/claude-sonnet","object":"model"},
+			{"id":"bedrock/kimi-k2-thinking","object":"model"},
+			{"id":"claude-opus","object":"model"}]}`))
+	}))
+	defer srv.Close()
+
+	ids, err := FetchModels(context.Background(), srv.URL, DefaultProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"claude-opus", "claude-sonnet", "kimi-k2-thinking"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+}
+
+func TestSyncModels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opencode.json")
+	writeJSON(t, path, map[string]interface{}{
+		"provider": map[string]interface{}{
+			"bedrock": map[string]interface{}{
+				"options": map[string]interface{}{"baseURL": "http://localhost:18080/v1"},
+				"models": map[string]interface{}{
+					"claude-opus": map[string]interface{}{"name": "Claude Opus 4.6"},
+					"retired":     map[string]interface{}{"name": "Retired"},
+					"selected":    map[string]interface{}{"name": "Selected"},
+				},
+			},
+		},
+		"model": "bedrock/selected",
+	})
+	ids := []string{"claude-opus", "glm-4.7-flash", "qwen3-coder"}
+
+	// Without prune, missing models are kept
+	sync, err := SyncModels(path, DefaultProvider, ids, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sync.Added, []string{"glm-4.7-flash", "qwen3-coder"}) || sync.Removed != nil ||
+		!reflect.DeepEqual(sync.Kept, []string{"retired", "selected"}) {
+		t.Errorf("sync = %+v", sync)
+	}
+
+	// With prune, the selected default model is still kept
+	sync, err = SyncModels(path, DefaultProvider, ids, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sync.Removed, []string{"retired"}) || !reflect.DeepEqual(sync.Kept, []string{"selected"}) {
+		t.Errorf("prune sync = %+v", sync)
+	}
+	if err := Apply(path, sync.Spec); err != nil {
+		t.Fatal(err)
+	}
+
+	result := readJSON(t, path)
+	bedrock := result["provider"].(map[string]interface{})["bedrock"].(map[string]interface{})
+	models := bedrock["models"].(map[string]interface{})
+	if len(models) != 4 {
+		t.Errorf("models = %v", models)
+	}
+	if models["claude-opus"].(map[string]interface{})["name"] != "Claude Opus 4.6" {
+		t.Error("existing model definition was replaced")
+	}
+	// IDs with dots are stored as one key, not a nested path
+	if models["glm-4.7-flash"].(map[string]interface{})["name"] != "Glm 4.7 Flash" {
+		t.Errorf("glm-4.7-flash = %v", models["glm-4.7-flash"])
+	}
+	if bedrock["options"] == nil || result["model"] != "bedrock/selected" {
+		t.Error("provider options or model preference were modified")
+	}
+
+	// A second sync has nothing to do
+	sync, _ = SyncModels(path, DefaultProvider, ids, true)
+	if len(sync.Added)+len(sync.Removed) != 0 || sync.Spec.SetDeep != nil {
+		t.Errorf("repeat sync = %+v", sync)
+	}
+}
@@ -4,11 +4,14 @@
 package configpatch
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,6 +20,7 @@ import (
 type PatchResponse struct {
 	ConfigVersion int                  `json:"config_version"`
 	Patches       map[string]PatchSpec `json:"patches"`
+	Rollout       *Rollout             `json:"rollout,omitempty"`
 }
 
 // PatchSpec defines the operations for a single config file.
@@ -25,14 +29,41 @@ type PatchSpec struct {
 	SetDeep    map[string]interface{} `json:"set_deep,omitempty"`
 	Remove     []string               `json:"remove,omitempty"`
 	RemoveDeep []string               `json:"remove_deep,omitempty"`
+
+	// Conditions limit which clients apply the spec; see Conditions.Match.
+	Conditions *Conditions `json:"conditions,omitempty"`
+
+	// After lists actions to run once the spec is applied and the file
+	// validated, e.g. ActionRestartProxy; see Actions.
+	After []string `json:"after,omitempty"`
 }
 
 // FetchConfigPatch fetches a config patch from the API via the proxy.
-func FetchConfigPatch(proxyURL string, sinceVersion int) (*PatchResponse, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	url := fmt.Sprintf("%s/v1/update/config?since_version=%d", proxyURL, sinceVersion)
+func FetchConfigPatch(ctx context.Context, proxyURL string, sinceVersion int) (*PatchResponse, error) {
+	return FetchConfigPatchFrom(ctx, proxyURL+"/v1/update/config", sinceVersion, nil)
+}
+
+// FetchConfigPatchFrom fetches a config patch from patchURL, the API's
+// endpoint or a mirror of config-patch.json, through transport (nil means
+// http.DefaultTransport). A file:// mirror needs mirror.Transport. A mirror
+// ignores since_version and serves the whole patch, which callers compare
+// with the version they have.
+func FetchConfigPatchFrom(ctx context.Context, patchURL string, sinceVersion int, transport http.RoundTripper) (*PatchResponse, error) {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	u, err := url.Parse(patchURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config patch URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("since_version", strconv.Itoa(sinceVersion))
+	u.RawQuery = q.Encode()
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating config patch request: %w", err)
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("fetching config patch: %w", err)
 	}
@@ -56,7 +87,8 @@ func FetchConfigPatch(proxyURL string, sinceVersion int) (*PatchResponse, error)
 
 // Apply applies a PatchSpec to a JSON file.
 // It reads the file, applies operations, and writes back.
-// Keys not mentioned in the patch are never modified.
+// Keys not mentioned in the patch are never modified. The first value of
+// each key it changes is kept in the file's patch history; see Revert.
 func Apply(filePath string, spec PatchSpec) error {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
@@ -68,6 +100,11 @@ func Apply(filePath string, spec PatchSpec) error {
 		return fmt.Errorf("parsing %s: %w", filePath, err)
 	}
 
+	// Keep what the patch replaces, so it can be reverted
+	if err := recordOriginals(filePath, obj, spec); err != nil {
+		return fmt.Errorf("recording patch history of %s: %w", filePath, err)
+	}
+
 	// Apply top-level set operations
 	for key, val := range spec.Set {
 		obj[key] = val
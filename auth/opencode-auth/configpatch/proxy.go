@@ -0,0 +1,66 @@
+package configpatch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProxyPatch is the patch entry for proxy-scoped settings. It is applied to
+// config.json, by 'oc' like any other entry and by a proxy with
+// proxy_config_poll_interval set, which also applies it in memory right away.
+const ProxyPatch = "proxy"
+
+// ProxyKeys are the config.json keys a running proxy applies without a
+// restart, and so the only keys a proxy patch may change.
+var ProxyKeys = map[string]bool{
+	"proxy_auth_headers":         true,
+	"proxy_client_headers":       true,
+	"proxy_allowed_models":       true,
+	"proxy_model_aliases":        true,
+	"proxy_guardrails":           true,
+	"proxy_config_poll_interval": true,
+	"proxy_history":              true,
+	"proxy_watchdog":             true,
+	"proxy_device_assertion":     true,
+	"proxy_expired_tokens":       true,
+	"proxy_dedup_window":         true,
+	"proxy_reauth_auto_open":     true,
+	"proxy_route_timeouts":       true,
+	"proxy_stream_idle_timeout":  true,
+	"proxy_quota_warn_percent":   true,
+	"proxy_experiments":          true,
+	"proxy_request_annotations":  true,
+	"http_timeout":               true,
+	"session_idle_timeout":       true,
+	"refresh_threshold":          true,
+	"check_interval":             true,
+	"token_audit":                true,
+}
+
+// CheckProxyScope returns an error naming any key the spec changes that is
+// not in ProxyKeys. Deep paths are checked by their top-level key.
+func (s PatchSpec) CheckProxyScope() error {
+	var keys []string
+	for key := range s.Set {
+		keys = append(keys, key)
+	}
+	for path := range s.SetDeep {
+		keys = append(keys, path)
+	}
+	keys = append(keys, s.Remove...)
+	keys = append(keys, s.RemoveDeep...)
+
+	var outside []string
+	for _, key := range keys {
+		top, _, _ := strings.Cut(key, ".")
+		if !ProxyKeys[top] {
+			outside = append(outside, key)
+		}
+	}
+	if len(outside) > 0 {
+		sort.Strings(outside)
+		return fmt.Errorf("proxy patch changes keys that are not proxy-scoped: %s", strings.Join(outside, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package configpatch
+
+import "testing"
+
+func TestCheckProxyScope(t *testing.T) {
+	ok := PatchSpec{
+		Set:        map[string]interface{}{"proxy_allowed_models": []string{"anthropic.*"}},
+		SetDeep:    map[string]interface{}{"proxy_guardrails.daily_token_budget": 1000},
+		RemoveDeep: []string{"proxy_guardrails.max_tokens"},
+	}
+	if err := ok.CheckProxyScope(); err != nil {
+		t.Errorf("CheckProxyScope() = %v", err)
+	}
+
+	bad := PatchSpec{
+		Set:    map[string]interface{}{"api_endpoint": "https://evil.example.com/v1"},
+		Remove: []string{"proxy_history", "client_id"},
+	}
+	err := bad.CheckProxyScope()
+	if err == nil || err.Error() != "proxy patch changes keys that are not proxy-scoped: api_endpoint, client_id" {
+		t.Errorf("CheckProxyScope() = %v", err)
+	}
+}
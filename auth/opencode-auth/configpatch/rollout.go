@@ -0,0 +1,47 @@
+package configpatch
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Rollout restricts a patch to a subset of clients so a risky change can be
+// canaried before it reaches everyone. A patch without a rollout applies to
+// all clients.
+type Rollout struct {
+	// Percentage of clients (0-100) that apply the patch.
+	Percentage float64 `json:"percentage"`
+
+	// Salt reshuffles cohorts. When empty a machine keeps the same bucket
+	// across rollouts, so the same canary clients go first every time.
+	Salt string `json:"salt,omitempty"`
+
+	// Platforms limits the patch to these GOOS values (e.g. "darwin").
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// Bucket maps a machine ID to a stable position in [0, 100) for the given
+// salt. A client is in a rollout when its bucket is below the percentage.
+func Bucket(machineID, salt string) float64 {
+	sum := sha256.Sum256([]byte(salt + ":" + machineID))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+// Includes reports whether the machine with the given ID and GOOS is in the
+// rollout, along with its bucket.
+func (r *Rollout) Includes(machineID, goos string) (bucket float64, included bool) {
+	bucket = Bucket(machineID, r.Salt)
+	if len(r.Platforms) > 0 {
+		matched := false
+		for _, p := range r.Platforms {
+			if p == goos {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return bucket, false
+		}
+	}
+	return bucket, bucket < r.Percentage
+}
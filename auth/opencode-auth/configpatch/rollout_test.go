@@ -0,0 +1,81 @@
+package configpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestBucket_StableAndInRange(t *testing.T) {
+	if Bucket("machine-a", "") != Bucket("machine-a", "") {
+		t.Error("bucket is not stable for the same machine")
+	}
+	if Bucket("machine-a", "") == Bucket("machine-a", "reshuffle") {
+		t.Error("salt did not change the bucket")
+	}
+	for i := 0; i < 1000; i++ {
+		if b := Bucket(fmt.Sprintf("m%d", i), ""); b < 0 || b >= 100 {
+			t.Fatalf("bucket %v out of range", b)
+		}
+	}
+}
+
+func TestRolloutIncludes_Percentage(t *testing.T) {
+	r := &Rollout{Percentage: 5}
+	included := 0
+	for i := 0; i < 10000; i++ {
+		if _, ok := r.Includes(fmt.Sprintf("machine-%d", i), "linux"); ok {
+			included++
+		}
+	}
+	// 5% of 10000 with generous tolerance for hash distribution
+	if included < 350 || included > 650 {
+		t.Errorf("included %d of 10000, want ~500", included)
+	}
+
+	if _, ok := (&Rollout{Percentage: 0}).Includes("machine-1", "linux"); ok {
+		t.Error("0% rollout included a machine")
+	}
+	if _, ok := (&Rollout{Percentage: 100}).Includes("machine-1", "linux"); !ok {
+		t.Error("100% rollout excluded a machine")
+	}
+}
+
+func TestRolloutIncludes_WideningKeepsCanaries(t *testing.T) {
+	small, large := &Rollout{Percentage: 5}, &Rollout{Percentage: 50}
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("machine-%d", i)
+		if _, in := small.Includes(id, "linux"); in {
+			if _, stillIn := large.Includes(id, "linux"); !stillIn {
+				t.Fatalf("%s dropped out when rollout widened", id)
+			}
+		}
+	}
+}
+
+func TestRolloutIncludes_Platforms(t *testing.T) {
+	r := &Rollout{Percentage: 100, Platforms: []string{"darwin"}}
+	if _, ok := r.Includes("machine-1", "darwin"); !ok {
+		t.Error("darwin client excluded from darwin rollout")
+	}
+	if _, ok := r.Includes("machine-1", "windows"); ok {
+		t.Error("windows client included in darwin rollout")
+	}
+}
+
+func TestPatchResponse_RolloutOptional(t *testing.T) {
+	var p PatchResponse
+	if err := json.Unmarshal([]byte(`{"config_version":3,"patches":{}}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Rollout != nil {
+		t.Error("expected nil rollout when absent")
+	}
+
+	if err := json.Unmarshal([]byte(`{"config_version":4,"patches":{},"rollout":{"percentage":5,"platforms":["linux"]}}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Rollout == nil || p.Rollout.Percentage != 5 || len(p.Rollout.Platforms) != 1 {
+		t.Errorf("rollout = %+v", p.Rollout)
+	}
+}
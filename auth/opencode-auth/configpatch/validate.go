@@ -0,0 +1,213 @@
+package configpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ActionRestartProxy restarts the proxy after the patch, for settings it
+// only reads at start. A spec requests it in After.
+const ActionRestartProxy = "restart_proxy"
+
+// knownActions are the post-apply actions this client runs.
+var knownActions = map[string]bool{
+	ActionRestartProxy: true,
+}
+
+// Validator checks a patched file. See ApplyValidated.
+type Validator func(filePath string) error
+
+// ValidationError is a patch that was rolled back because the file failed
+// validation after it.
+type ValidationError struct {
+	File string
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s is invalid after the patch, rolled back: %v", filepath.Base(e.File), e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyValidated applies spec to filePath like Apply, keeping a backup, and
+// checks the result with validate. When the file passed validate before the
+// patch and fails after it, the backup is restored and a *ValidationError
+// returned; a file that was already invalid is not held against the patch.
+func ApplyValidated(filePath string, spec PatchSpec, validate Validator) error {
+	before := validate(filePath)
+	if err := Backup(filePath); err != nil {
+		return fmt.Errorf("backing up %s: %w", filePath, err)
+	}
+	if err := Apply(filePath, spec); err != nil {
+		_ = Restore(filePath)
+		return err
+	}
+	if err := validate(filePath); err != nil && before == nil {
+		if restoreErr := Restore(filePath); restoreErr != nil {
+			return fmt.Errorf("%s is invalid after the patch (%v) and could not be restored: %w", filePath, err, restoreErr)
+		}
+		return &ValidationError{File: filePath, Err: err}
+	}
+	return nil
+}
+
+// Actions splits the spec's post-apply actions into those this client runs
+// and those it doesn't know, e.g. from a newer release.
+func (s PatchSpec) Actions() (known, unknown []string) {
+	for _, action := range s.After {
+		if knownActions[action] {
+			known = append(known, action)
+		} else {
+			unknown = append(unknown, action)
+		}
+	}
+	return known, unknown
+}
+
+// openCodeTypes are the JSON types of opencode.json's top-level keys, from
+// opencode's config schema. Keys not listed are not checked.
+var openCodeTypes = map[string]string{
+	"$schema":            "string",
+	"model":              "string",
+	"small_model":        "string",
+	"theme":              "string",
+	"username":           "string",
+	"share":              "string",
+	"provider":           "object",
+	"mcp":                "object",
+	"agent":              "object",
+	"mode":               "object",
+	"command":            "object",
+	"keybinds":           "object",
+	"tools":              "object",
+	"permission":         "object",
+	"formatter":          "object",
+	"lsp":                "object",
+	"instructions":       "array",
+	"disabled_providers": "array",
+	"enabled_providers":  "array",
+}
+
+// ValidateOpenCodeJSON checks that filePath is an opencode.json opencode can
+// load: the known keys have the schema's types, each provider and model is
+// an object, each MCP server is a complete local or remote server, and
+// model and small_model name a provider and a model.
+func ValidateOpenCodeJSON(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("parsing %s: %w", filePath, err)
+	}
+
+	var problems []string
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if want, ok := openCodeTypes[key]; ok && jsonType(obj[key]) != want {
+			problems = append(problems, fmt.Sprintf("%s is %s, not %s", key, jsonType(obj[key]), want))
+		}
+	}
+	for _, key := range []string{"model", "small_model"} {
+		if model, ok := obj[key].(string); ok && !strings.Contains(model, "/") {
+			problems = append(problems, fmt.Sprintf("%s %q is not provider/model", key, model))
+		}
+	}
+	if providers, ok := obj["provider"].(map[string]interface{}); ok {
+		problems = append(problems, checkProviders(providers)...)
+	}
+	if servers, ok := obj["mcp"].(map[string]interface{}); ok {
+		problems = append(problems, checkMCPServers(servers)...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkProviders(providers map[string]interface{}) []string {
+	var problems []string
+	for _, name := range sortedKeys(providers) {
+		provider, ok := providers[name].(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("provider.%s is %s, not object", name, jsonType(providers[name])))
+			continue
+		}
+		for key, want := range map[string]string{"npm": "string", "name": "string", "options": "object", "models": "object"} {
+			if val, ok := provider[key]; ok && jsonType(val) != want {
+				problems = append(problems, fmt.Sprintf("provider.%s.%s is %s, not %s", name, key, jsonType(val), want))
+			}
+		}
+		models, _ := provider["models"].(map[string]interface{})
+		for _, id := range sortedKeys(models) {
+			if jsonType(models[id]) != "object" {
+				problems = append(problems, fmt.Sprintf("provider.%s.models.%s is %s, not object", name, id, jsonType(models[id])))
+			}
+		}
+	}
+	return problems
+}
+
+func checkMCPServers(servers map[string]interface{}) []string {
+	var problems []string
+	for _, name := range sortedKeys(servers) {
+		server, ok := servers[name].(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("mcp.%s is %s, not object", name, jsonType(servers[name])))
+			continue
+		}
+		switch server["type"] {
+		case "local":
+			if command, ok := server["command"].([]interface{}); !ok || len(command) == 0 {
+				problems = append(problems, fmt.Sprintf("mcp.%s has no command", name))
+			}
+		case "remote":
+			if u, _ := server["url"].(string); u == "" {
+				problems = append(problems, fmt.Sprintf("mcp.%s has no url", name))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("mcp.%s type is %v, not local or remote", name, server["type"]))
+		}
+	}
+	return problems
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
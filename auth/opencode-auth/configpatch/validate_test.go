@@ -0,0 +1,97 @@
+package configpatch
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyValidatedRollsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opencode.json")
+	writeJSON(t, path, map[string]interface{}{"model": "bedrock/claude-sonnet", "theme": "dark"})
+
+	err := ApplyValidated(path, PatchSpec{Set: map[string]interface{}{"model": "claude-sonnet", "theme": "light"}}, ValidateOpenCodeJSON)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("ApplyValidated() = %v, want a ValidationError", err)
+	}
+	result := readJSON(t, path)
+	if result["model"] != "bedrock/claude-sonnet" || result["theme"] != "dark" {
+		t.Errorf("file not rolled back: %v", result)
+	}
+}
+
+func TestApplyValidatedKeepsFix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opencode.json")
+	writeJSON(t, path, map[string]interface{}{"model": "claude-sonnet"})
+
+	// Still invalid afterwards, but no worse than before
+	if err := ApplyValidated(path, PatchSpec{Set: map[string]interface{}{"theme": "dark"}}, ValidateOpenCodeJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyValidated(path, PatchSpec{Set: map[string]interface{}{"model": "bedrock/claude-sonnet"}}, ValidateOpenCodeJSON); err != nil {
+		t.Fatal(err)
+	}
+	if result := readJSON(t, path); result["model"] != "bedrock/claude-sonnet" || result["theme"] != "dark" {
+		t.Errorf("patches not applied: %v", result)
+	}
+}
+
+func TestValidateOpenCodeJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		wantErr string
+	}{
+		{"valid", map[string]interface{}{
+			"$schema": "https://opencode.ai/config.json",
+			"model":   "bedrock/claude-sonnet",
+			"provider": map[string]interface{}{"bedrock": map[string]interface{}{
+				"npm":    "@ai-sdk/openai-compatible",
+				"models": map[string]interface{}{"claude-sonnet": map[string]interface{}{"name": "Claude Sonnet"}},
+			}},
+			"mcp": map[string]interface{}{
+				"auth":   map[string]interface{}{"type": "local", "command": []interface{}{"opencode-auth", "mcp"}},
+				"remote": map[string]interface{}{"type": "remote", "url": "https://mcp.example.com"},
+			},
+			"custom_key": 1,
+		}, ""},
+		{"wrong type", map[string]interface{}{"provider": "bedrock"}, "provider is string, not object"},
+		{"model without provider", map[string]interface{}{"small_model": "haiku"}, `small_model "haiku" is not provider/model`},
+		{"model not an object", map[string]interface{}{"provider": map[string]interface{}{
+			"bedrock": map[string]interface{}{"models": map[string]interface{}{"claude": true}},
+		}}, "provider.bedrock.models.claude is boolean, not object"},
+		{"local server without command", map[string]interface{}{"mcp": map[string]interface{}{
+			"auth": map[string]interface{}{"type": "local"},
+		}}, "mcp.auth has no command"},
+		{"unknown server type", map[string]interface{}{"mcp": map[string]interface{}{
+			"auth": map[string]interface{}{"type": "stdio"},
+		}}, "mcp.auth type is stdio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "opencode.json")
+			writeJSON(t, path, tt.config)
+			err := ValidateOpenCodeJSON(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateOpenCodeJSON() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateOpenCodeJSON() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestActions(t *testing.T) {
+	spec := PatchSpec{After: []string{ActionRestartProxy, "reboot_laptop"}}
+	known, unknown := spec.Actions()
+	if !reflect.DeepEqual(known, []string{ActionRestartProxy}) || !reflect.DeepEqual(unknown, []string{"reboot_laptop"}) {
+		t.Errorf("Actions() = %v, %v", known, unknown)
+	}
+}
@@ -0,0 +1,130 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/apikey"
+)
+
+// Client communicates with the /v1/devices registration endpoints. Like
+// API key management, they need the user's JWT, which the proxy adds.
+type Client struct {
+	baseURL    string
+	jwtToken   string
+	httpClient *http.Client
+}
+
+// NewClient creates a new device registration client.
+func NewClient(baseURL, jwtToken string) *Client {
+	return &Client{
+		baseURL:  baseURL,
+		jwtToken: jwtToken,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// RegisterRequest is the request body for registering a device. Registering
+// a device ID that is already registered to the user replaces its key.
+type RegisterRequest struct {
+	DeviceID  string `json:"device_id"`
+	PublicKey JWK    `json:"public_key"`
+	Name      string `json:"name,omitempty"`
+	Platform  string `json:"platform,omitempty"`
+}
+
+// Device is a registered device, as the router reports it.
+type Device struct {
+	DeviceID   string  `json:"device_id"`
+	Name       string  `json:"name"`
+	Platform   string  `json:"platform"`
+	Status     string  `json:"status"`
+	Thumbprint string  `json:"key_thumbprint"`
+	CreatedAt  string  `json:"created_at"`
+	RotatedAt  *string `json:"rotated_at"`
+	LastSeenAt *string `json:"last_seen_at"`
+}
+
+// ListResponse is the response from listing devices.
+type ListResponse struct {
+	Devices []Device `json:"devices"`
+}
+
+// Register registers a device's public key, or replaces the key if the
+// device is already registered.
+func (c *Client) Register(ctx context.Context, reqBody RegisterRequest) (*Device, error) {
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	var dev Device
+	if err := c.do(ctx, "POST", "/v1/devices", bytes.NewReader(data), &dev, http.StatusCreated, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// List returns the user's registered devices.
+func (c *Client) List(ctx context.Context) (*ListResponse, error) {
+	var listResp ListResponse
+	if err := c.do(ctx, "GET", "/v1/devices", nil, &listResp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &listResp, nil
+}
+
+// Deregister removes a device. Its assertions are refused from then on.
+func (c *Client) Deregister(ctx context.Context, deviceID string) error {
+	return c.do(ctx, "DELETE", "/v1/devices/"+url.PathEscape(deviceID), nil, nil, http.StatusOK)
+}
+
+// do sends a request and decodes the response into out. A status other than
+// want is returned as an *apikey.APIError.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, out interface{}, want ...int) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.jwtToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.jwtToken)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	ok := false
+	for _, status := range want {
+		ok = ok || resp.StatusCode == status
+	}
+	if !ok {
+		var errResp apikey.ErrorResponse
+		json.Unmarshal(data, &errResp)
+		return &apikey.APIError{StatusCode: resp.StatusCode, Message: errResp.Error, Body: string(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Package device provides the machine identity used for device posture
+// checks: a per-machine RSA key pair whose public key is registered with the
+// router, and the short-lived X-Device-Assertion the proxy signs with it.
+// The private key is kept in the TPM where there is one (see keystore).
+package device
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/keystore"
+)
+
+const (
+	// IdentityFile holds the device ID and private key, in the config dir.
+	IdentityFile = "device.json"
+
+	// Header carries the signed assertion on proxied requests.
+	Header = "X-Device-Assertion"
+
+	// idPrefix marks device IDs, like oc_ marks API keys
+	idPrefix = "dev_"
+)
+
+// ErrNoIdentity means no key pair has been created on this machine.
+var ErrNoIdentity = errors.New("no device identity")
+
+// Identity is this machine's device ID and key pair.
+type Identity struct {
+	DeviceID string `json:"device_id"`
+	// PrivateKey is the PKCS #8 DER key, base64-encoded, when it is kept
+	// in software
+	PrivateKey string `json:"private_key,omitempty"`
+	// KeyStore names the hardware store holding the key, e.g. "tpm", and
+	// KeyRef is how to open it there; both are empty for a software key
+	KeyStore     string     `json:"key_store,omitempty"`
+	KeyRef       string     `json:"key_ref,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RegisteredAt *time.Time `json:"registered_at,omitempty"`
+	RotatedAt    *time.Time `json:"rotated_at,omitempty"`
+
+	key *keystore.Key
+}
+
+// JWK is an RSA public key in JSON Web Key form, as registered with the
+// router.
+type JWK struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Path returns the identity file in dir.
+func Path(dir string) string {
+	return filepath.Join(dir, IdentityFile)
+}
+
+// Generate creates a key pair in the key store store selects (see
+// keystore.Create). An empty deviceID gets a new random one; rotation passes
+// the current ID so the router replaces the device's key.
+func Generate(deviceID, store string) (*Identity, error) {
+	if deviceID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		deviceID = idPrefix + base64.RawURLEncoding.EncodeToString(b)
+	}
+	key, err := keystore.Create(store)
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{DeviceID: deviceID, CreatedAt: time.Now().UTC(), key: key}
+	if key.Store == keystore.Software {
+		id.PrivateKey = key.Ref
+	} else {
+		id.KeyStore, id.KeyRef = key.Store, key.Ref
+	}
+	return id, nil
+}
+
+// Load reads the identity in dir. A missing file wraps ErrNoIdentity.
+func Load(dir string) (*Identity, error) {
+	data, err := os.ReadFile(Path(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %w", ErrNoIdentity, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", IdentityFile, err)
+	}
+	if id.DeviceID == "" {
+		return nil, fmt.Errorf("invalid %s: no device ID", IdentityFile)
+	}
+	ref := id.PrivateKey
+	if id.KeyStore != "" {
+		ref = id.KeyRef
+	}
+	key, err := keystore.Open(id.KeyStore, ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", IdentityFile, err)
+	}
+	id.key = key
+	return &id, nil
+}
+
+// Save writes the identity to dir (mode 0600). It writes and renames, so
+// the proxy never reads a half-written key during rotation.
+func Save(dir string, id *Identity) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := Path(dir)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", IdentityFile, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", IdentityFile, err)
+	}
+	return nil
+}
+
+// Remove deletes the identity in dir, if any, and its hardware key.
+func Remove(dir string) error {
+	if id, err := Load(dir); err == nil {
+		if err := id.DeleteKey(); err != nil {
+			return fmt.Errorf("failed to delete the device key: %w", err)
+		}
+	}
+	if err := os.Remove(Path(dir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DeleteKey destroys the key in its hardware store, as after rotation. A
+// software key goes with the identity file.
+func (id *Identity) DeleteKey() error {
+	return keystore.Delete(id.KeyStore, id.KeyRef)
+}
+
+// Store names the key store holding the private key.
+func (id *Identity) Store() string {
+	if id.KeyStore == "" {
+		return keystore.Software
+	}
+	return id.KeyStore
+}
+
+// HardwareBound reports whether the private key is held by a hardware
+// store. A software key is in the identity file, and a copy of that file
+// signs for the device as well as this machine does.
+func (id *Identity) HardwareBound() bool {
+	return id.Store() != keystore.Software
+}
+
+// Registered reports whether the router has accepted the current key.
+func (id *Identity) Registered() bool {
+	return id.RegisteredAt != nil
+}
+
+// PublicJWK returns the public key to register.
+func (id *Identity) PublicJWK() JWK {
+	pub := id.key.PublicKey()
+	return JWK{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// Thumbprint returns the key's RFC 7638 thumbprint, which the router shows
+// for each registered device.
+func (id *Identity) Thumbprint() string {
+	return id.PublicJWK().Thumbprint()
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of k.
+func (k JWK) Thumbprint() string {
+	// The required members in lexicographic order, without whitespace
+	canonical := fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, k.E, k.Kty, k.N)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Assertion signs an RS256 JWT asserting this device, valid for ttl. With a
+// method and path it is bound to that one request; without them it can be
+// reused for the rest of a session.
+func (id *Identity) Assertion(now time.Time, ttl time.Duration, method, path string) (string, error) {
+	jti := make([]byte, 12)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	header := map[string]string{"alg": "RS256", "typ": "device+jwt", "kid": id.DeviceID}
+	claims := map[string]interface{}{
+		"iss": id.DeviceID,
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+	}
+	if method != "" {
+		claims["htm"] = method
+		claims["htu"] = path
+	}
+
+	var parts [2]string
+	for i, v := range []interface{}{header, claims} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := parts[0] + "." + parts[1]
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := id.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign device assertion: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
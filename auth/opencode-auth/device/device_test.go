@@ -0,0 +1,173 @@
+package device
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/apikey"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/keystore"
+)
+
+func TestIdentity_SaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(dir); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("Load() with no file = %v, want ErrNoIdentity", err)
+	}
+
+	id, err := Generate("", keystore.Software)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id.DeviceID, idPrefix) || id.Registered() {
+		t.Errorf("new identity = %s, registered %v", id.DeviceID, id.Registered())
+	}
+	if id.HardwareBound() {
+		t.Errorf("software key reported as hardware-bound (store %s)", id.Store())
+	}
+	if err := Save(dir, id); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(Path(dir)); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Errorf("%s mode = %v, %v", IdentityFile, info.Mode(), err)
+	}
+
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.DeviceID != id.DeviceID || loaded.Thumbprint() != id.Thumbprint() {
+		t.Errorf("loaded %s %s, saved %s %s", loaded.DeviceID, loaded.Thumbprint(), id.DeviceID, id.Thumbprint())
+	}
+
+	// Rotation keeps the ID and changes the key
+	rotated, err := Generate(id.DeviceID, keystore.Software)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.DeviceID != id.DeviceID || rotated.Thumbprint() == id.Thumbprint() {
+		t.Errorf("rotated %s %s", rotated.DeviceID, rotated.Thumbprint())
+	}
+}
+
+func TestJWK_Thumbprint(t *testing.T) {
+	// The example in RFC 7638 section 3.1
+	k := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	if got, want := k.Thumbprint(), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("Thumbprint() = %s, want %s", got, want)
+	}
+}
+
+func TestIdentity_Assertion(t *testing.T) {
+	id, err := Generate("", keystore.Software)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	assertion, err := id.Assertion(now, 5*time.Minute, "POST", "/v1/chat/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify it the way the router does, from the registered JWK
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion has %d parts", len(parts))
+	}
+	jwk := id.PublicJWK()
+	n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+	e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+
+	var header, claims map[string]interface{}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, _ := base64.RawURLEncoding.DecodeString(parts[i])
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if header["alg"] != "RS256" || header["kid"] != id.DeviceID {
+		t.Errorf("header = %v", header)
+	}
+	if claims["iss"] != id.DeviceID || claims["htm"] != "POST" || claims["htu"] != "/v1/chat/completions" ||
+		claims["exp"].(float64)-claims["iat"].(float64) != 300 {
+		t.Errorf("claims = %v", claims)
+	}
+
+	// A session assertion is bound to no request
+	session, _ := id.Assertion(now, time.Hour, "", "")
+	data, _ := base64.RawURLEncoding.DecodeString(strings.Split(session, ".")[1])
+	if strings.Contains(string(data), "htm") {
+		t.Errorf("session claims = %s", data)
+	}
+}
+
+func TestClient(t *testing.T) {
+	id, err := Generate("", keystore.Software)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := map[string]JWK{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/devices":
+			var req RegisterRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			_, rotated := registered[req.DeviceID]
+			registered[req.DeviceID] = req.PublicKey
+			if !rotated {
+				w.WriteHeader(http.StatusCreated)
+			}
+			json.NewEncoder(w).Encode(Device{DeviceID: req.DeviceID, Status: "active", Thumbprint: req.PublicKey.Thumbprint()})
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v1/devices/"):
+			if _, ok := registered[strings.TrimPrefix(r.URL.Path, "/v1/devices/")]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"Device not found"}`))
+				return
+			}
+			w.Write([]byte(`{"status":"deregistered"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL, "")
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		dev, err := client.Register(ctx, RegisterRequest{DeviceID: id.DeviceID, PublicKey: id.PublicJWK()})
+		if err != nil {
+			t.Fatalf("Register() #%d: %v", i+1, err)
+		}
+		if dev.Thumbprint != id.Thumbprint() {
+			t.Errorf("registered thumbprint %s, want %s", dev.Thumbprint, id.Thumbprint())
+		}
+	}
+	if err := client.Deregister(ctx, id.DeviceID); err != nil {
+		t.Errorf("Deregister() = %v", err)
+	}
+	if err := client.Deregister(ctx, "dev_unknown"); !errors.Is(err, apikey.ErrNotFound) {
+		t.Errorf("Deregister() of unknown device = %v, want ErrNotFound", err)
+	}
+}
@@ -2,7 +2,11 @@ module github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth
 
 go 1.21
 
-require github.com/spf13/cobra v1.8.0
+require (
+	github.com/spf13/cobra v1.8.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
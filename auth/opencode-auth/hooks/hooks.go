@@ -0,0 +1,118 @@
+// Package hooks runs user-configured commands before opencode starts and
+// after it exits, e.g. to check a VPN, mount credentials into a container,
+// or record session start and stop.
+package hooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Hook points.
+const (
+	PreLaunch = "pre_launch"
+	PostExit  = "post_exit"
+)
+
+// DefaultTimeout bounds each hook command when no timeout is configured.
+const DefaultTimeout = time.Minute
+
+// Session describes the opencode session a hook runs for. It is passed to
+// hook commands as OPENCODE_* environment variables.
+type Session struct {
+	ID          string
+	Email       string
+	ProxyURL    string
+	APIEndpoint string
+	ProjectDir  string
+	Start       time.Time
+	// ExitCode and Duration are set for post_exit hooks
+	ExitCode int
+	Duration time.Duration
+}
+
+// NewSession returns a session with a random ID starting now.
+func NewSession() *Session {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Session{ID: hex.EncodeToString(id), Start: time.Now()}
+}
+
+// Env returns the variables describing the session at hook point event.
+func (s *Session) Env(event string) []string {
+	env := []string{
+		"OPENCODE_HOOK=" + event,
+		"OPENCODE_SESSION_ID=" + s.ID,
+		"OPENCODE_EMAIL=" + s.Email,
+		"OPENCODE_PROXY_URL=" + s.ProxyURL,
+		"OPENCODE_API_ENDPOINT=" + s.APIEndpoint,
+		"OPENCODE_SESSION_START=" + s.Start.UTC().Format(time.RFC3339),
+	}
+	if s.ProjectDir != "" {
+		env = append(env, "OPENCODE_PROJECT_DIR="+s.ProjectDir)
+	}
+	if event == PostExit {
+		env = append(env,
+			"OPENCODE_EXIT_CODE="+strconv.Itoa(s.ExitCode),
+			"OPENCODE_SESSION_SECONDS="+strconv.Itoa(int(s.Duration.Seconds())),
+		)
+	}
+	return env
+}
+
+// Runner runs hook commands through the shell.
+type Runner struct {
+	Timeout time.Duration
+	// Output receives the commands' stdout and stderr (os.Stderr if nil) so
+	// hook output never mixes with opencode's stdout.
+	Output io.Writer
+}
+
+// Run runs commands in order for event. It stops at the first command that
+// fails or times out and returns its error.
+func (r *Runner) Run(ctx context.Context, event string, commands []string, s *Session) error {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	out := r.Output
+	if out == nil {
+		out = os.Stderr
+	}
+
+	for _, command := range commands {
+		cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(cmdCtx, "cmd", "/c", command)
+		} else {
+			cmd = exec.CommandContext(cmdCtx, "sh", "-c", command)
+		}
+		cmd.Env = append(os.Environ(), s.Env(event)...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = out
+		cmd.Stderr = out
+		// Don't wait on background processes the hook left holding its output
+		cmd.WaitDelay = time.Second
+
+		err := cmd.Run()
+		timedOut := cmdCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			return fmt.Errorf("%s hook %q timed out after %v", event, command, timeout)
+		}
+		if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+			return fmt.Errorf("%s hook %q failed: %w", event, command, err)
+		}
+	}
+	return nil
+}
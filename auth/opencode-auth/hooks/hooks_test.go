@@ -0,0 +1,57 @@
+//go:build !windows
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun_PassesSessionEnv(t *testing.T) {
+	var out bytes.Buffer
+	r := &Runner{Output: &out}
+	s := &Session{ID: "abc", Email: "dev@example.com", ProxyURL: "http://localhost:18080", Start: time.Now(), ExitCode: 3}
+
+	err := r.Run(context.Background(), PostExit, []string{
+		`echo "$OPENCODE_HOOK $OPENCODE_EMAIL $OPENCODE_PROXY_URL $OPENCODE_EXIT_CODE"`,
+	}, s)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "post_exit dev@example.com http://localhost:18080 3" {
+		t.Errorf("hook output = %q", got)
+	}
+}
+
+func TestRun_StopsAtFirstFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	r := &Runner{Output: &bytes.Buffer{}}
+
+	err := r.Run(context.Background(), PreLaunch, []string{"exit 2", "touch " + marker}, NewSession())
+	if err == nil || !strings.Contains(err.Error(), "exit status 2") {
+		t.Errorf("Run() error = %v, want the failing hook's status", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("hooks after a failure should not run")
+	}
+}
+
+func TestRun_Timeout(t *testing.T) {
+	r := &Runner{Timeout: 100 * time.Millisecond, Output: &bytes.Buffer{}}
+	err := r.Run(context.Background(), PreLaunch, []string{"sleep 5"}, NewSession())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run() error = %v, want timeout", err)
+	}
+}
+
+func TestSessionEnv_PreLaunchOmitsExitCode(t *testing.T) {
+	env := strings.Join(NewSession().Env(PreLaunch), "\n")
+	if strings.Contains(env, "OPENCODE_EXIT_CODE") {
+		t.Errorf("pre_launch env includes an exit code:\n%s", env)
+	}
+}
@@ -0,0 +1,144 @@
+// Package hostmap pins host names to other addresses for networks whose DNS
+// answers with an address that cannot be reached from inside, e.g. split
+// horizon setups that resolve the API domain to its public IP while only an
+// internal VIP is routable. The overrides apply to the connections this
+// program dials; /etc/hosts is left alone. TLS still verifies the original
+// host name.
+package hostmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
+)
+
+// DialFunc is the signature of net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Override is one pinned host and how often it was dialed.
+type Override struct {
+	Host string `json:"host"`
+	// Target is an IP address or host name, optionally with a port that
+	// replaces the dialed one
+	Target   string     `json:"target"`
+	Dials    int64      `json:"dials"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// Map is a set of host overrides. A nil *Map overrides nothing.
+type Map struct {
+	mu      sync.Mutex
+	targets map[string]string
+	dials   map[string]int64
+	last    map[string]time.Time
+}
+
+// New checks overrides (host name to target) and returns them as a Map, or
+// nil when there are none.
+func New(overrides map[string]string) (*Map, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	m := &Map{targets: make(map[string]string), dials: make(map[string]int64), last: make(map[string]time.Time)}
+	for host, target := range overrides {
+		if host == "" || strings.ContainsAny(host, ":/ ") {
+			return nil, fmt.Errorf("host_overrides: %q is not a host name", host)
+		}
+		name := target
+		if h, port, err := net.SplitHostPort(target); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("host_overrides: target %q for %s has an invalid port", target, host)
+			}
+			name = h
+		}
+		if name == "" || strings.ContainsAny(name, "/ :") && net.ParseIP(name) == nil {
+			return nil, fmt.Errorf("host_overrides: target %q for %s is not an address", target, host)
+		}
+		m.targets[strings.ToLower(strings.TrimSuffix(host, "."))] = target
+	}
+	return m, nil
+}
+
+// Target returns the address host is pinned to, if any.
+func (m *Map) Target(host string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	target, ok := m.targets[strings.ToLower(strings.TrimSuffix(host, "."))]
+	return target, ok
+}
+
+// Rewrite returns addr (host:port) with an overridden host replaced by its
+// target. A target without a port keeps addr's port.
+func (m *Map) Rewrite(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	target, ok := m.Target(host)
+	if !ok {
+		return addr, false
+	}
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target, true
+	}
+	return net.JoinHostPort(target, port), true
+}
+
+// Dialer wraps dial so that connections to pinned hosts go to their targets.
+func (m *Map) Dialer(dial DialFunc) DialFunc {
+	if m == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		rewritten, ok := m.Rewrite(addr)
+		if ok {
+			host, _, _ := net.SplitHostPort(addr)
+			key := strings.ToLower(strings.TrimSuffix(host, "."))
+			m.mu.Lock()
+			m.dials[key]++
+			m.last[key] = time.Now()
+			m.mu.Unlock()
+		}
+		return dial(ctx, network, rewritten)
+	}
+}
+
+// Overrides returns the overrides sorted by host, with their use so far.
+func (m *Map) Overrides() []Override {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Override, 0, len(m.targets))
+	for host, target := range m.targets {
+		o := Override{Host: host, Target: target, Dials: m.dials[host]}
+		if last, ok := m.last[host]; ok {
+			o.LastUsed = &last
+		}
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// Install makes http.DefaultTransport, used by the sign-in, discovery and
+// other plain HTTP clients, dial through m.
+func Install(m *Map) {
+	if m == nil {
+		return
+	}
+	if t, ok := tracelog.Unwrap(http.DefaultTransport).(*http.Transport); ok {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = m.Dialer(dialer.DialContext)
+	}
+}
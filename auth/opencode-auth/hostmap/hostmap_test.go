@@ -0,0 +1,78 @@
+package hostmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	m, err := New(map[string]string{
+		"api.example.com":  "10.0.0.5",
+		"idp.example.com.": "10.0.0.6:8443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ addr, want string }{
+		{"api.example.com:443", "10.0.0.5:443"},
+		{"API.example.com:80", "10.0.0.5:80"},
+		{"idp.example.com:443", "10.0.0.6:8443"},
+		{"other.example.com:443", "other.example.com:443"},
+	} {
+		if got, _ := m.Rewrite(tc.addr); got != tc.want {
+			t.Errorf("Rewrite(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+
+	for _, bad := range []map[string]string{
+		{"api.example.com:443": "10.0.0.5"},
+		{"api.example.com": ""},
+		{"api.example.com": "http://10.0.0.5"},
+	} {
+		if _, err := New(bad); err == nil {
+			t.Errorf("New(%v) accepted an invalid override", bad)
+		}
+	}
+	if m, err := New(nil); m != nil || err != nil {
+		t.Errorf("New(nil) = %v, %v", m, err)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	m, _ := New(map[string]string{"api.example.com": srv.Listener.Addr().String()})
+	var dialed []string
+	dial := m.Dialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr != srv.Listener.Addr().String() {
+			return nil, errors.New("unreachable")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+	client := &http.Client{Transport: &http.Transport{DialContext: dial}}
+
+	resp, err := client.Get("http://api.example.com/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := client.Get("http://other.example.com/"); err == nil {
+		t.Error("a host without an override was redirected")
+	}
+
+	overrides := m.Overrides()
+	if len(overrides) != 1 || overrides[0].Dials != 1 || overrides[0].LastUsed == nil {
+		t.Errorf("Overrides() = %+v", overrides)
+	}
+	if len(dialed) != 2 || dialed[1] != "other.example.com:80" {
+		t.Errorf("dialed %v", dialed)
+	}
+}
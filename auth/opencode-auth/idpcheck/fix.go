@@ -0,0 +1,69 @@
+package idpcheck
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fix returns the instructions that repair a class of misconfiguration in
+// the provider's console. redirectURI is the one the check used, if any.
+func Fix(provider, class, clientID, redirectURI string) string {
+	if redirectURI == "" {
+		redirectURI = "http://localhost:<port>/callback"
+	}
+	scopes := strings.Join(Scopes, ", ")
+	switch provider {
+	case ProviderCognito:
+		switch class {
+		case ClassRedirectMismatch:
+			return fmt.Sprintf("Cognito console: User pools > your pool > App integration > App client %s > Login pages > Edit, and add %s to Allowed callback URLs.", clientID, redirectURI)
+		case ClassUnauthorizedClient:
+			return fmt.Sprintf("Cognito console: App client %s > Login pages > Edit, and select Authorization code grant under OAuth 2.0 grant types.", clientID)
+		case ClassInvalidScope:
+			return fmt.Sprintf("Cognito console: App client %s > Login pages > Edit, and select the OpenID Connect scopes %s.", clientID, scopes)
+		case ClassInvalidClient:
+			return fmt.Sprintf("App client %s is unknown or has a client secret. opencode-auth signs in with PKCE and no secret: create a public app client (\"Don't generate a client secret\", generateSecret: false) and put its ID in client_id.", clientID)
+		case ClassPKCE:
+			return "Cognito supports PKCE with S256 on every app client; check that issuer points at the Cognito user pool."
+		}
+	case ProviderOkta:
+		switch class {
+		case ClassRedirectMismatch:
+			return fmt.Sprintf("Okta Admin Console: Applications > your app (client %s) > General > LOGIN, and add %s to Sign-in redirect URIs.", clientID, redirectURI)
+		case ClassUnauthorizedClient:
+			return fmt.Sprintf("Okta Admin Console: Applications > your app (client %s) > General > General Settings, and enable Authorization Code and Refresh Token under Grant type. Make sure the app is assigned to your users.", clientID)
+		case ClassInvalidScope:
+			return fmt.Sprintf("Okta Admin Console: Security > API > Authorization Servers > your server > Access Policies, and allow the scopes %s in a rule that covers client %s.", scopes, clientID)
+		case ClassInvalidClient:
+			return fmt.Sprintf("Okta Admin Console: Applications > your app (client %s) > General > Client Credentials, and set Client authentication to None with Require PKCE as additional verification. A Web app cannot do this; create a Native app.", clientID)
+		case ClassPKCE:
+			return fmt.Sprintf("Okta Admin Console: Applications > your app (client %s) > General > Client Credentials, and select Require PKCE as additional verification.", clientID)
+		}
+	case ProviderEntra:
+		switch class {
+		case ClassRedirectMismatch:
+			return fmt.Sprintf("Azure portal: App registrations > your app (client %s) > Authentication > Add a platform > Mobile and desktop applications, and add %s as a redirect URI.", clientID, redirectURI)
+		case ClassUnauthorizedClient:
+			return fmt.Sprintf("Azure portal: Enterprise applications > your app (client %s) > Properties, and check that it is enabled for users to sign in and assigned to you. Check the supported account types under App registrations > Authentication.", clientID)
+		case ClassInvalidScope:
+			return fmt.Sprintf("Azure portal: App registrations > your app (client %s) > API permissions, and add the Microsoft Graph delegated permissions %s, then grant admin consent.", clientID, scopes)
+		case ClassInvalidClient:
+			return fmt.Sprintf("Client %s is unknown in this tenant, or its redirect URI is on the Web platform, which needs a secret. Azure portal: App registrations > your app > Authentication, and move the redirect URI to Mobile and desktop applications.", clientID)
+		case ClassPKCE:
+			return fmt.Sprintf("Azure portal: App registrations > your app (client %s) > Authentication, and register the redirect URI under Mobile and desktop applications rather than Single-page application.", clientID)
+		}
+	}
+	switch class {
+	case ClassRedirectMismatch:
+		return fmt.Sprintf("Register %s as an allowed redirect URI for client %s.", redirectURI, clientID)
+	case ClassUnauthorizedClient:
+		return fmt.Sprintf("Allow the authorization_code and refresh_token grants for client %s.", clientID)
+	case ClassInvalidScope:
+		return fmt.Sprintf("Allow the scopes %s for client %s.", scopes, clientID)
+	case ClassInvalidClient:
+		return fmt.Sprintf("Make client %s a public client: no client secret, PKCE required.", clientID)
+	case ClassPKCE:
+		return fmt.Sprintf("Enable PKCE with the S256 method for client %s.", clientID)
+	}
+	return ""
+}
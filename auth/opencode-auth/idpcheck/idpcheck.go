@@ -0,0 +1,428 @@
+// Package idpcheck validates the identity provider's app client before the
+// first login: the discovery metadata, a throwaway authorize request built
+// exactly as login builds it, and a token request with a dummy code. A
+// rejection is classified and comes with the fix for Cognito, Okta, or
+// Entra ID.
+package idpcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// Identity providers with specific fix instructions.
+const (
+	ProviderCognito = "Cognito"
+	ProviderOkta    = "Okta"
+	ProviderEntra   = "Entra ID"
+	ProviderGeneric = "identity provider"
+)
+
+// Classes of app client misconfiguration.
+const (
+	ClassRedirectMismatch   = "redirect_mismatch"
+	ClassUnauthorizedClient = "unauthorized_client"
+	ClassInvalidScope       = "invalid_scope"
+	ClassInvalidClient      = "invalid_client"
+	ClassPKCE               = "pkce_unsupported"
+)
+
+// Scopes login asks for; they must all be allowed for the client.
+var Scopes = []string{"openid", "email", "profile"}
+
+// dummyCode is sent to the token endpoint in place of a real authorization
+// code. An identity provider that accepts the client rejects it with
+// invalid_grant.
+const dummyCode = "opencode-auth-idpcheck"
+
+// Check is the outcome of one check.
+type Check struct {
+	Name   string `json:"name"`
+	Level  string `json:"level"` // ok, warn, or fail
+	Detail string `json:"detail"`
+	Class  string `json:"class,omitempty"` // set for a recognised misconfiguration
+	Fix    string `json:"fix,omitempty"`
+}
+
+// Checker runs the checks against one app client.
+type Checker struct {
+	Config   *config.Config
+	Provider string
+	Client   *http.Client // redirects must not be followed
+}
+
+// New returns a Checker for cfg's issuer and client.
+func New(cfg *config.Config) *Checker {
+	return &Checker{
+		Config:   cfg,
+		Provider: DetectProvider(cfg.Issuer, cfg.AuthorizeEndpoint),
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// DetectProvider names the identity provider from its issuer or authorize
+// endpoint, or returns ProviderGeneric.
+func DetectProvider(issuer, authorizeEndpoint string) string {
+	for _, u := range []string{issuer, authorizeEndpoint} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(parsed.Hostname())
+		switch {
+		case strings.HasPrefix(host, "cognito-idp.") || strings.HasSuffix(host, ".amazoncognito.com"):
+			return ProviderCognito
+		case strings.HasSuffix(host, ".okta.com") || strings.HasSuffix(host, ".oktapreview.com") || strings.HasSuffix(host, ".okta-emea.com"):
+			return ProviderOkta
+		case host == "login.microsoftonline.com" || strings.HasSuffix(host, ".ciamlogin.com"):
+			return ProviderEntra
+		}
+	}
+	return ProviderGeneric
+}
+
+// Run runs every check: discovery, then an authorize request for each
+// redirect URI login may use, then the token endpoint. The config is not
+// changed.
+func (c *Checker) Run(ctx context.Context) []Check {
+	cfg := *c.Config
+	var checks []Check
+	checks = append(checks, c.discovery(ctx, &cfg)...)
+	if cfg.AuthorizeEndpoint == "" || cfg.TokenEndpoint == "" {
+		return checks
+	}
+	redirects := cfg.CallbackURLs()
+	for i, redirectURI := range redirects {
+		check := c.authorize(ctx, &cfg, redirectURI)
+		// Later redirect URIs are only used when the earlier ports are busy
+		if i > 0 && check.Level == "fail" && check.Class == ClassRedirectMismatch {
+			check.Level = "warn"
+			check.Detail += "; login falls back to it only when the ports before it are busy"
+		}
+		checks = append(checks, check)
+	}
+	checks = append(checks, c.token(ctx, &cfg, redirects[0]))
+	return checks
+}
+
+// discovery fetches the issuer's metadata, fills in the endpoints it names
+// that cfg lacks, and checks PKCE, scopes, and grant types.
+func (c *Checker) discovery(ctx context.Context, cfg *config.Config) []Check {
+	check := Check{Name: "Discovery"}
+	if cfg.Issuer == "" {
+		if cfg.AuthorizeEndpoint == "" || cfg.TokenEndpoint == "" {
+			check.Level, check.Detail = "fail", "no issuer configured, and authorize_endpoint or token_endpoint is missing"
+			check.Fix = "Set issuer in " + config.ConfigPath() + " to the identity provider's issuer URL"
+			return []Check{check}
+		}
+		check.Level, check.Detail = "warn", "no issuer configured; using the configured endpoints without metadata"
+		return []Check{check}
+	}
+
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var meta struct {
+		Issuer                string   `json:"issuer"`
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		ResponseTypes         []string `json:"response_types_supported"`
+		GrantTypes            []string `json:"grant_types_supported"`
+		CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+		Scopes                []string `json:"scopes_supported"`
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", discoveryURL, nil)
+	if err != nil {
+		check.Level, check.Detail = "fail", err.Error()
+		return []Check{check}
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		check.Level, check.Detail = "fail", fmt.Sprintf("GET %s: %v", discoveryURL, err)
+		return []Check{check}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		check.Level, check.Detail = "fail", fmt.Sprintf("GET %s: %s", discoveryURL, resp.Status)
+		check.Fix = "Check issuer in " + config.ConfigPath() + "; it must be the URL the identity provider puts in the iss claim"
+		return []Check{check}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&meta); err != nil {
+		check.Level, check.Detail = "fail", fmt.Sprintf("%s is not OIDC discovery metadata: %v", discoveryURL, err)
+		return []Check{check}
+	}
+	if cfg.AuthorizeEndpoint == "" {
+		cfg.AuthorizeEndpoint = meta.AuthorizationEndpoint
+	}
+	if cfg.TokenEndpoint == "" {
+		cfg.TokenEndpoint = meta.TokenEndpoint
+	}
+	// A custom domain in front of the issuer may only show the provider in
+	// the endpoints
+	if c.Provider == ProviderGeneric {
+		c.Provider = DetectProvider(cfg.Issuer, cfg.AuthorizeEndpoint)
+	}
+	switch {
+	case cfg.AuthorizeEndpoint == "" || cfg.TokenEndpoint == "":
+		check.Level, check.Detail = "fail", "metadata lacks authorization_endpoint or token_endpoint"
+	case meta.Issuer != "" && strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(cfg.Issuer, "/"):
+		check.Level, check.Detail = "warn", fmt.Sprintf("metadata names issuer %s, not %s; token validation compares them", meta.Issuer, cfg.Issuer)
+		check.Fix = "Set issuer in " + config.ConfigPath() + " to " + meta.Issuer
+	default:
+		check.Level, check.Detail = "ok", "authorize "+cfg.AuthorizeEndpoint+", token "+cfg.TokenEndpoint
+	}
+	checks := []Check{check}
+
+	pkce := Check{Name: "PKCE"}
+	switch {
+	case contains(meta.CodeChallengeMethods, "S256"):
+		pkce.Level, pkce.Detail = "ok", "S256 supported"
+	case len(meta.CodeChallengeMethods) > 0:
+		pkce.Level, pkce.Detail, pkce.Class = "fail", "S256 not among code_challenge_methods_supported "+strings.Join(meta.CodeChallengeMethods, ", "), ClassPKCE
+	case c.Provider != ProviderGeneric:
+		pkce.Level, pkce.Detail = "ok", "not advertised; "+c.Provider+" supports S256"
+	default:
+		pkce.Level, pkce.Detail = "warn", "code_challenge_methods_supported not advertised; login sends S256"
+	}
+	checks = append(checks, pkce)
+
+	if len(meta.ResponseTypes) > 0 && !contains(meta.ResponseTypes, "code") {
+		checks = append(checks, Check{Name: "Response types", Level: "fail", Class: ClassUnauthorizedClient,
+			Detail: "response type code not supported (" + strings.Join(meta.ResponseTypes, ", ") + ")"})
+	}
+	if len(meta.Scopes) > 0 {
+		var missing []string
+		for _, s := range Scopes {
+			if !contains(meta.Scopes, s) {
+				missing = append(missing, s)
+			}
+		}
+		if len(missing) > 0 {
+			checks = append(checks, Check{Name: "Scopes", Level: "fail", Class: ClassInvalidScope,
+				Detail: "scopes_supported lacks " + strings.Join(missing, ", ")})
+		}
+	}
+	if len(meta.GrantTypes) > 0 {
+		switch {
+		case !contains(meta.GrantTypes, "authorization_code"):
+			checks = append(checks, Check{Name: "Grant types", Level: "fail", Class: ClassUnauthorizedClient,
+				Detail: "authorization_code not among grant_types_supported"})
+		case !contains(meta.GrantTypes, "refresh_token"):
+			checks = append(checks, Check{Name: "Grant types", Level: "warn",
+				Detail: "refresh_token not among grant_types_supported; sessions will need a new login when the token expires"})
+		}
+	}
+	for i := range checks {
+		if checks[i].Class != "" {
+			checks[i].Fix = Fix(c.Provider, checks[i].Class, cfg.ClientID, "")
+		}
+	}
+	return checks
+}
+
+// authorize sends the authorization request login would send, without
+// following the redirect, and classifies the answer. An identity provider
+// that accepts the request shows or redirects to its sign-in page; one that
+// rejects it redirects with an error or renders an error page.
+func (c *Checker) authorize(ctx context.Context, cfg *config.Config, redirectURI string) Check {
+	check := Check{Name: "Authorize " + redirectURI}
+	pkce, err := auth.GeneratePKCE()
+	if err != nil {
+		check.Level, check.Detail = "fail", err.Error()
+		return check
+	}
+	defer pkce.Wipe()
+	state, err := auth.GenerateState()
+	if err != nil {
+		check.Level, check.Detail = "fail", err.Error()
+		return check
+	}
+	authURL := auth.AuthURL(cfg, redirectURI, pkce, state)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", authURL, nil)
+	if err != nil {
+		check.Level, check.Detail = "fail", err.Error()
+		return check
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		check.Level, check.Detail = "fail", fmt.Sprintf("GET %s: %v", cfg.AuthorizeEndpoint, err)
+		return check
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256<<10))
+
+	class, detail := Classify(resp.StatusCode, resp.Header.Get("Location"), redirectURI, body)
+	switch {
+	case class != "":
+		check.Level, check.Class, check.Detail = "fail", class, detail
+		check.Fix = Fix(c.Provider, class, cfg.ClientID, redirectURI)
+	case detail != "":
+		check.Level, check.Detail = "fail", detail
+	default:
+		check.Level, check.Detail = "ok", fmt.Sprintf("client %s accepted (%s)", cfg.ClientID, resp.Status)
+	}
+	return check
+}
+
+// token redeems a dummy code. invalid_grant means the endpoint accepts the
+// client without a secret; invalid_client means it wants one.
+func (c *Checker) token(ctx context.Context, cfg *config.Config, redirectURI string) Check {
+	check := Check{Name: "Token endpoint"}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {cfg.ClientID},
+		"code":          {dummyCode},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {strings.Repeat("0", 43)},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		check.Level, check.Detail = "fail", err.Error()
+		return check
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		check.Level, check.Detail = "fail", fmt.Sprintf("POST %s: %v", cfg.TokenEndpoint, err)
+		return check
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var oauthErr struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.Unmarshal(body, &oauthErr)
+	class := normalize(oauthErr.Error, oauthErr.Description)
+	switch {
+	case resp.StatusCode >= 500:
+		check.Level, check.Detail = "fail", "identity provider error: "+resp.Status
+	case class == ClassInvalidClient || class == ClassUnauthorizedClient:
+		check.Level, check.Class = "fail", class
+		check.Detail = fmt.Sprintf("client %s rejected without a secret (%s)", cfg.ClientID, describe(oauthErr.Error, oauthErr.Description))
+		check.Fix = Fix(c.Provider, class, cfg.ClientID, redirectURI)
+	case oauthErr.Error != "":
+		check.Level, check.Detail = "ok", "public client accepted, dummy code rejected as expected ("+oauthErr.Error+")"
+	default:
+		check.Level, check.Detail = "fail", fmt.Sprintf("unexpected %s response, not an OAuth token endpoint", resp.Status)
+	}
+	return check
+}
+
+var (
+	// Entra ID error pages name the problem by AADSTS code
+	aadstsPattern = regexp.MustCompile(`AADSTS(\d+)`)
+	aadstsClasses = map[string]string{
+		"50011":   ClassRedirectMismatch,
+		"500113":  ClassRedirectMismatch,
+		"700016":  ClassInvalidClient,
+		"7000218": ClassInvalidClient,
+		"700025":  ClassInvalidClient,
+		"70011":   ClassInvalidScope,
+		"650053":  ClassInvalidScope,
+		"700054":  ClassUnauthorizedClient,
+		"70001":   ClassUnauthorizedClient,
+		"9002325": ClassPKCE,
+	}
+	oauthErrorPattern = regexp.MustCompile(`\b(redirect_mismatch|unauthorized_client|invalid_scope|invalid_client)\b`)
+	// Okta's error page for an unregistered redirect URI
+	redirectMessagePattern = regexp.MustCompile(`(?i)redirect_uri.{0,80}(?:must be|mismatch|not (?:registered|allowed|valid))|(?:invalid|unregistered) redirect`)
+)
+
+// Classify reads the answer to an authorize request: an error in the
+// redirect, or on the identity provider's error page. It returns the class
+// of a recognised misconfiguration with a description, "" with a
+// description for another rejection, or "", "" if the request was accepted.
+func Classify(status int, location, redirectURI string, body []byte) (class, detail string) {
+	if location != "" {
+		if u, err := url.Parse(location); err == nil {
+			q := u.Query()
+			if e := q.Get("error"); e != "" {
+				d := q.Get("error_description")
+				if class := normalize(e, d); class != "" {
+					return class, describe(e, d)
+				}
+				return "", "rejected: " + describe(e, d)
+			}
+			// Accepted straight away: the browser has a session
+			if redirectURI != "" && strings.HasPrefix(location, redirectURI) && q.Get("code") != "" {
+				return "", ""
+			}
+		}
+	}
+	if m := aadstsPattern.FindSubmatch(body); m != nil {
+		code := "AADSTS" + string(m[1])
+		if class, ok := aadstsClasses[string(m[1])]; ok {
+			return class, code
+		}
+		return "", "rejected with " + code
+	}
+	if m := oauthErrorPattern.FindSubmatch(body); m != nil && status >= 400 {
+		return string(m[1]), string(m[1])
+	}
+	if redirectMessagePattern.Match(body) {
+		return ClassRedirectMismatch, "the error page says the redirect_uri is not registered"
+	}
+	if status >= 400 {
+		return "", "rejected: " + http.StatusText(status)
+	}
+	return "", ""
+}
+
+// normalize maps an OAuth error code and description to a class, or "".
+func normalize(code, description string) string {
+	if m := aadstsPattern.FindStringSubmatch(description); m != nil {
+		if class, ok := aadstsClasses[m[1]]; ok {
+			return class
+		}
+	}
+	switch code {
+	case ClassRedirectMismatch, ClassUnauthorizedClient, ClassInvalidScope, ClassInvalidClient:
+		return code
+	case "invalid_request":
+		lower := strings.ToLower(description)
+		switch {
+		case strings.Contains(lower, "redirect"):
+			return ClassRedirectMismatch
+		case strings.Contains(lower, "code_challenge") || strings.Contains(lower, "pkce"):
+			return ClassPKCE
+		case strings.Contains(lower, "client"):
+			return ClassInvalidClient
+		}
+	}
+	return ""
+}
+
+func describe(code, description string) string {
+	if description == "" {
+		return code
+	}
+	if i := strings.IndexAny(description, "\r\n"); i >= 0 {
+		description = description[:i]
+	}
+	return code + ": " + description
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
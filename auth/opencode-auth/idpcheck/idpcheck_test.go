@@ -0,0 +1,161 @@
+package idpcheck
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// fakeIdP registers http://localhost:19876/callback for client "public" and
+// lets client "confidential" sign in only with a secret.
+func fakeIdP(t *testing.T, meta map[string]interface{}) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			doc := map[string]interface{}{
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/oauth2/authorize",
+				"token_endpoint":         srv.URL + "/oauth2/token",
+			}
+			for k, v := range meta {
+				doc[k] = v
+			}
+			json.NewEncoder(w).Encode(doc)
+		case "/oauth2/authorize":
+			q := r.URL.Query()
+			if q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid email profile" {
+				t.Errorf("authorize query = %v", q)
+			}
+			if q.Get("redirect_uri") != "http://localhost:19876/callback" {
+				http.Redirect(w, r, "/error?error=redirect_mismatch&client_id="+q.Get("client_id"), http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, "/login?"+r.URL.RawQuery, http.StatusFound)
+		case "/oauth2/token":
+			r.ParseForm()
+			w.WriteHeader(http.StatusBadRequest)
+			if r.PostForm.Get("client_id") == "confidential" {
+				w.Write([]byte(`{"error":"invalid_client","error_description":"Client secret required"}`))
+				return
+			}
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func levels(checks []Check) map[string]Check {
+	got := map[string]Check{}
+	for _, c := range checks {
+		got[c.Name] = c
+	}
+	return got
+}
+
+func TestRun(t *testing.T) {
+	srv := fakeIdP(t, map[string]interface{}{"code_challenge_methods_supported": []string{"S256"}})
+
+	cfg := &config.Config{Issuer: srv.URL, ClientID: "public", CallbackPort: 19876, CallbackPorts: []int{19877}}
+	got := levels(New(cfg).Run(context.Background()))
+	for name, level := range map[string]string{
+		"Discovery": "ok",
+		"PKCE":      "ok",
+		"Authorize http://localhost:19876/callback": "ok",
+		"Authorize http://localhost:19877/callback": "warn",
+		"Token endpoint": "ok",
+	} {
+		if got[name].Level != level {
+			t.Errorf("%s: level %q (%s), want %q", name, got[name].Level, got[name].Detail, level)
+		}
+	}
+	if c := got["Authorize http://localhost:19877/callback"]; c.Class != ClassRedirectMismatch || !strings.Contains(c.Fix, "http://localhost:19877/callback") {
+		t.Errorf("fallback redirect = %+v", c)
+	}
+	if cfg.AuthorizeEndpoint != "" {
+		t.Error("Run() changed the config")
+	}
+
+	cfg = &config.Config{Issuer: srv.URL, ClientID: "confidential", CallbackPort: 19876}
+	if c := levels(New(cfg).Run(context.Background()))["Token endpoint"]; c.Level != "fail" || c.Class != ClassInvalidClient {
+		t.Errorf("confidential client token check = %+v", c)
+	}
+}
+
+func TestRun_Metadata(t *testing.T) {
+	srv := fakeIdP(t, map[string]interface{}{
+		"code_challenge_methods_supported": []string{"plain"},
+		"scopes_supported":                 []string{"openid", "email"},
+		"grant_types_supported":            []string{"authorization_code"},
+	})
+	checker := New(&config.Config{Issuer: srv.URL, ClientID: "public", CallbackPort: 19876})
+	checker.Provider = ProviderOkta
+	got := levels(checker.Run(context.Background()))
+
+	if c := got["PKCE"]; c.Level != "fail" || c.Class != ClassPKCE || !strings.Contains(c.Fix, "Require PKCE") {
+		t.Errorf("PKCE = %+v", c)
+	}
+	if c := got["Scopes"]; c.Level != "fail" || c.Class != ClassInvalidScope || !strings.Contains(c.Detail, "profile") {
+		t.Errorf("Scopes = %+v", c)
+	}
+	if c := got["Grant types"]; c.Level != "warn" {
+		t.Errorf("Grant types = %+v", c)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	redirect := "http://localhost:19876/callback"
+	tests := []struct {
+		name     string
+		status   int
+		location string
+		body     string
+		class    string
+		rejected bool
+	}{
+		{"cognito login page", 302, "https://auth.example.com/login?client_id=x", "", "", false},
+		{"cognito redirect mismatch", 302, "https://auth.example.com/error?error=redirect_mismatch&client_id=x", "", ClassRedirectMismatch, true},
+		{"error to the redirect uri", 302, redirect + "?error=unauthorized_client&error_description=Client+not+allowed", "", ClassUnauthorizedClient, true},
+		{"invalid scope", 302, redirect + "?error=invalid_scope", "", ClassInvalidScope, true},
+		{"existing session", 302, redirect + "?code=abc&state=s", "", "", false},
+		{"entra redirect mismatch", 200, "", "<div>AADSTS50011: The redirect URI specified in the request does not match</div>", ClassRedirectMismatch, true},
+		{"entra unknown app", 400, "", "AADSTS700016: Application with identifier 'x' was not found", ClassInvalidClient, true},
+		{"entra other", 200, "", "AADSTS50105: not assigned", "", true},
+		{"okta redirect page", 400, "", "<p>The 'redirect_uri' parameter must be a Login redirect URI in the client app settings</p>", ClassRedirectMismatch, true},
+		{"okta login page", 200, "", "<html>Sign In</html>", "", false},
+		{"server error", 500, "", "oops", "", true},
+		{"unknown oauth error", 302, redirect + "?error=access_denied", "", "", true},
+	}
+	for _, tt := range tests {
+		class, detail := Classify(tt.status, tt.location, redirect, []byte(tt.body))
+		if class != tt.class || (detail != "") != tt.rejected {
+			t.Errorf("%s: Classify() = %q, %q; want class %q, rejected %v", tt.name, class, detail, tt.class, tt.rejected)
+		}
+	}
+}
+
+func TestDetectProvider(t *testing.T) {
+	tests := map[string]string{
+		"https://cognito-idp.us-east-1.amazonaws.com/us-east-1_abc": ProviderCognito,
+		"https://dev-123.okta.com/oauth2/default":                   ProviderOkta,
+		"https://login.microsoftonline.com/tenant/v2.0":             ProviderEntra,
+		"https://sso.example.com":                                   ProviderGeneric,
+	}
+	for issuer, want := range tests {
+		if got := DetectProvider(issuer, ""); got != want {
+			t.Errorf("DetectProvider(%q) = %q, want %q", issuer, got, want)
+		}
+	}
+	if got := DetectProvider("https://sso.example.com", "https://auth.example.auth.us-east-1.amazoncognito.com/oauth2/authorize"); got != ProviderCognito {
+		t.Errorf("DetectProvider() from the authorize endpoint = %q", got)
+	}
+}
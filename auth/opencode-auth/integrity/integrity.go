@@ -0,0 +1,199 @@
+// Package integrity finds and repairs damaged files in the config directory:
+// empty or truncated JSON left by a crash, permissions a copy or restore
+// widened, and symlinks into a dotfile manager whose target is gone.
+package integrity
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMinAge is how long a file must be unmodified before its content is
+// judged. config.json is not written atomically, so a file caught mid-write
+// would otherwise look truncated.
+const DefaultMinAge = 5 * time.Second
+
+// Kinds of problems.
+const (
+	KindEmpty       = "empty file"
+	KindCorrupt     = "truncated JSON"
+	KindBrokenLink  = "broken symlink"
+	KindPermissions = "permissions too open"
+)
+
+// Options selects the directory to check.
+type Options struct {
+	ConfigDir string
+	MinAge    time.Duration
+	Now       func() time.Time
+}
+
+// Problem is a damaged file, or the config directory itself.
+type Problem struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+func (p Problem) String() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%s: %s", p.Path, p.Kind)
+	}
+	return fmt.Sprintf("%s: %s (%s)", p.Path, p.Kind, p.Detail)
+}
+
+// Repair is a problem Fix dealt with, and what it did.
+type Repair struct {
+	Problem
+	Action string
+	// Restored is set when the file was replaced from its backup
+	Restored bool
+}
+
+// Check returns the problems in the config directory, sorted by path.
+func Check(opts Options) []Problem {
+	opts = withDefaults(opts)
+	var found []Problem
+
+	if info, err := os.Stat(opts.ConfigDir); err != nil || !info.IsDir() {
+		return nil
+	} else if open(info.Mode(), 0700) {
+		found = append(found, Problem{Path: opts.ConfigDir, Kind: KindPermissions, Detail: fmt.Sprintf("mode %04o, want 0700", info.Mode().Perm())})
+	}
+
+	entries, err := os.ReadDir(opts.ConfigDir)
+	if err != nil {
+		return found
+	}
+	now := opts.Now()
+	for _, e := range entries {
+		// Backups hold the same secrets, so their permissions count too
+		backup := strings.HasSuffix(e.Name(), ".json.bak")
+		if !strings.HasSuffix(e.Name(), ".json") && !backup {
+			continue
+		}
+		path := filepath.Join(opts.ConfigDir, e.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) && e.Type()&os.ModeSymlink != 0 {
+				target, _ := os.Readlink(path)
+				found = append(found, Problem{Path: path, Kind: KindBrokenLink, Detail: "target " + target + " is missing"})
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if open(info.Mode(), 0600) {
+			found = append(found, Problem{Path: path, Kind: KindPermissions, Detail: fmt.Sprintf("mode %04o, want 0600", info.Mode().Perm())})
+		}
+		if backup || now.Sub(info.ModTime()) < opts.MinAge {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if kind, detail := judge(data); kind != "" {
+			found = append(found, Problem{Path: path, Kind: kind, Detail: detail})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found
+}
+
+// Fix repairs every problem Check reports. A damaged file is renamed to
+// <name>.corrupt-<time> so nothing is lost, then restored from <name>.bak
+// if that holds valid JSON; permissions are tightened in place. It returns
+// the repairs made and the errors for the rest.
+func Fix(opts Options) ([]Repair, []error) {
+	opts = withDefaults(opts)
+	var repairs []Repair
+	var errs []error
+	for _, p := range Check(opts) {
+		r := Repair{Problem: p}
+		var err error
+		if r.Action, r.Restored, err = fix(p, opts.Now()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Path, err))
+			continue
+		}
+		repairs = append(repairs, r)
+	}
+	return repairs, errs
+}
+
+func fix(p Problem, now time.Time) (string, bool, error) {
+	if p.Kind == KindPermissions {
+		perm := os.FileMode(0600)
+		if info, err := os.Stat(p.Path); err == nil && info.IsDir() {
+			perm = 0700
+		}
+		if err := os.Chmod(p.Path, perm); err != nil {
+			return "", false, err
+		}
+		return fmt.Sprintf("set mode %04o", perm), false, nil
+	}
+
+	aside := fmt.Sprintf("%s.corrupt-%s", p.Path, now.UTC().Format("20060102T150405Z"))
+	if err := os.Rename(p.Path, aside); err != nil {
+		return "", false, err
+	}
+	action := "moved aside to " + filepath.Base(aside)
+
+	backup := p.Path + ".bak"
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return action + "; no backup to restore", false, nil
+	}
+	if kind, _ := judge(data); kind != "" {
+		return action + "; " + filepath.Base(backup) + " is damaged too, not restored", false, nil
+	}
+	if err := os.WriteFile(p.Path, data, 0600); err != nil {
+		return action, false, fmt.Errorf("restore from %s: %w", filepath.Base(backup), err)
+	}
+	return action + "; restored from " + filepath.Base(backup), true, nil
+}
+
+// judge returns the kind of damage in a JSON file's content, or "" if it
+// has none. Only what a crash leaves counts: no content, content cut short,
+// or NUL bytes from blocks allocated but never written. Other syntax errors,
+// such as a comment added by hand to opencode.json, are not damage.
+func judge(data []byte) (kind, detail string) {
+	if len(bytes.Trim(data, " \t\r\n\x00")) == 0 {
+		return KindEmpty, fmt.Sprintf("%d bytes", len(data))
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return KindCorrupt, fmt.Sprintf("NUL byte at offset %d", i)
+	}
+	var v interface{}
+	var syntaxErr *json.SyntaxError
+	if err := json.Unmarshal(data, &v); errors.As(err, &syntaxErr) && syntaxErr.Offset >= int64(len(data)) {
+		return KindCorrupt, fmt.Sprintf("truncated after %d bytes", len(data))
+	}
+	return "", ""
+}
+
+// open reports whether mode grants more than want. Windows has no Unix
+// permission bits, so nothing is reported there.
+func open(mode, want os.FileMode) bool {
+	return runtime.GOOS != "windows" && mode.Perm()&^want != 0
+}
+
+func withDefaults(opts Options) Options {
+	if opts.MinAge == 0 {
+		opts.MinAge = DefaultMinAge
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return opts
+}
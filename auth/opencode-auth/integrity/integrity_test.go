@@ -0,0 +1,118 @@
+package integrity
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, path, content string, perm os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFix(t *testing.T) {
+	dir := t.TempDir()
+	os.Chmod(dir, 0700)
+	write(t, filepath.Join(dir, "tokens.json"), "", 0600)
+	write(t, filepath.Join(dir, "config.json"), `{"client_id": "abc", "issu`, 0600)
+	write(t, filepath.Join(dir, "config.json.bak"), `{"client_id": "abc"}`, 0600)
+	write(t, filepath.Join(dir, "opencode.json"), `{"model": `, 0600)
+	write(t, filepath.Join(dir, "opencode.json.bak"), ``, 0600)
+	write(t, filepath.Join(dir, "device.json"), `{"id": "d"}`, 0600)
+	write(t, filepath.Join(dir, "project-keys.json"), "{\"a\": 1}\x00\x00\x00", 0600)
+	write(t, filepath.Join(dir, "history.json"), "\x00\x00\x00\x00", 0600)
+	write(t, filepath.Join(dir, "hand-edited.json"), "{\n  // a comment\n  \"model\": \"x\"\n}\n", 0600)
+	write(t, filepath.Join(dir, "notes.txt"), ``, 0600)
+	if runtime.GOOS != "windows" {
+		os.Chmod(filepath.Join(dir, "device.json"), 0644)
+		os.Chmod(filepath.Join(dir, "config.json.bak"), 0644)
+		if err := os.Symlink(filepath.Join(dir, "dotfiles", "proxy.json"), filepath.Join(dir, "proxy.json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Written a moment ago: possibly mid-write, so left alone
+	later := func() time.Time { return time.Now().Add(time.Minute) }
+	write(t, filepath.Join(dir, "version-check.json"), `{`, 0600)
+	if problems := Check(Options{ConfigDir: dir}); len(problems) == 0 {
+		t.Fatal("Check() found nothing")
+	} else {
+		for _, p := range problems {
+			if filepath.Base(p.Path) == "version-check.json" {
+				t.Errorf("a file written just now was judged: %v", p)
+			}
+		}
+	}
+	os.Remove(filepath.Join(dir, "version-check.json"))
+
+	repairs, errs := Fix(Options{ConfigDir: dir, Now: later})
+	if len(errs) != 0 {
+		t.Fatalf("Fix() errors = %v", errs)
+	}
+	got := map[string]Repair{}
+	for _, r := range repairs {
+		got[filepath.Base(r.Path)] = r
+	}
+	want := map[string]string{
+		"tokens.json":       KindEmpty,
+		"config.json":       KindCorrupt,
+		"opencode.json":     KindCorrupt,
+		"project-keys.json": KindCorrupt,
+		"history.json":      KindEmpty,
+	}
+	if runtime.GOOS != "windows" {
+		want["device.json"] = KindPermissions
+		want["config.json.bak"] = KindPermissions
+		want["proxy.json"] = KindBrokenLink
+	}
+	if len(got) != len(want) {
+		t.Errorf("repairs = %v, want %v", repairs, want)
+	}
+	for name, kind := range want {
+		if got[name].Kind != kind {
+			t.Errorf("%s: repaired as %q, want %q", name, got[name].Kind, kind)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "config.json")); err != nil || string(data) != `{"client_id": "abc"}` {
+		t.Errorf("config.json = %q, %v; want it restored from the backup", data, err)
+	}
+	if r := got["config.json"]; !r.Restored || !strings.Contains(r.Action, "restored from config.json.bak") {
+		t.Errorf("config.json action = %q", got["config.json"].Action)
+	}
+	if r := got["opencode.json"]; r.Restored || !strings.Contains(r.Action, "damaged too") {
+		t.Errorf("opencode.json action = %q", got["opencode.json"].Action)
+	}
+	for _, gone := range []string{"tokens.json", "opencode.json", "proxy.json"} {
+		if _, err := os.Lstat(filepath.Join(dir, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s still in place", gone)
+		}
+	}
+	moved := 0
+	for _, kind := range want {
+		if kind != KindPermissions {
+			moved++
+		}
+	}
+	if aside, _ := filepath.Glob(filepath.Join(dir, "*.corrupt-*")); len(aside) != moved {
+		t.Errorf("moved aside = %v", aside)
+	}
+	if runtime.GOOS != "windows" {
+		if info, _ := os.Stat(filepath.Join(dir, "device.json")); info.Mode().Perm() != 0600 {
+			t.Errorf("device.json mode = %04o, want 0600", info.Mode().Perm())
+		}
+	}
+
+	if problems := Check(Options{ConfigDir: dir, Now: later}); len(problems) != 0 {
+		t.Errorf("after Fix, Check() = %v", problems)
+	}
+}
@@ -0,0 +1,174 @@
+// Package janitor finds and removes leftover temporary files and stale locks
+// from the config directory and the system temp directory.
+package janitor
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMinAge is how old a temp or lock file in the config directory
+	// must be before it is removed. Atomic writes and lock holds last
+	// milliseconds, so an hour-old file is abandoned.
+	DefaultMinAge = time.Hour
+
+	// DefaultTempMinAge is how old an installer download or extraction
+	// directory must be. install.sh can wait on prompts, so these get longer.
+	DefaultTempMinAge = 24 * time.Hour
+
+	// DownloadsDir is the subdirectory of the config directory that
+	// 'update' downloads the installer to.
+	DownloadsDir = "downloads"
+)
+
+// Kinds of artifacts.
+const (
+	KindTemp      = "temp file"
+	KindLock      = "lock"
+	KindInstaller = "installer download"
+	KindUpdateDir = "update directory"
+)
+
+// Options selects where to look and how old artifacts must be.
+type Options struct {
+	ConfigDir  string
+	TempDir    string // defaults to os.TempDir()
+	MinAge     time.Duration
+	TempMinAge time.Duration
+	Now        func() time.Time
+}
+
+// Artifact is a file or directory that can be removed.
+type Artifact struct {
+	Path string
+	Kind string
+	Size int64
+	Age  time.Duration
+}
+
+// Find returns the removable artifacts, oldest first. Lock files are only
+// reported if no process holds them.
+func Find(opts Options) []Artifact {
+	opts = withDefaults(opts)
+	now := opts.Now()
+
+	var found []Artifact
+	add := func(path, kind string, minAge time.Duration) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return
+		}
+		age := now.Sub(info.ModTime())
+		if age < minAge {
+			return
+		}
+		size := info.Size()
+		if info.IsDir() {
+			size = dirSize(path)
+		}
+		found = append(found, Artifact{Path: path, Kind: kind, Size: size, Age: age})
+	}
+
+	if entries, err := os.ReadDir(opts.ConfigDir); err == nil {
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			path := filepath.Join(opts.ConfigDir, e.Name())
+			switch {
+			case strings.HasSuffix(e.Name(), ".tmp"):
+				add(path, KindTemp, opts.MinAge)
+			case strings.HasSuffix(e.Name(), ".lock"):
+				if unlocked(path) {
+					add(path, KindLock, opts.MinAge)
+				}
+			}
+		}
+	}
+
+	// Finished downloads, and partial ones 'update' would otherwise resume.
+	// Older versions downloaded to the temp directory.
+	downloadDirs := []string{opts.TempDir}
+	if opts.ConfigDir != "" {
+		downloadDirs = append(downloadDirs, filepath.Join(opts.ConfigDir, DownloadsDir))
+	}
+	for _, dir := range downloadDirs {
+		for _, pattern := range []string{"opencode-installer-*.zip", "opencode-installer-*.zip.part", "opencode-installer-*.zip.etag"} {
+			installers, _ := filepath.Glob(filepath.Join(dir, pattern))
+			for _, path := range installers {
+				add(path, KindInstaller, opts.TempMinAge)
+			}
+		}
+	}
+	updateDirs, _ := filepath.Glob(filepath.Join(opts.TempDir, "opencode-update-*"))
+	for _, path := range updateDirs {
+		add(path, KindUpdateDir, opts.TempMinAge)
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Age > found[j].Age })
+	return found
+}
+
+// Remove deletes an artifact. A lock file is deleted only if it can be
+// locked at that moment, so a lock taken since Find is left alone.
+func Remove(a Artifact) error {
+	switch a.Kind {
+	case KindLock:
+		return removeLock(a.Path)
+	case KindUpdateDir:
+		return os.RemoveAll(a.Path)
+	default:
+		return os.Remove(a.Path)
+	}
+}
+
+// Clean removes every artifact Find reports and returns those removed and
+// the errors for the rest.
+func Clean(opts Options) ([]Artifact, []error) {
+	var removed []Artifact
+	var errs []error
+	for _, a := range Find(opts) {
+		if err := Remove(a); err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		removed = append(removed, a)
+	}
+	return removed, errs
+}
+
+func withDefaults(opts Options) Options {
+	if opts.TempDir == "" {
+		opts.TempDir = os.TempDir()
+	}
+	if opts.MinAge == 0 {
+		opts.MinAge = DefaultMinAge
+	}
+	if opts.TempMinAge == 0 {
+		opts.TempMinAge = DefaultTempMinAge
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return opts
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
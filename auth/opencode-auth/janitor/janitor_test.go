@@ -0,0 +1,100 @@
+package janitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func touch(t *testing.T, path string, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	configDir := t.TempDir()
+	tempDir := t.TempDir()
+
+	touch(t, filepath.Join(configDir, "tokens.json.tmp"), 2*time.Hour)
+	touch(t, filepath.Join(configDir, "fresh.tmp"), time.Minute)
+	touch(t, filepath.Join(configDir, "proxy-startup.lock"), 2*time.Hour)
+	touch(t, filepath.Join(configDir, "tokens.json"), 2*time.Hour)
+	touch(t, filepath.Join(tempDir, "opencode-installer-123.zip"), 48*time.Hour)
+	touch(t, filepath.Join(tempDir, "opencode-installer-456.zip"), 2*time.Hour)
+	touch(t, filepath.Join(tempDir, "opencode-installer-abc.zip.part"), 48*time.Hour)
+	touch(t, filepath.Join(tempDir, "unrelated.zip"), 48*time.Hour)
+	os.Mkdir(filepath.Join(configDir, DownloadsDir), 0700)
+	touch(t, filepath.Join(configDir, DownloadsDir, "opencode-installer-def.zip.etag"), 48*time.Hour)
+	updateDir := filepath.Join(tempDir, "opencode-update-789")
+	os.Mkdir(updateDir, 0700)
+	touch(t, filepath.Join(updateDir, "install.sh"), 48*time.Hour)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(updateDir, old, old)
+
+	// A lock held by another process is never removed
+	held := filepath.Join(configDir, "held.lock")
+	touch(t, held, 2*time.Hour)
+	lock := tryLock(held)
+	if lock == nil {
+		t.Fatal("tryLock() failed on a free lock")
+	}
+	defer lock.Close()
+
+	removed, errs := Clean(Options{ConfigDir: configDir, TempDir: tempDir})
+	if len(errs) != 0 {
+		t.Fatalf("Clean() errors = %v", errs)
+	}
+
+	got := map[string]string{}
+	for _, a := range removed {
+		got[filepath.Base(a.Path)] = a.Kind
+	}
+	want := map[string]string{
+		"tokens.json.tmp":                 KindTemp,
+		"proxy-startup.lock":              KindLock,
+		"opencode-installer-123.zip":      KindInstaller,
+		"opencode-installer-abc.zip.part": KindInstaller,
+		"opencode-installer-def.zip.etag": KindInstaller,
+		"opencode-update-789":             KindUpdateDir,
+	}
+	if len(got) != len(want) {
+		t.Errorf("removed %v, want %v", got, want)
+	}
+	for name, kind := range want {
+		if got[name] != kind {
+			t.Errorf("%s: removed as %q, want %q", name, got[name], kind)
+		}
+	}
+
+	for _, kept := range []string{
+		filepath.Join(configDir, "fresh.tmp"),
+		filepath.Join(configDir, "tokens.json"),
+		held,
+		filepath.Join(tempDir, "opencode-installer-456.zip"),
+		filepath.Join(tempDir, "unrelated.zip"),
+	} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("%s was removed: %v", filepath.Base(kept), err)
+		}
+	}
+}
+
+func TestFind_MinAge(t *testing.T) {
+	configDir := t.TempDir()
+	touch(t, filepath.Join(configDir, "tokens.json.tmp"), 10*time.Minute)
+
+	if found := Find(Options{ConfigDir: configDir, TempDir: t.TempDir()}); len(found) != 0 {
+		t.Errorf("Find() = %v, want nothing younger than the default age", found)
+	}
+	found := Find(Options{ConfigDir: configDir, TempDir: t.TempDir(), MinAge: 5 * time.Minute})
+	if len(found) != 1 || found[0].Size != 1 {
+		t.Errorf("Find(MinAge: 5m) = %+v, want the temp file", found)
+	}
+}
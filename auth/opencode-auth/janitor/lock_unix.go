@@ -0,0 +1,45 @@
+//go:build !windows
+
+package janitor
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock on path without blocking. It returns nil if
+// another process holds the lock or the file cannot be opened.
+func tryLock(path string) *os.File {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil
+	}
+	return file
+}
+
+// unlocked reports whether no process holds the lock on path.
+func unlocked(path string) bool {
+	file := tryLock(path)
+	if file == nil {
+		return false
+	}
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+	return true
+}
+
+// removeLock deletes the lock file while holding its lock, so no other
+// process can be inside the critical section it guards.
+func removeLock(path string) error {
+	file := tryLock(path)
+	if file == nil {
+		return &os.PathError{Op: "remove", Path: path, Err: syscall.EWOULDBLOCK}
+	}
+	defer file.Close()
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return os.Remove(path)
+}
@@ -0,0 +1,70 @@
+//go:build windows
+
+package janitor
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileExclusiveLock   = 0x00000002
+	lockfileFailImmediately = 0x00000001
+)
+
+// tryLock takes an exclusive lock on path without blocking. It returns nil if
+// another process holds the lock or the file cannot be opened.
+func tryLock(path string) *os.File {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+	var overlapped syscall.Overlapped
+	r1, _, _ := procLockFileEx.Call(
+		file.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if r1 == 0 {
+		file.Close()
+		return nil
+	}
+	return file
+}
+
+func unlock(file *os.File) {
+	var overlapped syscall.Overlapped
+	procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	file.Close()
+}
+
+// unlocked reports whether no process holds the lock on path.
+func unlocked(path string) bool {
+	file := tryLock(path)
+	if file == nil {
+		return false
+	}
+	unlock(file)
+	return true
+}
+
+// removeLock deletes the lock file if it is free. Windows cannot delete an
+// open file, so the lock is released just before the removal.
+func removeLock(path string) error {
+	file := tryLock(path)
+	if file == nil {
+		return &os.PathError{Op: "remove", Path: path, Err: syscall.Errno(33)} // ERROR_LOCK_VIOLATION
+	}
+	unlock(file)
+	return os.Remove(path)
+}
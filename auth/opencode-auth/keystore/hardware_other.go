@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package keystore
+
+// platformStore returns nil: there is no hardware store for RSA keys here.
+func platformStore() store {
+	return nil
+}
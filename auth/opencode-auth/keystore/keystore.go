@@ -0,0 +1,160 @@
+// Package keystore keeps the device's RSA signing key. Where the machine has
+// a TPM the key is created inside it and never leaves it, so a copy of the
+// config directory taken from a stolen laptop can't sign for the device.
+// Elsewhere the key is held in software, as PKCS #8 in the identity file.
+//
+// The macOS Secure Enclave only holds P-256 keys, and device assertions are
+// RS256, so macOS uses the software store.
+package keystore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Values of the device_key_store setting.
+const (
+	// Auto uses the hardware store where there is one (the default)
+	Auto = "auto"
+	// Software always keeps the key in the identity file
+	Software = "software"
+	// Hardware refuses to create a key without a hardware store
+	Hardware = "hardware"
+)
+
+// KeyBits is the size of device keys, in either store.
+const KeyBits = 2048
+
+// ErrUnavailable means this machine has no usable hardware key store.
+var ErrUnavailable = errors.New("no hardware key store on this machine")
+
+// Key is a stored signing key. Sign takes a SHA-256 digest and returns an
+// RSASSA-PKCS1-v1_5 signature, as rsa.PrivateKey does.
+type Key struct {
+	crypto.Signer
+	// Store names the store holding the key: "software", or a hardware
+	// store such as "tpm"
+	Store string
+	// Ref is what the store needs to open the key again: the PKCS #8 key,
+	// base64-encoded, for software, or a handle that is useless off this
+	// machine for hardware
+	Ref string
+}
+
+// store is a hardware key store.
+type store interface {
+	name() string
+	// available reports whether keys can be created, which may take a moment
+	available() bool
+	create() (crypto.Signer, string, error)
+	open(ref string) (crypto.Signer, error)
+	delete(ref string) error
+}
+
+// hardware is this platform's hardware store, or nil.
+var hardware store = platformStore()
+
+// HardwareName returns the name of this machine's hardware store, or "" if
+// it has none.
+func HardwareName() string {
+	if hardware == nil || !hardware.available() {
+		return ""
+	}
+	return hardware.name()
+}
+
+// Create makes a new key in the store mode selects. Auto falls back to
+// software when the hardware store fails.
+func Create(mode string) (*Key, error) {
+	switch mode {
+	case "", Auto, Hardware:
+		if hardware == nil || !hardware.available() {
+			if mode == Hardware {
+				return nil, ErrUnavailable
+			}
+			break
+		}
+		signer, ref, err := hardware.create()
+		if err == nil {
+			return &Key{Signer: signer, Store: hardware.name(), Ref: ref}, nil
+		}
+		if mode == Hardware {
+			return nil, fmt.Errorf("failed to create a %s key: %w", hardware.name(), err)
+		}
+	case Software:
+	default:
+		return nil, fmt.Errorf("unknown key store %q (expected auto, software or hardware)", mode)
+	}
+	return createSoftware()
+}
+
+// Open returns the key a store created.
+func Open(storeName, ref string) (*Key, error) {
+	if storeName == "" || storeName == Software {
+		return openSoftware(ref)
+	}
+	if hardware == nil || hardware.name() != storeName {
+		return nil, fmt.Errorf("the device key is in a %s, which this machine does not have", storeName)
+	}
+	signer, err := hardware.open(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s key: %w", storeName, err)
+	}
+	return &Key{Signer: signer, Store: storeName, Ref: ref}, nil
+}
+
+// Delete destroys a hardware key. Software keys go with the identity file.
+func Delete(storeName, ref string) error {
+	if storeName == "" || storeName == Software || hardware == nil || hardware.name() != storeName {
+		return nil
+	}
+	return hardware.delete(ref)
+}
+
+// PublicKey returns the key's public half.
+func (k *Key) PublicKey() *rsa.PublicKey {
+	pub, _ := k.Public().(*rsa.PublicKey)
+	return pub
+}
+
+func createSoftware() (*Key, error) {
+	key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate device key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Signer: key, Store: Software, Ref: base64.StdEncoding.EncodeToString(der)}, nil
+}
+
+func openSoftware(ref string) (*Key, error) {
+	der, err := base64.StdEncoding.DecodeString(ref)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA device key")
+	}
+	return &Key{Signer: key, Store: Software, Ref: ref}, nil
+}
+
+// parsePublicKey checks that a hardware store's public key is RSA.
+func parsePublicKey(pub crypto.PublicKey) (*rsa.PublicKey, error) {
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaPub, nil
+}
@@ -0,0 +1,54 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestSoftwareKey(t *testing.T) {
+	key, err := Create(Software)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Store != Software || key.PublicKey().N.BitLen() != KeyBits {
+		t.Fatalf("Create(software) = %s key of %d bits", key.Store, key.PublicKey().N.BitLen())
+	}
+	opened, err := Open("", key.Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("payload"))
+	sig, err := opened.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(key.PublicKey(), crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("signature by the reopened key: %v", err)
+	}
+	if err := Delete(Software, key.Ref); err != nil {
+		t.Errorf("Delete(software) = %v", err)
+	}
+}
+
+func TestCreateWithoutHardware(t *testing.T) {
+	saved := hardware
+	hardware = nil
+	defer func() { hardware = saved }()
+
+	if _, err := Create(Hardware); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Create(hardware) = %v, want ErrUnavailable", err)
+	}
+	if key, err := Create(Auto); err != nil || key.Store != Software {
+		t.Errorf("Create(auto) = %+v, %v, want a software key", key, err)
+	}
+	if _, err := Create("enclave"); err == nil {
+		t.Error("Create(enclave) succeeded")
+	}
+	if _, err := Open("tpm", "ref"); err == nil {
+		t.Error("Open(tpm) succeeded without a TPM")
+	}
+}
@@ -0,0 +1,236 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tpmDevice is the kernel's resource-managed TPM 2.0 device
+	tpmDevice = "/dev/tpmrm0"
+
+	// tpmCommandTimeout bounds one tpm2-tools command
+	tpmCommandTimeout = 30 * time.Second
+
+	// tpmKeyAttributes make an unrestricted signing key whose private part
+	// was made in the TPM and can't leave it
+	tpmKeyAttributes = "fixedtpm|fixedparent|sensitivedataorigin|userwithauth|sign"
+)
+
+// tpmStore keeps keys in the TPM through tpm2-tools. The ref is the key's
+// public and private blobs; the private blob is encrypted under the TPM's
+// storage key, so it can only be loaded into this TPM.
+type tpmStore struct{}
+
+func platformStore() store {
+	return tpmStore{}
+}
+
+func (tpmStore) name() string {
+	return "tpm"
+}
+
+func (tpmStore) available() bool {
+	f, err := os.OpenFile(tpmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	for _, tool := range []string{"tpm2_createprimary", "tpm2_create", "tpm2_load", "tpm2_readpublic", "tpm2_sign"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (tpmStore) create() (crypto.Signer, string, error) {
+	dir, err := os.MkdirTemp("", "opencode-auth-tpm-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := tpm2(dir, "tpm2_createprimary", "-C", "o", "-c", "primary.ctx"); err != nil {
+		return nil, "", err
+	}
+	if err := tpm2(dir, "tpm2_create", "-C", "primary.ctx", "-G", "rsa2048:rsassa-sha256",
+		"-a", tpmKeyAttributes, "-u", "key.pub", "-r", "key.priv"); err != nil {
+		return nil, "", err
+	}
+	pub, err := os.ReadFile(filepath.Join(dir, "key.pub"))
+	if err != nil {
+		return nil, "", err
+	}
+	priv, err := os.ReadFile(filepath.Join(dir, "key.priv"))
+	if err != nil {
+		return nil, "", err
+	}
+	key := &tpmKey{pub: pub, priv: priv}
+	if err := key.init(dir); err != nil {
+		return nil, "", err
+	}
+	ref := base64.StdEncoding.EncodeToString(pub) + "." + base64.StdEncoding.EncodeToString(priv)
+	return key, ref, nil
+}
+
+func (tpmStore) open(ref string) (crypto.Signer, error) {
+	pubPart, privPart, ok := strings.Cut(ref, ".")
+	if !ok {
+		return nil, errors.New("invalid key reference")
+	}
+	pub, err := base64.StdEncoding.DecodeString(pubPart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key reference: %w", err)
+	}
+	priv, err := base64.StdEncoding.DecodeString(privPart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key reference: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "opencode-auth-tpm-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	key := &tpmKey{pub: pub, priv: priv}
+	if err := key.init(dir); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// delete has nothing to do: the key only exists as the blobs in the ref.
+func (tpmStore) delete(string) error {
+	return nil
+}
+
+// tpmKey signs with a key in the TPM.
+type tpmKey struct {
+	pub, priv []byte
+	public    crypto.PublicKey
+
+	mu sync.Mutex
+	// loaded is the saved context of the key loaded into the TPM, which
+	// saves reloading it for each signature until the TPM is reset
+	loaded []byte
+}
+
+// init loads the key and reads its public half, in dir.
+func (k *tpmKey) init(dir string) error {
+	if err := k.load(dir); err != nil {
+		return err
+	}
+	if err := tpm2(dir, "tpm2_readpublic", "-c", "key.ctx", "-f", "pem", "-o", "key.pem"); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "key.pem"))
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("tpm2_readpublic wrote no PEM public key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	pub, err := parsePublicKey(parsed)
+	if err != nil {
+		return err
+	}
+	k.public = pub
+	return nil
+}
+
+// load loads the key under the owner's primary key, which the TPM derives
+// again from its seed, and keeps the context. It leaves key.ctx in dir.
+func (k *tpmKey) load(dir string) error {
+	if err := os.WriteFile(filepath.Join(dir, "key.pub"), k.pub, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.priv"), k.priv, 0600); err != nil {
+		return err
+	}
+	if err := tpm2(dir, "tpm2_createprimary", "-C", "o", "-c", "primary.ctx"); err != nil {
+		return err
+	}
+	if err := tpm2(dir, "tpm2_load", "-C", "primary.ctx", "-u", "key.pub", "-r", "key.priv", "-c", "key.ctx"); err != nil {
+		return err
+	}
+	loaded, err := os.ReadFile(filepath.Join(dir, "key.ctx"))
+	if err != nil {
+		return err
+	}
+	k.loaded = loaded
+	return nil
+}
+
+func (k *tpmKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign signs a SHA-256 digest with RSASSA-PKCS1-v1_5.
+func (k *tpmKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != sha256.Size {
+		return nil, errors.New("tpm keys only sign SHA-256 digests")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	dir, err := os.MkdirTemp("", "opencode-auth-tpm-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "digest.bin"), digest, 0600); err != nil {
+		return nil, err
+	}
+	sign := func() ([]byte, error) {
+		if err := os.WriteFile(filepath.Join(dir, "key.ctx"), k.loaded, 0600); err != nil {
+			return nil, err
+		}
+		if err := tpm2(dir, "tpm2_sign", "-c", "key.ctx", "-g", "sha256", "-s", "rsassa", "-d",
+			"-f", "plain", "-o", "sig.bin", "digest.bin"); err != nil {
+			return nil, err
+		}
+		return os.ReadFile(filepath.Join(dir, "sig.bin"))
+	}
+	sig, err := sign()
+	if err == nil {
+		return sig, nil
+	}
+	// The saved context does not survive a reboot; load the key again
+	if err := k.load(dir); err != nil {
+		return nil, fmt.Errorf("failed to load the tpm key: %w", err)
+	}
+	return sign()
+}
+
+// tpm2 runs a tpm2-tools command in dir.
+func tpm2(dir, tool string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tpmCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
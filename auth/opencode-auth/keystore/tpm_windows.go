@@ -0,0 +1,220 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// platformProvider is the CNG key storage provider backed by the TPM
+	platformProvider = "Microsoft Platform Crypto Provider"
+
+	// keyNamePrefix names the persisted keys this store creates
+	keyNamePrefix = "opencode-auth-device-"
+
+	bcryptPadPKCS1 = 0x2
+	// rsaPublicMagic is BCRYPT_RSAPUBLIC_MAGIC ("RSA1")
+	rsaPublicMagic = 0x31415352
+)
+
+var (
+	ncrypt                  = windows.NewLazySystemDLL("ncrypt.dll")
+	procOpenStorageProvider = ncrypt.NewProc("NCryptOpenStorageProvider")
+	procCreatePersistedKey  = ncrypt.NewProc("NCryptCreatePersistedKey")
+	procSetProperty         = ncrypt.NewProc("NCryptSetProperty")
+	procFinalizeKey         = ncrypt.NewProc("NCryptFinalizeKey")
+	procOpenKey             = ncrypt.NewProc("NCryptOpenKey")
+	procExportKey           = ncrypt.NewProc("NCryptExportKey")
+	procSignHash            = ncrypt.NewProc("NCryptSignHash")
+	procDeleteKey           = ncrypt.NewProc("NCryptDeleteKey")
+	procFreeObject          = ncrypt.NewProc("NCryptFreeObject")
+)
+
+// tpmStore keeps keys in the TPM through the Platform Crypto Provider. The
+// ref is the persisted key's name; the key itself stays in the provider.
+type tpmStore struct{}
+
+func platformStore() store {
+	return tpmStore{}
+}
+
+func (tpmStore) name() string {
+	return "tpm"
+}
+
+func (tpmStore) available() bool {
+	if ncrypt.Load() != nil {
+		return false
+	}
+	prov, err := openProvider()
+	if err != nil {
+		return false
+	}
+	freeObject(prov)
+	return true
+}
+
+func (tpmStore) create() (crypto.Signer, string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	name := keyNamePrefix + hex.EncodeToString(b)
+
+	prov, err := openProvider()
+	if err != nil {
+		return nil, "", err
+	}
+	defer freeObject(prov)
+	var key uintptr
+	if err := check(procCreatePersistedKey.Call(prov, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(utf16("RSA"))), uintptr(unsafe.Pointer(utf16(name))), 0, 0)); err != nil {
+		return nil, "", err
+	}
+	defer freeObject(key)
+	bits := uint32(KeyBits)
+	if err := check(procSetProperty.Call(key, uintptr(unsafe.Pointer(utf16("Length"))), uintptr(unsafe.Pointer(&bits)), unsafe.Sizeof(bits), 0)); err != nil {
+		return nil, "", err
+	}
+	if err := check(procFinalizeKey.Call(key, 0)); err != nil {
+		return nil, "", err
+	}
+	pub, err := exportPublic(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return &tpmKey{name: name, public: pub}, name, nil
+}
+
+func (tpmStore) open(ref string) (crypto.Signer, error) {
+	prov, key, err := openKey(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer freeObject(prov)
+	defer freeObject(key)
+	pub, err := exportPublic(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tpmKey{name: ref, public: pub}, nil
+}
+
+func (tpmStore) delete(ref string) error {
+	prov, key, err := openKey(ref)
+	if err != nil {
+		return err
+	}
+	defer freeObject(prov)
+	// NCryptDeleteKey frees the handle
+	return check(procDeleteKey.Call(key, 0))
+}
+
+// tpmKey signs with a persisted key in the Platform Crypto Provider.
+type tpmKey struct {
+	name   string
+	public *rsa.PublicKey
+}
+
+func (k *tpmKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign signs a SHA-256 digest with RSASSA-PKCS1-v1_5.
+func (k *tpmKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != sha256.Size {
+		return nil, errors.New("tpm keys only sign SHA-256 digests")
+	}
+	prov, key, err := openKey(k.name)
+	if err != nil {
+		return nil, err
+	}
+	defer freeObject(prov)
+	defer freeObject(key)
+
+	padding := struct{ algID *uint16 }{windows.StringToUTF16Ptr("SHA256")}
+	var size uint32
+	if err := check(procSignHash.Call(key, uintptr(unsafe.Pointer(&padding)), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		0, 0, uintptr(unsafe.Pointer(&size)), bcryptPadPKCS1)); err != nil {
+		return nil, err
+	}
+	sig := make([]byte, size)
+	if err := check(procSignHash.Call(key, uintptr(unsafe.Pointer(&padding)), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		uintptr(unsafe.Pointer(&sig[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), bcryptPadPKCS1)); err != nil {
+		return nil, err
+	}
+	return sig[:size], nil
+}
+
+func openProvider() (uintptr, error) {
+	var prov uintptr
+	if err := check(procOpenStorageProvider.Call(uintptr(unsafe.Pointer(&prov)), uintptr(unsafe.Pointer(utf16(platformProvider))), 0)); err != nil {
+		return 0, err
+	}
+	return prov, nil
+}
+
+func openKey(name string) (prov, key uintptr, err error) {
+	prov, err = openProvider()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := check(procOpenKey.Call(prov, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(utf16(name))), 0, 0)); err != nil {
+		freeObject(prov)
+		return 0, 0, err
+	}
+	return prov, key, nil
+}
+
+// exportPublic reads the key's BCRYPT_RSAKEY_BLOB: six little-endian
+// uint32s, then the big-endian exponent and modulus.
+func exportPublic(key uintptr) (*rsa.PublicKey, error) {
+	blobType := utf16("RSAPUBLICBLOB")
+	var size uint32
+	if err := check(procExportKey.Call(key, 0, uintptr(unsafe.Pointer(blobType)), 0, 0, 0, uintptr(unsafe.Pointer(&size)), 0)); err != nil {
+		return nil, err
+	}
+	blob := make([]byte, size)
+	if err := check(procExportKey.Call(key, 0, uintptr(unsafe.Pointer(blobType)), 0, uintptr(unsafe.Pointer(&blob[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), 0)); err != nil {
+		return nil, err
+	}
+	blob = blob[:size]
+	if len(blob) < 24 || binary.LittleEndian.Uint32(blob) != rsaPublicMagic {
+		return nil, errors.New("unexpected public key blob")
+	}
+	expLen := int(binary.LittleEndian.Uint32(blob[8:]))
+	modLen := int(binary.LittleEndian.Uint32(blob[12:]))
+	if len(blob) < 24+expLen+modLen {
+		return nil, errors.New("short public key blob")
+	}
+	e := new(big.Int).SetBytes(blob[24 : 24+expLen])
+	n := new(big.Int).SetBytes(blob[24+expLen : 24+expLen+modLen])
+	return parsePublicKey(&rsa.PublicKey{N: n, E: int(e.Int64())})
+}
+
+func freeObject(handle uintptr) {
+	procFreeObject.Call(handle)
+}
+
+// check turns the SECURITY_STATUS an NCrypt function returned into an
+// error. Pointers are passed to proc.Call directly, which keeps them alive.
+func check(status, _ uintptr, _ error) error {
+	if status != 0 {
+		return fmt.Errorf("platform crypto provider: %w", windows.Errno(status))
+	}
+	return nil
+}
+
+func utf16(s string) *uint16 {
+	return windows.StringToUTF16Ptr(s)
+}
@@ -0,0 +1,223 @@
+// Package launcher locates the real opencode executable that 'run' starts,
+// skipping the oc wrapper and opencode-auth itself.
+package launcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// CacheFile holds the last resolved path inside the config directory
+	CacheFile = "opencode-path.json"
+
+	// verifyTimeout bounds 'opencode --version' for each candidate
+	verifyTimeout = 5 * time.Second
+)
+
+// RecursionEnv is set for candidates run during verification. If it reaches
+// 'opencode-auth run', the candidate is a wrapper that leads back to us.
+const RecursionEnv = "OPENCODE_AUTH_RESOLVING"
+
+// Resolved is a verified opencode executable.
+type Resolved struct {
+	Path    string    `json:"path"`
+	Version string    `json:"version"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// PathHash identifies the PATH the executable was found on, so a new
+	// install earlier in PATH is picked up
+	PathHash string `json:"path_hash,omitempty"`
+	// Explicit is the configured opencode_path this entry was resolved for
+	Explicit string `json:"explicit,omitempty"`
+	// Cached reports that the result came from CacheFile (not persisted)
+	Cached bool `json:"-"`
+}
+
+// Resolver finds opencode.
+type Resolver struct {
+	ConfigDir string
+	// Explicit is the configured opencode_path; when set, only it is tried
+	Explicit string
+	// PathEnv is the PATH to search
+	PathEnv string
+	// Exclude lists files that must never be launched, such as the oc
+	// wrapper and this executable. Candidates are compared by file identity
+	// (device and inode), so symlinks and hard links to them are caught.
+	Exclude []string
+	// Verify runs a candidate and returns its version; defaults to running
+	// '<path> --version'
+	Verify func(ctx context.Context, path string) (string, error)
+}
+
+// Resolve returns the opencode executable to launch.
+func (r *Resolver) Resolve(ctx context.Context) (*Resolved, error) {
+	explicit := expandHome(r.Explicit)
+	pathHash := ""
+	if explicit == "" {
+		sum := sha256.Sum256([]byte(r.PathEnv))
+		pathHash = hex.EncodeToString(sum[:8])
+	}
+
+	if cached := r.loadCache(); cached != nil && cached.Explicit == explicit && cached.PathHash == pathHash {
+		if info, err := os.Stat(cached.Path); err == nil && info.Size() == cached.Size &&
+			info.ModTime().Equal(cached.ModTime) && !r.excluded(cached.Path) {
+			cached.Cached = true
+			return cached, nil
+		}
+	}
+
+	var res *Resolved
+	if explicit != "" {
+		var err error
+		if res, err = r.check(ctx, explicit); err != nil {
+			return nil, fmt.Errorf("opencode_path %s: %w", explicit, err)
+		}
+		res.Explicit = explicit
+	} else {
+		var rejected []string
+		for _, dir := range filepath.SplitList(r.PathEnv) {
+			for _, name := range executableNames() {
+				candidate := filepath.Join(dir, name)
+				if _, err := os.Stat(candidate); err != nil {
+					continue
+				}
+				found, err := r.check(ctx, candidate)
+				if err != nil {
+					rejected = append(rejected, fmt.Sprintf("%s: %v", candidate, err))
+					continue
+				}
+				res = found
+				break
+			}
+			if res != nil {
+				break
+			}
+		}
+		if res == nil {
+			if len(rejected) == 0 {
+				return nil, fmt.Errorf("opencode not found in PATH")
+			}
+			return nil, fmt.Errorf("no usable opencode in PATH (set opencode_path in config.json):\n  %s", strings.Join(rejected, "\n  "))
+		}
+		res.PathHash = pathHash
+	}
+
+	r.saveCache(res)
+	return res, nil
+}
+
+// check verifies that path is an executable opencode that is not excluded.
+func (r *Resolver) check(ctx context.Context, path string) (*Resolved, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return nil, fmt.Errorf("not executable")
+	}
+	if r.excluded(path) {
+		return nil, fmt.Errorf("is the opencode-auth wrapper")
+	}
+
+	verify := r.Verify
+	if verify == nil {
+		verify = runVersion
+	}
+	version, err := verify(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolved{Path: path, Version: version, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// excluded reports whether path is the same file as an excluded one.
+func (r *Resolver) excluded(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for _, ex := range r.Exclude {
+		if exInfo, err := os.Stat(ex); err == nil && os.SameFile(info, exInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// runVersion runs '<path> --version' and returns the first line of output.
+// The recursion guards make wrappers that lead back to opencode-auth fail
+// fast instead of looping.
+func runVersion(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, "--version")
+	cmd.Env = append(os.Environ(), RecursionEnv+"=1", "OPENCODE_AUTH_WRAPPER=1")
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("'--version' did not finish within %v", verifyTimeout)
+	}
+	if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return "", fmt.Errorf("'--version' failed: %w", err)
+	}
+
+	version := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	if !strings.ContainsFunc(version, unicode.IsDigit) {
+		return "", fmt.Errorf("'--version' printed %q, not a version", version)
+	}
+	return version, nil
+}
+
+func executableNames() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"opencode.exe", "opencode.cmd"}
+	}
+	return []string{"opencode"}
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+func (r *Resolver) loadCache() *Resolved {
+	data, err := os.ReadFile(filepath.Join(r.ConfigDir, CacheFile))
+	if err != nil {
+		return nil
+	}
+	var res Resolved
+	if json.Unmarshal(data, &res) != nil || res.Path == "" {
+		return nil
+	}
+	return &res
+}
+
+// saveCache records res; failures only cost a re-verification next time.
+func (r *Resolver) saveCache(res *Resolved) {
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(r.ConfigDir, 0700)
+	os.WriteFile(filepath.Join(r.ConfigDir, CacheFile), data, 0600)
+}
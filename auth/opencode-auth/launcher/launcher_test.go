@@ -0,0 +1,107 @@
+//go:build !windows
+
+package launcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, path, body string) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolve_SkipsWrapperAndBrokenCandidates(t *testing.T) {
+	root := t.TempDir()
+	wrapper := filepath.Join(root, "bin", "oc")
+	writeScript(t, wrapper, `exec opencode-auth run -- "$@"`)
+
+	// An opencode symlinked to the wrapper, one that prints no version, and
+	// a script launcher (as installed by npm or bun) that works
+	linked := filepath.Join(root, "linked")
+	os.MkdirAll(linked, 0700)
+	os.Symlink(wrapper, filepath.Join(linked, "opencode"))
+	writeScript(t, filepath.Join(root, "broken", "opencode"), "echo usage: opencode")
+	real := filepath.Join(root, "real", "opencode")
+	writeScript(t, real, "echo 0.15.3")
+
+	r := &Resolver{
+		ConfigDir: filepath.Join(root, "config"),
+		PathEnv:   strings.Join([]string{filepath.Join(root, "bin"), linked, filepath.Join(root, "broken"), filepath.Join(root, "real")}, string(os.PathListSeparator)),
+		Exclude:   []string{wrapper},
+	}
+	res, err := r.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if res.Path != real || res.Version != "0.15.3" || res.Cached {
+		t.Errorf("Resolve() = %+v, want %s version 0.15.3", res, real)
+	}
+}
+
+func TestResolve_Cache(t *testing.T) {
+	root := t.TempDir()
+	real := filepath.Join(root, "real", "opencode")
+	writeScript(t, real, "echo 1.0.0")
+
+	calls := 0
+	r := &Resolver{
+		ConfigDir: filepath.Join(root, "config"),
+		PathEnv:   filepath.Dir(real),
+		Verify: func(ctx context.Context, path string) (string, error) {
+			calls++
+			return runVersion(ctx, path)
+		},
+	}
+	if _, err := r.Resolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.Resolve(context.Background())
+	if err != nil || !res.Cached || calls != 1 {
+		t.Errorf("second Resolve() = %+v, %v after %d verifications, want cached result", res, err, calls)
+	}
+
+	// Replacing the executable invalidates the cache
+	writeScript(t, real, "echo 1.1.0")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(real, later, later)
+	res, err = r.Resolve(context.Background())
+	if err != nil || res.Cached || res.Version != "1.1.0" {
+		t.Errorf("Resolve() after upgrade = %+v, %v, want re-verified 1.1.0", res, err)
+	}
+
+	// So does a different PATH
+	r.PathEnv += string(os.PathListSeparator) + root
+	if res, _ := r.Resolve(context.Background()); res == nil || res.Cached {
+		t.Errorf("Resolve() with a new PATH = %+v, want re-resolved", res)
+	}
+}
+
+func TestResolve_Explicit(t *testing.T) {
+	root := t.TempDir()
+	onPath := filepath.Join(root, "path", "opencode")
+	writeScript(t, onPath, "echo 1.0.0")
+	explicit := filepath.Join(root, "custom", "opencode-bin")
+	writeScript(t, explicit, "echo 2.0.0")
+
+	r := &Resolver{ConfigDir: filepath.Join(root, "config"), Explicit: explicit, PathEnv: filepath.Dir(onPath)}
+	res, err := r.Resolve(context.Background())
+	if err != nil || res.Path != explicit {
+		t.Fatalf("Resolve() = %+v, %v, want the configured path", res, err)
+	}
+
+	// A broken explicit path is an error, not a fallback to PATH
+	writeScript(t, explicit, "exit 1")
+	r.ConfigDir = filepath.Join(root, "config2")
+	if _, err := r.Resolve(context.Background()); err == nil || !strings.Contains(err.Error(), "opencode_path") {
+		t.Errorf("Resolve() error = %v, want opencode_path failure", err)
+	}
+}
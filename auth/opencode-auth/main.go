@@ -2,24 +2,59 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/apikey"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/audit"
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/bootstrap"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/bundle"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/client"
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/configpatch"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/device"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/hooks"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/hostmap"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/idpcheck"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/integrity"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/janitor"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/launcher"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/mcp"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/mirror"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/netcheck"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/ping"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/progress"
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxy"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxyctl"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/secret"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/smoke"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tlspolicy"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tokenverify"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
 	updatepkg "github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/update"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/urlscheme"
 	versionpkg "github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/version"
 	"github.com/spf13/cobra"
 )
@@ -28,11 +63,109 @@ var (
 	cfg           *config.Config
 	version       = "dev"
 	noUpdateCheck bool
+	errorFormat   string
+	stateDir      string
+	traceOn       bool
+	traceFile     string
 )
 
+// Exit codes, so scripts can tell failures apart without parsing messages.
+const (
+	exitError           = 1
+	exitLoginRequired   = 3
+	exitProxyNotRunning = 4
+	exitForbidden       = 5
+	exitRateLimited     = 6
+	exitTimeout         = 7
+	exitCancelled       = 130
+)
+
+// cliError is the JSON form of a failed command, printed to stderr with
+// --error-format json.
+type cliError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	ExitCode  int    `json:"exit_code"`
+	Retryable bool   `json:"retryable"`
+}
+
+// classifyError maps err to a stable error code and exit code. Retryable
+// errors may succeed if the same command is run again after a pause.
+func classifyError(err error) cliError {
+	e := cliError{Code: "error", Message: err.Error(), ExitCode: exitError}
+	var discoveryErr *config.DiscoveryError
+	var startupErr *proxy.StartupError
+	var incompatibleErr *versionpkg.IncompatibleError
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		e.Code, e.ExitCode = "token_expired", exitLoginRequired
+	case errors.Is(err, auth.ErrRefreshTokenInvalid):
+		e.Code, e.ExitCode = "refresh_token_invalid", exitLoginRequired
+	case errors.Is(err, auth.ErrNotLoggedIn):
+		e.Code, e.ExitCode = "not_logged_in", exitLoginRequired
+	case errors.Is(err, client.ErrLoginRequired):
+		e.Code, e.ExitCode = "login_required", exitLoginRequired
+	case errors.Is(err, proxy.ErrNotRunning):
+		e.Code, e.ExitCode = "proxy_not_running", exitProxyNotRunning
+	case errors.Is(err, apikey.ErrUnauthorized):
+		e.Code, e.ExitCode = "unauthorized", exitForbidden
+	case errors.Is(err, apikey.ErrForbidden):
+		e.Code, e.ExitCode = "forbidden", exitForbidden
+	case errors.Is(err, auth.ErrWrongAccount):
+		e.Code, e.ExitCode = "wrong_account", exitForbidden
+	case errors.Is(err, apikey.ErrNotFound):
+		e.Code = "not_found"
+	case errors.Is(err, auth.ErrRateLimited), errors.Is(err, apikey.ErrRateLimited):
+		e.Code, e.ExitCode, e.Retryable = "rate_limited", exitRateLimited, true
+	case errors.Is(err, auth.ErrLockTimeout):
+		e.Code, e.ExitCode, e.Retryable = "lock_timeout", exitTimeout, true
+	case errors.As(err, &startupErr):
+		e.Code = "proxy_start_" + startupErr.Kind
+		if startupErr.Kind == proxy.StartupTimeout {
+			e.ExitCode, e.Retryable = exitTimeout, true
+		}
+	case errors.As(err, &incompatibleErr):
+		e.Code = "opencode_incompatible"
+	case errors.As(err, &discoveryErr):
+		e.Code, e.Retryable = "oidc_discovery_"+discoveryErr.Kind, discoveryErr.Retryable()
+		if discoveryErr.Kind == config.DiscoveryTimeout {
+			e.ExitCode = exitTimeout
+		}
+	case errors.Is(err, auth.ErrCallbackTimeout), errors.Is(err, context.DeadlineExceeded):
+		e.Code, e.ExitCode, e.Retryable = "timeout", exitTimeout, true
+	case errors.Is(err, context.Canceled):
+		e.Code, e.ExitCode = "cancelled", exitCancelled
+	}
+	return e
+}
+
+// jsonErrors reports whether errors are printed as JSON.
+func jsonErrors() bool {
+	return errorFormat == "json" || os.Getenv("OPENCODE_ERROR_FORMAT") == "json"
+}
+
+// printError reports a failed command on stderr, as cobra would, or as a
+// JSON object with --error-format json.
+func printError(err error) {
+	if jsonErrors() {
+		json.NewEncoder(os.Stderr).Encode(struct {
+			Error cliError `json:"error"`
+		}{classifyError(err)})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+}
+
 func main() {
+	// apiKeyHelper consumers may run 'token' on every request; answer from
+	// the proxy's token socket before building the command tree
+	if tokenFastPath() {
+		return
+	}
+
 	cfg = config.DefaultConfig()
 	cfg.ClientVersion = version
+	useTokenStorage(cfg)
 
 	rootCmd := &cobra.Command{
 		Use:   "opencode-auth",
@@ -44,53 +177,271 @@ Environment variables:
   OPENCODE_CLIENT_ID            OIDC Client ID (required)
   OPENCODE_ISSUER               OIDC Issuer URL (for auto-discovery)
   OPENCODE_AUTHORIZE_ENDPOINT   OIDC authorization endpoint
-  OPENCODE_TOKEN_ENDPOINT       OIDC token endpoint`,
-		Version: version,
+  OPENCODE_TOKEN_ENDPOINT       OIDC token endpoint
+  OPENCODE_STATE_DIR            Directory for config.json, tokens, and proxy state
+                                (default ~/.opencode)`,
+		Version:       version,
+		SilenceErrors: true, // printed by printError
 	}
+	// Usage text would get in the way of the JSON error object
+	cobra.OnInitialize(func() {
+		if jsonErrors() {
+			rootCmd.SilenceUsage = true
+		}
+	})
 
 	// Add flags
 	rootCmd.PersistentFlags().StringVar(&cfg.ClientID, "client-id", cfg.ClientID, "OIDC Client ID (or set OPENCODE_CLIENT_ID)")
 	rootCmd.PersistentFlags().StringVar(&cfg.Issuer, "issuer", cfg.Issuer, "OIDC Issuer URL (or set OPENCODE_ISSUER)")
 	rootCmd.PersistentFlags().StringVar(&cfg.AuthorizeEndpoint, "authorize-endpoint", cfg.AuthorizeEndpoint, "OIDC authorization endpoint")
 	rootCmd.PersistentFlags().StringVar(&cfg.TokenEndpoint, "token-endpoint", cfg.TokenEndpoint, "OIDC token endpoint")
-	rootCmd.PersistentFlags().IntVar(&cfg.CallbackPort, "port", cfg.CallbackPort, "Local callback port")
+	rootCmd.PersistentFlags().IntVar(&cfg.CallbackPort, "port", cfg.CallbackPort, fmt.Sprintf("Local callback port (default %d, or set OPENCODE_CALLBACK_PORT)", config.DefaultCallbackPort))
 	rootCmd.PersistentFlags().BoolVar(&noUpdateCheck, "no-update-check", false, "Skip version update check")
+	rootCmd.PersistentFlags().StringVar(&errorFormat, "error-format", "text", "How to print errors: text or json (or set OPENCODE_ERROR_FORMAT=json)")
+	rootCmd.PersistentFlags().BoolVar(&progress.Disabled, "no-progress", false, "Print plain log lines instead of spinners and progress bars (or set OPENCODE_NO_PROGRESS=1)")
+	rootCmd.PersistentFlags().StringVar(&stateDir, "state-dir", "", "Directory for config.json, tokens, and proxy state (default ~/.opencode, or set OPENCODE_STATE_DIR)")
+	rootCmd.PersistentFlags().BoolVar(&traceOn, "trace", false, "Log each HTTP request and decision, with secrets redacted, to stderr (or set OPENCODE_TRACE=1)")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace-file", "", "Append the --trace log to this file instead of stderr")
 
 	// Add commands
 	rootCmd.AddCommand(loginCmd())
 	rootCmd.AddCommand(logoutCmd())
+	rootCmd.AddCommand(urlSchemeCmd())
 	rootCmd.AddCommand(tokenCmd())
 	rootCmd.AddCommand(statusCmd())
+	rootCmd.AddCommand(reportCmd())
+	rootCmd.AddCommand(usageCmd())
+	rootCmd.AddCommand(workspaceCmd())
 	rootCmd.AddCommand(runCmd())
 	rootCmd.AddCommand(proxyCmd())
 	rootCmd.AddCommand(apikeyCmd())
+	rootCmd.AddCommand(envCmd())
+	rootCmd.AddCommand(deviceCmd())
 	rootCmd.AddCommand(updateCmd())
+	rootCmd.AddCommand(doctorCmd())
+	rootCmd.AddCommand(smokeCmd())
+	rootCmd.AddCommand(pingCmd())
+	rootCmd.AddCommand(configCmd())
+	rootCmd.AddCommand(initCmd())
+	rootCmd.AddCommand(profileCmd())
+	rootCmd.AddCommand(modelsCmd())
+	rootCmd.AddCommand(cleanCmd())
+	rootCmd.AddCommand(uninstallCmd())
+	rootCmd.AddCommand(supportBundleCmd())
+	rootCmd.AddCommand(observeCmd())
+	rootCmd.AddCommand(mcpCmd())
+
+	// Flags are parsed by now; start the trace first so it covers the rest
+	cobra.OnInitialize(func() {
+		if err := startTrace(rootCmd); err != nil {
+			printError(err)
+			os.Exit(classifyError(err).ExitCode)
+		}
+	})
 
-	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+	// Check the state directory before any command reads or writes it
+	cobra.OnInitialize(func() {
+		if err := initStateDir(rootCmd); err != nil {
+			printError(err)
+			os.Exit(classifyError(err).ExitCode)
+		}
+	})
+
+	// Cancel the root context on Ctrl+C / SIGTERM so in-flight HTTP calls,
+	// the login callback server, and the foreground proxy shut down cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
+		printError(err)
+		os.Exit(classifyError(err).ExitCode)
 	}
 }
 
 func loginCmd() *cobra.Command {
 	var timeout time.Duration
 	var noBrowser bool
+	var hint string
+	var saveHint bool
 
 	cmd := &cobra.Command{
 		Use:   "login",
 		Short: "Authenticate with your identity provider",
 		Long: `Opens a browser window to authenticate with your OIDC identity provider.
-After successful authentication, tokens are stored locally for CLI use.`,
+After successful authentication, tokens are stored locally for CLI use.
+
+With --hint, the identity provider preselects that account, and the login
+fails if you sign in with another one. --save-hint makes it the default
+(login_hint in ~/.opencode/config.json), also for the proxy's re-auth.
+
+With --no-browser, the URL is printed with a QR code to sign in from a
+phone. The phone's browser then fails to load the localhost callback page;
+paste that page's address at the prompt to finish.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runLogin(timeout, noBrowser)
+			if saveHint && hint == "" {
+				return fmt.Errorf("--save-hint needs --hint")
+			}
+			cfg.LoginHint = hint
+			if err := runLogin(cmd.Context(), timeout, noBrowser); err != nil {
+				return err
+			}
+			if saveHint {
+				return saveLoginHint(hint)
+			}
+			return nil
 		},
 	}
 
 	cmd.Flags().DurationVar(&timeout, "timeout", 5*time.Minute, "Timeout for authentication")
-	cmd.Flags().BoolVar(&noBrowser, "no-browser", false, "Print URL instead of opening browser")
+	cmd.Flags().BoolVar(&noBrowser, "no-browser", false, "Print the URL and a QR code instead of opening a browser")
+	cmd.Flags().StringVar(&hint, "hint", "", "Account to sign in with, e.g. user@example.com (default: login_hint from config)")
+	cmd.Flags().BoolVar(&saveHint, "save-hint", false, "Save --hint as the default account")
+
+	return cmd
+}
+
+// saveLoginHint stores hint as login_hint in the user config.
+func saveLoginHint(hint string) error {
+	oc, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	oc.LoginHint = hint
+	if err := config.SaveOpenCodeConfig(oc); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "  Default account saved to %s (restart the proxy to use it for re-auth)\n", config.ConfigPath())
+	return nil
+}
+
+func urlSchemeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "url-scheme",
+		Short: "Register a private-use URL scheme for the login callback",
+		Long: `Some identity providers don't allow http://localhost redirect URIs and
+require a private-use scheme instead, e.g. opencode-auth://callback. Add it
+to redirect_uris in config.json and register it with the OS once:
+
+  opencode-auth url-scheme register
+
+The browser then opens the redirect with 'opencode-auth url-scheme handle',
+which hands it to the waiting login.`,
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "register [scheme]",
+		Short: "Make the OS open the scheme with opencode-auth",
+		Long:  "Registers the scheme given, or each private-use scheme in redirect_uris, for the current user.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schemes, err := urlSchemes(args)
+			if err != nil {
+				return err
+			}
+			exe, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("failed to get executable path: %w", err)
+			}
+			if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+				exe = resolved
+			}
+			for _, scheme := range schemes {
+				where, err := urlscheme.Register(scheme, exe)
+				if err != nil {
+					return fmt.Errorf("registering %s: %w", scheme, err)
+				}
+				fmt.Printf("Registered %s:// in %s\n", scheme, where)
+			}
+			if len(args) == 1 && len(configuredURLSchemes()) == 0 {
+				fmt.Printf("Add a redirect URI such as %s://callback to redirect_uris in %s to sign in with it.\n", schemes[0], config.ConfigPath())
+			}
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "unregister [scheme]",
+		Short: "Remove the scheme's handler",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schemes, err := urlSchemes(args)
+			if err != nil {
+				return err
+			}
+			for _, scheme := range schemes {
+				if err := urlscheme.Unregister(scheme); err != nil {
+					return fmt.Errorf("unregistering %s: %w", scheme, err)
+				}
+				fmt.Printf("Unregistered %s://\n", scheme)
+			}
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show whether the schemes in redirect_uris are registered",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schemes, err := urlSchemes(nil)
+			if err != nil {
+				return err
+			}
+			for _, scheme := range schemes {
+				if where, err := urlscheme.Handler(scheme); err != nil {
+					fmt.Printf("%s://: %v\n", scheme, err)
+				} else {
+					fmt.Printf("%s://: registered in %s\n", scheme, where)
+				}
+			}
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:    "handle <url>",
+		Short:  "Hand a redirect to the waiting login (run by the OS)",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := urlscheme.Forward(urlscheme.SocketPath(cfg.ConfigDir), args[0]); err != nil {
+				return err
+			}
+			fmt.Println("Signed in; return to your terminal.")
+			return nil
+		},
+	})
 
 	return cmd
 }
 
+// urlSchemes returns the scheme in args, or else the private-use schemes in
+// redirect_uris.
+func urlSchemes(args []string) ([]string, error) {
+	if len(args) == 1 {
+		scheme := strings.ToLower(strings.TrimSuffix(args[0], "://"))
+		return []string{scheme}, urlscheme.CheckScheme(scheme)
+	}
+	schemes := configuredURLSchemes()
+	if len(schemes) == 0 {
+		return nil, fmt.Errorf("no redirect_uris in %s use a private-use scheme; name one, e.g. 'opencode-auth url-scheme register opencode-auth'", config.ConfigPath())
+	}
+	return schemes, nil
+}
+
+// configuredURLSchemes returns the private-use schemes of the login callbacks.
+func configuredURLSchemes() []string {
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+	var schemes []string
+	seen := make(map[string]bool)
+	for _, u := range cfg.CallbackURLs() {
+		if scheme := urlscheme.Scheme(u); scheme != "" && !seen[scheme] {
+			seen[scheme] = true
+			schemes = append(schemes, scheme)
+		}
+	}
+	return schemes
+}
+
 func logoutCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "logout",
@@ -104,6 +455,7 @@ func logoutCmd() *cobra.Command {
 
 func tokenCmd() *cobra.Command {
 	var refresh bool
+	var timeout time.Duration
 
 	cmd := &cobra.Command{
 		Use:   "token",
@@ -111,1290 +463,5956 @@ func tokenCmd() *cobra.Command {
 		Long: `Outputs the current ID token to stdout for use with apiKeyHelper.
 Exits with code 1 if no valid token is available.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runToken(refresh)
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runToken(ctx, refresh)
 		},
 	}
 
 	cmd.Flags().BoolVar(&refresh, "refresh", false, "Attempt to refresh expired token")
+	cmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for proxy-delegated refresh")
+
+	cmd.AddCommand(tokenAuditCmd())
+	cmd.AddCommand(tokenVerifyCmd())
+	cmd.AddCommand(tokenExchangeCmd())
 
 	return cmd
 }
 
-func statusCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "status",
-		Short: "Show authentication status",
-		Long:  `Displays the current authentication status including user email and token expiry.`,
+func tokenExchangeCmd() *cobra.Command {
+	var path, model string
+	var ttl, timeout time.Duration
+	var asJSON, asEnv bool
+
+	cmd := &cobra.Command{
+		Use:   "exchange --path <path> [--model <pattern>]",
+		Short: "Get a short-lived child token for a helper tool",
+		Long: `Asks the running proxy for a child token that is only good for requests
+to --path (and paths below it) through the proxy, and, with --model, only for
+requests naming a matching model. It expires after --ttl, at most 15 minutes.
+
+Wrapper scripts and MCP servers send the child token as their bearer token
+instead of the user's token, to the proxy's helper port rather than the one
+opencode uses. That port accepts nothing but child tokens, and the main port
+refuses them. The proxy swaps in the real credentials, so the tool never
+sees the ID token or the refresh token:
+
+  eval "$(opencode-auth token exchange --path /v1/chat/completions --model 'claude-*' --env)"
+
+--env prints OPENAI_API_KEY and OPENAI_BASE_URL (the helper port) as shell
+exports.`,
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStatus()
+			if asJSON && asEnv {
+				return fmt.Errorf("--json and --env cannot be combined")
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runTokenExchange(ctx, path, model, ttl, asJSON, asEnv)
 		},
 	}
+
+	cmd.Flags().StringVar(&path, "path", "", "Request path the token is good for, e.g. /v1/chat/completions")
+	cmd.Flags().StringVar(&model, "model", "", "Model, or model pattern, the token is limited to")
+	cmd.Flags().DurationVar(&ttl, "ttl", proxy.ChildTokenMaxTTL, "How long the token lives (at most 15m)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the token, helper URL, scope, and expiry as JSON")
+	cmd.Flags().BoolVar(&asEnv, "env", false, "Print OPENAI_API_KEY and OPENAI_BASE_URL as shell exports")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Second, "Timeout for reaching the proxy")
+	cmd.MarkFlagRequired("path")
+
+	return cmd
 }
 
-// applyOpenCodeConfig applies values from the installer config file to the
-// runtime config, without overriding values already set by flags or env vars.
-func applyOpenCodeConfig(cfg *config.Config, oc *config.OpenCodeConfig) {
-	if cfg.ClientID == "" {
-		cfg.ClientID = oc.ClientID
-	}
-	if cfg.APIEndpoint == "" {
-		cfg.APIEndpoint = oc.APIEndpoint
+// runTokenExchange prints a child token from the running proxy.
+func runTokenExchange(ctx context.Context, path, model string, ttl time.Duration, asJSON, asEnv bool) error {
+	if ttl <= 0 || ttl > proxy.ChildTokenMaxTTL {
+		return fmt.Errorf("--ttl must be between 1s and %s", proxy.ChildTokenMaxTTL)
 	}
-	if cfg.APIKey == "" {
-		cfg.APIKey = oc.APIKey
-	}
-	if cfg.Issuer == "" {
-		cfg.Issuer = oc.Issuer
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return fmt.Errorf("%w\nStart with 'oc' or 'opencode-auth proxy start'", err)
 	}
-	if cfg.AuthorizeEndpoint == "" {
-		cfg.AuthorizeEndpoint = oc.AuthorizeEndpoint
+	resp, err := proxyctl.ExchangeToken(ctx, proxyURL, proxy.ExchangeRequest{Path: path, Model: model, TTL: ttl.String()})
+	if err != nil {
+		return err
 	}
-	if cfg.TokenEndpoint == "" {
-		cfg.TokenEndpoint = oc.TokenEndpoint
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
 	}
-	if cfg.VersionCheckURL == "" {
-		cfg.VersionCheckURL = oc.VersionCheckURL
+	if asEnv {
+		fmt.Printf("export OPENAI_API_KEY=%s\nexport OPENAI_BASE_URL=%s/v1\n", resp.Token, resp.BaseURL)
+		return nil
 	}
+	fmt.Print(resp.Token)
+	return nil
 }
 
-func runLogin(timeout time.Duration, noBrowser bool) error {
-	// Load config file values if not overridden by flags / env
-	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
-		applyOpenCodeConfig(cfg, openCodeConfig)
-	}
+func tokenVerifyCmd() *cobra.Command {
+	var file, jwks string
+	var asJSON bool
+	var timeout time.Duration
 
-	if cfg.ClientID == "" {
-		return fmt.Errorf("client ID not set. Use --client-id or set OPENCODE_CLIENT_ID environment variable")
+	cmd := &cobra.Command{
+		Use:   "verify --file <jwt>",
+		Short: "Check whether the API would accept a token",
+		Long: `Decodes the JWT in --file ("-" for stdin), prints its header and claims,
+and runs the checks the API's load balancer applies before a request reaches
+the router: the signature against the issuer's JWKS, the issuer, an aud claim
+that is a single string equal to the CLI client ID (and azp, when present),
+and the expiry.
+
+The issuer and client ID come from config.json, --issuer and --client-id. The
+signing keys are fetched through OIDC discovery unless --jwks names a JWKS
+URL or a saved JWKS file, which makes the check work offline. This is meant
+for debugging a user's rejected token; the token is never sent anywhere.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runTokenVerify(ctx, file, jwks, asJSON)
+		},
 	}
 
-	// Auto-discover OIDC endpoints from issuer if needed
-	if err := cfg.DiscoverEndpoints(); err != nil {
-		return fmt.Errorf("OIDC endpoint discovery failed: %w", err)
-	}
+	cmd.Flags().StringVar(&file, "file", "", "File holding the JWT, or - for stdin")
+	cmd.Flags().StringVar(&jwks, "jwks", "", "JWKS URL or file to verify the signature with (default: issuer discovery)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the claims and checks as JSON")
+	cmd.Flags().DurationVar(&timeout, "timeout", 15*time.Second, "Timeout for fetching the issuer's keys")
+	cmd.MarkFlagRequired("file")
 
-	if cfg.AuthorizeEndpoint == "" || cfg.TokenEndpoint == "" {
-		return fmt.Errorf("OIDC endpoints not configured. Set --issuer for auto-discovery or provide --authorize-endpoint and --token-endpoint")
-	}
+	return cmd
+}
 
-	// Generate PKCE verifier and challenge
-	pkce, err := auth.GeneratePKCE()
-	if err != nil {
-		return fmt.Errorf("failed to generate PKCE: %w", err)
+// runTokenVerify prints a token's claims and whether the API would accept it.
+func runTokenVerify(ctx context.Context, file, jwks string, asJSON bool) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
 	}
-
-	// Generate state for CSRF protection
-	state, err := auth.GenerateState()
 	if err != nil {
-		return fmt.Errorf("failed to generate state: %w", err)
+		return fmt.Errorf("failed to read token: %w", err)
 	}
-
-	// Start callback server
-	server, err := auth.NewCallbackServer(cfg)
+	token, err := tokenverify.Parse(strings.TrimPrefix(strings.TrimSpace(string(data)), "Bearer "))
 	if err != nil {
-		return fmt.Errorf("failed to start callback server: %w", err)
+		return err
 	}
-	server.Start()
-	defer server.Shutdown(context.Background())
 
-	// Build authorization URL
-	authURL := buildAuthURL(pkce, state)
-
-	if noBrowser {
-		fmt.Fprintf(os.Stderr, "Open this URL in your browser:\n\n%s\n\n", authURL)
-	} else {
-		fmt.Fprintf(os.Stderr, "Opening browser for authentication...\n")
-		if err := openBrowser(authURL); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open browser. Please open this URL manually:\n\n%s\n\n", authURL)
+	if oc, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, oc)
+	}
+	var keys *tokenverify.JWKS
+	switch {
+	case jwks != "" && !strings.HasPrefix(jwks, "https://") && !strings.HasPrefix(jwks, "http://"):
+		var doc []byte
+		if doc, err = os.ReadFile(jwks); err == nil {
+			keys, err = tokenverify.ParseJWKS(doc)
 		}
+	default:
+		keys, err = tokenverify.FetchJWKS(ctx, cfg.Issuer, jwks)
 	}
-
-	fmt.Fprintf(os.Stderr, "Waiting for authentication callback...\n")
-
-	// Wait for callback
-	result, err := server.WaitForCallback(timeout)
-	if err != nil {
-		return fmt.Errorf("authentication failed: %w", err)
+	if err == nil {
+		err = token.Verify(keys)
 	}
+	checks := token.Checks(cfg.Issuer, cfg.ClientID, err, time.Now())
+	accepted := tokenverify.Accepted(checks)
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{
+			"header":   token.Header,
+			"claims":   token.Claims,
+			"checks":   checks,
+			"accepted": accepted,
+		}); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Header: alg %s, kid %s\n\nClaims:\n", token.Header.Alg, orDefault(token.Header.Kid, "-"))
+		names := make([]string, 0, len(token.Claims))
+		for name := range token.Claims {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, _ := json.Marshal(token.Claims[name])
+			line := string(value)
+			switch name {
+			case "exp", "iat", "nbf", "auth_time":
+				if t := token.Time(name); !t.IsZero() {
+					line += "  (" + t.Local().Format("2006-01-02 15:04:05 MST") + ")"
+				}
+			}
+			fmt.Printf("  %-16s %s\n", name, line)
+		}
 
-	if result.Error != "" {
-		return fmt.Errorf("authentication error: %s", result.Error)
+		fmt.Printf("\n%-18s %-6s %s\n", "CHECK", "RESULT", "DETAIL")
+		for _, c := range checks {
+			result := "ok"
+			if !c.OK {
+				result = "FAIL"
+			}
+			fmt.Printf("%-18s %-6s %s\n", c.Name, result, c.Detail)
+		}
+		fmt.Println()
 	}
 
-	// Verify state
-	if result.State != state {
-		return fmt.Errorf("state mismatch: possible CSRF attack")
+	if !accepted {
+		return fmt.Errorf("the API would reject this token")
+	}
+	if !asJSON {
+		fmt.Println("The API would accept this token.")
 	}
+	return nil
+}
 
-	fmt.Fprintf(os.Stderr, "Exchanging authorization code for tokens...\n")
+func tokenAuditCmd() *cobra.Command {
+	var showLog bool
+	var clear bool
 
-	// Exchange code for tokens
-	tokenResp, err := auth.ExchangeCodeForTokens(cfg, result.Code, pkce)
-	if err != nil {
-		return fmt.Errorf("token exchange failed: %w", err)
-	}
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show which processes have requested tokens",
+		Long: `Lists the programs that obtained a credential from 'opencode-auth token',
+so wrapper scripts and unexpected consumers can be reviewed.
 
-	// Extract email from ID token
-	email, err := auth.ExtractEmailFromIDToken(tokenResp.IDToken)
-	if err != nil {
-		email = "unknown"
-	}
+Auditing is off by default. Enable it with "token_audit": true in
+~/.opencode/config.json or OPENCODE_TOKEN_AUDIT=1.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := audit.Path(cfg.ConfigDir)
+			if clear {
+				if err := audit.Clear(path); err != nil {
+					return fmt.Errorf("failed to clear audit log: %w", err)
+				}
+				fmt.Println("Token audit log cleared.")
+				return nil
+			}
 
-	// Get expiry from ID token
-	expiresAt, err := auth.GetExpiryFromIDToken(tokenResp.IDToken)
-	if err != nil {
-		// Fallback to expires_in
-		expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
-	}
+			entries, err := audit.Load(path)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				fmt.Printf("No token requests recorded in %s.\n", path)
+				if oc, err := config.LoadOpenCodeConfig(); !cfg.TokenAudit && (err != nil || !oc.TokenAudit) {
+					fmt.Println("Auditing is disabled; set \"token_audit\": true in config.json to enable it.")
+				}
+				return nil
+			}
 
-	// Save tokens
-	tokens := &auth.TokenData{
-		IDToken:      tokenResp.IDToken,
-		AccessToken:  tokenResp.AccessToken,
-		RefreshToken: tokenResp.RefreshToken,
-		ExpiresAt:    expiresAt,
-		Email:        email,
-	}
+			if showLog {
+				for _, e := range entries {
+					command := orDefault(e.Caller.Command, e.Caller.Name)
+					if len(command) > 120 {
+						command = command[:117] + "..."
+					}
+					fmt.Printf("%s  pid %-7d %s\n", e.Time.Local().Format(time.RFC3339), e.Caller.PID, command)
+				}
+				return nil
+			}
 
-	if err := auth.SaveTokens(cfg.TokenPath, tokens); err != nil {
-		return fmt.Errorf("failed to save tokens: %w", err)
+			fmt.Printf("%-16s %6s  %-19s  %s\n", "CONSUMER", "CALLS", "LAST SEEN", "PATH")
+			for _, c := range audit.Summarize(entries) {
+				fmt.Printf("%-16s %6d  %-19s  %s\n", c.Name, c.Calls, c.Last.Local().Format("2006-01-02 15:04:05"), orDefault(c.Path, "-"))
+			}
+			return nil
+		},
 	}
 
-	fmt.Fprintf(os.Stderr, "\nAuthentication successful!\n")
-	fmt.Fprintf(os.Stderr, "  Email: %s\n", email)
-	fmt.Fprintf(os.Stderr, "  Expires: %s\n", expiresAt.Local().Format(time.RFC822))
-	fmt.Fprintf(os.Stderr, "  Tokens stored at: %s\n", cfg.TokenPath)
+	cmd.Flags().BoolVar(&showLog, "log", false, "Print every recorded request with the caller's command line")
+	cmd.Flags().BoolVar(&clear, "clear", false, "Delete the audit log")
 
-	return nil
+	return cmd
 }
 
-func runLogout() error {
-	if err := auth.DeleteTokens(cfg.TokenPath); err != nil {
-		return fmt.Errorf("failed to delete tokens: %w", err)
+// orDefault returns s, or def if s is empty.
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
 	}
-	fmt.Fprintf(os.Stderr, "Logged out successfully. Tokens removed from %s\n", cfg.TokenPath)
-	return nil
+	return s
 }
 
-func runToken(refresh bool) error {
-	tokens, err := auth.LoadTokens(cfg.TokenPath)
-	if err != nil {
-		return fmt.Errorf("not authenticated: %w", err)
-	}
+func statusCmd() *cobra.Command {
+	var all, asJSON, logins bool
 
-	// Check if token is expired or expiring soon
-	if tokens.IsExpired() || (refresh && tokens.IsExpiringSoon(5*time.Minute)) {
-		if !refresh {
-			return fmt.Errorf("token expired at %s. Run 'opencode-auth login' to re-authenticate", tokens.ExpiresAt.Local().Format(time.RFC822))
-		}
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show authentication status",
+		Long: `Displays the current authentication status including user email and token expiry.
 
-		// Delegate refresh to proxy if running (prevents multiple processes from refreshing)
-		proxyURL, err := proxy.GetProxyURL(cfg)
-		if err == nil {
-			// Proxy is running - ask it to ensure token is valid
-			ensureResp, err := callProxyEnsure(proxyURL)
-			if err != nil {
-				return fmt.Errorf("failed to communicate with proxy: %w", err)
-			}
+With --all, also reports proxy health, the configured API key's expiry,
+pending config patches, and update availability in one view. --json prints
+the same report as JSON.
 
-			if ensureResp.Status == "reauth_required" || ensureResp.Status == "reauth_in_progress" {
-				return fmt.Errorf("re-authentication required. Run 'opencode-auth login' or 'oc' to re-authenticate")
+With --logins, lists recent browser login attempts from 'login' and proxy
+re-authentication with their outcome, e.g. an IdP error or a timeout.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if logins {
+				return runStatusLogins(asJSON)
 			}
-
-			// Reload tokens after proxy refresh
-			tokens, err = auth.LoadTokens(cfg.TokenPath)
-			if err != nil {
-				return fmt.Errorf("failed to load tokens after refresh: %w", err)
+			if all || asJSON {
+				ctx, cancel := context.WithTimeout(cmd.Context(), 20*time.Second)
+				defer cancel()
+				return runStatusAll(ctx, asJSON)
 			}
-		} else {
-			// No proxy running - return error instead of refreshing directly
-			// This prevents multiple token commands from racing to refresh
-			return fmt.Errorf("token expired and proxy not running. Run 'oc' to start proxy and refresh token")
-		}
+			return runStatus(cmd.Context())
+		},
 	}
 
-	// Output ID token to stdout (for apiKeyHelper)
-	fmt.Print(tokens.IDToken)
-	return nil
+	cmd.Flags().BoolVar(&all, "all", false, "Show auth, proxy, API key, config, and update status together")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the --all or --logins report as JSON")
+	cmd.Flags().BoolVar(&logins, "logins", false, "List recent login attempts and their outcome")
+
+	return cmd
 }
 
-func runStatus() error {
-	tokens, err := auth.LoadTokens(cfg.TokenPath)
+// runStatusLogins prints the recorded login attempts, newest first.
+func runStatusLogins(asJSON bool) error {
+	path := auth.LoginsPath(cfg.ConfigDir)
+	attempts, err := auth.LoadLogins(path)
 	if err != nil {
-		fmt.Println("Status: Not authenticated")
-		fmt.Printf("Token path: %s\n", cfg.TokenPath)
-		return nil
+		return err
 	}
 
-	status := "Valid"
-	if tokens.IsExpired() {
-		status = "Expired"
-	} else if tokens.IsExpiringSoon(10 * time.Minute) {
-		status = "Expiring soon"
+	if asJSON {
+		if attempts == nil {
+			attempts = []auth.LoginAttempt{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(attempts)
 	}
 
-	fmt.Printf("Status: %s\n", status)
-	fmt.Printf("Email: %s\n", tokens.Email)
-	fmt.Printf("Expires: %s\n", tokens.ExpiresAt.Local().Format(time.RFC822))
-	fmt.Printf("Token path: %s\n", cfg.TokenPath)
-
-	if !tokens.IsExpired() {
-		remaining := time.Until(tokens.ExpiresAt)
-		fmt.Printf("Time remaining: %s\n", remaining.Round(time.Second))
+	if len(attempts) == 0 {
+		fmt.Printf("No login attempts recorded in %s.\n", path)
+		return nil
 	}
 
-	// Check for updates (synchronous in status command — informational)
-	if !noUpdateCheck && !versionpkg.IsDev(version) {
-		checkURL := cfg.VersionCheckURL
-		if checkURL == "" {
-			// Try to load from config file
-			if oc, err := config.LoadOpenCodeConfig(); err == nil {
-				checkURL = oc.VersionCheckURL
-			}
-		}
-		if checkURL != "" {
-			if info, _, err := versionpkg.CheckForUpdate(version, checkURL); err == nil {
-				if info != nil && info.Available {
-					fmt.Printf("Update: v%s available (current: v%s)\n", info.Latest, info.Current)
-				} else {
-					fmt.Println("Update: Up to date")
-				}
+	fmt.Printf("%-19s  %-6s  %-15s  %8s  %s\n", "TIME", "SOURCE", "OUTCOME", "DURATION", "DETAIL")
+	for i := len(attempts) - 1; i >= 0; i-- {
+		a := attempts[i]
+		detail := orDefault(a.Email, "-")
+		if a.Error != "" {
+			detail = a.Error
+			if len(detail) > 80 {
+				detail = detail[:77] + "..."
 			}
 		}
+		duration := (time.Duration(a.DurationMS) * time.Millisecond).Round(time.Second)
+		fmt.Printf("%-19s  %-6s  %-15s  %8s  %s\n", a.Time.Local().Format("2006-01-02 15:04:05"), a.Source, a.Outcome, duration, detail)
 	}
-
 	return nil
 }
 
-func buildAuthURL(pkce *auth.PKCE, state string) string {
-	params := url.Values{
-		"response_type":         {"code"},
-		"client_id":             {cfg.ClientID},
-		"redirect_uri":          {cfg.CallbackURL()},
-		"scope":                 {"openid email profile"},
-		"state":                 {state},
-		"code_challenge":        {pkce.Challenge},
-		"code_challenge_method": {"S256"},
+func reportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Summarize local usage statistics",
 	}
 
-	return cfg.AuthorizeEndpoint + "?" + params.Encode()
-}
-
-func openBrowser(url string) error {
-	var cmd *exec.Cmd
-
-	switch runtime.GOOS {
-	case "darwin":
-		cmd = exec.Command("open", url)
-	case "linux":
-		// Try xdg-open first, then common browsers
-		if _, err := exec.LookPath("xdg-open"); err == nil {
-			cmd = exec.Command("xdg-open", url)
-		} else if _, err := exec.LookPath("sensible-browser"); err == nil {
-			cmd = exec.Command("sensible-browser", url)
-		} else {
-			return fmt.Errorf("no browser command found")
-		}
-	case "windows":
-		cmd = exec.Command("cmd", "/c", "start", url)
-	default:
-		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	var days int
+	var asJSON bool
+	authCmd := &cobra.Command{
+		Use:   "auth",
+		Short: "Summarize token lifetimes, refresh latency, and IdP errors",
+		Long: `Summarizes the token refreshes the proxy recorded and the login attempts
+over the last --days days (at most 30): ID token lifetimes, how much lifetime
+was left when tokens were refreshed, IdP latency, and refresh failures by
+cause.
+
+The records hold no identity or token, so the report (--json) can be shared
+with the administrators to tune the refresh threshold and IdP token lifetimes
+across the fleet.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if days < 1 || days > 30 {
+				return fmt.Errorf("--days must be between 1 and 30")
+			}
+			return runReportAuth(days, asJSON)
+		},
 	}
+	authCmd.Flags().IntVar(&days, "days", 30, "Number of days to summarize")
+	authCmd.Flags().BoolVar(&asJSON, "json", false, "Print the report as JSON")
+	cmd.AddCommand(authCmd)
 
-	return cmd.Start()
+	return cmd
 }
 
-func runCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "run [flags] [-- args...]",
-		Short: "Run opencode with automatic authentication",
-		Long: `Authenticates automatically and launches opencode with the proper token.
+// runReportAuth prints the token refresh and login summary.
+func runReportAuth(days int, asJSON bool) error {
+	since := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	stats, err := auth.LoadRefreshStats(auth.AuthStatsPath(cfg.ConfigDir), since)
+	if err != nil {
+		return err
+	}
+	logins, err := auth.LoadLogins(auth.LoginsPath(cfg.ConfigDir))
+	if err != nil {
+		return err
+	}
+	rep := auth.NewAuthReport(stats, logins, since)
 
-If not authenticated, opens a browser to login first.
-All arguments after -- are passed to opencode.`,
-		DisableFlagParsing: true,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runOpenCode(args)
-		},
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+
+	fmt.Printf("Auth report for the last %d days (since %s)\n\n", days, since.Local().Format("2006-01-02"))
+	if rep.Refreshes == 0 {
+		fmt.Printf("Token refreshes:       none recorded in %s\n", auth.AuthStatsPath(cfg.ConfigDir))
+	} else {
+		fmt.Printf("Token refreshes:       %d (%.1f%% failed)\n", rep.Refreshes, rep.ErrorRate*100)
+		for _, outcome := range sortedKeys(rep.Outcomes) {
+			if outcome != auth.RefreshSucceeded {
+				fmt.Printf("  %-19s  %d\n", outcome, rep.Outcomes[outcome])
+			}
+		}
+		printDistribution("Refresh latency:", rep.Latency, time.Millisecond)
+		printDistribution("ID token lifetime:", rep.Lifetime, time.Minute)
+		printDistribution("Left at refresh:", rep.Remaining, time.Second)
+		fmt.Printf("Late refreshes:        %d (under 5m left)\n", rep.Late)
+		if rep.ThresholdS > 0 {
+			fmt.Printf("Refresh threshold:     %s\n", time.Duration(rep.ThresholdS)*time.Second)
+		}
 	}
+	fmt.Printf("Logins:                %d\n", rep.Logins)
+	for _, outcome := range sortedKeys(rep.LoginsBy) {
+		fmt.Printf("  %-19s  %d\n", outcome, rep.LoginsBy[outcome])
+	}
+	fmt.Println("\nThe report holds no identity; share 'report auth --json' to help tune token lifetimes.")
+	return nil
 }
 
-// findRealOpenCode finds the actual opencode binary, skipping wrapper scripts
-func findRealOpenCode() (string, error) {
-	pathEnv := os.Getenv("PATH")
-	paths := filepath.SplitList(pathEnv)
+// printDistribution prints a report line of p50/p95/max rounded to unit.
+func printDistribution(label string, d auth.Distribution, unit time.Duration) {
+	if d.Count == 0 {
+		return
+	}
+	fmt.Printf("%-22s p50 %s, p95 %s, max %s\n", label, d.P50.Round(unit), d.P95.Round(unit), d.Max.Round(unit))
+}
 
-	for _, dir := range paths {
-		// Skip the directory containing our wrapper
-		if dir == filepath.Dir(os.Args[0]) {
-			continue
-		}
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-		opencodePath := filepath.Join(dir, "opencode")
-		info, err := os.Stat(opencodePath)
-		if err != nil {
-			continue
-		}
+func usageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Manage the soft daily token budget",
+	}
 
-		// Check if it's a regular file (not a symlink or directory)
-		if info.Mode().IsRegular() {
-			// Check if it's not a shell script (wrapper)
-			data := make([]byte, 2)
-			file, err := os.Open(opencodePath)
+	budgetCmd := &cobra.Command{
+		Use:   "budget",
+		Short: "Show today's usage against the daily token budget",
+		Long: `Shows today's token usage against the soft daily budget (usage_budget in
+config.json), the tokens used in the last hour, and when the budget runs out
+at that rate.
+
+The proxy shows a desktop notification when today's usage reaches 80% and
+100% of the budget, once each per day. It never refuses a request for it;
+administrators enforce limits with proxy_guardrails daily_token_budget.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUsageBudgetShow(cmd.Context())
+		},
+	}
+	budgetCmd.AddCommand(&cobra.Command{
+		Use:   "set <tokens>",
+		Short: "Set the daily token budget, e.g. 500k or 2M",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tokens, err := proxy.ParseTokens(args[0])
 			if err != nil {
-				continue
+				return err
 			}
-			n, _ := file.Read(data)
-			file.Close()
-
-			// If it starts with "#!", it's a script - skip it
-			if n >= 2 && string(data) == "#!" {
-				continue
+			if tokens == 0 {
+				return fmt.Errorf("the budget must be more than 0 tokens; use 'usage budget clear' to remove it")
 			}
+			return runUsageBudgetSet(tokens)
+		},
+	})
+	budgetCmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "Remove the daily token budget",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUsageBudgetSet(0)
+		},
+	})
+	cmd.AddCommand(budgetCmd)
 
-			// Found the real binary
-			return opencodePath, nil
-		}
-	}
+	return cmd
+}
 
-	return "", fmt.Errorf("real opencode binary not found in PATH")
+// runUsageBudgetSet saves usage_budget in the user layer; 0 removes it. The
+// running proxy picks it up when it reloads config.json.
+func runUsageBudgetSet(tokens int) error {
+	oc, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	oc.UsageBudget = tokens
+	if err := config.SaveOpenCodeConfig(oc); err != nil {
+		return err
+	}
+	if tokens == 0 {
+		fmt.Printf("Daily token budget removed from %s\n", config.ConfigPath())
+	} else {
+		fmt.Printf("Daily token budget set to %s tokens in %s\n", proxy.FormatTokens(tokens), config.ConfigPath())
+	}
+	if effective, err := config.LoadOpenCodeConfig(); err == nil && effective.UsageBudget != tokens {
+		fmt.Printf("Note: another config layer sets usage_budget to %d, which takes precedence\n", effective.UsageBudget)
+	}
+	fmt.Println("A running proxy applies it within 30 seconds.")
+	return nil
 }
 
-// ProxyHealth represents the health status response from the proxy
-type ProxyHealth struct {
-	Status    string `json:"status"`
-	Port      int    `json:"port"`
-	Target    string `json:"target"`
-	Timestamp string `json:"timestamp"`
-	Refresher *struct {
-		Running          bool      `json:"running"`
-		LastRefresh      time.Time `json:"last_refresh"`
-		RetryCount       int       `json:"retry_count"`
-		NeedsReauth      bool      `json:"needs_reauth"`
-		ReauthInProgress bool      `json:"reauth_in_progress"`
-	} `json:"refresher,omitempty"`
+func runUsageBudgetShow(ctx context.Context) error {
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+	if cfg.UsageBudget == 0 {
+		fmt.Println("No daily token budget set. Set one with 'opencode-auth usage budget set 500k'.")
+		return nil
+	}
+	fmt.Printf("Budget: %s tokens a day\n", proxy.FormatTokens(cfg.UsageBudget))
+
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		fmt.Println("Usage: unknown, the proxy is not running")
+		return nil
+	}
+	health, err := proxyctl.CheckHealth(ctx, proxyURL)
+	if err != nil {
+		return err
+	}
+	if health.UsageBudget == nil {
+		fmt.Println("Usage: unknown, the proxy has not loaded the budget yet")
+		return nil
+	}
+	fmt.Printf("Usage: %s\n", describeUsageBudget(health.UsageBudget))
+	fmt.Println("Counts reset at midnight and when the proxy restarts.")
+	return nil
 }
 
-// EnsureResponse is the response from /api/auth/ensure endpoint
-type EnsureResponse struct {
-	Status           string `json:"status"`
-	ReauthInProgress bool   `json:"reauth_in_progress,omitempty"`
-	Message          string `json:"message,omitempty"`
+// describeUsageBudget summarizes the proxy's usage_budget health section.
+func describeUsageBudget(b *proxy.UsageBudgetStatus) string {
+	s := fmt.Sprintf("%s of %s tokens today (%.1f%%), %s in the last hour",
+		proxy.FormatTokens(b.Used), proxy.FormatTokens(b.Budget), b.Percent, proxy.FormatTokens(b.BurnRate))
+	if b.ExhaustedAt != nil {
+		s += ", runs out at " + b.ExhaustedAt.Local().Format("15:04") + " at this rate"
+	}
+	return s
 }
 
-// TokenStatusResponse is the response from /api/token/status endpoint
-type TokenStatusResponse struct {
-	Valid            bool      `json:"valid"`
-	ExpiresIn        string    `json:"expires_in,omitempty"`
-	Email            string    `json:"email,omitempty"`
-	NeedsReauth      bool      `json:"needs_reauth"`
-	ReauthInProgress bool      `json:"reauth_in_progress"`
-	ExpiresAt        time.Time `json:"expires_at,omitempty"`
+func workspaceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "workspace",
+		Short: "List workspaces and show the active one",
+		Long: `Lists the workspaces in config.json and marks the active one. The proxy
+sends the active workspace upstream as X-OpenCode-Workspace, and the router
+attributes usage to it.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runWorkspaceList()
+		},
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "use <name>",
+		Short: "Switch the active workspace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runWorkspaceUse(cmd.Context(), args[0])
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "Stop sending a workspace",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runWorkspaceUse(cmd.Context(), "")
+		},
+	})
+
+	return cmd
 }
 
-// checkProxyHealth queries the proxy health endpoint
-func checkProxyHealth(proxyURL string) (*ProxyHealth, error) {
-	resp, err := http.Get(proxyURL + "/health")
+func runWorkspaceList() error {
+	oc, err := config.LoadOpenCodeConfig()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close()
+	if len(oc.Workspaces) == 0 {
+		if oc.Workspace == "" {
+			fmt.Println("No workspaces configured. Switch to one with 'opencode-auth workspace use <name>'.")
+		} else {
+			fmt.Printf("* %s\n", oc.Workspace)
+		}
+		return nil
+	}
+	for _, ws := range oc.Workspaces {
+		mark := " "
+		if ws.Name == oc.Workspace {
+			mark = "*"
+		}
+		fmt.Printf("%s %-24s %s\n", mark, ws.Name, ws.Description)
+	}
+	if oc.Workspace != "" && oc.CheckWorkspace(oc.Workspace) != nil {
+		fmt.Printf("Active workspace %q is not listed and is not sent.\n", oc.Workspace)
+	}
+	return nil
+}
 
-	var health ProxyHealth
-	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
-		return nil, err
+// runWorkspaceUse saves workspace in the user layer; "" removes it. A
+// running proxy is asked to reload so that the next request is billed to the
+// new workspace.
+func runWorkspaceUse(ctx context.Context, name string) error {
+	oc, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		effective, err := config.LoadOpenCodeConfig()
+		if err != nil {
+			return err
+		}
+		if err := effective.CheckWorkspace(name); err != nil {
+			return fmt.Errorf("%w; run 'opencode-auth workspace' to list them", err)
+		}
+	}
+	oc.Workspace = name
+	if err := config.SaveOpenCodeConfig(oc); err != nil {
+		return err
+	}
+	if name == "" {
+		fmt.Printf("Workspace removed from %s\n", config.ConfigPath())
+	} else {
+		fmt.Printf("Workspace set to %s in %s\n", name, config.ConfigPath())
+	}
+	if effective, err := config.LoadOpenCodeConfig(); err == nil && effective.Workspace != name {
+		fmt.Printf("Note: another config layer sets workspace to %q, which takes precedence\n", effective.Workspace)
 	}
 
-	return &health, nil
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return nil
+	}
+	reload, err := proxyctl.ReloadConfig(ctx, proxyURL)
+	if err != nil {
+		fmt.Printf("Could not reach the proxy (%v); it applies the change within 30 seconds.\n", err)
+		return nil
+	}
+	if reload.Workspace != name {
+		fmt.Printf("Warning: the proxy is sending workspace %q; see proxy.log\n", reload.Workspace)
+		return nil
+	}
+	fmt.Println("The running proxy applied it.")
+	return nil
 }
 
-// callProxyEnsure asks the proxy to ensure we have a valid token
-func callProxyEnsure(proxyURL string) (*EnsureResponse, error) {
-	resp, err := http.Post(proxyURL+"/api/auth/ensure", "application/json", nil)
-	if err != nil {
-		return nil, err
+// applyOpenCodeConfig applies values from the installer config file to the
+// runtime config, without overriding values already set by flags or env vars.
+func applyOpenCodeConfig(cfg *config.Config, oc *config.OpenCodeConfig) {
+	traceOverrides(cfg, oc)
+	if err := oc.Apply(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 	}
-	defer resp.Body.Close()
+	// Sign-in, discovery and the other HTTP clients dial through the
+	// host overrides; the proxy sets up its own transport
+	if hosts, err := hostmap.New(cfg.HostOverrides); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	} else {
+		hostmap.Install(hosts)
+	}
+	tlspolicy.Install(cfg.TLSPolicy)
+	useTokenStorage(cfg)
+}
 
-	var ensureResp EnsureResponse
-	if err := json.NewDecoder(resp.Body).Decode(&ensureResp); err != nil {
-		return nil, err
+// useTokenStorage points the token functions at the proxy's memory when
+// token_storage is memory. The proxy process replaces this with its own
+// store when it starts.
+func useTokenStorage(cfg *config.Config) {
+	if cfg.MemoryTokens() {
+		auth.UseTokenStore(proxy.NewRemoteTokens(cfg))
 	}
+}
 
-	return &ensureResp, nil
+// tokenLocation describes where the tokens are kept, for messages.
+func tokenLocation(cfg *config.Config) string {
+	if cfg.MemoryTokens() {
+		return "proxy memory (token_storage memory)"
+	}
+	return cfg.TokenPath
 }
 
-// waitForReauth polls the proxy until reauth is complete or times out
-func waitForReauth(proxyURL string, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	pollInterval := 2 * time.Second
+// errStaticAuth is returned by the commands that manage a sign-in, which
+// auth_mode static does without.
+var errStaticAuth = errors.New("auth_mode is static: there is no sign-in, the proxy sends the configured static token")
 
-	for time.Now().Before(deadline) {
-		resp, err := http.Get(proxyURL + "/api/token/status")
-		if err != nil {
-			time.Sleep(pollInterval)
-			continue
+func runLogin(ctx context.Context, timeout time.Duration, noBrowser bool) error {
+	// Load config file values if not overridden by flags / env
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+	if cfg.StaticAuth() {
+		return errStaticAuth
+	}
+	// The tokens will only be kept by a running proxy; start it before
+	// the sign-in rather than losing the tokens after it
+	if cfg.MemoryTokens() {
+		if _, err := proxy.StartProxy(cfg); err != nil {
+			return fmt.Errorf("token_storage memory needs the proxy running: %w", err)
 		}
+	}
 
-		var status TokenStatusResponse
-		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-			resp.Body.Close()
-			time.Sleep(pollInterval)
-			continue
-		}
-		resp.Body.Close()
+	c := client.New(cfg)
+	c.Out = os.Stderr
+	opts := client.LoginOptions{Timeout: timeout, NoBrowser: noBrowser}
+	// Signing in on a phone ends on a page that cannot reach this machine;
+	// its address is pasted at the terminal instead
+	if info, err := os.Stdin.Stat(); noBrowser && err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		opts.Paste = os.Stdin
+	}
+	tokens, err := c.Login(ctx, opts)
+	if err != nil {
+		return err
+	}
 
-		// If valid, reauth succeeded
-		if status.Valid {
-			return nil
+	fmt.Fprintf(os.Stderr, "\nAuthentication successful!\n")
+	fmt.Fprintf(os.Stderr, "  Email: %s\n", tokens.Email)
+	fmt.Fprintf(os.Stderr, "  Expires: %s\n", tokens.ExpiresAt.Local().Format(time.RFC822))
+	for resource := range tokens.AudienceTokens {
+		fmt.Fprintf(os.Stderr, "  Audience: %s\n", resource)
+	}
+	fmt.Fprintf(os.Stderr, "  Tokens stored at: %s\n", tokenLocation(cfg))
+
+	return nil
+}
+
+func runLogout() error {
+	if oc, err := config.LoadOpenCodeConfig(); err == nil {
+		if oc.AuthMode == config.AuthModeStatic {
+			return errStaticAuth
 		}
+		applyOpenCodeConfig(cfg, oc)
+	}
+	if err := client.New(cfg).Logout(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Logged out successfully. Tokens removed from %s\n", tokenLocation(cfg))
+	return nil
+}
 
-		// If not in progress and needs reauth, something went wrong
-		if !status.ReauthInProgress && status.NeedsReauth {
-			return fmt.Errorf("re-authentication failed")
+func runToken(ctx context.Context, refresh bool) error {
+	if oc, err := config.LoadOpenCodeConfig(); err == nil && oc.AuthMode == config.AuthModeStatic {
+		applyOpenCodeConfig(cfg, oc)
+		if err := cfg.ResolveStaticToken(ctx); err != nil {
+			return err
 		}
+		recordTokenCaller()
+		fmt.Print(cfg.StaticToken)
+		return nil
+	}
 
-		time.Sleep(pollInterval)
+	c := client.New(cfg)
+	tokens, err := c.Tokens()
+	if err != nil {
+		return fmt.Errorf("not authenticated: %w", err)
 	}
+	token := tokens.BearerToken()
 
-	return fmt.Errorf("re-authentication timed out after %v", timeout)
-}
+	// Check if token is expired or expiring soon
+	if tokens.IsExpired() || (refresh && tokens.IsExpiringSoon(5*time.Minute)) {
+		tracelog.Printf("token: expires %s; refresh requested: %v", tokens.ExpiresAt.Format(time.RFC3339), refresh)
+		if !refresh {
+			return fmt.Errorf("%w at %s. Run 'opencode-auth login' to re-authenticate", auth.ErrTokenExpired, tokens.ExpiresAt.Local().Format(time.RFC822))
+		}
 
-func runOpenCode(args []string) error {
-	// Load installer config (get client ID from file)
-	openCodeConfig, err := config.LoadOpenCodeConfig()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Run the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash\n")
-		os.Exit(1)
+		// The proxy refreshes; this prevents multiple token commands from
+		// racing to refresh
+		token, err = c.EnsureToken(ctx)
+		switch {
+		case errors.Is(err, client.ErrProxyNotRunning):
+			return fmt.Errorf("token expired and %w. Run 'oc' to start proxy and refresh token", client.ErrProxyNotRunning)
+		case errors.Is(err, client.ErrLoginRequired):
+			return fmt.Errorf("%w: re-authentication required. Run 'opencode-auth login' or 'oc' to re-authenticate", client.ErrLoginRequired)
+		case err != nil:
+			return err
+		}
+	} else {
+		tracelog.Printf("token: no refresh, expires %s (in %s)", tokens.ExpiresAt.Format(time.RFC3339), time.Until(tokens.ExpiresAt).Round(time.Second))
 	}
 
-	// Apply config file values
-	applyOpenCodeConfig(cfg, openCodeConfig)
+	recordTokenCaller()
 
-	// Start async version check (non-blocking)
-	type versionResult struct {
-		info     *versionpkg.UpdateInfo
-		manifest *versionpkg.Manifest
+	// Output bearer token to stdout (for apiKeyHelper)
+	fmt.Print(token)
+	return nil
+}
+
+// tokenFastPath prints the token served by a running proxy for a bare
+// 'opencode-auth token' or 'opencode-auth token --refresh'. It returns false,
+// having printed nothing, whenever the regular path is needed: other
+// arguments, no proxy, or no valid token.
+func tokenFastPath() bool {
+	args := os.Args[1:]
+	if len(args) == 0 || len(args) > 2 || args[0] != "token" || (len(args) == 2 && args[1] != "--refresh") {
+		return false
 	}
-	versionCh := make(chan *versionResult, 1)
-	if !noUpdateCheck && !versionpkg.IsDev(version) && cfg.VersionCheckURL != "" {
-		go func() {
-			info, manifest, err := versionpkg.CheckForUpdate(version, cfg.VersionCheckURL)
-			if err != nil {
-				// Silently ignore errors — version check must never block
-				versionCh <- nil
-				return
-			}
-			versionCh <- &versionResult{info: info, manifest: manifest}
-		}()
-	} else {
-		versionCh <- nil
+	if os.Getenv("OPENCODE_AUTH_NO_FAST_TOKEN") == "1" {
+		return false
 	}
 
-	// Auto-discover OIDC endpoints from issuer if needed
-	if err := cfg.DiscoverEndpoints(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+	if _, err := config.StateDir(); err != nil {
+		return false
+	}
+	cfg = config.DefaultConfig()
+	resp, err := proxy.ReadTokenSocket(proxy.TokenSocketPath(cfg))
+	if err != nil {
+		return false
+	}
+	// --refresh wants the token refreshed when it is close to expiry, which
+	// the regular path asks the proxy to do
+	if len(args) == 2 && time.Until(resp.ExpiresAt) < 5*time.Minute {
+		return false
+	}
+	if resp.Audit {
+		cfg.TokenAudit = true
+		recordTokenCaller()
 	}
 
-	// Check if we have valid tokens (not just present — also not expired)
-	tokens, err := auth.LoadTokens(cfg.TokenPath)
-	needsInitialAuth := err != nil || tokens == nil || tokens.IsExpired()
+	fmt.Print(resp.Token)
+	return true
+}
 
-	if needsInitialAuth {
-		reason := "Authentication required"
-		if tokens != nil && tokens.IsExpired() {
-			reason = "Session expired"
-		}
-		fmt.Fprintf(os.Stderr, "%s. Opening browser...\n", reason)
-		if err := runLogin(5*time.Minute, false); err != nil {
-			return fmt.Errorf("authentication failed: %w", err)
+// recordTokenCaller appends the parent process to the token audit log when
+// auditing is enabled. Failures are reported but never block the token.
+func recordTokenCaller() {
+	if !cfg.TokenAudit {
+		if oc, err := config.LoadOpenCodeConfig(); err != nil || !oc.TokenAudit {
+			return
 		}
 	}
+	caller, err := audit.Parent()
+	if err != nil && cfg.Debug {
+		fmt.Fprintf(os.Stderr, "Warning: could not identify caller: %v\n", err)
+	}
+	if err := audit.Record(audit.Path(cfg.ConfigDir), caller); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record token audit entry: %v\n", err)
+	}
+}
+
+func runStatus(ctx context.Context) error {
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
 
-	// Ensure proxy is running
-	proxyURL, err := proxy.GetProxyURL(cfg)
-	if err != nil {
-		// Proxy not running, start it
-		fmt.Fprintf(os.Stderr, "Starting authentication proxy...\n")
-		proxyConfig, err := proxy.StartProxy(cfg)
-		if err != nil {
-			return fmt.Errorf("failed to start proxy: %w", err)
+	if cfg.StaticAuth() {
+		fmt.Println("Status: Static token (auth_mode static)")
+		if err := cfg.ResolveStaticToken(ctx); err != nil {
+			fmt.Printf("Token: %v\n", err)
+		} else {
+			fmt.Printf("Token: %s\n", proxy.StaticTokenPrefix(cfg.StaticToken))
 		}
-		proxyURL = fmt.Sprintf("http://localhost:%d", proxyConfig.Port)
-		fmt.Fprintf(os.Stderr, "Proxy started\n")
-		// Give the proxy a moment to initialize its refresher
-		time.Sleep(500 * time.Millisecond)
-	} else {
-		// Verify proxy config matches current config (catches stale proxy after update)
-		if proxyConfig, err := proxy.LoadProxyConfig(cfg); err == nil {
-			needsRestart := false
-			reason := ""
-
-			expectedTarget := strings.TrimSuffix(cfg.APIEndpoint, "/v1")
-			if proxyConfig.TargetURL != expectedTarget {
-				needsRestart = true
-				reason = fmt.Sprintf("Proxy target changed (%s → %s)", proxyConfig.TargetURL, expectedTarget)
-			} else if proxyConfig.ClientVersion != "" && proxyConfig.ClientVersion != version {
-				needsRestart = true
-				reason = fmt.Sprintf("Proxy version changed (v%s → v%s)", proxyConfig.ClientVersion, version)
-			}
-
-			if needsRestart {
-				fmt.Fprintf(os.Stderr, "%s, restarting...\n", reason)
-				proxy.StopProxy(cfg)
-				time.Sleep(500 * time.Millisecond)
-				newConfig, err := proxy.StartProxy(cfg)
-				if err != nil {
-					return fmt.Errorf("failed to restart proxy: %w", err)
+		if proxyURL, err := proxy.GetProxyURL(cfg); err == nil {
+			if health, err := proxyctl.CheckHealth(ctx, proxyURL); err == nil {
+				if health.UsageBudget != nil {
+					fmt.Printf("Usage: %s\n", describeUsageBudget(health.UsageBudget))
+				}
+				if health.RateLimits != nil {
+					fmt.Printf("Quota: %s\n", describeRateLimits(health.RateLimits))
 				}
-				proxyURL = fmt.Sprintf("http://localhost:%d", newConfig.Port)
-				time.Sleep(500 * time.Millisecond)
 			}
 		}
+		return nil
 	}
 
-	// Ask proxy to ensure we have a valid token
-	// This delegates ALL token refresh/reauth to the proxy
-	ensureResp, err := callProxyEnsure(proxyURL)
+	tokens, err := auth.LoadTokens(cfg.TokenPath)
 	if err != nil {
-		return fmt.Errorf("failed to communicate with proxy: %w", err)
+		fmt.Println("Status: Not authenticated")
+		fmt.Printf("Token path: %s\n", tokenLocation(cfg))
+		printClockSkew()
+		return nil
 	}
 
-	switch ensureResp.Status {
-	case "ok":
-		// Token is valid, continue
-	case "reauth_required", "reauth_in_progress":
-		// Proxy is handling reauth, wait for it
-		fmt.Fprintf(os.Stderr, "Re-authentication in progress. Please complete login in browser...\n")
-		if err := waitForReauth(proxyURL, 5*time.Minute); err != nil {
-			return fmt.Errorf("re-authentication failed: %w", err)
-		}
-		fmt.Fprintf(os.Stderr, "Re-authentication successful\n")
-	default:
-		return fmt.Errorf("unexpected proxy response: %s", ensureResp.Status)
+	status := "Valid"
+	if tokens.IsExpired() {
+		status = "Expired"
+	} else if tokens.IsExpiringSoon(10 * time.Minute) {
+		status = "Expiring soon"
 	}
 
-	// Final safety check: verify tokens are valid before launching opencode
-	tokens, err = auth.LoadTokens(cfg.TokenPath)
-	if err != nil || tokens == nil || tokens.IsExpired() {
-		return fmt.Errorf("tokens are not valid after refresh. Run 'opencode-auth login' manually")
+	fmt.Printf("Status: %s\n", status)
+	fmt.Printf("Email: %s\n", tokens.Email)
+	fmt.Printf("Expires: %s\n", tokens.ExpiresAt.Local().Format(time.RFC822))
+	fmt.Printf("Token path: %s\n", tokenLocation(cfg))
+
+	if !tokens.IsExpired() {
+		remaining := time.Until(tokens.ExpiresAt)
+		fmt.Printf("Time remaining: %s\n", remaining.Round(time.Second))
 	}
-	fmt.Fprintf(os.Stderr, "Authenticated as %s (expires %s)\n", tokens.Email, tokens.ExpiresAt.Local().Format(time.Kitchen))
 
-	// Wait for version check result (up to 4s — must block launch if below minimum)
-	var versionManifest *versionpkg.Manifest
-	select {
-	case result := <-versionCh:
-		if result != nil {
-			versionManifest = result.manifest
-			if result.info != nil && result.info.BelowMin {
-				// Hard block: do not launch opencode when below minimum version
-				fmt.Fprintln(os.Stderr, "")
-				fmt.Fprintln(os.Stderr, "══════════════════════════════════════════════════")
-				fmt.Fprintln(os.Stderr, " CLIENT UPDATE REQUIRED")
-				fmt.Fprintln(os.Stderr, "")
-				fmt.Fprintf(os.Stderr, " Your version:     v%s\n", result.info.Current)
-				fmt.Fprintf(os.Stderr, " Minimum required: v%s\n", result.info.Latest)
-				fmt.Fprintln(os.Stderr, "══════════════════════════════════════════════════")
-				fmt.Fprintln(os.Stderr, "")
-				fmt.Fprintln(os.Stderr, "Attempting auto-update...")
-				if err := runUpdate(false, false); err != nil {
-					fmt.Fprintf(os.Stderr, "Auto-update failed: %v\n\n", err)
-					if result.info.DownloadURL != "" {
-						fmt.Fprintln(os.Stderr, "Download the latest installer from:")
-						fmt.Fprintf(os.Stderr, "  %s\n", result.info.DownloadURL)
-					} else {
-						fmt.Fprintln(os.Stderr, "Run 'opencode-auth update' to try again.")
-					}
-					os.Exit(1)
-				}
-				fmt.Fprintln(os.Stderr, "")
-				fmt.Fprintln(os.Stderr, "Update complete! Run 'oc' to start.")
-				os.Exit(0)
+	printClockSkew()
+
+	// A configured API key that the router rejects is silently replaced by JWT
+	if proxyURL, err := proxy.GetProxyURL(cfg); err == nil {
+		if health, err := proxyctl.CheckHealth(ctx, proxyURL); err == nil {
+			if health.Revocation != nil {
+				fmt.Printf("Access: REVOKED since %s. %s\n", health.Revocation.Since.Local().Format(time.RFC822), health.Revocation.Message)
 			}
-			if result.info != nil && versionpkg.ShouldNotify(result.info) {
-				fmt.Fprintln(os.Stderr, "")
-				if result.info.Critical {
-					fmt.Fprintln(os.Stderr, "*** CRITICAL UPDATE AVAILABLE ***")
-					fmt.Fprintf(os.Stderr, "opencode-auth v%s contains a critical update (current: v%s)\n",
-						result.info.Latest, result.info.Current)
+			if health.UsageBudget != nil {
+				fmt.Printf("Usage: %s\n", describeUsageBudget(health.UsageBudget))
+			}
+			if health.RateLimits != nil {
+				fmt.Printf("Quota: %s\n", describeRateLimits(health.RateLimits))
+			}
+			if health.APIKey != nil {
+				if health.APIKey.Valid {
+					fmt.Printf("API key: %s... valid\n", health.APIKey.Prefix)
 				} else {
-					fmt.Fprintf(os.Stderr, "A new version of opencode-auth is available: v%s (current: v%s)\n",
-						result.info.Latest, result.info.Current)
+					fmt.Printf("API key: %s... rejected (%s), using JWT auth\n", health.APIKey.Prefix, health.APIKey.Reason)
 				}
-				if result.info.Message != "" {
-					fmt.Fprintf(os.Stderr, "  %s\n", result.info.Message)
-				}
-				fmt.Fprintln(os.Stderr, "  Update with: opencode-auth update")
-				fmt.Fprintln(os.Stderr, "")
-				// Dismiss non-critical notifications
-				if !result.info.Critical {
-					_ = versionpkg.DismissVersion(result.info.Latest)
+			}
+			// Paths the router marked deprecated in the last day
+			for _, d := range health.Deprecations {
+				if time.Since(d.LastSeen) < 24*time.Hour {
+					fmt.Printf("Deprecated: %s\n", d.Message())
 				}
 			}
 		}
-	case <-time.After(4 * time.Second):
-		// Version check timed out — proceed without blocking
-	}
-
-	// Silent config update — apply config patches if config_version changed
-	// This runs after auth is complete (proxy is running, JWT is valid)
-	if versionManifest != nil && versionpkg.ShouldUpdateConfig(versionManifest) {
-		applyConfigPatch(proxyURL, versionManifest.ConfigVersion)
 	}
 
-	// Find the real opencode binary (not a wrapper)
-	opencodePath, err := findRealOpenCode()
-	if err != nil {
-		return fmt.Errorf("opencode not found in PATH. Please install opencode first: %w", err)
-	}
-
-	// Execute opencode
-	cmd := exec.Command(opencodePath, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
+	// Check for updates (synchronous in status command — informational)
+	if !noUpdateCheck && !versionpkg.IsDev(version) {
+		checkURL := cfg.VersionCheckURL
+		if checkURL == "" {
+			// Try to load from config file
+			if oc, err := config.LoadOpenCodeConfig(); err == nil {
+				checkURL = oc.VersionCheckURL
+			}
+		}
+		if checkURL != "" {
+			if info, _, err := versionpkg.CheckForUpdateWith(version, manifestFetcher(ctx, checkURL)); err == nil {
+				if info != nil && info.Available {
+					fmt.Printf("Update: v%s available (current: v%s)\n", info.Latest, info.Current)
+				} else {
+					fmt.Println("Update: Up to date")
+				}
+			}
 		}
-		return fmt.Errorf("failed to run opencode: %w", err)
 	}
 
 	return nil
 }
 
-// applyConfigPatch fetches and applies config patches from the API.
-// This is silent — no user interaction, only logs on error.
-func applyConfigPatch(proxyURL string, configVersion int) {
-	state := versionpkg.LoadSuppression()
-	patch, err := configpatch.FetchConfigPatch(proxyURL, state.LastConfigVersion)
-	if err != nil || patch == nil {
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[config] Warning: failed to fetch config patch: %v\n", err)
-		}
-		return
-	}
+// statusItem is one section of the `status --all` report.
+type statusItem struct {
+	State  string                 `json:"state"` // ok, warn, fail, or off
+	Detail string                 `json:"detail"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
 
-	configDir := cfg.ConfigDir
-	fileMap := map[string]string{
-		"config.json":   filepath.Join(configDir, "config.json"),
-		"opencode.json": filepath.Join(configDir, "opencode.json"),
-	}
+// statusReport aggregates system state for `status --all`.
+type statusReport struct {
+	Auth      statusItem `json:"auth"`
+	Proxy     statusItem `json:"proxy"`
+	Refresher statusItem `json:"refresher"`
+	APIKey    statusItem `json:"api_key"`
+	Usage     statusItem `json:"usage"`
+	Workspace statusItem `json:"workspace"`
+	Quota     statusItem `json:"quota"`
+	Config    statusItem `json:"config"`
+	Version   statusItem `json:"version"`
+}
 
-	for fileName, spec := range patch.Patches {
-		filePath, ok := fileMap[fileName]
-		if !ok {
-			continue
-		}
+func runStatusAll(ctx context.Context, asJSON bool) error {
+	var report statusReport
 
-		// Backup before patching
-		if err := configpatch.Backup(filePath); err != nil {
-			fmt.Fprintf(os.Stderr, "[config] Warning: failed to backup %s: %v\n", fileName, err)
-			continue
-		}
+	openCodeConfig, configErr := config.LoadOpenCodeConfig()
+	if configErr == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
 
-		// Apply patch
-		if err := configpatch.Apply(filePath, spec); err != nil {
-			fmt.Fprintf(os.Stderr, "[config] Warning: failed to patch %s, restoring backup: %v\n", fileName, err)
-			_ = configpatch.Restore(filePath)
-			continue
+	// Auth
+	if cfg.StaticAuth() {
+		if err := cfg.ResolveStaticToken(ctx); err != nil {
+			report.Auth = statusItem{State: "fail", Detail: err.Error(), Data: map[string]interface{}{"auth_mode": config.AuthModeStatic}}
+		} else {
+			report.Auth = statusItem{State: "ok", Detail: "static token " + proxy.StaticTokenPrefix(cfg.StaticToken) + " (auth_mode static)", Data: map[string]interface{}{"auth_mode": config.AuthModeStatic}}
+		}
+	} else if tokens, err := auth.LoadTokens(cfg.TokenPath); err != nil {
+		report.Auth = statusItem{State: "fail", Detail: "not authenticated (run 'opencode-auth login')"}
+	} else {
+		data := map[string]interface{}{"email": tokens.Email, "expires_at": tokens.ExpiresAt}
+		switch {
+		case tokens.IsExpired():
+			report.Auth = statusItem{State: "warn", Detail: fmt.Sprintf("%s, token expired (the proxy refreshes it on next use)", tokens.Email), Data: data}
+		default:
+			report.Auth = statusItem{State: "ok", Detail: fmt.Sprintf("%s, token valid for %s", tokens.Email, time.Until(tokens.ExpiresAt).Round(time.Minute)), Data: data}
 		}
 	}
 
-	// Record the config version we applied
-	_ = versionpkg.RecordConfigVersion(configVersion)
-}
-
-func updateCmd() *cobra.Command {
-	var checkOnly bool
-	var configOnly bool
-
-	cmd := &cobra.Command{
-		Use:   "update",
-		Short: "Update opencode-auth to the latest version",
-		Long: `Check for and install the latest version of opencode-auth.
+	// Proxy
+	proxyURL, proxyErr := proxy.GetProxyURL(cfg)
+	if proxyErr != nil {
+		report.Proxy = statusItem{State: "warn", Detail: fmt.Sprintf("not running (%v)", proxyErr)}
+	} else {
+		report.Proxy = statusItem{State: "ok", Detail: "healthy at " + proxyURL, Data: map[string]interface{}{"url": proxyURL, "log": proxy.LogPath(cfg)}}
+	}
 
-Requires the proxy to be running (start with 'oc' or 'opencode-auth proxy start').
+	// An administrator disabling the user outranks any token state
+	if proxyErr == nil {
+		if health, err := proxyctl.CheckHealth(ctx, proxyURL); err == nil && health.Revocation != nil {
+			report.Auth = statusItem{State: "fail", Detail: health.Revocation.Message, Data: map[string]interface{}{"revoked_since": health.Revocation.Since, "contact": health.Revocation.Contact}}
+		}
+	}
 
-The update is downloaded via a JWT-authenticated presigned URL and installed
-by running install.sh from the downloaded package.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runUpdate(checkOnly, configOnly)
-		},
+	// Refresher reachability of the identity provider
+	if cfg.StaticAuth() {
+		report.Refresher = statusItem{State: "off", Detail: "auth_mode is static, no identity provider"}
+	} else if proxyErr != nil {
+		report.Refresher = statusItem{State: "off", Detail: "proxy not running, self-test skipped"}
+	} else if result, err := refresherSelfTest(ctx, proxyURL); err != nil {
+		report.Refresher = statusItem{State: "warn", Detail: fmt.Sprintf("self-test unavailable (%v)", err)}
+	} else if result.OK {
+		report.Refresher = statusItem{State: "ok", Detail: "identity provider reachable: " + summarizeSelfTest(result), Data: map[string]interface{}{"steps": result.Steps}}
+	} else {
+		report.Refresher = statusItem{State: "fail", Detail: "identity provider check failed: " + summarizeSelfTest(result), Data: map[string]interface{}{"steps": result.Steps}}
 	}
 
-	cmd.Flags().BoolVar(&checkOnly, "check-only", false, "Only check if an update is available (don't download)")
-	cmd.Flags().BoolVar(&configOnly, "config-only", false, "Only apply config patches (don't update binary)")
+	// API key
+	report.APIKey = apiKeyStatus(ctx, proxyURL)
 
-	return cmd
-}
+	// Soft daily token budget
+	report.Usage = usageBudgetStatus(ctx, proxyURL, proxyErr)
 
-func runUpdate(checkOnly, configOnly bool) error {
-	// Load config
-	openCodeConfig, err := config.LoadOpenCodeConfig()
-	if err != nil {
-		return fmt.Errorf("failed to load config: %w\nRun the installer first", err)
-	}
-	applyOpenCodeConfig(cfg, openCodeConfig)
+	// Workspace usage is billed to
+	report.Workspace = workspaceStatus(ctx, proxyURL, proxyErr)
 
-	// Check for updates
-	checkURL := cfg.VersionCheckURL
-	if checkURL == "" {
-		return fmt.Errorf("version check URL not configured. Re-run the installer to update config")
-	}
+	// Upstream rate limits and quotas
+	report.Quota = quotaStatus(ctx, proxyURL, proxyErr)
 
-	info, manifest, err := versionpkg.CheckForUpdate(version, checkURL)
-	if err != nil {
-		return fmt.Errorf("version check failed: %w", err)
+	// Config patches and updates both come from the version manifest
+	var manifest *versionpkg.Manifest
+	if configErr != nil {
+		report.Config = statusItem{State: "fail", Detail: configErr.Error()}
 	}
-
-	if checkOnly {
+	if versionpkg.IsDev(version) {
+		report.Version = statusItem{State: "off", Detail: "development build, update checks disabled"}
+	} else if info, m, err := versionpkg.CheckForUpdateWith(version, manifestFetcher(ctx, cfg.VersionCheckURL)); err != nil {
+		report.Version = statusItem{State: "warn", Detail: fmt.Sprintf("v%s, update check failed (%v)", version, err)}
+	} else {
+		manifest = m
 		if info != nil && info.Available {
-			fmt.Printf("Update available: v%s → v%s\n", info.Current, info.Latest)
+			state := "warn"
 			if info.Critical {
-				fmt.Println("This is a critical update.")
-			}
-			if info.Message != "" {
-				fmt.Printf("  %s\n", info.Message)
+				state = "fail"
 			}
+			report.Version = statusItem{State: state, Detail: fmt.Sprintf("v%s, v%s available (run 'opencode-auth update')", info.Current, info.Latest),
+				Data: map[string]interface{}{"current": info.Current, "latest": info.Latest, "critical": info.Critical}}
 		} else {
-			fmt.Printf("Already running the latest version (v%s)\n", version)
+			report.Version = statusItem{State: "ok", Detail: fmt.Sprintf("v%s, up to date", version)}
 		}
-		return nil
 	}
-
-	// Config-only mode: just apply patches
-	if configOnly {
-		if manifest == nil {
-			return fmt.Errorf("could not fetch version manifest")
-		}
-		if !versionpkg.ShouldUpdateConfig(manifest) {
-			fmt.Println("Config is up to date.")
-			return nil
+	if configErr == nil {
+		suppression := versionpkg.LoadSuppression()
+		applied := suppression.LastConfigVersion
+		data := map[string]interface{}{"path": config.ConfigPath(), "applied_version": applied}
+		switch {
+		case manifest == nil:
+			report.Config = statusItem{State: "ok", Detail: fmt.Sprintf("%s (config version %d)", config.ConfigPath(), applied), Data: data}
+		case versionpkg.ShouldUpdateConfig(manifest):
+			data["pending_version"] = manifest.ConfigVersion
+			if c := suppression.ConfigCohort; c != nil && c.ConfigVersion == manifest.ConfigVersion && !c.Included {
+				data["cohort"] = c
+				report.Config = statusItem{State: "ok", Detail: fmt.Sprintf("config patch v%d rolling out to %.0f%% of clients; not included yet (applied v%d)", manifest.ConfigVersion, c.Percentage, applied), Data: data}
+				break
+			}
+			report.Config = statusItem{State: "warn", Detail: fmt.Sprintf("config patch v%d pending (applied v%d); applied on next 'oc' start or 'opencode-auth update --config-only'", manifest.ConfigVersion, applied), Data: data}
+		default:
+			report.Config = statusItem{State: "ok", Detail: fmt.Sprintf("%s (config version %d, current)", config.ConfigPath(), applied), Data: data}
 		}
+	}
 
-		// Need proxy for config patch fetch
-		proxyURL, err := proxy.GetProxyURL(cfg)
+	if asJSON {
+		out, err := json.MarshalIndent(report, "", "  ")
 		if err != nil {
-			return fmt.Errorf("proxy not running: %w\nStart with 'oc' or 'opencode-auth proxy start'", err)
+			return err
 		}
-
-		fmt.Println("Applying config patches...")
-		applyConfigPatch(proxyURL, manifest.ConfigVersion)
-		fmt.Println("Config updated successfully.")
+		fmt.Println(string(out))
 		return nil
 	}
 
-	// Full update: download and install
-	if info == nil || !info.Available {
-		fmt.Printf("Already running the latest version (v%s)\n", version)
-		return nil
+	for _, row := range []struct {
+		name string
+		item statusItem
+	}{
+		{"Auth", report.Auth},
+		{"Proxy", report.Proxy},
+		{"Refresher", report.Refresher},
+		{"API key", report.APIKey},
+		{"Usage", report.Usage},
+		{"Workspace", report.Workspace},
+		{"Quota", report.Quota},
+		{"Config", report.Config},
+		{"Version", report.Version},
+	} {
+		fmt.Printf("[%-4s] %-9s %s\n", row.item.State, row.name, row.item.Detail)
 	}
+	return nil
+}
 
-	fmt.Printf("Updating opencode-auth v%s → v%s\n", info.Current, info.Latest)
-
-	// Need proxy for download URL
-	proxyURL, err := proxy.GetProxyURL(cfg)
-	if err != nil {
-		return fmt.Errorf("proxy not running: %w\nStart with 'oc' or 'opencode-auth proxy start'", err)
+// usageBudgetStatus reports today's usage against the soft daily budget.
+func usageBudgetStatus(ctx context.Context, proxyURL string, proxyErr error) statusItem {
+	if cfg.UsageBudget == 0 {
+		return statusItem{State: "off", Detail: "no daily token budget (set one with 'opencode-auth usage budget set')"}
+	}
+	if proxyErr != nil {
+		return statusItem{State: "off", Detail: fmt.Sprintf("budget %s tokens, proxy not running", proxy.FormatTokens(cfg.UsageBudget))}
+	}
+	health, err := proxyctl.CheckHealth(ctx, proxyURL)
+	if err != nil || health.UsageBudget == nil {
+		return statusItem{State: "off", Detail: fmt.Sprintf("budget %s tokens, not loaded by the proxy yet", proxy.FormatTokens(cfg.UsageBudget))}
+	}
+	b := health.UsageBudget
+	data := map[string]interface{}{"budget": b.Budget, "used": b.Used, "percent": b.Percent, "burn_rate_per_hour": b.BurnRate}
+	if b.ExhaustedAt != nil {
+		data["exhausted_at"] = b.ExhaustedAt
 	}
+	state := "ok"
+	if b.Percent >= 80 {
+		state = "warn"
+	}
+	return statusItem{State: state, Detail: describeUsageBudget(b), Data: data}
+}
 
-	// Get presigned download URL
-	fmt.Fprintf(os.Stderr, "Fetching download URL...\n")
-	dlResp, err := updatepkg.GetDownloadURL(proxyURL)
-	if err != nil {
-		return fmt.Errorf("failed to get download URL: %w", err)
+// workspaceStatus reports the active workspace and whether the proxy sends it.
+func workspaceStatus(ctx context.Context, proxyURL string, proxyErr error) statusItem {
+	if cfg.Workspace == "" {
+		return statusItem{State: "off", Detail: "none (switch with 'opencode-auth workspace use')"}
 	}
+	data := map[string]interface{}{"workspace": cfg.Workspace}
+	if proxyErr != nil {
+		return statusItem{State: "off", Detail: cfg.Workspace + ", proxy not running", Data: data}
+	}
+	health, err := proxyctl.CheckHealth(ctx, proxyURL)
+	if err != nil || health.Workspace != cfg.Workspace {
+		return statusItem{State: "warn", Detail: cfg.Workspace + ", not applied by the proxy yet", Data: data}
+	}
+	return statusItem{State: "ok", Detail: cfg.Workspace, Data: data}
+}
 
-	// Download the installer zip
-	fmt.Fprintf(os.Stderr, "Downloading installer...\n")
-	zipPath, err := updatepkg.DownloadZip(dlResp.DownloadURL)
+// quotaStatus reports the rate limits and quotas the upstream last sent.
+func quotaStatus(ctx context.Context, proxyURL string, proxyErr error) statusItem {
+	if proxyErr != nil {
+		return statusItem{State: "off", Detail: "proxy not running"}
+	}
+	health, err := proxyctl.CheckHealth(ctx, proxyURL)
 	if err != nil {
-		return fmt.Errorf("download failed: %w", err)
+		return statusItem{State: "warn", Detail: fmt.Sprintf("unavailable (%v)", err)}
 	}
-	defer os.Remove(zipPath)
-
-	// Extract and run install.sh
-	// Note: install.sh stops the proxy during binary replacement, which will
-	// briefly disconnect any active oc session. We restart the proxy afterward
-	// so the session can reconnect automatically.
-	fmt.Fprintf(os.Stderr, "Installing update...\n")
-	if err := updatepkg.ExtractAndInstall(zipPath); err != nil {
-		return fmt.Errorf("installation failed: %w", err)
+	if health.RateLimits == nil {
+		return statusItem{State: "off", Detail: "none reported by the upstream"}
 	}
-
-	// Restart the proxy with the new binary so active sessions can reconnect.
-	fmt.Fprintf(os.Stderr, "Restarting proxy...\n")
-	if _, err := proxy.StartProxy(cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: could not restart proxy: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Run 'oc' to restart it manually.\n")
+	state := "ok"
+	for _, l := range health.RateLimits.Limits {
+		if l.Low {
+			state = "warn"
+		}
 	}
-
-	fmt.Fprintf(os.Stderr, "\nUpdate complete! Restart your shell or run 'oc' to use v%s.\n", info.Latest)
-	return nil
+	return statusItem{State: state, Detail: describeRateLimits(health.RateLimits), Data: map[string]interface{}{"limits": health.RateLimits.Limits}}
 }
 
-func apikeyCmd() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "apikey",
-		Short: "Manage API keys for programmatic access",
-		Long: `Manage API keys that can be used for CI/CD pipelines and automation.
-
-API keys are tied to your OIDC identity and provide long-lived access
-without requiring interactive browser login.
-
-Keys are shown in full only once at creation. Store them securely.`,
+// describeRateLimits summarizes the limits the upstream last sent.
+func describeRateLimits(rl *proxy.RateLimitsStatus) string {
+	parts := make([]string, 0, len(rl.Limits))
+	for i := range rl.Limits {
+		parts = append(parts, rl.Limits[i].Message())
 	}
-
-	cmd.AddCommand(apikeyCreateCmd())
-	cmd.AddCommand(apikeyListCmd())
-	cmd.AddCommand(apikeyRevokeCmd())
-
-	return cmd
+	return strings.Join(parts, "; ")
 }
 
-func apikeyCreateCmd() *cobra.Command {
-	var description string
-	var expiresInDays int
-	var saveToConfig bool
-
-	cmd := &cobra.Command{
-		Use:   "create",
-		Short: "Create a new API key",
-		Long: `Creates a new API key tied to your OIDC identity.
-
-The full API key is displayed only once. Store it securely — it cannot be
-retrieved again.
-
-Use --save to automatically save the key to ~/.opencode/config.json so the
-proxy uses API key authentication instead of JWT.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runApikeyCreate(description, expiresInDays, saveToConfig)
-		},
+// apiKeyStatus reports the configured API key and, if the proxy can reach the
+// management API, its expiry.
+func apiKeyStatus(ctx context.Context, proxyURL string) statusItem {
+	if cfg.APIKey == "" && cfg.APIKeyRef == "" && cfg.APIKeyCmd == "" {
+		return statusItem{State: "off", Detail: "not configured (JWT mode)"}
+	}
+	if err := cfg.ResolveAPIKey(ctx); err != nil {
+		return statusItem{State: "fail", Detail: err.Error()}
+	}
+	prefix := cfg.APIKey
+	if len(prefix) > 10 {
+		prefix = prefix[:10]
+	}
+	if proxyURL == "" {
+		return statusItem{State: "ok", Detail: prefix + "... (expiry unknown, proxy not running)"}
+	}
+	if health, err := proxyctl.CheckHealth(ctx, proxyURL); err == nil && health.APIKey != nil && !health.APIKey.Valid {
+		return statusItem{State: "fail", Detail: fmt.Sprintf("%s... rejected by the API (%s); the proxy is using JWT auth", prefix, health.APIKey.Reason),
+			Data: map[string]interface{}{"prefix": prefix, "rejected": health.APIKey.Reason}}
 	}
 
-	cmd.Flags().StringVarP(&description, "description", "d", "", "Description for the API key (e.g., 'CI pipeline')")
-	cmd.Flags().IntVar(&expiresInDays, "expires-in-days", 90, "Number of days until key expires (1-365)")
-	cmd.Flags().BoolVar(&saveToConfig, "save", false, "Save the API key to config for proxy to use")
+	keys, err := apikey.NewClient(proxyURL, "").List(ctx)
+	if err != nil {
+		return statusItem{State: "warn", Detail: fmt.Sprintf("%s... (could not list keys: %v)", prefix, err)}
+	}
+	for _, k := range keys.Keys {
+		if k.KeyPrefix != prefix {
+			continue
+		}
+		data := map[string]interface{}{"prefix": prefix, "status": k.Status, "expires_at": k.ExpiresAt}
+		if k.Status != "active" {
+			return statusItem{State: "fail", Detail: fmt.Sprintf("%s... is %s", prefix, k.Status), Data: data}
+		}
+		expires, err := apikey.ParseTimestamp(k.ExpiresAt)
+		if err != nil {
+			return statusItem{State: "ok", Detail: prefix + "... active", Data: data}
+		}
+		remaining := time.Until(expires)
+		switch {
+		case remaining <= 0:
+			return statusItem{State: "fail", Detail: fmt.Sprintf("%s... expired on %s", prefix, expires.Local().Format("2006-01-02")), Data: data}
+		case remaining < 7*24*time.Hour:
+			return statusItem{State: "warn", Detail: fmt.Sprintf("%s... expires in %d days (rotate with 'opencode-auth apikey create --save')", prefix, int(remaining.Hours()/24)), Data: data}
+		default:
+			return statusItem{State: "ok", Detail: fmt.Sprintf("%s... active, expires %s", prefix, expires.Local().Format("2006-01-02")), Data: data}
+		}
+	}
+	return statusItem{State: "fail", Detail: prefix + "... not found among your keys (revoked or created by another user)"}
+}
 
-	return cmd
+// skewEndpoint returns the IdP URL used to measure clock skew, or "" if none
+// is configured.
+func skewEndpoint() string {
+	if cfg.TokenEndpoint != "" {
+		return cfg.TokenEndpoint
+	}
+	return cfg.Issuer
 }
 
-func apikeyListCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "list",
-		Short: "List your API keys",
-		Long:  `Lists all API keys associated with your identity, showing prefix, description, and status.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runApikeyList()
-		},
+// printClockSkew prints the measured clock skew against the IdP (status output).
+func printClockSkew() {
+	endpoint := skewEndpoint()
+	if endpoint == "" {
+		return
 	}
+	skew, err := auth.MeasureClockSkew(context.Background(), endpoint)
+	if err != nil {
+		fmt.Printf("Clock skew: unknown (%v)\n", err)
+		return
+	}
+	label := "OK"
+	if warning, err := auth.CheckClockSkew(skew); err != nil {
+		label = "TOO LARGE — run 'opencode-auth doctor'"
+	} else if warning != "" {
+		label = "warning"
+	}
+	fmt.Printf("Clock skew: %s (%s)\n", skew.Round(time.Second), label)
 }
 
-func apikeyRevokeCmd() *cobra.Command {
+// checkClockSkewGuard refuses to proceed when the local clock is too far from
+// the IdP's. Measurement failures are ignored so offline checks never block.
+// A recent measurement without a warning is reused instead of asking the IdP
+// on every launch; sign-in still checks the skew of each new ID token.
+func checkClockSkewGuard(ctx context.Context) error {
+	endpoint := skewEndpoint()
+	if endpoint == "" {
+		return nil
+	}
+	if _, ok := auth.CachedClockSkew(cfg.ConfigDir, endpoint, time.Now()); ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	skew, err := auth.MeasureClockSkew(ctx, endpoint)
+	if err != nil {
+		return nil
+	}
+	auth.SaveClockSkew(cfg.ConfigDir, endpoint, skew, time.Now())
+	warning, err := auth.CheckClockSkew(skew)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	return nil
+}
+
+func runCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:   "revoke <key-prefix>",
-		Short: "Revoke an API key",
-		Long: `Revokes an API key by its prefix (e.g., oc_AbCdEfG).
+		Use:   "run [flags] [-- args...]",
+		Short: "Run opencode with automatic authentication",
+		Long: `Authenticates automatically and launches opencode with the proper token.
 
-Revoked keys stop working within 5 minutes (due to caching).`,
-		Args: cobra.ExactArgs(1),
+If not authenticated, opens a browser to login first.
+All arguments after -- are passed to opencode.`,
+		DisableFlagParsing: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runApikeyRevoke(args[0])
+			return runOpenCode(cmd.Context(), args)
 		},
 	}
 }
 
-func loadConfigAndToken() (string, string, error) {
-	openCodeConfig, err := config.LoadOpenCodeConfig()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to load config: %w\nRun the installer first", err)
+// findRealOpenCode resolves the opencode executable to launch: the
+// configured opencode_path, or the first opencode in PATH that runs and
+// reports a version and is not the oc wrapper or this binary.
+func findRealOpenCode(ctx context.Context) (*launcher.Resolved, error) {
+	var exclude []string
+	if self, err := os.Executable(); err == nil {
+		exclude = append(exclude, self)
 	}
+	if wrapper, err := exec.LookPath("oc"); err == nil {
+		exclude = append(exclude, wrapper)
+	}
+	exclude = append(exclude, filepath.Join(filepath.Dir(os.Args[0]), "oc"))
 
-	applyOpenCodeConfig(cfg, openCodeConfig)
+	r := &launcher.Resolver{
+		ConfigDir: cfg.ConfigDir,
+		Explicit:  cfg.OpenCodePath,
+		PathEnv:   os.Getenv("PATH"),
+		Exclude:   exclude,
+	}
+	return r.Resolve(ctx)
+}
 
-	// API key management goes through the proxy (which adds JWT for us).
-	// Check if proxy is running first.
-	proxyURL, err := proxy.GetProxyURL(cfg)
+// refresherSelfTest asks the proxy to check its path to the identity provider.
+// The proxy answers 503 when a check fails, with the same JSON body.
+func refresherSelfTest(ctx context.Context, proxyURL string) (*proxy.SelfTestResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", proxyURL+"/api/refresher/selftest", nil)
 	if err != nil {
-		return "", "", fmt.Errorf("proxy not running: %w\nStart with 'opencode-auth proxy start' or 'oc'", err)
+		return nil, err
 	}
-
-	// Verify we have a valid JWT (proxy needs it for management endpoints)
-	tokens, err := auth.LoadTokens(cfg.TokenPath)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", "", fmt.Errorf("not authenticated: %w\nRun 'opencode-auth login' first", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if tokens.IsExpired() {
-		return "", "", fmt.Errorf("token expired. Run 'opencode-auth login' to re-authenticate")
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("proxy returned %s (restart it to pick up the self-test endpoint)", resp.Status)
 	}
+	var result proxy.SelfTestResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
 
-	// Use proxy URL — it will add the JWT Authorization header
-	return proxyURL, "", nil
+// summarizeSelfTest joins the self-test steps into one line, failures first.
+func summarizeSelfTest(result *proxy.SelfTestResult) string {
+	var failed, passed []string
+	for _, step := range result.Steps {
+		switch {
+		case step.Skipped:
+		case step.OK:
+			passed = append(passed, fmt.Sprintf("%s %s", step.Name, step.Latency))
+		default:
+			failed = append(failed, fmt.Sprintf("%s: %s", step.Name, step.Detail))
+		}
+	}
+	if len(failed) > 0 {
+		return strings.Join(failed, "; ")
+	}
+	return strings.Join(passed, ", ")
 }
 
-func runApikeyCreate(description string, expiresInDays int, saveToConfig bool) error {
-	endpoint, token, err := loadConfigAndToken()
-	if err != nil {
-		return err
+func runOpenCode(ctx context.Context, args []string) error {
+	// Reached while verifying an opencode candidate: that candidate is a
+	// wrapper leading back here, and launching would loop
+	if os.Getenv(launcher.RecursionEnv) == "1" {
+		return fmt.Errorf("this opencode is a wrapper around opencode-auth; set opencode_path to the real executable")
 	}
 
-	client := apikey.NewClient(endpoint, token)
-	key, err := client.Create(description, expiresInDays)
+	// Load installer config (get client ID from file)
+	openCodeConfig, err := config.LoadOpenCodeConfig()
 	if err != nil {
-		return fmt.Errorf("failed to create API key: %w", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Run the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash\n")
+		os.Exit(1)
 	}
 
-	fmt.Fprintf(os.Stderr, "\nAPI key created successfully!\n\n")
-	fmt.Fprintf(os.Stderr, "  Key:         %s\n", key.Key)
-	fmt.Fprintf(os.Stderr, "  Prefix:      %s\n", key.KeyPrefix)
-	fmt.Fprintf(os.Stderr, "  Description: %s\n", key.Description)
-	fmt.Fprintf(os.Stderr, "  Expires:     %s\n", key.ExpiresAt)
-	fmt.Fprintf(os.Stderr, "\n  WARNING: This is the only time the full key will be shown.\n")
-	fmt.Fprintf(os.Stderr, "  Store it securely!\n\n")
+	// Apply config file values
+	applyOpenCodeConfig(cfg, openCodeConfig)
 
-	if saveToConfig {
-		openCodeConfig, err := config.LoadOpenCodeConfig()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "  Warning: could not load config to save API key: %v\n", err)
-		} else {
-			openCodeConfig.APIKey = key.Key
-			if err := config.SaveOpenCodeConfig(openCodeConfig); err != nil {
-				fmt.Fprintf(os.Stderr, "  Warning: could not save API key to config: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "  API key saved to %s\n", config.ConfigPath())
-				fmt.Fprintf(os.Stderr, "  The proxy will use this key for authentication.\n")
-				fmt.Fprintf(os.Stderr, "  Restart the proxy to apply: opencode-auth proxy restart\n\n")
+	// Start async version check (non-blocking)
+	type versionResult struct {
+		info     *versionpkg.UpdateInfo
+		manifest *versionpkg.Manifest
+	}
+	versionCh := make(chan *versionResult, 1)
+	if !noUpdateCheck && !versionpkg.IsDev(version) && cfg.VersionCheckURL != "" {
+		go func() {
+			info, manifest, err := versionpkg.CheckForUpdateWith(version, manifestFetcher(ctx, cfg.VersionCheckURL))
+			if err != nil {
+				// Silently ignore errors — version check must never block
+				versionCh <- nil
+				return
 			}
-		}
+			versionCh <- &versionResult{info: info, manifest: manifest}
+		}()
 	} else {
-		fmt.Fprintf(os.Stderr, "  To save to config: opencode-auth apikey create --save -d \"...\"\n")
-		fmt.Fprintf(os.Stderr, "  For direct use:    curl -H \"X-API-Key: %s\" https://<api-domain>/v1/chat/completions\n\n", key.Key)
+		versionCh <- nil
 	}
 
-	return nil
-}
+	// auth_mode static has no identity provider and nothing to sign in to
+	if !cfg.StaticAuth() {
+		// Auto-discover OIDC endpoints from issuer if needed
+		if err := cfg.DiscoverEndpoints(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+		}
 
-func runApikeyList() error {
-	endpoint, token, err := loadConfigAndToken()
+		// Refuse to start with a drifted clock — JWT validation would fail later
+		// with confusing 401s
+		if err := checkClockSkewGuard(ctx); err != nil {
+			return err
+		}
+
+		// Check if we have valid tokens (not just present — also not expired)
+		tokens, err := auth.LoadTokens(cfg.TokenPath)
+		needsInitialAuth := err != nil || tokens == nil || tokens.IsExpired()
+		switch {
+		case err != nil || tokens == nil:
+			tracelog.Printf("run: signing in, no saved tokens: %v", err)
+		case tokens.IsExpired():
+			tracelog.Printf("run: signing in, tokens expired %s", tokens.ExpiresAt.Format(time.RFC3339))
+		default:
+			tracelog.Printf("run: saved tokens valid until %s", tokens.ExpiresAt.Format(time.RFC3339))
+		}
+
+		if needsInitialAuth {
+			reason := "Authentication required"
+			if tokens != nil && tokens.IsExpired() {
+				reason = "Session expired"
+			}
+			fmt.Fprintf(os.Stderr, "%s. Opening browser...\n", reason)
+			if err := runLogin(ctx, 5*time.Minute, false); err != nil {
+				return fmt.Errorf("authentication failed: %w", err)
+			}
+		}
+	}
+
+	// Ensure proxy is running, restarting it if it is stale (e.g. after an update)
+	running, err := proxyctl.EnsureConfig(ctx, cfg)
 	if err != nil {
 		return err
 	}
+	if running.Started {
+		fmt.Fprintf(os.Stderr, "Authentication proxy started\n")
+	} else if running.Restarted != "" {
+		fmt.Fprintf(os.Stderr, "%s, proxy restarted\n", running.Restarted)
+	}
+	proxyURL := running.URL
+	tracelog.Printf("run: proxy at %s (started: %v, restarted: %q)", proxyURL, running.Started, running.Restarted)
 
-	client := apikey.NewClient(endpoint, token)
-	resp, err := client.List()
+	// Ask proxy to ensure we have a valid token
+	// This delegates ALL token refresh/reauth to the proxy
+	ensureResp, err := proxyctl.EnsureAuth(ctx, proxyURL)
 	if err != nil {
-		return fmt.Errorf("failed to list API keys: %w", err)
+		return fmt.Errorf("failed to communicate with proxy: %w", err)
 	}
 
-	if len(resp.Keys) == 0 {
-		fmt.Println("No API keys found.")
-		fmt.Println("Create one with: opencode-auth apikey create -d \"my key\"")
-		return nil
+	tracelog.Printf("run: proxy answered %s to ensure-auth", ensureResp.Status)
+	switch ensureResp.Status {
+	case proxyctl.StatusOK:
+		// Token is valid, continue
+	case proxyctl.StatusReauthRequired, proxyctl.StatusReauthInProgress:
+		// Proxy is handling reauth, wait for it
+		fmt.Fprintf(os.Stderr, "Re-authentication in progress. Please complete login in browser...\n")
+		if err := proxyctl.WaitForReauth(ctx, proxyURL, 5*time.Minute); err != nil {
+			return fmt.Errorf("re-authentication failed: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Re-authentication successful\n")
+	default:
+		return fmt.Errorf("unexpected proxy response: %s", ensureResp.Status)
 	}
 
-	fmt.Printf("%-12s %-10s %-25s %-25s %-25s %s\n", "PREFIX", "STATUS", "CREATED", "EXPIRES", "LAST USED", "DESCRIPTION")
-	fmt.Println("---------- -------- ----------------------- ----------------------- ----------------------- -----------")
-	for _, k := range resp.Keys {
-		lastUsed := "never"
-		if k.LastUsedAt != nil {
-			lastUsed = *k.LastUsedAt
+	// Final safety check: verify tokens are valid before launching opencode
+	var email string
+	if cfg.StaticAuth() {
+		fmt.Fprintf(os.Stderr, "Using static token (auth_mode static)\n")
+	} else {
+		tokens, err := auth.LoadTokens(cfg.TokenPath)
+		if err != nil || tokens == nil || tokens.IsExpired() {
+			return fmt.Errorf("tokens are not valid after refresh. Run 'opencode-auth login' manually")
 		}
-		// Truncate ISO timestamps for display
-		created := truncateTimestamp(k.CreatedAt)
-		expires := truncateTimestamp(k.ExpiresAt)
-		if lastUsed != "never" {
-			lastUsed = truncateTimestamp(lastUsed)
+		email = tokens.Email
+		fmt.Fprintf(os.Stderr, "Authenticated as %s (expires %s)\n", email, tokens.ExpiresAt.Local().Format(time.Kitchen))
+		registerDeviceIfNeeded(ctx, proxyURL)
+	}
+
+	// Wait for version check result (up to 4s — must block launch if below minimum)
+	var versionManifest *versionpkg.Manifest
+	select {
+	case result := <-versionCh:
+		if result != nil {
+			versionManifest = result.manifest
+			if result.info != nil && result.info.BelowMin {
+				// Hard block: do not launch opencode when below minimum version
+				fmt.Fprintln(os.Stderr, "")
+				fmt.Fprintln(os.Stderr, "══════════════════════════════════════════════════")
+				fmt.Fprintln(os.Stderr, " CLIENT UPDATE REQUIRED")
+				fmt.Fprintln(os.Stderr, "")
+				fmt.Fprintf(os.Stderr, " Your version:     v%s\n", result.info.Current)
+				fmt.Fprintf(os.Stderr, " Minimum required: v%s\n", result.info.Latest)
+				fmt.Fprintln(os.Stderr, "══════════════════════════════════════════════════")
+				fmt.Fprintln(os.Stderr, "")
+				fmt.Fprintln(os.Stderr, "Attempting auto-update...")
+				if err := runUpdate(ctx, false, false, 0); err != nil {
+					fmt.Fprintf(os.Stderr, "Auto-update failed: %v\n\n", err)
+					if result.info.DownloadURL != "" {
+						fmt.Fprintln(os.Stderr, "Download the latest installer from:")
+						fmt.Fprintf(os.Stderr, "  %s\n", result.info.DownloadURL)
+					} else {
+						fmt.Fprintln(os.Stderr, "Run 'opencode-auth update' to try again.")
+					}
+					os.Exit(1)
+				}
+				fmt.Fprintln(os.Stderr, "")
+				fmt.Fprintln(os.Stderr, "Update complete! Run 'oc' to start.")
+				os.Exit(0)
+			}
+			if result.info != nil && versionpkg.ShouldNotify(result.info) {
+				fmt.Fprintln(os.Stderr, "")
+				if result.info.Critical {
+					fmt.Fprintln(os.Stderr, "*** CRITICAL UPDATE AVAILABLE ***")
+					fmt.Fprintf(os.Stderr, "opencode-auth v%s contains a critical update (current: v%s)\n",
+						result.info.Latest, result.info.Current)
+				} else {
+					fmt.Fprintf(os.Stderr, "A new version of opencode-auth is available: v%s (current: v%s)\n",
+						result.info.Latest, result.info.Current)
+				}
+				if result.info.Message != "" {
+					fmt.Fprintf(os.Stderr, "  %s\n", result.info.Message)
+				}
+				fmt.Fprintln(os.Stderr, "  Update with: opencode-auth update")
+				fmt.Fprintln(os.Stderr, "")
+				// Dismiss non-critical notifications
+				if !result.info.Critical {
+					_ = versionpkg.DismissVersion(result.info.Latest)
+				}
+			}
 		}
-		fmt.Printf("%-12s %-10s %-25s %-25s %-25s %s\n", k.KeyPrefix, k.Status, created, expires, lastUsed, k.Description)
+	case <-time.After(4 * time.Second):
+		// Version check timed out — proceed without blocking
+		tracelog.Printf("run: version check timed out, not blocking the launch")
 	}
 
-	return nil
-}
+	// Silent config update — apply config patches if config_version changed
+	// This runs after auth is complete (proxy is running, JWT is valid)
+	if versionManifest != nil && versionpkg.ShouldUpdateConfig(versionManifest) {
+		applyConfigPatch(ctx, proxyURL, versionManifest.ConfigVersion)
+	}
 
-func runApikeyRevoke(keyPrefix string) error {
-	endpoint, token, err := loadConfigAndToken()
+	// Find the real opencode binary (not a wrapper)
+	resolved, err := findRealOpenCode(ctx)
 	if err != nil {
+		return fmt.Errorf("cannot launch opencode; install it or set opencode_path in %s: %w", config.ConfigPath(), err)
+	}
+	opencodePath := resolved.Path
+	tracelog.Printf("run: opencode %s (%s)", opencodePath, resolved.Version)
+
+	// The manifest lists opencode releases that misbehave with this client
+	if err := checkOpenCodeCompat(versionManifest, resolved.Version); err != nil {
 		return err
 	}
 
-	client := apikey.NewClient(endpoint, token)
-	resp, err := client.Revoke(keyPrefix)
+	// Pre-launch hooks may veto the launch (e.g. VPN not connected)
+	session := hooks.NewSession()
+	session.Email = email
+	session.ProxyURL = proxyURL
+	session.APIEndpoint = cfg.APIEndpoint
+	session.ProjectDir = config.ProjectDir()
+	hookRunner, err := newHookRunner()
 	if err != nil {
-		return fmt.Errorf("failed to revoke API key: %w", err)
+		return err
+	}
+	if err := hookRunner.Run(ctx, hooks.PreLaunch, cfg.Hooks.PreLaunch, session); err != nil {
+		return fmt.Errorf("not starting opencode: %w", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "API key %s revoked successfully.\n", resp.KeyPrefix)
-	fmt.Fprintf(os.Stderr, "Note: Cached sessions may take up to 5 minutes to expire.\n")
+	// Execute opencode
+	cmd := exec.Command(opencodePath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	runErr := cmd.Run()
+	exitCode := 0
+	if exitErr, ok := runErr.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if runErr != nil {
+		exitCode = -1
+	}
+
+	// Post-exit hooks run even if opencode was interrupted
+	session.ExitCode = exitCode
+	session.Duration = time.Since(session.Start)
+	if err := hookRunner.Run(context.WithoutCancel(ctx), hooks.PostExit, cfg.Hooks.PostExit, session); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+
+	if _, ok := runErr.(*exec.ExitError); ok {
+		os.Exit(exitCode)
+	}
+	if runErr != nil {
+		return fmt.Errorf("failed to run opencode: %w", runErr)
+	}
 	return nil
 }
 
-func truncateTimestamp(ts string) string {
-	t, err := time.Parse(time.RFC3339, ts)
-	if err != nil {
-		// Try parsing without timezone
-		t, err = time.Parse("2006-01-02T15:04:05.999999", ts)
+// checkOpenCodeCompat warns about an opencode release the manifest's
+// compatibility matrix lists for this opencode-auth, or refuses to launch a
+// broken one unless OPENCODE_IGNORE_COMPAT=1.
+func checkOpenCodeCompat(manifest *versionpkg.Manifest, versionOutput string) error {
+	openCode := versionpkg.OpenCodeVersion(versionOutput)
+	entry := versionpkg.CheckCompatibility(manifest, version, openCode)
+	if entry == nil {
+		return nil
+	}
+	if entry.Status == versionpkg.CompatBroken && os.Getenv("OPENCODE_IGNORE_COMPAT") != "1" {
+		err := &versionpkg.IncompatibleError{Client: version, OpenCode: openCode, Entry: *entry}
+		return fmt.Errorf("%w (set OPENCODE_IGNORE_COMPAT=1 to launch anyway)", err)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: opencode %s has known problems with opencode-auth %s\n", openCode, version)
+	if entry.Message != "" {
+		fmt.Fprintf(os.Stderr, "  %s\n", entry.Message)
+	}
+	if entry.Upgrade != "" {
+		fmt.Fprintf(os.Stderr, "  Suggested: %s\n", entry.Upgrade)
+	}
+	return nil
+}
+
+// traceOverrides notes the settings a flag or environment variable set
+// over a different value in the config file.
+func traceOverrides(cfg *config.Config, oc *config.OpenCodeConfig) {
+	for _, o := range []struct{ key, set, file string }{
+		{"client_id", cfg.ClientID, oc.ClientID},
+		{"issuer", cfg.Issuer, oc.Issuer},
+		{"authorize_endpoint", cfg.AuthorizeEndpoint, oc.AuthorizeEndpoint},
+		{"token_endpoint", cfg.TokenEndpoint, oc.TokenEndpoint},
+		{"api_endpoint", cfg.APIEndpoint, oc.APIEndpoint},
+	} {
+		if o.set != "" && o.file != "" && o.set != o.file {
+			tracelog.Printf("config: %s from a flag or the environment wins over the config file's", o.key)
+		}
+	}
+}
+
+// newHookRunner returns a runner for the configured hooks, or a no-op runner
+// when OPENCODE_NO_HOOKS=1.
+func newHookRunner() (*hooks.Runner, error) {
+	if os.Getenv("OPENCODE_NO_HOOKS") == "1" {
+		cfg.Hooks = config.Hooks{}
+	}
+	runner := &hooks.Runner{}
+	if cfg.Hooks.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Hooks.Timeout)
 		if err != nil {
-			return ts
+			return nil, fmt.Errorf("invalid hooks.timeout %q: %w", cfg.Hooks.Timeout, err)
 		}
+		runner.Timeout = timeout
 	}
-	return t.Local().Format("2006-01-02 15:04")
+	return runner, nil
 }
 
-func proxyCmd() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "proxy",
-		Short: "Manage the authentication proxy server",
+// applyConfigPatch fetches and applies config patches from the API.
+// This is silent — no user interaction, only logs on error. Returns false if
+// the patch is being rolled out gradually and this client is not in the
+// cohort yet; the version is then left unrecorded so the next start re-checks.
+func applyConfigPatch(ctx context.Context, proxyURL string, configVersion int) bool {
+	state := versionpkg.LoadSuppression()
+	patch, err := fetchConfigPatch(ctx, proxyURL, state.LastConfigVersion)
+	if err != nil || patch == nil {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[config] Warning: failed to fetch config patch: %v\n", err)
+		}
+		return true
+	}
+
+	if patch.Rollout != nil {
+		bucket, included := patch.Rollout.Includes(versionpkg.MachineID(), runtime.GOOS)
+		_ = versionpkg.RecordConfigCohort(versionpkg.ConfigCohort{
+			ConfigVersion: patch.ConfigVersion,
+			Bucket:        bucket,
+			Percentage:    patch.Rollout.Percentage,
+			Included:      included,
+		})
+		if !included {
+			return false
+		}
+	}
+
+	configDir := cfg.ConfigDir
+	fileMap := map[string]string{
+		"config.json":   filepath.Join(configDir, "config.json"),
+		"opencode.json": filepath.Join(configDir, "opencode.json"),
+		// Proxy-scoped settings, also applied live by a polling proxy
+		configpatch.ProxyPatch: filepath.Join(configDir, "config.json"),
+	}
+
+	// A patch that leaves its file invalid is rolled back
+	validators := map[string]configpatch.Validator{
+		"config.json":          config.CheckFile,
+		"opencode.json":        configpatch.ValidateOpenCodeJSON,
+		configpatch.ProxyPatch: config.CheckFile,
+	}
+
+	target := configpatch.Target{OS: runtime.GOOS, Arch: runtime.GOARCH, ClientVersion: version, Profile: cfg.Profile}
+
+	var actions []string
+	for fileName, spec := range patch.Patches {
+		filePath, ok := fileMap[fileName]
+		if !ok {
+			continue
+		}
+		if match, reason := spec.Conditions.Match(target); !match {
+			if cfg.Debug {
+				fmt.Fprintf(os.Stderr, "[config] Skipping patch for %s: %s\n", fileName, reason)
+			}
+			continue
+		}
+		if fileName == configpatch.ProxyPatch {
+			if err := spec.CheckProxyScope(); err != nil {
+				fmt.Fprintf(os.Stderr, "[config] Warning: skipping patch: %v\n", err)
+				continue
+			}
+		}
+
+		// Apply patch, with a backup to roll back to
+		if err := configpatch.ApplyValidated(filePath, spec, validators[fileName]); err != nil {
+			fmt.Fprintf(os.Stderr, "[config] Warning: failed to patch %s: %v\n", fileName, err)
+			continue
+		}
+		known, unknown := spec.Actions()
+		for _, action := range unknown {
+			fmt.Fprintf(os.Stderr, "[config] Warning: ignoring unknown action %q after the patch for %s\n", action, fileName)
+		}
+		actions = append(actions, known...)
+	}
+	runPatchActions(actions)
+
+	// Record the config version we applied
+	_ = versionpkg.RecordConfigVersion(configVersion)
+	return true
+}
+
+// fetchConfigPatch fetches the config patch from the configured mirror, or
+// from the API via the proxy.
+func fetchConfigPatch(ctx context.Context, proxyURL string, sinceVersion int) (*configpatch.PatchResponse, error) {
+	if cfg.ConfigPatchURL != "" {
+		return configpatch.FetchConfigPatchFrom(ctx, cfg.ConfigPatchURL, sinceVersion, mirror.Transport(cfg.ConfigPatchURL))
+	}
+	return configpatch.FetchConfigPatch(ctx, proxyURL, sinceVersion)
+}
+
+// runPatchActions runs the actions applied patches requested, once each.
+func runPatchActions(actions []string) {
+	done := make(map[string]bool)
+	for _, action := range actions {
+		if done[action] {
+			continue
+		}
+		done[action] = true
+		var err error
+		switch action {
+		case configpatch.ActionRestartProxy:
+			err = restartRunningProxy()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[config] Warning: %s after the config patch failed: %v\n", action, err)
+		}
+	}
+}
+
+// restartRunningProxy restarts a running proxy so it reads the current
+// config, handing its socket over where it can, as 'proxy restart' does. A
+// proxy that isn't running is left alone.
+func restartRunningProxy() error {
+	if runtime.GOOS != "windows" {
+		_, err := proxy.HandoverProxy(cfg)
+		if err == nil || errors.Is(err, proxy.ErrNotRunning) {
+			return nil
+		}
+	}
+	if err := proxy.StopProxy(cfg); err != nil {
+		if errors.Is(err, proxy.ErrNotRunning) {
+			return nil
+		}
+		return err
+	}
+	// Small delay to ensure port is released
+	time.Sleep(500 * time.Millisecond)
+	_, err := proxy.StartProxy(cfg)
+	return err
+}
+
+func updateCmd() *cobra.Command {
+	var checkOnly bool
+	var configOnly bool
+	var timeout time.Duration
+	var limitRate string
+
+	cmd := &cobra.Command{
+		Use:   "update",
+		Short: "Update opencode-auth to the latest version",
+		Long: `Check for and install the latest version of opencode-auth.
+
+Requires the proxy to be running (start with 'oc' or 'opencode-auth proxy start').
+
+The update is downloaded via a JWT-authenticated presigned URL and installed
+by running install.sh from the downloaded package, once it matches the
+SHA-256 digest published in the version manifest. A download interrupted by
+a dropped connection resumes where it stopped, also on the next 'update'.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var rate int64
+			if limitRate != "" {
+				var err error
+				if rate, err = updatepkg.ParseRate(limitRate); err != nil {
+					return err
+				}
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runUpdate(ctx, checkOnly, configOnly, rate)
+		},
+	}
+
+	cmd.Flags().BoolVar(&checkOnly, "check-only", false, "Only check if an update is available (don't download)")
+	cmd.Flags().BoolVar(&configOnly, "config-only", false, "Only apply config patches (don't update binary)")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Minute, "Timeout for the whole update (download and install)")
+	cmd.Flags().StringVar(&limitRate, "limit-rate", "", "Maximum download speed in bytes per second, e.g. 500k or 2m")
+
+	return cmd
+}
+
+// manifestFetcher returns a manifest fetch function that goes through the
+// running proxy first (JWT attached, presigned URL for the private bucket) and
+// falls back to the public manifest URL.
+func manifestFetcher(ctx context.Context, publicURL string) func() (*versionpkg.Manifest, error) {
+	return func() (*versionpkg.Manifest, error) {
+		// A file mirror is read directly; there is no egress to presign for
+		if mirror.IsFile(publicURL) {
+			return versionpkg.FetchManifestWith(publicURL, mirror.Transport(publicURL))
+		}
+		if proxyURL, err := proxy.GetProxyURL(cfg); err == nil {
+			if resp, err := updatepkg.GetManifestURL(ctx, proxyURL); err == nil {
+				if manifest, err := versionpkg.FetchManifest(resp.DownloadURL); err == nil {
+					return manifest, nil
+				}
+			}
+		}
+		if publicURL == "" {
+			return nil, fmt.Errorf("version check URL not configured")
+		}
+		return versionpkg.FetchManifest(publicURL)
+	}
+}
+
+func runUpdate(ctx context.Context, checkOnly, configOnly bool, limitRate int64) error {
+	// Load config
+	openCodeConfig, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w\nRun the installer first", err)
+	}
+	applyOpenCodeConfig(cfg, openCodeConfig)
+
+	// Check for updates
+	checkURL := cfg.VersionCheckURL
+	if checkURL == "" {
+		return fmt.Errorf("version check URL not configured. Re-run the installer to update config")
+	}
+
+	info, manifest, err := versionpkg.CheckForUpdateWith(version, manifestFetcher(ctx, checkURL))
+	if err != nil {
+		return fmt.Errorf("version check failed: %w", err)
+	}
+
+	if checkOnly {
+		if info != nil && info.Available {
+			fmt.Printf("Update available: v%s → v%s\n", info.Current, info.Latest)
+			if info.Critical {
+				fmt.Println("This is a critical update.")
+			}
+			if info.Message != "" {
+				fmt.Printf("  %s\n", info.Message)
+			}
+		} else {
+			fmt.Printf("Already running the latest version (v%s)\n", version)
+		}
+		return nil
+	}
+
+	// Config-only mode: just apply patches
+	if configOnly {
+		if manifest == nil {
+			return fmt.Errorf("could not fetch version manifest")
+		}
+		if !versionpkg.ShouldUpdateConfig(manifest) {
+			fmt.Println("Config is up to date.")
+			return nil
+		}
+
+		// Need proxy for config patch fetch, unless it is mirrored
+		var proxyURL string
+		if cfg.ConfigPatchURL == "" {
+			if proxyURL, err = proxy.GetProxyURL(cfg); err != nil {
+				return fmt.Errorf("%w\nStart with 'oc' or 'opencode-auth proxy start'", err)
+			}
+		}
+
+		fmt.Println("Applying config patches...")
+		if !applyConfigPatch(ctx, proxyURL, manifest.ConfigVersion) {
+			fmt.Printf("Config v%d is being rolled out gradually and this machine is not included yet.\n", manifest.ConfigVersion)
+			return nil
+		}
+		fmt.Println("Config updated successfully.")
+		return nil
+	}
+
+	// Full update: download and install
+	if info == nil || !info.Available {
+		fmt.Printf("Already running the latest version (v%s)\n", version)
+		return nil
+	}
+
+	if manifest == nil || manifest.InstallerSHA256 == "" {
+		return fmt.Errorf("the version manifest publishes no installer_sha256, so the installer can't be verified\nAsk your administrator to republish with scripts/publish-distribution.sh")
+	}
+
+	fmt.Printf("Updating opencode-auth v%s → v%s\n", info.Current, info.Latest)
+
+	downloadURL, err := installerURL(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Download the installer zip
+	bar := progress.NewBar(os.Stderr, "Downloading installer")
+	opts := updatepkg.DownloadOptions{
+		OnProgress: bar.Update,
+		LimitRate:  limitRate,
+		Dir:        filepath.Join(cfg.ConfigDir, janitor.DownloadsDir),
+		SHA256:     manifest.InstallerSHA256,
+	}
+	if cfg.UpdateDownloadBase != "" {
+		// Only a configured mirror may be read from disk, never a URL the
+		// API returned
+		opts.Transport = mirror.Transport(downloadURL)
+	}
+	zipPath, err := updatepkg.DownloadZipWith(ctx, downloadURL, opts)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	bar.Finish()
+	defer os.Remove(zipPath)
+
+	// Extract and run install.sh
+	// Note: install.sh stops the proxy during binary replacement, which will
+	// briefly disconnect any active oc session. We restart the proxy afterward
+	// so the session can reconnect automatically.
+	// install.sh writes its own output, so only time it rather than animate.
+	fmt.Fprintf(os.Stderr, "Installing update...\n")
+	installStart := time.Now()
+	if err := updatepkg.ExtractAndInstall(ctx, zipPath); err != nil {
+		return fmt.Errorf("installation failed: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Installed in %s\n", time.Since(installStart).Round(time.Second))
+
+	// Restart the proxy with the new binary so active sessions can reconnect.
+	spinner := progress.StartSpinner(os.Stderr, "Restarting proxy", 0)
+	_, err = proxy.StartProxy(cfg)
+	spinner.Stop("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not restart proxy: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Run 'oc' to restart it manually.\n")
+	}
+
+	fmt.Fprintf(os.Stderr, "\nUpdate complete! Restart your shell or run 'oc' to use v%s.\n", info.Latest)
+	return nil
+}
+
+// installerURL returns the installer's URL in the configured mirror, or a
+// presigned URL for it from the API via the proxy.
+func installerURL(ctx context.Context) (string, error) {
+	if cfg.UpdateDownloadBase != "" {
+		return mirror.InstallerURL(cfg.UpdateDownloadBase), nil
+	}
+
+	// Need proxy for download URL
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return "", fmt.Errorf("%w\nStart with 'oc' or 'opencode-auth proxy start'", err)
+	}
+
+	// Get presigned download URL
+	spinner := progress.StartSpinner(os.Stderr, "Fetching download URL", 0)
+	dlResp, err := updatepkg.GetDownloadURL(ctx, proxyURL)
+	spinner.Stop("")
+	if err != nil {
+		return "", fmt.Errorf("failed to get download URL: %w", err)
+	}
+	return dlResp.DownloadURL, nil
+}
+
+func apikeyCmd() *cobra.Command {
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "apikey",
+		Short: "Manage API keys for programmatic access",
+		Long: `Manage API keys that can be used for CI/CD pipelines and automation.
+
+API keys are tied to your OIDC identity and provide long-lived access
+without requiring interactive browser login.
+
+Keys are shown in full only once at creation. Store them securely.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			cobra.OnFinalize(cancel)
+			cmd.SetContext(ctx)
+		},
+	}
+
+	cmd.PersistentFlags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for API key requests")
+
+	cmd.AddCommand(apikeyCreateCmd())
+	cmd.AddCommand(apikeyListCmd())
+	cmd.AddCommand(apikeyShowCmd())
+	cmd.AddCommand(apikeyRevokeCmd())
+
+	return cmd
+}
+
+func apikeyCreateCmd() *cobra.Command {
+	var description string
+	var expiresInDays int
+	var saveToConfig bool
+	var store string
+	var federatedToken string
+	var audience string
+	var expiresIn time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create a new API key",
+		Long: `Creates a new API key tied to your OIDC identity.
+
+The full API key is displayed only once. Store it securely — it cannot be
+retrieved again.
+
+Use --save to automatically save the key so the proxy uses API key
+authentication instead of JWT. With --store keychain the key is kept in the OS
+keychain and ~/.opencode/config.json only holds a reference to it.
+
+In CI, --federated-token exchanges the pipeline's own OIDC token for a
+short-lived key (default 1h) without a login. The router must trust the CI
+issuer. The key is printed alone on stdout:
+
+  # GitHub Actions (needs 'permissions: id-token: write')
+  OPENCODE_API_KEY=$(opencode-auth apikey create --federated-token github-actions)
+
+  # Any other CI: pass the JWT, @file or - for stdin
+  opencode-auth apikey create --federated-token @$CI_OIDC_TOKEN_FILE --expires-in 30m
+
+The router is read from OPENAI_BASE_URL or api_endpoint in config.json.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if store != "config" && store != "keychain" {
+				return fmt.Errorf("invalid --store %q (expected config or keychain)", store)
+			}
+			if federatedToken != "" {
+				if cmd.Flags().Changed("expires-in-days") {
+					return fmt.Errorf("--expires-in-days does not apply to --federated-token; use --expires-in")
+				}
+				return runApikeyExchange(cmd.Context(), federatedToken, audience, description, expiresIn, saveToConfig, store)
+			}
+			if cmd.Flags().Changed("expires-in") || cmd.Flags().Changed("audience") {
+				return fmt.Errorf("--expires-in and --audience require --federated-token")
+			}
+			return runApikeyCreate(cmd.Context(), description, expiresInDays, saveToConfig, store)
+		},
+	}
+
+	cmd.Flags().StringVarP(&description, "description", "d", "", "Description for the API key (e.g., 'CI pipeline')")
+	cmd.Flags().IntVar(&expiresInDays, "expires-in-days", 90, "Number of days until key expires (1-365)")
+	cmd.Flags().BoolVar(&saveToConfig, "save", false, "Save the API key to config for proxy to use")
+	cmd.Flags().StringVar(&store, "store", "config", "Where --save stores the key: config (plaintext) or keychain")
+	cmd.Flags().StringVar(&federatedToken, "federated-token", "", "Exchange a CI OIDC token for a short-lived key: a JWT, @file, - (stdin) or github-actions")
+	cmd.Flags().StringVar(&audience, "audience", "opencode", "Audience to request with --federated-token github-actions")
+	cmd.Flags().DurationVar(&expiresIn, "expires-in", time.Hour, "Lifetime of a --federated-token key (capped by the router)")
+
+	return cmd
+}
+
+func apikeyListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List your API keys",
+		Long:  `Lists all API keys associated with your identity, showing prefix, description, and status.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runApikeyList(cmd.Context())
+		},
+	}
+}
+
+func apikeyShowCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:     "show <key-prefix>",
+		Aliases: []string{"describe"},
+		Short:   "Show an API key's full metadata",
+		Long: `Shows everything the router records about one API key (e.g., oc_AbCdEfG):
+who created it and from which address, its scopes, when it expires, and how
+often and from where it was last used. The key itself is never shown.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runApikeyShow(cmd.Context(), args[0], asJSON)
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the metadata as JSON")
+	return cmd
+}
+
+func apikeyRevokeCmd() *cobra.Command {
+	var allExpired bool
+	var olderThan string
+	var dryRun bool
+	var concurrency int
+
+	cmd := &cobra.Command{
+		Use:   "revoke [key-prefix...]",
+		Short: "Revoke one or more API keys",
+		Long: `Revokes API keys by prefix (e.g., oc_AbCdEfG), or in bulk by age or expiry.
+
+Examples:
+  opencode-auth apikey revoke oc_AbCdEfG
+  opencode-auth apikey revoke oc_AbCdEfG oc_HiJkLmN
+  opencode-auth apikey revoke --all-expired
+  opencode-auth apikey revoke --older-than 90d --dry-run
+
+Revoked keys stop working within 5 minutes (due to caching).`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && !allExpired && olderThan == "" {
+				return fmt.Errorf("specify at least one key prefix, --all-expired, or --older-than")
+			}
+
+			var age time.Duration
+			if olderThan != "" {
+				var err error
+				if age, err = parseAge(olderThan); err != nil {
+					return fmt.Errorf("invalid --older-than: %w", err)
+				}
+			}
+
+			// Single prefix without filters keeps the simple one-shot output
+			if len(args) == 1 && !allExpired && age == 0 && !dryRun {
+				return runApikeyRevoke(cmd.Context(), args[0])
+			}
+
+			selector := apikey.Selector{Prefixes: args, AllExpired: allExpired, OlderThan: age}
+			return runApikeyRevokeMany(cmd.Context(), selector, dryRun, concurrency)
+		},
+	}
+
+	cmd.Flags().BoolVar(&allExpired, "all-expired", false, "Revoke all keys past their expiry date")
+	cmd.Flags().StringVar(&olderThan, "older-than", "", "Revoke keys created longer ago than this (e.g. 90d, 720h)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "List the keys that would be revoked without revoking them")
+	cmd.Flags().IntVar(&concurrency, "concurrency", apikey.DefaultRevokeConcurrency, "Number of keys to revoke in parallel")
+
+	return cmd
+}
+
+func envCmd() *cobra.Command {
+	var project bool
+	var ttl time.Duration
+	var shell string
+	var renew bool
+
+	cmd := &cobra.Command{
+		Use:   "env --project",
+		Short: "Print shell exports with a short-lived API key for this project",
+		Long: `Prints a shell snippet that exports a short-lived API key for the current
+project, so repository hooks and scripts can call the router without your
+personal long-lived key:
+
+  eval "$(opencode-auth env --project)"
+  curl -H "X-API-Key: $OPENCODE_API_KEY" "$OPENAI_BASE_URL/chat/completions" ...
+
+The project is the nearest directory with .opencode/config.json or a git
+checkout. Its key is labelled with the directory name, expires after --ttl,
+and is reused until less than half of --ttl remains (--new mints a fresh one).
+Minting a key needs a login and the running proxy.
+
+Exports OPENCODE_API_KEY, OPENCODE_API_KEY_EXPIRES, and OPENAI_BASE_URL.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !project {
+				return fmt.Errorf("only project keys are supported; pass --project")
+			}
+			if ttl < time.Hour || ttl > apikey.MaxProjectKeyTTL {
+				return fmt.Errorf("--ttl must be between 1h and %s", apikey.MaxProjectKeyTTL)
+			}
+			if shell != "sh" && shell != "fish" && shell != "powershell" {
+				return fmt.Errorf("invalid --shell %q (expected sh, fish, or powershell)", shell)
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+			defer cancel()
+			return runEnvProject(ctx, ttl, shell, renew)
+		},
+	}
+
+	cmd.Flags().BoolVar(&project, "project", false, "Export a key scoped to the current project")
+	cmd.Flags().DurationVar(&ttl, "ttl", 8*time.Hour, "Lifetime of a new key, in hours (max 24h)")
+	cmd.Flags().StringVar(&shell, "shell", "sh", "Syntax of the exports: sh, fish, or powershell")
+	cmd.Flags().BoolVar(&renew, "new", false, "Mint a new key even if a cached one is still valid")
+
+	return cmd
+}
+
+// projectRoot returns the directory 'env --project' mints keys for: the
+// config project directory, else the enclosing git checkout.
+func projectRoot() (string, error) {
+	if dir := config.ProjectDir(); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("not in a project: run inside a git checkout or a directory with .opencode/config.json")
+		}
+		dir = parent
+	}
+}
+
+func runEnvProject(ctx context.Context, ttl time.Duration, shell string, renew bool) error {
+	dir, err := projectRoot()
+	if err != nil {
+		return err
+	}
+	openCodeConfig, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w\nRun the installer first", err)
+	}
+	applyOpenCodeConfig(cfg, openCodeConfig)
+	if cfg.APIEndpoint == "" {
+		return fmt.Errorf("no API endpoint configured; set api_endpoint in %s", config.ConfigPath())
+	}
+
+	cachePath := filepath.Join(cfg.ConfigDir, "project-keys.json")
+	key := apikey.LoadProjectKey(cachePath, dir, ttl/2, time.Now())
+	if renew || key == nil {
+		endpoint, token, err := loadConfigAndToken()
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(dir)
+		created, err := apikey.NewClient(endpoint, token).CreateProject(ctx, name, "project: "+name, ttl)
+		if err != nil {
+			return fmt.Errorf("failed to create project API key: %w", err)
+		}
+		expires, err := apikey.ParseTimestamp(created.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("invalid expiry from router: %w", err)
+		}
+		key = &apikey.ProjectKey{Key: created.Key, KeyPrefix: created.KeyPrefix, Project: name, ExpiresAt: expires}
+		if err := apikey.SaveProjectKey(cachePath, dir, *key, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not cache the project key: %v\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created API key %s for project %s, expires %s\n", key.KeyPrefix, name, key.ExpiresAt.Local().Format("15:04 Jan 2"))
+	}
+
+	vars := [][2]string{
+		{"OPENCODE_API_KEY", key.Key},
+		{"OPENCODE_API_KEY_EXPIRES", key.ExpiresAt.UTC().Format(time.RFC3339)},
+		{"OPENAI_BASE_URL", cfg.APIEndpoint},
+	}
+	for _, v := range vars {
+		// Keys, timestamps, and URLs never contain a single quote
+		switch shell {
+		case "fish":
+			fmt.Printf("set -gx %s '%s';\n", v[0], v[1])
+		case "powershell":
+			fmt.Printf("$env:%s = '%s'\n", v[0], v[1])
+		default:
+			fmt.Printf("export %s='%s'\n", v[0], v[1])
+		}
+	}
+	return nil
+}
+
+// parseAge parses a duration that may use a "d" (days) suffix, e.g. "90d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid day count %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	return d, nil
+}
+
+func loadConfigAndToken() (string, string, error) {
+	openCodeConfig, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load config: %w\nRun the installer first", err)
+	}
+
+	applyOpenCodeConfig(cfg, openCodeConfig)
+
+	// API key management goes through the proxy (which adds JWT for us).
+	// Check if proxy is running first.
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("%w\nStart with 'opencode-auth proxy start' or 'oc'", err)
+	}
+
+	// The proxy sends the static token instead
+	if cfg.StaticAuth() {
+		return proxyURL, "", nil
+	}
+
+	// Verify we have a valid JWT (proxy needs it for management endpoints)
+	tokens, err := auth.LoadTokens(cfg.TokenPath)
+	if err != nil {
+		return "", "", fmt.Errorf("not authenticated: %w\nRun 'opencode-auth login' first", err)
+	}
+
+	if tokens.IsExpired() {
+		return "", "", fmt.Errorf("token expired. Run 'opencode-auth login' to re-authenticate")
+	}
+
+	// Use proxy URL — it will add the JWT Authorization header
+	return proxyURL, "", nil
+}
+
+func runApikeyCreate(ctx context.Context, description string, expiresInDays int, saveToConfig bool, store string) error {
+	endpoint, token, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+
+	client := apikey.NewClient(endpoint, token)
+	key, err := client.Create(ctx, description, expiresInDays)
+	if err != nil {
+		return fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nAPI key created successfully!\n\n")
+	fmt.Fprintf(os.Stderr, "  Key:         %s\n", key.Key)
+	fmt.Fprintf(os.Stderr, "  Prefix:      %s\n", key.KeyPrefix)
+	fmt.Fprintf(os.Stderr, "  Description: %s\n", key.Description)
+	fmt.Fprintf(os.Stderr, "  Expires:     %s\n", key.ExpiresAt)
+	fmt.Fprintf(os.Stderr, "\n  WARNING: This is the only time the full key will be shown.\n")
+	fmt.Fprintf(os.Stderr, "  Store it securely!\n\n")
+
+	if saveToConfig {
+		openCodeConfig, err := config.LoadUserConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: could not load config to save API key: %v\n", err)
+		} else if err := saveAPIKey(ctx, openCodeConfig, key.Key, store); err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: could not save API key: %v\n", err)
+		} else {
+			if store == "keychain" {
+				fmt.Fprintf(os.Stderr, "  API key saved to the OS keychain (referenced from %s)\n", config.ConfigPath())
+			} else {
+				fmt.Fprintf(os.Stderr, "  API key saved to %s\n", config.ConfigPath())
+			}
+			fmt.Fprintf(os.Stderr, "  The proxy will use this key for authentication.\n")
+			fmt.Fprintf(os.Stderr, "  Restart the proxy to apply: opencode-auth proxy restart\n\n")
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "  To save to config: opencode-auth apikey create --save -d \"...\"\n")
+		fmt.Fprintf(os.Stderr, "  For direct use:    curl -H \"X-API-Key: %s\" https://<api-domain>/v1/chat/completions\n\n", key.Key)
+	}
+
+	return nil
+}
+
+// runApikeyExchange trades a CI OIDC token for a short-lived API key. It talks
+// to the router directly: CI has no login and no proxy.
+func runApikeyExchange(ctx context.Context, spec, audience, description string, expiresIn time.Duration, saveToConfig bool, store string) error {
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+	if cfg.APIEndpoint == "" {
+		return fmt.Errorf("no API endpoint configured; set OPENAI_BASE_URL (e.g. https://oc.example.com/v1)")
+	}
+	baseURL := strings.TrimSuffix(strings.TrimSuffix(cfg.APIEndpoint, "/"), "/v1")
+
+	subjectToken, err := apikey.ReadFederatedToken(ctx, spec, audience)
+	if err != nil {
+		return err
+	}
+
+	key, err := apikey.NewClient(baseURL, "").Exchange(ctx, subjectToken, description, expiresIn)
+	if err != nil {
+		return fmt.Errorf("failed to exchange federated token: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "API key issued: %s... (%s), expires %s\n", key.KeyPrefix, key.Description, key.ExpiresAt)
+	if saveToConfig {
+		openCodeConfig, err := config.LoadUserConfig()
+		if err != nil {
+			return fmt.Errorf("could not load config to save API key: %w", err)
+		}
+		if err := saveAPIKey(ctx, openCodeConfig, key.Key, store); err != nil {
+			return fmt.Errorf("could not save API key: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "API key saved (%s)\n", store)
+	}
+	// The key alone on stdout, so pipelines can capture it
+	fmt.Println(key.Key)
+	return nil
+}
+
+// saveAPIKey persists a newly created API key, either as plaintext in
+// config.json or in the OS keychain with config.json holding a reference.
+func saveAPIKey(ctx context.Context, oc *config.OpenCodeConfig, key, store string) error {
+	if store == "keychain" {
+		const account = "api-key"
+		if err := secret.KeychainSet(ctx, account, key); err != nil {
+			return err
+		}
+		oc.APIKey = ""
+		oc.APIKeyCmd = ""
+		oc.APIKeyRef = secret.KeychainPrefix + account
+	} else {
+		oc.APIKey = key
+	}
+	return config.SaveOpenCodeConfig(oc)
+}
+
+func runApikeyList(ctx context.Context) error {
+	endpoint, token, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+
+	client := apikey.NewClient(endpoint, token)
+	resp, err := client.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list API keys: %w", err)
+	}
+
+	if len(resp.Keys) == 0 {
+		fmt.Println("No API keys found.")
+		fmt.Println("Create one with: opencode-auth apikey create -d \"my key\"")
+		return nil
+	}
+
+	fmt.Printf("%-12s %-10s %-25s %-25s %-25s %s\n", "PREFIX", "STATUS", "CREATED", "EXPIRES", "LAST USED", "DESCRIPTION")
+	fmt.Println("---------- -------- ----------------------- ----------------------- ----------------------- -----------")
+	for _, k := range resp.Keys {
+		lastUsed := "never"
+		if k.LastUsedAt != nil {
+			lastUsed = *k.LastUsedAt
+		}
+		// Truncate ISO timestamps for display
+		created := truncateTimestamp(k.CreatedAt)
+		expires := truncateTimestamp(k.ExpiresAt)
+		if lastUsed != "never" {
+			lastUsed = truncateTimestamp(lastUsed)
+		}
+		fmt.Printf("%-12s %-10s %-25s %-25s %-25s %s\n", k.KeyPrefix, k.Status, created, expires, lastUsed, k.Description)
+	}
+
+	return nil
+}
+
+func runApikeyShow(ctx context.Context, keyPrefix string, asJSON bool) error {
+	endpoint, token, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+
+	client := apikey.NewClient(endpoint, token)
+	key, err := client.Get(ctx, keyPrefix)
+	if errors.Is(err, apikey.ErrNotFound) {
+		return fmt.Errorf("no API key %s among yours (see 'opencode-auth apikey list')", keyPrefix)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(key)
+	}
+
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	expires := truncateTimestamp(key.ExpiresAt)
+	if t, err := apikey.ParseTimestamp(key.ExpiresAt); err == nil {
+		if left := time.Until(t); left >= 48*time.Hour {
+			expires += fmt.Sprintf(" (in %d days)", int(left.Hours()/24))
+		} else if left > 0 {
+			expires += fmt.Sprintf(" (in %s)", left.Round(time.Minute))
+		} else {
+			expires += " (expired)"
+		}
+	}
+	lastUsed := "never"
+	if key.LastUsedAt != nil {
+		lastUsed = truncateTimestamp(*key.LastUsedAt)
+		if key.LastUsedIP != "" {
+			lastUsed += " from " + key.LastUsedIP
+		}
+	}
+
+	fmt.Printf("Prefix:       %s\n", key.KeyPrefix)
+	fmt.Printf("Description:  %s\n", orDash(key.Description))
+	fmt.Printf("Status:       %s\n", key.Status)
+	if key.RevokedAt != nil {
+		fmt.Printf("Revoked:      %s\n", truncateTimestamp(*key.RevokedAt))
+	}
+	fmt.Printf("Created:      %s\n", truncateTimestamp(key.CreatedAt))
+	fmt.Printf("Created by:   %s\n", orDash(key.CreatedBy))
+	fmt.Printf("Created from: %s\n", orDash(key.CreatedIP))
+	fmt.Printf("Expires:      %s\n", expires)
+	fmt.Printf("Scopes:       %s\n", orDash(strings.Join(key.Scopes, ", ")))
+	if key.Project != "" {
+		fmt.Printf("Project:      %s\n", key.Project)
+	}
+	if key.FederatedIssuer != "" {
+		fmt.Printf("Issuer:       %s\n", key.FederatedIssuer)
+	}
+	fmt.Printf("Last used:    %s\n", lastUsed)
+	fmt.Printf("Requests:     %d\n", key.RequestCount)
+	return nil
+}
+
+func runApikeyRevoke(ctx context.Context, keyPrefix string) error {
+	endpoint, token, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+
+	client := apikey.NewClient(endpoint, token)
+	resp, err := client.Revoke(ctx, keyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "API key %s revoked successfully.\n", resp.KeyPrefix)
+	fmt.Fprintf(os.Stderr, "Note: Cached sessions may take up to 5 minutes to expire.\n")
+	return nil
+}
+
+func runApikeyRevokeMany(ctx context.Context, selector apikey.Selector, dryRun bool, concurrency int) error {
+	endpoint, token, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+
+	client := apikey.NewClient(endpoint, token)
+	resp, err := client.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list API keys: %w", err)
+	}
+
+	selected := selector.Select(resp.Keys, time.Now())
+
+	// Explicit prefixes that don't match an active key are reported, not silently skipped
+	found := make(map[string]bool, len(selected))
+	for _, k := range selected {
+		found[k.KeyPrefix] = true
+	}
+	var missing []string
+	for _, p := range selector.Prefixes {
+		if !found[p] {
+			missing = append(missing, p)
+		}
+	}
+
+	if len(selected) == 0 {
+		fmt.Println("No matching API keys to revoke.")
+		for _, p := range missing {
+			fmt.Printf("  %s: not found or already revoked\n", p)
+		}
+		return nil
+	}
+
+	if dryRun {
+		fmt.Printf("Would revoke %d key(s):\n\n", len(selected))
+		fmt.Printf("%-12s %-18s %-18s %s\n", "PREFIX", "CREATED", "EXPIRES", "DESCRIPTION")
+		for _, k := range selected {
+			fmt.Printf("%-12s %-18s %-18s %s\n", k.KeyPrefix, truncateTimestamp(k.CreatedAt), truncateTimestamp(k.ExpiresAt), k.Description)
+		}
+		for _, p := range missing {
+			fmt.Printf("%-12s (not found or already revoked)\n", p)
+		}
+		return nil
+	}
+
+	prefixes := make([]string, len(selected))
+	descriptions := make(map[string]string, len(selected))
+	for i, k := range selected {
+		prefixes[i] = k.KeyPrefix
+		descriptions[k.KeyPrefix] = k.Description
+	}
+
+	results := client.RevokeMany(ctx, prefixes, concurrency)
+
+	failed := 0
+	fmt.Printf("%-12s %-10s %s\n", "PREFIX", "RESULT", "DETAIL")
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("%-12s %-10s %v\n", r.KeyPrefix, "failed", r.Err)
+		} else {
+			fmt.Printf("%-12s %-10s %s\n", r.KeyPrefix, "revoked", descriptions[r.KeyPrefix])
+		}
+	}
+	for _, p := range missing {
+		fmt.Printf("%-12s %-10s %s\n", p, "skipped", "not found or already revoked")
+	}
+
+	fmt.Printf("\nRevoked %d of %d key(s).\n", len(results)-failed, len(results))
+	fmt.Fprintf(os.Stderr, "Note: Cached sessions may take up to 5 minutes to expire.\n")
+	if failed > 0 {
+		return fmt.Errorf("%d revocation(s) failed", failed)
+	}
+	return nil
+}
+
+func truncateTimestamp(ts string) string {
+	t, err := apikey.ParseTimestamp(ts)
+	if err != nil {
+		return ts
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func deviceCmd() *cobra.Command {
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "device",
+		Short: "Manage this machine's identity for device posture checks",
+		Long: `Manages the key pair that identifies this machine to the router.
+
+The installer creates the key pair in ~/.opencode/device.json, and 'oc'
+registers its public key after your first login. From then on the proxy signs
+an X-Device-Assertion header on each request with the private key. A router
+that enforces device posture refuses requests without a valid assertion from a
+registered device.
+
+Where the machine has a TPM 2.0 (Linux and Windows), the private key is
+created inside it and never leaves it. Elsewhere, including every Mac, the key
+is a software key stored in device.json: anyone with a copy of that file can
+sign as this device. 'device status' shows which one this machine has.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			cobra.OnFinalize(cancel)
+			cmd.SetContext(ctx)
+		},
+	}
+
+	cmd.PersistentFlags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for device requests")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "init",
+		Short: "Create this machine's key pair without registering it",
+		Long: `Creates ~/.opencode/device.json if it does not exist. Nothing is sent to the
+router; 'oc' registers the key after the next login. The installer runs this.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDeviceInit()
+		},
+	})
+
+	var name string
+	register := &cobra.Command{
+		Use:   "register",
+		Short: "Register this machine's public key with the router",
+		Long: `Registers this machine's public key with the router, creating the key pair
+first if needed. Running it again for a registered device is harmless.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDeviceRegister(cmd.Context(), name)
+		},
+	}
+	register.Flags().StringVar(&name, "name", "", "Name shown in 'device list' (default: the hostname)")
+	cmd.AddCommand(register)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rotate",
+		Short: "Replace this machine's key pair",
+		Long: `Creates a new key pair for this device and registers it in place of the old
+one. The device ID stays the same. The old key is kept until the router has
+accepted the new one, and the running proxy switches to the new key on its
+next request.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDeviceRotate(cmd.Context())
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "deregister [device-id]",
+		Short: "Remove a device from the router",
+		Long: `Deregisters this machine, or the device with the given ID (see 'device list'),
+such as a lost laptop. Deregistering this machine also deletes its key pair;
+run 'device register' to enroll it again.
+
+Deregistered devices are refused within 5 minutes (due to caching).`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			deviceID := ""
+			if len(args) == 1 {
+				deviceID = args[0]
+			}
+			return runDeviceDeregister(cmd.Context(), deviceID)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List your registered devices",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDeviceList(cmd.Context())
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show this machine's device identity",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDeviceStatus()
+		},
+	})
+
+	return cmd
+}
+
+func runDeviceInit() error {
+	// Only for device_key_store; the installer runs this before signing in
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+	if id, err := device.Load(cfg.ConfigDir); err == nil {
+		fmt.Printf("This machine already has a device identity (%s)\n", id.DeviceID)
+		return nil
+	} else if !errors.Is(err, device.ErrNoIdentity) {
+		return err
+	}
+	id, err := device.Generate("", cfg.DeviceKeyStore)
+	if err != nil {
+		return err
+	}
+	if err := device.Save(cfg.ConfigDir, id); err != nil {
+		return err
+	}
+	fmt.Printf("Created device identity %s in %s (key store: %s)\n", id.DeviceID, device.Path(cfg.ConfigDir), id.Store())
+	if !id.HardwareBound() {
+		fmt.Println("The private key is a software key in that file; it is not hardware-bound.")
+	}
+	return nil
+}
+
+// registerDevice registers id's public key through the proxy at endpoint,
+// which adds the user's JWT, and saves id as registered.
+func registerDevice(ctx context.Context, endpoint string, id *device.Identity, name string) (*device.Device, error) {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	dev, err := device.NewClient(endpoint, "").Register(ctx, device.RegisterRequest{
+		DeviceID:  id.DeviceID,
+		PublicKey: id.PublicJWK(),
+		Name:      name,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register device: %w", err)
+	}
+	now := time.Now().UTC()
+	id.RegisteredAt = &now
+	if err := device.Save(cfg.ConfigDir, id); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// registerDeviceIfNeeded registers a key pair the installer created but that
+// was never registered. Failures only warn: posture checks may be off.
+func registerDeviceIfNeeded(ctx context.Context, proxyURL string) {
+	id, err := device.Load(cfg.ConfigDir)
+	if err != nil || id.Registered() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := registerDevice(ctx, proxyURL, id, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v (retry with 'opencode-auth device register')\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Registered this device (%s)\n", id.DeviceID)
+}
+
+func runDeviceRegister(ctx context.Context, name string) error {
+	endpoint, _, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+	id, err := device.Load(cfg.ConfigDir)
+	if errors.Is(err, device.ErrNoIdentity) {
+		id, err = device.Generate("", cfg.DeviceKeyStore)
+	}
+	if err != nil {
+		return err
+	}
+	dev, err := registerDevice(ctx, endpoint, id, name)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Device registered")
+	fmt.Printf("  ID:          %s\n", dev.DeviceID)
+	fmt.Printf("  Name:        %s\n", dev.Name)
+	fmt.Printf("  Thumbprint:  %s\n", id.Thumbprint())
+	return nil
+}
+
+func runDeviceRotate(ctx context.Context) error {
+	endpoint, _, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+	old, err := device.Load(cfg.ConfigDir)
+	if errors.Is(err, device.ErrNoIdentity) {
+		return fmt.Errorf("%w; run 'opencode-auth device register' first", err)
+	}
+	if err != nil {
+		return err
+	}
+	id, err := device.Generate(old.DeviceID, cfg.DeviceKeyStore)
+	if err != nil {
+		return err
+	}
+	id.CreatedAt = old.CreatedAt
+	rotated := time.Now().UTC()
+	id.RotatedAt = &rotated
+	// device.json keeps the old key until the router has the new one
+	if _, err := registerDevice(ctx, endpoint, id, ""); err != nil {
+		id.DeleteKey()
+		return err
+	}
+	if err := old.DeleteKey(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to delete the old key from the %s: %v\n", old.Store(), err)
+	}
+	fmt.Printf("Rotated the key for device %s\n", id.DeviceID)
+	fmt.Printf("  Old thumbprint:  %s\n", old.Thumbprint())
+	fmt.Printf("  New thumbprint:  %s\n", id.Thumbprint())
+	return nil
+}
+
+func runDeviceDeregister(ctx context.Context, deviceID string) error {
+	endpoint, _, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+	local, err := device.Load(cfg.ConfigDir)
+	if err != nil && !errors.Is(err, device.ErrNoIdentity) {
+		return err
+	}
+	if deviceID == "" {
+		if local == nil {
+			return fmt.Errorf("this machine has no device identity; pass the ID of the device to deregister")
+		}
+		deviceID = local.DeviceID
+	}
+
+	err = device.NewClient(endpoint, "").Deregister(ctx, deviceID)
+	isLocal := local != nil && local.DeviceID == deviceID
+	// A device the router no longer knows can still be removed here
+	if err != nil && !(isLocal && errors.Is(err, apikey.ErrNotFound)) {
+		return fmt.Errorf("failed to deregister device: %w", err)
+	}
+	if isLocal {
+		if err := device.Remove(cfg.ConfigDir); err != nil {
+			return err
+		}
+		fmt.Printf("Deregistered this device (%s) and deleted its key pair\n", deviceID)
+	} else {
+		fmt.Printf("Deregistered device %s\n", deviceID)
+	}
+	fmt.Fprintf(os.Stderr, "Note: The router may accept the device for up to 5 more minutes.\n")
+	return nil
+}
+
+func runDeviceList(ctx context.Context) error {
+	endpoint, _, err := loadConfigAndToken()
+	if err != nil {
+		return err
+	}
+	resp, err := device.NewClient(endpoint, "").List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list devices: %w", err)
+	}
+	if len(resp.Devices) == 0 {
+		fmt.Println("No registered devices.")
+		fmt.Println("Register this one with: opencode-auth device register")
+		return nil
+	}
+
+	localID := ""
+	if id, err := device.Load(cfg.ConfigDir); err == nil {
+		localID = id.DeviceID
+	}
+	fmt.Printf("%-28s %-13s %-18s %-18s %-18s %s\n", "DEVICE", "STATUS", "REGISTERED", "LAST SEEN", "PLATFORM", "NAME")
+	for _, d := range resp.Devices {
+		lastSeen := "never"
+		if d.LastSeenAt != nil {
+			lastSeen = truncateTimestamp(*d.LastSeenAt)
+		}
+		name := d.Name
+		if d.DeviceID == localID {
+			name += " (this machine)"
+		}
+		fmt.Printf("%-28s %-13s %-18s %-18s %-18s %s\n", d.DeviceID, d.Status, truncateTimestamp(d.CreatedAt), lastSeen, d.Platform, name)
+	}
+	return nil
+}
+
+func runDeviceStatus() error {
+	id, err := device.Load(cfg.ConfigDir)
+	if errors.Is(err, device.ErrNoIdentity) {
+		fmt.Println("This machine has no device identity.")
+		fmt.Println("Create and register one with: opencode-auth device register")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device ID:   %s\n", id.DeviceID)
+	fmt.Printf("Thumbprint:  %s\n", id.Thumbprint())
+	if id.HardwareBound() {
+		fmt.Printf("Key store:   %s (hardware-bound)\n", id.Store())
+	} else {
+		fmt.Printf("Key store:   %s (not hardware-bound; a copy of %s can sign as this device)\n", id.Store(), device.Path(cfg.ConfigDir))
+	}
+	fmt.Printf("Created:     %s\n", id.CreatedAt.Local().Format("2006-01-02 15:04"))
+	if id.RotatedAt != nil {
+		fmt.Printf("Rotated:     %s\n", id.RotatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	if id.Registered() {
+		fmt.Printf("Registered:  %s\n", id.RegisteredAt.Local().Format("2006-01-02 15:04"))
+	} else {
+		fmt.Println("Registered:  no (run 'opencode-auth device register')")
+	}
+	return nil
+}
+
+func proxyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Manage the authentication proxy server",
 		Long: `Manage the local authentication proxy server that handles token refresh.
 
-The proxy runs in the background and:
-- Intercepts API requests from opencode
-- Automatically adds authentication headers
-- Refreshes tokens before they expire (every 50 minutes)
+The proxy runs in the background and:
+- Intercepts API requests from opencode
+- Automatically adds authentication headers
+- Refreshes tokens before they expire (every 50 minutes)
+
+This enables seamless long-running sessions without 401 errors.`,
+	}
+
+	// Exported via the environment so the forked daemon inherits them
+	cmd.PersistentFlags().BoolVar(&cfg.NoPeerCheck, "no-peer-check", cfg.NoPeerCheck, "Allow any local process to use the proxy (debugging only)")
+	cmd.PersistentFlags().IntVar(&cfg.ProxyPort, "proxy-port", cfg.ProxyPort, fmt.Sprintf("Proxy port (default %d, or set OPENCODE_PROXY_PORT)", config.DefaultProxyPort))
+	cmd.PersistentFlags().DurationVar(&cfg.RefreshThreshold, "refresh-threshold", cfg.RefreshThreshold, "Refresh tokens this long before expiry (default 50m, or set PROXY_REFRESH_THRESHOLD)")
+	cmd.PersistentFlags().DurationVar(&cfg.CheckInterval, "check-interval", cfg.CheckInterval, "How often to check token expiry (default 2m, or set PROXY_CHECK_INTERVAL)")
+	cmd.PersistentFlags().DurationVar(&cfg.HTTPTimeout, "http-timeout", cfg.HTTPTimeout, "Upstream response header timeout (default 30s, or set OPENCODE_HTTP_TIMEOUT)")
+	cmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if cfg.NoPeerCheck {
+			os.Setenv("OPENCODE_AUTH_NO_PEER_CHECK", "1")
+		}
+		if cfg.ProxyPort > 0 {
+			os.Setenv("OPENCODE_PROXY_PORT", strconv.Itoa(cfg.ProxyPort))
+		}
+		if cfg.RefreshThreshold > 0 {
+			os.Setenv("PROXY_REFRESH_THRESHOLD", cfg.RefreshThreshold.String())
+		}
+		if cfg.CheckInterval > 0 {
+			os.Setenv("PROXY_CHECK_INTERVAL", cfg.CheckInterval.String())
+		}
+		if cfg.HTTPTimeout > 0 {
+			os.Setenv("OPENCODE_HTTP_TIMEOUT", cfg.HTTPTimeout.String())
+		}
+	}
+
+	cmd.AddCommand(proxyStartCmd())
+	cmd.AddCommand(proxyStopCmd())
+	cmd.AddCommand(proxyRestartCmd())
+	cmd.AddCommand(proxyStatusCmd())
+	cmd.AddCommand(proxyReauthCmd())
+	cmd.AddCommand(proxySimulateExpiryCmd())
+	cmd.AddCommand(proxyHistoryCmd())
+	cmd.AddCommand(proxyExperimentsCmd())
+	cmd.AddCommand(proxyTapCmd())
+	cmd.AddCommand(proxyFaultsCmd())
+	cmd.AddCommand(proxyInstallServiceCmd())
+	cmd.AddCommand(proxyUninstallServiceCmd())
+	cmd.AddCommand(proxyRunServiceCmd())
+
+	return cmd
+}
+
+func proxyStartCmd() *cobra.Command {
+	var foreground bool
+
+	cmd := &cobra.Command{
+		Use:   "start",
+		Short: "Start the authentication proxy",
+		Long: `Starts the local authentication proxy server if not already running.
+
+By default, the proxy runs in the background. Use --foreground to run in the current terminal.`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if foreground {
+				// A background proxy tells 'proxy start' or 'oc', which
+				// wait for it, whether it came up
+				defer func() { proxy.ReportStartup(err) }()
+			}
+
+			// Load config
+			openCodeConfig, err := config.LoadOpenCodeConfig()
+			if err != nil {
+				proxy.ReportStartup(fmt.Errorf("%w: %v", proxy.ErrConfigInvalid, err))
+				return fmt.Errorf("failed to load config: %w\nRun the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash", err)
+			}
+			applyOpenCodeConfig(cfg, openCodeConfig)
+			if err := cfg.DiscoverEndpoints(cmd.Context()); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+			}
+
+			// Check if already running, unless this is its replacement
+			if proxyURL, err := proxy.GetProxyURL(cfg); err == nil && !proxy.InheritsListener() {
+				fmt.Fprintf(os.Stderr, "Proxy already running at %s\n", proxyURL)
+				proxy.ReportStartup(fmt.Errorf("%w at %s", proxy.ErrAlreadyRunning, proxyURL))
+				return nil
+			}
+
+			if foreground {
+				// Run in current process (blocking)
+				fmt.Fprintf(os.Stderr, "Starting authentication proxy...\n")
+				server, err := proxy.NewServer(cfg)
+				if err != nil {
+					return fmt.Errorf("failed to create proxy server: %w", err)
+				}
+
+				if err := server.Start(); err != nil {
+					return fmt.Errorf("failed to start proxy: %w", err)
+				}
+				proxy.ReportStartup(nil)
+
+				fmt.Fprintf(os.Stderr, "Proxy started successfully!\n")
+				fmt.Fprintf(os.Stderr, "  Port: %d\n", server.Port())
+				fmt.Fprintf(os.Stderr, "  PID: %d\n", os.Getpid())
+				fmt.Fprintf(os.Stderr, "  Target: %s\n", cfg.APIEndpoint)
+				fmt.Fprintf(os.Stderr, "\nUse 'opencode-auth proxy status' to check status\n")
+				fmt.Fprintf(os.Stderr, "Use 'opencode-auth proxy stop' to stop the proxy\n")
+				fmt.Fprintf(os.Stderr, "\nRunning in foreground mode. Press Ctrl+C to stop.\n")
+				return waitProxy(cmd.Context(), server)
+			}
+
+			// Background mode - fork a new process
+			proxyConfig, err := proxy.StartProxy(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to start proxy: %w", err)
+			}
+
+			fmt.Fprintf(os.Stderr, "Proxy started successfully!\n")
+			fmt.Fprintf(os.Stderr, "  Port: %d\n", proxyConfig.Port)
+			fmt.Fprintf(os.Stderr, "  PID: %d\n", proxyConfig.PID)
+			fmt.Fprintf(os.Stderr, "  Target: %s\n", proxyConfig.TargetURL)
+			fmt.Fprintf(os.Stderr, "\nUse 'opencode-auth proxy status' to check status\n")
+			fmt.Fprintf(os.Stderr, "Use 'opencode-auth proxy stop' to stop the proxy\n")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&foreground, "foreground", false, "Run proxy in foreground (don't detach)")
+
+	return cmd
+}
+
+// waitProxy blocks until the proxy is interrupted or has handed over to a
+// replacement, then shuts it down cleanly. When its watchdog asks for a
+// restart instead, a daemon starts its replacement; a proxy run in a
+// terminal just exits.
+func waitProxy(ctx context.Context, server *proxy.Server) error {
+	select {
+	case <-ctx.Done():
+		return server.Stop()
+	case <-server.HandedOver():
+		return server.Stop()
+	case <-server.RestartRequested():
+	}
+	if os.Getenv("OPENCODE_AUTH_PROXY_DAEMON") == "1" {
+		pid, err := server.Handover()
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Replacement proxy started (PID %d)\n", pid)
+			return server.Stop()
+		}
+		fmt.Fprintf(os.Stderr, "[proxy] Handover failed, restarting: %v\n", err)
+	}
+	if err := server.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: %v\n", err)
+	}
+	if os.Getenv("OPENCODE_AUTH_PROXY_DAEMON") != "1" {
+		return fmt.Errorf("proxy stopped by its watchdog")
+	}
+	proxyConfig, err := proxy.StartProxy(cfg)
+	if err != nil {
+		return fmt.Errorf("starting a replacement proxy: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Replacement proxy started (PID %d)\n", proxyConfig.PID)
+	return nil
+}
+
+func proxyInstallServiceCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "install-service",
+		Short: "Run the proxy as a Windows service",
+		Long: `Installs the proxy as a Windows service that starts with the machine.
+
+A background proxy started from a console stops when the console closes. The
+service keeps running instead; 'proxy start', 'proxy stop', 'proxy restart',
+and 'oc' use it once it is installed. Starts, stops, and failures are written
+to the Application event log, and proxy output to ~/.opencode/proxy.log.
+
+Run from an elevated prompt, as the user whose ~/.opencode the proxy should use.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The service takes over the port from a console-started proxy
+			if err := proxy.StopProxy(cfg); err == nil {
+				fmt.Fprintf(os.Stderr, "Stopped the running proxy\n")
+			}
+			if err := proxy.InstallService(cfg); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Installed service %s\n", proxy.ServiceName)
+
+			proxyConfig, err := proxy.StartProxy(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to start proxy service: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "Proxy service started on port %d\n", proxyConfig.Port)
+			return nil
+		},
+	}
+}
+
+func proxyUninstallServiceCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "uninstall-service",
+		Short: "Remove the proxy's Windows service",
+		Long: `Stops and removes the service added by 'proxy install-service'. The proxy
+is then started in the background again as needed.
+
+Run from an elevated prompt.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := proxy.UninstallService(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Removed service %s\n", proxy.ServiceName)
+			return nil
+		},
+	}
+}
+
+// proxyRunServiceCmd is the entry point the service manager starts.
+func proxyRunServiceCmd() *cobra.Command {
+	var home string
+
+	cmd := &cobra.Command{
+		Use:    "run-service",
+		Short:  "Run the proxy under the Windows service manager",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Services run outside the user's profile; use the installer's
+			if home != "" {
+				os.Setenv("USERPROFILE", home)
+				os.Setenv("HOME", home)
+				fresh := config.DefaultConfig()
+				cfg.ConfigDir, cfg.TokenPath = fresh.ConfigDir, fresh.TokenPath
+			}
+			return proxy.RunService(cfg, func() (*proxy.Server, error) {
+				openCodeConfig, err := config.LoadOpenCodeConfig()
+				if err != nil {
+					return nil, fmt.Errorf("failed to load config: %w", err)
+				}
+				applyOpenCodeConfig(cfg, openCodeConfig)
+				if err := cfg.DiscoverEndpoints(context.Background()); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+				}
+				return proxy.NewServer(cfg)
+			})
+		},
+	}
+
+	cmd.Flags().StringVar(&home, "home", "", "Home directory holding .opencode")
+
+	return cmd
+}
+
+func proxyStopCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "stop",
+		Short: "Stop the authentication proxy",
+		Long:  `Stops the local authentication proxy server.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := proxy.StopProxy(cfg); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Proxy stopped successfully\n")
+			return nil
+		},
+	}
+}
+
+func proxyRestartCmd() *cobra.Command {
+	var foreground bool
+
+	cmd := &cobra.Command{
+		Use:   "restart",
+		Short: "Restart the authentication proxy",
+		Long: `Stops and restarts the local authentication proxy server.
+
+This is useful for applying updates or recovering from issues. A background
+proxy on macOS or Linux hands its socket to the new one and finishes the
+requests it is serving, so opencode sessions are not interrupted.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Sockets can't be handed to another process on Windows
+			if !foreground && runtime.GOOS != "windows" {
+				proxyConfig, err := proxy.HandoverProxy(cfg)
+				if err == nil {
+					fmt.Fprintf(os.Stderr, "Proxy restarted without dropping requests\n")
+					fmt.Fprintf(os.Stderr, "  Port: %d\n", proxyConfig.Port)
+					fmt.Fprintf(os.Stderr, "  PID: %d\n", proxyConfig.PID)
+					return nil
+				}
+				if !errors.Is(err, proxy.ErrNotRunning) {
+					fmt.Fprintf(os.Stderr, "Note: %v; stopping and starting instead\n", err)
+				}
+			}
+
+			// Stop if running
+			if err := proxy.StopProxy(cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "Note: %v\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Proxy stopped\n")
+			}
+
+			// Small delay to ensure port is released
+			time.Sleep(500 * time.Millisecond)
+
+			// Load config
+			openCodeConfig, err := config.LoadOpenCodeConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w\nRun the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash", err)
+			}
+			applyOpenCodeConfig(cfg, openCodeConfig)
+			if err := cfg.DiscoverEndpoints(cmd.Context()); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+			}
+
+			if foreground {
+				// Run in current process (blocking)
+				fmt.Fprintf(os.Stderr, "Starting authentication proxy...\n")
+				server, err := proxy.NewServer(cfg)
+				if err != nil {
+					return fmt.Errorf("failed to create proxy server: %w", err)
+				}
+
+				if err := server.Start(); err != nil {
+					return fmt.Errorf("failed to start proxy: %w", err)
+				}
+
+				fmt.Fprintf(os.Stderr, "Proxy restarted successfully!\n")
+				fmt.Fprintf(os.Stderr, "  Port: %d\n", server.Port())
+				fmt.Fprintf(os.Stderr, "  PID: %d\n", os.Getpid())
+				fmt.Fprintf(os.Stderr, "  Target: %s\n", cfg.APIEndpoint)
+				fmt.Fprintf(os.Stderr, "\nRunning in foreground mode. Press Ctrl+C to stop.\n")
+				return waitProxy(cmd.Context(), server)
+			}
+
+			// Background mode - fork a new process
+			proxyConfig, err := proxy.StartProxy(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to start proxy: %w", err)
+			}
+
+			fmt.Fprintf(os.Stderr, "Proxy restarted successfully!\n")
+			fmt.Fprintf(os.Stderr, "  Port: %d\n", proxyConfig.Port)
+			fmt.Fprintf(os.Stderr, "  PID: %d\n", proxyConfig.PID)
+			fmt.Fprintf(os.Stderr, "  Target: %s\n", proxyConfig.TargetURL)
+			fmt.Fprintf(os.Stderr, "\nUse 'opencode-auth proxy status' to check status\n")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&foreground, "foreground", false, "Run proxy in foreground (don't detach)")
+
+	return cmd
+}
+
+func proxyStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show proxy status",
+		Long:  `Displays the current status of the authentication proxy server.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := proxy.StatusProxy(cfg)
+			if err != nil {
+				return err
+			}
+
+			// Pretty print the status
+			jsonData, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(jsonData))
+			return nil
+		},
+	}
+}
+
+func proxyReauthCmd() *cobra.Command {
+	var cont bool
+
+	cmd := &cobra.Command{
+		Use:   "reauth",
+		Short: "Force re-authentication",
+		Long: `Forces the proxy to re-authenticate immediately.
+
+This is useful if you want to refresh your session proactively or if
+automatic re-authentication failed and you want to retry manually.
+
+When the session expires, the proxy does not open a browser on its own right
+away: it shows a desktop notification and waits. --continue opens the browser
+to sign in and waits for it to finish. Clicking the notification does the
+same. Otherwise the browser opens after proxy_reauth_auto_open (default 2m,
+or "never").`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cont {
+				return runProxyReauthContinue(cmd.Context())
+			}
+
+			// Check if proxy is running
+			proxyConfig, err := proxy.LoadProxyConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("%w: %w", proxy.ErrNotRunning, err)
+			}
+
+			if !proxy.IsProcessRunning(proxyConfig.PID) {
+				return proxy.ErrNotRunning
+			}
+
+			fmt.Fprintf(os.Stderr, "Triggering proxy re-authentication...\n")
+
+			// Stop and restart proxy to trigger re-auth
+			if err := proxy.StopProxy(cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to stop proxy: %v\n", err)
+			}
+
+			time.Sleep(500 * time.Millisecond)
+
+			// Load config before starting
+			openCodeConfig, err := config.LoadOpenCodeConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w\nRun the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash", err)
+			}
+			applyOpenCodeConfig(cfg, openCodeConfig)
+			if err := cfg.DiscoverEndpoints(cmd.Context()); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+			}
+
+			newConfig, err := proxy.StartProxy(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to restart proxy: %w", err)
+			}
+
+			fmt.Fprintf(os.Stderr, "Proxy restarted. PID: %d\n", newConfig.PID)
+			fmt.Fprintf(os.Stderr, "The proxy will re-authenticate on next token check.\n")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&cont, "continue", false, "Open the browser for a re-authentication waiting on consent")
+
+	return cmd
+}
+
+// runProxyReauthContinue lets a pending re-authentication open the browser
+// and waits for the sign-in to finish.
+func runProxyReauthContinue(ctx context.Context) error {
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", proxyURL+"/api/reauth/continue", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach proxy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%s; run 'opencode-auth proxy reauth' to sign in again anyway", errResp.Error)
+		}
+		return fmt.Errorf("proxy returned %s: %s (restart it if it predates reauth --continue)", resp.Status, errResp.Error)
+	}
+
+	fmt.Fprintf(os.Stderr, "Opening the browser to sign in...\n")
+	if err := proxyctl.WaitForReauth(ctx, proxyURL, proxy.ReauthTimeout+30*time.Second); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Signed in.\n")
+	return nil
+}
+
+func proxyFaultsCmd() *cobra.Command {
+	var status, afterBytes int
+	var latency, ttl time.Duration
+	var drop, clear bool
+	var percent float64
+	var path string
+
+	cmd := &cobra.Command{
+		Use:   "faults",
+		Short: "Inject upstream errors, latency, or dropped streams",
+		Long: `Makes the running proxy fail a share of requests on purpose, so opencode's
+handling of upstream errors can be tested without touching the real router:
+
+  --status 429     answer with this status instead of forwarding
+  --latency 3s     wait before forwarding
+  --drop           cut the connection partway through the response
+
+Several can be combined; each applies to --percent of the requests whose path
+starts with --path. The faults replace any active ones and end after --for
+(default 15m), when the proxy restarts, or with --clear. Without flags, shows
+the active faults and how many requests each has affected.
+
+The proxy only accepts this command with the admin token it writes to
+proxy.json, so other local processes can't turn faults on.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var rules []proxy.FaultRule
+			base := proxy.FaultRule{Percent: percent, Path: path}
+			if cmd.Flags().Changed("status") {
+				rule := base
+				rule.Type, rule.Status = proxy.FaultStatus, status
+				rules = append(rules, rule)
+			}
+			if latency > 0 {
+				rule := base
+				rule.Type, rule.Delay = proxy.FaultLatency, latency.String()
+				rules = append(rules, rule)
+			}
+			if drop {
+				rule := base
+				rule.Type, rule.AfterBytes = proxy.FaultDrop, afterBytes
+				rules = append(rules, rule)
+			}
+
+			method, body := "GET", []byte(nil)
+			switch {
+			case clear:
+				method = "DELETE"
+			case len(rules) > 0:
+				method = "PUT"
+				body, _ = json.Marshal(proxy.SetFaultsRequest{Rules: rules, TTL: ttl.String()})
+			}
+			resp, err := proxyAdminRequest(cmd.Context(), method, "/api/admin/faults", body)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if clear {
+				var result struct {
+					Cleared bool `json:"cleared"`
+				}
+				json.NewDecoder(resp.Body).Decode(&result)
+				if result.Cleared {
+					fmt.Println("Faults cleared.")
+				} else {
+					fmt.Println("No faults were active.")
+				}
+				return nil
+			}
+
+			var faults proxy.Faults
+			if err := json.NewDecoder(resp.Body).Decode(&faults); err != nil {
+				return err
+			}
+			if len(faults.Rules) == 0 {
+				fmt.Println("No faults active.")
+				return nil
+			}
+			fmt.Printf("Faults active until %s:\n", faults.ExpiresAt.Local().Format("15:04:05"))
+			for _, rule := range faults.Rules {
+				fmt.Printf("  %s (%d injected)\n", rule, rule.Injected)
+			}
+			fmt.Printf("Watch it with: tail -f %s\n", proxy.LogPath(cfg))
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&status, "status", 0, "Answer with this HTTP status, e.g. 401, 429, 500")
+	cmd.Flags().DurationVar(&latency, "latency", 0, "Delay requests by this long before forwarding")
+	cmd.Flags().BoolVar(&drop, "drop", false, "Cut the connection partway through the response")
+	cmd.Flags().IntVar(&afterBytes, "after-bytes", 0, "With --drop, bytes of the response body sent before the cut")
+	cmd.Flags().Float64Var(&percent, "percent", 100, "Percentage of matching requests affected")
+	cmd.Flags().StringVar(&path, "path", "", "Only affect request paths starting with this, e.g. /v1/chat")
+	cmd.Flags().DurationVar(&ttl, "for", proxy.DefaultFaultTTL, "How long the faults stay active")
+	cmd.Flags().BoolVar(&clear, "clear", false, "Remove all faults")
+
+	return cmd
+}
+
+// proxyAdminRequest sends an /api/admin request to the running proxy with
+// the admin token from proxy.json. Non-200 responses are returned as errors.
+func proxyAdminRequest(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxyConfig, err := proxy.LoadProxyConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy config: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, proxyURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+proxyConfig.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		if proxyConfig.AdminToken == "" || resp.StatusCode == http.StatusNotFound {
+			errResp.Error += " (restart the proxy if it predates admin commands)"
+		}
+		return nil, fmt.Errorf("proxy returned %s: %s", resp.Status, errResp.Error)
+	}
+	return resp, nil
+}
+
+func proxySimulateExpiryCmd() *cobra.Command {
+	var in time.Duration
+	var failRefresh, clear bool
+
+	cmd := &cobra.Command{
+		Use:   "simulate-expiry",
+		Short: "Make the running proxy treat the token as expiring soon",
+		Long: `Tells the running proxy to treat the token as expiring after --in, so the
+refresh pipeline can be watched live in the proxy log without editing
+tokens.json or waiting for the real expiry. The token file is not changed.
+
+An expiry within the refresh threshold (default 50m) starts a refresh right
+away. With --fail-refresh the refresh fails with invalid_grant, which starts
+browser re-authentication. The simulation ends when a refresh or
+re-authentication succeeds, when the proxy restarts, or with --clear.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			method, body := "POST", []byte(nil)
+			if clear {
+				method = "DELETE"
+			} else {
+				body, _ = json.Marshal(proxy.SimulateExpiryRequest{In: in.String(), FailRefresh: failRefresh})
+			}
+			resp, err := proxyAdminRequest(cmd.Context(), method, "/api/admin/simulate-expiry", body)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if clear {
+				var result struct {
+					Ended bool `json:"ended"`
+				}
+				json.NewDecoder(resp.Body).Decode(&result)
+				if result.Ended {
+					fmt.Println("Simulation ended.")
+				} else {
+					fmt.Println("No simulation was running.")
+				}
+				return nil
+			}
+
+			var sim proxy.ExpirySimulation
+			if err := json.NewDecoder(resp.Body).Decode(&sim); err != nil {
+				return err
+			}
+			fmt.Printf("Proxy now treats the token as expiring at %s.\n", sim.ExpiresAt.Local().Format("15:04:05"))
+			if sim.FailRefresh {
+				fmt.Println("The next refresh will fail with invalid_grant and start re-authentication.")
+			}
+			fmt.Printf("Watch it with: tail -f %s\n", proxy.LogPath(cfg))
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&in, "in", 2*time.Minute, "Simulated time until expiry")
+	cmd.Flags().BoolVar(&failRefresh, "fail-refresh", false, "Fail the refresh with invalid_grant to exercise re-authentication")
+	cmd.Flags().BoolVar(&clear, "clear", false, "End a running simulation")
+
+	return cmd
+}
+
+func proxyHistoryCmd() *cobra.Command {
+	var failed, asJSON, clear bool
+	var limit int
+
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Show the last requests the proxy handled",
+		Long: fmt.Sprintf(`Lists recent requests the proxy handled: time, path, model, status,
+latency, and bytes sent and received. Use it to check whether a request
+reached the API at all without turning on debug logging. Bodies, headers,
+and query strings are not recorded here; 'proxy tap' shows the body of the
+newest streaming response.
+
+The proxy keeps the last %d requests in ~/.opencode/proxy-history.jsonl,
+also across restarts. History is off by default. Enable it with
+"proxy_history": true in ~/.opencode/config.json or OPENCODE_PROXY_HISTORY=1.
+
+An ERROR row means the proxy got no response from the API (DNS, connect,
+TLS, or timeout) and answered 502 itself.`, proxy.HistorySize),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := proxy.HistoryPath(cfg)
+			if clear {
+				if err := proxy.ClearHistory(path); err != nil {
+					return fmt.Errorf("failed to clear request history: %w", err)
+				}
+				fmt.Println("Request history cleared.")
+				return nil
+			}
+
+			entries, err := proxy.LoadHistory(path)
+			if err != nil {
+				return err
+			}
+			if failed {
+				kept := entries[:0]
+				for _, e := range entries {
+					if e.Failed() {
+						kept = append(kept, e)
+					}
+				}
+				entries = kept
+			}
+			if limit > 0 && len(entries) > limit {
+				entries = entries[len(entries)-limit:]
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(entries)
+			}
+			if len(entries) == 0 {
+				fmt.Printf("No requests recorded in %s.\n", path)
+				if !requestHistoryEnabled() {
+					fmt.Println("Request history is disabled; set \"proxy_history\": true in config.json to enable it.")
+				}
+				return nil
+			}
+
+			fmt.Printf("%-19s  %-6s %-28s %-24s %6s %8s  %s\n", "TIME", "METHOD", "PATH", "MODEL", "STATUS", "LATENCY", "SENT / RECEIVED")
+			for _, e := range entries {
+				status := strconv.Itoa(e.Status)
+				if e.Error != "" {
+					status = "ERROR"
+				}
+				fmt.Printf("%-19s  %-6s %-28s %-24s %6s %8s  %s / %s\n",
+					e.Time.Local().Format("2006-01-02 15:04:05"), e.Method, e.Path, orDefault(e.Model, "-"), status,
+					(time.Duration(e.LatencyMS) * time.Millisecond).String(), formatSize(e.BytesIn), formatSize(e.BytesOut))
+				if e.Error != "" {
+					fmt.Printf("  %s\n", e.Error)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&failed, "failed", false, "Only show requests that failed (no response, or status 400 and above)")
+	cmd.Flags().IntVarP(&limit, "limit", "n", 50, "Show at most this many of the newest requests (0 for all)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the entries as JSON")
+	cmd.Flags().BoolVar(&clear, "clear", false, "Delete the request history")
+
+	return cmd
+}
+
+func proxyExperimentsCmd() *cobra.Command {
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "experiments",
+		Short: "Show the stats of the running model experiments",
+		Long: `Shows each model experiment the proxy is running and, for both arms,
+the requests sent, the error rate, the average latency until the response
+headers, and the prompt and completion tokens of the completions that
+reported usage.
+
+An experiment sends a share of the chat completions for one model to a
+candidate model instead. Configure them with "proxy_experiments" in
+~/.opencode/config.json, for example:
+
+  "proxy_experiments": [
+    {"name": "haiku-trial", "model": "claude-sonnet", "candidate": "claude-haiku", "percent": 10}
+  ]
+
+Responses carry X-OpenCode-Experiment: <name>; arm=<control|candidate>.
+Stats are kept in memory; they start over when the proxy restarts or an
+experiment's settings change.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			proxyURL, err := proxy.GetProxyURL(cfg)
+			if err != nil {
+				return fmt.Errorf("proxy is not running: %w", err)
+			}
+			health, err := proxyctl.CheckHealth(cmd.Context(), proxyURL)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(health.Experiments)
+			}
+			if len(health.Experiments) == 0 {
+				fmt.Println("No model experiments running. Add them with \"proxy_experiments\" in config.json.")
+				return nil
+			}
+
+			for i, e := range health.Experiments {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("%s: %d%% of %s to %s, since %s\n", e.Name, e.Percent, e.Control.Model, e.Candidate.Model,
+					e.Since.Local().Format("2006-01-02 15:04"))
+				fmt.Printf("  %-9s %-24s %8s %7s %8s %12s %12s\n", "ARM", "MODEL", "REQUESTS", "ERRORS", "LATENCY", "PROMPT", "COMPLETION")
+				for _, arm := range []struct {
+					name string
+					a    proxy.ExperimentArm
+				}{{proxy.ArmControl, e.Control}, {proxy.ArmCandidate, e.Candidate}} {
+					fmt.Printf("  %-9s %-24s %8d %6.1f%% %8s %12s %12s\n", arm.name, arm.a.Model, arm.a.Requests, arm.a.ErrorRate*100,
+						(time.Duration(arm.a.AvgLatencyMS) * time.Millisecond).String(),
+						proxy.FormatTokens(arm.a.PromptTokens), proxy.FormatTokens(arm.a.CompletionTokens))
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the experiments as JSON")
+
+	return cmd
+}
+
+func proxyTapCmd() *cobra.Command {
+	var last, raw bool
+
+	cmd := &cobra.Command{
+		Use:   "tap",
+		Short: "Decode the most recent streaming response",
+		Long: `Shows the most recent streaming (SSE) response the proxy returned, one
+decoded chunk per line: content and reasoning deltas, tool calls, the finish
+reason, usage, and [DONE], each with the time since the response started.
+It ends with a summary that says whether the stream finished or was cut off,
+for "the model stops mid-answer" reports.
+
+Without --last, it waits for the next stream, or shows the one in progress
+from its start, and keeps following new streams until interrupted. With
+--last, it prints the stream captured last and exits.
+
+Streams are captured in ~/.opencode/proxy-stream.sse while request history
+is on ("proxy_history": true in ~/.opencode/config.json or
+OPENCODE_PROXY_HISTORY=1). Only the newest stream is kept, and only its
+first 4 MB. It holds the model's answer, so the file is readable by you only;
+'proxy history --clear' deletes it.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := proxy.StreamPath(cfg)
+			if !requestHistoryEnabled() {
+				fmt.Println("Request history is disabled, so no streams are captured; set \"proxy_history\": true in config.json to enable it.")
+				if !last {
+					return nil
+				}
+			}
+			if last {
+				p, events, err := proxy.ParseStream(path)
+				if errors.Is(err, os.ErrNotExist) {
+					fmt.Printf("No stream captured in %s.\n", path)
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if raw {
+					data, _ := os.ReadFile(path)
+					os.Stdout.Write(data)
+				}
+				printer := &streamPrinter{raw: raw}
+				printer.start(p.Info)
+				for _, ev := range events {
+					printer.event(ev)
+				}
+				printer.finish(p.End)
+				return nil
+			}
+			return followStream(cmd.Context(), path, raw)
+		},
+	}
+
+	cmd.Flags().BoolVar(&last, "last", false, "Print the last captured stream and exit instead of following")
+	cmd.Flags().BoolVar(&raw, "raw", false, "Print the SSE lines as received instead of decoding them")
+
+	return cmd
+}
+
+// requestHistoryEnabled reports whether the proxy records history, and so
+// captures streams.
+func requestHistoryEnabled() bool {
+	oc, err := config.LoadOpenCodeConfig()
+	return cfg.RequestHistory || (err == nil && oc.ProxyHistory)
+}
+
+// followStream prints captured streams as the proxy writes them, until ctx
+// ends. A capture that had already ended when following started is skipped.
+func followStream(ctx context.Context, path string, raw bool) error {
+	var (
+		f       *os.File
+		info    os.FileInfo
+		offset  int64
+		partial string
+		parser  *proxy.StreamParser
+		printer *streamPrinter
+		waiting bool
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	first := true
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// The proxy replaces the file for each new stream
+		if current, err := os.Stat(path); err == nil && (f == nil || !os.SameFile(info, current) || current.Size() < offset) {
+			if f != nil {
+				f.Close()
+			}
+			if f, err = os.Open(path); err == nil {
+				info, offset, partial = current, 0, ""
+				parser, printer = &proxy.StreamParser{}, &streamPrinter{raw: raw}
+				if p, _, err := proxy.ParseStream(path); first && err == nil && p.End != nil {
+					printer.done = true
+				} else {
+					waiting = false
+				}
+			}
+		}
+		first = false
+
+		if f != nil {
+			data, _ := io.ReadAll(f)
+			offset += int64(len(data))
+			lines := strings.Split(partial+string(data), "\n")
+			partial = lines[len(lines)-1]
+			for _, line := range lines[:len(lines)-1] {
+				line = strings.TrimSuffix(line, "\r")
+				ev := parser.Line(line)
+				if printer.done {
+					continue
+				}
+				if raw {
+					fmt.Println(line)
+				}
+				if !printer.started && parser.Info != nil {
+					printer.start(parser.Info)
+				}
+				if ev != nil {
+					printer.event(*ev)
+				}
+				if parser.End != nil {
+					printer.finish(parser.End)
+				}
+			}
+		}
+
+		if (f == nil || printer.done) && !waiting {
+			fmt.Println("Waiting for the next streaming response (Ctrl-C to stop)...")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamPrinter prints a captured stream's events and how it ended.
+type streamPrinter struct {
+	raw     bool
+	summary proxy.StreamSummary
+	started bool
+	done    bool
+}
+
+// start prints the stream's request; with raw output the first line of the
+// capture already shows it.
+func (p *streamPrinter) start(info *proxy.StreamInfo) {
+	p.started = true
+	if info == nil || p.raw {
+		return
+	}
+	fmt.Printf("Stream %s %s  model %s  status %d  started %s\n",
+		info.Method, info.Path, orDefault(info.Model, "-"), info.Status, info.Time.Local().Format("2006-01-02 15:04:05"))
+}
+
+// event prints one decoded event.
+func (p *streamPrinter) event(ev proxy.StreamEvent) {
+	chunk := p.summary.Add(ev)
+	if p.raw {
+		return
+	}
+	at := fmt.Sprintf("%+7.2fs", ev.At.Seconds())
+	switch {
+	case ev.Data == "[DONE]":
+		fmt.Printf("%s  [DONE]\n", at)
+		return
+	case chunk == nil:
+		if ev.Event != "" {
+			fmt.Printf("%s  event      %s: %s\n", at, ev.Event, ev.Data)
+		} else {
+			fmt.Printf("%s  data       %s\n", at, ev.Data)
+		}
+		return
+	}
+	if chunk.Error != nil {
+		fmt.Printf("%s  error      %s (%s)\n", at, chunk.Error.Message, orDefault(chunk.Error.Code, chunk.Error.Type))
+	}
+	for _, choice := range chunk.Choices {
+		d := choice.Delta
+		if d.Role != "" && d.Content == "" && len(d.ToolCalls) == 0 {
+			fmt.Printf("%s  role       %s\n", at, d.Role)
+		}
+		if d.ReasoningContent != "" {
+			fmt.Printf("%s  reasoning  %s\n", at, strconv.Quote(d.ReasoningContent))
+		}
+		if d.Content != "" {
+			fmt.Printf("%s  content    %s\n", at, strconv.Quote(d.Content))
+		}
+		for _, call := range d.ToolCalls {
+			if call.Function.Name != "" {
+				fmt.Printf("%s  tool_call  #%d %s %s\n", at, call.Index, call.Function.Name, call.ID)
+			}
+			if call.Function.Arguments != "" {
+				fmt.Printf("%s  tool_args  #%d %s\n", at, call.Index, call.Function.Arguments)
+			}
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			fmt.Printf("%s  finish     %s\n", at, *choice.FinishReason)
+		}
+	}
+	if u := chunk.Usage; u != nil {
+		fmt.Printf("%s  usage      %d prompt + %d completion = %d tokens\n", at, u.PromptTokens, u.CompletionTokens, u.TotalTokens)
+	}
+}
+
+// finish prints the summary, and the problems of a stream that ended.
+func (p *streamPrinter) finish(end *proxy.StreamEnd) {
+	p.done = true
+	s := p.summary
+	if end == nil {
+		fmt.Println("The proxy has not finished sending this stream (or stopped while sending it).")
+	} else {
+		fmt.Printf("Stream ended after %s, %s", (time.Duration(end.DurationMS) * time.Millisecond).String(), formatSize(end.Bytes))
+		if end.Truncated {
+			fmt.Print(" (only the start was captured)")
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d chunks, %d characters of content, %d tool calls, finish_reason %s, usage %s, [DONE] %s\n",
+		s.Chunks, s.Content, s.ToolCalls, orDefault(s.FinishReason, "none"), yesNo(s.Usage), yesNo(s.Done))
+	if end != nil {
+		for _, problem := range s.Problems() {
+			fmt.Printf("  ! %s\n", problem)
+		}
+	}
+	fmt.Println()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func doctorCmd() *cobra.Command {
+	var fix bool
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose common setup problems",
+		Long: `Runs local health checks (config, tokens, proxy, clock skew) and prints
+instructions for anything that needs fixing. Exits with code 1 if any check fails.
+
+Files in ~/.opencode are checked for damage: empty or truncated JSON, broken
+symlinks, and permissions wider than 0600. With --fix, damaged files are
+renamed to <name>.corrupt-<time> and restored from <name>.bak where one is
+valid, and permissions are tightened. Other commands make the same repairs
+when they start.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctor(cmd.Context(), fix)
+		},
+	}
+
+	cmd.Flags().BoolVar(&fix, "fix", false, "Repair damaged files in ~/.opencode")
+	cmd.AddCommand(doctorIdPCmd())
+
+	return cmd
+}
+
+func doctorIdPCmd() *cobra.Command {
+	var provider string
+
+	cmd := &cobra.Command{
+		Use:   "idp",
+		Short: "Check the identity provider's app client before the first login",
+		Long: `Checks that the identity provider accepts this client the way login uses it:
+the discovery metadata (PKCE with S256, scopes, grant types), an authorize
+request for each redirect URI login may use, built exactly as login builds it
+but never completed, and a token request with a dummy code, which a public
+client gets back as invalid_grant.
+
+A rejection is classified (redirect_mismatch, unauthorized_client,
+invalid_scope, invalid_client, pkce_unsupported) and printed with the fix for
+Cognito, Okta, or Entra ID. The provider is detected from the issuer; use
+--provider when it sits behind a custom domain. Exits with code 1 if any
+check fails.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctorIdP(cmd.Context(), provider)
+		},
+	}
+
+	cmd.Flags().StringVar(&provider, "provider", "", "Identity provider for the fix instructions: cognito, okta, or entra (default: detected)")
+
+	return cmd
+}
+
+func runDoctorIdP(ctx context.Context, provider string) error {
+	openCodeConfig, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	applyOpenCodeConfig(cfg, openCodeConfig)
+	if cfg.StaticAuth() {
+		return fmt.Errorf("auth_mode is static: there is no identity provider to check")
+	}
+
+	checker := idpcheck.New(cfg)
+	switch strings.ToLower(provider) {
+	case "":
+	case "cognito":
+		checker.Provider = idpcheck.ProviderCognito
+	case "okta":
+		checker.Provider = idpcheck.ProviderOkta
+	case "entra", "azure":
+		checker.Provider = idpcheck.ProviderEntra
+	default:
+		return fmt.Errorf("unknown provider %q: use cognito, okta, or entra", provider)
+	}
+
+	fmt.Printf("Client %s at %s\n", cfg.ClientID, cfg.Issuer)
+	failed := 0
+	for _, check := range checker.Run(ctx) {
+		if check.Level == "fail" {
+			failed++
+		}
+		detail := check.Detail
+		if check.Class != "" {
+			detail = fmt.Sprintf("%s [%s]", detail, check.Class)
+		}
+		fmt.Printf("[%-4s] %s: %s\n", check.Level, check.Name, detail)
+		if check.Fix != "" {
+			fmt.Printf("       Fix: %s\n", check.Fix)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+func runDoctor(ctx context.Context, fix bool) error {
+	failed := 0
+	report := func(level, format string, a ...interface{}) {
+		if level == "fail" {
+			failed++
+		}
+		fmt.Printf("[%-4s] %s\n", level, fmt.Sprintf(format, a...))
+	}
+
+	// State directory, which the other commands refuse to run without
+	if dir, err := config.CheckStateDir(); err != nil {
+		report("fail", "State directory: %v", err)
+	} else {
+		report("ok", "State directory: %s", dir)
+	}
+
+	// Config directory integrity, first so the checks below see the repairs
+	opts := integrity.Options{ConfigDir: cfg.ConfigDir}
+	if fix {
+		repairs, errs := integrity.Fix(opts)
+		for _, r := range repairs {
+			report("ok", "Repaired %s: %s", r.Problem, r.Action)
+		}
+		for _, err := range errs {
+			report("fail", "Repair failed: %v", err)
+		}
+	} else {
+		for _, p := range integrity.Check(opts) {
+			level := "fail"
+			if p.Kind == integrity.KindPermissions {
+				level = "warn"
+			}
+			report(level, "%s; run 'opencode-auth doctor --fix'", p)
+		}
+	}
+
+	// Config
+	openCodeConfig, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		report("fail", "Config: %v", err)
+	} else {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+		report("ok", "Config: %s", config.ConfigPath())
+	}
+
+	// Host overrides
+	if hosts, err := hostmap.New(cfg.HostOverrides); err != nil {
+		report("fail", "Host overrides: %v", err)
+	} else {
+		for _, o := range hosts.Overrides() {
+			checkHostOverride(ctx, hosts, o, report)
+		}
+	}
+
+	// Captive portal, which breaks everything below with TLS errors
+	if captive, portal, err := netcheck.Probe(ctx); err != nil {
+		report("warn", "Network: connectivity probe unanswered (%v); expected offline or where %s is blocked", err, netcheck.ProbeURL)
+	} else if captive && portal != "" {
+		report("fail", "Network: %v (%s)", netcheck.ErrCaptivePortal, portal)
+	} else if captive {
+		report("fail", "Network: %v", netcheck.ErrCaptivePortal)
+	} else {
+		report("ok", "Network: no captive portal")
+	}
+
+	// Tokens
+	if cfg.StaticAuth() {
+		if err := cfg.ResolveStaticToken(ctx); err != nil {
+			report("fail", "Tokens: %v", err)
+		} else {
+			report("ok", "Tokens: static token %s (auth_mode static)", proxy.StaticTokenPrefix(cfg.StaticToken))
+		}
+	} else if tokens, err := auth.LoadTokens(cfg.TokenPath); err != nil {
+		report("warn", "Tokens: not authenticated (run 'opencode-auth login')")
+	} else if tokens.IsExpired() {
+		report("warn", "Tokens: expired at %s", tokens.ExpiresAt.Local().Format(time.RFC822))
+	} else {
+		report("ok", "Tokens: valid for %s (%s)", tokens.Email, time.Until(tokens.ExpiresAt).Round(time.Second))
+	}
+
+	// Proxy
+	if proxyURL, err := proxy.GetProxyURL(cfg); err != nil {
+		report("warn", "Proxy: not running (%v)", err)
+	} else {
+		report("ok", "Proxy: running at %s", proxyURL)
+
+		// Refresher self-test: reaches the IdP without spending the refresh token
+		if cfg.StaticAuth() {
+			report("ok", "Refresher: not used, auth_mode is static")
+		} else if result, err := refresherSelfTest(ctx, proxyURL); err != nil {
+			report("warn", "Refresher: self-test unavailable (%v)", err)
+		} else {
+			for _, step := range result.Steps {
+				switch {
+				case step.Skipped:
+					report("warn", "Refresher %s: skipped, %s", step.Name, step.Detail)
+				case step.OK:
+					report("ok", "Refresher %s: %s (%s)", step.Name, step.Detail, step.Latency)
+				default:
+					report("fail", "Refresher %s: %s", step.Name, step.Detail)
+				}
+			}
+		}
+	}
+
+	// opencode executable
+	if resolved, err := findRealOpenCode(ctx); err != nil {
+		report("fail", "opencode: %v", err)
+	} else {
+		report("ok", "opencode: %s (%s)", resolved.Path, resolved.Version)
+	}
+
+	// Clock skew
+	if cfg.StaticAuth() {
+		report("ok", "Clock skew: not checked, auth_mode is static")
+	} else if endpoint := skewEndpoint(); endpoint == "" {
+		report("warn", "Clock skew: no issuer configured, skipped")
+	} else if skew, err := auth.MeasureClockSkew(ctx, endpoint); err != nil {
+		report("warn", "Clock skew: could not measure (%v)", err)
+	} else if warning, err := auth.CheckClockSkew(skew); err != nil {
+		report("fail", "Clock skew: %v", err)
+	} else if warning != "" {
+		report("warn", "Clock skew: %s", warning)
+	} else {
+		report("ok", "Clock skew: %s", skew.Round(time.Second))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// checkHostOverride reports which configured endpoints a host override
+// applies to, whether its target is reachable, and what DNS would answer.
+func checkHostOverride(ctx context.Context, hosts *hostmap.Map, o hostmap.Override, report func(level, format string, a ...interface{})) {
+	var used []string
+	port := "443"
+	for _, e := range []struct{ name, url string }{
+		{"api_endpoint", cfg.APIEndpoint},
+		{"issuer", cfg.Issuer},
+		{"authorize_endpoint", cfg.AuthorizeEndpoint},
+		{"token_endpoint", cfg.TokenEndpoint},
+	} {
+		if u, err := url.Parse(e.url); err == nil && strings.EqualFold(u.Hostname(), o.Host) {
+			used = append(used, e.name)
+			if u.Port() != "" {
+				port = u.Port()
+			} else if u.Scheme == "http" {
+				port = "80"
+			}
+		}
+	}
+	label := fmt.Sprintf("Host override %s -> %s", o.Host, o.Target)
+	if len(used) == 0 {
+		report("warn", "%s: no configured endpoint uses this host", label)
+		return
+	}
+	label += " (" + strings.Join(used, ", ") + ")"
+
+	dns := "DNS has no answer"
+	lookupCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	if addrs, err := net.DefaultResolver.LookupHost(lookupCtx, o.Host); err == nil {
+		dns = "DNS answers " + strings.Join(addrs, ", ")
+	}
+	cancel()
+
+	addr, _ := hosts.Rewrite(net.JoinHostPort(o.Host, port))
+	start := time.Now()
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		report("fail", "%s: %s unreachable (%v); %s", label, addr, err, dns)
+		return
+	}
+	conn.Close()
+	report("ok", "%s: %s reachable in %s; %s", label, addr, time.Since(start).Round(time.Millisecond), dns)
+}
+
+func smokeCmd() *cobra.Command {
+	var model string
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "smoke",
+		Short: "Run an end-to-end smoke test through the proxy",
+		Long: `Performs a full round trip to validate a deployment:
+
+  1. Validate the local token (or configured API key)
+  2. Check the proxy /health endpoint
+  3. Send a minimal streamed chat completion to a cheap model
+
+Each step's latency is printed. Exits with code 1 if any step fails.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runSmoke(ctx, model)
+		},
+	}
+
+	cmd.Flags().StringVar(&model, "model", smoke.DefaultModel, "Model alias for the completion step")
+	cmd.Flags().DurationVar(&timeout, "timeout", 60*time.Second, "Timeout for the whole smoke test")
+
+	return cmd
+}
+
+func runSmoke(ctx context.Context, model string) error {
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+
+	var proxyURL string
+	steps := []struct {
+		name string
+		fn   func() (string, error)
+	}{
+		{"Token", func() (string, error) {
+			if cfg.StaticAuth() {
+				if err := cfg.ResolveStaticToken(ctx); err != nil {
+					return "", err
+				}
+				return "static token " + proxy.StaticTokenPrefix(cfg.StaticToken), nil
+			}
+			if cfg.APIKey != "" || cfg.APIKeyRef != "" || cfg.APIKeyCmd != "" {
+				return "API key configured", nil
+			}
+			tokens, err := auth.LoadTokens(cfg.TokenPath)
+			if err != nil {
+				return "", fmt.Errorf("not authenticated: %w", err)
+			}
+			if tokens.IsExpired() {
+				return "", fmt.Errorf("token expired at %s", tokens.ExpiresAt.Local().Format(time.RFC822))
+			}
+			return fmt.Sprintf("%s, expires in %s", tokens.Email, time.Until(tokens.ExpiresAt).Round(time.Second)), nil
+		}},
+		{"Proxy health", func() (string, error) {
+			url, err := proxy.GetProxyURL(cfg)
+			if err != nil {
+				return "", err
+			}
+			proxyURL = url
+			return smoke.CheckHealth(ctx, proxyURL)
+		}},
+		{"Streamed completion", func() (string, error) {
+			return smoke.StreamCompletion(ctx, proxyURL, model)
+		}},
+	}
+
+	fmt.Printf("%-20s %-6s %10s  %s\n", "STEP", "RESULT", "LATENCY", "DETAIL")
+	failed := false
+	for _, st := range steps {
+		if failed {
+			fmt.Printf("%-20s %-6s %10s  %s\n", st.name, "skip", "-", "previous step failed")
+			continue
+		}
+		r := smoke.Step(st.name, st.fn)
+		if r.Err != nil {
+			failed = true
+			fmt.Printf("%-20s %-6s %10s  %v\n", r.Name, "FAIL", r.Duration.Round(time.Millisecond), r.Err)
+		} else {
+			fmt.Printf("%-20s %-6s %10s  %s\n", r.Name, "ok", r.Duration.Round(time.Millisecond), r.Detail)
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("smoke test failed")
+	}
+	fmt.Println("\nSmoke test passed.")
+	return nil
+}
+
+// repairConfigDir moves damaged files in the config directory aside,
+// restoring them from backups where possible, and says what it did.
+// initStateDir applies --state-dir, checks that the state directory can be
+// written, and repairs damaged files in it before any command reads them.
+// doctor reports both instead, and repairs files with --fix.
+// startTrace turns on the --trace log, on stderr or appended to
+// --trace-file.
+func startTrace(root *cobra.Command) error {
+	if !traceOn && traceFile == "" && os.Getenv("OPENCODE_TRACE") != "1" {
+		return nil
+	}
+	var w io.Writer = os.Stderr
+	if traceFile != "" {
+		f, err := os.OpenFile(traceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file: %w", err)
+		}
+		w = f
+	}
+	tracelog.Enable(w)
+	command := root.Name()
+	if c, _, err := root.Find(os.Args[1:]); err == nil {
+		command = c.CommandPath()
+	}
+	tracelog.Printf("%s: opencode-auth %s on %s/%s at %s", command, version, runtime.GOOS, runtime.GOARCH, time.Now().Format(time.RFC3339))
+	return nil
+}
+
+func initStateDir(root *cobra.Command) error {
+	if stateDir == "" {
+		stateDir = os.Getenv(config.StateDirEnv)
+	}
+	if stateDir != "" {
+		dir, err := filepath.Abs(stateDir)
+		if err != nil {
+			return err
+		}
+		// Exported, absolute, so the background proxy and other children
+		// use the same directory
+		os.Setenv(config.StateDirEnv, dir)
+		fresh := config.DefaultConfig()
+		cfg.ConfigDir, cfg.TokenPath = fresh.ConfigDir, fresh.TokenPath
+	}
+	c, _, err := root.Find(os.Args[1:])
+	if err == nil {
+		switch c.Name() {
+		case "doctor", "help", "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return nil
+		}
+	}
+	if _, err := config.CheckStateDir(); err != nil {
+		return err
+	}
+	repairConfigDir()
+	return nil
+}
+
+func repairConfigDir() {
+	repairs, errs := integrity.Fix(integrity.Options{ConfigDir: cfg.ConfigDir})
+	for _, r := range repairs {
+		fmt.Fprintf(os.Stderr, "Repaired %s: %s\n", r.Problem, r.Action)
+		if r.Path == cfg.TokenPath && r.Kind != integrity.KindPermissions && !r.Restored {
+			fmt.Fprintln(os.Stderr, "Run 'opencode-auth login' to sign in again.")
+		}
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Warning: repair failed: %v\n", err)
+	}
+}
+
+func cleanCmd() *cobra.Command {
+	var dryRun bool
+	var minAge time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Remove leftover temp files, stale locks, and old installer downloads",
+		Long: `Removes artifacts that interrupted commands leave behind:
+
+  *.tmp files in ~/.opencode from interrupted atomic writes
+  *.lock files in ~/.opencode that no process holds
+  opencode-installer-*.zip downloads in ~/.opencode/downloads
+  opencode-installer-*.zip and opencode-update-* in the temp directory
+
+Lock files are probed before removal and skipped if held. Config directory
+files must be older than 1h and temp directory files older than 24h;
+--min-age sets both. The background proxy runs the same cleanup when it
+starts.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := janitor.Options{ConfigDir: cfg.ConfigDir, MinAge: minAge, TempMinAge: minAge}
+			if dryRun {
+				found := janitor.Find(opts)
+				for _, a := range found {
+					fmt.Printf("Would remove %s (%s, %s, %s old)\n", a.Path, a.Kind, formatSize(a.Size), formatAge(a.Age))
+				}
+				if len(found) == 0 {
+					fmt.Println("Nothing to clean.")
+				}
+				return nil
+			}
+
+			removed, errs := janitor.Clean(opts)
+			var total int64
+			for _, a := range removed {
+				total += a.Size
+				fmt.Printf("Removed %s (%s, %s)\n", a.Path, a.Kind, formatSize(a.Size))
+			}
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			if len(removed) == 0 && len(errs) == 0 {
+				fmt.Println("Nothing to clean.")
+			} else if len(removed) > 0 {
+				fmt.Printf("Freed %s.\n", formatSize(total))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "List what would be removed without removing it")
+	cmd.Flags().DurationVar(&minAge, "min-age", 0, "Only remove artifacts older than this (default 1h in ~/.opencode, 24h in the temp directory)")
+
+	return cmd
+}
+
+func uninstallCmd() *cobra.Command {
+	var revokeAPIKey, dryRun, yes bool
+
+	cmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop the proxy and undo what opencode-auth set up, for offboarding",
+		Long: `Undoes what opencode-auth set up on this machine, in this order:
+
+  revokes the API key in config.json on the server (--revoke-api-key)
+  stops the proxy
+  removes the proxy's Windows service, if installed
+  removes the OS handlers of the private-use schemes in redirect_uris
+  reverts the keys config patches set in opencode.json to their values
+    before the first patch, from its patch history
+  deletes the keychain entries config.json refers to: api_key_ref,
+    static_token_ref, and the key of 'config encrypt'
+  deletes tokens.json
+
+Revoking goes through the proxy with your sign-in, so it needs the proxy
+running and runs first. Only the steps that apply are listed, and they run
+once you confirm them; --yes skips the question, --dry-run only lists them.
+A failed step is reported and the others still run.
+
+config.json, logs and the rest of ~/.opencode, and the opencode-auth binary
+itself, are left in place; remove them afterwards if nothing else needs them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUninstall(cmd.Context(), revokeAPIKey, dryRun, yes)
+		},
+	}
+
+	cmd.Flags().BoolVar(&revokeAPIKey, "revoke-api-key", false, "Also revoke the API key in config.json on the server, and remove it from config.json")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "List the steps without running them")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Run the steps without asking")
+
+	return cmd
+}
+
+// uninstallStep is one thing 'uninstall' undoes.
+type uninstallStep struct {
+	desc string
+	run  func() error
+}
+
+func runUninstall(ctx context.Context, revokeAPIKey, dryRun, yes bool) error {
+	oc, err := config.LoadOpenCodeConfig()
+	if err == nil {
+		applyOpenCodeConfig(cfg, oc)
+	}
+	var steps []uninstallStep
+
+	if revokeAPIKey {
+		if err := cfg.ResolveAPIKey(ctx); err != nil {
+			return err
+		}
+		if cfg.APIKey == "" {
+			return fmt.Errorf("--revoke-api-key: no API key is configured in %s", config.ConfigPath())
+		}
+		if _, err := proxy.GetProxyURL(cfg); err != nil {
+			return fmt.Errorf("--revoke-api-key needs the proxy to reach the API: %w\nStart it with 'opencode-auth proxy start', or leave out --revoke-api-key", err)
+		}
+		prefix := cfg.APIKey
+		if len(prefix) > 10 {
+			prefix = prefix[:10]
+		}
+		steps = append(steps, uninstallStep{"Revoke API key " + prefix + "... and remove it from config.json", func() error {
+			endpoint, token, err := loadConfigAndToken()
+			if err != nil {
+				return err
+			}
+			if _, err := apikey.NewClient(endpoint, token).Revoke(ctx, prefix); err != nil {
+				return err
+			}
+			user, err := config.LoadUserConfig()
+			if err != nil {
+				return err
+			}
+			user.APIKey, user.APIKeyRef, user.APIKeyCmd = "", "", ""
+			return config.SaveOpenCodeConfig(user)
+		}})
+	}
+
+	service := proxy.ServiceState()
+	if _, err := proxy.LoadProxyConfig(cfg); err == nil || service != "" {
+		steps = append(steps, uninstallStep{"Stop the proxy", func() error {
+			if err := proxy.StopProxy(cfg); err != nil && !errors.Is(err, proxy.ErrNotRunning) {
+				return err
+			}
+			return nil
+		}})
+	}
+	if service != "" {
+		steps = append(steps, uninstallStep{"Remove the Windows service " + proxy.ServiceName + " (needs an elevated prompt)", proxy.UninstallService})
+	}
+
+	for _, scheme := range configuredURLSchemes() {
+		if _, err := urlscheme.Handler(scheme); err != nil {
+			continue
+		}
+		scheme := scheme
+		steps = append(steps, uninstallStep{"Remove the " + scheme + ":// handler", func() error {
+			if err := urlscheme.Unregister(scheme); err != nil && !errors.Is(err, urlscheme.ErrNotRegistered) {
+				return err
+			}
+			return nil
+		}})
+	}
+
+	openCodeJSON := filepath.Join(cfg.ConfigDir, "opencode.json")
+	if _, err := os.Stat(configpatch.HistoryPath(openCodeJSON)); err == nil {
+		steps = append(steps, uninstallStep{"Revert the keys config patches set in " + openCodeJSON, func() error {
+			n, err := configpatch.Revert(openCodeJSON)
+			if err == nil {
+				fmt.Printf("  %d keys reverted\n", n)
+			}
+			return err
+		}})
+	}
+
+	var accounts []string
+	for _, ref := range []string{cfg.APIKeyRef, cfg.StaticTokenRef} {
+		if backend, name, err := secret.ParseRef(ref); err == nil && backend == "keychain" {
+			accounts = append(accounts, name)
+		}
+	}
+	if oc != nil && oc.ConfigRecipient != "" {
+		accounts = append(accounts, secret.ConfigKeyAccount)
+	}
+	for _, account := range accounts {
+		account := account
+		steps = append(steps, uninstallStep{fmt.Sprintf("Delete keychain entry %q", account), func() error {
+			return secret.KeychainDelete(ctx, account)
+		}})
+	}
+
+	if _, err := os.Stat(cfg.TokenPath); err == nil {
+		steps = append(steps, uninstallStep{"Delete " + cfg.TokenPath, func() error {
+			return auth.DeleteTokens(cfg.TokenPath)
+		}})
+	}
+
+	if len(steps) == 0 {
+		fmt.Println("Nothing to uninstall.")
+		return nil
+	}
+	fmt.Println("Uninstall will:")
+	for _, step := range steps {
+		fmt.Printf("  %s\n", step.desc)
+	}
+	if dryRun {
+		return nil
+	}
+	if !yes {
+		if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return fmt.Errorf("uninstall asks for confirmation on a terminal; pass --yes to run without it")
+		}
+		fmt.Print("Continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("Nothing changed.")
+			return nil
+		}
+	}
+
+	failed := 0
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Failed: %s: %v\n", step.desc, err)
+			continue
+		}
+		fmt.Printf("Done: %s\n", step.desc)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uninstall steps failed; fix the cause and run 'opencode-auth uninstall' again", failed, len(steps))
+	}
+	fmt.Printf("opencode-auth is uninstalled. %s and the opencode-auth binary are left in place.\n", cfg.ConfigDir)
+	return nil
+}
+
+func observeCmd() *cobra.Command {
+	var token string
+	var asJSON bool
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "observe [host:port]",
+		Short: "Show a machine's auth health from its observer feed",
+		Long: `Shows the read-only status feed a proxy serves for telemetry collectors:
+whether the token is valid and when it expires, whether re-authentication is
+needed, the last day's token refreshes by outcome, and today's request error
+rate. The feed never contains a token, key, or key prefix.
+
+Without an argument, shows this machine's feed, which is what a collector
+would see. With host:port (or a URL), reads the feed a user's proxy serves
+on its proxy_observer_listen address, with the collector's bearer token from
+--token or OPENCODE_OBSERVER_TOKEN.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			target := ""
+			if len(args) == 1 {
+				target = args[0]
+			}
+			if token == "" {
+				token = os.Getenv("OPENCODE_OBSERVER_TOKEN")
+			}
+			return runObserve(ctx, target, token, asJSON)
+		},
+	}
+
+	cmd.Flags().StringVar(&token, "token", "", "Collector bearer token for a remote feed (default $OPENCODE_OBSERVER_TOKEN)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the feed as JSON")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Second, "Timeout for reading the feed")
+
+	return cmd
+}
+
+// runObserve prints the observer feed of this machine's proxy or of target.
+func runObserve(ctx context.Context, target, token string, asJSON bool) error {
+	var feedURL string
+	if target == "" {
+		proxyURL, err := proxy.GetProxyURL(cfg)
+		if err != nil {
+			return fmt.Errorf("%w\nStart with 'oc' or 'opencode-auth proxy start'", err)
+		}
+		feedURL = proxyURL + "/api/observe"
+	} else {
+		feedURL = proxy.ObserverURL(target)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", feedURL, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" && target != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to read the observer feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%s refused the collector token; pass the proxy_observer_token with --token", feedURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s (restart the proxy if it predates the observer feed)", feedURL, resp.Status)
+	}
+	var report proxy.ObserverReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("invalid observer feed: %w", err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Printf("Host:      %s (v%s)\n", report.Host, report.ClientVersion)
+	if report.Email != "" {
+		fmt.Printf("User:      %s\n", report.Email)
+	}
+	fmt.Printf("Auth mode: %s\n", report.AuthMode)
+	switch {
+	case report.Revocation != nil:
+		fmt.Printf("Token:     access revoked since %s\n", report.Revocation.Since.Local().Format("2006-01-02 15:04"))
+	case report.ReauthInProgress:
+		fmt.Printf("Token:     re-authentication in progress\n")
+	case report.NeedsReauth:
+		fmt.Printf("Token:     needs re-authentication\n")
+	case report.TokenValid && !report.TokenExpiresAt.IsZero():
+		fmt.Printf("Token:     valid, expires in %s\n", time.Until(report.TokenExpiresAt).Round(time.Second))
+	case report.TokenValid:
+		fmt.Printf("Token:     valid\n")
+	default:
+		fmt.Printf("Token:     not valid\n")
+	}
+	if !report.LastRefresh.IsZero() {
+		fmt.Printf("Refreshed: %s (%d retries)\n", report.LastRefresh.Local().Format("15:04:05"), report.RetryCount)
+	}
+	if len(report.Refreshes) > 0 {
+		outcomes := make([]string, 0, len(report.Refreshes))
+		for outcome, n := range report.Refreshes {
+			outcomes = append(outcomes, fmt.Sprintf("%d %s", n, outcome))
+		}
+		sort.Strings(outcomes)
+		fmt.Printf("Refreshes: %s (last 24h)\n", strings.Join(outcomes, ", "))
+	}
+	if report.APIKey != nil && !report.APIKey.Valid {
+		fmt.Printf("API key:   rejected (%s)\n", report.APIKey.Reason)
+	}
+	fmt.Printf("Requests:  %d today, %d errors (%.1f%%)\n", report.Requests, report.Errors, report.ErrorRate*100)
+	return nil
+}
+
+func supportBundleCmd() *cobra.Command {
+	var output string
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "support-bundle",
+		Short: "Collect redacted logs and diagnostics into a zip for a support ticket",
+		Long: `Collects what support needs to diagnose a problem into one zip file:
+
+  system.txt            client version, Go version, OS and architecture
+  config/*.json         each config layer, and opencode.json
+  health.json           the running proxy's /health
+  token.txt             token expiry and whether a refresh token is saved
+  integrity.txt         damaged files in ~/.opencode ('doctor' checks)
+  logs/                 the end of proxy.log, refresh and login history,
+                        request history, and the token audit log
+
+Tokens, API keys, values of secret-named settings, and the local part of
+email addresses are masked, and your home directory is shown as ~. The
+contents are listed before anything is written: view any item, leave items
+out, then write or quit. --yes writes without the review, e.g. in scripts.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSupportBundle(cmd.Context(), output, yes)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Zip file to write (default: opencode-auth-support-<time>.zip in the current directory)")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Write the bundle without reviewing its contents")
+
+	return cmd
+}
+
+func runSupportBundle(ctx context.Context, output string, yes bool) error {
+	if output == "" {
+		output = fmt.Sprintf("opencode-auth-support-%s.zip", time.Now().Format("20060102-150405"))
+	}
+	if !yes {
+		if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return fmt.Errorf("the bundle contents need a review on a terminal; pass --yes to write without one")
+		}
+	}
+
+	items := collectSupportBundle(ctx)
+	if !yes {
+		var ok bool
+		if items, ok = bundle.Review(os.Stdin, os.Stdout, items); !ok {
+			fmt.Println("Nothing written.")
+			return nil
+		}
+	}
+	if err := bundle.Write(output, items); err != nil {
+		return fmt.Errorf("failed to write support bundle: %w", err)
+	}
+	fmt.Printf("Wrote %s (%d files). Attach it to your support ticket.\n", output, len(items))
+	return nil
+}
+
+// collectSupportBundle gathers the support bundle's files, redacted.
+func collectSupportBundle(ctx context.Context) []bundle.Item {
+	home, _ := os.UserHomeDir()
+	var items []bundle.Item
+	add := func(name string, data []byte) {
+		items = append(items, bundle.Item{Name: name, Data: bundle.Redact(data, home)})
+	}
+
+	system := bundle.SystemInfo(ctx, version)
+
+	// Config layers, and opencode's own config the installer patches
+	if layers, _, err := config.ConfigLayers(); err != nil {
+		system = append(system, fmt.Sprintf("config: %v\n", err)...)
+		if data, err := os.ReadFile(config.ConfigPath()); err == nil {
+			add("config/user.json", data)
+		}
+	} else {
+		for _, l := range layers {
+			if data, err := os.ReadFile(l.Path); l.Found && err == nil {
+				add("config/"+l.Name+".json", data)
+			}
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(cfg.ConfigDir, "opencode.json")); err == nil {
+		add("config/opencode.json", data)
+	}
+
+	// Proxy health
+	proxyState := "not running"
+	if proxyURL, err := proxy.GetProxyURL(cfg); err == nil {
+		healthCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		req, _ := http.NewRequestWithContext(healthCtx, "GET", proxyURL+"/health", nil)
+		if resp, err := http.DefaultClient.Do(req); err != nil {
+			proxyState = fmt.Sprintf("%s, not answering (%v)", proxyURL, err)
+		} else {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			proxyState = fmt.Sprintf("%s, /health answered %d", proxyURL, resp.StatusCode)
+			var pretty bytes.Buffer
+			if json.Indent(&pretty, data, "", "  ") == nil {
+				data = pretty.Bytes()
+			}
+			add("health.json", data)
+		}
+		cancel()
+	}
+	system = append(system, fmt.Sprintf("proxy: %s\n", proxyState)...)
+	add("system.txt", system)
+
+	// Token metadata, never the tokens
+	if cfg.StaticAuth() {
+		add("token.txt", []byte("auth mode: static\n"))
+	} else if tokens, err := auth.LoadTokens(cfg.TokenPath); err != nil {
+		add("token.txt", []byte(fmt.Sprintf("%v\n", err)))
+	} else {
+		add("token.txt", []byte(fmt.Sprintf("email: %s\nexpires: %s\nexpired: %s\nrefresh token saved: %s\nschema version: %d\n",
+			tokens.Email, tokens.ExpiresAt.Format(time.RFC3339), yesNo(tokens.IsExpired()), yesNo(tokens.RefreshToken != ""), tokens.SchemaVersion)))
+	}
+
+	var problems strings.Builder
+	for _, p := range integrity.Check(integrity.Options{ConfigDir: cfg.ConfigDir}) {
+		fmt.Fprintln(&problems, p)
+	}
+	if problems.Len() == 0 {
+		problems.WriteString("no problems found\n")
+	}
+	add("integrity.txt", []byte(problems.String()))
+
+	// Logs and history
+	logPath := proxy.LogPath(cfg)
+	for _, path := range []string{
+		logPath,
+		logPath + ".1",
+		auth.AuthStatsPath(cfg.ConfigDir),
+		auth.LoginsPath(cfg.ConfigDir),
+		proxy.HistoryPath(cfg),
+		audit.Path(cfg.ConfigDir),
+	} {
+		if data, err := bundle.Tail(path, bundle.MaxLogBytes); err == nil {
+			add("logs/"+filepath.Base(path), data)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return strings.Count(items[i].Name, "/") < strings.Count(items[j].Name, "/")
+	})
+	return items
+}
+
+// formatSize renders a byte count for display.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// formatAge renders an age rounded to a readable unit.
+func formatAge(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+	return d.Round(time.Minute).String()
+}
+
+func initCmd() *cobra.Command {
+	var from string
+	var keys []string
+	var dryRun bool
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Set up config.json and opencode.json from a signed bootstrap URL",
+		Long: `Downloads the bootstrap config your administrator published, verifies its
+signature, and writes the client ID, issuer, and API endpoints to
+~/.opencode/config.json and the model catalog to ~/.opencode/opencode.json:
+
+  opencode-auth init --from https://config.corp.example/opencode.json
+
+The document must be signed with a trusted Ed25519 key: one built into this
+binary, or one passed with --key (the public key your administrator
+published). Other settings in the files are kept; the previous files are
+saved as .bak. A bootstrap config never contains credentials.
+
+Administrators create the key pair with 'init keygen' and sign the config
+with 'init sign'.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if from == "" {
+				return fmt.Errorf("--from is required")
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runInit(ctx, from, keys, dryRun)
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "Bootstrap config URL (https)")
+	cmd.Flags().StringArrayVar(&keys, "key", nil, "Trusted base64 Ed25519 public key (repeatable)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Verify the bootstrap config and show the changes without writing them")
+	cmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for downloading the bootstrap config")
+
+	var keyFile string
+	cmd.AddCommand(&cobra.Command{
+		Use:   "keygen",
+		Short: "Create a key pair for signing bootstrap configs",
+		Long: `Creates an Ed25519 key pair. The private key is written to --key-file
+(mode 0600); keep it out of the repository. The public key is printed: give it
+to users for 'init --key', or build it into opencode-auth with
+-ldflags "-X main.bootstrapKeys=<key>".`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := os.Stat(keyFile); err == nil {
+				return fmt.Errorf("%s already exists", keyFile)
+			}
+			pub, priv, err := bootstrap.GenerateKey()
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(keyFile, []byte(priv+"\n"), 0600); err != nil {
+				return err
+			}
+			fmt.Printf("Private key written to %s\n", keyFile)
+			fmt.Printf("Public key: %s\n", pub)
+			return nil
+		},
+	})
+	cmd.Commands()[0].Flags().StringVar(&keyFile, "key-file", "bootstrap-signing.key", "Where to write the private key")
+
+	var signKeyFile string
+	var expiresIn time.Duration
+	signCmd := &cobra.Command{
+		Use:   "sign <config.json>",
+		Short: "Sign a bootstrap config for 'init --from'",
+		Long: `Signs a bootstrap config and prints the document to publish:
+
+  {
+    "config": {"client_id": "...", "issuer": "...", "api_endpoint": "https://oc.example.com/v1"},
+    "models": {"claude-sonnet": {"name": "Claude Sonnet 4.6"}},
+    "default_model": "claude-sonnet"
+  }
+
+"config" holds config.json keys; client_id and api_endpoint are required and
+API keys are refused. "models" replaces provider.bedrock.models in
+opencode.json ("provider" picks another provider). "profile" (a name such as
+"team-x") and "description" make it an org profile for 'profile import'.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			var c bootstrap.Config
+			if err := json.Unmarshal(data, &c); err != nil {
+				return fmt.Errorf("parsing %s: %w", args[0], err)
+			}
+			if expiresIn > 0 {
+				expires := time.Now().UTC().Add(expiresIn).Truncate(time.Second)
+				c.ExpiresAt = &expires
+			}
+			key, err := os.ReadFile(signKeyFile)
+			if err != nil {
+				return err
+			}
+			envelope, err := bootstrap.Sign(&c, string(key))
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(envelope)
+		},
+	}
+	signCmd.Flags().StringVar(&signKeyFile, "key-file", "bootstrap-signing.key", "Private key from 'init keygen'")
+	signCmd.Flags().DurationVar(&expiresIn, "expires-in", 0, "Refuse the config after this long, e.g. 2160h (default: never)")
+	cmd.AddCommand(signCmd)
+
+	return cmd
+}
+
+func profileCmd() *cobra.Command {
+	var keys []string
+	var dryRun bool
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Show the org profile installed with 'profile import'",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runProfileShow()
+		},
+	}
+	importCmd := &cobra.Command{
+		Use:   "import <url>",
+		Short: "Install a signed org profile from a URL",
+		Long: `Downloads the profile a team lead published, verifies its signature, and
+installs it like 'init --from': the issuer, client ID, API endpoints and
+policies go to ~/.opencode/config.json, and the models to
+~/.opencode/opencode.json:
+
+  opencode-auth profile import https://corp.example/profiles/team-x.json
+
+A profile is a bootstrap config with a "profile" name, signed with 'init
+sign' by a trusted key (built in, or passed with --key). The name and URL are
+saved as "profile" in config.json, so config patches with a profiles
+condition reach the team, and 'profile update' re-imports it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runProfileImport(ctx, args[0], keys, dryRun)
+		},
+	}
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "Re-import the installed profile from its URL",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			oc, err := config.LoadUserConfig()
+			if err != nil {
+				return err
+			}
+			if oc.Profile == nil || oc.Profile.Source == "" {
+				return fmt.Errorf("no profile installed; run 'opencode-auth profile import <url>'")
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runProfileImport(ctx, oc.Profile.Source, keys, dryRun)
+		},
+	}
+	for _, c := range []*cobra.Command{importCmd, updateCmd} {
+		c.Flags().StringArrayVar(&keys, "key", nil, "Trusted base64 Ed25519 public key (repeatable)")
+		c.Flags().BoolVar(&dryRun, "dry-run", false, "Verify the profile and show the changes without writing them")
+		c.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for downloading the profile")
+		cmd.AddCommand(c)
+	}
+	return cmd
+}
+
+func runProfileImport(ctx context.Context, from string, keyFlags []string, dryRun bool) error {
+	bc, err := fetchBootstrap(ctx, from, keyFlags)
+	if err != nil {
+		return err
+	}
+	if bc.Profile == "" {
+		return fmt.Errorf("%s has no profile name; install it with 'opencode-auth init --from %s'", from, from)
+	}
+	fmt.Printf("Verified profile %s from %s (issued %s)\n", bc.Profile, from, bc.IssuedAt.Local().Format("2006-01-02"))
+	if bc.Description != "" {
+		fmt.Printf("  %s\n", bc.Description)
+	}
+	if oc, err := config.LoadUserConfig(); err == nil && oc.Profile != nil && oc.Profile.Name != bc.Profile {
+		fmt.Printf("  Replaces profile %s\n", oc.Profile.Name)
+	}
+	return installBootstrap(bc, from, dryRun)
+}
+
+func runProfileShow() error {
+	oc, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+	if oc.Profile == nil {
+		fmt.Println("No profile installed. Import one with 'opencode-auth profile import <url>'.")
+		return nil
+	}
+	p := oc.Profile
+	fmt.Printf("Profile: %s\n", p.Name)
+	if p.Description != "" {
+		fmt.Printf("Description: %s\n", p.Description)
+	}
+	fmt.Printf("Source: %s\n", p.Source)
+	fmt.Printf("Issued: %s\n", p.IssuedAt.Local().Format("2006-01-02"))
+	return nil
+}
+
+// bootstrapKeys lists trusted bootstrap signing keys, comma-separated. Set at
+// build time with -ldflags "-X main.bootstrapKeys=...".
+var bootstrapKeys string
+
+func runInit(ctx context.Context, from string, keyFlags []string, dryRun bool) error {
+	bc, err := fetchBootstrap(ctx, from, keyFlags)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified bootstrap config from %s (issued %s)\n", from, bc.IssuedAt.Local().Format("2006-01-02"))
+	return installBootstrap(bc, from, dryRun)
+}
+
+// fetchBootstrap downloads the bootstrap config at from and verifies it with
+// the built-in keys and keyFlags.
+func fetchBootstrap(ctx context.Context, from string, keyFlags []string) (*bootstrap.Config, error) {
+	var keys []ed25519.PublicKey
+	for _, s := range append(strings.Split(bootstrapKeys, ","), keyFlags...) {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		key, err := bootstrap.ParseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	envelope, err := bootstrap.Fetch(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.Verify(keys, time.Now())
+}
+
+// installBootstrap writes a verified bootstrap config to config.json and
+// opencode.json, recording its profile, if any, as imported from from.
+func installBootstrap(bc *bootstrap.Config, from string, dryRun bool) error {
+	configPath := config.ConfigPath()
+	configSpec := configpatch.PatchSpec{Set: make(map[string]interface{}, len(bc.Config)+1)}
+	settings := make([]string, 0, len(bc.Config))
+	for key, value := range bc.Config {
+		configSpec.Set[key] = value
+		settings = append(settings, key)
+	}
+	if bc.Profile != "" {
+		configSpec.Set["profile"] = config.Profile{Name: bc.Profile, Description: bc.Description, Source: from, IssuedAt: bc.IssuedAt}
+		settings = append(settings, "profile")
+	}
+	sort.Strings(settings)
+	fmt.Printf("  %s: %s\n", configPath, strings.Join(settings, ", "))
+
+	provider := orDefault(bc.Provider, configpatch.DefaultProvider)
+	opencodePath := filepath.Join(filepath.Dir(configPath), "opencode.json")
+	var opencodeSpec configpatch.PatchSpec
+	if len(bc.Models) > 0 {
+		opencodeSpec.SetDeep = map[string]interface{}{"provider." + provider + ".models": bc.Models}
+		if bc.DefaultModel != "" {
+			opencodeSpec.Set = map[string]interface{}{"model": provider + "/" + bc.DefaultModel}
+		}
+		fmt.Printf("  %s: %d models", opencodePath, len(bc.Models))
+		if bc.DefaultModel != "" {
+			fmt.Printf(", default %s/%s", provider, bc.DefaultModel)
+		}
+		fmt.Println()
+	}
+	if dryRun {
+		fmt.Println("Dry run: nothing written.")
+		return nil
+	}
+
+	if err := writeBootstrapFile(configPath, configSpec, nil); err != nil {
+		return err
+	}
+	if _, err := config.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if len(bc.Models) > 0 {
+		// A new opencode.json has to send opencode's requests to the proxy
+		port := config.DefaultProxyPort
+		if oc, err := config.LoadOpenCodeConfig(); err == nil && oc.ProxyPort > 0 {
+			port = oc.ProxyPort
+		}
+		skeleton := map[string]interface{}{
+			"$schema": "https://opencode.ai/config.json",
+			"provider": map[string]interface{}{
+				provider: map[string]interface{}{
+					"npm":     "@ai-sdk/openai-compatible",
+					"name":    "Bedrock Models",
+					"options": map[string]interface{}{"baseURL": fmt.Sprintf("http://localhost:%d/v1", port)},
+				},
+			},
+		}
+		if err := writeBootstrapFile(opencodePath, opencodeSpec, skeleton); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Done. Run 'oc' to sign in.")
+	return nil
+}
+
+// writeBootstrapFile applies spec to the JSON file at path, backing it up
+// first. A missing file is created from skeleton (or empty).
+func writeBootstrapFile(path string, spec configpatch.PatchSpec, skeleton map[string]interface{}) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if skeleton == nil {
+			skeleton = map[string]interface{}{}
+		}
+		data, _ := json.MarshalIndent(skeleton, "", "  ")
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+			return err
+		}
+	} else if err := configpatch.Backup(path); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", filepath.Base(path), err)
+	}
+	if err := configpatch.Apply(path, spec); err != nil {
+		_ = configpatch.Restore(path)
+		return fmt.Errorf("failed to update %s, restored backup: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the layered config.json settings and encrypt the API key",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "sources",
+		Short: "Show which config file each setting comes from",
+		Long: `Lists the config layers in precedence order and where each effective
+setting comes from:
+
+  system   /etc/opencode/config.json (OPENCODE_SYSTEM_CONFIG overrides)
+  user     ~/.opencode/config.json
+  project  .opencode/config.json in the current directory or a parent
+
+Later layers override earlier ones, and environment variables and flags
+override all of them. A project may only set endpoint and transport
+settings, and its api_endpoint must be one the user or system config
+already lists; other keys are reported as ignored.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConfigSources()
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "encrypt",
+		Short: "Encrypt the API key in config.json with a key in the OS keychain",
+		Long: `Encrypts api_key in ~/.opencode/config.json so the file no longer holds the
+key in plaintext. The first run creates an X25519 key pair: the private key is
+stored in the OS keychain (macOS Keychain or libsecret on Linux) and the public
+key is saved as config_recipient.
+
+Every command and the proxy decrypt the key transparently on load. Keys saved
+later with 'apikey create --save' are encrypted as well. Running it again
+encrypts a plaintext api_key that was added by hand.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+			defer cancel()
+			return runConfigEncrypt(ctx)
+		},
+	})
+
+	return cmd
+}
+
+// runConfigEncrypt encrypts the user layer's api_key, creating the keychain
+// config key on first use.
+func runConfigEncrypt(ctx context.Context) error {
+	oc, err := config.LoadUserConfig()
+	if err != nil {
+		return err
+	}
+
+	if oc.ConfigRecipient != "" {
+		// A new key would make the existing ciphertext unreadable
+		key, err := secret.ConfigKey(ctx)
+		if err != nil {
+			return fmt.Errorf("config.json is encrypted, but its key can't be read from the keychain: %w", err)
+		}
+		if secret.EncodeKey(key.PublicKey().Bytes()) != oc.ConfigRecipient {
+			return fmt.Errorf("the keychain's config key does not match config_recipient in %s", config.ConfigPath())
+		}
+	} else {
+		key, err := secret.GenerateConfigKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate config key: %w", err)
+		}
+		if err := secret.StoreConfigKey(ctx, key); err != nil {
+			return err
+		}
+		oc.ConfigRecipient = secret.EncodeKey(key.PublicKey().Bytes())
+		fmt.Printf("Created a config key in the OS keychain (account %q)\n", secret.ConfigKeyAccount)
+	}
+
+	wasPlaintext := oc.APIKey != "" && !secret.IsSealed(oc.APIKey)
+	if err := config.SaveOpenCodeConfig(oc); err != nil {
+		return err
+	}
+	switch {
+	case wasPlaintext:
+		fmt.Printf("Encrypted api_key in %s\n", config.ConfigPath())
+	case oc.APIKey != "":
+		fmt.Printf("api_key in %s is already encrypted\n", config.ConfigPath())
+	default:
+		fmt.Printf("No api_key in %s; keys saved with 'apikey create --save' will be encrypted\n", config.ConfigPath())
+	}
+	return nil
+}
+
+func modelsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "models",
+		Short: "Manage the models opencode offers",
+	}
+
+	var dryRun, prune bool
+	var provider string
+	var timeout time.Duration
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Add the router's models to opencode.json",
+		Long: `Fetches the model catalog (/v1/models) through the proxy and adds models
+that are missing from provider.bedrock.models in ~/.opencode/opencode.json, so
+new Bedrock models show up in opencode without waiting for a config patch.
+
+Existing model entries are left as they are. New ones get a name derived from
+the model ID. With --prune, models the router no longer serves are removed,
+except the one selected as opencode's default "model".
+
+Requires the proxy to be running (start with 'oc' or 'opencode-auth proxy start').`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			return runModelsSync(ctx, provider, dryRun, prune)
+		},
+	}
+	syncCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the changes without writing opencode.json")
+	syncCmd.Flags().BoolVar(&prune, "prune", false, "Remove models the router no longer serves")
+	syncCmd.Flags().StringVar(&provider, "provider", configpatch.DefaultProvider, "opencode provider to update")
+	syncCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for fetching the model catalog")
+	cmd.AddCommand(syncCmd)
+
+	return cmd
+}
+
+func runModelsSync(ctx context.Context, provider string, dryRun, prune bool) error {
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return fmt.Errorf("%w\nStart with 'oc' or 'opencode-auth proxy start'", err)
+	}
+
+	ids, err := configpatch.FetchModels(ctx, proxyURL, provider)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("the router returned no models; leaving opencode.json unchanged")
+	}
+
+	filePath := filepath.Join(cfg.ConfigDir, "opencode.json")
+	sync, err := configpatch.SyncModels(filePath, provider, ids, prune)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range sync.Added {
+		fmt.Printf("  + %s/%s\n", provider, id)
+	}
+	for _, id := range sync.Removed {
+		fmt.Printf("  - %s/%s\n", provider, id)
+	}
+	if len(sync.Kept) > 0 {
+		if prune {
+			fmt.Printf("Kept %s/%s: it is opencode's default model.\n", provider, sync.Kept[0])
+		} else {
+			fmt.Printf("Not served by the router (use --prune to remove): %s\n", strings.Join(sync.Kept, ", "))
+		}
+	}
+	if len(sync.Added) == 0 && len(sync.Removed) == 0 {
+		fmt.Printf("opencode.json already lists all %d models.\n", len(ids))
+		return nil
+	}
+	if dryRun {
+		fmt.Println("Dry run: opencode.json not changed.")
+		return nil
+	}
+
+	if err := configpatch.Backup(filePath); err != nil {
+		return fmt.Errorf("failed to back up opencode.json: %w", err)
+	}
+	if err := configpatch.Apply(filePath, sync.Spec); err != nil {
+		_ = configpatch.Restore(filePath)
+		return fmt.Errorf("failed to update opencode.json, restored backup: %w", err)
+	}
+	fmt.Printf("Updated %s (%d added, %d removed). Restart opencode to see the changes.\n", filePath, len(sync.Added), len(sync.Removed))
+	return nil
+}
+
+func runConfigSources() error {
+	layers, settings, err := config.ConfigLayers()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Layers (lowest precedence first):")
+	for _, l := range layers {
+		state := "not found"
+		if l.Found {
+			state = fmt.Sprintf("%d keys", len(l.Keys))
+		}
+		fmt.Printf("  %-8s %s (%s)\n", l.Name, l.Path, state)
+		ignored := make([]string, 0, len(l.Ignored))
+		for key := range l.Ignored {
+			ignored = append(ignored, key)
+		}
+		sort.Strings(ignored)
+		for _, key := range ignored {
+			fmt.Printf("           ignored %s: %s\n", key, l.Ignored[key])
+		}
+	}
+	if len(layers) < 3 {
+		fmt.Println("  project  no .opencode/config.json in this directory or its parents")
+	}
+
+	if len(settings) == 0 {
+		return nil
+	}
+	fmt.Println("\nEffective settings:")
+	for _, st := range settings {
+		value := string(st.Value)
+		if st.Key == "api_key" {
+			var key string
+			json.Unmarshal(st.Value, &key)
+			if secret.IsSealed(key) {
+				value = "(encrypted)"
+			} else {
+				if len(key) > 10 {
+					key = key[:10]
+				}
+				value = fmt.Sprintf("%q", key+"...")
+			}
+		}
+		if len(value) > 60 {
+			value = value[:57] + "..."
+		}
+		fmt.Printf("  %-24s %-60s %s\n", st.Key, value, st.Layer)
+	}
+	return nil
+}
+
+func pingCmd() *cobra.Command {
+	var count int
+	var interval time.Duration
+	var timeout time.Duration
+	var targets []string
+
+	cmd := &cobra.Command{
+		Use:   "ping",
+		Short: "Measure latency to the API endpoint and alternate regions",
+		Long: `Probes the health check of the configured API endpoint over fresh
+connections and prints TCP connect, TLS handshake, and first-byte latency
+percentiles.
+
+Endpoints listed under "alternate_endpoints" in ~/.opencode/config.json (or
+given with --target) are probed too, and a switch is suggested if one is
+materially faster from this machine.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPing(cmd.Context(), count, interval, timeout, targets)
+		},
+	}
+
+	cmd.Flags().IntVarP(&count, "count", "c", 5, "Probes per endpoint")
+	cmd.Flags().DurationVar(&interval, "interval", 200*time.Millisecond, "Delay between probes")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Second, "Timeout for each probe")
+	cmd.Flags().StringArrayVar(&targets, "target", nil, "Additional endpoint to compare (repeatable)")
+
+	return cmd
+}
+
+func runPing(ctx context.Context, count int, interval, timeout time.Duration, targets []string) error {
+	if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+		applyOpenCodeConfig(cfg, openCodeConfig)
+	}
+	if cfg.APIEndpoint == "" {
+		return fmt.Errorf("no API endpoint configured (set api_endpoint in %s or OPENAI_BASE_URL)", config.ConfigPath())
+	}
+	if count < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+
+	prober := &ping.Prober{Timeout: timeout, TLSConfig: cfg.TLSPolicy.Apply(nil)}
+	var alternates []ping.Result
+	seen := map[string]bool{cfg.APIEndpoint: true}
+
+	fmt.Printf("%-40s %-10s %15s %15s %21s\n", "ENDPOINT", "SAMPLES", "TCP p50/p90", "TLS p50/p90", "FIRST BYTE p50/p90/p99")
+	primary := prober.Run(ctx, cfg.APIEndpoint, count, interval)
+	printPingResult(primary)
+	for _, endpoint := range append(append([]string{}, cfg.AlternateEndpoints...), targets...) {
+		if seen[endpoint] {
+			continue
+		}
+		seen[endpoint] = true
+		r := prober.Run(ctx, endpoint, count, interval)
+		printPingResult(r)
+		alternates = append(alternates, r)
+	}
+
+	for _, r := range append([]ping.Result{primary}, alternates...) {
+		if r.LastErr != nil {
+			fmt.Printf("\n%s: %d of %d probes failed: %v\n", r.Endpoint, r.Errors, count, r.LastErr)
+		}
+	}
 
-This enables seamless long-running sessions without 401 errors.`,
+	if best := ping.Recommend(primary, alternates); best != nil {
+		fmt.Printf("\n%s is faster from here (first byte p50 %s vs %s).\n",
+			best.Endpoint, best.MedianFirstByte().Round(time.Millisecond), primary.MedianFirstByte().Round(time.Millisecond))
+		fmt.Printf("To switch, set \"api_endpoint\": %q in %s and run 'opencode-auth proxy restart'.\n", best.Endpoint, config.ConfigPath())
 	}
 
-	cmd.AddCommand(proxyStartCmd())
-	cmd.AddCommand(proxyStopCmd())
-	cmd.AddCommand(proxyRestartCmd())
-	cmd.AddCommand(proxyStatusCmd())
-	cmd.AddCommand(proxyReauthCmd())
+	if len(primary.Samples) == 0 {
+		return fmt.Errorf("%s is unreachable", cfg.APIEndpoint)
+	}
+	return nil
+}
 
-	return cmd
+func printPingResult(r ping.Result) {
+	samples := fmt.Sprintf("%d/%d", len(r.Samples), len(r.Samples)+r.Errors)
+	if len(r.Samples) == 0 {
+		fmt.Printf("%-40s %-10s %15s %15s %21s\n", r.Endpoint, samples, "-", "-", "-")
+		return
+	}
+
+	ms := func(d time.Duration) string { return fmt.Sprint(d.Round(time.Millisecond).Milliseconds()) }
+	pct := func(phase func(ping.Sample) time.Duration, ps ...float64) string {
+		ds := r.Durations(phase)
+		parts := make([]string, len(ps))
+		for i, p := range ps {
+			parts[i] = ms(ping.Percentile(ds, p))
+		}
+		return strings.Join(parts, "/") + "ms"
+	}
+
+	tlsCol := "-" // plain HTTP endpoint
+	if r.Samples[0].TLS > 0 {
+		tlsCol = pct(func(s ping.Sample) time.Duration { return s.TLS }, 50, 90)
+	}
+
+	fmt.Printf("%-40s %-10s %15s %15s %21s\n", r.Endpoint, samples,
+		pct(func(s ping.Sample) time.Duration { return s.TCP }, 50, 90),
+		tlsCol,
+		pct(func(s ping.Sample) time.Duration { return s.FirstByte }, 50, 90, 99))
 }
 
-func proxyStartCmd() *cobra.Command {
-	var foreground bool
+func mcpCmd() *cobra.Command {
+	var httpAddr string
 
 	cmd := &cobra.Command{
-		Use:   "start",
-		Short: "Start the authentication proxy",
-		Long: `Starts the local authentication proxy server if not already running.
+		Use:   "mcp",
+		Short: "Serve auth tools to opencode over MCP",
+		Long: `Runs a Model Context Protocol server so the agent can report auth issues
+from inside the editor. Tools:
 
-By default, the proxy runs in the background. Use --foreground to run in the current terminal.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			// Load config
-			openCodeConfig, err := config.LoadOpenCodeConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w\nRun the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash", err)
-			}
-			applyOpenCodeConfig(cfg, openCodeConfig)
-			if err := cfg.DiscoverEndpoints(); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
-			}
+  auth_status   Token validity, remaining session time, and proxy health
+  usage_today   Requests sent through the local proxy today
+  rotate_key    Create a new API key, switch the proxy to it, revoke the old one
 
-			// Check if already running
-			if proxyURL, err := proxy.GetProxyURL(cfg); err == nil {
-				fmt.Fprintf(os.Stderr, "Proxy already running at %s\n", proxyURL)
-				return nil
-			}
+By default the server speaks JSON-RPC on stdin/stdout. Add it to opencode.json:
 
-			if foreground {
-				// Run in current process (blocking)
-				fmt.Fprintf(os.Stderr, "Starting authentication proxy...\n")
-				server, err := proxy.NewServer(cfg)
-				if err != nil {
-					return fmt.Errorf("failed to create proxy server: %w", err)
-				}
+  "mcp": {"opencode-auth": {"type": "local", "command": ["opencode-auth", "mcp"]}}
 
-				if err := server.Start(); err != nil {
-					return fmt.Errorf("failed to start proxy: %w", err)
-				}
+Use --http to serve on a local address instead. Requests must then send the
+bearer token written to ~/.opencode/mcp-http.token (mode 0600), as
+application/json, from localhost:
 
-				fmt.Fprintf(os.Stderr, "Proxy started successfully!\n")
-				fmt.Fprintf(os.Stderr, "  Port: %d\n", server.Port())
-				fmt.Fprintf(os.Stderr, "  PID: %d\n", os.Getpid())
-				fmt.Fprintf(os.Stderr, "  Target: %s\n", cfg.APIEndpoint)
-				fmt.Fprintf(os.Stderr, "\nUse 'opencode-auth proxy status' to check status\n")
-				fmt.Fprintf(os.Stderr, "Use 'opencode-auth proxy stop' to stop the proxy\n")
-				fmt.Fprintf(os.Stderr, "\nRunning in foreground mode. Press Ctrl+C to stop.\n")
-				// Block until interrupted
-				select {}
-			}
+  "mcp": {"opencode-auth": {"type": "remote", "url": "http://localhost:18090",
+          "headers": {"Authorization": "Bearer <token>"}}}
 
-			// Background mode - fork a new process
-			proxyConfig, err := proxy.StartProxy(cfg)
-			if err != nil {
-				return fmt.Errorf("failed to start proxy: %w", err)
+rotate_key only acts when called with "confirm": true, after the user agreed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if openCodeConfig, err := config.LoadOpenCodeConfig(); err == nil {
+				applyOpenCodeConfig(cfg, openCodeConfig)
 			}
 
-			fmt.Fprintf(os.Stderr, "Proxy started successfully!\n")
-			fmt.Fprintf(os.Stderr, "  Port: %d\n", proxyConfig.Port)
-			fmt.Fprintf(os.Stderr, "  PID: %d\n", proxyConfig.PID)
-			fmt.Fprintf(os.Stderr, "  Target: %s\n", proxyConfig.TargetURL)
-			fmt.Fprintf(os.Stderr, "\nUse 'opencode-auth proxy status' to check status\n")
-			fmt.Fprintf(os.Stderr, "Use 'opencode-auth proxy stop' to stop the proxy\n")
+			server := newMCPServer()
+			if httpAddr == "" {
+				return server.ServeStdio(cmd.Context(), os.Stdin, os.Stdout)
+			}
 
+			if !strings.HasPrefix(httpAddr, "localhost:") && !strings.HasPrefix(httpAddr, "127.0.0.1:") {
+				return fmt.Errorf("--http must listen on localhost (got %q)", httpAddr)
+			}
+			token, tokenPath, err := writeMCPToken()
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tokenPath)
+			httpServer := &http.Server{Addr: httpAddr, Handler: server.HTTPHandler(token)}
+			go func() {
+				<-cmd.Context().Done()
+				httpServer.Close()
+			}()
+			fmt.Fprintf(os.Stderr, "MCP server listening on http://%s\n", httpAddr)
+			fmt.Fprintf(os.Stderr, "  Bearer token: %s\n", tokenPath)
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				return err
+			}
 			return nil
 		},
 	}
 
-	cmd.Flags().BoolVar(&foreground, "foreground", false, "Run proxy in foreground (don't detach)")
+	cmd.Flags().StringVar(&httpAddr, "http", "", "Serve MCP over HTTP on this address (e.g. localhost:18090) instead of stdio")
 
 	return cmd
 }
 
-func proxyStopCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "stop",
-		Short: "Stop the authentication proxy",
-		Long:  `Stops the local authentication proxy server.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := proxy.StopProxy(cfg); err != nil {
-				return err
-			}
-			fmt.Fprintf(os.Stderr, "Proxy stopped successfully\n")
-			return nil
-		},
+// mcpTokenFile holds the bearer token of 'mcp --http', readable only by the
+// user.
+const mcpTokenFile = "mcp-http.token"
+
+// writeMCPToken creates a new random bearer token for 'mcp --http' and
+// writes it to a 0600 file in the config directory.
+func writeMCPToken() (token, path string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("creating MCP token: %w", err)
+	}
+	token = hex.EncodeToString(b)
+	if err := os.MkdirAll(cfg.ConfigDir, 0700); err != nil {
+		return "", "", err
 	}
+	path = filepath.Join(cfg.ConfigDir, mcpTokenFile)
+	// A file left with wider permissions would keep them through WriteFile
+	os.Remove(path)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", "", fmt.Errorf("writing MCP token: %w", err)
+	}
+	return token, path, nil
 }
 
-func proxyRestartCmd() *cobra.Command {
-	var foreground bool
+// newMCPServer registers the auth tools. Tool output goes to the agent, so
+// handlers return text instead of printing.
+func newMCPServer() *mcp.Server {
+	server := mcp.NewServer("opencode-auth", version)
 
-	cmd := &cobra.Command{
-		Use:   "restart",
-		Short: "Restart the authentication proxy",
-		Long: `Stops and restarts the local authentication proxy server.
+	server.AddTool(mcp.Tool{
+		Name:        "auth_status",
+		Description: "Report whether the user is authenticated, how much session time remains, and whether the local auth proxy is healthy.",
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			return mcpAuthStatus(), nil
+		},
+	})
 
-This is useful for applying updates or recovering from issues.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			// Stop if running
-			if err := proxy.StopProxy(cfg); err != nil {
-				fmt.Fprintf(os.Stderr, "Note: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Proxy stopped\n")
+	server.AddTool(mcp.Tool{
+		Name:        "usage_today",
+		Description: "Report how many requests were sent through the local auth proxy today.",
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			return mcpUsageToday(ctx)
+		},
+	})
+
+	server.AddTool(mcp.Tool{
+		Name:        "rotate_key",
+		Description: "Create a new API key, switch the local proxy to it, and revoke the previously configured key. Ask the user first, then call it with confirm set to true.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"expires_in_days": map[string]interface{}{
+					"type":        "integer",
+					"description": "Days until the new key expires (1-365, default 90)",
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Must be true: the user agreed to replace and revoke their API key",
+				},
+			},
+			"required": []string{"confirm"},
+		},
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			var params struct {
+				ExpiresInDays int  `json:"expires_in_days"`
+				Confirm       bool `json:"confirm"`
 			}
-
-			// Small delay to ensure port is released
-			time.Sleep(500 * time.Millisecond)
-
-			// Load config
-			openCodeConfig, err := config.LoadOpenCodeConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w\nRun the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash", err)
+			if len(args) > 0 {
+				if err := json.Unmarshal(args, &params); err != nil {
+					return "", fmt.Errorf("invalid arguments: %w", err)
+				}
 			}
-			applyOpenCodeConfig(cfg, openCodeConfig)
-			if err := cfg.DiscoverEndpoints(); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
+			if !params.Confirm {
+				return "", fmt.Errorf("rotate_key revokes the API key in use; ask the user, then call it again with confirm set to true")
 			}
-
-			if foreground {
-				// Run in current process (blocking)
-				fmt.Fprintf(os.Stderr, "Starting authentication proxy...\n")
-				server, err := proxy.NewServer(cfg)
-				if err != nil {
-					return fmt.Errorf("failed to create proxy server: %w", err)
-				}
-
-				if err := server.Start(); err != nil {
-					return fmt.Errorf("failed to start proxy: %w", err)
-				}
-
-				fmt.Fprintf(os.Stderr, "Proxy restarted successfully!\n")
-				fmt.Fprintf(os.Stderr, "  Port: %d\n", server.Port())
-				fmt.Fprintf(os.Stderr, "  PID: %d\n", os.Getpid())
-				fmt.Fprintf(os.Stderr, "  Target: %s\n", cfg.APIEndpoint)
-				fmt.Fprintf(os.Stderr, "\nRunning in foreground mode. Press Ctrl+C to stop.\n")
-				// Block until interrupted
-				select {}
+			if params.ExpiresInDays == 0 {
+				params.ExpiresInDays = 90
 			}
+			return mcpRotateKey(ctx, params.ExpiresInDays)
+		},
+	})
 
-			// Background mode - fork a new process
-			proxyConfig, err := proxy.StartProxy(cfg)
-			if err != nil {
-				return fmt.Errorf("failed to start proxy: %w", err)
-			}
+	return server
+}
 
-			fmt.Fprintf(os.Stderr, "Proxy restarted successfully!\n")
-			fmt.Fprintf(os.Stderr, "  Port: %d\n", proxyConfig.Port)
-			fmt.Fprintf(os.Stderr, "  PID: %d\n", proxyConfig.PID)
-			fmt.Fprintf(os.Stderr, "  Target: %s\n", proxyConfig.TargetURL)
-			fmt.Fprintf(os.Stderr, "\nUse 'opencode-auth proxy status' to check status\n")
+func mcpAuthStatus() string {
+	var b strings.Builder
 
-			return nil
-		},
+	tokens, err := auth.LoadTokens(cfg.TokenPath)
+	switch {
+	case cfg.StaticAuth():
+		b.WriteString("Using the static token from the config (auth_mode static); there is no sign-in.\n")
+	case err != nil:
+		b.WriteString("Not authenticated. Run `opencode-auth login` in a terminal.\n")
+	case tokens.IsExpired():
+		fmt.Fprintf(&b, "Session expired at %s. Run `opencode-auth login` in a terminal.\n",
+			tokens.ExpiresAt.Local().Format(time.RFC822))
+	default:
+		fmt.Fprintf(&b, "Authenticated as %s. Token expires in %s (the proxy refreshes it automatically).\n",
+			tokens.Email, time.Until(tokens.ExpiresAt).Round(time.Minute))
 	}
 
-	cmd.Flags().BoolVar(&foreground, "foreground", false, "Run proxy in foreground (don't detach)")
-
-	return cmd
-}
-
-func proxyStatusCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "status",
-		Short: "Show proxy status",
-		Long:  `Displays the current status of the authentication proxy server.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			status, err := proxy.StatusProxy(cfg)
-			if err != nil {
-				return err
-			}
+	if cfg.APIKey != "" || cfg.APIKeyRef != "" || cfg.APIKeyCmd != "" {
+		b.WriteString("Proxy auth mode: API key.\n")
+	}
 
-			// Pretty print the status
-			jsonData, err := json.MarshalIndent(status, "", "  ")
-			if err != nil {
-				return err
-			}
-			fmt.Println(string(jsonData))
-			return nil
-		},
+	if proxyURL, err := proxy.GetProxyURL(cfg); err != nil {
+		fmt.Fprintf(&b, "Proxy: not running (%v).\n", err)
+	} else {
+		fmt.Fprintf(&b, "Proxy: healthy at %s.\n", proxyURL)
 	}
-}
 
-func proxyReauthCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "reauth",
-		Short: "Force re-authentication",
-		Long: `Forces the proxy to re-authenticate immediately.
+	return b.String()
+}
 
-This is useful if you want to refresh your session proactively or if
-automatic re-authentication failed and you want to retry manually.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			// Check if proxy is running
-			proxyConfig, err := proxy.LoadProxyConfig(cfg)
-			if err != nil {
-				return fmt.Errorf("proxy not running: %w", err)
-			}
+func mcpUsageToday(ctx context.Context) (string, error) {
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		return "", err
+	}
 
-			if !proxy.IsProcessRunning(proxyConfig.PID) {
-				return fmt.Errorf("proxy not running")
-			}
+	req, err := http.NewRequestWithContext(ctx, "GET", proxyURL+"/api/usage", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("usage request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("usage request returned status %d", resp.StatusCode)
+	}
 
-			fmt.Fprintf(os.Stderr, "Triggering proxy re-authentication...\n")
+	var usage proxy.UsageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return "", fmt.Errorf("parsing usage response: %w", err)
+	}
+	summary := fmt.Sprintf("%s: %d requests through the local proxy (%d chat completions, %d errors), %d tokens",
+		usage.Date, usage.Requests, usage.Completions, usage.Errors, usage.Tokens)
+	if usage.TokenBudget > 0 {
+		summary += fmt.Sprintf(" of a daily budget of %d", usage.TokenBudget)
+	} else if usage.UsageBudget > 0 {
+		summary += fmt.Sprintf(" of a soft daily budget of %d", usage.UsageBudget)
+	}
+	return summary + ". Counts reset when the proxy restarts.", nil
+}
 
-			// Stop and restart proxy to trigger re-auth
-			if err := proxy.StopProxy(cfg); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to stop proxy: %v\n", err)
-			}
+// activeKeyPrefix returns the prefix the router lists for key among the
+// user's active keys, so rotation revokes exactly that key.
+func activeKeyPrefix(ctx context.Context, client *apikey.Client, key string) (string, error) {
+	list, err := client.List(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list API keys: %w", err)
+	}
+	var prefix string
+	for _, k := range list.Keys {
+		if k.Status == "active" && k.KeyPrefix != "" && strings.HasPrefix(key, k.KeyPrefix) && len(k.KeyPrefix) > len(prefix) {
+			prefix = k.KeyPrefix
+		}
+	}
+	if prefix == "" {
+		return "", fmt.Errorf("the configured API key is not among your active keys; nothing was rotated")
+	}
+	return prefix, nil
+}
 
-			time.Sleep(500 * time.Millisecond)
+func mcpRotateKey(ctx context.Context, expiresInDays int) (string, error) {
+	openCodeConfig, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		return "", fmt.Errorf("failed to load config: %w", err)
+	}
+	if openCodeConfig.APIKeyCmd != "" {
+		return "", fmt.Errorf("the API key comes from api_key_cmd and must be rotated by its owner")
+	}
+	store := "config"
+	if openCodeConfig.APIKeyRef != "" {
+		store = "keychain"
+	}
 
-			// Load config before starting
-			openCodeConfig, err := config.LoadOpenCodeConfig()
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w\nRun the installer first: curl -fsSL https://downloads.oc.example.com/install.sh | bash", err)
-			}
-			applyOpenCodeConfig(cfg, openCodeConfig)
-			if err := cfg.DiscoverEndpoints(); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: OIDC endpoint discovery failed: %v\n", err)
-			}
+	// Identify the key being replaced before it is overwritten
+	if err := cfg.ResolveAPIKey(ctx); err != nil {
+		return "", err
+	}
+	oldKey := cfg.APIKey
+	if oldKey == "" {
+		return "", fmt.Errorf("no API key is configured; create one with `opencode-auth apikey create --save`")
+	}
 
-			newConfig, err := proxy.StartProxy(cfg)
-			if err != nil {
-				return fmt.Errorf("failed to restart proxy: %w", err)
-			}
+	endpoint, token, err := loadConfigAndToken()
+	if err != nil {
+		return "", err
+	}
+	client := apikey.NewClient(endpoint, token)
+	oldPrefix, err := activeKeyPrefix(ctx, client, oldKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := client.Create(ctx, "rotated by opencode-auth mcp", expiresInDays)
+	if err != nil {
+		return "", fmt.Errorf("failed to create API key: %w", err)
+	}
+	userConfig, err := config.LoadUserConfig()
+	if err == nil {
+		err = saveAPIKey(ctx, userConfig, key.Key, store)
+	}
+	if err != nil {
+		return "", fmt.Errorf("created key %s but could not save it: %w", key.KeyPrefix, err)
+	}
 
-			fmt.Fprintf(os.Stderr, "Proxy restarted. PID: %d\n", newConfig.PID)
-			fmt.Fprintf(os.Stderr, "The proxy will re-authenticate on next token check.\n")
+	// The proxy resolves the key at startup
+	cfg.APIKey = ""
+	applyOpenCodeConfig(cfg, openCodeConfig)
+	if err := restartRunningProxy(); err != nil {
+		return "", fmt.Errorf("saved new key %s but the proxy failed to restart: %w", key.KeyPrefix, err)
+	}
 
-			return nil
-		},
+	if _, err := client.Revoke(ctx, oldPrefix); err != nil {
+		return fmt.Sprintf("Switched to new key %s (expires %s), but revoking old key %s failed: %v",
+			key.KeyPrefix, key.ExpiresAt, oldPrefix, err), nil
 	}
+
+	return fmt.Sprintf("Rotated API key: %s is now in use (expires %s); %s was revoked.",
+		key.KeyPrefix, key.ExpiresAt, oldPrefix), nil
 }
@@ -0,0 +1,177 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testServer() *Server {
+	s := NewServer("opencode-auth", "1.2.3")
+	s.AddTool(Tool{
+		Name:        "echo",
+		Description: "Echo the message",
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			var a struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(args, &a)
+			if a.Message == "" {
+				return "", fmt.Errorf("message is required")
+			}
+			return a.Message, nil
+		},
+	})
+	return s
+}
+
+func decode(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("invalid response %q: %v", data, err)
+	}
+	return m
+}
+
+func TestHandle_Initialize(t *testing.T) {
+	resp := decode(t, testServer().Handle(context.Background(),
+		[]byte(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`)))
+
+	result := resp["result"].(map[string]interface{})
+	if result["protocolVersion"] != ProtocolVersion {
+		t.Errorf("protocolVersion = %v, want %s", result["protocolVersion"], ProtocolVersion)
+	}
+	info := result["serverInfo"].(map[string]interface{})
+	if info["version"] != "1.2.3" {
+		t.Errorf("serverInfo.version = %v, want 1.2.3", info["version"])
+	}
+}
+
+func TestHandle_NotificationHasNoResponse(t *testing.T) {
+	if resp := testServer().Handle(context.Background(),
+		[]byte(`{"jsonrpc":"2.0","method":"notifications/initialized"}`)); resp != nil {
+		t.Errorf("expected no response for notification, got %s", resp)
+	}
+}
+
+func TestHandle_ToolsCall(t *testing.T) {
+	s := testServer()
+
+	resp := decode(t, s.Handle(context.Background(),
+		[]byte(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"echo","arguments":{"message":"hi"}}}`)))
+	result := resp["result"].(map[string]interface{})
+	if result["isError"] != false {
+		t.Errorf("isError = %v, want false", result["isError"])
+	}
+	text := result["content"].([]interface{})[0].(map[string]interface{})["text"]
+	if text != "hi" {
+		t.Errorf("text = %v, want hi", text)
+	}
+
+	// Tool failures are results, not protocol errors
+	resp = decode(t, s.Handle(context.Background(),
+		[]byte(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"echo","arguments":{}}}`)))
+	if resp["result"].(map[string]interface{})["isError"] != true {
+		t.Error("expected isError for failing tool")
+	}
+}
+
+func TestHandle_Errors(t *testing.T) {
+	tests := []struct {
+		msg  string
+		code float64
+	}{
+		{`not json`, codeParseError},
+		{`{"jsonrpc":"1.0","id":1,"method":"ping"}`, codeInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1,"method":"resources/list"}`, codeMethodNotFound},
+		{`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"nope"}}`, codeInvalidParams},
+	}
+	for _, tt := range tests {
+		resp := decode(t, testServer().Handle(context.Background(), []byte(tt.msg)))
+		rerr, ok := resp["error"].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: expected error, got %v", tt.msg, resp)
+			continue
+		}
+		if rerr["code"] != tt.code {
+			t.Errorf("%s: code = %v, want %v", tt.msg, rerr["code"], tt.code)
+		}
+	}
+}
+
+func TestServeStdio(t *testing.T) {
+	in := strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"initialize"}
+{"jsonrpc":"2.0","method":"notifications/initialized"}
+
+{"jsonrpc":"2.0","id":2,"method":"tools/list"}
+`)
+	var out bytes.Buffer
+	if err := testServer().ServeStdio(context.Background(), in, &out); err != nil {
+		t.Fatalf("ServeStdio() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d responses, want 2: %q", len(lines), out.String())
+	}
+	tools := decode(t, []byte(lines[1]))["result"].(map[string]interface{})["tools"].([]interface{})
+	if len(tools) != 1 || tools[0].(map[string]interface{})["name"] != "echo" {
+		t.Errorf("tools/list = %v", tools)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	srv := httptest.NewServer(testServer().HTTPHandler("secret"))
+	defer srv.Close()
+	ping := `{"jsonrpc":"2.0","id":1,"method":"ping"}`
+
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"authorized", "POST", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json"}, http.StatusOK},
+		{"GET", "GET", map[string]string{"Authorization": "Bearer secret"}, http.StatusMethodNotAllowed},
+		{"no token", "POST", map[string]string{"Content-Type": "application/json"}, http.StatusUnauthorized},
+		{"wrong token", "POST", map[string]string{"Authorization": "Bearer guess", "Content-Type": "application/json"}, http.StatusUnauthorized},
+		// A form or fetch without preflight can only send these types
+		{"text/plain", "POST", map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"web page origin", "POST", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Origin": "https://evil.example"}, http.StatusForbidden},
+		{"local origin", "POST", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Origin": "http://localhost:3000"}, http.StatusOK},
+		{"rebound host", "POST", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Host": "evil.example:18090"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL, strings.NewReader(ping))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.header {
+				if k == "Host" {
+					req.Host = v
+					continue
+				}
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+
+	if localHost("localhost.evil.example") || !localHost("[::1]:80") || !localHost("127.0.0.1") {
+		t.Error("localHost() misclassified a host")
+	}
+}
@@ -0,0 +1,50 @@
+// Package mirror lets the version check, the updater and config patches
+// work on networks without internet egress, from an internal mirror of the
+// distribution bucket's downloads/ prefix. A mirror is served over https://
+// or is a file:// directory, e.g. on a network share.
+package mirror
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// InstallerName is the installer's name in a mirror, as in the bucket.
+const InstallerName = "opencode-installer.zip"
+
+// Transport returns the transport for fetching rawURL, a mirror URL from
+// config: for a file:// mirror one that reads only local files, otherwise
+// nil, the default transport. No other client can read file:// URLs, so
+// never pass it a URL a server returned.
+func Transport(rawURL string) http.RoundTripper {
+	if !IsFile(rawURL) {
+		return nil
+	}
+	return http.NewFileTransport(localFS{})
+}
+
+// IsFile reports whether rawURL is a file:// URL.
+func IsFile(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "file"
+}
+
+// InstallerURL returns the installer's URL in the mirror at base.
+func InstallerURL(base string) string {
+	return strings.TrimSuffix(base, "/") + "/" + InstallerName
+}
+
+// localFS opens the paths of file:// URLs. On Windows, file:///C:/mirror
+// has the path /C:/mirror.
+type localFS struct{}
+
+func (localFS) Open(name string) (http.File, error) {
+	if runtime.GOOS == "windows" && len(name) > 2 && name[0] == '/' && name[2] == ':' {
+		name = name[1:]
+	}
+	return os.Open(filepath.FromSlash(name))
+}
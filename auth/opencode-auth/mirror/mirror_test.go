@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/configpatch"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/update"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/version"
+)
+
+// fileURL returns the file:// URL of a local path.
+func fileURL(path string) string {
+	return (&url.URL{Scheme: "file", Path: "/" + strings.TrimPrefix(filepath.ToSlash(path), "/")}).String()
+}
+
+func TestFileMirror(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"version.json":      `{"latest":"1.2.0","config_version":7}`,
+		"config-patch.json": `{"config_version":7,"patches":{"opencode.json":{"set":{"theme":"dark"}}}}`,
+		InstallerName:       "PK installer bytes",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := fileURL(dir)
+
+	// Only the mirror's transport reads files
+	if _, err := version.FetchManifest(base + "/version.json"); err == nil {
+		t.Error("FetchManifest() read a file:// URL through the default transport")
+	}
+	if Transport("https://downloads.example.com/version.json") != nil {
+		t.Error("Transport() of an https mirror is not the default")
+	}
+
+	manifest, err := version.FetchManifestWith(base+"/version.json", Transport(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Latest != "1.2.0" || manifest.ConfigVersion != 7 {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	patch, err := configpatch.FetchConfigPatchFrom(context.Background(), base+"/config-patch.json", 6, Transport(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch.ConfigVersion != 7 || patch.Patches["opencode.json"].Set["theme"] != "dark" {
+		t.Errorf("patch = %+v", patch)
+	}
+
+	zipPath, err := update.DownloadZipWith(context.Background(), InstallerURL(base+"/"), update.DownloadOptions{Dir: t.TempDir(), Transport: Transport(base)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(zipPath); !bytes.Equal(data, []byte(files[InstallerName])) {
+		t.Errorf("installer = %q", data)
+	}
+
+	if _, err := version.FetchManifestWith(base+"/missing.json", Transport(base)); err == nil {
+		t.Error("FetchManifest() of a missing file succeeded")
+	}
+}
+
+func TestIsFile(t *testing.T) {
+	for rawURL, want := range map[string]bool{
+		"file:///srv/mirror/version.json":      true,
+		"https://downloads.example.com/v.json": false,
+		"":                                     false,
+	} {
+		if got := IsFile(rawURL); got != want {
+			t.Errorf("IsFile(%q) = %v, want %v", rawURL, got, want)
+		}
+	}
+}
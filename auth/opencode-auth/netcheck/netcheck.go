@@ -0,0 +1,133 @@
+// Package netcheck recognizes captive portals, as on hotel and airport
+// Wi-Fi. Until the user signs into the network, a portal answers every
+// request itself, so a token refresh fails with a TLS error that says
+// nothing about the network. A probe of an endpoint that always answers 204
+// tells the two apart: through a portal it is redirected or gets a page.
+package netcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultProbeURL answers 204 with no body to anyone not behind a portal.
+const DefaultProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+// probeTimeout bounds the probe, which only runs after a failure
+const probeTimeout = 3 * time.Second
+
+// ProbeURL is the endpoint Probe requests.
+var ProbeURL = DefaultProbeURL
+
+// ErrCaptivePortal means the network is held by a captive portal.
+var ErrCaptivePortal = errors.New("captive portal detected — open a browser to sign into the network")
+
+// CaptivePortalError is a failed request explained by a captive portal.
+// errors.Is matches ErrCaptivePortal and anything Err matches.
+type CaptivePortalError struct {
+	// Portal is the portal's sign-in page, if it redirected the probe
+	Portal string
+	// Certificate describes the certificate the network presented in
+	// place of the real one, if that is how the request failed
+	Certificate string
+	Err         error
+}
+
+func (e *CaptivePortalError) Error() string {
+	msg := ErrCaptivePortal.Error()
+	if e.Portal != "" {
+		msg += " (" + e.Portal + ")"
+	}
+	if e.Certificate != "" {
+		msg += "; " + e.Certificate
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *CaptivePortalError) Unwrap() []error {
+	return []error{ErrCaptivePortal, e.Err}
+}
+
+// Probe requests ProbeURL without following redirects. It reports a portal
+// when the answer is anything but an empty 204, with the page it redirected
+// to, if any. An error means the probe got no answer at all, e.g. offline
+// or on a network that blocks the probe.
+func Probe(ctx context.Context) (captive bool, portal string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ProbeURL, nil)
+	if err != nil {
+		return false, "", err
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1))
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent && len(body) == 0:
+		return false, "", nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return true, resp.Header.Get("Location"), nil
+	}
+	return true, "", nil
+}
+
+// Diagnose returns err as a *CaptivePortalError when it is a connection or
+// TLS failure and the probe finds a portal, and err unchanged otherwise. A
+// certificate for another host, where the probe got no answer either,
+// counts as a portal too: some intercept every connection.
+func Diagnose(ctx context.Context, err error) error {
+	if err == nil || !connectionError(err) || errors.Is(err, ErrCaptivePortal) {
+		return err
+	}
+	captive, portal, probeErr := Probe(ctx)
+	cert, wrongHost := certificateMismatch(err)
+	if captive || (probeErr != nil && wrongHost) {
+		return &CaptivePortalError{Portal: portal, Certificate: cert, Err: err}
+	}
+	return err
+}
+
+// connectionError reports whether err is a failure to reach a server, as
+// opposed to an answer from it.
+func connectionError(err error) bool {
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	return errors.As(err, &netErr) || errors.As(err, &certErr)
+}
+
+// certificateMismatch describes the certificate behind a verification
+// failure, and whether it was for another host.
+func certificateMismatch(err error) (string, bool) {
+	var hostErr x509.HostnameError
+	if errors.As(err, &hostErr) && hostErr.Certificate != nil {
+		return fmt.Sprintf("the network presented a certificate for %s instead of %s", certName(hostErr.Certificate), hostErr.Host), true
+	}
+	var authErr x509.UnknownAuthorityError
+	if errors.As(err, &authErr) && authErr.Cert != nil {
+		return fmt.Sprintf("the network presented a certificate issued by %q, which is not trusted", authErr.Cert.Issuer.CommonName), false
+	}
+	return "", false
+}
+
+func certName(cert *x509.Certificate) string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,124 @@
+package netcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useProbe points ProbeURL at a server answering with h for the test.
+func useProbe(t *testing.T, h http.HandlerFunc) {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	useProbeURL(t, srv.URL+"/generate_204")
+}
+
+func useProbeURL(t *testing.T, u string) {
+	old := ProbeURL
+	ProbeURL = u
+	t.Cleanup(func() { ProbeURL = old })
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		captive    bool
+		wantPortal string
+	}{
+		{"open network", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}, false, ""},
+		{"redirect", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://portal.hotel.example/login", http.StatusFound)
+		}, true, "http://portal.hotel.example/login"},
+		{"login page", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html>Accept the terms to continue</html>"))
+		}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useProbe(t, tt.handler)
+			captive, portal, err := Probe(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if captive != tt.captive || portal != tt.wantPortal {
+				t.Errorf("Probe() = %v, %q, want %v, %q", captive, portal, tt.captive, tt.wantPortal)
+			}
+		})
+	}
+}
+
+func TestDiagnoseUntrustedCertificate(t *testing.T) {
+	useProbe(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://portal.hotel.example/login", http.StatusFound)
+	})
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer idp.Close()
+
+	_, err := http.Get(idp.URL)
+	if err == nil {
+		t.Fatal("expected a certificate error")
+	}
+	got := Diagnose(context.Background(), err)
+	var portalErr *CaptivePortalError
+	if !errors.As(got, &portalErr) || !errors.Is(got, ErrCaptivePortal) {
+		t.Fatalf("Diagnose() = %v, want a captive portal error", got)
+	}
+	if portalErr.Portal != "http://portal.hotel.example/login" || !strings.Contains(portalErr.Certificate, "not trusted") {
+		t.Errorf("Diagnose() = %+v", portalErr)
+	}
+	var tlsErr *tls.CertificateVerificationError
+	if !errors.As(got, &tlsErr) {
+		t.Error("Diagnose() lost the original error")
+	}
+}
+
+func TestDiagnoseWrongHostWithoutProbe(t *testing.T) {
+	// The probe is intercepted too and gets no answer
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	useProbeURL(t, unreachable.URL)
+
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer idp.Close()
+	client := idp.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.ServerName = "idp.example.org"
+
+	_, err := client.Get(idp.URL)
+	if err == nil {
+		t.Fatal("expected a certificate error")
+	}
+	var portalErr *CaptivePortalError
+	if got := Diagnose(context.Background(), err); !errors.As(got, &portalErr) {
+		t.Fatalf("Diagnose() = %v, want a captive portal error", got)
+	}
+	if !strings.Contains(portalErr.Certificate, "instead of idp.example.org") {
+		t.Errorf("Certificate = %q", portalErr.Certificate)
+	}
+}
+
+func TestDiagnoseLeavesOtherErrors(t *testing.T) {
+	useProbe(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("portal"))
+	})
+	err := errors.New("invalid_grant")
+	if got := Diagnose(context.Background(), err); got != err {
+		t.Errorf("Diagnose() = %v, want the error unchanged", got)
+	}
+
+	useProbe(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, err = http.Get(closed.URL)
+	if got := Diagnose(context.Background(), err); got != err {
+		t.Errorf("Diagnose() = %v, want the error unchanged on an open network", got)
+	}
+}
@@ -0,0 +1,179 @@
+// Package ping measures connection latency to API endpoints so users can
+// tell whether another regional deployment would serve them faster.
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sample is the latency breakdown of a single probe. TLS is zero for plain
+// HTTP endpoints.
+type Sample struct {
+	TCP       time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+}
+
+// Result collects the probes sent to one endpoint.
+type Result struct {
+	Endpoint string
+	Samples  []Sample
+	Errors   int
+	LastErr  error
+}
+
+// Prober sends latency probes. The zero value uses a 10 second timeout and
+// the system TLS configuration.
+type Prober struct {
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+}
+
+// HealthURL returns the unauthenticated health check URL for an API
+// endpoint such as "https://api.example.com/v1".
+func HealthURL(endpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), "/v1") + "/health"
+}
+
+// Probe opens a fresh connection to the endpoint's health check and times
+// the TCP connect, TLS handshake, and first response byte.
+func (p *Prober) Probe(ctx context.Context, endpoint string) (Sample, error) {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var sample Sample
+	var connectStart, tlsStart, start time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart:      func(_, _ string) { connectStart = time.Now() },
+		ConnectDone:       func(_, _ string, _ error) { sample.TCP = time.Since(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(_ tls.ConnectionState, _ error) { sample.TLS = time.Since(tlsStart) },
+		GotFirstResponseByte: func() {
+			sample.FirstByte = time.Since(start)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", HealthURL(endpoint), nil)
+	if err != nil {
+		return Sample{}, err
+	}
+
+	// A new transport per probe so every sample pays for TCP and TLS
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   p.TLSConfig,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	start = time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return Sample{}, fmt.Errorf("probe %s: %w", endpoint, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return sample, nil
+}
+
+// Run probes endpoint count times, waiting interval between probes.
+func (p *Prober) Run(ctx context.Context, endpoint string, count int, interval time.Duration) Result {
+	result := Result{Endpoint: endpoint}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return result
+			case <-time.After(interval):
+			}
+		}
+		sample, err := p.Probe(ctx, endpoint)
+		if err != nil {
+			result.Errors++
+			result.LastErr = err
+			continue
+		}
+		result.Samples = append(result.Samples, sample)
+	}
+	return result
+}
+
+// Percentile returns the p-th percentile (0-100) of the given durations
+// using the nearest-rank method, or 0 if there are none.
+func Percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(p/100*float64(len(sorted)) + 0.999999)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// Durations extracts one phase from each sample.
+func (r Result) Durations(phase func(Sample) time.Duration) []time.Duration {
+	out := make([]time.Duration, len(r.Samples))
+	for i, s := range r.Samples {
+		out[i] = phase(s)
+	}
+	return out
+}
+
+// MedianFirstByte is the p50 time to first byte, the figure used to compare
+// endpoints.
+func (r Result) MedianFirstByte() time.Duration {
+	return Percentile(r.Durations(func(s Sample) time.Duration { return s.FirstByte }), 50)
+}
+
+const (
+	// An alternate is recommended only when its median first byte is at
+	// least minImprovementRatio faster and minImprovement in absolute terms,
+	// so jitter between similar regions doesn't trigger a suggestion.
+	minImprovementRatio = 0.25
+	minImprovement      = 20 * time.Millisecond
+)
+
+// Recommend returns the alternate that is materially faster than primary,
+// or nil if none is. Endpoints without successful samples are ignored.
+func Recommend(primary Result, alternates []Result) *Result {
+	if len(primary.Samples) == 0 {
+		return nil
+	}
+	base := primary.MedianFirstByte()
+
+	var best *Result
+	for i := range alternates {
+		alt := &alternates[i]
+		if len(alt.Samples) == 0 {
+			continue
+		}
+		m := alt.MedianFirstByte()
+		if base-m < minImprovement || float64(base-m) < minImprovementRatio*float64(base) {
+			continue
+		}
+		if best == nil || m < best.MedianFirstByte() {
+			best = alt
+		}
+	}
+	return best
+}
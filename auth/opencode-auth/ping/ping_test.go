@@ -0,0 +1,107 @@
+package ping
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthURL(t *testing.T) {
+	tests := map[string]string{
+		"https://api.example.com/v1":  "https://api.example.com/health",
+		"https://api.example.com/v1/": "https://api.example.com/health",
+		"https://api.example.com":     "https://api.example.com/health",
+	}
+	for in, want := range tests {
+		if got := HealthURL(in); got != want {
+			t.Errorf("HealthURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestProbe_TLS(t *testing.T) {
+	var path string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"status":"healthy"}`))
+	}))
+	defer srv.Close()
+
+	p := &Prober{TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+	result := p.Run(context.Background(), srv.URL+"/v1", 3, time.Millisecond)
+
+	if result.Errors != 0 {
+		t.Fatalf("Errors = %d, last: %v", result.Errors, result.LastErr)
+	}
+	if len(result.Samples) != 3 {
+		t.Fatalf("got %d samples, want 3", len(result.Samples))
+	}
+	if path != "/health" {
+		t.Errorf("probed %q, want /health", path)
+	}
+	for _, s := range result.Samples {
+		// Every sample uses a new connection, so each pays for TLS
+		if s.TCP <= 0 || s.TLS <= 0 || s.FirstByte <= 0 {
+			t.Errorf("sample missing a phase: %+v", s)
+		}
+	}
+}
+
+func TestProbe_Unreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	result := (&Prober{Timeout: time.Second}).Run(context.Background(), url, 2, time.Millisecond)
+	if result.Errors != 2 || len(result.Samples) != 0 || result.LastErr == nil {
+		t.Errorf("result = %+v, want 2 errors", result)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	ms := func(vals ...int) []time.Duration {
+		out := make([]time.Duration, len(vals))
+		for i, v := range vals {
+			out[i] = time.Duration(v) * time.Millisecond
+		}
+		return out
+	}
+	data := ms(50, 10, 40, 20, 30)
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{50, 30 * time.Millisecond},
+		{90, 50 * time.Millisecond},
+		{100, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := Percentile(data, tt.p); got != tt.want {
+			t.Errorf("Percentile(p%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if Percentile(nil, 50) != 0 {
+		t.Error("Percentile(nil) should be 0")
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	result := func(endpoint string, firstByteMs int) Result {
+		return Result{Endpoint: endpoint, Samples: []Sample{{FirstByte: time.Duration(firstByteMs) * time.Millisecond}}}
+	}
+
+	primary := result("primary", 200)
+	if got := Recommend(primary, []Result{result("similar", 185)}); got != nil {
+		t.Errorf("recommended %s for a 15ms difference", got.Endpoint)
+	}
+	if got := Recommend(primary, []Result{result("fast", 120), result("faster", 80), {Endpoint: "down", Errors: 3}}); got == nil || got.Endpoint != "faster" {
+		t.Errorf("Recommend() = %v, want faster", got)
+	}
+	if got := Recommend(Result{Endpoint: "primary", Errors: 3}, []Result{result("fast", 10)}); got != nil {
+		t.Error("recommended an alternate without a primary baseline")
+	}
+}
@@ -0,0 +1,201 @@
+// Package progress renders spinners, elapsed timers and progress bars on
+// interactive terminals, degrading to plain log lines when output is not a
+// TTY or progress display is disabled.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disabled turns off live rendering everywhere (set by --no-progress).
+var Disabled bool
+
+const (
+	// redrawInterval limits how often live output is repainted
+	redrawInterval = 100 * time.Millisecond
+
+	// barWidth is the number of cells in a progress bar
+	barWidth = 30
+
+	// clearLine returns the cursor to column 0 and erases the line
+	clearLine = "\r\033[K"
+)
+
+var spinnerFrames = []string{"-", "\\", "|", "/"}
+
+// Enabled reports whether live progress can be drawn on w: progress is not
+// disabled and w is a terminal.
+func Enabled(w io.Writer) bool {
+	if Disabled || os.Getenv("OPENCODE_NO_PROGRESS") == "1" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Spinner shows an animated message with an elapsed timer until stopped.
+type Spinner struct {
+	w       io.Writer
+	msg     string
+	timeout time.Duration
+	start   time.Time
+	live    bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// StartSpinner prints msg and, on a terminal, animates it with the elapsed
+// time. A non-zero timeout also shows the time remaining.
+func StartSpinner(w io.Writer, msg string, timeout time.Duration) *Spinner {
+	s := &Spinner{
+		w:       w,
+		msg:     msg,
+		timeout: timeout,
+		start:   time.Now(),
+		live:    Enabled(w),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if !s.live {
+		fmt.Fprintf(w, "%s...\n", msg)
+		close(s.done)
+		return s
+	}
+
+	go s.run()
+	return s
+}
+
+func (s *Spinner) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(redrawInterval)
+	defer ticker.Stop()
+
+	for frame := 0; ; frame++ {
+		fmt.Fprintf(s.w, "%s%s %s", clearLine, spinnerFrames[frame%len(spinnerFrames)], s.status(time.Since(s.start)))
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			fmt.Fprint(s.w, clearLine)
+			return
+		}
+	}
+}
+
+// status formats the spinner's message with its elapsed (and remaining) time.
+func (s *Spinner) status(elapsed time.Duration) string {
+	if s.timeout > 0 {
+		remaining := s.timeout - elapsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		return fmt.Sprintf("%s... %s (times out in %s)", s.msg, formatElapsed(elapsed), formatElapsed(remaining))
+	}
+	return fmt.Sprintf("%s... %s", s.msg, formatElapsed(elapsed))
+}
+
+// Stop ends the animation and prints final, if non-empty, on its own line.
+func (s *Spinner) Stop(final string) {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	if final != "" {
+		fmt.Fprintln(s.w, final)
+	}
+}
+
+// Bar tracks a transfer of known (or unknown) size.
+type Bar struct {
+	w        io.Writer
+	msg      string
+	start    time.Time
+	live     bool
+	lastDraw time.Time
+	done     int64
+	total    int64
+}
+
+// NewBar prints msg and returns a bar to be fed with Update.
+func NewBar(w io.Writer, msg string) *Bar {
+	b := &Bar{w: w, msg: msg, start: time.Now(), live: Enabled(w)}
+	if !b.live {
+		fmt.Fprintf(w, "%s...\n", msg)
+	}
+	return b
+}
+
+// Update records done of total bytes (total <= 0 if unknown) and repaints
+// the bar at most every redrawInterval.
+func (b *Bar) Update(done, total int64) {
+	b.done, b.total = done, total
+	if !b.live || time.Since(b.lastDraw) < redrawInterval {
+		return
+	}
+	b.lastDraw = time.Now()
+	fmt.Fprintf(b.w, "%s%s %s", clearLine, b.msg, formatBar(done, total))
+}
+
+// Finish replaces the bar with a summary line.
+func (b *Bar) Finish() {
+	summary := fmt.Sprintf("%s: %s in %s", b.msg, formatBytes(b.done), formatElapsed(time.Since(b.start)))
+	if b.live {
+		fmt.Fprint(b.w, clearLine)
+	}
+	fmt.Fprintln(b.w, summary)
+}
+
+// formatBar renders "[=====>    ]  45%  2.1/4.6 MB", or just the byte count
+// when the total is unknown.
+func formatBar(done, total int64) string {
+	if total <= 0 {
+		return formatBytes(done)
+	}
+	if done > total {
+		done = total
+	}
+	filled := int(int64(barWidth) * done / total)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3d%%  %s", bar, 100*done/total, formatRatio(done, total))
+}
+
+// formatRatio renders "done/total" in the unit formatBytes picks for total.
+func formatRatio(done, total int64) string {
+	if total < 1024*1024 {
+		return fmt.Sprintf("%d/%d KB", done/1024, total/1024)
+	}
+	return fmt.Sprintf("%s/%s MB", formatMB(done), formatMB(total))
+}
+
+// formatBytes renders a byte count in KB or MB.
+func formatBytes(n int64) string {
+	if n < 1024*1024 {
+		return fmt.Sprintf("%d KB", n/1024)
+	}
+	return formatMB(n) + " MB"
+}
+
+func formatMB(n int64) string {
+	return fmt.Sprintf("%.1f", float64(n)/(1024*1024))
+}
+
+// formatElapsed renders a duration as m:ss.
+func formatElapsed(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
@@ -0,0 +1,73 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnabled_NonTerminal(t *testing.T) {
+	if Enabled(&bytes.Buffer{}) {
+		t.Error("Enabled() = true for a buffer")
+	}
+}
+
+func TestSpinner_PlainOutput(t *testing.T) {
+	var buf bytes.Buffer
+	s := StartSpinner(&buf, "Waiting for callback", time.Minute)
+	s.Stop("Done")
+	s.Stop("") // second Stop is a no-op for the animation
+
+	if got := buf.String(); got != "Waiting for callback...\nDone\n" {
+		t.Errorf("output = %q", got)
+	}
+}
+
+func TestSpinnerStatus(t *testing.T) {
+	s := &Spinner{msg: "Waiting", timeout: 5 * time.Minute}
+	if got := s.status(72 * time.Second); got != "Waiting... 1:12 (times out in 3:48)" {
+		t.Errorf("status = %q", got)
+	}
+	if got := s.status(6 * time.Minute); !strings.HasSuffix(got, "(times out in 0:00)") {
+		t.Errorf("status past timeout = %q", got)
+	}
+
+	s.timeout = 0
+	if got := s.status(5 * time.Second); got != "Waiting... 0:05" {
+		t.Errorf("status without timeout = %q", got)
+	}
+}
+
+func TestBar_PlainOutput(t *testing.T) {
+	var buf bytes.Buffer
+	b := NewBar(&buf, "Downloading installer")
+	b.Update(1024*1024, 4*1024*1024)
+	b.Update(4*1024*1024, 4*1024*1024)
+	b.Finish()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[1], "Downloading installer: 4.0 MB in ") {
+		t.Errorf("summary = %q", lines[1])
+	}
+}
+
+func TestFormatBar(t *testing.T) {
+	tests := []struct {
+		done, total int64
+		want        string
+	}{
+		{0, 100 * 1024, "[>                             ]   0%  0/100 KB"},
+		{50 * 1024, 100 * 1024, "[===============>              ]  50%  50/100 KB"},
+		{2 * 1024 * 1024, 2 * 1024 * 1024, "[==============================] 100%  2.0/2.0 MB"},
+		{3 * 1024 * 1024, 0, "3.0 MB"},
+	}
+	for _, tt := range tests {
+		if got := formatBar(tt.done, tt.total); got != tt.want {
+			t.Errorf("formatBar(%d, %d) = %q, want %q", tt.done, tt.total, got, tt.want)
+		}
+	}
+}
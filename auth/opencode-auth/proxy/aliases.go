@@ -0,0 +1,158 @@
+// Package proxy provides model aliases: proxy_model_aliases renames
+// upstream models, e.g. claude-sonnet-4 to team-default, so a config patch
+// can pin a team to an approved default. Chat completions for an alias are
+// sent upstream with the model it stands for, and /v1/models lists that
+// model under its aliases. Every rewrite is logged.
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// modelsPath is the model catalog, whose names aliases rename.
+const modelsPath = "/v1/models"
+
+// ModelAliasesStatus is the "model_aliases" section of /health.
+type ModelAliasesStatus struct {
+	Aliases  map[string]string `json:"aliases"`
+	Rewrites int64             `json:"rewrites"` // chat completions
+}
+
+// modelAliases holds the configured aliases. The zero value has none.
+type modelAliases struct {
+	mu       sync.Mutex
+	aliases  map[string]string // alias to upstream model
+	rewrites int64
+}
+
+// set replaces the aliases and reports whether they changed.
+func (a *modelAliases) set(aliases map[string]string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if reflect.DeepEqual(a.aliases, aliases) || (len(a.aliases) == 0 && len(aliases) == 0) {
+		return false
+	}
+	a.aliases = aliases
+	return true
+}
+
+func (a *modelAliases) current() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.aliases
+}
+
+// status returns the /health section, or nil without aliases.
+func (a *modelAliases) status() *ModelAliasesStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.aliases) == 0 {
+		return nil
+	}
+	return &ModelAliasesStatus{Aliases: a.aliases, Rewrites: a.rewrites}
+}
+
+// resolveModelAlias rewrites the model of a chat completion for an alias
+// to the model it stands for. It runs before the model policy, which so
+// checks the model actually sent upstream.
+func (s *Server) resolveModelAlias(r *http.Request) {
+	aliases := s.modelAliases.current()
+	if len(aliases) == 0 || r.Method != http.MethodPost || r.URL.Path != completionsPath || r.Body == nil || r.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	setBody(r, body)
+	if err != nil {
+		return
+	}
+	alias := sniffModel(body)
+	model, ok := aliases[alias]
+	if !ok {
+		return
+	}
+	var req map[string]json.RawMessage
+	if json.Unmarshal(body, &req) != nil {
+		return
+	}
+	req["model"], _ = json.Marshal(model)
+	rewritten, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	setBody(r, rewritten)
+
+	s.modelAliases.mu.Lock()
+	s.modelAliases.rewrites++
+	s.modelAliases.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "[proxy] Model alias: sending %s as %s\n", alias, model)
+}
+
+// renameListedModels lists the models in a /v1/models response under
+// their aliases. A model with several aliases is listed once per alias.
+func (s *Server) renameListedModels(resp *http.Response) error {
+	aliases := s.modelAliases.current()
+	if len(aliases) == 0 || resp.Request.Method != http.MethodGet || resp.Request.URL.Path != modelsPath ||
+		resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	byModel := make(map[string][]string)
+	for alias, model := range aliases {
+		byModel[model] = append(byModel[model], alias)
+	}
+	for _, names := range byModel {
+		sort.Strings(names)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var list map[string]json.RawMessage
+	var models []map[string]json.RawMessage
+	if json.Unmarshal(body, &list) != nil || json.Unmarshal(list["data"], &models) != nil {
+		return nil
+	}
+
+	renamed := make([]map[string]json.RawMessage, 0, len(models))
+	for _, m := range models {
+		var id string
+		json.Unmarshal(m["id"], &id)
+		names, ok := byModel[id]
+		if !ok {
+			renamed = append(renamed, m)
+			continue
+		}
+		for _, alias := range names {
+			entry := make(map[string]json.RawMessage, len(m))
+			for k, v := range m {
+				entry[k] = v
+			}
+			entry["id"], _ = json.Marshal(alias)
+			renamed = append(renamed, entry)
+			fmt.Fprintf(os.Stderr, "[proxy] Model alias: listing %s as %s\n", id, alias)
+		}
+	}
+	if list["data"], err = json.Marshal(renamed); err != nil {
+		return nil
+	}
+	rewritten, err := json.Marshal(list)
+	if err != nil {
+		return nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	return nil
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestModelAliases(t *testing.T) {
+	var sent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == modelsPath {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"object":"list","data":[{"id":"claude-sonnet-4","owned_by":"bedrock"},{"id":"claude-haiku","owned_by":"bedrock"}]}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sent = sniffModel(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		APIEndpoint:   upstream.URL,
+		AllowedModels: []string{"claude-sonnet-4"},
+		ModelAliases:  map[string]string{"team-default": "claude-sonnet-4", "fast": "claude-sonnet-4"},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	complete := func(model string) int {
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, httptest.NewRequest("POST", completionsPath, strings.NewReader(`{"model":"`+model+`","messages":[]}`)))
+		return rec.Code
+	}
+	// The policy checks the model the alias stands for
+	if code := complete("team-default"); code != http.StatusOK || sent != "claude-sonnet-4" {
+		t.Errorf("team-default: status %d, upstream got %q, want claude-sonnet-4", code, sent)
+	}
+	if code := complete("claude-haiku"); code != http.StatusForbidden {
+		t.Errorf("claude-haiku: status %d, want 403", code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest("GET", modelsPath, nil))
+	var list struct {
+		Data []struct {
+			ID      string `json:"id"`
+			OwnedBy string `json:"owned_by"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("models response %q: %v", rec.Body.String(), err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID+"/"+m.OwnedBy)
+	}
+	if got := strings.Join(ids, ","); got != "fast/bedrock,team-default/bedrock,claude-haiku/bedrock" {
+		t.Errorf("listed models = %s", got)
+	}
+
+	if st := s.modelAliases.status(); st == nil || st.Rewrites != 1 {
+		t.Errorf("status() = %+v, want 1 rewrite", st)
+	}
+}
@@ -0,0 +1,201 @@
+// Package proxy provides request annotations: static headers and body
+// fields from proxy_request_annotations, e.g. metadata.team, added to every
+// chat completion so the router can attribute, experiment and route on
+// them. A config patch changes them for a whole team at once.
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// errNotObject is returned when a body path runs through a field that is
+// not an object.
+var errNotObject = errors.New("not an object")
+
+// AnnotationsStatus is the "annotations" section of /health.
+type AnnotationsStatus struct {
+	Headers  []string `json:"headers,omitempty"`
+	Body     []string `json:"body,omitempty"` // paths
+	Requests int64    `json:"requests"`
+	// Skipped counts body paths left out because the client sent a
+	// non-object on the way
+	Skipped int64 `json:"skipped,omitempty"`
+}
+
+// annotations holds the configured annotations and how often they were
+// added. The zero value adds none.
+type annotations struct {
+	mu       sync.Mutex
+	current  *config.RequestAnnotations
+	requests int64
+	skipped  int64
+}
+
+// set replaces the annotations and reports whether they changed.
+func (a *annotations) set(ra *config.RequestAnnotations) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if reflect.DeepEqual(a.current, ra) {
+		return false
+	}
+	a.current = ra
+	return true
+}
+
+func (a *annotations) get() *config.RequestAnnotations {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current
+}
+
+// status returns the /health section, or nil without annotations.
+func (a *annotations) status() *AnnotationsStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current == nil {
+		return nil
+	}
+	st := &AnnotationsStatus{Requests: a.requests, Skipped: a.skipped}
+	for name := range a.current.Headers {
+		st.Headers = append(st.Headers, http.CanonicalHeaderKey(name))
+	}
+	for path := range a.current.Body {
+		st.Body = append(st.Body, path)
+	}
+	sort.Strings(st.Headers)
+	sort.Strings(st.Body)
+	return st
+}
+
+// applyHeaders sets the annotation headers on a chat completion. It runs
+// in the director, after the client header filter.
+func (a *annotations) applyHeaders(req *http.Request) {
+	ra := a.get()
+	if ra == nil || req.URL.Path != completionsPath {
+		return
+	}
+	for name, value := range ra.Headers {
+		if !annotationHeaderAllowed(name) {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// annotationHeaderAllowed reports whether an annotation may set name:
+// credentials, forwarding, hop-by-hop and framing headers are the proxy's.
+func annotationHeaderAllowed(name string) bool {
+	canonical := http.CanonicalHeaderKey(name)
+	switch canonical {
+	case "Host", "Content-Length", "Content-Type", "Content-Encoding":
+		return false
+	}
+	return !hopByHopHeaders[canonical] && !proxyManagedHeaders[canonical]
+}
+
+// validateAnnotations warns about annotation headers the proxy won't set.
+func validateAnnotations(ra *config.RequestAnnotations) {
+	if ra == nil {
+		return
+	}
+	for name := range ra.Headers {
+		if !annotationHeaderAllowed(name) {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_request_annotations can't set %s; ignoring it\n", http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+// annotateBody sets the annotation body fields of a chat completion and
+// counts it. It runs before the model policy and guardrails, so they see
+// the body that is sent upstream.
+func (s *Server) annotateBody(r *http.Request) *http.Request {
+	ra := s.annotations.get()
+	if ra == nil || r.Method != http.MethodPost || r.URL.Path != completionsPath {
+		return r
+	}
+	var skipped int64
+	if len(ra.Body) > 0 && r.Body != nil && r.Header.Get("Content-Encoding") == "" {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		setBody(r, body)
+		if err != nil {
+			return r
+		}
+		var req map[string]json.RawMessage
+		if json.Unmarshal(body, &req) != nil {
+			return r
+		}
+		for path, value := range ra.Body {
+			if config.ReservedBodyPath(path) {
+				// Config validation refuses these; never change what the
+				// model policy and guardrails check
+				skipped++
+				continue
+			}
+			if err := setBodyPath(req, strings.Split(path, "."), value); err != nil {
+				skipped++
+				if s.config.Debug {
+					fmt.Fprintf(os.Stderr, "[proxy] Not annotating %s: %v\n", path, err)
+				}
+			}
+		}
+		if annotated, err := json.Marshal(req); err == nil {
+			setBody(r, annotated)
+		}
+	}
+
+	s.annotations.mu.Lock()
+	s.annotations.requests++
+	s.annotations.skipped += skipped
+	s.annotations.mu.Unlock()
+	return r
+}
+
+// setBodyPath sets the field at path in obj to value, creating the objects
+// on the way. An object value is merged field by field. A field on the way
+// that is not an object is left alone.
+func setBodyPath(obj map[string]json.RawMessage, path []string, value interface{}) error {
+	if fields, ok := value.(map[string]interface{}); ok && len(fields) > 0 {
+		var errs []error
+		for key, v := range fields {
+			if err := setBodyPath(obj, append(path[:len(path):len(path)], key), v); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	if len(path) == 1 {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		obj[path[0]] = raw
+		return nil
+	}
+	child := map[string]json.RawMessage{}
+	if raw, ok := obj[path[0]]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &child); err != nil || child == nil {
+			return fmt.Errorf("%s is %w", path[0], errNotObject)
+		}
+	}
+	if err := setBodyPath(child, path[1:], value); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(child)
+	if err != nil {
+		return err
+	}
+	obj[path[0]] = raw
+	return nil
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestAnnotations(t *testing.T) {
+	var got struct {
+		header http.Header
+		body   map[string]interface{}
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.header = r.Header.Clone()
+		got.body = nil
+		json.NewDecoder(r.Body).Decode(&got.body)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: upstream.URL,
+		Annotations: &config.RequestAnnotations{
+			Headers: map[string]string{"X-Team": "payments", "Authorization": "Bearer spoofed"},
+			Body: map[string]interface{}{
+				"metadata.team":   "payments",
+				"temperature.max": 1,
+				// Objects merge, keeping the client's other fields
+				"metadata": map[string]interface{}{"cohort": map[string]interface{}{"id": 7}},
+			},
+		},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(path, body string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-Team", "spoofed")
+		s.handleRequest(httptest.NewRecorder(), req)
+	}
+
+	send(completionsPath, `{"model":"m","messages":[],"metadata":{"team":"spoofed","user":"dev"},"temperature":0.2}`)
+	if got.header.Get("X-Team") != "payments" || got.header.Get("Authorization") != "Bearer id-token" {
+		t.Errorf("headers = %v", got.header)
+	}
+	want := map[string]interface{}{"team": "payments", "user": "dev", "cohort": map[string]interface{}{"id": 7.0}}
+	if b, _ := json.Marshal(got.body["metadata"]); string(b) != mustJSON(t, want) {
+		t.Errorf("metadata = %s, want %s", b, mustJSON(t, want))
+	}
+	if got.body["model"] != "m" || got.body["temperature"] != 0.2 {
+		t.Errorf("body = %v", got.body)
+	}
+
+	// Other routes are left alone
+	send("/v1/models", `{}`)
+	if got.header.Get("X-Team") != "" || got.body["metadata"] != nil {
+		t.Errorf("other route annotated: %v %v", got.header, got.body)
+	}
+
+	st := s.annotations.status()
+	if st == nil || st.Requests != 1 || st.Skipped != 1 || strings.Join(st.Body, ",") != "metadata,metadata.team,temperature.max" {
+		t.Errorf("status() = %+v", st)
+	}
+
+	if s.annotations.set(nil); s.annotations.status() != nil {
+		t.Error("status() after removing the annotations is not nil")
+	}
+}
+
+func TestAnnotationsCannotChangeModel(t *testing.T) {
+	// Config validation refuses the fields the policy and guardrails check
+	for _, path := range []string{"model", "max_tokens", "stream_options.include_usage", "messages"} {
+		oc := &config.OpenCodeConfig{ProxyRequestAnnotations: &config.RequestAnnotations{Body: map[string]interface{}{path: "x"}}}
+		if err := oc.ApplyTunables(&config.Config{}); err == nil {
+			t.Errorf("ApplyTunables() accepted an annotation of %s", path)
+		}
+	}
+
+	// An annotation that got past validation is still not applied
+	var sent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sent = sniffModel(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		APIEndpoint:   upstream.URL,
+		AllowedModels: []string{"claude-haiku"},
+		Annotations:   &config.RequestAnnotations{Body: map[string]interface{}{"model": "claude-opus"}},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest("POST", completionsPath, strings.NewReader(`{"model":"claude-haiku","messages":[]}`)))
+	if rec.Code != http.StatusOK || sent != "claude-haiku" {
+		t.Errorf("status %d, upstream got model %q, want claude-haiku", rec.Code, sent)
+	}
+	if st := s.annotations.status(); st == nil || st.Skipped != 1 {
+		t.Errorf("status() = %+v, want 1 skipped", st)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
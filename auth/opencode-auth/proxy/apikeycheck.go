@@ -0,0 +1,145 @@
+// Package proxy provides validation of the configured API key, so a revoked or
+// expired key falls back to JWT auth instead of failing every request.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// apiKeyCheckInterval is how often the proxy revalidates its API key
+const apiKeyCheckInterval = 15 * time.Minute
+
+// APIKeyState is the outcome of the last API key validation, reported under
+// "api_key" in /health.
+type APIKeyState struct {
+	Prefix    string    `json:"prefix"`
+	Valid     bool      `json:"valid"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// apiKeyValidator holds the latest API key validation result.
+type apiKeyValidator struct {
+	mu    sync.RWMutex
+	state *APIKeyState // nil until the first conclusive check
+}
+
+func (v *apiKeyValidator) get() *APIKeyState {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.state
+}
+
+// rejected reports whether the router refused the key on the last check.
+func (v *apiKeyValidator) rejected() bool {
+	state := v.get()
+	return state != nil && !state.Valid
+}
+
+func (v *apiKeyValidator) set(state *APIKeyState) *APIKeyState {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	prev := v.state
+	v.state = state
+	return prev
+}
+
+// checkAPIKey authenticates a lightweight request (GET /v1/models) with key.
+// It returns valid=false and the router's error code when the key is
+// rejected, and an error when the check itself could not be completed.
+func checkAPIKey(ctx context.Context, client *http.Client, target *url.URL, key, clientVersion string) (valid bool, reason string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String()+"/v1/models", nil)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("X-API-Key", key)
+	if clientVersion != "" {
+		req.Header.Set("X-Client-Version", clientVersion)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("API key check failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, "", nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		var errResp struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error.Code != "" {
+			reason = errResp.Error.Code
+		}
+		return false, reason, nil
+	default:
+		return false, "", fmt.Errorf("API key check returned status %d", resp.StatusCode)
+	}
+}
+
+// validateAPIKey checks the configured API key and records the result.
+// Inconclusive checks (network errors, 5xx) keep the previous state.
+func (s *Server) validateAPIKey(ctx context.Context) {
+	key := s.config.APIKey
+	if key == "" {
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	valid, reason, err := checkAPIKey(ctx, client, s.targetURL, key, s.ClientVersion)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: %v\n", err)
+		return
+	}
+
+	prefix := key
+	if len(prefix) > 10 {
+		prefix = prefix[:10]
+	}
+	prev := s.apiKey.set(&APIKeyState{Prefix: prefix, Valid: valid, Reason: reason, CheckedAt: time.Now()})
+
+	switch {
+	case !valid && (prev == nil || prev.Valid):
+		fmt.Fprintf(os.Stderr, "[proxy] WARNING: API key %s... was rejected (%s); falling back to JWT auth.\n", prefix, reason)
+		fmt.Fprintf(os.Stderr, "[proxy] Create a new key with 'opencode-auth apikey create --save'.\n")
+		s.events.publish(Event{Type: EventAPIKeyRejected, Reason: reason, Message: fmt.Sprintf("API key %s... was rejected; using JWT auth", prefix)})
+	case valid && prev != nil && !prev.Valid:
+		fmt.Fprintf(os.Stderr, "[proxy] API key %s... is accepted again; resuming API key auth\n", prefix)
+		s.events.publish(Event{Type: EventAPIKeyAccepted, Message: fmt.Sprintf("API key %s... is accepted again", prefix)})
+	}
+}
+
+// watchAPIKey validates the API key at startup and every apiKeyCheckInterval
+// until the server stops.
+func (s *Server) watchAPIKey() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stopChan
+		cancel()
+	}()
+
+	s.validateAPIKey(ctx)
+	ticker := time.NewTicker(apiKeyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.validateAPIKey(ctx)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// keyCheckBackend accepts only the given API key on /v1/models, answering
+// others the way the router does for revoked keys.
+func keyCheckBackend(t *testing.T, goodKey string, status *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *status != 0 {
+			w.WriteHeader(*status)
+			return
+		}
+		if r.Header.Get("X-API-Key") != goodKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"message":"API key has been revoked","type":"auth_error","code":"revoked_api_key"}}`))
+			return
+		}
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+}
+
+func apiKeyTestServer(t *testing.T, backendURL, key string) *Server {
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "jwt-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	server, err := newServerInternal(&config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: backendURL + "/v1",
+		APIKey:      key,
+	}, 0, false)
+	if err != nil {
+		t.Fatalf("newServerInternal() error = %v", err)
+	}
+	return server
+}
+
+func authHeaders(server *Server) (apiKey, bearer string) {
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", nil)
+	server.addAuthHeader(req)
+	return req.Header.Get("X-API-Key"), req.Header.Get("Authorization")
+}
+
+func TestValidateAPIKey_RejectedFallsBackToJWT(t *testing.T) {
+	var status int
+	backend := keyCheckBackend(t, "oc_good_key_123", &status)
+	defer backend.Close()
+
+	server := apiKeyTestServer(t, backend.URL, "oc_revoked_key_456")
+	server.validateAPIKey(context.Background())
+
+	state := server.apiKey.get()
+	if state == nil || state.Valid || state.Reason != "revoked_api_key" || state.Prefix != "oc_revoked" {
+		t.Fatalf("state = %+v, want rejected with revoked_api_key", state)
+	}
+
+	apiKey, bearer := authHeaders(server)
+	if apiKey != "" || bearer != "Bearer jwt-token" {
+		t.Errorf("headers = X-API-Key %q, Authorization %q; want JWT fallback", apiKey, bearer)
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		APIKey *APIKeyState `json:"api_key"`
+	}
+	json.NewDecoder(rec.Body).Decode(&health)
+	if health.APIKey == nil || health.APIKey.Valid {
+		t.Errorf("/health api_key = %+v, want rejected state", health.APIKey)
+	}
+}
+
+func TestValidateAPIKey_ValidKeyIsUsed(t *testing.T) {
+	var status int
+	backend := keyCheckBackend(t, "oc_good_key_123", &status)
+	defer backend.Close()
+
+	server := apiKeyTestServer(t, backend.URL, "oc_good_key_123")
+	server.validateAPIKey(context.Background())
+
+	if state := server.apiKey.get(); state == nil || !state.Valid {
+		t.Fatalf("state = %+v, want valid", state)
+	}
+	if apiKey, _ := authHeaders(server); apiKey != "oc_good_key_123" {
+		t.Errorf("X-API-Key = %q, want the configured key", apiKey)
+	}
+}
+
+func TestValidateAPIKey_InconclusiveKeepsState(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	backend := keyCheckBackend(t, "oc_good_key_123", &status)
+	defer backend.Close()
+
+	server := apiKeyTestServer(t, backend.URL, "oc_good_key_123")
+
+	// An outage before any conclusive check must not disable the key
+	server.validateAPIKey(context.Background())
+	if server.apiKey.get() != nil {
+		t.Fatalf("state = %+v, want none after an inconclusive check", server.apiKey.get())
+	}
+	if apiKey, _ := authHeaders(server); apiKey != "oc_good_key_123" {
+		t.Errorf("X-API-Key = %q, want the configured key", apiKey)
+	}
+
+	// Nor may it re-enable a rejected key
+	server.apiKey.set(&APIKeyState{Valid: false, Reason: "expired_api_key"})
+	server.validateAPIKey(context.Background())
+	if !server.apiKey.rejected() {
+		t.Error("inconclusive check cleared the rejected state")
+	}
+}
@@ -0,0 +1,113 @@
+// Package proxy provides configurable auth headers, for upstreams that take
+// credentials in a header other than Authorization: Bearer.
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// AuthHeaderData is what a proxy_auth_headers format can refer to, e.g.
+// "Bearer {{.IDToken}}" or "{{.APIKey}}".
+type AuthHeaderData struct {
+	IDToken     string
+	AccessToken string
+	APIKey      string
+	// Token is the credential the proxy would otherwise send: the API key
+	// when one is in use, otherwise the route's bearer token
+	Token string
+	Email string
+}
+
+// authHeaderTemplates caches parsed formats by format string.
+var authHeaderTemplates sync.Map
+
+func parseAuthHeader(format string) (*template.Template, error) {
+	if t, ok := authHeaderTemplates.Load(format); ok {
+		return t.(*template.Template), nil
+	}
+	t, err := template.New("auth_header").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	authHeaderTemplates.Store(format, t)
+	return t, nil
+}
+
+// renderAuthHeader fills in the route's format. An empty result is an error,
+// so a route never sends a header without a credential in it.
+func renderAuthHeader(h *config.AuthHeader, data AuthHeaderData) (string, error) {
+	t, err := parseAuthHeader(h.Format)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(buf.String())
+	if value == "" {
+		return "", fmt.Errorf("format %q rendered an empty value", h.Format)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("format %q rendered a value containing a line break", h.Format)
+	}
+	return value, nil
+}
+
+// validateAuthHeaders warns about proxy_auth_headers entries that can never
+// be used. Such routes fall back to the default auth header at request time.
+func validateAuthHeaders(headers []config.AuthHeader) {
+	for _, h := range headers {
+		switch {
+		case h.Name == "" || strings.ContainsAny(h.Name, " :\r\n"):
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_auth_headers entry for %q has invalid name %q\n", h.PathPrefix, h.Name)
+		case h.Format == "":
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_auth_headers entry %s has no format\n", h.Name)
+		default:
+			if _, err := parseAuthHeader(h.Format); err != nil {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_auth_headers entry %s: %v\n", h.Name, err)
+			}
+		}
+	}
+}
+
+// setRouteAuthHeader sets the header configured for req's route. It reports
+// false when no route matches or the header can't be rendered, in which case
+// the caller sets the default header.
+func (s *Server) setRouteAuthHeader(req *http.Request, data AuthHeaderData) bool {
+	h := config.MatchAuthHeader(s.currentAuthHeaders(), s.targetURL.Host, req.URL.Path)
+	if h == nil || h.Name == "" {
+		return false
+	}
+	value, err := renderAuthHeader(h, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: auth header %s for %s: %v; using default header\n", h.Name, req.URL.Path, err)
+		return false
+	}
+	if s.config.Debug {
+		fmt.Fprintf(os.Stderr, "[proxy] Using %s auth header for %s\n", h.Name, req.URL.Path)
+	}
+	req.Header.Set(h.Name, value)
+	return true
+}
+
+// authHeaderData returns the template data for a JWT-authenticated request
+// whose bearer token is token.
+func (s *Server) authHeaderData(tokens *auth.TokenData, token string) AuthHeaderData {
+	return AuthHeaderData{
+		IDToken:     tokens.IDToken,
+		AccessToken: tokens.AccessToken,
+		APIKey:      s.config.APIKey,
+		Token:       token,
+		Email:       tokens.Email,
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestRouteAuthHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	headers := []config.AuthHeader{
+		{PathPrefix: "/internal/", Name: "x-amzn-oidc-data", Format: "{{.IDToken}}"},
+		{PathPrefix: "/internal/keys/", Name: "X-Service-Key", Format: "Key {{.APIKey}}"},
+		{PathPrefix: "/broken/", Name: "X-Broken", Format: "{{.NoSuchField}}"},
+	}
+	send := func(cfg *config.Config, path string) {
+		t.Helper()
+		server, err := newServerInternal(cfg, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+		defer front.Close()
+
+		req, _ := http.NewRequest("GET", front.URL+path, nil)
+		req.Header.Set("X-Amzn-Oidc-Data", "smuggled")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	jwt := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, AuthHeaders: headers}
+	send(jwt, "/internal/search")
+	if v := got.Get("X-Amzn-Oidc-Data"); v != "id-token" || got.Get("Authorization") != "" {
+		t.Errorf("jwt route: x-amzn-oidc-data = %q, Authorization = %q", v, got.Get("Authorization"))
+	}
+
+	// Other paths keep the default bearer header, and the client's copy of
+	// a route header is dropped
+	send(jwt, "/v1/models")
+	if got.Get("Authorization") != "Bearer id-token" || got.Get("X-Amzn-Oidc-Data") != "" {
+		t.Errorf("default route: headers = %v", got)
+	}
+
+	// A format that fails to render falls back to the default header
+	send(jwt, "/broken/x")
+	if got.Get("Authorization") != "Bearer id-token" || got.Get("X-Broken") != "" {
+		t.Errorf("broken route: headers = %v", got)
+	}
+
+	// The longest prefix wins, and API key formats can use the key
+	apiKey := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, APIKey: "oc_configured_key", AuthHeaders: headers}
+	send(apiKey, "/internal/keys/list")
+	if v := got.Get("X-Service-Key"); v != "Key oc_configured_key" || got.Get("X-API-Key") != "" {
+		t.Errorf("api key route: X-Service-Key = %q, X-API-Key = %q", v, got.Get("X-API-Key"))
+	}
+	send(apiKey, "/internal/search")
+	if v := got.Get("X-Amzn-Oidc-Data"); v != "id-token" {
+		t.Errorf("api key mode, token route: x-amzn-oidc-data = %q", v)
+	}
+}
+
+func TestRenderAuthHeader(t *testing.T) {
+	data := AuthHeaderData{IDToken: "id", APIKey: "key"}
+	for _, tt := range []struct {
+		format, want string
+		wantErr      bool
+	}{
+		{format: "Bearer {{.IDToken}}", want: "Bearer id"},
+		{format: "{{.APIKey}}", want: "key"},
+		{format: "{{.AccessToken}}", wantErr: true}, // empty
+		{format: "{{.IDToken", wantErr: true},       // parse error
+		{format: "a\n{{.IDToken}}", wantErr: true},  // header injection
+		{format: "{{.Unknown}}", wantErr: true},     // unknown field
+	} {
+		got, err := renderAuthHeader(&config.AuthHeader{Name: "X", Format: tt.format}, data)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("render %q = %q, %v", tt.format, got, err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package proxy provides the token broker. Wrapper scripts and MCP servers
+// exchange the user's session for a child token through
+// /api/token/exchange and send it to the proxy's helper listener instead of
+// the user's token. A child token is only good at that listener, for one
+// path and optionally one model, for at most 15 minutes, so a helper tool
+// never sees the ID token or the refresh token.
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ChildTokenPrefix starts every child token, so the proxy can tell them
+	// from other bearer tokens a client sends
+	ChildTokenPrefix = "occ_"
+
+	// ChildTokenMaxTTL is the longest a child token lives, and the default
+	ChildTokenMaxTTL = 15 * time.Minute
+
+	// maxChildTokens bounds the live child tokens; the oldest is dropped
+	// when a new one would exceed it
+	maxChildTokens = 256
+)
+
+// ExchangeRequest is the body of POST /api/token/exchange.
+type ExchangeRequest struct {
+	// Path is the request path the token is good for, e.g.
+	// /v1/chat/completions; it also covers paths below it
+	Path string `json:"path"`
+	// Model, if set, limits the token to requests naming a matching model
+	// (a path.Match pattern, as in proxy_allowed_models)
+	Model string `json:"model,omitempty"`
+	// TTL is how long the token lives, e.g. "5m"; at most and by default
+	// ChildTokenMaxTTL
+	TTL string `json:"ttl,omitempty"`
+}
+
+// ExchangeResponse is the response of /api/token/exchange.
+type ExchangeResponse struct {
+	Token string `json:"token,omitempty"`
+	// BaseURL is the helper listener, the only place the token is accepted
+	BaseURL   string    `json:"base_url,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// BrokerStatus is the "broker" section of /health.
+type BrokerStatus struct {
+	Active    int    `json:"active"`
+	Issued    int64  `json:"issued"`
+	Refused   int64  `json:"refused"`
+	HelperURL string `json:"helper_url,omitempty"`
+}
+
+// childToken is the scope of an issued child token.
+type childToken struct {
+	path      string
+	model     string
+	expiresAt time.Time
+}
+
+// allows reports whether the token covers a request to path for model.
+func (c *childToken) allows(path, model string) bool {
+	scope := strings.TrimSuffix(c.path, "/")
+	if path != c.path && path != scope && !strings.HasPrefix(path, scope+"/") {
+		return false
+	}
+	return c.model == "" || modelAllowed([]string{c.model}, model)
+}
+
+// cleanPath reports whether p is already in canonical form: no "." or ".."
+// segments, no doubled or trailing slash, and, in the escaped form, no
+// encoded slash or dot. Anything else could climb out of a token's scope
+// once the upstream cleans it, so it is refused rather than cleaned here.
+func cleanPath(p, escaped string) bool {
+	escaped = strings.ToLower(escaped)
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%2e") {
+		return false
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return path.Clean(p) == p
+}
+
+// tokenBroker holds the live child tokens. The zero value is ready to use;
+// tokens don't survive a proxy restart.
+type tokenBroker struct {
+	now func() time.Time // for tests; nil means time.Now
+
+	mu      sync.Mutex
+	tokens  map[string]*childToken
+	issued  int64
+	refused int64
+}
+
+func (b *tokenBroker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// issue creates a child token for req.
+func (b *tokenBroker) issue(req ExchangeRequest) (string, *childToken, error) {
+	if !strings.HasPrefix(req.Path, "/") {
+		return "", nil, fmt.Errorf("path must start with /")
+	}
+	if !cleanPath(req.Path, req.Path) {
+		return "", nil, fmt.Errorf("path %s is not in canonical form", req.Path)
+	}
+	if strings.HasPrefix(req.Path, "/api/") || req.Path == "/health" {
+		return "", nil, fmt.Errorf("path %s is a proxy endpoint", req.Path)
+	}
+	ttl := ChildTokenMaxTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			return "", nil, fmt.Errorf("invalid ttl %q", req.TTL)
+		}
+		if d < ttl {
+			ttl = d
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := ChildTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	child := &childToken{path: req.Path, model: req.Model, expiresAt: b.clock().Add(ttl)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	if b.tokens == nil {
+		b.tokens = make(map[string]*childToken)
+	}
+	if len(b.tokens) >= maxChildTokens {
+		var oldest string
+		for t, c := range b.tokens {
+			if oldest == "" || c.expiresAt.Before(b.tokens[oldest].expiresAt) {
+				oldest = t
+			}
+		}
+		delete(b.tokens, oldest)
+	}
+	b.tokens[token] = child
+	b.issued++
+	return token, child, nil
+}
+
+// lookup returns the scope of a live child token, or nil.
+func (b *tokenBroker) lookup(token string) *childToken {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.tokens[token]
+	if c == nil || !b.clock().Before(c.expiresAt) {
+		return nil
+	}
+	return c
+}
+
+func (b *tokenBroker) refuse() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refused++
+}
+
+// revokeAll drops every child token, e.g. when the session locks.
+func (b *tokenBroker) revokeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = nil
+}
+
+// prune drops expired tokens. Called with mu held.
+func (b *tokenBroker) prune() {
+	now := b.clock()
+	for t, c := range b.tokens {
+		if !now.Before(c.expiresAt) {
+			delete(b.tokens, t)
+		}
+	}
+}
+
+// status returns the /health section, or nil before any token was issued.
+func (b *tokenBroker) status() *BrokerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.issued == 0 {
+		return nil
+	}
+	b.prune()
+	return &BrokerStatus{Active: len(b.tokens), Issued: b.issued, Refused: b.refused}
+}
+
+// handleTokenExchange issues a child token (POST). It needs a usable
+// session, since the child token is only as good as the user's.
+func (s *Server) handleTokenExchange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ExchangeResponse{Error: "method not allowed"})
+		return
+	}
+	var req ExchangeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ExchangeResponse{Error: "invalid request: " + err.Error()})
+		return
+	}
+	// A child token can't be exchanged for another
+	if _, ok := childTokenFrom(r); ok {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ExchangeResponse{Error: "child tokens cannot be exchanged"})
+		return
+	}
+	if s.helperURL() == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ExchangeResponse{Error: "the helper listener is not running; see the proxy log"})
+		return
+	}
+	if !s.usesAPIKey(req.Path) && !s.tokenStatus().Valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ExchangeResponse{Error: "reauth_required"})
+		return
+	}
+
+	token, child, err := s.broker.issue(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ExchangeResponse{Error: err.Error()})
+		return
+	}
+	scope := child.path
+	if child.model != "" {
+		scope += " (model " + child.model + ")"
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Issued child token for %s, expires %s\n", scope, child.expiresAt.Local().Format(time.Kitchen))
+	json.NewEncoder(w).Encode(ExchangeResponse{Token: token, BaseURL: s.helperURL(), Path: child.path, Model: child.model, ExpiresAt: child.expiresAt})
+}
+
+// childTokenFrom returns the child token a request carries as its bearer
+// token, if any.
+func childTokenFrom(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(token, ChildTokenPrefix) {
+		return "", false
+	}
+	return token, true
+}
+
+// checkChildToken refuses a request with a child token that is unknown,
+// expired, scoped to another path or model, sent with a path that is not in
+// canonical form, or not sent to the helper listener. Requests without one are left alone; the helper listener
+// refuses those before. It reports whether the request was answered.
+func (s *Server) checkChildToken(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := childTokenFrom(r)
+	if !ok {
+		return false
+	}
+	if !isHelperRequest(r) {
+		s.refuseOffHelperListener(w)
+		return true
+	}
+	// The proxy sets the upstream credentials; the child token never
+	// leaves this machine
+	r.Header.Del("Authorization")
+
+	child := s.broker.lookup(token)
+	if child == nil {
+		s.broker.refuse()
+		writeProxyError(w, http.StatusUnauthorized, "invalid_child_token",
+			"The child token is unknown or expired. Request a new one from /api/token/exchange.")
+		return true
+	}
+	if !cleanPath(r.URL.Path, r.URL.EscapedPath()) {
+		s.broker.refuse()
+		fmt.Fprintf(os.Stderr, "[proxy] Refused %s %s: path is not in canonical form\n", r.Method, r.URL.EscapedPath())
+		writeProxyError(w, http.StatusForbidden, "child_token_scope",
+			"The request path must not contain dot segments, doubled or encoded slashes, or encoded dots.")
+		return true
+	}
+	var model string
+	if child.model != "" && r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeProxyError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Failed to read request body: %v", err))
+			return true
+		}
+		setBody(r, body)
+		model = sniffModel(body)
+	}
+	if !child.allows(r.URL.Path, model) {
+		s.broker.refuse()
+		fmt.Fprintf(os.Stderr, "[proxy] Refused %s %s: outside the child token's scope\n", r.Method, r.URL.Path)
+		msg := fmt.Sprintf("The child token is limited to %s", child.path)
+		if child.model != "" {
+			msg += fmt.Sprintf(" and model %s", child.model)
+		}
+		writeProxyError(w, http.StatusForbidden, "child_token_scope", msg+".")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestTokenBroker(t *testing.T) {
+	var upstreamAuth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = append(upstreamAuth, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", RefreshToken: "rt", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: upstream.URL, SessionIdleTimeout: time.Hour}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.broker.now = func() time.Time { return now }
+	s.listenHelpers()
+	defer s.helpers.Close()
+
+	exchange := func(body string) (int, ExchangeResponse) {
+		rec := httptest.NewRecorder()
+		s.handleTokenExchange(rec, httptest.NewRequest("POST", "/api/token/exchange", strings.NewReader(body)))
+		var resp ExchangeResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	code, child := exchange(`{"path":"/v1/chat/completions","model":"claude-*","ttl":"1h"}`)
+	if code != http.StatusOK || !strings.HasPrefix(child.Token, ChildTokenPrefix) || child.BaseURL != s.helperURL() {
+		t.Fatalf("exchange = %d %+v", code, child)
+	}
+	if got := child.ExpiresAt.Sub(now); got != ChildTokenMaxTTL {
+		t.Errorf("ttl = %v, want capped at %v", got, ChildTokenMaxTTL)
+	}
+	for _, body := range []string{`{"path":"v1"}`, `{"path":"/api/token"}`, `{"path":"/v1/models","ttl":"soon"}`, `{"path":"/v1/models/../../api/token"}`} {
+		if code, _ := exchange(body); code != http.StatusBadRequest {
+			t.Errorf("exchange %s = %d, want 400", body, code)
+		}
+	}
+
+	send := func(token, path, body string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.helperHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, tc := range []struct {
+		token, path, body string
+		want              int
+	}{
+		{child.Token, "/v1/chat/completions", `{"model":"claude-sonnet"}`, http.StatusOK},
+		{child.Token, "/v1/chat/completions", `{"model":"gpt-4"}`, http.StatusForbidden},
+		{child.Token, "/v1/chat/completions", `{}`, http.StatusForbidden},
+		{child.Token, "/v1/embeddings", `{"model":"claude-sonnet"}`, http.StatusForbidden},
+		// Paths that would climb out of the scope once cleaned upstream
+		{child.Token, "/v1/chat/completions/../../v1/api-keys", `{"model":"claude-sonnet"}`, http.StatusForbidden},
+		{child.Token, "/v1/chat/completions/%2e%2e/%2E%2E/v1/api-keys", `{"model":"claude-sonnet"}`, http.StatusForbidden},
+		{child.Token, "/v1/chat/completions%2f..%2f..%2fv1/api-keys", `{"model":"claude-sonnet"}`, http.StatusForbidden},
+		{child.Token, "/v1/chat/completions//x", `{"model":"claude-sonnet"}`, http.StatusForbidden},
+		{ChildTokenPrefix + "forged", "/v1/chat/completions", `{"model":"claude-sonnet"}`, http.StatusUnauthorized},
+		// The helper listener takes nothing but child tokens
+		{"id-token", "/v1/chat/completions", `{"model":"claude-sonnet"}`, http.StatusUnauthorized},
+		{"", "/v1/chat/completions", `{"model":"claude-sonnet"}`, http.StatusUnauthorized},
+	} {
+		if got := send(tc.token, tc.path, tc.body); got != tc.want {
+			t.Errorf("%s %s with %.8s...: status %d, want %d", tc.path, tc.body, tc.token, got, tc.want)
+		}
+	}
+	if len(upstreamAuth) != 1 || upstreamAuth[0] != "Bearer id-token" {
+		t.Errorf("upstream saw Authorization %q, want only the user's token once", upstreamAuth)
+	}
+
+	// The main listener refuses child tokens on every route
+	main := s.refuseChildTokens(http.HandlerFunc(s.handleGetToken))
+	for _, path := range []string{"/v1/chat/completions", "/api/token"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"model":"claude-sonnet"}`))
+		req.Header.Set("Authorization", "Bearer "+child.Token)
+		main.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s with a child token on the main listener = %d, want 403", path, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"claude-sonnet"}`))
+	req.Header.Set("Authorization", "Bearer "+child.Token)
+	if s.handleRequest(rec, req); rec.Code != http.StatusForbidden {
+		t.Errorf("handleRequest off the helper listener = %d, want 403", rec.Code)
+	}
+
+	// A child token can't mint another
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/api/token/exchange", strings.NewReader(`{"path":"/v1/models"}`))
+	req.Header.Set("Authorization", "Bearer "+child.Token)
+	s.handleTokenExchange(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("exchange with a child token = %d, want 403", rec.Code)
+	}
+
+	now = now.Add(ChildTokenMaxTTL)
+	if got := send(child.Token, "/v1/chat/completions", `{"model":"claude-sonnet"}`); got != http.StatusUnauthorized {
+		t.Errorf("expired child token: status %d, want 401", got)
+	}
+	if st := s.broker.status(); st == nil || st.Active != 0 || st.Issued != 1 || st.Refused != 14 {
+		t.Errorf("status() = %+v", st)
+	}
+
+	// Signing out revokes child tokens
+	_, child = exchange(`{"path":"/v1/models"}`)
+	s.lockSession()
+	if s.broker.lookup(child.Token) != nil {
+		t.Error("child token survived the session lock")
+	}
+	if code, _ := exchange(`{"path":"/v1/models"}`); code != http.StatusUnauthorized {
+		t.Errorf("exchange without a session = %d, want 401", code)
+	}
+}
@@ -0,0 +1,171 @@
+// Package proxy provides the soft daily token budget (usage_budget). Unlike
+// the daily_token_budget guardrail it refuses nothing: the user gets one
+// desktop notification when today's usage reaches 80% of it and one when it
+// reaches 100%, and /health shows how fast the budget is being used.
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// budgetThresholds are the percentages of the budget that notify, in order.
+var budgetThresholds = []int{80, 100}
+
+// budgetNotifier shows the desktop notification. Replaced in tests.
+var budgetNotifier = notifyDesktop
+
+// UsageBudgetStatus is the "usage_budget" section of /health.
+type UsageBudgetStatus struct {
+	Budget  int     `json:"budget"`
+	Used    int     `json:"used"` // tokens reported today
+	Percent float64 `json:"percent"`
+	// BurnRate is the tokens reported in the last hour
+	BurnRate int `json:"burn_rate_per_hour"`
+	// ExhaustedAt is when the budget runs out at the burn rate, if that is
+	// before midnight and it has not run out yet
+	ExhaustedAt *time.Time `json:"exhausted_at,omitempty"`
+	// Notified lists the thresholds notified today
+	Notified []int `json:"notified,omitempty"`
+}
+
+// usageBudget remembers which thresholds were notified, per day.
+type usageBudget struct {
+	mu       sync.Mutex
+	budget   int
+	date     string
+	notified []int
+}
+
+// set replaces the budget and returns the previous one. A new budget is
+// notified about afresh.
+func (b *usageBudget) set(budget int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.budget
+	if budget != prev {
+		b.budget = budget
+		b.notified = nil
+	}
+	return prev
+}
+
+func (b *usageBudget) get() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.budget
+}
+
+// observe records today's usage and returns the highest threshold it newly
+// reached, or 0. Thresholds passed over at once are not notified separately.
+func (b *usageBudget) observe(date string, used int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.date != date {
+		b.date = date
+		b.notified = nil
+	}
+	if b.budget <= 0 {
+		return 0
+	}
+	reached := 0
+	for _, t := range budgetThresholds[len(b.notified):] {
+		if used*100 < b.budget*t {
+			break
+		}
+		b.notified = append(b.notified, t)
+		reached = t
+	}
+	return reached
+}
+
+func (b *usageBudget) notifiedOn(date string) []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.date != date {
+		return nil
+	}
+	return append([]int(nil), b.notified...)
+}
+
+// checkUsageBudget notifies once a completion takes today's usage past a
+// threshold of the soft budget.
+func (s *Server) checkUsageBudget() {
+	today := s.usage.snapshot()
+	threshold := s.budget.observe(today.Date, today.Tokens)
+	if threshold == 0 {
+		return
+	}
+	message := budgetMessage(threshold, today.Tokens, s.budget.get())
+	fmt.Fprintf(os.Stderr, "[proxy] %s\n", message)
+	s.events.publish(Event{Type: EventUsageBudget, Message: message})
+	budgetNotifier(message)
+}
+
+// budgetMessage is what the user is told when usage reaches threshold
+// percent of budget.
+func budgetMessage(threshold, used, budget int) string {
+	if threshold >= 100 {
+		return fmt.Sprintf("Daily token budget reached: %s of %s tokens used today. Requests are not blocked; the budget resets at midnight.",
+			FormatTokens(used), FormatTokens(budget))
+	}
+	return fmt.Sprintf("%d%% of your daily token budget used: %s of %s tokens today.", threshold, FormatTokens(used), FormatTokens(budget))
+}
+
+// usageBudgetStatus returns the /health section, or nil without a budget.
+func (s *Server) usageBudgetStatus() *UsageBudgetStatus {
+	budget := s.budget.get()
+	if budget <= 0 {
+		return nil
+	}
+	today := s.usage.snapshot()
+	st := &UsageBudgetStatus{
+		Budget:   budget,
+		Used:     today.Tokens,
+		Percent:  float64(int(float64(today.Tokens)*1000/float64(budget))) / 10,
+		BurnRate: s.usage.burnRate(),
+		Notified: s.budget.notifiedOn(today.Date),
+	}
+	if st.BurnRate > 0 && st.Used < budget {
+		now := s.usage.now()
+		at := now.Add(time.Duration(float64(budget-st.Used) / float64(st.BurnRate) * float64(time.Hour))).Truncate(time.Minute)
+		if midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()); at.Before(midnight) {
+			st.ExhaustedAt = &at
+		}
+	}
+	return st
+}
+
+// FormatTokens abbreviates a token count, e.g. 1.5M, 500k, or 950.
+func FormatTokens(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/1e6), ".0") + "M"
+	case n >= 1_000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/1e3), ".0") + "k"
+	}
+	return fmt.Sprint(n)
+}
+
+// ParseTokens parses a token count with an optional k or M suffix, e.g.
+// "500k" or "1.5M".
+func ParseTokens(s string) (int, error) {
+	v := strings.TrimSpace(strings.ReplaceAll(s, ",", ""))
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(v, "k"), strings.HasSuffix(v, "K"):
+		mult, v = 1e3, v[:len(v)-1]
+	case strings.HasSuffix(v, "m"), strings.HasSuffix(v, "M"):
+		mult, v = 1e6, v[:len(v)-1]
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) || f*mult > math.MaxInt32 {
+		return 0, fmt.Errorf("%q is not a token count, e.g. 500k or 2M", s)
+	}
+	return int(math.Round(f * mult)), nil
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageBudget(t *testing.T) {
+	var notified []string
+	budgetNotifier = func(message string) { notified = append(notified, message) }
+	defer func() { budgetNotifier = notifyDesktop }()
+
+	now := time.Now()
+	s := &Server{usage: newUsageStats(""), events: newEventHub()}
+	s.usage.now = func() time.Time { return now }
+	s.budget.set(1000)
+	events, _ := s.events.subscribe(0)
+
+	for i, tokens := range []int{500, 300, 100, 200, 50} {
+		s.recordUsage(RequestUsage{TotalTokens: tokens})
+		if want := map[int]int{0: 0, 1: 1, 2: 1, 3: 2, 4: 2}[i]; len(notified) != want {
+			t.Fatalf("after %d completions: %d notifications %q, want %d", i+1, len(notified), notified, want)
+		}
+	}
+	if !strings.HasPrefix(notified[0], "80% of your daily token budget used: 800 of 1k") || !strings.HasPrefix(notified[1], "Daily token budget reached: 1.1k of 1k") {
+		t.Errorf("notifications = %q", notified)
+	}
+	var budgetEvents int
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventUsageBudget {
+			budgetEvents++
+		}
+	}
+	if budgetEvents != 2 {
+		t.Errorf("%d usage_budget events, want 2", budgetEvents)
+	}
+
+	st := s.usageBudgetStatus()
+	if st.Used != 1150 || st.Percent != 115 || st.BurnRate != 1150 || st.ExhaustedAt != nil || !reflect.DeepEqual(st.Notified, []int{80, 100}) {
+		t.Errorf("usageBudgetStatus() = %+v", st)
+	}
+
+	// A higher budget notifies afresh; the burn rate only counts the last hour
+	s.budget.set(10000)
+	now = now.Add(30 * time.Minute)
+	if st := s.usageBudgetStatus(); st.Notified != nil || st.BurnRate != 1150 {
+		t.Errorf("usageBudgetStatus() after raising the budget = %+v", st)
+	}
+	now = now.Add(31 * time.Minute)
+	if st := s.usageBudgetStatus(); st.BurnRate != 0 || st.ExhaustedAt != nil {
+		t.Errorf("usageBudgetStatus() an hour later = %+v", st)
+	}
+
+	s.budget.set(0)
+	if st := s.usageBudgetStatus(); st != nil {
+		t.Errorf("usageBudgetStatus() without a budget = %+v", st)
+	}
+}
+
+func TestUsageBudget_ExhaustedAt(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.Local)
+	s := &Server{usage: newUsageStats("")}
+	s.usage.now = func() time.Time { return now }
+	s.usage.addUsage(RequestUsage{Time: now.Add(-10 * time.Minute), TotalTokens: 1000})
+	s.budget.set(3000)
+
+	if st := s.usageBudgetStatus(); st.ExhaustedAt == nil || !st.ExhaustedAt.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("ExhaustedAt = %v, want 12:00", st.ExhaustedAt)
+	}
+	s.budget.set(100000)
+	if st := s.usageBudgetStatus(); st.ExhaustedAt != nil {
+		t.Errorf("ExhaustedAt = %v, want nil when the budget lasts past midnight", st.ExhaustedAt)
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	for in, want := range map[string]int{"500k": 500000, "1.5M": 1500000, "2m": 2000000, "250,000": 250000, " 950 ": 950} {
+		if got, err := ParseTokens(in); err != nil || got != want {
+			t.Errorf("ParseTokens(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "k", "-5k", "lots", "5g", "9999M"} {
+		if _, err := ParseTokens(in); err == nil {
+			t.Errorf("ParseTokens(%q) succeeded", in)
+		}
+	}
+	for n, want := range map[int]string{950: "950", 500000: "500k", 1500000: "1.5M", 1234: "1.2k"} {
+		if got := FormatTokens(n); got != want {
+			t.Errorf("FormatTokens(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
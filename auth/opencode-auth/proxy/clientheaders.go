@@ -0,0 +1,191 @@
+// Package proxy provides the client header allowlist. Only headers an
+// upstream needs to serve a request are forwarded by default, so session
+// IDs, feature flags, and whatever else a client adds stay out of router
+// logs unless proxy_client_headers allows them.
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// defaultClientHeaders are forwarded on every route: content negotiation,
+// conditional requests, the headers the router reads, and trace context.
+var defaultClientHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Cache-Control",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"Expect",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"Idempotency-Key",
+	"User-Agent",
+	"X-Request-Id",
+	"Traceparent",
+	"Tracestate",
+	"Anthropic-Version",
+	"Anthropic-Beta",
+	"Openai-Beta",
+	"Sec-Websocket-*",
+}
+
+// hopByHopHeaders are left for httputil.ReverseProxy, which acts on
+// Upgrade and TE before removing them.
+var hopByHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// proxyManagedHeaders are removed or set by sanitizeHeaders, which the
+// filter leaves them to.
+var proxyManagedHeaders = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, h := range append(append([]string(nil), credentialHeaders...), forwardingHeaders...) {
+		m[http.CanonicalHeaderKey(h)] = true
+	}
+	return m
+}()
+
+// maxDroppedNames bounds how many header names /health counts separately.
+const maxDroppedNames = 50
+
+// ClientHeadersStatus is the "client_headers" section of /health.
+type ClientHeadersStatus struct {
+	Routes       int   `json:"routes"`
+	DroppedTotal int64 `json:"dropped_total"`
+	// Dropped counts drops by header name, for the first names seen
+	Dropped map[string]int64 `json:"dropped,omitempty"`
+}
+
+// clientHeaderFilter removes client headers that are not allowed on a
+// request's route. The zero value applies the built-in allowlist.
+type clientHeaderFilter struct {
+	routes atomic.Pointer[[]config.ClientHeaders]
+
+	mu      sync.Mutex
+	total   int64
+	dropped map[string]int64
+}
+
+func (f *clientHeaderFilter) set(routes []config.ClientHeaders) {
+	f.routes.Store(&routes)
+}
+
+func (f *clientHeaderFilter) current() []config.ClientHeaders {
+	if r := f.routes.Load(); r != nil {
+		return *r
+	}
+	return nil
+}
+
+// apply deletes the headers of req that its route does not allow and
+// returns their names, sorted.
+func (f *clientHeaderFilter) apply(req *http.Request, host string) []string {
+	route := config.MatchClientHeaders(f.current(), host, req.URL.Path)
+	var dropped []string
+	for name := range req.Header {
+		canonical := http.CanonicalHeaderKey(name)
+		if hopByHopHeaders[canonical] || proxyManagedHeaders[canonical] || clientHeaderAllowed(route, name) {
+			continue
+		}
+		req.Header.Del(name)
+		dropped = append(dropped, canonical)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	sort.Strings(dropped)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dropped == nil {
+		f.dropped = make(map[string]int64)
+	}
+	for _, name := range dropped {
+		f.total++
+		if _, seen := f.dropped[name]; seen || len(f.dropped) < maxDroppedNames {
+			f.dropped[name]++
+		}
+	}
+	return dropped
+}
+
+// status returns the /health section, or nil if no routes are configured
+// and nothing was dropped.
+func (f *clientHeaderFilter) status() *ClientHeadersStatus {
+	routes := len(f.current())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if routes == 0 && f.total == 0 {
+		return nil
+	}
+	st := &ClientHeadersStatus{Routes: routes, DroppedTotal: f.total}
+	if len(f.dropped) > 0 {
+		st.Dropped = make(map[string]int64, len(f.dropped))
+		for name, n := range f.dropped {
+			st.Dropped[name] = n
+		}
+	}
+	return st
+}
+
+// clientHeaderAllowed reports whether name may be forwarded on route (nil
+// for no route).
+func clientHeaderAllowed(route *config.ClientHeaders, name string) bool {
+	if route != nil && headerMatches(route.Deny, name) {
+		return false
+	}
+	if headerMatches(defaultClientHeaders, name) {
+		return true
+	}
+	return route != nil && headerMatches(route.Allow, name)
+}
+
+// headerMatches reports whether name matches one of patterns: a header
+// name, a prefix ending in "*", or "*".
+func headerMatches(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClientHeaders warns about proxy_client_headers entries that do
+// nothing or cannot match a header.
+func validateClientHeaders(routes []config.ClientHeaders) {
+	for _, r := range routes {
+		if len(r.Allow) == 0 && len(r.Deny) == 0 {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_client_headers entry for %q allows and denies nothing\n", r.PathPrefix)
+		}
+		for _, p := range append(append([]string(nil), r.Allow...), r.Deny...) {
+			if p == "" || strings.ContainsAny(p, " :\r\n") || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_client_headers entry for %q has invalid header %q\n", r.PathPrefix, p)
+			}
+		}
+	}
+}
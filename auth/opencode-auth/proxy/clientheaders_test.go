@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestClientHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "proxy-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	server, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, ClientHeaders: []config.ClientHeaders{
+		{Allow: []string{"X-Opencode-Session"}},
+		{PathPrefix: "/v1/chat/", Allow: []string{"x-feature-*", "X-Opencode-Session"}, Deny: []string{"User-Agent"}},
+		{PathPrefix: "/debug/", Allow: []string{"*"}, Deny: []string{"X-User-Email"}},
+	}}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	send := func(path string) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", front.URL+path, nil)
+		for name, value := range map[string]string{
+			"Content-Type":       "application/json",
+			"User-Agent":         "opencode/1.0",
+			"X-Request-Id":       "req-1",
+			"X-Opencode-Session": "s-1",
+			"X-Feature-Flags":    "beta",
+			"X-User-Email":       "alice@example.com",
+			"Authorization":      "Bearer smuggled",
+		} {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	check := func(path string, kept, dropped []string) {
+		t.Helper()
+		for _, name := range kept {
+			if got.Get(name) == "" {
+				t.Errorf("%s: %s was not forwarded", path, name)
+			}
+		}
+		for _, name := range dropped {
+			if v := got.Get(name); v != "" {
+				t.Errorf("%s: %s = %q was forwarded", path, name, v)
+			}
+		}
+	}
+
+	// Built-in allowlist plus the catch-all route
+	send("/v1/models")
+	check("/v1/models", []string{"Content-Type", "User-Agent", "X-Request-Id", "X-Opencode-Session"}, []string{"X-Feature-Flags", "X-User-Email"})
+	if got.Get("Authorization") != "Bearer proxy-token" {
+		t.Errorf("Authorization = %q, want the proxy's token", got.Get("Authorization"))
+	}
+
+	// The longest prefix wins; prefixes match case-insensitively, and deny
+	// overrides the built-in allowlist
+	send("/v1/chat/completions")
+	check("/v1/chat/completions", []string{"Content-Type", "X-Feature-Flags", "X-Opencode-Session"}, []string{"User-Agent", "X-User-Email"})
+
+	send("/debug/echo")
+	check("/debug/echo", []string{"X-Feature-Flags", "X-Opencode-Session", "User-Agent"}, []string{"X-User-Email"})
+
+	st := server.clientHeaders.status()
+	want := map[string]int64{"X-Feature-Flags": 1, "X-User-Email": 3, "User-Agent": 1}
+	if st == nil || st.Routes != 3 || st.DroppedTotal != 5 || !reflect.DeepEqual(st.Dropped, want) {
+		t.Errorf("status() = %+v", st)
+	}
+}
+
+func TestClientHeaders_Default(t *testing.T) {
+	var f clientHeaderFilter
+	if f.status() != nil {
+		t.Error("status() of an idle filter is not nil")
+	}
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Session-Id", "s")
+	req.Header.Set("Connection", "keep-alive")
+	if dropped := f.apply(req, "api.example.com"); !reflect.DeepEqual(dropped, []string{"X-Session-Id"}) {
+		t.Errorf("apply() dropped %v", dropped)
+	}
+	if req.Header.Get("Accept") == "" || req.Header.Get("Connection") == "" {
+		t.Errorf("headers after apply() = %v", req.Header)
+	}
+}
@@ -0,0 +1,157 @@
+// Package proxy provides the expired credential check. A request that would
+// go upstream with an expired token is answered locally with a 401 that says
+// to sign in, and re-authentication starts, instead of the upstream's 401,
+// which doesn't say why. proxy_expired_tokens "forward" sends such requests
+// upstream anyway, for debugging the router's token validation.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+)
+
+const (
+	// ExpiredTokensReject answers requests locally while the token is
+	// expired (the default)
+	ExpiredTokensReject = "reject"
+	// ExpiredTokensForward sends requests upstream with the expired token
+	ExpiredTokensForward = "forward"
+)
+
+// ExpiredTokensStatus is the "expired_tokens" section of /health.
+type ExpiredTokensStatus struct {
+	Mode         string    `json:"mode"`
+	Rejected     int64     `json:"rejected"`
+	LastRejected time.Time `json:"last_rejected,omitempty"`
+}
+
+// expiredTokens holds the mode and counts refused requests.
+type expiredTokens struct {
+	mu           sync.Mutex
+	mode         string
+	rejected     int64
+	lastRejected time.Time
+}
+
+// setMode replaces the mode and returns the previous one.
+func (e *expiredTokens) setMode(mode string) string {
+	if mode == "" {
+		mode = ExpiredTokensReject
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prev := e.mode
+	e.mode = mode
+	return prev
+}
+
+func (e *expiredTokens) forward() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mode == ExpiredTokensForward
+}
+
+func (e *expiredTokens) reject(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rejected++
+	e.lastRejected = now
+}
+
+// status returns the /health section, or nil in the default mode before
+// any request was refused.
+func (e *expiredTokens) status() *ExpiredTokensStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.mode != ExpiredTokensForward && e.rejected == 0 {
+		return nil
+	}
+	return &ExpiredTokensStatus{Mode: e.mode, Rejected: e.rejected, LastRejected: e.lastRejected}
+}
+
+// usesAPIKey reports whether a request to path is sent with the API key
+// rather than the user's token. API key and device management paths always
+// use the token, since the router needs the user's identity.
+func (s *Server) usesAPIKey(path string) bool {
+	isManagementPath := strings.HasPrefix(path, "/v1/api-keys") || strings.HasPrefix(path, "/v1/devices")
+	return s.config.APIKey != "" && !isManagementPath && !s.apiKey.rejected()
+}
+
+// checkCredentials answers a request with a 401 if it would be sent with an
+// expired token that can't be refreshed, and starts re-authentication. It
+// reports whether the request was answered.
+func (s *Server) checkCredentials(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.StaticAuth() || s.usesAPIKey(r.URL.Path) || s.expired.forward() {
+		return false
+	}
+	if tokens, err := auth.LoadTokens(s.config.TokenPath); err == nil && !tokens.IsExpired() {
+		return false
+	}
+
+	// ensure refreshes the token, or starts re-authentication
+	result := s.ensure()
+	reason := result.Message
+	if result.Status == "ok" {
+		if tokens, err := auth.LoadTokens(s.config.TokenPath); err == nil && !tokens.IsExpired() {
+			return false
+		}
+		// A refresh that failed for a transient reason still reports ok
+		reason = "token refresh failed, see proxy.log"
+	}
+	s.expired.reject(time.Now())
+	fmt.Fprintf(os.Stderr, "[proxy] Refused %s %s: the token is expired (%s)\n", r.Method, r.URL.Path, reason)
+
+	msg := "Your sign-in has expired. Sign in in the browser window that opens, or run 'opencode-auth login', then retry."
+	if !result.ReauthInProgress {
+		msg = "Your sign-in has expired and could not be renewed (" + reason + "). Run 'opencode-auth login', then retry."
+	}
+	w.Header().Set("X-Opencode-Auth", "reauth_required")
+	writeProxyError(w, http.StatusUnauthorized, "reauth_required", msg)
+	return true
+}
+
+// audienceTokenKey holds the audience access token resolveAudienceToken
+// found for a request.
+type audienceTokenKey struct{}
+
+// resolveAudienceToken finds the access token for a request whose route is
+// served by a separate audience, asking the IdP for one if none is stored,
+// and keeps it in the request context for addAuthHeader. Without one the
+// request is answered with a 502: the primary token would only be rejected
+// by that audience, or worse, accepted by a route that shouldn't see it.
+// It reports whether the request was answered.
+func (s *Server) resolveAudienceToken(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.config.StaticAuth() || s.usesAPIKey(r.URL.Path) {
+		return r, false
+	}
+	resource := s.config.AudienceFor(s.targetURL.Host, r.URL.Path)
+	if resource == "" {
+		return r, false
+	}
+	tokens, err := auth.LoadTokens(s.config.TokenPath)
+	if err != nil {
+		// Only with proxy_expired_tokens "forward"; addAuthHeader logs it
+		return r, false
+	}
+	token, ok := tokens.TokenFor(resource)
+	if !ok {
+		err = fmt.Errorf("no token stored")
+		if s.refresher != nil {
+			token, err = s.refresher.EnsureAudienceToken(resource)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Refused %s %s: no token for audience %s: %v\n", r.Method, r.URL.Path, resource, err)
+			writeProxyError(w, http.StatusBadGateway, "audience_token_unavailable",
+				"Could not get an access token for "+resource+" ("+err.Error()+"). Retry, or run 'opencode-auth login'.")
+			return r, true
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), audienceTokenKey{}, token)), false
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestExpiredTokens(t *testing.T) {
+	var upstream []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = append(upstream, r.Header.Get("Authorization")+r.Header.Get("X-API-Key"))
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "expired-token", ExpiresAt: time.Now().Add(-time.Minute)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(front.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Refused locally by default
+	resp, err := http.Get(front.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || body.Error.Type != "reauth_required" || !strings.Contains(body.Error.Message, "opencode-auth login") {
+		t.Errorf("status %d, error %+v", resp.StatusCode, body.Error)
+	}
+	if len(upstream) != 0 {
+		t.Errorf("upstream got %q", upstream)
+	}
+	if st := server.expired.status(); st == nil || st.Mode != ExpiredTokensReject || st.Rejected != 1 {
+		t.Errorf("status() = %+v", st)
+	}
+
+	// An API key doesn't need the token
+	server.config.APIKey = "oc_test_key_0123456789"
+	if resp := get("/v1/models"); resp.StatusCode != http.StatusOK {
+		t.Errorf("with an API key: status %d", resp.StatusCode)
+	}
+	server.config.APIKey = ""
+
+	// "forward" sends the expired token upstream
+	server.expired.setMode(ExpiredTokensForward)
+	if resp := get("/v1/models"); resp.StatusCode != http.StatusOK {
+		t.Errorf("forward: status %d", resp.StatusCode)
+	}
+	if want := []string{"oc_test_key_0123456789", "Bearer expired-token"}; strings.Join(upstream, ",") != strings.Join(want, ",") {
+		t.Errorf("upstream got %q, want %q", upstream, want)
+	}
+
+	// A valid token is forwarded in either mode
+	server.expired.setMode("")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "fresh-token", ExpiresAt: time.Now().Add(time.Hour)})
+	if resp := get("/v1/models"); resp.StatusCode != http.StatusOK || upstream[len(upstream)-1] != "Bearer fresh-token" {
+		t.Errorf("valid token: status %d, upstream got %q", resp.StatusCode, upstream)
+	}
+}
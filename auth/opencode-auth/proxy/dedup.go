@@ -0,0 +1,204 @@
+// Package proxy provides request deduplication: with proxy_dedup_window set,
+// a non-streaming chat completion identical to one sent within the window is
+// not sent upstream again but answered with the first request's response,
+// if that succeeded.
+// opencode retries a completion after a local error, which would otherwise
+// pay for the same answer twice.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// dedupMaxBody is the largest response kept for duplicates; larger ones are
+// only returned to the first request.
+const dedupMaxBody = 16 << 20
+
+// DedupStatus is the "dedup" section of /health.
+type DedupStatus struct {
+	Window    string `json:"window"`
+	InFlight  int    `json:"in_flight"`
+	Coalesced uint64 `json:"coalesced"`
+}
+
+// deduplicator coalesces identical completions. The zero value is off.
+type deduplicator struct {
+	mu        sync.Mutex
+	window    time.Duration
+	calls     map[[sha256.Size]byte]*dedupCall
+	coalesced uint64
+}
+
+// dedupCall is the first of a set of identical requests. Its response is
+// shared once done is closed; duplicates arriving before expires wait for it.
+type dedupCall struct {
+	done    chan struct{}
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+	shared  bool // the response can be given to duplicates
+}
+
+// setWindow changes the window and returns the previous one.
+func (d *deduplicator) setWindow(window time.Duration) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev := d.window
+	d.window = window
+	return prev
+}
+
+// status returns the health section, or nil when deduplication is off.
+func (d *deduplicator) status() *DedupStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.window <= 0 {
+		return nil
+	}
+	inFlight := 0
+	for _, call := range d.calls {
+		select {
+		case <-call.done:
+		default:
+			inFlight++
+		}
+	}
+	return &DedupStatus{Window: d.window.String(), InFlight: inFlight, Coalesced: d.coalesced}
+}
+
+// serve proxies r through next, or answers it with the response of an
+// identical request sent within the window.
+func (d *deduplicator) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	d.mu.Lock()
+	window := d.window
+	d.mu.Unlock()
+	if window <= 0 || r.Method != http.MethodPost || r.URL.Path != completionsPath || r.Body == nil || r.Header.Get("Content-Encoding") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProxyError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Failed to read request body: %v", err))
+		return
+	}
+	setBody(r, body)
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.Stream {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// The body names the model, so it alone identifies the request
+	key := sha256.Sum256(body)
+	now := time.Now()
+	d.mu.Lock()
+	if d.calls == nil {
+		d.calls = make(map[[sha256.Size]byte]*dedupCall)
+	}
+	if call, ok := d.calls[key]; ok && now.Before(call.expires) {
+		d.coalesced++
+		d.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if call.shared {
+			fmt.Fprintf(os.Stderr, "[proxy] Answered a duplicate chat completion with the response to the first one\n")
+			for k, v := range call.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Opencode-Deduplicated", "true")
+			w.WriteHeader(call.status)
+			w.Write(call.body)
+			return
+		}
+		// The first request failed; this one gets its own attempt
+		next.ServeHTTP(w, r)
+		return
+	}
+	call := &dedupCall{done: make(chan struct{}), expires: now.Add(window)}
+	d.calls[key] = call
+	d.mu.Unlock()
+
+	// The upstream request outlives a client that gives up on it, so the
+	// retry that follows can still be answered
+	rec := &dedupRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r.WithContext(context.WithoutCancel(r.Context())))
+
+	call.status, call.header, call.body = rec.status, rec.header, rec.body.Bytes()
+	// Only a success is an answer to the duplicates too; a 408, 409 or 429
+	// says nothing about what a second attempt would get
+	call.shared = rec.status >= 200 && rec.status < 300 && !rec.overflow
+	close(call.done)
+	time.AfterFunc(time.Until(call.expires), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.calls[key] == call {
+			delete(d.calls, key)
+		}
+	})
+}
+
+// dedupRecorder keeps the response it passes to the client. It keeps reading
+// the upstream response after the client has gone.
+type dedupRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+	gone     bool
+}
+
+func (rec *dedupRecorder) WriteHeader(code int) {
+	if rec.status == 0 && code >= 200 {
+		rec.status = code
+		rec.header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *dedupRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(p) > dedupMaxBody {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	if !rec.gone {
+		if _, err := rec.ResponseWriter.Write(p); err != nil {
+			rec.gone = true
+		}
+	}
+	return len(p), nil
+}
+
+// Flush keeps the response flowing to the client.
+func (rec *dedupRecorder) Flush() {
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the client connection.
+func (rec *dedupRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestDedup(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		time.Sleep(200 * time.Millisecond)
+		if strings.Contains(string(body), "fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if strings.Contains(string(body), "busy") {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"chatcmpl-%d","choices":[]}`, n)
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, DedupWindow: 5 * time.Second}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	type result struct {
+		status int
+		body   string
+		dedup  bool
+	}
+	post := func(ctx context.Context, body string) result {
+		req, _ := http.NewRequestWithContext(ctx, "POST", front.URL+"/v1/chat/completions", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return result{}
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return result{resp.StatusCode, string(data), resp.Header.Get("X-Opencode-Deduplicated") == "true"}
+	}
+	concurrently := func(bodies ...string) []result {
+		results := make([]result, len(bodies))
+		var wg sync.WaitGroup
+		for i, body := range bodies {
+			wg.Add(1)
+			go func(i int, body string) {
+				defer wg.Done()
+				results[i] = post(context.Background(), body)
+			}(i, body)
+			time.Sleep(20 * time.Millisecond)
+		}
+		wg.Wait()
+		return results
+	}
+
+	// An identical request waits for the first one's response
+	same := `{"model":"claude-sonnet","messages":[{"role":"user","content":"hi"}]}`
+	results := concurrently(same, same)
+	if hits.Load() != 1 {
+		t.Errorf("upstream requests = %d, want 1", hits.Load())
+	}
+	if results[0].body != `{"id":"chatcmpl-1","choices":[]}` || results[1].body != results[0].body || results[0].dedup || !results[1].dedup {
+		t.Errorf("results = %+v", results)
+	}
+	// and so does one sent after it finished, within the window
+	if r := post(context.Background(), same); r.body != results[0].body || !r.dedup || hits.Load() != 1 {
+		t.Errorf("later duplicate = %+v, upstream requests %d", r, hits.Load())
+	}
+	if status := server.dedup.status(); status == nil || status.Coalesced != 2 {
+		t.Errorf("status = %+v", status)
+	}
+
+	// Other models, streams, and failed responses are not shared
+	hits.Store(0)
+	concurrently(
+		`{"model":"claude-haiku","messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"claude-opus","messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"claude-sonnet","stream":true}`,
+		`{"model":"claude-sonnet","stream":true}`,
+	)
+	if hits.Load() != 4 {
+		t.Errorf("upstream requests for distinct and streaming requests = %d, want 4", hits.Load())
+	}
+	hits.Store(0)
+	results = concurrently(`{"model":"fail"}`, `{"model":"fail"}`)
+	if hits.Load() != 2 || results[1].status != http.StatusInternalServerError || results[1].dedup {
+		t.Errorf("failed response: upstream requests %d, results %+v", hits.Load(), results)
+	}
+	hits.Store(0)
+	results = concurrently(`{"model":"busy"}`, `{"model":"busy"}`)
+	if hits.Load() != 2 || results[1].status != http.StatusTooManyRequests || results[1].dedup {
+		t.Errorf("rate limited response: upstream requests %d, results %+v", hits.Load(), results)
+	}
+
+	// A retry after the client gave up gets the response it was waiting for
+	hits.Store(0)
+	retried := `{"model":"claude-sonnet","messages":[{"role":"user","content":"retry"}]}`
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	post(ctx, retried)
+	cancel()
+	if r := post(context.Background(), retried); r.status != http.StatusOK || !r.dedup || hits.Load() != 1 {
+		t.Errorf("retry = %+v, upstream requests %d", r, hits.Load())
+	}
+
+	// Without a window every request goes upstream
+	server.dedup.setWindow(0)
+	hits.Store(0)
+	concurrently(same, same)
+	if hits.Load() != 2 || server.dedup.status() != nil {
+		t.Errorf("disabled: upstream requests = %d, want 2", hits.Load())
+	}
+}
@@ -0,0 +1,133 @@
+// Package proxy provides deprecation tracking: when the router marks a path
+// with Deprecation or Sunset headers (RFC 9745, RFC 8594), the proxy records
+// it, logs a warning at most once a day per path, and reports it in /health
+// so `opencode-auth status` can show it.
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// deprecationWarnInterval is how often a deprecated path is logged.
+	deprecationWarnInterval = 24 * time.Hour
+
+	// maxDeprecations bounds the paths tracked, in case the router marks
+	// paths with IDs in them.
+	maxDeprecations = 32
+)
+
+// DeprecationStatus is one entry of the "deprecations" section of /health.
+// Deprecation, Sunset, and Link are the header values as sent.
+type DeprecationStatus struct {
+	Path        string    `json:"path"`
+	Deprecation string    `json:"deprecation,omitempty"`
+	Sunset      string    `json:"sunset,omitempty"`
+	Link        string    `json:"link,omitempty"`
+	Requests    int64     `json:"requests"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	WarnedAt    time.Time `json:"warned_at"`
+}
+
+// Message describes the deprecation for logs and `status`.
+func (d *DeprecationStatus) Message() string {
+	msg := fmt.Sprintf("the router marked %s as deprecated", d.Path)
+	if d.Sunset != "" {
+		sunset := d.Sunset
+		if t, err := http.ParseTime(d.Sunset); err == nil {
+			sunset = t.Local().Format("Mon, 02 Jan 2006")
+		}
+		msg += "; it stops working after " + sunset
+	}
+	if d.Link != "" {
+		msg += " (see " + d.Link + ")"
+	}
+	return msg
+}
+
+// deprecations records the deprecated paths the router has answered on.
+type deprecations struct {
+	mu    sync.Mutex
+	paths map[string]*DeprecationStatus
+	now   func() time.Time // time.Now if nil
+}
+
+// observe records a response to urlPath with headers h. It returns the
+// entry and whether to log it: the first time, once a day after that, and
+// when the router changes the headers.
+func (d *deprecations) observe(urlPath string, h http.Header) (DeprecationStatus, bool) {
+	deprecation, sunset := h.Get("Deprecation"), h.Get("Sunset")
+	if deprecation == "" && sunset == "" {
+		return DeprecationStatus{}, false
+	}
+	link := deprecationLink(h)
+
+	now := time.Now()
+	if d.now != nil {
+		now = d.now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.paths[urlPath]
+	if !ok {
+		if len(d.paths) >= maxDeprecations {
+			return DeprecationStatus{}, false
+		}
+		if d.paths == nil {
+			d.paths = make(map[string]*DeprecationStatus)
+		}
+		e = &DeprecationStatus{Path: urlPath, FirstSeen: now}
+		d.paths[urlPath] = e
+	}
+	changed := e.Deprecation != deprecation || e.Sunset != sunset || e.Link != link
+	e.Deprecation, e.Sunset, e.Link = deprecation, sunset, link
+	e.Requests++
+	e.LastSeen = now
+	warn := changed || now.Sub(e.WarnedAt) >= deprecationWarnInterval
+	if warn {
+		e.WarnedAt = now
+	}
+	return *e, warn
+}
+
+// status returns the deprecated paths seen, sorted, or nil if none.
+func (d *deprecations) status() []DeprecationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.paths) == 0 {
+		return nil
+	}
+	out := make([]DeprecationStatus, 0, len(d.paths))
+	for _, e := range d.paths {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// deprecationLink returns the target of a Link header with rel="deprecation"
+// or rel="sunset", if any.
+func deprecationLink(h http.Header) string {
+	for _, v := range h.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, p := range parts[1:] {
+				p = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(p), `"`, ""))
+				if p == "rel=deprecation" || p == "rel=sunset" {
+					return strings.Trim(target, "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestDeprecations(t *testing.T) {
+	now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	d := &deprecations{now: func() time.Time { return now }}
+	h := http.Header{}
+	h.Set("Deprecation", "@1788220800")
+	h.Set("Sunset", "Tue, 01 Dec 2026 00:00:00 GMT")
+	h.Add("Link", `<https://example.com/a>; rel="alternate", <https://example.com/migrate>; rel="deprecation"`)
+
+	if _, warn := d.observe("/v1/models", http.Header{}); warn || d.status() != nil {
+		t.Fatal("a response without deprecation headers was recorded")
+	}
+	e, warn := d.observe("/v1/old", h)
+	if !warn || e.Link != "https://example.com/migrate" || e.Requests != 1 {
+		t.Fatalf("first observe = %+v, %v", e, warn)
+	}
+	if !strings.Contains(e.Message(), "/v1/old") || !strings.Contains(e.Message(), "01 Dec 2026") {
+		t.Errorf("Message() = %q", e.Message())
+	}
+
+	now = now.Add(23 * time.Hour)
+	if _, warn := d.observe("/v1/old", h); warn {
+		t.Error("warned twice within a day")
+	}
+	now = now.Add(time.Hour)
+	if _, warn := d.observe("/v1/old", h); !warn {
+		t.Error("no warning after a day")
+	}
+	h.Set("Sunset", "Fri, 01 Jan 2027 00:00:00 GMT")
+	if _, warn := d.observe("/v1/old", h); !warn {
+		t.Error("no warning when the sunset date changed")
+	}
+
+	st := d.status()
+	if len(st) != 1 || st[0].Requests != 4 || !st[0].FirstSeen.Equal(time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("status() = %+v", st)
+	}
+}
+
+func TestDeprecationHealth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Sunset", "Tue, 01 Dec 2026 00:00:00 GMT")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: upstream.URL}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest("GET", "/v1/models", nil))
+	if rec.Header().Get("Sunset") == "" {
+		t.Error("the Sunset header was not passed on")
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Deprecations []DeprecationStatus `json:"deprecations"`
+	}
+	json.NewDecoder(rec.Body).Decode(&health)
+	if len(health.Deprecations) != 1 || health.Deprecations[0].Path != "/v1/models" {
+		t.Errorf("health deprecations = %+v", health.Deprecations)
+	}
+}
@@ -0,0 +1,140 @@
+// Package proxy provides device assertions: when this machine has a
+// registered device key, the proxy signs an X-Device-Assertion on each
+// upstream request, so the router can refuse devices it doesn't manage.
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/device"
+)
+
+// Values of the proxy_device_assertion setting.
+const (
+	// DeviceAssertionRequest binds each assertion to one request (the default)
+	DeviceAssertionRequest = "request"
+	// DeviceAssertionSession reuses one assertion until it is close to expiry
+	DeviceAssertionSession = "session"
+	// DeviceAssertionOff sends no assertion
+	DeviceAssertionOff = "off"
+)
+
+const (
+	requestAssertionTTL = 5 * time.Minute
+	sessionAssertionTTL = time.Hour
+
+	// sessionAssertionRenew is how long before expiry a session assertion is
+	// replaced, so one is never sent that expires in flight
+	sessionAssertionRenew = 5 * time.Minute
+)
+
+// DeviceStatus is the "device" section of /health.
+type DeviceStatus struct {
+	DeviceID   string `json:"device_id"`
+	Registered bool   `json:"registered"`
+	Assertion  string `json:"assertion"`
+	// KeyStore is "software" or the hardware store holding the key
+	KeyStore      string `json:"key_store"`
+	HardwareBound bool   `json:"hardware_bound"`
+}
+
+// deviceSigner signs assertions with the identity in device.json, reloading
+// it when 'device rotate' or 'device register' rewrites the file.
+type deviceSigner struct {
+	mu         sync.Mutex
+	dir        string
+	mode       string
+	modTime    time.Time
+	identity   *device.Identity // nil without an identity file
+	session    string
+	sessionExp time.Time
+}
+
+// setMode changes the assertion mode and returns the previous one. An empty
+// mode signs each request.
+func (d *deviceSigner) setMode(mode string) string {
+	if mode == "" {
+		mode = DeviceAssertionRequest
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev := d.mode
+	if mode != prev {
+		d.mode = mode
+		d.session = ""
+	}
+	return prev
+}
+
+// load returns the current identity. Callers hold d.mu.
+func (d *deviceSigner) load() *device.Identity {
+	info, err := os.Stat(device.Path(d.dir))
+	if err != nil {
+		d.identity, d.modTime = nil, time.Time{}
+		return nil
+	}
+	if info.ModTime().Equal(d.modTime) {
+		return d.identity
+	}
+	d.modTime = info.ModTime()
+	d.session = ""
+	id, err := device.Load(d.dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: device identity unusable: %v\n", err)
+	}
+	d.identity = id
+	return id
+}
+
+// assertion returns the assertion for a request, or "" when there is no
+// registered identity or assertions are off.
+func (d *deviceSigner) assertion(now time.Time, method, path string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mode == DeviceAssertionOff {
+		return "", nil
+	}
+	id := d.load()
+	if id == nil || !id.Registered() {
+		return "", nil
+	}
+	if d.mode != DeviceAssertionSession {
+		return id.Assertion(now, requestAssertionTTL, method, path)
+	}
+	if d.session == "" || now.After(d.sessionExp.Add(-sessionAssertionRenew)) {
+		session, err := id.Assertion(now, sessionAssertionTTL, "", "")
+		if err != nil {
+			return "", err
+		}
+		d.session, d.sessionExp = session, now.Add(sessionAssertionTTL)
+	}
+	return d.session, nil
+}
+
+// status returns the health section, or nil without an identity file.
+func (d *deviceSigner) status() *DeviceStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.load()
+	if id == nil {
+		return nil
+	}
+	return &DeviceStatus{DeviceID: id.DeviceID, Registered: id.Registered(), Assertion: d.mode, KeyStore: id.Store(), HardwareBound: id.HardwareBound()}
+}
+
+// addDeviceAssertion signs req for the router. It runs after the Director
+// has set the upstream path, which a per-request assertion is bound to.
+func (s *Server) addDeviceAssertion(req *http.Request) {
+	assertion, err := s.device.assertion(time.Now(), req.Method, req.URL.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: %v\n", err)
+		return
+	}
+	if assertion != "" {
+		req.Header.Set(device.Header, assertion)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/device"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/keystore"
+)
+
+// assertionClaims decodes the claims of an X-Device-Assertion.
+func assertionClaims(t *testing.T, assertion string) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion %q is not a JWT", assertion)
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestAddDeviceAssertion(t *testing.T) {
+	tempDir := t.TempDir()
+	server, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tempDir + "/tokens.json"}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func() string {
+		req := httptest.NewRequest("POST", "http://router/v1/chat/completions", nil)
+		server.addDeviceAssertion(req)
+		return req.Header.Get(device.Header)
+	}
+
+	// No identity, then one the router hasn't accepted yet
+	if got := sign(); got != "" || server.device.status() != nil {
+		t.Fatalf("assertion without identity = %q", got)
+	}
+	id, err := device.Generate("", keystore.Software)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Save(tempDir, id)
+	if got := sign(); got != "" {
+		t.Fatalf("assertion for unregistered device = %q", got)
+	}
+
+	now := time.Now().UTC()
+	id.RegisteredAt = &now
+	device.Save(tempDir, id)
+	os.Chtimes(device.Path(tempDir), now, now.Add(time.Second)) // coarse mtimes
+	claims := assertionClaims(t, sign())
+	if claims["iss"] != id.DeviceID || claims["htu"] != "/v1/chat/completions" || claims["htm"] != "POST" {
+		t.Errorf("request claims = %v", claims)
+	}
+	if status := server.device.status(); status == nil || !status.Registered || status.Assertion != DeviceAssertionRequest {
+		t.Errorf("status = %+v", status)
+	}
+
+	// A session assertion is reused and bound to no request
+	server.device.setMode(DeviceAssertionSession)
+	first := sign()
+	if second := sign(); second != first {
+		t.Error("session assertion not reused")
+	}
+	if _, bound := assertionClaims(t, first)["htu"]; bound {
+		t.Error("session assertion bound to a request")
+	}
+
+	server.device.setMode(DeviceAssertionOff)
+	if got := sign(); got != "" {
+		t.Errorf("assertion with assertions off = %q", got)
+	}
+}
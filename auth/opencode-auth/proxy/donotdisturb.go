@@ -0,0 +1,137 @@
+// Package proxy provides do-not-disturb windows for re-authentication: while
+// one is active, a re-authentication prompt opens no browser and shows no
+// notification until the window ends, and the refresher refreshes ahead of
+// a window the token would expire in, so a sign-in it needs happens before
+// the window rather than during it.
+package proxy
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// dndLead is how long before a do-not-disturb window the refresher
+// refreshes a token that would expire during it.
+const dndLead = 15 * time.Minute
+
+// DoNotDisturbStatus is the "do_not_disturb" section of /health.
+type DoNotDisturbStatus struct {
+	Windows    []config.QuietWindow `json:"windows"`
+	QuietUntil *time.Time           `json:"quiet_until,omitempty"` // set during a window
+	NextStart  *time.Time           `json:"next_start,omitempty"`
+}
+
+// doNotDisturb holds the configured windows.
+type doNotDisturb struct {
+	mu      sync.RWMutex
+	windows []config.QuietWindow
+}
+
+// set replaces the windows and reports whether they changed.
+func (d *doNotDisturb) set(windows []config.QuietWindow) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := !reflect.DeepEqual(d.windows, windows)
+	d.windows = windows
+	return changed
+}
+
+// bounds calls fn with each window starting on the day before now through a
+// week after it, in now's location, until fn returns false.
+func (d *doNotDisturb) bounds(now time.Time, fn func(start, end time.Time) bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for day := -1; day <= 7; day++ {
+		t := now.AddDate(0, 0, day)
+		for _, w := range d.windows {
+			if start, end, ok := w.Bounds(t); ok && !fn(start, end) {
+				return
+			}
+		}
+	}
+}
+
+// quietUntil returns when the window now falls in ends, following windows
+// that overlap it, or the zero time outside a window.
+func (d *doNotDisturb) quietUntil(now time.Time) time.Time {
+	var until time.Time
+	for extended := true; extended; {
+		extended = false
+		at := now
+		if !until.IsZero() {
+			at = until
+		}
+		d.bounds(now, func(start, end time.Time) bool {
+			if !start.After(at) && end.After(at) {
+				until, extended = end, true
+				return false
+			}
+			return true
+		})
+	}
+	return until
+}
+
+// nextStart returns when the next window after now starts, or the zero time
+// if there is none within a week.
+func (d *doNotDisturb) nextStart(now time.Time) time.Time {
+	var next time.Time
+	d.bounds(now, func(start, end time.Time) bool {
+		if start.After(now) && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+		return true
+	})
+	return next
+}
+
+// status returns the /health section, or nil without windows.
+func (d *doNotDisturb) status(now time.Time) *DoNotDisturbStatus {
+	d.mu.RLock()
+	windows := d.windows
+	d.mu.RUnlock()
+	if len(windows) == 0 {
+		return nil
+	}
+	st := &DoNotDisturbStatus{Windows: windows}
+	if until := d.quietUntil(now); !until.IsZero() {
+		st.QuietUntil = &until
+	}
+	if next := d.nextStart(now); !next.IsZero() {
+		st.NextStart = &next
+	}
+	return st
+}
+
+// SetDoNotDisturb replaces the do-not-disturb windows and reports whether
+// they changed.
+func (r *Refresher) SetDoNotDisturb(windows []config.QuietWindow) bool {
+	return r.dnd.set(windows)
+}
+
+// DoNotDisturb returns the /health section for the windows, or nil.
+func (r *Refresher) DoNotDisturb() *DoNotDisturbStatus {
+	return r.dnd.status(r.clock.Now())
+}
+
+// refreshBeforeQuiet reports whether a do-not-disturb window starts within
+// dndLead, the token expires before it ends, and the token was not already
+// refreshed for it.
+func (r *Refresher) refreshBeforeQuiet(expiresAt time.Time) bool {
+	now := r.clock.Now()
+	start := r.dnd.nextStart(now)
+	if start.IsZero() || start.Sub(now) > dndLead {
+		return false
+	}
+	threshold, _ := r.Timing()
+	if !expiresAt.Before(r.dnd.quietUntil(start).Add(threshold)) {
+		return false
+	}
+	r.mu.RLock()
+	lastRefresh := r.lastRefresh
+	r.mu.RUnlock()
+	return lastRefresh.Before(start.Add(-dndLead))
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestDoNotDisturbSchedule(t *testing.T) {
+	// 1 October 2026 is a Thursday
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 10, day, hour, min, 0, 0, time.UTC) }
+	var d doNotDisturb
+	d.set([]config.QuietWindow{
+		{Start: "09:00", End: "11:00", Days: []string{"mon", "Thu"}},
+		{Start: "10:30", End: "12:00", Days: []string{"thu"}},
+		{Start: "22:00", End: "02:00"},
+	})
+
+	for _, tc := range []struct {
+		now, until, next time.Time
+	}{
+		{at(1, 8, 0), time.Time{}, at(1, 9, 0)},
+		// Overlapping windows are one
+		{at(1, 9, 30), at(1, 12, 0), at(1, 10, 30)},
+		{at(1, 12, 0), time.Time{}, at(1, 22, 0)},
+		// Past midnight, in the window that started the day before
+		{at(2, 1, 0), at(2, 2, 0), at(2, 22, 0)},
+		// Friday has no morning window
+		{at(2, 9, 30), time.Time{}, at(2, 22, 0)},
+	} {
+		if got := d.quietUntil(tc.now); !got.Equal(tc.until) {
+			t.Errorf("quietUntil(%v) = %v, want %v", tc.now, got, tc.until)
+		}
+		if got := d.nextStart(tc.now); !got.Equal(tc.next) {
+			t.Errorf("nextStart(%v) = %v, want %v", tc.now, got, tc.next)
+		}
+	}
+
+	if d.set(nil); d.status(at(1, 9, 30)) != nil || !d.quietUntil(at(1, 9, 30)).IsZero() {
+		t.Error("windows remained after clearing them")
+	}
+}
+
+func TestRefreshBeforeQuiet(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 10, 1, 8, 40, 0, 0, time.UTC))
+	r, _ := NewRefresherWithClock(&config.Config{DoNotDisturb: []config.QuietWindow{{Start: "09:00", End: "11:00"}}}, clock)
+
+	if r.refreshBeforeQuiet(clock.Now().Add(time.Hour)) {
+		t.Error("refreshing 20 minutes before the window")
+	}
+	clock.Advance(10 * time.Minute)
+	if !r.refreshBeforeQuiet(clock.Now().Add(time.Hour)) {
+		t.Error("not refreshing 10 minutes before the window")
+	}
+	if r.refreshBeforeQuiet(clock.Now().Add(4 * time.Hour)) {
+		t.Error("refreshing a token that outlasts the window")
+	}
+	r.mu.Lock()
+	r.lastRefresh = clock.Now()
+	r.mu.Unlock()
+	if r.refreshBeforeQuiet(clock.Now().Add(time.Hour)) {
+		t.Error("refreshing again for the same window")
+	}
+}
+
+func TestReauthConsent_DoNotDisturb(t *testing.T) {
+	notified := make(chan string, 1)
+	reauthNotifier = func(ctx context.Context, message string, onClick func()) { notified <- message }
+	defer func() { reauthNotifier = notifyReauth }()
+
+	clock := newFakeClock(time.Date(2026, 10, 1, 9, 30, 0, 0, time.UTC))
+	r, _ := NewRefresherWithClock(&config.Config{
+		ReauthAutoOpen: 3 * time.Minute,
+		DoNotDisturb:   []config.QuietWindow{{Start: "09:00", End: "11:00"}},
+	}, clock)
+
+	result := make(chan bool, 1)
+	go func() { result <- r.awaitReauthConsent() }()
+	if d := clock.waitAfter(t); d != 90*time.Minute {
+		t.Errorf("waiting %v, want until the window ends", d)
+	}
+	prompt := r.PendingReauth()
+	if prompt == nil || prompt.QuietUntil == nil || !prompt.AutoOpenAt.Equal(time.Date(2026, 10, 1, 11, 3, 0, 0, time.UTC)) {
+		t.Errorf("pending prompt = %+v", prompt)
+	}
+	select {
+	case m := <-notified:
+		t.Errorf("notified during the window: %q", m)
+	default:
+	}
+
+	// Asking explicitly still signs in
+	r.ContinueReauth(consentCLI)
+	select {
+	case ok := <-result:
+		if !ok {
+			t.Error("reauth --continue did not continue the prompt")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("prompt was not answered")
+	}
+}
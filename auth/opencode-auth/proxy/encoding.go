@@ -0,0 +1,92 @@
+// Package proxy provides response compression control for the proxy.
+package proxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// decodableEncodings are the content codings the proxy can decompress.
+// zstd and br are not in the standard library, so with decompression
+// enabled they are filtered out of Accept-Encoding instead.
+var decodableEncodings = map[string]bool{"gzip": true, "x-gzip": true, "identity": true}
+
+// rewriteAcceptEncoding applies the configured Accept-Encoding policy to an
+// outgoing request:
+//
+//	""          pass the client's header through unchanged
+//	"identity"  ask upstream not to compress
+//	other       replace the header with the given list (e.g. "gzip")
+//
+// With decompress enabled, codings the proxy cannot decode are dropped.
+func rewriteAcceptEncoding(req *http.Request, policy string, decompress bool) {
+	if policy != "" {
+		req.Header.Set("Accept-Encoding", policy)
+	}
+	if !decompress {
+		return
+	}
+	if ae := req.Header.Get("Accept-Encoding"); ae != "" {
+		if filtered := filterAcceptEncoding(ae); filtered != "" {
+			req.Header.Set("Accept-Encoding", filtered)
+		} else {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+	}
+}
+
+// filterAcceptEncoding keeps only codings the proxy can decode, preserving
+// quality values.
+func filterAcceptEncoding(header string) string {
+	var kept []string
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		coding, _, _ := strings.Cut(part, ";")
+		if decodableEncodings[strings.ToLower(strings.TrimSpace(coding))] {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// decompressResponse replaces a gzip-encoded body with its decompressed
+// stream and fixes up the headers so the client sees a plain response.
+// Codings the proxy cannot decode are passed through with a warning.
+func decompressResponse(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+	default:
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: cannot decompress %q response for %s, passing through\n",
+			encoding, resp.Request.URL.Path)
+		return nil
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("invalid gzip response: %w", err)
+	}
+	resp.Body = &gzipBody{Reader: zr, underlying: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length") // Decompressed size is unknown
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// gzipBody closes both the gzip reader and the upstream body.
+type gzipBody struct {
+	*gzip.Reader
+	underlying io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.underlying.Close()
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// zstdFrame is an arbitrary body labelled as zstd; the proxy never decodes it.
+var zstdFrame = []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58, 0x01, 0x00, 0x00}
+
+func compressedBackend(t *testing.T, gotAcceptEncoding *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*gotAcceptEncoding = r.Header.Get("Accept-Encoding")
+		var body []byte
+		switch r.URL.Path {
+		case "/gzip":
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte(`{"choices":[]}`))
+			zw.Close()
+			body = buf.Bytes()
+			w.Header().Set("Content-Encoding", "gzip")
+		case "/zstd":
+			body = zstdFrame
+			w.Header().Set("Content-Encoding", "zstd")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+}
+
+func encodingTestServer(t *testing.T, backendURL string, acceptEncoding string, decompress bool) *Server {
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "test-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	server, err := newServerInternal(&config.Config{
+		ConfigDir:      tempDir,
+		TokenPath:      tokenPath,
+		APIEndpoint:    backendURL,
+		AcceptEncoding: acceptEncoding,
+		Decompress:     decompress,
+	}, 0, false)
+	if err != nil {
+		t.Fatalf("newServerInternal() error = %v", err)
+	}
+	return server
+}
+
+func proxyGet(server *Server, path, acceptEncoding string) *http.Response {
+	req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	server.proxy.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestProxyDecompressesGzip(t *testing.T) {
+	var gotAE string
+	backend := compressedBackend(t, &gotAE)
+	defer backend.Close()
+
+	server := encodingTestServer(t, backend.URL, "", true)
+	resp := proxyGet(server, "/gzip", "gzip, br, zstd")
+
+	if gotAE != "gzip" {
+		t.Errorf("upstream Accept-Encoding = %q, want undecodable codings dropped", gotAE)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding = %q, want none after decompression", ce)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" && cl != "14" {
+		t.Errorf("Content-Length = %q, want removed or decompressed size", cl)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `{"choices":[]}` {
+		t.Errorf("body = %q, want decompressed JSON", body)
+	}
+}
+
+func TestProxyPassesThroughZstd(t *testing.T) {
+	var gotAE string
+	backend := compressedBackend(t, &gotAE)
+	defer backend.Close()
+
+	server := encodingTestServer(t, backend.URL, "", true)
+	resp := proxyGet(server, "/zstd", "zstd")
+
+	if gotAE != "identity" {
+		t.Errorf("upstream Accept-Encoding = %q, want identity when nothing decodable remains", gotAE)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "zstd" {
+		t.Errorf("Content-Encoding = %q, want zstd passed through", ce)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, zstdFrame) {
+		t.Errorf("body = %x, want unchanged zstd frame", body)
+	}
+}
+
+func TestProxyAcceptEncodingPolicy(t *testing.T) {
+	var gotAE string
+	backend := compressedBackend(t, &gotAE)
+	defer backend.Close()
+
+	// Without decompression, compressed bodies pass through untouched
+	server := encodingTestServer(t, backend.URL, "", false)
+	resp := proxyGet(server, "/gzip", "gzip, zstd")
+	if gotAE != "gzip, zstd" {
+		t.Errorf("passthrough Accept-Encoding = %q, want client's header", gotAE)
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error("expected gzip body passed through without decompress")
+	}
+
+	server = encodingTestServer(t, backend.URL, "identity", false)
+	proxyGet(server, "/gzip", "gzip, zstd")
+	if gotAE != "identity" {
+		t.Errorf("policy Accept-Encoding = %q, want identity", gotAE)
+	}
+}
+
+func TestFilterAcceptEncoding(t *testing.T) {
+	tests := map[string]string{
+		"gzip, deflate, br, zstd": "gzip",
+		"zstd;q=1.0, gzip;q=0.5":  "gzip;q=0.5",
+		"br":                      "",
+		"identity, x-gzip":        "identity, x-gzip",
+	}
+	for in, want := range tests {
+		if got := filterAcceptEncoding(in); got != want {
+			t.Errorf("filterAcceptEncoding(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
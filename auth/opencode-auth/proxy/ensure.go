@@ -0,0 +1,106 @@
+// Package proxy provides burst protection for /api/auth/ensure. opencode
+// workers starting together all ask the proxy to ensure a token at the same
+// moment, and each could force a refresh. Concurrent calls share one
+// evaluation, so at most one refresh runs, and a token bucket limits the
+// endpoint so a misbehaving client can't keep the refresher spinning.
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// ensureRate is how many ensure calls per second are allowed sustained.
+	ensureRate = 2
+
+	// ensureBurst is how many ensure calls are allowed at once, enough for
+	// a launch that starts many workers.
+	ensureBurst = 20
+)
+
+// EnsureStats is the "ensure" section of /health.
+type EnsureStats struct {
+	Calls int64 `json:"calls"`
+	// Coalesced calls got the result of a call already running
+	Coalesced   int64 `json:"coalesced"`
+	RateLimited int64 `json:"rate_limited"`
+}
+
+// ensureGate coalesces and rate-limits ensure calls.
+type ensureGate struct {
+	mu       sync.Mutex
+	now      func() time.Time // time.Now if nil
+	tokens   float64
+	filled   time.Time // when tokens was last topped up
+	inflight *ensureCall
+	stats    EnsureStats
+}
+
+// ensureCall is an evaluation that other callers can wait for.
+type ensureCall struct {
+	done chan struct{}
+	resp EnsureResponse
+}
+
+// allow takes a token from the bucket. When it is empty, it returns false
+// and how long until a token is free.
+func (g *ensureGate) allow() (bool, time.Duration) {
+	now := time.Now()
+	if g.now != nil {
+		now = g.now()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.filled.IsZero() {
+		g.tokens = ensureBurst
+	} else {
+		g.tokens += now.Sub(g.filled).Seconds() * ensureRate
+		if g.tokens > ensureBurst {
+			g.tokens = ensureBurst
+		}
+	}
+	g.filled = now
+	if g.tokens < 1 {
+		g.stats.RateLimited++
+		return false, time.Duration((1 - g.tokens) / ensureRate * float64(time.Second))
+	}
+	g.tokens--
+	return true, 0
+}
+
+// do runs evaluate, or, if a call is already running, waits for it and
+// returns its result. It reports whether the result was shared.
+func (g *ensureGate) do(evaluate func() EnsureResponse) (EnsureResponse, bool) {
+	g.mu.Lock()
+	g.stats.Calls++
+	if c := g.inflight; c != nil {
+		g.stats.Coalesced++
+		g.mu.Unlock()
+		<-c.done
+		return c.resp, true
+	}
+	c := &ensureCall{done: make(chan struct{})}
+	g.inflight = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		g.inflight = nil
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.resp = evaluate()
+	return c.resp, false
+}
+
+// status returns the health section, or nil before the first call.
+func (g *ensureGate) status() *EnsureStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stats.Calls == 0 && g.stats.RateLimited == 0 {
+		return nil
+	}
+	st := g.stats
+	return &st
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnsureGate(t *testing.T) {
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	g := &ensureGate{now: func() time.Time { return now }}
+	for i := 0; i < ensureBurst; i++ {
+		if ok, _ := g.allow(); !ok {
+			t.Fatalf("call %d of the burst was limited", i+1)
+		}
+	}
+	if ok, wait := g.allow(); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("call past the burst = %v, wait %v", ok, wait)
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < ensureRate; i++ {
+		if ok, _ := g.allow(); !ok {
+			t.Errorf("call %d after a second was limited", i+1)
+		}
+	}
+	if ok, _ := g.allow(); ok {
+		t.Error("the bucket refilled faster than ensureRate")
+	}
+
+	release := make(chan struct{})
+	var evaluations int
+	evaluate := func() EnsureResponse {
+		evaluations++
+		<-release
+		return EnsureResponse{Status: "ok"}
+	}
+	var wg sync.WaitGroup
+	results := make(chan EnsureResponse, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := g.do(evaluate)
+			results <- resp
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if st := g.status(); st != nil && st.Coalesced == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("calls were not coalesced: %+v", g.status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+	for resp := range results {
+		if resp.Status != "ok" {
+			t.Errorf("shared result = %+v", resp)
+		}
+	}
+	if evaluations != 1 {
+		t.Errorf("evaluated %d times, want 1", evaluations)
+	}
+	if st := g.status(); st.Calls != 5 || st.RateLimited != 2 {
+		t.Errorf("status() = %+v", st)
+	}
+}
@@ -0,0 +1,174 @@
+// Package proxy provides /api/events, a Server-Sent Events stream of auth
+// lifecycle events, so a menu bar app or editor extension can show a live
+// auth indicator without polling /health. Completions' usage is sent on the
+// same stream.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types sent on /api/events.
+const (
+	EventTokenRefreshed  = "token_refreshed"
+	EventRefreshFailed   = "refresh_failed"
+	EventReauthRequired  = "reauth_required"
+	EventReauthSucceeded = "reauth_succeeded"
+	EventReauthFailed    = "reauth_failed"
+	EventAPIKeyRejected  = "api_key_rejected"
+	EventAPIKeyAccepted  = "api_key_accepted"
+	EventSessionLocked   = "session_locked"
+	EventAccessRevoked   = "access_revoked"
+	EventStepUpRequired  = "step_up_required"
+	EventUsage           = "usage"
+	EventUsageBudget     = "usage_budget"
+	EventRateLimitLow    = "rate_limit_low"
+)
+
+const (
+	// eventBacklog is how many recent events are kept for clients that
+	// reconnect with Last-Event-ID.
+	eventBacklog = 64
+
+	// eventHeartbeat is how often an idle stream gets a comment line, so
+	// clients and intermediaries don't time it out.
+	eventHeartbeat = 30 * time.Second
+)
+
+// Event is one auth lifecycle event.
+type Event struct {
+	ID        int64         `json:"id"`
+	Type      string        `json:"type"`
+	Time      time.Time     `json:"time"`
+	Message   string        `json:"message,omitempty"`
+	Email     string        `json:"email,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	Usage     *RequestUsage `json:"usage,omitempty"`
+}
+
+// eventHub fans events out to /api/events clients. A nil hub drops events.
+type eventHub struct {
+	mu     sync.Mutex
+	nextID int64
+	recent []Event
+	subs   map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[chan Event]struct{}{}}
+}
+
+// publish numbers e and sends it to every subscriber. A subscriber that has
+// fallen behind is dropped; it reconnects and catches up from the backlog.
+func (h *eventHub) publish(e Event) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	e.ID = h.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	h.recent = append(h.recent, e)
+	if len(h.recent) > eventBacklog {
+		h.recent = h.recent[len(h.recent)-eventBacklog:]
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of new events, and the kept events after
+// lastID when a client resumes.
+func (h *eventHub) subscribe(lastID int64) (chan Event, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var missed []Event
+	if lastID > 0 {
+		for _, e := range h.recent {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+	ch := make(chan Event, 16)
+	h.subs[ch] = struct{}{}
+	return ch, missed
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// handleEvents streams auth events. The stream opens with a "status" event
+// holding the same fields as /api/token/status, so a client can draw its
+// indicator before anything happens.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	events, missed := s.events.subscribe(lastID)
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	writeEvent(w, "status", 0, s.tokenStatus())
+	for _, e := range missed {
+		writeEvent(w, e.Type, e.ID, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return // Fell behind; the client resumes with Last-Event-ID
+			}
+			writeEvent(w, e.Type, e.ID, e)
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.stopChan:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one SSE event; id 0 is sent without an id.
+func writeEvent(w io.Writer, eventType string, id int64, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	if id > 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, body)
+}
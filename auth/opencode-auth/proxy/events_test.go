@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestEventHub_DropsSlowSubscriber(t *testing.T) {
+	h := newEventHub()
+	ch, _ := h.subscribe(0)
+	for i := 0; i < cap(ch)+1; i++ {
+		h.publish(Event{Type: EventTokenRefreshed})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != cap(ch) {
+		t.Errorf("received %d events before the channel closed, want %d", n, cap(ch))
+	}
+
+	// A resuming client gets what it missed from the backlog
+	_, missed := h.subscribe(int64(cap(ch)))
+	if len(missed) != 1 || missed[0].ID != int64(cap(ch)+1) {
+		t.Errorf("missed = %+v", missed)
+	}
+
+	var nilHub *eventHub
+	nilHub.publish(Event{Type: EventTokenRefreshed}) // must not panic
+}
+
+func TestHandleEvents(t *testing.T) {
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", Email: "dev@example.com", ExpiresAt: time.Now().Add(time.Hour)})
+	server, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: "http://127.0.0.1:1"}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleEvents))
+	defer front.Close()
+
+	// open connects and returns a reader of the next event's type, id, and data
+	open := func(lastID string) (*http.Response, func() (string, string, string)) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+		lines := bufio.NewScanner(resp.Body)
+		return resp, func() (eventType, id, data string) {
+			for lines.Scan() {
+				line := lines.Text()
+				switch {
+				case line == "" && eventType != "":
+					return
+				case strings.HasPrefix(line, "event: "):
+					eventType = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "id: "):
+					id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "data: "):
+					data = strings.TrimPrefix(line, "data: ")
+				}
+			}
+			t.Fatalf("stream ended: %v", lines.Err())
+			return
+		}
+	}
+
+	resp, next := open("")
+	eventType, _, data := next()
+	var status TokenStatusResponse
+	if err := json.Unmarshal([]byte(data), &status); eventType != "status" || err != nil || !status.Valid || status.Email != "dev@example.com" {
+		t.Fatalf("first event = %s %s", eventType, data)
+	}
+
+	server.events.publish(Event{Type: EventReauthRequired, Message: "sign in"})
+	eventType, id, data := next()
+	var e Event
+	if err := json.Unmarshal([]byte(data), &e); eventType != EventReauthRequired || id != "1" || err != nil || e.Message != "sign in" {
+		t.Fatalf("event = %s id %s %s", eventType, id, data)
+	}
+	resp.Body.Close()
+
+	// Events published while disconnected are replayed after Last-Event-ID
+	server.events.publish(Event{Type: EventReauthSucceeded})
+	resp, next = open("1")
+	defer resp.Body.Close()
+	next() // status
+	if eventType, id, _ := next(); eventType != EventReauthSucceeded || id != "2" {
+		t.Errorf("replayed event = %s id %s", eventType, id)
+	}
+}
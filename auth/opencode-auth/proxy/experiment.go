@@ -0,0 +1,273 @@
+// Package proxy provides model experiments: a configured share of the chat
+// completions for one model is rewritten to a candidate model, responses
+// say which arm served them in X-OpenCode-Experiment, and latency, tokens
+// and errors are counted per arm, so a team can evaluate a model switch
+// before committing to it.
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// ExperimentHeader tags the responses of requests in an experiment, e.g.
+// "haiku-trial; arm=candidate".
+const ExperimentHeader = "X-OpenCode-Experiment"
+
+// Experiment arms.
+const (
+	ArmControl   = "control"
+	ArmCandidate = "candidate"
+)
+
+// ExperimentArm is the stats of one arm since the experiment was set.
+type ExperimentArm struct {
+	Model            string  `json:"model"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"` // 4xx, 5xx and failed requests
+	ErrorRate        float64 `json:"error_rate"`
+	AvgLatencyMS     int64   `json:"avg_latency_ms"` // until response headers
+	Completions      int     `json:"completions"`    // that reported usage
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+
+	latency   time.Duration // total
+	responses int           // with a latency
+}
+
+// ExperimentStatus is one entry of the "experiments" section of /health.
+type ExperimentStatus struct {
+	Name      string        `json:"name"`
+	Percent   int           `json:"percent"`
+	Since     time.Time     `json:"since"`
+	Control   ExperimentArm `json:"control"`
+	Candidate ExperimentArm `json:"candidate"`
+}
+
+// experiment is a configured experiment and its stats.
+type experiment struct {
+	config.Experiment
+	stats ExperimentStatus
+}
+
+// experimentRequest is the arm a request was assigned to, stored in its
+// context.
+type experimentRequest struct {
+	exp   *experiment
+	arm   string
+	start time.Time
+}
+
+type experimentKey struct{}
+
+// experiments holds the configured experiments and their stats. The zero
+// value runs none.
+type experiments struct {
+	mu   sync.Mutex
+	list []*experiment
+	roll func(body []byte) int // returns [0, 100); nil hashes the body
+}
+
+// set replaces the experiments and reports whether they changed. Stats
+// are kept for experiments that did not change.
+func (x *experiments) set(list []config.Experiment) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prev := make([]config.Experiment, len(x.list))
+	for i, e := range x.list {
+		prev[i] = e.Experiment
+	}
+	if reflect.DeepEqual(prev, list) || (len(prev) == 0 && len(list) == 0) {
+		return false
+	}
+	kept := make(map[config.Experiment]*experiment, len(x.list))
+	for _, e := range x.list {
+		kept[e.Experiment] = e
+	}
+	x.list = nil
+	for _, c := range list {
+		e := kept[c]
+		if e == nil {
+			e = &experiment{Experiment: c, stats: ExperimentStatus{Name: c.Name, Percent: c.Percent, Since: time.Now().UTC()}}
+			e.stats.Control.Model, e.stats.Candidate.Model = c.Model, c.Candidate
+		}
+		x.list = append(x.list, e)
+	}
+	return true
+}
+
+// forModel returns the experiment on model, or nil.
+func (x *experiments) forModel(model string) *experiment {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, e := range x.list {
+		if e.Model == model {
+			return e
+		}
+	}
+	return nil
+}
+
+// pick returns the arm of a request to e. The roll is a hash of the
+// experiment name and the request body, so a retry of the same request lands
+// in the same arm, is rewritten the same way, and proxy_dedup_window can
+// still coalesce it.
+func (x *experiments) pick(e *experiment, body []byte) string {
+	var roll int
+	if x.roll != nil {
+		roll = x.roll(body)
+	} else {
+		h := sha256.New()
+		h.Write([]byte(e.Name))
+		h.Write([]byte{0})
+		h.Write(body)
+		roll = int(binary.BigEndian.Uint64(h.Sum(nil)) % 100)
+	}
+	if roll < e.Percent {
+		return ArmCandidate
+	}
+	return ArmControl
+}
+
+// stats returns the stats of req's arm. Callers hold experiments.mu.
+func (req *experimentRequest) stats() *ExperimentArm {
+	if req.arm == ArmCandidate {
+		return &req.exp.stats.Candidate
+	}
+	return &req.exp.stats.Control
+}
+
+// status returns the /health section, or nil without experiments.
+func (x *experiments) status() []ExperimentStatus {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.list) == 0 {
+		return nil
+	}
+	st := make([]ExperimentStatus, 0, len(x.list))
+	for _, e := range x.list {
+		s := e.stats
+		for _, a := range []*ExperimentArm{&s.Control, &s.Candidate} {
+			if a.Requests > 0 {
+				a.ErrorRate = float64(a.Errors) / float64(a.Requests)
+			}
+			if a.responses > 0 {
+				a.AvgLatencyMS = (a.latency / time.Duration(a.responses)).Milliseconds()
+			}
+		}
+		st = append(st, s)
+	}
+	return st
+}
+
+// assignExperiment puts a chat completion for a model under experiment in
+// an arm, rewriting its model to the candidate for the candidate arm. A
+// candidate that proxy_allowed_models refuses is never used.
+func (s *Server) assignExperiment(r *http.Request) *http.Request {
+	if r.Method != http.MethodPost || r.URL.Path != completionsPath || r.Body == nil || r.Header.Get("Content-Encoding") != "" {
+		return r
+	}
+	x := &s.experiments
+	x.mu.Lock()
+	running := len(x.list) > 0
+	x.mu.Unlock()
+	if !running {
+		return r
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	setBody(r, body)
+	if err != nil {
+		return r
+	}
+	e := x.forModel(sniffModel(body))
+	if e == nil {
+		return r
+	}
+
+	arm := x.pick(e, body)
+	if allowed := s.currentAllowedModels(); arm == ArmCandidate && len(allowed) > 0 && !modelAllowed(allowed, e.Candidate) {
+		arm = ArmControl
+	}
+	if arm == ArmCandidate {
+		var req map[string]json.RawMessage
+		if json.Unmarshal(body, &req) != nil {
+			return r
+		}
+		req["model"], _ = json.Marshal(e.Candidate)
+		rewritten, err := json.Marshal(req)
+		if err != nil {
+			return r
+		}
+		setBody(r, rewritten)
+		if s.config.Debug {
+			fmt.Fprintf(os.Stderr, "[proxy] Experiment %s: sending %s to %s\n", e.Name, e.Model, e.Candidate)
+		}
+	}
+
+	x.mu.Lock()
+	(&experimentRequest{exp: e, arm: arm}).stats().Requests++
+	x.mu.Unlock()
+	return r.WithContext(context.WithValue(r.Context(), experimentKey{}, &experimentRequest{exp: e, arm: arm, start: time.Now()}))
+}
+
+// experimentFrom returns the arm ctx's request was assigned to, or nil.
+func experimentFrom(ctx context.Context) *experimentRequest {
+	req, _ := ctx.Value(experimentKey{}).(*experimentRequest)
+	return req
+}
+
+// observeExperiment tags the response of a request in an experiment and
+// counts its latency and status.
+func (s *Server) observeExperiment(resp *http.Response) {
+	req := experimentFrom(resp.Request.Context())
+	if req == nil {
+		return
+	}
+	resp.Header.Set(ExperimentHeader, req.exp.Name+"; arm="+req.arm)
+	s.experiments.mu.Lock()
+	defer s.experiments.mu.Unlock()
+	a := req.stats()
+	a.latency += time.Since(req.start)
+	a.responses++
+	if resp.StatusCode >= 400 {
+		a.Errors++
+	}
+}
+
+// experimentFailed counts a request in an experiment that got no response.
+func (s *Server) experimentFailed(ctx context.Context) {
+	if req := experimentFrom(ctx); req != nil {
+		s.experiments.mu.Lock()
+		req.stats().Errors++
+		s.experiments.mu.Unlock()
+	}
+}
+
+// experimentUsage returns a function that counts a completion's usage
+// for ctx's arm, or nil when the request is in no experiment.
+func (s *Server) experimentUsage(ctx context.Context) func(RequestUsage) {
+	req := experimentFrom(ctx)
+	if req == nil {
+		return nil
+	}
+	return func(u RequestUsage) {
+		s.experiments.mu.Lock()
+		defer s.experiments.mu.Unlock()
+		a := req.stats()
+		a.Completions++
+		a.PromptTokens += u.PromptTokens
+		a.CompletionTokens += u.CompletionTokens
+	}
+}
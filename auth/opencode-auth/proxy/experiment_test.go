@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestExperiments(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model == "flaky" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"` + req.Model + `","usage":{"prompt_tokens":10,"completion_tokens":5}}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: upstream.URL,
+		Experiments: []config.Experiment{{Name: "trial", Model: "big", Candidate: "small", Percent: 50}},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolls := []int{10, 90, 49, 50}
+	s.experiments.roll = func([]byte) int {
+		n := rolls[0]
+		rolls = rolls[1:]
+		return n
+	}
+
+	send := func(model string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, httptest.NewRequest("POST", completionsPath, strings.NewReader(`{"model":"`+model+`","messages":[]}`)))
+		return rec
+	}
+	for i, want := range []struct{ arm, model string }{
+		{ArmCandidate, "small"},
+		{ArmControl, "big"},
+		{ArmCandidate, "small"},
+		{ArmControl, "big"},
+	} {
+		rec := send("big")
+		if got := rec.Header().Get(ExperimentHeader); got != "trial; arm="+want.arm {
+			t.Errorf("request %d: %s = %q, want arm %s", i, ExperimentHeader, got, want.arm)
+		}
+		if !strings.Contains(rec.Body.String(), `"model":"`+want.model+`"`) {
+			t.Errorf("request %d: upstream got %s, want %s", i, rec.Body.String(), want.model)
+		}
+	}
+	if rec := send("other"); rec.Header().Get(ExperimentHeader) != "" {
+		t.Error("a model without an experiment was tagged")
+	}
+
+	st := s.experiments.status()
+	if len(st) != 1 {
+		t.Fatalf("status() = %+v", st)
+	}
+	for _, a := range []ExperimentArm{st[0].Control, st[0].Candidate} {
+		if a.Requests != 2 || a.Errors != 0 || a.Completions != 2 || a.PromptTokens != 20 || a.CompletionTokens != 10 {
+			t.Errorf("arm %s = %+v", a.Model, a)
+		}
+	}
+
+	// Unchanged experiments keep their stats; a changed one starts over
+	if s.experiments.set([]config.Experiment{{Name: "trial", Model: "big", Candidate: "small", Percent: 50}}) {
+		t.Error("setting the same experiments reported a change")
+	}
+	s.experiments.set([]config.Experiment{{Name: "trial", Model: "big", Candidate: "flaky", Percent: 50}})
+	if st := s.experiments.status(); st[0].Candidate.Requests != 0 || st[0].Candidate.Model != "flaky" {
+		t.Errorf("stats were kept for a changed experiment: %+v", st[0])
+	}
+	rolls = []int{0}
+	send("big")
+	if st := s.experiments.status(); st[0].Candidate.Errors != 1 || st[0].Candidate.ErrorRate != 1 {
+		t.Errorf("candidate errors = %+v", st[0].Candidate)
+	}
+
+	// A candidate the allowlist refuses is never used
+	s.setAllowedModels([]string{"big"})
+	rolls = []int{0}
+	if rec := send("big"); rec.Header().Get(ExperimentHeader) != "trial; arm=control" {
+		t.Errorf("refused candidate used: %q", rec.Header().Get(ExperimentHeader))
+	}
+}
+
+func TestExperiments_Dedup(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"` + req.Model + `"}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: upstream.URL,
+		DedupWindow: time.Minute,
+		Experiments: []config.Experiment{{Name: "trial", Model: "big", Candidate: "small", Percent: 50}},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry lands in the arm of the first request and is coalesced with it
+	arms := map[string]int{}
+	for i := 0; i < 20; i++ {
+		body := fmt.Sprintf(`{"model":"big","messages":[{"role":"user","content":"question %d"}]}`, i)
+		var first, retry *httptest.ResponseRecorder
+		for _, rec := range []**httptest.ResponseRecorder{&first, &retry} {
+			*rec = httptest.NewRecorder()
+			s.handleRequest(*rec, httptest.NewRequest("POST", completionsPath, strings.NewReader(body)))
+		}
+		arm := first.Header().Get(ExperimentHeader)
+		if retry.Header().Get(ExperimentHeader) != arm || retry.Body.String() != first.Body.String() {
+			t.Errorf("question %d: retry got %q %s, first %q %s", i, retry.Header().Get(ExperimentHeader), retry.Body, arm, first.Body)
+		}
+		if retry.Header().Get("X-Opencode-Deduplicated") != "true" {
+			t.Errorf("question %d: retry was not coalesced", i)
+		}
+		arms[arm]++
+	}
+	if got := hits.Load(); got != 20 {
+		t.Errorf("upstream got %d requests, want 20", got)
+	}
+	if arms["trial; arm=control"] == 0 || arms["trial; arm=candidate"] == 0 {
+		t.Errorf("arms = %v, want both used", arms)
+	}
+}
@@ -0,0 +1,346 @@
+// Package proxy provides fault injection, so opencode's handling of upstream
+// errors, slow responses, and broken streams can be exercised without
+// touching the real router.
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault types.
+const (
+	FaultStatus  = "status"  // answer with Status instead of proxying
+	FaultLatency = "latency" // wait Delay before proxying
+	FaultDrop    = "drop"    // cut the connection after AfterBytes of the response
+)
+
+const (
+	// DefaultFaultTTL is how long faults stay active when no TTL is given,
+	// so a forgotten test setup doesn't keep breaking requests
+	DefaultFaultTTL = 15 * time.Minute
+
+	maxFaultTTL   = 24 * time.Hour
+	maxFaultDelay = 5 * time.Minute
+)
+
+// FaultRule injects one kind of failure into a share of proxied requests.
+type FaultRule struct {
+	Type string `json:"type"`
+	// Percent of matching requests affected, from 0 (exclusive) to 100
+	Percent float64 `json:"percent"`
+	// Path limits the rule to request paths with this prefix
+	Path string `json:"path,omitempty"`
+
+	Status     int    `json:"status,omitempty"`      // FaultStatus, e.g. 401, 429, 500
+	Delay      string `json:"delay,omitempty"`       // FaultLatency, e.g. "2s"
+	AfterBytes int    `json:"after_bytes,omitempty"` // FaultDrop
+
+	// Injected counts the requests the rule has affected (read-only)
+	Injected int64 `json:"injected"`
+
+	delay time.Duration
+}
+
+// Faults is the body of GET /api/admin/faults and the response to PUT.
+type Faults struct {
+	Rules     []FaultRule `json:"rules"`
+	ExpiresAt time.Time   `json:"expires_at,omitempty"`
+}
+
+// SetFaultsRequest is the body of PUT /api/admin/faults. It replaces the
+// active rules.
+type SetFaultsRequest struct {
+	Rules []FaultRule `json:"rules"`
+	TTL   string      `json:"ttl,omitempty"` // duration, default DefaultFaultTTL
+}
+
+// validate checks the rule and parses its delay.
+func (f *FaultRule) validate() error {
+	if f.Percent <= 0 || f.Percent > 100 {
+		return fmt.Errorf("percent must be in (0, 100], got %v", f.Percent)
+	}
+	if f.Path != "" && !strings.HasPrefix(f.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	switch f.Type {
+	case FaultStatus:
+		if f.Status < 400 || f.Status > 599 {
+			return fmt.Errorf("status must be 4xx or 5xx, got %d", f.Status)
+		}
+	case FaultLatency:
+		d, err := time.ParseDuration(f.Delay)
+		if err != nil || d <= 0 || d > maxFaultDelay {
+			return fmt.Errorf("delay must be a duration up to %v, got %q", maxFaultDelay, f.Delay)
+		}
+		f.delay = d
+	case FaultDrop:
+		if f.AfterBytes < 0 {
+			return fmt.Errorf("after_bytes must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown fault type %q (expected %s, %s, or %s)", f.Type, FaultStatus, FaultLatency, FaultDrop)
+	}
+	return nil
+}
+
+// faultInjector holds the active rules. The zero value injects nothing.
+type faultInjector struct {
+	mu        sync.Mutex
+	rules     []FaultRule
+	expiresAt time.Time
+	roll      func() float64 // returns [0, 100); nil uses math/rand
+}
+
+// set replaces the active rules.
+func (f *faultInjector) set(rules []FaultRule, ttl time.Duration) Faults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = rules
+	f.expiresAt = time.Now().Add(ttl)
+	if len(rules) == 0 {
+		f.expiresAt = time.Time{}
+	}
+	for _, r := range rules {
+		fmt.Fprintf(os.Stderr, "[proxy] FAULTS: %s until %s\n", r, f.expiresAt.Format(time.RFC3339))
+	}
+	return f.snapshotLocked()
+}
+
+// clear removes all rules. It reports whether any were active.
+func (f *faultInjector) clear(reason string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.clearLocked(reason)
+}
+
+func (f *faultInjector) clearLocked(reason string) bool {
+	active := len(f.rules) > 0
+	f.rules, f.expiresAt = nil, time.Time{}
+	if active {
+		fmt.Fprintf(os.Stderr, "[proxy] FAULTS: cleared (%s)\n", reason)
+	}
+	return active
+}
+
+// snapshot returns the active rules, or nil when there are none.
+func (f *faultInjector) snapshot() *Faults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expireLocked()
+	if len(f.rules) == 0 {
+		return nil
+	}
+	faults := f.snapshotLocked()
+	return &faults
+}
+
+func (f *faultInjector) snapshotLocked() Faults {
+	return Faults{Rules: append([]FaultRule{}, f.rules...), ExpiresAt: f.expiresAt}
+}
+
+func (f *faultInjector) expireLocked() {
+	if len(f.rules) > 0 && time.Now().After(f.expiresAt) {
+		f.clearLocked("expired")
+	}
+}
+
+// pick returns copies of the rules that fire for r, at most one of each
+// type, in rule order.
+func (f *faultInjector) pick(r *http.Request) []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expireLocked()
+
+	var fired []FaultRule
+	seen := map[string]bool{}
+	for i := range f.rules {
+		rule := &f.rules[i]
+		if seen[rule.Type] || !strings.HasPrefix(r.URL.Path, rule.Path) {
+			continue
+		}
+		roll := f.roll
+		if roll == nil {
+			roll = func() float64 { return mathrand.Float64() * 100 }
+		}
+		if roll() >= rule.Percent {
+			continue
+		}
+		seen[rule.Type] = true
+		rule.Injected++
+		fired = append(fired, *rule)
+	}
+	return fired
+}
+
+// inject applies the faults that fire for r. It returns the writer to
+// proxy with and whether the request was already answered.
+func (f *faultInjector) inject(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, bool) {
+	for _, rule := range f.pick(r) {
+		fmt.Fprintf(os.Stderr, "[proxy] FAULT: injected %s into %s %s\n", rule.action(), r.Method, r.URL.Path)
+		switch rule.Type {
+		case FaultLatency:
+			select {
+			case <-time.After(rule.delay):
+			case <-r.Context().Done():
+				return w, true
+			}
+		case FaultStatus:
+			writeInjectedStatus(w, rule.Status)
+			return w, true
+		case FaultDrop:
+			w.Header().Set("X-Opencode-Fault", FaultDrop)
+			w = &droppingWriter{ResponseWriter: w, remaining: rule.AfterBytes}
+		}
+	}
+	return w, false
+}
+
+// writeInjectedStatus answers with an OpenAI-style error, as the router
+// would.
+func writeInjectedStatus(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Opencode-Fault", FaultStatus)
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": fmt.Sprintf("%d %s (injected by opencode-auth proxy faults)", status, http.StatusText(status)),
+			"type":    "injected_fault",
+			"code":    status,
+		},
+	})
+}
+
+// String describes the rule for logs and 'proxy faults'.
+func (f FaultRule) String() string {
+	what := f.action()
+	if f.Path != "" {
+		what += " on " + f.Path + "*"
+	}
+	return fmt.Sprintf("%s for %g%% of requests", what, f.Percent)
+}
+
+// action describes what the rule does to a request.
+func (f FaultRule) action() string {
+	switch f.Type {
+	case FaultStatus:
+		return fmt.Sprintf("status %d", f.Status)
+	case FaultLatency:
+		return "latency " + f.Delay
+	case FaultDrop:
+		return fmt.Sprintf("drop after %d bytes", f.AfterBytes)
+	}
+	return f.Type
+}
+
+// droppingWriter passes on the first remaining bytes of the response, then
+// aborts the connection like a dropped stream.
+type droppingWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (d *droppingWriter) Write(p []byte) (int, error) {
+	if len(p) <= d.remaining {
+		d.remaining -= len(p)
+		return d.ResponseWriter.Write(p)
+	}
+	d.ResponseWriter.Write(p[:d.remaining])
+	d.Flush()
+	// net/http closes the connection without logging a stack trace
+	panic(http.ErrAbortHandler)
+}
+
+// Flush keeps streamed responses streaming.
+func (d *droppingWriter) Flush() {
+	http.NewResponseController(d.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the client connection.
+func (d *droppingWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// newAdminToken returns the random secret that authorizes /api/admin
+// requests. It is written to proxy.json, which only the user can read, so
+// local processes the peer check lets through (such as opencode) can't
+// change proxy behavior.
+func newAdminToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "" // admin endpoints stay disabled
+	}
+	return hex.EncodeToString(b)
+}
+
+// requireAdmin rejects requests without the admin token.
+func (s *Server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "admin token required; use the 'opencode-auth proxy' commands"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleFaults shows (GET), replaces (PUT), or clears (DELETE) the injected
+// faults.
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		faults := s.faults.snapshot()
+		if faults == nil {
+			faults = &Faults{Rules: []FaultRule{}}
+		}
+		json.NewEncoder(w).Encode(faults)
+	case http.MethodPut:
+		var req SetFaultsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+		ttl := DefaultFaultTTL
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > maxFaultTTL {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("ttl must be a duration up to %v, got %q", maxFaultTTL, req.TTL)})
+				return
+			}
+			ttl = d
+		}
+		for i := range req.Rules {
+			req.Rules[i].Injected = 0
+			if err := req.Rules[i].validate(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("rule %d: %v", i+1, err)})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(s.faults.set(req.Rules, ttl))
+	case http.MethodDelete:
+		json.NewEncoder(w).Encode(map[string]bool{"cleared": s.faults.clear("cancelled")})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
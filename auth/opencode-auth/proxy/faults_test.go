@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestFaults(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 4096)))
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "proxy-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, NoPeerCheck: true}
+
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(server.server.Handler)
+	defer front.Close()
+
+	adminAt := func(path, method, body, token string) *http.Response {
+		req, _ := http.NewRequest(method, front.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	admin := func(method, body, token string) *http.Response {
+		return adminAt("/api/admin/faults", method, body, token)
+	}
+
+	// Admin endpoints need the token from proxy.json
+	if resp := admin("PUT", `{"rules":[{"type":"status","status":500,"percent":100}]}`, "wrong"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("wrong admin token: status %d, want 403", resp.StatusCode)
+	}
+	if resp := adminAt("/api/admin/simulate-expiry", "POST", `{"in":"1m","fail_refresh":true}`, "wrong"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("simulate-expiry with a wrong admin token: status %d, want 403", resp.StatusCode)
+	}
+	if resp := admin("PUT", `{"rules":[{"type":"status","status":200,"percent":100}]}`, server.adminToken); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid rule: status %d, want 400", resp.StatusCode)
+	}
+
+	resp := admin("PUT", `{"rules":[{"type":"status","status":429,"percent":100,"path":"/v1/chat"}],"ttl":"1m"}`, server.adminToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status %d", resp.StatusCode)
+	}
+	resp, _ = http.Post(front.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{}`))
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" || !strings.Contains(string(body), "injected_fault") {
+		t.Errorf("injected 429 = %d %s", resp.StatusCode, body)
+	}
+	// Other paths are untouched
+	resp, _ = http.Get(front.URL + "/v1/models")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unmatched path: status %d", resp.StatusCode)
+	}
+
+	var faults Faults
+	resp = admin("GET", "", server.adminToken)
+	json.NewDecoder(resp.Body).Decode(&faults)
+	resp.Body.Close()
+	if len(faults.Rules) != 1 || faults.Rules[0].Injected != 1 {
+		t.Errorf("faults = %+v", faults)
+	}
+
+	// A dropped stream delivers the first bytes, then fails
+	admin("PUT", `{"rules":[{"type":"drop","after_bytes":100,"percent":100}]}`, server.adminToken)
+	resp, err = http.Get(front.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || len(body) != 100 {
+		t.Errorf("dropped stream: read %d bytes, err %v", len(body), err)
+	}
+
+	// Latency delays the request and then forwards it
+	admin("PUT", `{"rules":[{"type":"latency","delay":"200ms","percent":100}]}`, server.adminToken)
+	start := time.Now()
+	resp, _ = http.Get(front.URL + "/v1/models")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("latency fault: status %d after %v", resp.StatusCode, time.Since(start))
+	}
+
+	resp = admin("DELETE", "", server.adminToken)
+	json.NewDecoder(resp.Body).Decode(&map[string]bool{})
+	resp.Body.Close()
+	if server.faults.snapshot() != nil {
+		t.Error("faults still active after DELETE")
+	}
+}
+
+func TestFaults_PercentAndExpiry(t *testing.T) {
+	var f faultInjector
+	rolls := []float64{10, 30, 10}
+	f.roll = func() float64 {
+		r := rolls[0]
+		rolls = rolls[1:]
+		return r
+	}
+	rule := FaultRule{Type: FaultStatus, Status: 500, Percent: 20}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+	f.set([]FaultRule{rule}, time.Minute)
+
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	var injected int
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		if _, handled := f.inject(rec, req); handled {
+			injected++
+		}
+	}
+	if injected != 2 {
+		t.Errorf("injected %d of 3 with rolls 10, 30, 10 at 20%%", injected)
+	}
+
+	// Expired faults stop applying
+	f.mu.Lock()
+	f.expiresAt = time.Now().Add(-time.Second)
+	f.mu.Unlock()
+	if _, handled := f.inject(httptest.NewRecorder(), req); handled || f.snapshot() != nil {
+		t.Error("expired fault still applied")
+	}
+}
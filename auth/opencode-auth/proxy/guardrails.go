@@ -0,0 +1,305 @@
+// Package proxy provides cost guardrails: a max_tokens ceiling, a context
+// length cap, and a daily token budget, enforced on chat completion requests
+// before they leave the machine.
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// completionsPath is the only route guardrails apply to.
+const completionsPath = "/v1/chat/completions"
+
+// bytesPerToken is the rough request size of one input token, used to
+// estimate context length without a tokenizer.
+const bytesPerToken = 4
+
+// maxUsageBody is the largest non-streaming response scanned for usage.
+const maxUsageBody = 16 << 20
+
+// setGuardrails replaces the enforced limits and returns the previous ones.
+func (s *Server) setGuardrails(g config.Guardrails) config.Guardrails {
+	prev := s.guardrails.Swap(&g)
+	if prev == nil {
+		return config.Guardrails{}
+	}
+	return *prev
+}
+
+// currentGuardrails returns the enforced limits; all zero when none are set.
+func (s *Server) currentGuardrails() config.Guardrails {
+	if g := s.guardrails.Load(); g != nil {
+		return *g
+	}
+	return config.Guardrails{}
+}
+
+// tracksUsage reports whether a daily budget, enforced or soft, needs the
+// usage of each chat completion.
+func (s *Server) tracksUsage() bool {
+	return s.currentGuardrails().DailyTokenBudget > 0 || s.budget.get() > 0
+}
+
+// checkGuardrails enforces the guardrails on a chat completion request,
+// lowering max_tokens in the body if needed. It reports whether the request
+// was answered with an error.
+func (s *Server) checkGuardrails(w http.ResponseWriter, r *http.Request) bool {
+	g := s.currentGuardrails()
+	track := s.tracksUsage()
+	if (g == (config.Guardrails{}) && !track) || r.Method != http.MethodPost || r.URL.Path != completionsPath || r.Body == nil {
+		return false
+	}
+
+	used := s.usage.snapshot().Tokens
+	if g.DailyTokenBudget > 0 && used >= g.DailyTokenBudget {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+		writeProxyError(w, http.StatusTooManyRequests, "guardrail_exceeded", fmt.Sprintf(
+			"Daily token budget exhausted: %d of %d tokens used today. The budget resets at midnight.", used, g.DailyTokenBudget))
+		return true
+	}
+
+	// Compressed bodies can't be inspected; opencode doesn't send them
+	if r.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProxyError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Failed to read request body: %v", err))
+		return true
+	}
+	setBody(r, body)
+
+	if g.MaxContextTokens > 0 {
+		if estimate := len(body) / bytesPerToken; estimate > g.MaxContextTokens {
+			writeProxyError(w, http.StatusBadRequest, "guardrail_exceeded", fmt.Sprintf(
+				"Request context is about %d tokens, over the limit of %d. Start a new session or compact the conversation.", estimate, g.MaxContextTokens))
+			return true
+		}
+	}
+
+	remaining := 0
+	if g.DailyTokenBudget > 0 {
+		remaining = g.DailyTokenBudget - used
+	}
+	if adjusted, changed := adjustCompletionRequest(body, g.MaxTokens, remaining, track); changed {
+		if s.config.Debug {
+			fmt.Fprintf(os.Stderr, "[proxy] Guardrails adjusted request body: %s\n", adjusted)
+		}
+		setBody(r, adjusted)
+	}
+	return false
+}
+
+// adjustCompletionRequest lowers max_tokens and max_completion_tokens to
+// ceiling and to the remaining budget (zero means no limit), and sets
+// max_tokens when the request has neither and a ceiling is configured.
+// With includeUsage, streamed responses are asked to include usage so a
+// budget can be tracked. Bodies that aren't JSON objects are left alone.
+func adjustCompletionRequest(body []byte, ceiling, remaining int, includeUsage bool) ([]byte, bool) {
+	var req map[string]json.RawMessage
+	if json.Unmarshal(body, &req) != nil {
+		return body, false
+	}
+
+	limit := ceiling
+	if remaining > 0 && (limit == 0 || remaining < limit) {
+		limit = remaining
+	}
+	changed := false
+	present := false
+	for _, key := range []string{"max_tokens", "max_completion_tokens"} {
+		raw, ok := req[key]
+		if !ok {
+			continue
+		}
+		present = true
+		var n int
+		if json.Unmarshal(raw, &n) == nil && limit > 0 && n > limit {
+			req[key] = json.RawMessage(strconv.Itoa(limit))
+			changed = true
+		}
+	}
+	if !present && ceiling > 0 {
+		req["max_tokens"] = json.RawMessage(strconv.Itoa(limit))
+		changed = true
+	}
+
+	var stream bool
+	if includeUsage && json.Unmarshal(req["stream"], &stream) == nil && stream {
+		opts := map[string]json.RawMessage{}
+		json.Unmarshal(req["stream_options"], &opts)
+		if string(opts["include_usage"]) != "true" {
+			opts["include_usage"] = json.RawMessage("true")
+			req["stream_options"], _ = json.Marshal(opts)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return body, false
+	}
+	adjusted, err := json.Marshal(req)
+	if err != nil {
+		return body, false
+	}
+	return adjusted, true
+}
+
+// setBody replaces r's body with body.
+func setBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// writeProxyError answers a request the proxy refused with an OpenAI-style
+// error.
+func writeProxyError(w http.ResponseWriter, status int, errType, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": msg,
+			"type":    errType,
+			"code":    status,
+		},
+	})
+}
+
+// countTokens reads the usage a successful chat completion reports as the
+// client reads the response, and records it with recordUsage. Compressed
+// responses are not counted; with a daily budget the proxy asks for
+// uncompressed ones.
+func (s *Server) countTokens(resp *http.Response) {
+	if resp.Request.URL.Path != completionsPath || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	add := s.recordUsage
+	if arm := s.experimentUsage(resp.Request.Context()); arm != nil {
+		add = func(u RequestUsage) {
+			s.recordUsage(u)
+			arm(u)
+		}
+	}
+	resp.Body = &tokenCounter{
+		ReadCloser: resp.Body,
+		sse:        strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"),
+		add:        add,
+	}
+}
+
+// tokenCounter reads the usage object from a chat completion response as it
+// passes through: from the last "data:" event that has one when streaming,
+// otherwise from the whole body. A stream is only scanned line by line, never
+// held back, and its usage is reported at "data: [DONE]".
+type tokenCounter struct {
+	io.ReadCloser
+	sse   bool
+	buf   []byte
+	usage RequestUsage
+	found bool
+	done  bool
+	add   func(RequestUsage)
+}
+
+func (c *tokenCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.scan(p[:n])
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *tokenCounter) Close() error {
+	c.finish()
+	return c.ReadCloser.Close()
+}
+
+func (c *tokenCounter) scan(p []byte) {
+	if !c.sse {
+		if len(c.buf)+len(p) <= maxUsageBody {
+			c.buf = append(c.buf, p...)
+		}
+		return
+	}
+	c.buf = append(c.buf, p...)
+	for !c.done {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSpace(c.buf[:i])
+		c.buf = c.buf[i+1:]
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "[DONE]" {
+			c.finish()
+		} else if u, ok := parseUsage(data); ok {
+			c.usage, c.found = u, true
+		}
+	}
+	if len(c.buf) > maxUsageBody {
+		c.buf = nil
+	}
+}
+
+func (c *tokenCounter) finish() {
+	if c.done {
+		return
+	}
+	c.done = true
+	if !c.sse {
+		c.usage, c.found = parseUsage(c.buf)
+	}
+	c.buf = nil
+	if c.found {
+		c.usage.Streamed = c.sse
+		c.add(c.usage)
+	}
+}
+
+// parseUsage returns the usage a completion response or chunk reports, and
+// whether it reports any tokens.
+func parseUsage(data []byte) (RequestUsage, bool) {
+	if !bytes.Contains(data, []byte(`"usage"`)) {
+		return RequestUsage{}, false
+	}
+	var chunk struct {
+		Model string `json:"model"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(data, &chunk) != nil || chunk.Usage == nil {
+		return RequestUsage{}, false
+	}
+	u := RequestUsage{
+		Model:            chunk.Model,
+		PromptTokens:     chunk.Usage.PromptTokens,
+		CompletionTokens: chunk.Usage.CompletionTokens,
+		TotalTokens:      chunk.Usage.TotalTokens,
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	return u, u.TotalTokens > 0
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestGuardrails(t *testing.T) {
+	var sent map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = nil
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[],"usage":{"prompt_tokens":50,"completion_tokens":10,"total_tokens":60}}`)
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: backend.URL,
+		Guardrails:  config.Guardrails{MaxTokens: 100, MaxContextTokens: 1000, DailyTokenBudget: 100},
+	}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	post := func(body string) int {
+		t.Helper()
+		sent = nil
+		resp, err := http.Post(front.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// max_tokens is lowered to the ceiling
+	if status := post(`{"model":"m","max_tokens":500,"messages":[]}`); status != http.StatusOK || sent["max_tokens"] != 100.0 {
+		t.Fatalf("status %d, upstream max_tokens = %v, want 100", status, sent["max_tokens"])
+	}
+	if got := server.usage.snapshot().Tokens; got != 60 {
+		t.Errorf("tokens after one completion = %d, want 60", got)
+	}
+
+	// Oversized context is rejected locally
+	if status := post(`{"model":"m","messages":[{"role":"user","content":"` + strings.Repeat("x", 5000) + `"}]}`); status != http.StatusBadRequest || sent != nil {
+		t.Errorf("large context: status %d, sent upstream %v", status, sent != nil)
+	}
+
+	// A missing max_tokens is set to what is left of the budget
+	if status := post(`{"model":"m","messages":[]}`); status != http.StatusOK || sent["max_tokens"] != 40.0 {
+		t.Fatalf("status %d, upstream max_tokens = %v, want 40", status, sent["max_tokens"])
+	}
+
+	// Once the budget is spent, requests are refused until midnight
+	if status := post(`{"model":"m","messages":[]}`); status != http.StatusTooManyRequests || sent != nil {
+		t.Errorf("over budget: status %d, sent upstream %v", status, sent != nil)
+	}
+}
+
+func TestAdjustCompletionRequest_StreamUsage(t *testing.T) {
+	body, changed := adjustCompletionRequest([]byte(`{"stream":true,"stream_options":{"foo":1},"max_completion_tokens":20}`), 0, 1000, true)
+	var req struct {
+		StreamOptions       map[string]interface{} `json:"stream_options"`
+		MaxCompletionTokens int                    `json:"max_completion_tokens"`
+		MaxTokens           *int                   `json:"max_tokens"`
+	}
+	if err := json.Unmarshal(body, &req); !changed || err != nil {
+		t.Fatalf("changed = %v, err = %v", changed, err)
+	}
+	if req.StreamOptions["include_usage"] != true || req.StreamOptions["foo"] != 1.0 {
+		t.Errorf("stream_options = %v", req.StreamOptions)
+	}
+	if req.MaxCompletionTokens != 20 || req.MaxTokens != nil {
+		t.Errorf("max_completion_tokens = %d, max_tokens = %v", req.MaxCompletionTokens, req.MaxTokens)
+	}
+
+	if _, changed := adjustCompletionRequest([]byte(`{"max_tokens":20}`), 0, 0, false); changed {
+		t.Error("request changed without limits")
+	}
+}
+
+func TestTokenCounter_SSE(t *testing.T) {
+	stream := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3}}\n\n" +
+		"data: [DONE]\n\n"
+	var got int
+	c := &tokenCounter{ReadCloser: io.NopCloser(strings.NewReader(stream)), sse: true, add: func(u RequestUsage) { got += u.TotalTokens }}
+	io.Copy(io.Discard, c)
+	c.Close()
+	if got != 10 {
+		t.Errorf("counted %d tokens, want 10", got)
+	}
+}
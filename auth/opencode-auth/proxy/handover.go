@@ -0,0 +1,212 @@
+// Package proxy provides zero-downtime restarts: a background proxy starts
+// its replacement with its listening socket, so no connection is refused,
+// then finishes the requests it is serving and exits.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// listenFDEnv passes the inherited listening socket to a replacement
+	// proxy. ExtraFiles start at descriptor 3.
+	listenFDEnv = "OPENCODE_PROXY_LISTEN_FD"
+
+	// handoverReadyTimeout bounds how long the old proxy waits for its
+	// replacement to write proxy.json.
+	handoverReadyTimeout = 15 * time.Second
+
+	// handoverDrainTimeout bounds how long a replaced proxy keeps serving
+	// requests that were in flight, such as a long streamed completion.
+	handoverDrainTimeout = 10 * time.Minute
+)
+
+// HandoverResponse is the response to POST /api/admin/handover.
+type HandoverResponse struct {
+	PID int `json:"pid"`
+}
+
+// InheritsListener reports whether this process was started by a handover,
+// to take over from the proxy that is still running.
+func InheritsListener() bool {
+	return os.Getenv(listenFDEnv) != ""
+}
+
+// listen returns the socket handed over by the previous proxy, or a new one.
+func (s *Server) listen() (net.Listener, error) {
+	fd := os.Getenv(listenFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", s.server.Addr)
+	}
+	// A proxy this one starts later must bind its own
+	os.Unsetenv(listenFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", listenFDEnv, fd)
+	}
+	f := os.NewFile(uintptr(n), "proxy-listener")
+	defer f.Close() // FileListener keeps its own copy
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using the handed over socket: %w", err)
+	}
+	// The socket keeps the old proxy's port even if config.json changed it
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		s.port = addr.Port
+	}
+	return ln, nil
+}
+
+// Handover starts a replacement proxy on this proxy's socket and waits until
+// it has taken over proxy.json. HandedOver is then closed, and Stop drains
+// the requests still in flight instead of cutting them off. Only a
+// background proxy on Unix can hand over.
+func (s *Server) Handover() (int, error) {
+	if os.Getenv("OPENCODE_AUTH_PROXY_DAEMON") != "1" {
+		return 0, errors.New("only a background proxy can hand over its socket")
+	}
+	tcpListener, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return 0, errors.New("proxy is not listening")
+	}
+	f, err := tcpListener.File()
+	if err != nil {
+		return 0, fmt.Errorf("passing the socket: %w", err)
+	}
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	cmd := exec.Command(exe, "proxy", "start", "--foreground")
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr // proxy.log
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("starting the replacement proxy: %w", err)
+	}
+	// Passing f set the shared socket to blocking mode, which would leave
+	// this proxy stuck in accept, taking one more connection after Stop
+	if rc, err := tcpListener.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) { setNonblock(fd) })
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	pid := cmd.Process.Pid
+	deadline := time.After(handoverReadyTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	// The replacement may have taken the tokens; this proxy keeps them
+	failed := func() {
+		if s.refresher != nil {
+			s.refresher.Release()
+		}
+	}
+	for {
+		select {
+		case err := <-exited:
+			failed()
+			return 0, fmt.Errorf("replacement proxy exited: %v", err)
+		case <-deadline:
+			cmd.Process.Kill()
+			<-exited
+			failed()
+			return 0, errors.New("replacement proxy did not start in time")
+		case <-ticker.C:
+			if current, err := LoadProxyConfig(s.config); err == nil && current.PID == pid {
+				s.handoverOnce.Do(func() { close(s.handedOver) })
+				return pid, nil
+			}
+		}
+	}
+}
+
+// HandedOver is closed once a replacement proxy has taken over. Whatever
+// runs the server should then Stop it.
+func (s *Server) HandedOver() <-chan struct{} {
+	return s.handedOver
+}
+
+// isHandedOver reports whether a replacement proxy has taken over.
+func (s *Server) isHandedOver() bool {
+	select {
+	case <-s.handedOver:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleHandover replaces this proxy with a fresh one (POST).
+func (s *Server) handleHandover(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "use POST"})
+		return
+	}
+	pid, err := s.Handover()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Handover failed: %v\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Handed over to PID %d; finishing requests in flight\n", pid)
+	json.NewEncoder(w).Encode(HandoverResponse{PID: pid})
+}
+
+// HandoverProxy asks the running background proxy to start its replacement
+// on the same socket, so a restart drops no requests. The replacement runs
+// the current executable with the old proxy's environment. Callers fall
+// back to StopProxy and StartProxy when it fails.
+func HandoverProxy(cfg *config.Config) (*ProxyConfig, error) {
+	proxyConfig, err := LoadProxyConfig(cfg)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !IsProcessRunning(proxyConfig.PID)) {
+		return nil, ErrNotRunning
+	}
+	if err != nil {
+		return nil, err
+	}
+	if proxyConfig.AdminToken == "" {
+		return nil, errors.New("running proxy does not support handover")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handoverReadyTimeout+5*time.Second)
+	defer cancel()
+	url := fmt.Sprintf("http://localhost:%d/api/admin/handover", proxyConfig.Port)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+proxyConfig.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.New("running proxy does not support handover")
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return nil, fmt.Errorf("handover failed: %s", errResp.Error)
+	}
+	return LoadProxyConfig(cfg)
+}
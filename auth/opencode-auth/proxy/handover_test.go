@@ -0,0 +1,91 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestStart_InheritsListener(t *testing.T) {
+	tempDir := t.TempDir()
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: filepath.Join(tempDir, "tokens.json"), APIEndpoint: "http://127.0.0.1:1"}
+
+	// The old proxy: listening, and recorded in proxy.json as running
+	old, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	port := old.Addr().(*net.TCPAddr).Port
+	SaveProxyConfig(cfg, &ProxyConfig{Port: port, PID: os.Getpid()})
+
+	// Pass it the way Handover does, as a descriptor the new proxy owns
+	f, err := old.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(listenFDEnv, strconv.Itoa(fd))
+
+	server, err := NewServerWithPort(cfg, port)
+	if err != nil {
+		t.Fatalf("NewServerWithPort() on the inherited port: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	if InheritsListener() {
+		t.Error("listen fd still set for processes the proxy starts")
+	}
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", port))
+	if err != nil {
+		t.Fatalf("health on the inherited socket: %v", err)
+	}
+	resp.Body.Close()
+
+	// After a handover, proxy.json belongs to the replacement
+	server.handoverOnce.Do(func() { close(server.handedOver) })
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProxyConfig(cfg); err != nil {
+		t.Errorf("proxy.json removed after handover: %v", err)
+	}
+}
+
+func TestHandover_Refused(t *testing.T) {
+	tempDir := t.TempDir()
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: filepath.Join(tempDir, "tokens.json"), APIEndpoint: "http://127.0.0.1:1"}
+	if _, err := HandoverProxy(cfg); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("HandoverProxy() with no proxy = %v, want ErrNotRunning", err)
+	}
+
+	// A proxy in a terminal has nothing to hand over to
+	t.Setenv("OPENCODE_AUTH_PROXY_DAEMON", "")
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Handover(); err == nil {
+		t.Error("Handover() succeeded for a foreground proxy")
+	}
+	select {
+	case <-server.HandedOver():
+		t.Error("HandedOver closed after a failed handover")
+	default:
+	}
+}
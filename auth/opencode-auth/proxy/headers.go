@@ -0,0 +1,69 @@
+// Package proxy provides header hygiene for proxied requests, so a local
+// client cannot smuggle its own credentials or spoof forwarding headers
+// upstream.
+package proxy
+
+import (
+	"net/http"
+)
+
+// Values of the proxy_forwarded_headers setting.
+const (
+	// ForwardedStrip sends no X-Forwarded-* headers upstream (the default)
+	ForwardedStrip = "strip"
+	// ForwardedSet sends X-Forwarded-For/Proto/Host describing the local hop
+	ForwardedSet = "set"
+)
+
+// credentialHeaders carry credentials only the proxy may set. A client
+// value left in place would be sent upstream whenever the proxy falls back
+// to the other auth mode, and X-API-Key changes ALB routing on its own.
+var credentialHeaders = []string{
+	"Authorization",
+	"X-API-Key",
+	"Proxy-Authorization",
+	"X-Client-Version",
+	"X-Device-Assertion",
+}
+
+// forwardingHeaders describe the path a request took. Only the proxy knows
+// that path, so client values are always dropped.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// sanitizeHeaders removes client-supplied credential and forwarding headers
+// from an outgoing request before the proxy adds its own. Hop-by-hop headers
+// (Connection and the fields it names, Keep-Alive, TE, Upgrade, ...) are
+// removed afterwards by httputil.ReverseProxy, which needs to see Upgrade
+// and TE first.
+//
+// It runs in the Director, where req still carries the client's Host and TLS
+// state; policy is the proxy_forwarded_headers setting.
+func sanitizeHeaders(req *http.Request, policy string) {
+	for _, h := range credentialHeaders {
+		req.Header.Del(h)
+	}
+	for _, h := range forwardingHeaders {
+		req.Header.Del(h)
+	}
+
+	if policy != ForwardedSet {
+		// A nil value tells ReverseProxy not to add X-Forwarded-For itself
+		req.Header["X-Forwarded-For"] = nil
+		return
+	}
+	// ReverseProxy sets X-Forwarded-For to the client address, now that no
+	// client value is left to append to
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+}
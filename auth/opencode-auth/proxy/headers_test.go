@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestProxyHeaderHygiene(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "proxy-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	send := func(cfg *config.Config) {
+		t.Helper()
+		server, err := newServerInternal(cfg, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+		defer front.Close()
+
+		req, _ := http.NewRequest("GET", front.URL+"/v1/models", nil)
+		for name, value := range map[string]string{
+			"Authorization":       "Bearer smuggled",
+			"X-API-Key":           "oc_smuggled",
+			"Proxy-Authorization": "Basic smuggled",
+			"X-Forwarded-For":     "203.0.113.7",
+			"X-Forwarded-Host":    "spoofed.example.com",
+			"X-Forwarded-Proto":   "https",
+			"Forwarded":           "for=203.0.113.7",
+			"X-Real-Ip":           "203.0.113.7",
+			"Connection":          "X-Hop-Secret",
+			"X-Hop-Secret":        "hop",
+			"Keep-Alive":          "timeout=5",
+			"X-Custom":            "kept",
+		} {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	expectAbsent := func(mode string, names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if v, ok := got[http.CanonicalHeaderKey(name)]; ok {
+				t.Errorf("%s: upstream received %s: %v", mode, name, v)
+			}
+		}
+	}
+
+	// JWT mode: only the proxy's bearer token goes upstream
+	send(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL})
+	if auth := got.Get("Authorization"); auth != "Bearer proxy-token" {
+		t.Errorf("jwt: Authorization = %q, want the proxy's token", auth)
+	}
+	if got.Get("Accept-Encoding") == "" {
+		t.Error("jwt: end-to-end header Accept-Encoding was dropped")
+	}
+	// Not on the client header allowlist
+	expectAbsent("jwt", "X-Custom", "X-API-Key", "Proxy-Authorization", "X-Forwarded-For", "X-Forwarded-Host",
+		"X-Forwarded-Proto", "Forwarded", "X-Real-Ip", "X-Hop-Secret", "Keep-Alive")
+
+	// API key mode: a client Authorization header must not ride along
+	send(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, APIKey: "oc_configured_key"})
+	if key := got.Get("X-API-Key"); key != "oc_configured_key" {
+		t.Errorf("api key: X-API-Key = %q, want the configured key", key)
+	}
+	expectAbsent("api key", "Authorization", "X-Forwarded-For")
+
+	// "set": forwarding headers describe the local hop, not the client's claims
+	send(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, ForwardedHeaders: ForwardedSet})
+	if xff := got.Get("X-Forwarded-For"); xff != "127.0.0.1" {
+		t.Errorf("set: X-Forwarded-For = %q, want 127.0.0.1", xff)
+	}
+	if proto := got.Get("X-Forwarded-Proto"); proto != "http" {
+		t.Errorf("set: X-Forwarded-Proto = %q, want http", proto)
+	}
+	if host := got.Get("X-Forwarded-Host"); host == "" || host == "spoofed.example.com" {
+		t.Errorf("set: X-Forwarded-Host = %q, want the proxy's host", host)
+	}
+	expectAbsent("set", "Forwarded", "X-Real-Ip")
+}
@@ -0,0 +1,95 @@
+// Package proxy provides the helper listener: a second loopback port, apart
+// from the one opencode uses, where wrapper scripts and MCP servers send
+// their child tokens. It serves only proxied API paths and every request
+// needs a live child token, so a helper can't read /api/token or make a
+// request without a scope. The port is picked at startup and returned with
+// each child token; like the tokens, it lasts until the proxy stops.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// helperRequestKey marks the context of a request from the helper listener.
+type helperRequestKey struct{}
+
+// isHelperRequest reports whether r came in on the helper listener.
+func isHelperRequest(r *http.Request) bool {
+	helper, _ := r.Context().Value(helperRequestKey{}).(bool)
+	return helper
+}
+
+// listenHelpers binds the helper listener. Failure only disables child
+// tokens.
+func (s *Server) listenHelpers() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: child tokens disabled: %v\n", err)
+		return
+	}
+	s.helpers = listener
+}
+
+// helperURL returns the base URL of the helper listener, or "" when it is
+// not bound.
+func (s *Server) helperURL() string {
+	if s.helpers == nil {
+		return ""
+	}
+	return "http://" + s.helpers.Addr().String()
+}
+
+// serveHelpers serves the helper listener until the server stops.
+func (s *Server) serveHelpers() {
+	if s.helpers == nil {
+		return
+	}
+	server := &http.Server{Handler: s.helperHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-s.stopChan
+		server.Close()
+	}()
+	if err := server.Serve(s.helpers); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: helper listener: %v\n", err)
+	}
+}
+
+// helperHandler proxies the requests of helper tools. A request without a
+// child token is refused; checkChildToken then holds the others to their
+// scope.
+func (s *Server) helperHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := childTokenFrom(r); !ok {
+			s.broker.refuse()
+			writeProxyError(w, http.StatusUnauthorized, "child_token_required",
+				"This port only accepts child tokens. Get one with 'opencode-auth token exchange'.")
+			return
+		}
+		s.handleRequest(w, r.WithContext(context.WithValue(r.Context(), helperRequestKey{}, true)))
+	})
+}
+
+// refuseChildTokens wraps the main listener, where a child token is never
+// accepted: it would stand in for the user's credentials on every route,
+// /api/token included.
+func (s *Server) refuseChildTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := childTokenFrom(r); ok && !isHelperRequest(r) {
+			s.refuseOffHelperListener(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) refuseOffHelperListener(w http.ResponseWriter) {
+	s.broker.refuse()
+	writeProxyError(w, http.StatusForbidden, "child_token_listener",
+		"Child tokens are only accepted at the base_url returned with them.")
+}
@@ -0,0 +1,314 @@
+// Package proxy provides an opt-in local history of proxied requests, so
+// users can check whether a request left the machine without enabling debug
+// logging. The newest streaming response is kept as well (see tap.go).
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// historyFile holds one JSON entry per line inside the config directory
+	historyFile = "proxy-history.jsonl"
+
+	// HistorySize is the number of requests kept. The file grows to twice
+	// this before it is compacted back to the newest HistorySize entries.
+	HistorySize = 200
+
+	// historyModelScan is how much of a request body is kept to find the
+	// "model" field
+	historyModelScan = 64 << 10
+)
+
+// HistoryEntry is one request handled by the proxy. Request and response
+// bodies are never recorded.
+type HistoryEntry struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"` // without the query string
+	Model  string    `json:"model,omitempty"`
+	// Status is the status returned to the client, 0 if none was written
+	Status int `json:"status"`
+	// LatencyMS is the time until the response headers; DurationMS also
+	// covers the body, e.g. a whole stream
+	LatencyMS  int64 `json:"latency_ms"`
+	DurationMS int64 `json:"duration_ms"`
+	BytesIn    int64 `json:"bytes_in"`
+	BytesOut   int64 `json:"bytes_out"`
+	// Error is set when no upstream response arrived (the proxy answered
+	// 502 itself), e.g. a DNS, connect, or TLS failure
+	Error string `json:"error,omitempty"`
+}
+
+// Failed reports whether the request did not succeed.
+func (e HistoryEntry) Failed() bool {
+	return e.Error != "" || e.Status == 0 || e.Status >= 400
+}
+
+// HistoryPath returns the request history file for cfg.
+func HistoryPath(cfg *config.Config) string {
+	return filepath.Join(cfg.ConfigDir, historyFile)
+}
+
+// LoadHistory returns the newest HistorySize entries at path, oldest first.
+// A missing file yields no entries; malformed lines are skipped.
+func LoadHistory(path string) ([]HistoryEntry, error) {
+	entries, _, err := readHistory(path)
+	return entries, err
+}
+
+// ClearHistory deletes the request history at path and the stream captured
+// next to it.
+func ClearHistory(path string) error {
+	for _, p := range []string{path, filepath.Join(filepath.Dir(path), streamFile)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHistory returns the newest HistorySize entries at path and the number
+// of lines in the file.
+func readHistory(path string) ([]HistoryEntry, int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening request history: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		var e HistoryEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) > HistorySize {
+		entries = entries[len(entries)-HistorySize:]
+	}
+	return entries, lines, scanner.Err()
+}
+
+// requestHistory appends entries to the history file. The file on disk is
+// the ring buffer: it is compacted to the newest HistorySize entries once it
+// holds twice that many, so the proxy keeps no copy in memory.
+type requestHistory struct {
+	enabled atomic.Bool
+	path    string
+	tap     *streamTap
+
+	mu    sync.Mutex
+	lines int // -1 until the existing file has been counted
+}
+
+func newRequestHistory(path string, enabled bool) *requestHistory {
+	h := &requestHistory{path: path, lines: -1, tap: &streamTap{path: filepath.Join(filepath.Dir(path), streamFile)}}
+	h.enabled.Store(enabled)
+	return h
+}
+
+// add appends e to the history file, compacting it when it is full.
+func (h *requestHistory) add(e HistoryEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lines < 0 {
+		_, h.lines, _ = readHistory(h.path)
+	}
+	if h.lines >= 2*HistorySize {
+		h.compact()
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: could not record request history: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err == nil {
+		h.lines++
+	}
+}
+
+// compact rewrites the file with its newest HistorySize entries. Callers
+// hold mu.
+func (h *requestHistory) compact() {
+	entries, _, err := readHistory(h.path)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		data, _ := json.Marshal(e)
+		buf.Write(append(data, '\n'))
+	}
+
+	tmpPath := h.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmpPath, h.path); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	h.lines = len(entries)
+}
+
+// historyKey is the context key for the entry of the request being proxied
+type historyKey struct{}
+
+// historyEntryFrom returns the entry being recorded for ctx's request, or
+// nil when history is off.
+func historyEntryFrom(ctx context.Context) *HistoryEntry {
+	e, _ := ctx.Value(historyKey{}).(*HistoryEntry)
+	return e
+}
+
+// historyRecorder observes one request as it is proxied.
+type historyRecorder struct {
+	http.ResponseWriter
+	entry     HistoryEntry
+	start     time.Time
+	headersAt time.Time
+	body      *historyBody
+	tap       *streamTap
+	stream    *streamCapture // set for an event stream
+}
+
+// begin starts recording r, returning the writer and request to proxy with.
+func (h *requestHistory) begin(w http.ResponseWriter, r *http.Request) (*historyRecorder, *http.Request) {
+	rec := &historyRecorder{
+		ResponseWriter: w,
+		start:          time.Now(),
+		entry:          HistoryEntry{Method: r.Method, Path: r.URL.Path},
+		tap:            h.tap,
+	}
+	rec.entry.Time = rec.start.UTC()
+	r = r.WithContext(context.WithValue(r.Context(), historyKey{}, &rec.entry))
+	if r.Body != nil && r.Body != http.NoBody {
+		rec.body = &historyBody{ReadCloser: r.Body, sniff: strings.Contains(r.Header.Get("Content-Type"), "json")}
+		r.Body = rec.body
+	}
+	return rec, r
+}
+
+// finish records the completed request.
+func (h *requestHistory) finish(rec *historyRecorder) {
+	e := rec.entry
+	e.DurationMS = time.Since(rec.start).Milliseconds()
+	if !rec.headersAt.IsZero() {
+		e.LatencyMS = rec.headersAt.Sub(rec.start).Milliseconds()
+	}
+	if rec.body != nil {
+		e.BytesIn = rec.body.n
+		e.Model = sniffModel(rec.body.head)
+	}
+	if rec.stream != nil {
+		rec.stream.end()
+	}
+	h.add(e)
+}
+
+func (rec *historyRecorder) WriteHeader(code int) {
+	if rec.entry.Status == 0 && code >= 200 {
+		rec.entry.Status = code
+		rec.headersAt = time.Now()
+		if strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+			info := StreamInfo{Time: rec.headersAt.UTC(), Method: rec.entry.Method, Path: rec.entry.Path, Status: code}
+			if rec.body != nil {
+				info.Model = sniffModel(rec.body.head)
+			}
+			rec.stream = rec.tap.begin(info)
+		}
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *historyRecorder) Write(p []byte) (int, error) {
+	if rec.entry.Status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.entry.BytesOut += int64(n)
+	if rec.stream != nil {
+		rec.stream.write(p[:n])
+	}
+	return n, err
+}
+
+// Flush keeps streamed responses streaming.
+func (rec *historyRecorder) Flush() {
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the client connection.
+func (rec *historyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// historyBody counts the request body and keeps its start for sniffModel.
+type historyBody struct {
+	io.ReadCloser
+	sniff bool
+	n     int64
+	head  []byte
+}
+
+func (b *historyBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.sniff && len(b.head) < historyModelScan {
+		b.head = append(b.head, p[:min(n, historyModelScan-len(b.head))]...)
+	}
+	return n, err
+}
+
+// sniffModel returns the top-level "model" field of a JSON request body,
+// which may be truncated after the field.
+func sniffModel(body []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return ""
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if key, _ := t.(string); key == "model" {
+			var model string
+			dec.Decode(&model)
+			return model
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestRequestHistory(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"id":"chatcmpl-1"}`))
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "proxy-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, RequestHistory: true}
+
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	body := `{"messages":[{"role":"user","content":"hi"}],"model":"claude-sonnet","stream":false}`
+	resp, err := http.Post(front.URL+"/v1/chat/completions?debug=1", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, _ = http.Get(front.URL + "/v1/missing")
+	resp.Body.Close()
+
+	// An unreachable upstream is recorded with the cause
+	backend.Close()
+	resp, _ = http.Get(front.URL + "/v1/models")
+	resp.Body.Close()
+
+	entries, err := LoadHistory(HistoryPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3: %+v", len(entries), entries)
+	}
+	ok, missing, down := entries[0], entries[1], entries[2]
+	if ok.Path != "/v1/chat/completions" || ok.Model != "claude-sonnet" || ok.Status != 200 || ok.Failed() {
+		t.Errorf("completion entry = %+v", ok)
+	}
+	if ok.BytesIn != int64(len(body)) || ok.BytesOut != int64(len(`{"id":"chatcmpl-1"}`)) {
+		t.Errorf("bytes = %d in / %d out", ok.BytesIn, ok.BytesOut)
+	}
+	if missing.Status != 404 || !missing.Failed() {
+		t.Errorf("404 entry = %+v", missing)
+	}
+	if down.Status != http.StatusBadGateway || down.Error == "" {
+		t.Errorf("unreachable upstream entry = %+v", down)
+	}
+
+	// Disabled history records nothing
+	server.history.enabled.Store(false)
+	resp, _ = http.Get(front.URL + "/v1/models")
+	resp.Body.Close()
+	if entries, _ := LoadHistory(HistoryPath(cfg)); len(entries) != 3 {
+		t.Errorf("disabled history recorded a request: %d entries", len(entries))
+	}
+}
+
+func TestRequestHistory_Compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), historyFile)
+	h := newRequestHistory(path, true)
+	for i := 0; i < 2*HistorySize+10; i++ {
+		h.add(HistoryEntry{Path: "/v1/models", Status: 200 + i})
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 2*HistorySize {
+		t.Errorf("history file has %d lines, want at most %d", lines, 2*HistorySize)
+	}
+	entries, _ := LoadHistory(path)
+	if len(entries) != HistorySize || entries[len(entries)-1].Status != 200+2*HistorySize+9 {
+		t.Errorf("got %d entries ending with status %d", len(entries), entries[len(entries)-1].Status)
+	}
+}
+
+func TestSniffModel(t *testing.T) {
+	tests := map[string]string{
+		`{"model":"a"}`:                              "a",
+		`{"messages":[{"x":1}],"model":"b"}`:         "b",
+		`{"model":"c","messages":[{"content":"trunc`: "c",
+		`{"messages":[{"content":"trunc`:             "",
+		`[1,2]`:                                      "",
+		``:                                           "",
+	}
+	for body, want := range tests {
+		if got := sniffModel([]byte(body)); got != want {
+			t.Errorf("sniffModel(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Package proxy provides log file capture and rotation for the daemonized proxy.
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// proxyLogFile receives the background proxy's stdout and stderr
+	proxyLogFile = "proxy.log"
+
+	// MaxLogSize is the size at which the proxy log is rotated
+	MaxLogSize = 5 * 1024 * 1024
+
+	// maxLogBackups is how many rotated logs (proxy.log.1 ... .N) are kept
+	maxLogBackups = 3
+
+	// logRotateInterval is how often the daemon checks the log size
+	logRotateInterval = time.Minute
+
+	// daemonLogMarker starts the output of each background proxy in the log
+	daemonLogMarker = "=== proxy daemon starting"
+)
+
+// LogPath returns the path of the background proxy's log file.
+func LogPath(cfg *config.Config) string {
+	return filepath.Join(cfg.ConfigDir, proxyLogFile)
+}
+
+// openDaemonLog rotates the proxy log if it is over MaxLogSize and opens it
+// for appending. The file is handed to the daemon as stdout and stderr, so
+// panics and runtime errors are captured too.
+func openDaemonLog(cfg *config.Config) (*os.File, error) {
+	path := LogPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	if _, err := rotateLogIfNeeded(path, MaxLogSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to rotate proxy log: %v\n", err)
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// rotateLogIfNeeded renames path to path.1, shifting older backups, when it
+// exceeds maxSize, and reports whether it did. A process writing to the log
+// keeps writing to path.1 until it reopens path, so no line is lost.
+func rotateLogIfNeeded(path string, maxSize int64) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < maxSize {
+		return false, nil
+	}
+
+	for i := maxLogBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reopenDaemonLog points this process's stdout and stderr at a new log at
+// path, after rotateLogIfNeeded moved the old one away.
+func reopenDaemonLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return redirectStdio(f)
+}
+
+// watchLogSize periodically rotates the daemon's log until stop is closed.
+// Windows can't rename a file that is open, so there the log is only
+// rotated when the next daemon starts.
+func watchLogSize(path string, stop <-chan struct{}) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	ticker := time.NewTicker(logRotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rotated, err := rotateLogIfNeeded(path, MaxLogSize)
+			if err == nil && rotated {
+				err = reopenDaemonLog(path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: failed to rotate log: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
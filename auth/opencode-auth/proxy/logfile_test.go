@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRotateLogIfNeeded_UnderLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	os.WriteFile(path, []byte("small\n"), 0600)
+
+	if rotated, err := rotateLogIfNeeded(path, 1024); err != nil || rotated {
+		t.Fatalf("rotateLogIfNeeded() = %v, %v", rotated, err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Error("expected no backup for a log under the limit")
+	}
+}
+
+func TestRotateLogIfNeeded_KeepsOpenWriter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows can't rename an open file")
+	}
+	path := filepath.Join(t.TempDir(), "proxy.log")
+
+	// Simulate the daemon holding the log open with O_APPEND
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(strings.Repeat("x", 100))
+	os.WriteFile(path+".1", []byte("older"), 0600)
+
+	if rotated, err := rotateLogIfNeeded(path, 50); err != nil || !rotated {
+		t.Fatalf("rotateLogIfNeeded() = %v, %v", rotated, err)
+	}
+	if older, _ := os.ReadFile(path + ".2"); string(older) != "older" {
+		t.Errorf("previous backup not shifted to .2, got %q", older)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log still at %s after rotation: %v", path, err)
+	}
+
+	// Writes before the daemon reopens the log land in the backup
+	f.WriteString("after")
+	if backup, _ := os.ReadFile(path + ".1"); string(backup) != strings.Repeat("x", 100)+"after" {
+		t.Errorf("backup = %q, want every line written", backup)
+	}
+}
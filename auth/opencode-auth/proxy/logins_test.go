@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/urlscheme"
+)
+
+// startCallbackServer starts a callback server on a free port expecting state.
+func startCallbackServer(t *testing.T, state string) (*auth.CallbackServer, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cs, err := auth.NewCallbackServer(&config.Config{CallbackPort: port}, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Start()
+	t.Cleanup(func() { cs.Shutdown(context.Background()) })
+	return cs, fmt.Sprintf("http://127.0.0.1:%d/callback", port)
+}
+
+func TestCallbackServer_SingleUseState(t *testing.T) {
+	cs, callbackURL := startCallbackServer(t, "expected-state")
+
+	resp, err := http.Get(callbackURL + "?code=abc&state=expected-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	result, err := cs.WaitForCallback(context.Background(), 5*time.Second)
+	if err != nil || result.Err != nil || result.Code != "abc" {
+		t.Fatalf("result = %+v, %v", result, err)
+	}
+
+	// Replaying the same callback URL is refused and produces no result
+	resp, err = http.Get(callbackURL + "?code=abc&state=expected-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := cs.WaitForCallback(context.Background(), 100*time.Millisecond); !errors.Is(err, auth.ErrCallbackTimeout) {
+		t.Errorf("replayed callback: err = %v, want timeout", err)
+	}
+}
+
+func TestCallbackServer_Errors(t *testing.T) {
+	tests := []struct {
+		query   string
+		outcome string
+	}{
+		{"code=abc&state=other", auth.LoginStateMismatch},
+		{"code=abc", auth.LoginStateMismatch},
+		{"error=access_denied&error_description=" + url.QueryEscape("user cancelled"), auth.LoginIdPError},
+		{"state=expected-state", auth.LoginFailed},
+	}
+	for _, tt := range tests {
+		cs, callbackURL := startCallbackServer(t, "expected-state")
+		resp, err := http.Get(callbackURL + "?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		result, err := cs.WaitForCallback(context.Background(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Code != "" || auth.LoginOutcome(result.Err) != tt.outcome {
+			t.Errorf("%s: result = %+v, outcome %q, want %q", tt.query, result, auth.LoginOutcome(result.Err), tt.outcome)
+		}
+	}
+}
+
+func TestCallbackServer_PortFallback(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	busyURI := fmt.Sprintf("http://127.0.0.1:%d/callback", busy.Addr().(*net.TCPAddr).Port)
+	freeURI := fmt.Sprintf("http://127.0.0.1:%d/oauth2/callback", freePort)
+	cfg := &config.Config{RedirectURIs: []string{busyURI, freeURI}}
+	cs, err := auth.NewCallbackServer(cfg, "expected-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Start()
+	defer cs.Shutdown(context.Background())
+	if cs.RedirectURI() != freeURI {
+		t.Fatalf("RedirectURI() = %q, want %q", cs.RedirectURI(), freeURI)
+	}
+
+	// The registered path receives the callback
+	resp, err := http.Get(freeURI + "?code=abc&state=expected-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if result, err := cs.WaitForCallback(context.Background(), 5*time.Second); err != nil || result.Code != "abc" {
+		t.Fatalf("result = %+v, %v", result, err)
+	}
+
+	// The same redirect_uri is sent in the authorize request and exchange
+	pkce, _ := auth.GeneratePKCE()
+	u, _ := url.Parse(auth.AuthURL(cfg, cs.RedirectURI(), pkce, "state"))
+	if got := u.Query().Get("redirect_uri"); got != freeURI {
+		t.Errorf("authorize redirect_uri = %q", got)
+	}
+
+	if _, err := auth.NewCallbackServer(&config.Config{RedirectURIs: []string{busyURI}}, "s"); err == nil || !strings.Contains(err.Error(), "no callback port is free") {
+		t.Errorf("all ports busy: err = %v", err)
+	}
+	if _, err := auth.NewCallbackServer(&config.Config{RedirectURIs: []string{"https://example.com:443/callback"}}, "s"); err == nil {
+		t.Error("non-loopback redirect URI accepted")
+	}
+}
+
+func TestCallbackServer_URLScheme(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("registers the scheme with a desktop entry")
+	}
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("PATH", "")
+	dir := t.TempDir()
+	cfg := &config.Config{ConfigDir: dir, RedirectURIs: []string{"opencode-auth://callback"}}
+
+	if _, err := auth.NewCallbackServer(cfg, "s"); err == nil || !strings.Contains(err.Error(), "url-scheme register") {
+		t.Errorf("unregistered scheme: err = %v", err)
+	}
+	urlscheme.Register("opencode-auth", "/usr/local/bin/opencode-auth")
+
+	cs, err := auth.NewCallbackServer(cfg, "expected-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Start()
+	defer cs.Shutdown(context.Background())
+	if cs.RedirectURI() != "opencode-auth://callback" {
+		t.Errorf("RedirectURI() = %q", cs.RedirectURI())
+	}
+	// A second login can't wait on the same socket
+	if _, err := auth.NewCallbackServer(cfg, "s"); err == nil || !strings.Contains(err.Error(), "another sign-in is waiting") {
+		t.Errorf("second login: err = %v", err)
+	}
+
+	socket := urlscheme.SocketPath(dir)
+	if err := urlscheme.Forward(socket, "opencode-auth://elsewhere?code=abc&state=expected-state"); err == nil {
+		t.Error("another redirect URI was accepted")
+	}
+	if err := urlscheme.Forward(socket, "opencode-auth://callback?code=abc&state=expected-state"); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := cs.WaitForCallback(context.Background(), 5*time.Second); err != nil || result.Code != "abc" {
+		t.Fatalf("result = %+v, %v", result, err)
+	}
+	if err := urlscheme.Forward(socket, "opencode-auth://callback?code=abc&state=expected-state"); err == nil || !strings.Contains(err.Error(), "Already Used") {
+		t.Errorf("replayed redirect: %v", err)
+	}
+}
+
+func TestCallbackURLs(t *testing.T) {
+	cfg := &config.Config{}
+	if got := cfg.CallbackURLs(); len(got) != 1 || got[0] != "http://localhost:19876/callback" {
+		t.Errorf("default = %v", got)
+	}
+	cfg = &config.Config{CallbackPort: 8400, RedirectURIs: []string{"http://127.0.0.1:8401/cb"}, CallbackPorts: []int{8400, 8402}}
+	want := []string{"http://localhost:8400/callback", "http://127.0.0.1:8401/cb", "http://localhost:8402/callback"}
+	if got := cfg.CallbackURLs(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("CallbackURLs() = %v, want %v", got, want)
+	}
+}
+
+func TestExchangeCodeForTokens_VerifierSingleUse(t *testing.T) {
+	var verifiers []string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifiers = append(verifiers, r.PostForm.Get("code_verifier"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"a","id_token":"i","expires_in":3600}`))
+	}))
+	defer idp.Close()
+
+	cfg := &config.Config{ClientID: "client", TokenEndpoint: idp.URL}
+	pkce, err := auth.GeneratePKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ExchangeCodeForTokens(context.Background(), cfg, "code", cfg.CallbackURL(), pkce); err != nil {
+		t.Fatal(err)
+	}
+	if len(verifiers) != 1 || len(verifiers[0]) < 43 {
+		t.Fatalf("verifiers sent = %q", verifiers)
+	}
+
+	if _, err := auth.ExchangeCodeForTokens(context.Background(), cfg, "code", cfg.CallbackURL(), pkce); !errors.Is(err, auth.ErrVerifierUsed) {
+		t.Errorf("second exchange: err = %v, want ErrVerifierUsed", err)
+	}
+	if len(verifiers) != 1 {
+		t.Errorf("second exchange reached the token endpoint")
+	}
+}
+
+func TestRecordLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), auth.LoginsFile)
+	start := time.Now().Add(-2 * time.Second)
+
+	auth.RecordLogin(path, auth.NewLoginAttempt("login", start, "user@example.com", nil))
+	auth.RecordLogin(path, auth.NewLoginAttempt("proxy", start, "user@example.com",
+		fmt.Errorf("%w: %w", auth.ErrTokenExchange, errors.New("invalid_grant"))))
+	auth.RecordLogin(path, auth.NewLoginAttempt("login", start, "", fmt.Errorf("cancelled waiting for callback: %w", context.Canceled)))
+
+	attempts, err := auth.LoadLogins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(attempts))
+	}
+	if a := attempts[0]; a.Outcome != auth.LoginSucceeded || a.Email != "user@example.com" || a.DurationMS < 2000 {
+		t.Errorf("success = %+v", a)
+	}
+	if a := attempts[1]; a.Outcome != auth.LoginExchangeFailed || a.Email != "" || !strings.Contains(a.Error, "invalid_grant") {
+		t.Errorf("exchange failure = %+v", a)
+	}
+	if a := attempts[2]; a.Outcome != auth.LoginCancelled {
+		t.Errorf("cancelled = %+v", a)
+	}
+
+	// Only the newest attempts are kept
+	for i := 0; i < 60; i++ {
+		auth.RecordLogin(path, auth.NewLoginAttempt("proxy", start, "", auth.ErrCallbackTimeout))
+	}
+	attempts, _ = auth.LoadLogins(path)
+	if len(attempts) != 50 || attempts[0].Outcome != auth.LoginTimedOut {
+		t.Errorf("after trimming: %d attempts, first %+v", len(attempts), attempts[0])
+	}
+}
+
+func TestAuthURL_LoginHint(t *testing.T) {
+	pkce, err := auth.GeneratePKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{AuthorizeEndpoint: "https://idp.example.com/authorize", ClientID: "client"}
+	u, _ := url.Parse(auth.AuthURL(cfg, cfg.CallbackURL(), pkce, "state"))
+	if u.Query().Has("login_hint") {
+		t.Errorf("login_hint sent without a hint: %s", u)
+	}
+
+	cfg.LoginHint = "user@example.com"
+	u, _ = url.Parse(auth.AuthURL(cfg, cfg.CallbackURL(), pkce, "state"))
+	if got := u.Query().Get("login_hint"); got != "user@example.com" {
+		t.Errorf("login_hint = %q", got)
+	}
+}
+
+func TestVerifyAccount(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cfg     config.Config
+		email   string
+		wantErr bool
+	}{
+		{name: "no expectation", email: ""},
+		{name: "hint matches", cfg: config.Config{LoginHint: "User@Example.com"}, email: "user@example.com"},
+		{name: "hint differs", cfg: config.Config{LoginHint: "user@example.com"}, email: "user@personal.example", wantErr: true},
+		{name: "no email", cfg: config.Config{LoginHint: "user@example.com"}, email: "", wantErr: true},
+		{name: "domain allowed", cfg: config.Config{LoginEmailDomains: []string{"other.example", "@example.com"}}, email: "dev@EXAMPLE.com"},
+		{name: "domain not allowed", cfg: config.Config{LoginEmailDomains: []string{"example.com"}}, email: "dev@example.com.evil", wantErr: true},
+	} {
+		err := auth.VerifyAccount(&tt.cfg, tt.email)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if err != nil && (!errors.Is(err, auth.ErrWrongAccount) || auth.LoginOutcome(err) != auth.LoginWrongAccount) {
+			t.Errorf("%s: err %v is not classified as a wrong account", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Package proxy provides the observer feed: a read-only status report an org
+// telemetry collector can read from each machine to see fleet-wide auth
+// health. It has the token's state, the refresh history, and request error
+// rates, but no token, key, or key prefix. proxy_observer_listen serves it
+// on its own address, apart from the credentialed API; /api/observe shows
+// the same report locally.
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// observerPath is the feed's only route on the observer listener
+	observerPath = "/observe"
+
+	// observerRefreshWindow is how far back the refresh history goes
+	observerRefreshWindow = 24 * time.Hour
+
+	// observerRecentRefreshes is how many refreshes are listed one by one
+	observerRecentRefreshes = 10
+
+	// observerListenAttempts is how often, a second apart, the proxy tries
+	// to bind proxy_observer_listen
+	observerListenAttempts = 30
+)
+
+// ObserverReport is the observer feed. Every field is safe to hand to a
+// collector: nothing in it authenticates anyone.
+type ObserverReport struct {
+	Host          string    `json:"host"`
+	ClientVersion string    `json:"client_version,omitempty"`
+	Time          time.Time `json:"time"`
+	// AuthMode is "jwt", "api_key" or "static"
+	AuthMode string `json:"auth_mode"`
+	Email    string `json:"email,omitempty"`
+
+	TokenValid       bool      `json:"token_valid"`
+	TokenExpiresAt   time.Time `json:"token_expires_at,omitempty"`
+	NeedsReauth      bool      `json:"needs_reauth"`
+	ReauthInProgress bool      `json:"reauth_in_progress"`
+	LastRefresh      time.Time `json:"last_refresh,omitempty"`
+	RetryCount       int       `json:"retry_count"`
+
+	// Refreshes counts the last day's token refreshes by outcome
+	Refreshes map[string]int `json:"refreshes,omitempty"`
+	// RecentRefreshes are the latest of them, oldest first
+	RecentRefreshes []auth.RefreshStat `json:"recent_refreshes,omitempty"`
+
+	// Requests and Errors are today's proxied requests and those that
+	// failed; ErrorRate is their ratio
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+
+	APIKey     *ObserverAPIKey  `json:"api_key,omitempty"`
+	Revocation *RevocationState `json:"revocation,omitempty"`
+	Session    *SessionStatus   `json:"session,omitempty"`
+}
+
+// ObserverAPIKey is the API key's state without its prefix.
+type ObserverAPIKey struct {
+	Valid     bool      `json:"valid"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// observerReport builds the feed.
+func (s *Server) observerReport() ObserverReport {
+	host, _ := os.Hostname()
+	status := s.tokenStatus()
+	report := ObserverReport{
+		Host:             host,
+		ClientVersion:    s.ClientVersion,
+		Time:             time.Now().UTC(),
+		AuthMode:         "jwt",
+		Email:            status.Email,
+		TokenValid:       status.Valid,
+		TokenExpiresAt:   status.ExpiresAt,
+		NeedsReauth:      status.NeedsReauth,
+		ReauthInProgress: status.ReauthInProgress,
+		Revocation:       s.revocation.get(),
+		Session:          s.session.status(),
+	}
+	switch {
+	case s.config.StaticAuth():
+		report.AuthMode = config.AuthModeStatic
+	case s.config.APIKey != "" && !s.apiKey.rejected():
+		report.AuthMode = "api_key"
+	}
+	if s.refresher != nil {
+		report.LastRefresh = s.refresher.GetLastRefresh()
+		report.RetryCount = s.refresher.GetRetryCount()
+	}
+	if state := s.apiKey.get(); state != nil {
+		report.APIKey = &ObserverAPIKey{Valid: state.Valid, Reason: state.Reason, CheckedAt: state.CheckedAt}
+	}
+
+	stats, _ := auth.LoadRefreshStats(auth.AuthStatsPath(s.config.ConfigDir), time.Now().Add(-observerRefreshWindow))
+	if len(stats) > 0 {
+		report.Refreshes = make(map[string]int)
+		for _, st := range stats {
+			report.Refreshes[st.Outcome]++
+		}
+		if len(stats) > observerRecentRefreshes {
+			stats = stats[len(stats)-observerRecentRefreshes:]
+		}
+		report.RecentRefreshes = stats
+	}
+
+	usage := s.usage.snapshot()
+	report.Requests, report.Errors = usage.Requests, usage.Errors
+	if usage.Requests > 0 {
+		report.ErrorRate = float64(usage.Errors) / float64(usage.Requests)
+	}
+	return report
+}
+
+// handleObserve serves the observer feed (GET).
+func (s *Server) handleObserve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	json.NewEncoder(w).Encode(s.observerReport())
+}
+
+// observerHandler serves only the feed, to a collector with the token.
+func (s *Server) observerHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(observerPath, func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="opencode-auth observer"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.handleObserve(w, r)
+	})
+	return mux
+}
+
+// serveObserver serves the feed on proxy_observer_listen until the server
+// stops. A feed reachable from other machines needs proxy_observer_token;
+// without one it is not served. Failure only disables the feed.
+func (s *Server) serveObserver() {
+	addr := s.config.ObserverListen
+	if addr == "" {
+		return
+	}
+	if s.config.ObserverToken == "" && !loopbackAddr(addr) {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: observer feed disabled: proxy_observer_listen %s is not loopback and proxy_observer_token is not set\n", addr)
+		return
+	}
+	// After a handover the old proxy holds the address until it stops
+	listener, err := net.Listen("tcp", addr)
+	for attempt := 1; err != nil && attempt < observerListenAttempts; attempt++ {
+		select {
+		case <-time.After(time.Second):
+		case <-s.stopChan:
+			return
+		}
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: observer feed disabled: %v\n", err)
+		return
+	}
+	server := &http.Server{Handler: s.observerHandler(s.config.ObserverToken), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-s.stopChan
+		server.Close()
+	}()
+	fmt.Fprintf(os.Stderr, "[proxy] Serving the observer feed on %s%s\n", listener.Addr(), observerPath)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: observer feed: %v\n", err)
+	}
+}
+
+// loopbackAddr reports whether a listen address only accepts local
+// connections.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ObserverURL returns the feed URL for an observer address given as
+// host:port or a URL.
+func ObserverURL(target string) string {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return target
+	}
+	return "http://" + target + observerPath
+}
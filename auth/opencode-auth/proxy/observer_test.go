@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestObserverFeed(t *testing.T) {
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{
+		IDToken: "secret-id-token", AccessToken: "secret-access-token", RefreshToken: "secret-refresh-token",
+		Email: "dev@example.com", ExpiresAt: time.Now().Add(time.Hour),
+	})
+	statsPath := auth.AuthStatsPath(tempDir)
+	now := time.Now()
+	for _, outcome := range []string{auth.RefreshSucceeded, auth.RefreshNetwork, auth.RefreshSucceeded} {
+		auth.RecordRefresh(statsPath, auth.RefreshStat{Time: now, Outcome: outcome})
+	}
+	auth.RecordRefresh(statsPath, auth.RefreshStat{Time: now.Add(-48 * time.Hour), Outcome: auth.RefreshRejected})
+
+	s, err := newServerInternal(&config.Config{
+		ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: "http://127.0.0.1:1",
+		APIKey: "oc_secretkey_0123456789",
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiKey.set(&APIKeyState{Prefix: "oc_secretk", Valid: false, Reason: "expired_api_key", CheckedAt: now})
+	s.usage.record("/v1/chat/completions", http.StatusOK)
+	s.usage.record("/v1/chat/completions", http.StatusOK)
+	s.usage.record("/v1/chat/completions", http.StatusOK)
+	s.usage.record("/v1/chat/completions", http.StatusBadGateway)
+
+	feed := httptest.NewServer(s.observerHandler("collector-token"))
+	defer feed.Close()
+	get := func(token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", feed.URL+observerPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, token := range []string{"", "wrong"} {
+		if resp := get(token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want 401", token, resp.StatusCode)
+		}
+	}
+
+	resp := get("collector-token")
+	defer resp.Body.Close()
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "oc_secretk"} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("feed contains %q: %s", secret, raw)
+		}
+	}
+	var report ObserverReport
+	json.Unmarshal(raw, &report)
+	if !report.TokenValid || report.Email != "dev@example.com" || report.AuthMode != "jwt" {
+		t.Errorf("report = %+v", report)
+	}
+	if report.Refreshes[auth.RefreshSucceeded] != 2 || report.Refreshes[auth.RefreshNetwork] != 1 || len(report.Refreshes) != 2 {
+		t.Errorf("Refreshes = %v, want the last day's only", report.Refreshes)
+	}
+	if report.Requests != 4 || report.Errors != 1 || report.ErrorRate != 0.25 {
+		t.Errorf("requests = %d, errors = %d, rate = %v", report.Requests, report.Errors, report.ErrorRate)
+	}
+	if report.APIKey == nil || report.APIKey.Valid || report.APIKey.Reason != "expired_api_key" {
+		t.Errorf("APIKey = %+v", report.APIKey)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:18090": true,
+		"127.0.0.1:18090": true,
+		"[::1]:18090":     true,
+		":18090":          false,
+		"0.0.0.0:18090":   false,
+		"10.0.0.5:18090":  false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
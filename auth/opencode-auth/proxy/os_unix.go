@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // acquireFileLock acquires an exclusive lock on the specified file
@@ -50,3 +52,19 @@ func isProcessRunningOS(process *os.Process) bool {
 func terminateProcess(process *os.Process) error {
 	return process.Signal(syscall.SIGTERM)
 }
+
+// setNonblock puts a descriptor back in non-blocking mode (Unix implementation)
+func setNonblock(fd uintptr) error {
+	return syscall.SetNonblock(int(fd), true)
+}
+
+// redirectStdio makes f this process's stdout and stderr, including for
+// panics and runtime errors (Unix implementation)
+func redirectStdio(f *os.File) error {
+	for _, fd := range []int{1, 2} {
+		if err := unix.Dup2(int(f.Fd()), fd); err != nil {
+			return fmt.Errorf("redirecting output to %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
@@ -96,3 +96,14 @@ func isProcessRunningOS(process *os.Process) bool {
 func terminateProcess(process *os.Process) error {
 	return process.Kill()
 }
+
+// setNonblock is a no-op on Windows, where sockets are never handed over
+func setNonblock(fd uintptr) error {
+	return nil
+}
+
+// redirectStdio is not needed on Windows, where the daemon's log is not
+// rotated while it runs
+func redirectStdio(f *os.File) error {
+	return fmt.Errorf("redirecting output to %s is not supported on Windows", f.Name())
+}
@@ -0,0 +1,128 @@
+// Package proxy provides peer process verification so that only allowlisted
+// local programs can use the proxy's credentials.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// connContextKey stores the accepted net.Conn in the request context.
+type connContextKey struct{}
+
+// peerInfo describes the local process on the other end of a connection.
+type peerInfo struct {
+	PID  int
+	Name string // executable base name, e.g. "opencode"
+}
+
+// peerChecker verifies that connecting processes are on an allowlist.
+// Lookups are cached per connection since keep-alive connections carry
+// many requests.
+type peerChecker struct {
+	allowed map[string]bool
+	cache   sync.Map // remote addr -> *peerInfo (nil if lookup failed)
+}
+
+// newPeerChecker returns a checker for the given executable names, or nil if
+// the allowlist is empty (access control disabled). opencode-auth itself is
+// always allowed since the CLI talks to its own proxy.
+func newPeerChecker(allowed []string) *peerChecker {
+	if len(allowed) == 0 {
+		return nil
+	}
+	if !peerCheckSupported {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: proxy_allowed_processes is set but peer verification is not supported on this platform\n")
+		return nil
+	}
+	pc := &peerChecker{allowed: map[string]bool{"opencode-auth": true}}
+	for _, name := range allowed {
+		pc.allowed[normalizeExeName(name)] = true
+	}
+	if self, err := os.Executable(); err == nil {
+		pc.allowed[normalizeExeName(self)] = true
+	}
+	return pc
+}
+
+// normalizeExeName reduces a path or name to a comparable executable name.
+func normalizeExeName(name string) string {
+	name = strings.ToLower(filepath.Base(name))
+	return strings.TrimSuffix(name, ".exe")
+}
+
+// saveConn is used as http.Server.ConnContext to make the connection
+// available to handlers.
+func saveConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// forget drops the cached peer for a closed connection.
+func (pc *peerChecker) forget(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		pc.cache.Delete(c.RemoteAddr().String())
+	}
+}
+
+// lookup returns the peer process for the request's connection.
+func (pc *peerChecker) lookup(r *http.Request) (*peerInfo, error) {
+	c, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection not available")
+	}
+
+	key := c.RemoteAddr().String()
+	if cached, ok := pc.cache.Load(key); ok {
+		if cached == nil {
+			return nil, fmt.Errorf("peer process could not be identified")
+		}
+		return cached.(*peerInfo), nil
+	}
+
+	local, lok := c.LocalAddr().(*net.TCPAddr)
+	remote, rok := c.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+
+	peer, err := lookupPeerProcess(local, remote)
+	if err != nil {
+		pc.cache.Store(key, (*peerInfo)(nil))
+		return nil, err
+	}
+	pc.cache.Store(key, peer)
+	return peer, nil
+}
+
+// wrap rejects requests from processes that are not on the allowlist.
+func (pc *peerChecker) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer, err := pc.lookup(r)
+		if err == nil && pc.allowed[normalizeExeName(peer.Name)] {
+			next(w, r)
+			return
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = fmt.Sprintf("process %q (PID %d) is not in proxy_allowed_processes", peer.Name, peer.PID)
+		}
+		fmt.Fprintf(os.Stderr, "[proxy] Rejected %s %s: %s\n", r.Method, r.URL.Path, reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "peer_not_allowed",
+			"message": reason + " (set OPENCODE_AUTH_NO_PEER_CHECK=1 to bypass for debugging)",
+		})
+	}
+}
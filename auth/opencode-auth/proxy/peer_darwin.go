@@ -0,0 +1,48 @@
+//go:build darwin
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// lookupPeerProcess finds the process owning the client end of a loopback
+// TCP connection using lsof, skipping our own PID (the server end).
+func lookupPeerProcess(local, remote *net.TCPAddr) (*peerInfo, error) {
+	// +c 0 disables command name truncation; -F pc prints "p<pid>" / "c<cmd>" lines
+	out, err := exec.Command("lsof", "+c", "0", "-nP", "-F", "pc",
+		fmt.Sprintf("-iTCP:%d", remote.Port), "-sTCP:ESTABLISHED").Output()
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("lsof failed: %w", err)
+	}
+
+	self := os.Getpid()
+	pid := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			pid, _ = strconv.Atoi(line[1:])
+		case 'c':
+			if pid != 0 && pid != self {
+				return &peerInfo{PID: pid, Name: strings.TrimSpace(line[1:])}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no process found for port %d", remote.Port)
+}
+
+// peerCheckSupported reports whether peer verification works on this platform.
+const peerCheckSupported = true
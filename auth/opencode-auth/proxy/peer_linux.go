@@ -0,0 +1,108 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lookupPeerProcess finds the process owning the client end of a loopback
+// TCP connection by matching /proc/net/tcp{,6} entries to socket inodes
+// held open in /proc/<pid>/fd.
+func lookupPeerProcess(local, remote *net.TCPAddr) (*peerInfo, error) {
+	inode := ""
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		var err error
+		// The client's socket has the client address as local_address and
+		// the proxy address as rem_address
+		inode, err = findSocketInode(table, remote, local)
+		if err == nil && inode != "" {
+			break
+		}
+	}
+	if inode == "" {
+		return nil, fmt.Errorf("socket for %s not found", remote)
+	}
+
+	target := "socket:[" + inode + "]"
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("reading /proc: %w", err)
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Other users' processes are not readable
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				exe, err := os.Readlink(filepath.Join("/proc", p.Name(), "exe"))
+				if err != nil {
+					return nil, fmt.Errorf("reading executable of PID %d: %w", pid, err)
+				}
+				return &peerInfo{PID: pid, Name: filepath.Base(exe)}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no process owns socket inode %s", inode)
+}
+
+// findSocketInode scans a /proc/net/tcp table for a connection with the given
+// local and remote addresses and returns its inode.
+func findSocketInode(table string, localAddr, remoteAddr *net.TCPAddr) (string, error) {
+	f, err := os.Open(table)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if procAddrEqual(fields[1], localAddr) && procAddrEqual(fields[2], remoteAddr) {
+			return fields[9], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// procAddrEqual compares a /proc/net/tcp "HEXIP:HEXPORT" field to addr.
+// IPs are stored as little-endian 32-bit words.
+func procAddrEqual(field string, addr *net.TCPAddr) bool {
+	ipHex, portHex, ok := strings.Cut(field, ":")
+	if !ok {
+		return false
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil || int(port) != addr.Port {
+		return false
+	}
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || len(raw)%4 != 0 {
+		return false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return net.IP(raw).Equal(addr.IP)
+}
+
+// peerCheckSupported reports whether peer verification works on this platform.
+const peerCheckSupported = true
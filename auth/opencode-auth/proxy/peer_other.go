@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// lookupPeerProcess is not implemented on this platform.
+func lookupPeerProcess(local, remote *net.TCPAddr) (*peerInfo, error) {
+	return nil, fmt.Errorf("peer process verification is not supported on %s", runtime.GOOS)
+}
+
+// peerCheckSupported reports whether peer verification works on this platform.
+const peerCheckSupported = false
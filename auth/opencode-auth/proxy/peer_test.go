@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestNormalizeExeName(t *testing.T) {
+	tests := map[string]string{
+		"opencode":                "opencode",
+		"/usr/local/bin/opencode": "opencode",
+		"OpenCode.exe":            "opencode",
+	}
+	for in, want := range tests {
+		if got := normalizeExeName(in); got != want {
+			t.Errorf("normalizeExeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewPeerChecker_EmptyAllowlistDisables(t *testing.T) {
+	if pc := newPeerChecker(nil); pc != nil {
+		t.Error("newPeerChecker(nil) should return nil (access control disabled)")
+	}
+}
+
+func TestPeerChecker_AllowsAndRejects(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer lookup test relies on /proc")
+	}
+
+	run := func(pc *peerChecker) int {
+		srv := httptest.NewUnstartedServer(pc.wrap(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		srv.Config.ConnContext = saveConn
+		srv.Config.ConnState = pc.forget
+		srv.Start()
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The test binary itself is always allowed (same executable as the proxy)
+	if code := run(newPeerChecker([]string{"opencode"})); code != http.StatusOK {
+		t.Errorf("allowed peer got status %d, want 200", code)
+	}
+
+	// An allowlist that excludes the test binary rejects it
+	strict := &peerChecker{allowed: map[string]bool{"opencode": true}}
+	if code := run(strict); code != http.StatusForbidden {
+		t.Errorf("disallowed peer got status %d, want 403", code)
+	}
+}
@@ -0,0 +1,228 @@
+// Package proxy provides fleet policy for the proxy: a model allowlist, and
+// polling for proxy-scoped config patches, so that route, model, and
+// guardrail changes reach running proxies within minutes instead of at the
+// next 'oc' start.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/configpatch"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/mirror"
+	versionpkg "github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/version"
+)
+
+// PolicyStatus is the "policy" section of /health.
+type PolicyStatus struct {
+	PollInterval  string    `json:"poll_interval"`
+	ConfigVersion int       `json:"config_version,omitempty"`
+	LastPoll      time.Time `json:"last_poll,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// policyPoller tracks config patch polling. The zero value never polls.
+type policyPoller struct {
+	mu       sync.Mutex
+	interval time.Duration
+	version  int
+	lastPoll time.Time
+	lastErr  string
+}
+
+// setInterval changes the poll interval and returns the previous one.
+func (p *policyPoller) setInterval(d time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev := p.interval
+	p.interval = d
+	return prev
+}
+
+// wait returns how long to sleep before the next poll, and whether polling
+// is on. While it is off the caller checks again after configWatchInterval.
+func (p *policyPoller) wait() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interval <= 0 {
+		return configWatchInterval, false
+	}
+	return p.interval, true
+}
+
+func (p *policyPoller) record(now time.Time, version int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPoll = now
+	if version > 0 {
+		p.version = version
+	}
+	p.lastErr = ""
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+}
+
+// status returns the health section, or nil when polling is off.
+func (p *policyPoller) status() *PolicyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interval <= 0 {
+		return nil
+	}
+	return &PolicyStatus{PollInterval: p.interval.String(), ConfigVersion: p.version, LastPoll: p.lastPoll, LastError: p.lastErr}
+}
+
+// watchPolicy polls for config patches while proxy_config_poll_interval is
+// set, until the server stops.
+func (s *Server) watchPolicy() {
+	d, _ := s.policy.wait()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if _, on := s.policy.wait(); on {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				s.pollPolicy(ctx)
+				cancel()
+			}
+			d, _ := s.policy.wait()
+			timer.Reset(d)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// pollPolicy fetches the config patch from the upstream API and applies a
+// new version's proxy-scoped part.
+func (s *Server) pollPolicy(ctx context.Context) {
+	version, err := s.applyPolicyPatch(ctx)
+	s.policy.record(time.Now(), version, err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: config patch poll failed: %v\n", err)
+	}
+}
+
+// applyPolicyPatch applies the proxy entry of a config patch newer than the
+// last one polled: it is written to config.json so it survives a restart,
+// then reloaded into the running proxy. It returns the patch version
+// handled, or 0 if there was none.
+func (s *Server) applyPolicyPatch(ctx context.Context) (int, error) {
+	last := versionpkg.LoadSuppression().LastProxyConfigVersion
+	// Fetched through the proxy itself so the request is authenticated,
+	// unless it is mirrored
+	var patch *configpatch.PatchResponse
+	var err error
+	if s.config.ConfigPatchURL != "" {
+		patch, err = configpatch.FetchConfigPatchFrom(ctx, s.config.ConfigPatchURL, last, mirror.Transport(s.config.ConfigPatchURL))
+	} else {
+		patch, err = configpatch.FetchConfigPatch(ctx, fmt.Sprintf("http://localhost:%d", s.port), last)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if patch == nil || patch.ConfigVersion <= last {
+		return 0, nil
+	}
+	if patch.Rollout != nil {
+		if _, included := patch.Rollout.Includes(versionpkg.MachineID(), runtime.GOOS); !included {
+			// Checked again at the next poll, in case the rollout widens
+			return 0, nil
+		}
+	}
+
+	// A bad patch is recorded as handled, so it isn't retried every poll
+	defer versionpkg.RecordProxyConfigVersion(patch.ConfigVersion)
+
+	spec, ok := patch.Patches[configpatch.ProxyPatch]
+	if !ok {
+		return patch.ConfigVersion, nil
+	}
+	target := configpatch.Target{OS: runtime.GOOS, Arch: runtime.GOARCH, ClientVersion: s.ClientVersion, Profile: s.config.Profile}
+	if match, _ := spec.Conditions.Match(target); !match {
+		return patch.ConfigVersion, nil
+	}
+	if err := spec.CheckProxyScope(); err != nil {
+		return patch.ConfigVersion, err
+	}
+
+	configPath := filepath.Join(s.config.ConfigDir, "config.json")
+	if err := configpatch.ApplyValidated(configPath, spec, config.CheckFile); err != nil {
+		return patch.ConfigVersion, err
+	}
+	oc, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		return patch.ConfigVersion, fmt.Errorf("reloading config: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Applied proxy settings from config v%d\n", patch.ConfigVersion)
+	s.reloadTunables(oc)
+	return patch.ConfigVersion, nil
+}
+
+// setAllowedModels replaces the model allowlist.
+func (s *Server) setAllowedModels(models []string) {
+	s.allowedModels.Store(&models)
+}
+
+func (s *Server) currentAllowedModels() []string {
+	if m := s.allowedModels.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// setAuthHeaders replaces the auth header routes.
+func (s *Server) setAuthHeaders(headers []config.AuthHeader) {
+	s.authHeaders.Store(&headers)
+}
+
+func (s *Server) currentAuthHeaders() []config.AuthHeader {
+	if h := s.authHeaders.Load(); h != nil {
+		return *h
+	}
+	return nil
+}
+
+// modelAllowed reports whether model matches one of the patterns.
+func modelAllowed(patterns []string, model string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, model); ok || p == model {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModelPolicy refuses chat completions for models outside
+// proxy_allowed_models. It reports whether the request was answered.
+func (s *Server) checkModelPolicy(w http.ResponseWriter, r *http.Request) bool {
+	allowed := s.currentAllowedModels()
+	if len(allowed) == 0 || r.Method != http.MethodPost || r.URL.Path != completionsPath || r.Body == nil {
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProxyError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Failed to read request body: %v", err))
+		return true
+	}
+	setBody(r, body)
+
+	if model := sniffModel(body); !modelAllowed(allowed, model) {
+		writeProxyError(w, http.StatusForbidden, "model_not_allowed", fmt.Sprintf(
+			"Model %q is not allowed by your organization's policy. Allowed models: %v", model, allowed))
+		return true
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	versionpkg "github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/version"
+)
+
+func TestModelAllowed(t *testing.T) {
+	patterns := []string{"anthropic.claude-*", "amazon.nova-pro"}
+	for model, want := range map[string]bool{
+		"anthropic.claude-sonnet-4": true,
+		"amazon.nova-pro":           true,
+		"amazon.nova-lite":          false,
+		"":                          false,
+	} {
+		if got := modelAllowed(patterns, model); got != want {
+			t.Errorf("modelAllowed(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestCheckModelPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[]}`)
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		APIEndpoint:   backend.URL,
+		AllowedModels: []string{"anthropic.claude-*"},
+	}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	post := func(model string) (int, string) {
+		t.Helper()
+		resp, err := http.Post(front.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Error struct {
+				Type string `json:"type"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Error.Type
+	}
+
+	if status, _ := post("anthropic.claude-sonnet-4"); status != http.StatusOK {
+		t.Errorf("allowed model: status %d, want 200", status)
+	}
+	if status, errType := post("meta.llama3"); status != http.StatusForbidden || errType != "model_not_allowed" {
+		t.Errorf("disallowed model: status %d, type %q", status, errType)
+	}
+
+	// Replacing the allowlist takes effect on the next request
+	server.setAllowedModels(nil)
+	if status, _ := post("meta.llama3"); status != http.StatusOK {
+		t.Errorf("after clearing allowlist: status %d, want 200", status)
+	}
+}
+
+func TestApplyPolicyPatch(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OPENCODE_SYSTEM_CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+	configDir := filepath.Join(home, ".opencode")
+	os.MkdirAll(configDir, 0700)
+	configPath := filepath.Join(configDir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"client_id":"abc"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := `{"config_version":3,"patches":{
+		"proxy":{"set":{"proxy_allowed_models":["anthropic.claude-*"],"proxy_guardrails":{"max_tokens":2000}}},
+		"opencode.json":{"set":{"model":"other"}}}}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/update/config" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, patch)
+	}))
+	defer backend.Close()
+
+	tokenPath := filepath.Join(configDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: configDir, TokenPath: tokenPath, APIEndpoint: backend.URL}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The patch is fetched through the proxy's own port
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(server.handleRequest)}}
+	front.Start()
+	defer front.Close()
+	server.port = listener.Addr().(*net.TCPAddr).Port
+
+	version, err := server.applyPolicyPatch(context.Background())
+	if err != nil || version != 3 {
+		t.Fatalf("applyPolicyPatch() = %d, %v; want 3, nil", version, err)
+	}
+	if got := server.currentAllowedModels(); len(got) != 1 || got[0] != "anthropic.claude-*" {
+		t.Errorf("allowed models = %v", got)
+	}
+	if got := server.currentGuardrails().MaxTokens; got != 2000 {
+		t.Errorf("guardrails max_tokens = %d, want 2000", got)
+	}
+	data, _ := os.ReadFile(configPath)
+	var saved map[string]interface{}
+	json.Unmarshal(data, &saved)
+	if saved["client_id"] != "abc" || saved["proxy_allowed_models"] == nil || saved["model"] != nil {
+		t.Errorf("config.json = %s", data)
+	}
+	if got := versionpkg.LoadSuppression().LastProxyConfigVersion; got != 3 {
+		t.Errorf("LastProxyConfigVersion = %d, want 3", got)
+	}
+
+	// The same version is not applied twice
+	if version, err := server.applyPolicyPatch(context.Background()); version != 0 || err != nil {
+		t.Errorf("second poll = %d, %v; want 0, nil", version, err)
+	}
+
+	// Keys outside the proxy scope are refused, and the version still recorded
+	patch = `{"config_version":4,"patches":{"proxy":{"set":{"api_key_cmd":"curl attacker"}}}}`
+	if _, err := server.applyPolicyPatch(context.Background()); err == nil {
+		t.Error("expected an error for an out-of-scope key")
+	}
+	if data, _ := os.ReadFile(configPath); strings.Contains(string(data), "api_key_cmd") {
+		t.Errorf("out-of-scope key written: %s", data)
+	}
+	if got := versionpkg.LoadSuppression().LastProxyConfigVersion; got != 4 {
+		t.Errorf("LastProxyConfigVersion = %d, want 4", got)
+	}
+}
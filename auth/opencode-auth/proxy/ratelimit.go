@@ -0,0 +1,212 @@
+// Package proxy provides rate limit and quota tracking: the proxy reads the
+// x-ratelimit-* and x-quota-* headers of upstream responses, reports the
+// latest values in /health so `opencode-auth status` can show them, and logs
+// a warning when one drops below proxy_quota_warn_percent of its limit.
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQuotaWarnPercent is the share of a limit left at which the
+	// proxy warns, unless proxy_quota_warn_percent says otherwise.
+	DefaultQuotaWarnPercent = 10
+
+	// maxRateLimits bounds the limits tracked, in case the upstream sends
+	// many differently named headers.
+	maxRateLimits = 16
+)
+
+// rateLimitFamilies are the header prefixes read, and the name a header
+// without a suffix gets, e.g. x-quota-remaining is "quota".
+var rateLimitFamilies = []struct{ prefix, name string }{
+	{"x-ratelimit-", "rate limit"},
+	{"x-quota-", "quota"},
+}
+
+// RateLimit is the latest state of one limit the upstream reported.
+type RateLimit struct {
+	// Name is the header's suffix, e.g. "tokens" for
+	// x-ratelimit-remaining-tokens, or the family for headers without one
+	Name      string    `json:"name"`
+	Remaining int64     `json:"remaining"`
+	Limit     int64     `json:"limit,omitempty"`
+	Reset     string    `json:"reset,omitempty"` // as sent
+	Path      string    `json:"path"`            // of the last response
+	UpdatedAt time.Time `json:"updated_at"`
+	Low       bool      `json:"low,omitempty"`
+}
+
+// Message describes the limit for logs and `status`.
+func (l *RateLimit) Message() string {
+	msg := fmt.Sprintf("%s: %d left", l.Name, l.Remaining)
+	if l.Limit > 0 {
+		msg = fmt.Sprintf("%s: %d of %d left (%d%%)", l.Name, l.Remaining, l.Limit, l.Remaining*100/l.Limit)
+	}
+	if l.Reset != "" {
+		msg += ", resets " + l.Reset
+	}
+	return msg
+}
+
+// RateLimitsStatus is the "rate_limits" section of /health.
+type RateLimitsStatus struct {
+	WarnPercent int         `json:"warn_below_percent"` // negative never warns
+	Limits      []RateLimit `json:"limits"`
+}
+
+// rateLimits records the limits the upstream has reported.
+type rateLimits struct {
+	mu          sync.Mutex
+	warnPercent int
+	limits      map[string]*RateLimit
+}
+
+// setWarnPercent replaces the warning threshold and returns the previous
+// one; 0 means DefaultQuotaWarnPercent.
+func (r *rateLimits) setWarnPercent(percent int) int {
+	if percent == 0 {
+		percent = DefaultQuotaWarnPercent
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.warnPercent
+	r.warnPercent = percent
+	return prev
+}
+
+// parseRateLimitHeader splits a header name such as
+// x-ratelimit-remaining-tokens into the limit's name and the field
+// (remaining, limit or reset).
+func parseRateLimitHeader(header string) (name, field string, ok bool) {
+	lower := strings.ToLower(header)
+	for _, family := range rateLimitFamilies {
+		rest, found := strings.CutPrefix(lower, family.prefix)
+		if !found {
+			continue
+		}
+		field, suffix, _ := strings.Cut(rest, "-")
+		switch field {
+		case "remaining", "limit", "reset":
+		default:
+			return "", "", false
+		}
+		if suffix == "" {
+			return family.name, field, true
+		}
+		if family.name == "quota" {
+			suffix = "quota " + suffix
+		}
+		return suffix, field, true
+	}
+	return "", "", false
+}
+
+// parseCount reads the count at the start of a header value; the IETF
+// draft's RateLimit fields may follow it with parameters, e.g. "100;w=60".
+func parseCount(v string) (int64, bool) {
+	if i := strings.IndexAny(v, ";,"); i >= 0 {
+		v = v[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// observe records the limits in the headers of a response to urlPath, and
+// returns those that just dropped below the warning threshold.
+func (r *rateLimits) observe(urlPath string, h http.Header, now time.Time) []RateLimit {
+	type update struct {
+		remaining, limit *int64
+		reset            string
+	}
+	var updates map[string]*update
+	for header, values := range h {
+		name, field, ok := parseRateLimitHeader(header)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if updates == nil {
+			updates = make(map[string]*update)
+		}
+		u := updates[name]
+		if u == nil {
+			u = &update{}
+			updates[name] = u
+		}
+		switch field {
+		case "remaining", "limit":
+			n, ok := parseCount(values[0])
+			if !ok {
+				continue
+			}
+			if field == "remaining" {
+				u.remaining = &n
+			} else {
+				u.limit = &n
+			}
+		case "reset":
+			u.reset = strings.TrimSpace(values[0])
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var low []RateLimit
+	for name, u := range updates {
+		// A limit is tracked from its remaining count
+		if u.remaining == nil {
+			continue
+		}
+		l := r.limits[name]
+		if l == nil {
+			if len(r.limits) >= maxRateLimits {
+				continue
+			}
+			if r.limits == nil {
+				r.limits = make(map[string]*RateLimit)
+			}
+			l = &RateLimit{Name: name}
+			r.limits[name] = l
+		}
+		l.Remaining, l.Path, l.UpdatedAt = *u.remaining, urlPath, now
+		if u.limit != nil {
+			l.Limit = *u.limit
+		}
+		if u.reset != "" {
+			l.Reset = u.reset
+		}
+
+		wasLow := l.Low
+		l.Low = r.warnPercent > 0 && l.Limit > 0 && l.Remaining*100 < l.Limit*int64(r.warnPercent)
+		if l.Low && !wasLow {
+			low = append(low, *l)
+		}
+	}
+	sort.Slice(low, func(i, j int) bool { return low[i].Name < low[j].Name })
+	return low
+}
+
+// status returns the /health section, or nil before any limit was reported.
+func (r *rateLimits) status() *RateLimitsStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.limits) == 0 {
+		return nil
+	}
+	st := &RateLimitsStatus{WarnPercent: r.warnPercent}
+	for _, l := range r.limits {
+		st.Limits = append(st.Limits, *l)
+	}
+	sort.Slice(st.Limits, func(i, j int) bool { return st.Limits[i].Name < st.Limits[j].Name })
+	return st
+}
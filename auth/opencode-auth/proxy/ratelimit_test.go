@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestParseRateLimitHeader(t *testing.T) {
+	for header, want := range map[string][2]string{
+		"X-Ratelimit-Remaining":        {"rate limit", "remaining"},
+		"X-Ratelimit-Remaining-Tokens": {"tokens", "remaining"},
+		"X-Ratelimit-Limit-Requests":   {"requests", "limit"},
+		"X-Quota-Reset":                {"quota", "reset"},
+		"X-Quota-Limit-Daily":          {"quota daily", "limit"},
+		"X-Ratelimit-Policy":           {},
+		"Ratelimit-Remaining":          {},
+		"X-Request-Id":                 {},
+	} {
+		name, field, ok := parseRateLimitHeader(header)
+		if ok != (want[0] != "") || name != want[0] || field != want[1] {
+			t.Errorf("parseRateLimitHeader(%q) = %q, %q, %v", header, name, field, ok)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	r := &rateLimits{}
+	r.setWarnPercent(0)
+	h := http.Header{}
+	h.Set("X-Ratelimit-Limit-Tokens", "10000")
+	h.Set("X-Ratelimit-Remaining-Tokens", "5000")
+	h.Set("X-Ratelimit-Reset-Tokens", "6s")
+	h.Set("X-Ratelimit-Limit-Requests", "100;w=60")
+	h.Set("X-Ratelimit-Remaining-Requests", "99")
+
+	if low := r.observe("/v1/models", http.Header{}, now); low != nil || r.status() != nil {
+		t.Fatal("a response without rate limit headers was recorded")
+	}
+	if low := r.observe("/v1/chat/completions", h, now); low != nil {
+		t.Errorf("warned at 50%%: %+v", low)
+	}
+
+	// The limit is kept from the earlier response
+	h.Del("X-Ratelimit-Limit-Tokens")
+	h.Set("X-Ratelimit-Remaining-Tokens", "900")
+	low := r.observe("/v1/chat/completions", h, now)
+	if len(low) != 1 || low[0].Name != "tokens" || low[0].Limit != 10000 {
+		t.Fatalf("observe below 10%% = %+v", low)
+	}
+	if msg := low[0].Message(); msg != "tokens: 900 of 10000 left (9%), resets 6s" {
+		t.Errorf("Message() = %q", msg)
+	}
+	if low := r.observe("/v1/chat/completions", h, now); low != nil {
+		t.Error("warned twice while low")
+	}
+	h.Set("X-Ratelimit-Remaining-Tokens", "9000")
+	r.observe("/v1/chat/completions", h, now)
+	h.Set("X-Ratelimit-Remaining-Tokens", "10")
+	if low := r.observe("/v1/chat/completions", h, now); len(low) != 1 {
+		t.Error("no warning after the limit recovered and dropped again")
+	}
+
+	st := r.status()
+	if st.WarnPercent != DefaultQuotaWarnPercent || len(st.Limits) != 2 || st.Limits[0].Name != "requests" || st.Limits[0].Limit != 100 || !st.Limits[1].Low {
+		t.Errorf("status() = %+v", st)
+	}
+
+	r.setWarnPercent(-1)
+	h.Set("X-Ratelimit-Remaining-Requests", "0")
+	if low := r.observe("/v1/chat/completions", h, now); low != nil {
+		t.Errorf("warned with warnings off: %+v", low)
+	}
+}
+
+func TestRateLimitHealth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Quota-Limit", "1000")
+		w.Header().Set("X-Quota-Remaining", "50")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: upstream.URL}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := s.events.subscribe(0)
+	defer s.events.unsubscribe(events)
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest("GET", "/v1/models", nil))
+	if rec.Header().Get("X-Quota-Remaining") != "50" {
+		t.Error("the quota header was not passed on")
+	}
+	select {
+	case e := <-events:
+		if e.Type != EventRateLimitLow || !strings.Contains(e.Message, "quota: 50 of 1000 left (5%)") {
+			t.Errorf("event = %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no rate_limit_low event")
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		RateLimits *RateLimitsStatus `json:"rate_limits"`
+	}
+	json.NewDecoder(rec.Body).Decode(&health)
+	if health.RateLimits == nil || len(health.RateLimits.Limits) != 1 || health.RateLimits.Limits[0].Path != "/v1/models" {
+		t.Errorf("health rate_limits = %+v", health.RateLimits)
+	}
+}
@@ -0,0 +1,252 @@
+// Package proxy provides the consent gate for re-authentication the proxy
+// starts on its own. Rather than opening a browser from the background, the
+// proxy shows a desktop notification and a pending prompt in /health, and
+// opens the browser once the user runs 'opencode-auth proxy reauth
+// --continue', clicks the notification, or the auto-open timeout passes.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DefaultReauthAutoOpen is how long a re-authentication prompt waits before
+// opening the browser when the config sets no proxy_reauth_auto_open.
+const DefaultReauthAutoOpen = 2 * time.Minute
+
+// How a re-authentication prompt was answered.
+const (
+	consentCLI          = "reauth --continue"
+	consentNotification = "notification"
+	consentEnsure       = "sign-in requested by a client"
+	consentTimeout      = "auto-open timeout"
+)
+
+// ReauthPrompt is the "reauth_prompt" section of /health while a
+// re-authentication waits for consent.
+type ReauthPrompt struct {
+	Since time.Time `json:"since"`
+	// AutoOpenAt is when the browser opens unasked (unset with "never")
+	AutoOpenAt *time.Time `json:"auto_open_at,omitempty"`
+	// QuietUntil is when the do-not-disturb window holding the prompt ends
+	QuietUntil *time.Time `json:"quiet_until,omitempty"`
+}
+
+// reauthPrompt is a pending prompt. consent receives how it was answered;
+// an empty string dismisses it.
+type reauthPrompt struct {
+	ReauthPrompt
+	consent chan string
+}
+
+// reauthNotifier shows the desktop notification for a prompt and calls
+// clicked when the user clicks it. Replaced in tests.
+var reauthNotifier = notifyReauth
+
+// SetReauthAutoOpen changes how long prompts wait before opening the browser
+// (negative never opens it) and returns the previous setting.
+func (r *Refresher) SetReauthAutoOpen(d time.Duration) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.autoOpen
+	r.autoOpen = d
+	return prev
+}
+
+// PendingReauth returns the prompt waiting for consent, or nil.
+func (r *Refresher) PendingReauth() *ReauthPrompt {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.prompt == nil {
+		return nil
+	}
+	p := r.prompt.ReauthPrompt
+	return &p
+}
+
+// ContinueReauth answers the pending prompt so the browser opens. It reports
+// whether a prompt was waiting.
+func (r *Refresher) ContinueReauth(how string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.prompt == nil {
+		return false
+	}
+	select {
+	case r.prompt.consent <- how:
+	default: // already answered
+	}
+	return true
+}
+
+// dismissReauth drops the pending prompt without opening the browser, e.g.
+// after the user signed in with 'opencode-auth login'.
+func (r *Refresher) dismissReauth() {
+	r.ContinueReauth("")
+}
+
+// awaitReauthConsent notifies the user that the session expired and waits
+// until they agree to sign in or the auto-open timeout passes. During a
+// do-not-disturb window the notification and the timeout wait until the
+// window ends. It returns false when the prompt was dismissed or the
+// refresher stopped.
+func (r *Refresher) awaitReauthConsent() bool {
+	r.mu.Lock()
+	autoOpen := r.autoOpen
+	if autoOpen == 0 {
+		autoOpen = DefaultReauthAutoOpen
+	}
+	now := r.clock.Now()
+	p := &reauthPrompt{ReauthPrompt: ReauthPrompt{Since: now}, consent: make(chan string, 1)}
+	r.prompt = p
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.prompt = nil
+		r.mu.Unlock()
+	}()
+
+	message := "Your session has expired. Click to sign in, or run 'opencode-auth proxy reauth --continue'."
+	if autoOpen > 0 {
+		message += fmt.Sprintf(" The browser opens in %v.", autoOpen)
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Waiting for consent to open the browser; run 'opencode-auth proxy reauth --continue' to sign in\n")
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+
+	// quiet fires when a do-not-disturb window ends, timeout when the
+	// browser opens unasked
+	var quiet, timeout <-chan time.Time
+	hold := func(now time.Time) bool {
+		until := r.dnd.quietUntil(now)
+		if until.IsZero() {
+			return false
+		}
+		r.mu.Lock()
+		p.QuietUntil = &until
+		p.AutoOpenAt = nil
+		if autoOpen > 0 {
+			at := until.Add(autoOpen)
+			p.AutoOpenAt = &at
+		}
+		r.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "[proxy] Do not disturb until %s; the sign-in notification waits until then\n", until.Local().Format("15:04"))
+		quiet, timeout = r.clock.After(until.Sub(now)), nil
+		return true
+	}
+	prompt := func(now time.Time) {
+		r.mu.Lock()
+		p.QuietUntil = nil
+		if autoOpen > 0 {
+			at := now.Add(autoOpen)
+			p.AutoOpenAt = &at
+			timeout = r.clock.After(autoOpen)
+		}
+		r.mu.Unlock()
+		if autoOpen > 0 {
+			fmt.Fprintf(os.Stderr, "[proxy] The browser opens in %v otherwise\n", autoOpen)
+		}
+		r.events.publish(Event{Type: EventReauthRequired, Message: message})
+		reauthNotifier(ctx, message, func() { r.ContinueReauth(consentNotification) })
+	}
+	if !hold(now) {
+		prompt(now)
+	} else {
+		r.events.publish(Event{Type: EventReauthRequired, Message: "Your session has expired. Run 'opencode-auth proxy reauth --continue' to sign in; the browser waits for the do-not-disturb window to end."})
+	}
+
+	var how string
+	for how == "" {
+		select {
+		case how = <-p.consent:
+			if how == "" {
+				fmt.Fprintf(os.Stderr, "[proxy] Re-authentication prompt dismissed\n")
+				return false
+			}
+		case <-quiet:
+			quiet = nil
+			if now := r.clock.Now(); !hold(now) {
+				prompt(now)
+			}
+		case <-timeout:
+			// A window that began while the prompt waited holds the browser
+			if !hold(r.clock.Now()) {
+				how = consentTimeout
+			}
+		case <-r.ctx.Done():
+			return false
+		}
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Re-authentication continued (%s)\n", how)
+	return true
+}
+
+// notifyReauth shows a desktop notification until ctx is done. Clicking it
+// calls clicked where the platform supports notification actions: Linux
+// (notify-send 0.7.9+) and macOS with terminal-notifier installed. Elsewhere
+// the notification is informational.
+func notifyReauth(ctx context.Context, message string, clicked func()) {
+	const title = "OpenCode Auth"
+	switch runtime.GOOS {
+	case "darwin":
+		if _, err := exec.LookPath("terminal-notifier"); err == nil {
+			if exe, err := os.Executable(); err == nil {
+				// The click runs the CLI, which answers through /api/reauth/continue
+				exec.Command("terminal-notifier", "-title", title, "-message", message, "-sound", "default",
+					"-execute", shellQuote(exe)+" proxy reauth --continue").Run()
+				return
+			}
+		}
+		exec.Command("osascript", "-e",
+			fmt.Sprintf("display notification %q with title %q sound name \"default\"", message, title)).Run()
+	case "linux":
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return
+		}
+		go func() {
+			out, err := exec.CommandContext(ctx, "notify-send", "--app-name", title,
+				"--action=continue=Sign in", "--wait", title, message).Output()
+			if err == nil {
+				if strings.TrimSpace(string(out)) == "continue" {
+					clicked()
+				}
+				return
+			}
+			if ctx.Err() == nil {
+				// Older notify-send without actions
+				exec.Command("notify-send", "--app-name", title, title, message).Run()
+			}
+		}()
+	}
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// handleReauthContinue answers a pending re-authentication prompt (POST).
+func (s *Server) handleReauthContinue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	if s.refresher == nil || !s.refresher.ContinueReauth(consentCLI) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no re-authentication is waiting to continue"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"continued": true})
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestReauthConsent(t *testing.T) {
+	clicks := make(chan func(), 8)
+	reauthNotifier = func(ctx context.Context, message string, onClick func()) { clicks <- onClick }
+	defer func() { reauthNotifier = notifyReauth }()
+
+	clock := newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	r, _ := NewRefresherWithClock(&config.Config{ReauthAutoOpen: 3 * time.Minute}, clock)
+	server := &Server{refresher: r}
+	post := func() int {
+		rec := httptest.NewRecorder()
+		server.handleReauthContinue(rec, httptest.NewRequest("POST", "/api/reauth/continue", nil))
+		return rec.Code
+	}
+	await := func() <-chan bool {
+		result := make(chan bool, 1)
+		go func() { result <- r.awaitReauthConsent() }()
+		if d := clock.waitAfter(t); d != 3*time.Minute {
+			t.Errorf("auto-open timer = %v, want 3m", d)
+		}
+		return result
+	}
+	answer := func(result <-chan bool) bool {
+		select {
+		case ok := <-result:
+			return ok
+		case <-time.After(time.Second):
+			t.Fatal("prompt was not answered")
+			return false
+		}
+	}
+
+	if r.PendingReauth() != nil || post() != http.StatusConflict {
+		t.Error("a prompt was pending before re-authentication started")
+	}
+
+	// reauth --continue opens the browser
+	result := await()
+	prompt := r.PendingReauth()
+	if prompt == nil || prompt.AutoOpenAt == nil || !prompt.AutoOpenAt.Equal(clock.Now().Add(3*time.Minute)) {
+		t.Errorf("pending prompt = %+v", prompt)
+	}
+	if code := post(); code != http.StatusOK {
+		t.Errorf("continue status = %d", code)
+	}
+	if !answer(result) || r.PendingReauth() != nil {
+		t.Error("reauth --continue did not continue the prompt")
+	}
+
+	// So does clicking the notification
+	for len(clicks) > 0 {
+		<-clicks
+	}
+	result = await()
+	(<-clicks)()
+	if !answer(result) {
+		t.Error("clicking the notification did not continue the prompt")
+	}
+
+	// Signing in elsewhere dismisses it
+	result = await()
+	r.dismissReauth()
+	if answer(result) {
+		t.Error("a dismissed prompt opened the browser")
+	}
+
+	// Without consent the browser opens after the timeout
+	r, _ = NewRefresher(&config.Config{ReauthAutoOpen: 20 * time.Millisecond})
+	if !r.awaitReauthConsent() {
+		t.Error("prompt did not auto-open")
+	}
+
+	// unless it is set to never
+	r, _ = NewRefresher(&config.Config{ReauthAutoOpen: -1})
+	never := make(chan bool, 1)
+	go func() { never <- r.awaitReauthConsent() }()
+	time.Sleep(50 * time.Millisecond)
+	if prompt := r.PendingReauth(); prompt == nil || prompt.AutoOpenAt != nil {
+		t.Errorf("prompt with auto-open never = %+v", prompt)
+	}
+	r.Stop()
+	if answer(never) {
+		t.Error("stopping the refresher opened the browser")
+	}
+}
@@ -3,18 +3,17 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
+	"io/fs"
 	"os"
-	"os/exec"
-	"runtime"
 	"runtime/debug"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/netcheck"
 )
 
 const (
@@ -35,54 +34,97 @@ const (
 
 	// ReauthTimeout is how long to wait for user to complete browser auth
 	ReauthTimeout = 5 * time.Minute
-)
 
-// GetRefreshThreshold returns the refresh threshold, allowing override via environment
-func GetRefreshThreshold() time.Duration {
-	if val := os.Getenv("PROXY_REFRESH_THRESHOLD"); val != "" {
-		if d, err := time.ParseDuration(val); err == nil {
-			return d
-		}
-	}
-	return defaultRefreshThreshold
-}
+	// wakePoll bounds each wait of the refresh loop, so a sleep or clock
+	// change is noticed within this long of it ending
+	wakePoll = 15 * time.Second
 
-// GetCheckInterval returns the check interval, allowing override via environment
-func GetCheckInterval() time.Duration {
-	if val := os.Getenv("PROXY_CHECK_INTERVAL"); val != "" {
-		if d, err := time.ParseDuration(val); err == nil {
-			return d
-		}
-	}
-	return defaultCheckInterval
-}
+	// clockJumpSlack is how far the wall clock may drift from a wait before
+	// the loop treats it as a sleep or clock change
+	clockJumpSlack = 30 * time.Second
+)
 
+// Built-in timing defaults, used when the config sets no value
 var (
-	RefreshThreshold = GetRefreshThreshold()
-	CheckInterval    = GetCheckInterval()
+	RefreshThreshold = defaultRefreshThreshold
+	CheckInterval    = defaultCheckInterval
 )
 
 // Refresher manages background token refresh
 type Refresher struct {
 	config           *config.Config
-	ticker           *time.Ticker
+	clock            Clock
 	stopChan         chan struct{}
+	ctx              context.Context // cancelled by Stop to abort in-flight IdP calls
+	cancel           context.CancelFunc
 	wg               sync.WaitGroup
 	retryCount       int
 	lastRefresh      time.Time
+	threshold        time.Duration      // refresh when this close to expiry
+	interval         time.Duration      // how often run checks expiry
+	intervalChan     chan time.Duration // interval changes for the run loop
 	needsReauth      bool
 	reauthInProgress bool
+	paused           bool              // set while access is revoked or the session locked, see SetPaused
+	autoOpen         time.Duration     // how long a prompt waits before opening the browser
+	prompt           *reauthPrompt     // set while re-authentication waits for consent
+	dnd              doNotDisturb      // windows without browser or notification
+	simulation       *ExpirySimulation // set by SimulateExpiry
+	events           *eventHub         // set by the server; nil drops events
 	mu               sync.RWMutex
 	reauthMu         sync.Mutex
 	refreshMu        sync.Mutex // guards actual token refresh calls
+	held             bool       // set by Hold; guarded by refreshMu
+}
+
+// errRefreshHeld is returned by refresh calls while the tokens are held.
+var errRefreshHeld = errors.New("token refresh is held while the tokens are handed over")
+
+// Hold stops token refreshes, waiting for one in flight to finish, until
+// Release. A proxy handing its tokens to a replacement holds them, so the
+// refresh token it hands over isn't rotated after the copy.
+func (r *Refresher) Hold() {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	r.held = true
+}
+
+// Release lets refreshes run again after Hold, e.g. when a handover failed.
+func (r *Refresher) Release() {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	r.held = false
 }
 
 // NewRefresher creates a new token refresher instance
 func NewRefresher(cfg *config.Config) (*Refresher, error) {
-	return &Refresher{
-		config:   cfg,
-		stopChan: make(chan struct{}),
-	}, nil
+	return NewRefresherWithClock(cfg, realClock{})
+}
+
+// NewRefresherWithClock creates a refresher that reads time and creates
+// timers through clock. Used by tests to drive the refresh loop
+// deterministically.
+func NewRefresherWithClock(cfg *config.Config, clock Clock) (*Refresher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Refresher{
+		config:       cfg,
+		clock:        clock,
+		threshold:    RefreshThreshold,
+		interval:     CheckInterval,
+		intervalChan: make(chan time.Duration, 1),
+		autoOpen:     cfg.ReauthAutoOpen,
+		stopChan:     make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	if cfg.RefreshThreshold > 0 {
+		r.threshold = cfg.RefreshThreshold
+	}
+	if cfg.CheckInterval > 0 {
+		r.interval = cfg.CheckInterval
+	}
+	r.dnd.set(cfg.DoNotDisturb)
+	return r, nil
 }
 
 // Start begins the background token refresh loop
@@ -93,6 +135,7 @@ func (r *Refresher) Start() {
 
 // Stop gracefully stops the background refresh loop
 func (r *Refresher) Stop() {
+	r.cancel()
 	close(r.stopChan)
 	r.wg.Wait()
 }
@@ -111,112 +154,272 @@ func (r *Refresher) run() {
 		}
 	}()
 
-	// Create ticker for periodic checks
-	r.ticker = time.NewTicker(CheckInterval)
-	defer r.ticker.Stop()
-
-	fmt.Fprintf(os.Stderr, "[proxy] Refresher started at %s\n", time.Now().Format(time.RFC3339))
-	fmt.Fprintf(os.Stderr, "[proxy] Check interval: %v, Refresh threshold: %v\n", CheckInterval, RefreshThreshold)
+	threshold, interval := r.Timing()
+	fmt.Fprintf(os.Stderr, "[proxy] Refresher started at %s\n", r.clock.Now().Format(time.RFC3339))
+	fmt.Fprintf(os.Stderr, "[proxy] Check interval: %v, Refresh threshold: %v\n", interval, threshold)
 
 	// Do an immediate check on startup
 	r.checkAndRefresh()
+	next := r.nextCheck(r.wallNow())
 
+	// Timers follow the monotonic clock, which stops while a laptop sleeps,
+	// so a timer set for the next check could fire hours after the token
+	// expired. Wait in steps of at most wakePoll instead, and compare the
+	// wall clock with the deadline after each one.
 	for {
+		start := r.wallNow()
+		wait := next.Sub(start)
+		if wait > wakePoll {
+			wait = wakePoll
+		} else if wait < 0 {
+			wait = 0
+		}
+		timer := r.clock.NewTimer(wait)
 		select {
-		case <-r.ticker.C:
-			fmt.Fprintf(os.Stderr, "[proxy] Ticker fired at %s\n", time.Now().Format(time.RFC3339))
+		case <-timer.C():
+			now := r.wallNow()
+			if drift := now.Sub(start) - wait; drift > clockJumpSlack || drift < -clockJumpSlack {
+				fmt.Fprintf(os.Stderr, "[proxy] Clock jumped %v at %s (sleep or clock change), checking the token now\n",
+					drift.Round(time.Second), now.Format(time.RFC3339))
+			} else if now.Before(next) {
+				continue
+			}
 			r.checkAndRefresh()
+			next = r.nextCheck(r.wallNow())
+		case interval := <-r.intervalChan:
+			timer.Stop()
+			next = r.nextCheck(r.wallNow())
+			fmt.Fprintf(os.Stderr, "[proxy] Check interval changed to %v\n", interval)
 		case <-r.stopChan:
-			fmt.Fprintf(os.Stderr, "[proxy] Refresher stopped at %s\n", time.Now().Format(time.RFC3339))
+			timer.Stop()
+			fmt.Fprintf(os.Stderr, "[proxy] Refresher stopped at %s\n", r.clock.Now().Format(time.RFC3339))
 			return
 		}
 	}
 }
 
-// checkAndRefresh checks if token needs refresh and performs the refresh
+// wallNow returns the time without its monotonic reading, so differences
+// between two readings include time the machine slept and clock changes.
+func (r *Refresher) wallNow() time.Time {
+	return r.clock.Now().Round(0)
+}
+
+// nextCheck returns when the loop checks the token next after a check at
+// now: after the check interval, or earlier when the token reaches the
+// refresh threshold or a do-not-disturb window's lead time starts before
+// that.
+func (r *Refresher) nextCheck(now time.Time) time.Time {
+	threshold, interval := r.Timing()
+	next := now.Add(interval)
+	earlier := func(t time.Time) {
+		if t.After(now) && t.Before(next) {
+			next = t
+		}
+	}
+	if tokens, err := auth.LoadTokens(r.config.TokenPath); err == nil {
+		expiresAt := tokens.ExpiresAt
+		if sim := r.Simulation(); sim != nil && sim.ExpiresAt.Before(expiresAt) {
+			expiresAt = sim.ExpiresAt
+		}
+		// Just past the threshold, as expiringWithin is strict
+		earlier(expiresAt.Add(-threshold + time.Second))
+	}
+	if start := r.dnd.nextStart(now); !start.IsZero() {
+		earlier(start.Add(-dndLead))
+	}
+	return next
+}
+
+// checkAndRefresh runs one refresh cycle from the background loop. Errors
+// are already logged and handled by RefreshOnce.
 func (r *Refresher) checkAndRefresh() {
-	fmt.Fprintf(os.Stderr, "[proxy] checkAndRefresh() called at %s\n", time.Now().Format(time.RFC3339))
+	r.RefreshOnce(r.ctx)
+}
+
+// RefreshOnce performs a single check-and-refresh cycle synchronously: it
+// loads the tokens, refreshes them if they are within the refresh threshold of
+// expiry, and applies the usual retry/re-auth handling on failure. It returns
+// the load or refresh error, if any.
+func (r *Refresher) RefreshOnce(ctx context.Context) error {
+	fmt.Fprintf(os.Stderr, "[proxy] checkAndRefresh() called at %s\n", r.clock.Now().Format(time.RFC3339))
 
 	// Check if we need re-auth and it's not already in progress
 	r.mu.RLock()
 	needsReauth := r.needsReauth
 	reauthInProgress := r.reauthInProgress
+	paused := r.paused
 	r.mu.RUnlock()
 
+	if paused {
+		fmt.Fprintf(os.Stderr, "[proxy] Token refresh paused: access was revoked or the session is locked\n")
+		return nil
+	}
+
 	if needsReauth {
 		// Check if tokens were refreshed externally (e.g., opencode-auth login)
-		if tokens, err := auth.LoadTokens(r.config.TokenPath); err == nil && !tokens.IsExpiringSoon(5*time.Minute) {
+		if tokens, err := auth.LoadTokens(r.config.TokenPath); err == nil && !r.expiringWithin(tokens, 5*time.Minute) {
 			fmt.Fprintf(os.Stderr, "[proxy] Valid token found on disk (expires %s), clearing needsReauth\n",
 				tokens.ExpiresAt.Format(time.RFC3339))
 			r.mu.Lock()
 			r.needsReauth = false
 			r.retryCount = 0
-			r.lastRefresh = time.Now()
+			r.lastRefresh = r.clock.Now()
 			r.mu.Unlock()
-			return
+			r.dismissReauth()
+			expiresAt := tokens.ExpiresAt
+			r.events.publish(Event{Type: EventReauthSucceeded, Email: tokens.Email, ExpiresAt: &expiresAt, Message: "Signed in outside the proxy"})
+			return nil
 		}
 
 		if !reauthInProgress {
 			fmt.Fprintf(os.Stderr, "[proxy] Re-authentication required, initiating...\n")
-			go r.performReauth()
+			go r.performReauth(false)
 		}
-		return
+		return nil
 	}
 
 	// Test mode: Force re-auth flow for testing/troubleshooting
 	if os.Getenv("OPENCODE_FORCE_REAUTH") == "1" {
 		fmt.Fprintf(os.Stderr, "\n[proxy] TEST MODE: OPENCODE_FORCE_REAUTH=1, triggering re-authentication flow\n")
 		fmt.Fprintf(os.Stderr, "[proxy] This simulates a 12-hour token expiry for testing purposes\n\n")
-		r.handleRefreshError(fmt.Errorf("invalid_grant: refresh token expired (forced by OPENCODE_FORCE_REAUTH)"))
-		return
+		err := fmt.Errorf("%w: invalid_grant: refresh token expired (forced by OPENCODE_FORCE_REAUTH)", auth.ErrRefreshTokenInvalid)
+		r.handleRefreshError(err)
+		return err
 	}
 
 	tokens, err := auth.LoadTokens(r.config.TokenPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Failed to load tokens: %v\n", err)
-		return
+		return fmt.Errorf("failed to load tokens: %w", err)
 	}
 
-	timeUntilExpiry := time.Until(tokens.ExpiresAt)
+	timeUntilExpiry := tokens.ExpiresAt.Sub(r.clock.Now())
 	fmt.Fprintf(os.Stderr, "[proxy] Token loaded - Email: %s, Expires: %s (in %v)\n",
 		tokens.Email, tokens.ExpiresAt.Format(time.RFC3339), timeUntilExpiry)
 
 	// Check if token is already expired
-	if tokens.IsExpired() {
+	if r.expiringWithin(tokens, 30*time.Second) {
 		fmt.Fprintf(os.Stderr, "[proxy] WARNING: Token is already EXPIRED (expired %v ago)\n", -timeUntilExpiry)
 	}
 
 	// Check if token is expiring soon
 	needsRefresh := r.needsRefresh(tokens)
+	threshold, _ := r.Timing()
 	fmt.Fprintf(os.Stderr, "[proxy] needsRefresh check: IsExpiringSoon(%v)=%v, lastRefresh=%v\n",
-		RefreshThreshold, tokens.IsExpiringSoon(RefreshThreshold), r.GetLastRefresh())
+		threshold, r.expiringWithin(tokens, threshold), r.GetLastRefresh())
 
 	if !needsRefresh {
 		fmt.Fprintf(os.Stderr, "[proxy] Token does not need refresh yet (expires in %v)\n", timeUntilExpiry)
-		return
+		return nil
 	}
 
 	fmt.Fprintf(os.Stderr, "[proxy] Token needs refresh, attempting refresh...\n")
 
 	// Attempt to refresh
-	if err := r.refreshToken(tokens); err != nil {
+	err = r.simulatedFailure()
+	if err == nil {
+		// A portal answering for the IdP fails with a TLS error; name it
+		err = netcheck.Diagnose(ctx, r.refreshToken(ctx, tokens))
+	}
+	if errors.Is(err, errRefreshHeld) {
+		fmt.Fprintf(os.Stderr, "[proxy] Not refreshing: %v\n", err)
+		return nil
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "[proxy] Token refresh failed: %v\n", err)
+		expiresAt := tokens.ExpiresAt
+		r.events.publish(Event{Type: EventRefreshFailed, Reason: err.Error(), ExpiresAt: &expiresAt})
 		r.handleRefreshError(err)
-	} else {
-		// Success - reset retry count
-		r.mu.Lock()
-		r.retryCount = 0
-		r.lastRefresh = time.Now()
-		r.mu.Unlock()
+		return err
+	}
+
+	// Success - reset retry count
+	r.mu.Lock()
+	r.retryCount = 0
+	r.lastRefresh = r.clock.Now()
+	r.mu.Unlock()
+	r.EndSimulation("token refreshed")
+
+	fmt.Fprintf(os.Stderr, "[proxy] Token refreshed successfully at %s\n", r.clock.Now().Format(time.RFC3339))
+	return nil
+}
+
+// audiencesExpiringWithin reports whether any configured audience token is
+// missing or expires within the given duration.
+func (r *Refresher) audiencesExpiringWithin(tokens *auth.TokenData, within time.Duration) bool {
+	for _, resource := range r.config.Resources() {
+		at, ok := tokens.AudienceTokens[resource]
+		if !ok || r.clock.Now().Add(within).After(at.ExpiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureAudienceToken returns a valid access token for resource, obtaining
+// fresh audience tokens from the IdP if the stored one is missing or expired.
+func (r *Refresher) EnsureAudienceToken(resource string) (string, error) {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
 
-		fmt.Fprintf(os.Stderr, "[proxy] Token refreshed successfully at %s\n", time.Now().Format(time.RFC3339))
+	tokens, err := auth.LoadTokens(r.config.TokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load tokens: %w", err)
+	}
+	if token, ok := tokens.TokenFor(resource); ok {
+		return token, nil
+	}
+	if r.held {
+		return "", errRefreshHeld
+	}
+	if tokens.RefreshToken == "" {
+		return "", fmt.Errorf("no refresh token available")
 	}
+
+	audienceTokens, refreshToken, err := auth.AcquireAudienceTokens(r.ctx, r.config, tokens.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+	tokens.AudienceTokens = audienceTokens
+	tokens.RefreshToken = refreshToken
+	err = auth.UpdateTokens(r.config.TokenPath, func(current *auth.TokenData) error {
+		current.AudienceTokens = audienceTokens
+		current.RefreshToken = refreshToken
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save audience tokens: %w", err)
+	}
+
+	token, ok := tokens.TokenFor(resource)
+	if !ok {
+		return "", fmt.Errorf("no token issued for resource %s", resource)
+	}
+	return token, nil
+}
+
+// expiringWithin is TokenData.IsExpiringSoon evaluated against the
+// refresher's clock and any simulated expiry.
+func (r *Refresher) expiringWithin(tokens *auth.TokenData, within time.Duration) bool {
+	expiresAt := tokens.ExpiresAt
+	if sim := r.Simulation(); sim != nil && sim.ExpiresAt.Before(expiresAt) {
+		expiresAt = sim.ExpiresAt
+	}
+	return r.clock.Now().Add(within).After(expiresAt)
 }
 
 // needsRefresh determines if the token should be refreshed
 func (r *Refresher) needsRefresh(tokens *auth.TokenData) bool {
 	// Check if we're within the refresh threshold of expiry
-	if tokens.IsExpiringSoon(RefreshThreshold) {
+	threshold, _ := r.Timing()
+	if r.expiringWithin(tokens, threshold) || r.audiencesExpiringWithin(tokens, threshold) {
+		return true
+	}
+
+	// Refresh ahead of a do-not-disturb window, so a refresh token that no
+	// longer works prompts for sign-in before the window
+	if r.refreshBeforeQuiet(tokens.ExpiresAt) {
+		fmt.Fprintf(os.Stderr, "[proxy] Refreshing ahead of a do-not-disturb window\n")
 		return true
 	}
 
@@ -225,7 +428,7 @@ func (r *Refresher) needsRefresh(tokens *auth.TokenData) bool {
 	lastRefresh := r.lastRefresh
 	r.mu.RUnlock()
 
-	if !lastRefresh.IsZero() && time.Since(lastRefresh) > 55*time.Minute {
+	if !lastRefresh.IsZero() && r.clock.Now().Sub(lastRefresh) > 55*time.Minute {
 		return true
 	}
 
@@ -234,7 +437,7 @@ func (r *Refresher) needsRefresh(tokens *auth.TokenData) bool {
 
 // refreshToken performs the actual token refresh
 // Uses refreshMu to ensure only one refresh call at a time
-func (r *Refresher) refreshToken(tokens *auth.TokenData) error {
+func (r *Refresher) refreshToken(ctx context.Context, tokens *auth.TokenData) error {
 	if tokens.RefreshToken == "" {
 		return fmt.Errorf("no refresh token available")
 	}
@@ -246,49 +449,99 @@ func (r *Refresher) refreshToken(tokens *auth.TokenData) error {
 	// Serialize refresh calls to prevent concurrent requests
 	r.refreshMu.Lock()
 	defer r.refreshMu.Unlock()
+	if r.held {
+		return errRefreshHeld
+	}
 
 	// Re-check if token was already refreshed while we waited for the lock
 	freshTokens, err := auth.LoadTokens(r.config.TokenPath)
-	if err == nil && !freshTokens.IsExpiringSoon(5*time.Minute) {
+	if err == nil && !r.expiringWithin(freshTokens, 5*time.Minute) && !r.audiencesExpiringWithin(freshTokens, 5*time.Minute) {
 		fmt.Fprintf(os.Stderr, "[proxy] Token was already refreshed by another call, skipping\n")
 		return nil
 	}
+	// The file may hold a newer refresh token than the caller's copy,
+	// e.g. rotated by 'login' or an audience token request
+	if err == nil && freshTokens.RefreshToken != "" {
+		tokens = freshTokens
+	}
 
 	// Perform the refresh
-	tokenResp, err := auth.RefreshTokens(r.config, tokens.RefreshToken)
+	start := time.Now()
+	tokenResp, err := auth.RefreshTokens(ctx, r.config, tokens.RefreshToken)
+	r.recordRefresh(start, tokens, tokenResp, err)
 	if err != nil {
 		return fmt.Errorf("token refresh failed: %w", err)
 	}
 
-	// Extract expiry from new token
-	expiresAt, err := auth.GetExpiryFromIDToken(tokenResp.IDToken)
-	if err != nil {
-		// Fallback to expires_in
-		expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
-	}
-
 	// Create updated token data
 	updatedTokens := &auth.TokenData{
 		IDToken:      tokenResp.IDToken,
 		AccessToken:  tokenResp.AccessToken,
 		RefreshToken: tokens.RefreshToken,
 		Email:        tokens.Email,
-		ExpiresAt:    expiresAt,
+		ExpiresAt:    tokenResp.ExpiresAt(r.clock.Now()),
 	}
 
+	// Keep fields written by a newer version sharing this token file
+	updatedTokens.PreserveUnknown(tokens)
+
 	// Update refresh token if a new one was provided
 	if tokenResp.RefreshToken != "" {
 		updatedTokens.RefreshToken = tokenResp.RefreshToken
 	}
 
-	// Save the updated tokens
-	if err := auth.SaveTokens(r.config.TokenPath, updatedTokens); err != nil {
+	// Refresh per-audience tokens; keep the old ones if this fails so the
+	// proxy can retry on demand
+	updatedTokens.AudienceTokens = tokens.AudienceTokens
+	if len(r.config.Audiences) > 0 {
+		audienceTokens, refreshToken, err := auth.AcquireAudienceTokens(ctx, r.config, updatedTokens.RefreshToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: audience token refresh failed: %v\n", err)
+		} else {
+			updatedTokens.AudienceTokens = audienceTokens
+			updatedTokens.RefreshToken = refreshToken
+		}
+	}
+
+	// Save the updated tokens. Fields of the file that this refresh didn't
+	// produce, such as ones from a newer version, are kept from disk.
+	err = auth.UpdateTokens(r.config.TokenPath, func(current *auth.TokenData) error {
+		updatedTokens.PreserveUnknown(current)
+		*current = *updatedTokens
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		// Logged out while the refresh was in flight; don't resurrect the file
+		return fmt.Errorf("tokens were removed during refresh")
+	}
+	if err != nil {
 		return fmt.Errorf("failed to save refreshed tokens: %w", err)
 	}
+	r.events.publish(Event{Type: EventTokenRefreshed, Email: updatedTokens.Email, ExpiresAt: &updatedTokens.ExpiresAt})
 
 	return nil
 }
 
+// recordRefresh adds a refresh of tokens that started at start to the stats
+// 'opencode-auth report auth' summarizes.
+func (r *Refresher) recordRefresh(start time.Time, tokens *auth.TokenData, resp *auth.TokenResponse, err error) {
+	now := r.clock.Now()
+	threshold, _ := r.Timing()
+	stat := auth.RefreshStat{
+		Time:       now.UTC(),
+		Outcome:    auth.RefreshOutcome(err),
+		LatencyMS:  time.Since(start).Milliseconds(),
+		RemainingS: int64(tokens.ExpiresAt.Sub(now).Seconds()),
+		ThresholdS: int64(threshold.Seconds()),
+	}
+	if err == nil {
+		stat.LifetimeS = int64(resp.ExpiresAt(now).Sub(now).Seconds())
+	}
+	if recErr := auth.RecordRefresh(auth.AuthStatsPath(r.config.ConfigDir), stat); recErr != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: could not record refresh stats: %v\n", recErr)
+	}
+}
+
 // handleRefreshError manages retry logic for failed refreshes
 func (r *Refresher) handleRefreshError(err error) {
 	// Check if this is a permanent failure (e.g., refresh token expired)
@@ -302,7 +555,7 @@ func (r *Refresher) handleRefreshError(err error) {
 		fmt.Fprintf(os.Stderr, "[proxy] Re-authentication will be initiated automatically\n\n")
 
 		// Trigger re-auth immediately
-		go r.performReauth()
+		go r.performReauth(false)
 		return
 	}
 
@@ -311,21 +564,9 @@ func (r *Refresher) handleRefreshError(err error) {
 	retryCount := r.retryCount
 	r.mu.Unlock()
 
-	// Use much longer backoff for rate limits to avoid making things worse
-	var delay time.Duration
+	delay := retryDelay(retryCount, isRateLimitError(err))
 	if isRateLimitError(err) {
-		// Rate limit: start at 2 minutes, cap at 10 minutes
-		delay = 2 * time.Minute * time.Duration(1<<uint(min(retryCount-1, 2)))
-		if delay > 10*time.Minute {
-			delay = 10 * time.Minute
-		}
 		fmt.Fprintf(os.Stderr, "[proxy] Rate limited by identity provider (attempt %d/%d), backing off for %v\n", retryCount, MaxRetries, delay)
-	} else {
-		// Normal transient error: standard backoff
-		delay = InitialRetryDelay * time.Duration(1<<uint(retryCount-1))
-		if delay > MaxRetryDelay {
-			delay = MaxRetryDelay
-		}
 	}
 
 	if retryCount >= MaxRetries {
@@ -342,7 +583,7 @@ func (r *Refresher) handleRefreshError(err error) {
 	// Schedule a retry sooner than the normal check interval
 	go func() {
 		select {
-		case <-time.After(delay):
+		case <-r.clock.After(delay):
 			r.checkAndRefresh()
 		case <-r.stopChan:
 			return
@@ -350,45 +591,46 @@ func (r *Refresher) handleRefreshError(err error) {
 	}()
 }
 
-// isPermanentRefreshError determines if refresh failure is unrecoverable
-func isPermanentRefreshError(err error) bool {
-	if err == nil {
-		return false
-	}
-	errStr := strings.ToLower(err.Error())
-
-	// Refresh token expired or revoked
-	if strings.Contains(errStr, "invalid_grant") {
-		return true
-	}
-
-	// Refresh token not found
-	if strings.Contains(errStr, "invalid refresh token") {
-		return true
+// retryDelay returns the backoff before retry attempt retryCount (1-based).
+// Rate limits use a much longer backoff to avoid making things worse.
+func retryDelay(retryCount int, rateLimited bool) time.Duration {
+	if rateLimited {
+		// Rate limit: start at 2 minutes, cap at 10 minutes
+		delay := 2 * time.Minute * time.Duration(1<<uint(min(retryCount-1, 2)))
+		if delay > 10*time.Minute {
+			delay = 10 * time.Minute
+		}
+		return delay
 	}
 
-	// User no longer exists
-	if strings.Contains(errStr, "user not found") {
-		return true
+	// Normal transient error: standard backoff
+	delay := InitialRetryDelay * time.Duration(1<<uint(min(retryCount-1, 10)))
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
 	}
+	return delay
+}
 
-	return false
+// isPermanentRefreshError determines if refresh failure is unrecoverable
+func isPermanentRefreshError(err error) bool {
+	return errors.Is(err, auth.ErrRefreshTokenInvalid)
 }
 
 // isRateLimitError checks if the error is a rate limit from the identity provider
 func isRateLimitError(err error) bool {
-	if err == nil {
-		return false
-	}
-	errStr := strings.ToLower(err.Error())
-	return strings.Contains(errStr, "rate limit") ||
-		strings.Contains(errStr, "rate exceeded") ||
-		strings.Contains(errStr, "too many requests") ||
-		strings.Contains(errStr, "status 429")
+	return errors.Is(err, auth.ErrRateLimited)
 }
 
-// performReauth initiates full OAuth flow from proxy
-func (r *Refresher) performReauth() {
+// performReauth initiates full OAuth flow from proxy. Unless consented, it
+// first waits for the user to agree to open the browser.
+func (r *Refresher) performReauth(consented bool) {
+	r.mu.RLock()
+	paused := r.paused
+	r.mu.RUnlock()
+	if paused && !consented {
+		return
+	}
+
 	r.reauthMu.Lock()
 	if r.reauthInProgress {
 		r.reauthMu.Unlock()
@@ -405,8 +647,28 @@ func (r *Refresher) performReauth() {
 
 	fmt.Fprintf(os.Stderr, "\n[proxy] === Re-Authentication Required ===\n")
 	fmt.Fprintf(os.Stderr, "[proxy] Your session has expired (12-hour limit)\n")
+	if consented {
+		r.events.publish(Event{Type: EventReauthRequired, Message: "Session expired; complete sign-in in the browser"})
+	} else if !r.awaitReauthConsent() {
+		return
+	}
 	fmt.Fprintf(os.Stderr, "[proxy] Opening browser for authentication...\n\n")
 
+	// Record the outcome for 'opencode-auth status --logins'
+	start := time.Now()
+	var email string
+	var err error
+	defer func() {
+		if recErr := auth.RecordLogin(auth.LoginsPath(r.config.ConfigDir), auth.NewLoginAttempt("proxy", start, email, err)); recErr != nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: could not record login attempt: %v\n", recErr)
+		}
+		if err != nil {
+			r.events.publish(Event{Type: EventReauthFailed, Reason: err.Error()})
+		} else {
+			r.events.publish(Event{Type: EventReauthSucceeded, Email: email})
+		}
+	}()
+
 	// Generate PKCE
 	pkce, err := auth.GeneratePKCE()
 	if err != nil {
@@ -422,7 +684,7 @@ func (r *Refresher) performReauth() {
 	}
 
 	// Start callback server
-	callbackServer, err := auth.NewCallbackServer(r.config)
+	callbackServer, err := auth.NewCallbackServer(r.config, state)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Failed to start callback server: %v\n", err)
 		return
@@ -431,7 +693,7 @@ func (r *Refresher) performReauth() {
 	defer callbackServer.Shutdown(context.Background())
 
 	// Build auth URL
-	authURL := buildAuthURL(r.config, pkce, state)
+	authURL := auth.AuthURL(r.config, callbackServer.RedirectURI(), pkce, state)
 
 	// Open browser
 	if err := auth.OpenBrowser(authURL); err != nil {
@@ -439,76 +701,100 @@ func (r *Refresher) performReauth() {
 		fmt.Fprintf(os.Stderr, "[proxy] Please open this URL manually:\n%s\n\n", authURL)
 	}
 
-	// Send macOS desktop notification so the user notices the re-auth prompt
-	if runtime.GOOS == "darwin" {
-		exec.Command("osascript", "-e",
-			`display notification "Your session has expired. Please complete login in the browser." with title "OpenCode Auth" sound name "default"`).Run()
-	}
-
 	// Wait for callback (5 minute timeout)
 	fmt.Fprintf(os.Stderr, "[proxy] Waiting for authentication (%v timeout)...\n", ReauthTimeout)
-	result, err := callbackServer.WaitForCallback(ReauthTimeout)
+	result, err := callbackServer.WaitForCallback(r.ctx, ReauthTimeout)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Authentication timed out: %v\n", err)
 		return
 	}
 
-	if result.Error != "" {
-		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Authentication failed: %s\n", result.Error)
+	if err = result.Err; err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Authentication failed: %v\n", err)
 		return
 	}
 
 	// Exchange code for tokens
 	fmt.Fprintf(os.Stderr, "[proxy] Exchanging authorization code for tokens...\n")
-	tokenResp, err := auth.ExchangeCodeForTokens(r.config, result.Code, pkce)
+	tokenResp, err := auth.ExchangeCodeForTokens(r.ctx, r.config, result.Code, callbackServer.RedirectURI(), pkce)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Token exchange failed: %v\n", err)
+		err = fmt.Errorf("%w: %w", auth.ErrTokenExchange, err)
+		fmt.Fprintf(os.Stderr, "[proxy] ERROR: %v\n", err)
 		return
 	}
 
-	// Extract expiry and email
-	expiresAt, _ := auth.GetExpiryFromIDToken(tokenResp.IDToken)
-	email, _ := auth.ExtractEmailFromIDToken(tokenResp.IDToken)
-
 	// Save tokens
 	tokens := &auth.TokenData{
 		IDToken:      tokenResp.IDToken,
 		AccessToken:  tokenResp.AccessToken,
 		RefreshToken: tokenResp.RefreshToken,
-		ExpiresAt:    expiresAt,
-		Email:        email,
+		ExpiresAt:    tokenResp.ExpiresAt(r.clock.Now()),
+		Email:        tokenResp.Email(),
+	}
+
+	if err = auth.VerifyAccount(r.config, tokens.Email); err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] ERROR: %v\n", err)
+		return
+	}
+
+	if len(r.config.Audiences) > 0 {
+		audienceTokens, refreshToken, err := auth.AcquireAudienceTokens(r.ctx, r.config, tokens.RefreshToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: failed to obtain audience tokens: %v\n", err)
+		} else {
+			tokens.AudienceTokens = audienceTokens
+			tokens.RefreshToken = refreshToken
+		}
 	}
 
-	if err := auth.SaveTokens(r.config.TokenPath, tokens); err != nil {
+	if err = auth.SaveTokens(r.config.TokenPath, tokens); err != nil {
 		fmt.Fprintf(os.Stderr, "[proxy] ERROR: Failed to save tokens: %v\n", err)
 		return
 	}
+	email = tokens.Email
 
 	// Update state
 	r.mu.Lock()
 	r.needsReauth = false
 	r.retryCount = 0
-	r.lastRefresh = time.Now()
+	r.lastRefresh = r.clock.Now()
 	r.mu.Unlock()
+	r.EndSimulation("re-authenticated")
 
 	fmt.Fprintf(os.Stderr, "\n[proxy] === Re-Authentication Successful ===\n")
-	fmt.Fprintf(os.Stderr, "[proxy] Email: %s\n", email)
-	fmt.Fprintf(os.Stderr, "[proxy] Expires: %s\n", expiresAt.Format(time.RFC822))
+	fmt.Fprintf(os.Stderr, "[proxy] Email: %s\n", tokens.Email)
+	fmt.Fprintf(os.Stderr, "[proxy] Expires: %s\n", tokens.ExpiresAt.Format(time.RFC822))
 	fmt.Fprintf(os.Stderr, "[proxy] You can continue using opencode\n\n")
 }
 
-// buildAuthURL builds the OAuth authorization URL
-func buildAuthURL(cfg *config.Config, pkce *auth.PKCE, state string) string {
-	params := url.Values{
-		"response_type":         {"code"},
-		"client_id":             {cfg.ClientID},
-		"redirect_uri":          {cfg.CallbackURL()},
-		"scope":                 {"openid email profile"},
-		"state":                 {state},
-		"code_challenge":        {pkce.Challenge},
-		"code_challenge_method": {"S256"},
+// Timing returns the current refresh threshold and check interval.
+func (r *Refresher) Timing() (threshold, interval time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.threshold, r.interval
+}
+
+// SetTiming changes the refresh threshold and check interval of a running
+// refresher. Zero values leave the current setting unchanged.
+func (r *Refresher) SetTiming(threshold, interval time.Duration) {
+	r.mu.Lock()
+	if threshold > 0 {
+		r.threshold = threshold
+	}
+	changed := interval > 0 && interval != r.interval
+	if changed {
+		r.interval = interval
+	}
+	r.mu.Unlock()
+
+	if changed {
+		// Replace any pending change so the loop applies the latest one
+		select {
+		case <-r.intervalChan:
+		default:
+		}
+		r.intervalChan <- interval
 	}
-	return cfg.AuthorizeEndpoint + "?" + params.Encode()
 }
 
 // GetLastRefresh returns the timestamp of the last successful refresh
@@ -546,25 +832,41 @@ func (r *Refresher) ForceRefresh() error {
 		return fmt.Errorf("failed to load tokens: %w", err)
 	}
 
-	if err := r.refreshToken(tokens); err != nil {
+	if err := r.refreshToken(r.ctx, tokens); err != nil {
 		return err
 	}
 
 	// Reset retry count on success
 	r.mu.Lock()
 	r.retryCount = 0
-	r.lastRefresh = time.Now()
+	r.lastRefresh = r.clock.Now()
 	r.mu.Unlock()
+	r.EndSimulation("token refreshed")
 
 	return nil
 }
 
-// TriggerReauth triggers re-authentication flow if not already in progress
+// TriggerReauth triggers re-authentication flow if not already in progress.
+// A client asked for it, so the browser opens without a prompt, and a
+// pending prompt is answered.
 func (r *Refresher) TriggerReauth() {
 	r.mu.Lock()
 	r.needsReauth = true
 	r.mu.Unlock()
-	r.performReauth()
+	if r.ContinueReauth(consentEnsure) {
+		return
+	}
+	r.performReauth(true)
+}
+
+// SetPaused pauses token refresh and automatic re-authentication, e.g.
+// while an administrator has revoked the user's access, so the proxy doesn't
+// loop on a sign-in that cannot succeed, or while an idle session is
+// locked. A sign-in a client asks for still runs.
+func (r *Refresher) SetPaused(paused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = paused
 }
 
 // ClearNeedsReauth clears the re-authentication flag when tokens have been refreshed externally
@@ -572,6 +874,6 @@ func (r *Refresher) ClearNeedsReauth() {
 	r.mu.Lock()
 	r.needsReauth = false
 	r.retryCount = 0
-	r.lastRefresh = time.Now()
+	r.lastRefresh = r.clock.Now()
 	r.mu.Unlock()
 }
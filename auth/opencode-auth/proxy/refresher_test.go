@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -217,7 +222,7 @@ func TestRefresherRefreshToken_NoRefreshToken(t *testing.T) {
 
 	refresher, _ := NewRefresher(cfg)
 
-	err := refresher.refreshToken(tokens)
+	err := refresher.refreshToken(context.Background(), tokens)
 	if err == nil {
 		t.Error("refreshToken() expected error when no refresh token, got nil")
 	}
@@ -242,7 +247,7 @@ func TestRefresherRefreshToken_NoClientID(t *testing.T) {
 
 	refresher, _ := NewRefresher(cfg)
 
-	err := refresher.refreshToken(tokens)
+	err := refresher.refreshToken(context.Background(), tokens)
 	if err == nil {
 		t.Error("refreshToken() expected error when no client ID, got nil")
 	}
@@ -320,45 +325,363 @@ func TestRefresherIntegration(t *testing.T) {
 	}
 }
 
-func TestRefresherTickerFiresAtCheckInterval(t *testing.T) {
-	// Verify the refresher's run loop actually fires checkAndRefresh()
-	// at the configured CheckInterval by using a short override.
+// loopThreshold is the refresh threshold of startLoopRefresher, below the
+// 5 minutes under which refreshToken calls the token endpoint.
+const loopThreshold = 3 * time.Minute
+
+// startLoopRefresher starts a refresher on clock with a token expiring at
+// expiresAt, and returns it with the number of calls to its token endpoint.
+func startLoopRefresher(t *testing.T, clock *fakeClock, expiresAt time.Time) (*Refresher, *int32) {
+	t.Helper()
+	calls := new(int32)
+	mockTokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token":     "refreshed-id-token",
+			"access_token": "refreshed-access-token",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(mockTokenEndpoint.Close)
+
 	tempDir := t.TempDir()
 	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{
+		IDToken:      "test-token",
+		RefreshToken: "refresh-token",
+		ExpiresAt:    expiresAt,
+		Email:        "test@example.com",
+	})
+	refresher, _ := NewRefresherWithClock(&config.Config{
+		ConfigDir:        tempDir,
+		TokenPath:        tokenPath,
+		ClientID:         "test-client-id",
+		TokenEndpoint:    mockTokenEndpoint.URL,
+		RefreshThreshold: loopThreshold,
+	}, clock)
+	refresher.Start()
+	t.Cleanup(refresher.Stop)
+	return refresher, calls
+}
 
-	// Save a valid (not-expiring) token so checkAndRefresh() completes quickly
-	tokens := &auth.TokenData{
+func TestRefresherChecksAtDeadline(t *testing.T) {
+	// The token reaches the refresh threshold a minute after startup, before
+	// the check interval ends
+	clock := newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	_, calls := startLoopRefresher(t, clock, clock.Now().Add(loopThreshold+time.Minute))
+
+	for i := 0; i < 4; i++ {
+		if tm := clock.fire(t, wakePoll); tm.d != wakePoll {
+			t.Errorf("wait %d = %v, want %v", i+1, tm.d, wakePoll)
+		}
+	}
+	if atomic.LoadInt32(calls) != 0 {
+		t.Fatal("refreshed before the deadline")
+	}
+	// The last wait ends at the deadline; the check runs before the loop
+	// sets its next timer
+	if tm := clock.fire(t, time.Second); tm.d != time.Second {
+		t.Errorf("last wait = %v, want 1s", tm.d)
+	}
+	clock.waitTimer(t)
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("token endpoint called %d times at the deadline, want 1", got)
+	}
+}
+
+func TestRefresherChecksAfterSleep(t *testing.T) {
+	// The laptop sleeps for 3 hours during one wait; timers don't count the
+	// sleep, so the wait ends as if only wakePoll had passed
+	clock := newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	_, calls := startLoopRefresher(t, clock, clock.Now().Add(2*time.Hour))
+
+	clock.fire(t, 3*time.Hour)
+	clock.waitTimer(t)
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("token endpoint called %d times after waking, want 1", got)
+	}
+}
+
+func TestRefresherChecksAfterClockChange(t *testing.T) {
+	// The clock is set back an hour. Without noticing, the loop would wait an
+	// hour past its deadline; the token on disk now needs a refresh.
+	clock := newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	refresher, calls := startLoopRefresher(t, clock, clock.Now().Add(2*time.Hour))
+
+	tm := clock.waitTimer(t)
+	auth.SaveTokens(refresher.config.TokenPath, &auth.TokenData{
 		IDToken:      "test-token",
 		RefreshToken: "refresh-token",
-		ExpiresAt:    time.Now().Add(2 * time.Hour),
+		ExpiresAt:    clock.Now().Add(-time.Hour + time.Minute),
 		Email:        "test@example.com",
+	})
+	clock.Advance(-time.Hour)
+	select {
+	case tm.ch <- clock.Now():
+	case <-time.After(time.Second):
+		t.Fatal("run loop did not receive the timer")
 	}
-	auth.SaveTokens(tokenPath, tokens)
+	clock.waitTimer(t)
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("token endpoint called %d times after the clock change, want 1", got)
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	now := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	r, _ := NewRefresherWithClock(&config.Config{TokenPath: tokenPath, DoNotDisturb: []config.QuietWindow{{Start: "08:30", End: "09:00"}}}, newFakeClock(now))
+
+	// Without a token, after the check interval
+	if got := r.nextCheck(now); !got.Equal(now.Add(CheckInterval)) {
+		t.Errorf("nextCheck() without token = %v", got)
+	}
+	// At the refresh threshold
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "t", ExpiresAt: now.Add(RefreshThreshold + time.Minute)})
+	if got := r.nextCheck(now); !got.Equal(now.Add(time.Minute + time.Second)) {
+		t.Errorf("nextCheck() near the threshold = %v", got)
+	}
+	// At a do-not-disturb window's lead time
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "t", ExpiresAt: now.Add(3 * time.Hour)})
+	r.SetTiming(0, time.Hour)
+	if got := r.nextCheck(now); !got.Equal(now.Add(30*time.Minute - dndLead)) {
+		t.Errorf("nextCheck() before a window = %v", got)
+	}
+}
+
+func TestRefreshOnce_ThresholdUsesClock(t *testing.T) {
+	var calls int32
+	mockTokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token":     "refreshed-id-token",
+			"access_token": "refreshed-access-token",
+			"expires_in":   3600,
+		})
+	}))
+	defer mockTokenEndpoint.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	clock := newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	auth.SaveTokens(tokenPath, &auth.TokenData{
+		IDToken:      "old-id-token",
+		RefreshToken: "old-refresh-token",
+		ExpiresAt:    clock.Now().Add(time.Hour),
+		Email:        "test@example.com",
+	})
 
 	cfg := &config.Config{
-		ConfigDir: tempDir,
-		TokenPath: tokenPath,
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		ClientID:      "test-client-id",
+		TokenEndpoint: mockTokenEndpoint.URL,
 	}
+	refresher, _ := NewRefresherWithClock(cfg, clock)
 
-	// Override CheckInterval to a very short duration for the test
-	origCheckInterval := CheckInterval
-	CheckInterval = 100 * time.Millisecond
-	defer func() { CheckInterval = origCheckInterval }()
+	// An hour left: outside RefreshThreshold, nothing to do
+	if err := refresher.RefreshOnce(context.Background()); err != nil {
+		t.Fatalf("RefreshOnce() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Fatalf("token endpoint called %d times, want 0", got)
+	}
 
-	refresher, _ := NewRefresher(cfg)
-	refresher.Start()
+	// Three minutes left: refreshes
+	clock.Advance(57 * time.Minute)
+	if err := refresher.RefreshOnce(context.Background()); err != nil {
+		t.Fatalf("RefreshOnce() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("token endpoint called %d times, want 1", got)
+	}
+	if !refresher.GetLastRefresh().Equal(clock.Now()) {
+		t.Errorf("lastRefresh = %v, want %v", refresher.GetLastRefresh(), clock.Now())
+	}
+}
 
-	// Wait enough time for at least 3 ticker fires (100ms * 3 = 300ms + buffer)
-	time.Sleep(450 * time.Millisecond)
-	refresher.Stop()
+func TestRefreshOnce_FailureSchedulesBackoff(t *testing.T) {
+	mockTokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockTokenEndpoint.Close()
 
-	// The token file should have been accessed (loaded) multiple times.
-	// We verify this indirectly by checking the refresher ran without error.
-	// The real assertion is that the run() loop didn't hang — it fired and
-	// completed checkAndRefresh() multiple times within the short window.
-	// If the ticker wasn't wired to CheckInterval, this test would either
-	// take 2+ minutes (original interval) or never fire at all.
-	t.Log("✓ Refresher ticker fired multiple times within 450ms (CheckInterval=100ms)")
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	clock := newFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	auth.SaveTokens(tokenPath, &auth.TokenData{
+		IDToken:      "old-id-token",
+		RefreshToken: "old-refresh-token",
+		ExpiresAt:    clock.Now().Add(2 * time.Minute),
+	})
+
+	cfg := &config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		ClientID:      "test-client-id",
+		TokenEndpoint: mockTokenEndpoint.URL,
+	}
+	refresher, _ := NewRefresherWithClock(cfg, clock)
+	defer refresher.Stop()
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if err := refresher.RefreshOnce(context.Background()); err == nil {
+			t.Fatal("RefreshOnce() expected error from failing token endpoint")
+		}
+		if got := refresher.GetRetryCount(); got != attempt {
+			t.Errorf("retryCount = %d, want %d", got, attempt)
+		}
+		want := retryDelay(attempt, false)
+		if got := clock.waitAfter(t); got != want {
+			t.Errorf("retry %d scheduled after %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		retry       int
+		rateLimited bool
+		want        time.Duration
+	}{
+		{1, false, 30 * time.Second},
+		{2, false, time.Minute},
+		{4, false, 4 * time.Minute},
+		{5, false, MaxRetryDelay},
+		{50, false, MaxRetryDelay},
+		{1, true, 2 * time.Minute},
+		{2, true, 4 * time.Minute},
+		{3, true, 8 * time.Minute},
+		{9, true, 8 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.retry, tt.rateLimited); got != tt.want {
+			t.Errorf("retryDelay(%d, %v) = %v, want %v", tt.retry, tt.rateLimited, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshErrorClassification(t *testing.T) {
+	tests := []struct {
+		status      int
+		body        string
+		permanent   bool
+		rateLimited bool
+	}{
+		{http.StatusBadRequest, `{"error":"invalid_grant","error_description":"refresh token expired"}`, true, false},
+		{http.StatusBadRequest, `{"message":"User not found"}`, true, false},
+		{http.StatusTooManyRequests, `{}`, false, true},
+		{http.StatusBadRequest, `{"__type":"TooManyRequestsException","message":"Rate exceeded"}`, false, true},
+		{http.StatusInternalServerError, `upstream unavailable`, false, false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		_, err := auth.RefreshTokens(context.Background(), &config.Config{TokenEndpoint: srv.URL}, "refresh-token")
+		srv.Close()
+		if err == nil {
+			t.Fatalf("%d %s: no error", tt.status, tt.body)
+		}
+		if got := isPermanentRefreshError(err); got != tt.permanent {
+			t.Errorf("%d %s: permanent = %v, want %v (%v)", tt.status, tt.body, got, tt.permanent, err)
+		}
+		if got := isRateLimitError(err); got != tt.rateLimited {
+			t.Errorf("%d %s: rate limited = %v, want %v (%v)", tt.status, tt.body, got, tt.rateLimited, err)
+		}
+	}
+}
+
+// fakeClock is a manually advanced Clock. Timers never fire on their own;
+// tests send on fakeTimer.ch. After calls are recorded and never fire.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan *fakeTimer
+	afters chan time.Duration
+}
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+func (t *fakeTimer) Stop() bool          { return true }
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{
+		now:    now,
+		timers: make(chan *fakeTimer, 1),
+		afters: make(chan time.Duration, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{d: d, ch: make(chan time.Time)}
+	c.timers <- t
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.afters <- d
+	return make(chan time.Time)
+}
+
+func (c *fakeClock) waitTimer(t *testing.T) *fakeTimer {
+	t.Helper()
+	select {
+	case tm := <-c.timers:
+		return tm
+	case <-time.After(time.Second):
+		t.Fatal("timer was not created")
+		return nil
+	}
+}
+
+// fire advances the clock by d and fires the loop's next timer. The timer
+// channel is unbuffered, so the send completes only when the run loop has
+// received it.
+func (c *fakeClock) fire(t *testing.T, d time.Duration) *fakeTimer {
+	t.Helper()
+	tm := c.waitTimer(t)
+	c.Advance(d)
+	select {
+	case tm.ch <- c.Now():
+	case <-time.After(time.Second):
+		t.Fatal("run loop did not receive the timer")
+	}
+	return tm
+}
+
+func (c *fakeClock) waitAfter(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-c.afters:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no retry was scheduled")
+		return 0
+	}
 }
 
 func TestRefresherForceRefreshWithMockEndpoint(t *testing.T) {
@@ -436,3 +759,77 @@ func TestRefresherForceRefreshWithMockEndpoint(t *testing.T) {
 
 	t.Log("✓ ForceRefresh succeeded end-to-end with mock token endpoint")
 }
+
+func TestRefresherPreservesNewerTokenFields(t *testing.T) {
+	mockTokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token":     "refreshed-id-token",
+			"access_token": "refreshed-access-token",
+			"expires_in":   3600,
+		})
+	}))
+	defer mockTokenEndpoint.Close()
+
+	// A file written by a newer version, with a field this build doesn't know
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	newer := fmt.Sprintf(`{"schema_version": %d, "id_token": "old-id-token", "refresh_token": "old-refresh-token",
+		"expires_at": %q, "email": "test@example.com", "dpop_key": {"kty": "EC", "crv": "P-256"}}`,
+		auth.TokenSchemaVersion+1, time.Now().Add(2*time.Minute).Format(time.RFC3339))
+	if err := os.WriteFile(tokenPath, []byte(newer), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	refresher, _ := NewRefresher(&config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		ClientID:      "test-client-id",
+		TokenEndpoint: mockTokenEndpoint.URL,
+	})
+	if err := refresher.ForceRefresh(); err != nil {
+		t.Fatalf("ForceRefresh() error = %v", err)
+	}
+
+	data, err := os.ReadFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]interface{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["id_token"] != "refreshed-id-token" {
+		t.Errorf("id_token = %v, want the refreshed token", saved["id_token"])
+	}
+	if key, ok := saved["dpop_key"].(map[string]interface{}); !ok || key["kty"] != "EC" {
+		t.Errorf("dpop_key = %v, want it preserved across the refresh", saved["dpop_key"])
+	}
+	if v := saved["schema_version"]; v != float64(auth.TokenSchemaVersion+1) {
+		t.Errorf("schema_version = %v, want the newer version kept", v)
+	}
+}
+
+func TestLoadTokens_LegacySchema(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "tokens.json")
+	legacy := `{"id_token": "id", "refresh_token": "rt", "expires_at": "2030-01-01T00:00:00Z", "email": "a@example.com"}`
+	if err := os.WriteFile(tokenPath, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := auth.LoadTokens(tokenPath)
+	if err != nil {
+		t.Fatalf("LoadTokens() error = %v", err)
+	}
+	if tokens.SchemaVersion != auth.TokenSchemaVersion || tokens.IDToken != "id" || tokens.Email != "a@example.com" {
+		t.Errorf("LoadTokens() = %+v, want the legacy file upgraded", tokens)
+	}
+
+	if err := auth.SaveTokens(tokenPath, tokens); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(tokenPath)
+	if !strings.Contains(string(data), fmt.Sprintf(`"schema_version": %d`, auth.TokenSchemaVersion)) {
+		t.Errorf("saved file lacks schema_version:\n%s", data)
+	}
+}
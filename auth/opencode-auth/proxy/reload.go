@@ -0,0 +1,197 @@
+// Package proxy provides hot reload of tunables from config.json.
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// configWatchInterval is how often the proxy checks config.json for changes
+const configWatchInterval = 30 * time.Second
+
+// watchConfig reloads tunables when any config layer's modification time
+// changes, until the server stops.
+func (s *Server) watchConfig(paths []string) {
+	lastMod := latestModTime(paths)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mod := latestModTime(paths)
+			if !mod.After(lastMod) {
+				continue
+			}
+			lastMod = mod
+
+			oc, err := config.LoadOpenCodeConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: config reload failed: %v\n", err)
+				continue
+			}
+			s.reloadTunables(oc)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// latestModTime returns the newest modification time among paths that exist.
+func latestModTime(paths []string) time.Time {
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// reloadTunables applies tunables from oc to the running proxy. Env vars and
+// flags (exported to the daemon's environment) still take precedence. The
+// refresh timing and upstream timeouts apply immediately; port changes need a
+// restart.
+func (s *Server) reloadTunables(oc *config.OpenCodeConfig) {
+	fresh := config.DefaultConfig()
+	if err := oc.ApplyTunables(fresh); err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: %v\n", err)
+	}
+
+	threshold, interval := fresh.RefreshThreshold, fresh.CheckInterval
+	if threshold == 0 {
+		threshold = RefreshThreshold
+	}
+	if interval == 0 {
+		interval = CheckInterval
+	}
+	if s.refresher != nil {
+		oldThreshold, oldInterval := s.refresher.Timing()
+		if threshold != oldThreshold || interval != oldInterval {
+			s.refresher.SetTiming(threshold, interval)
+			fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: check interval %v, refresh threshold %v\n", interval, threshold)
+		}
+	}
+	if s.modelAliases.set(fresh.ModelAliases) {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: model aliases %v\n", fresh.ModelAliases)
+	}
+
+	s.tokenSock.audit.Store(fresh.TokenAudit || oc.TokenAudit)
+	if s.history != nil {
+		s.history.enabled.Store(fresh.RequestHistory || oc.ProxyHistory)
+	}
+
+	if prev := s.session.setTimeout(fresh.SessionIdleTimeout, time.Now()); prev != fresh.SessionIdleTimeout {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: session idle timeout %v\n", fresh.SessionIdleTimeout)
+	}
+
+	if models := fresh.AllowedModels; !reflect.DeepEqual(models, s.currentAllowedModels()) {
+		s.setAllowedModels(models)
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: allowed models %v\n", models)
+	}
+	if headers := oc.ProxyAuthHeaders; !reflect.DeepEqual(headers, s.currentAuthHeaders()) {
+		validateAuthHeaders(headers)
+		s.setAuthHeaders(headers)
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: %d auth header routes\n", len(headers))
+	}
+	if routes := oc.ProxyClientHeaders; !reflect.DeepEqual(routes, s.clientHeaders.current()) {
+		validateClientHeaders(routes)
+		s.clientHeaders.set(routes)
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: %d client header routes\n", len(routes))
+	}
+	if prev := s.policy.setInterval(fresh.ConfigPollInterval); prev != fresh.ConfigPollInterval {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: config patch poll interval %v\n", fresh.ConfigPollInterval)
+	}
+
+	if prev := s.setGuardrails(fresh.Guardrails); prev != fresh.Guardrails {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: guardrails max_tokens %d, max_context_tokens %d, daily_token_budget %d\n",
+			fresh.Guardrails.MaxTokens, fresh.Guardrails.MaxContextTokens, fresh.Guardrails.DailyTokenBudget)
+	}
+
+	if prev := s.budget.set(fresh.UsageBudget); prev != fresh.UsageBudget {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: usage budget %d tokens\n", fresh.UsageBudget)
+	}
+
+	if limits := watchdogLimits(fresh.Watchdog); s.watchdog.setLimits(limits) != limits {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: watchdog max goroutines %d, max heap %d MB, max open files %d, restart %v\n",
+			limits.MaxGoroutines, limits.MaxHeapMB, limits.MaxOpenFiles, limits.Restart)
+	}
+
+	if prev := s.dedup.setWindow(fresh.DedupWindow); prev != fresh.DedupWindow {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: dedup window %v\n", fresh.DedupWindow)
+	}
+	if s.timeouts.set(fresh.GetHTTPTimeout(), fresh.StreamIdleTimeout, fresh.RouteTimeouts) {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: upstream header timeout %v, stream idle timeout %v, %d route timeouts\n",
+			fresh.GetHTTPTimeout(), fresh.StreamIdleTimeout, len(fresh.RouteTimeouts))
+	}
+	if s.refresher != nil {
+		if autoOpen := fresh.ReauthAutoOpen; s.refresher.SetReauthAutoOpen(autoOpen) != autoOpen {
+			label := autoOpen.String()
+			if autoOpen < 0 {
+				label = "never"
+			} else if autoOpen == 0 {
+				label = DefaultReauthAutoOpen.String()
+			}
+			fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: re-authentication auto-open %s\n", label)
+		}
+		if s.refresher.SetDoNotDisturb(fresh.DoNotDisturb) {
+			fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: %d do-not-disturb windows\n", len(fresh.DoNotDisturb))
+		}
+	}
+
+	mode := fresh.DeviceAssertion
+	if mode == "" {
+		mode = DeviceAssertionRequest
+	}
+	if s.device.setMode(mode) != mode {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: device assertion %s\n", mode)
+	}
+
+	expired := fresh.ExpiredTokens
+	if expired == "" {
+		expired = ExpiredTokensReject
+	}
+	if s.expired.setMode(expired) != expired {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: expired tokens %s\n", expired)
+	}
+
+	if prev := s.workspace.set(fresh.Workspace); prev != fresh.Workspace {
+		label := fresh.Workspace
+		if label == "" {
+			label = "none"
+		}
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: workspace %s\n", label)
+	}
+
+	warnPercent := fresh.QuotaWarnPercent
+	if warnPercent == 0 {
+		warnPercent = DefaultQuotaWarnPercent
+	}
+	if s.rateLimits.setWarnPercent(warnPercent) != warnPercent {
+		label := fmt.Sprintf("below %d%%", warnPercent)
+		if warnPercent < 0 {
+			label = "off"
+		}
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: quota warning %s\n", label)
+	}
+
+	if s.experiments.set(fresh.Experiments) {
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: %d model experiments\n", len(fresh.Experiments))
+	}
+	if s.annotations.set(fresh.Annotations) {
+		validateAnnotations(fresh.Annotations)
+		n := 0
+		if fresh.Annotations != nil {
+			n = len(fresh.Annotations.Headers) + len(fresh.Annotations.Body)
+		}
+		fmt.Fprintf(os.Stderr, "[proxy] Config reloaded: %d request annotations\n", n)
+	}
+
+	if fresh.GetProxyPort() != s.port {
+		fmt.Fprintf(os.Stderr, "[proxy] Port changed in config; run 'opencode-auth proxy restart' to apply\n")
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestReloadTunables_AppliesRefreshTiming(t *testing.T) {
+	t.Setenv("PROXY_REFRESH_THRESHOLD", "")
+	t.Setenv("PROXY_CHECK_INTERVAL", "")
+
+	cfg := &config.Config{ConfigDir: t.TempDir()}
+	refresher, _ := NewRefresher(cfg)
+	server := &Server{config: cfg, port: cfg.GetProxyPort(), refresher: refresher}
+
+	server.reloadTunables(&config.OpenCodeConfig{
+		RefreshThreshold: "40m",
+		CheckInterval:    "5m",
+	})
+
+	threshold, interval := refresher.Timing()
+	if threshold != 40*time.Minute || interval != 5*time.Minute {
+		t.Errorf("Timing() = %v, %v; want 40m, 5m", threshold, interval)
+	}
+	select {
+	case got := <-refresher.intervalChan:
+		if got != 5*time.Minute {
+			t.Errorf("run loop notified of interval %v, want 5m", got)
+		}
+	default:
+		t.Error("run loop was not notified of the interval change")
+	}
+
+	// Removing the settings falls back to the built-in defaults
+	server.reloadTunables(&config.OpenCodeConfig{})
+	if threshold, interval := refresher.Timing(); threshold != RefreshThreshold || interval != CheckInterval {
+		t.Errorf("Timing() = %v, %v; want defaults %v, %v", threshold, interval, RefreshThreshold, CheckInterval)
+	}
+}
+
+func TestReloadTunables_EnvTakesPrecedence(t *testing.T) {
+	t.Setenv("PROXY_CHECK_INTERVAL", "90s")
+
+	cfg := &config.Config{ConfigDir: t.TempDir()}
+	refresher, _ := NewRefresher(cfg)
+	server := &Server{config: cfg, port: cfg.GetProxyPort(), refresher: refresher}
+
+	server.reloadTunables(&config.OpenCodeConfig{CheckInterval: "5m"})
+
+	if _, interval := refresher.Timing(); interval != 90*time.Second {
+		t.Errorf("interval = %v, want 90s from the environment", interval)
+	}
+}
+
+func TestApplyTunables_InvalidDuration(t *testing.T) {
+	cfg := &config.Config{}
+	err := (&config.OpenCodeConfig{CheckInterval: "soon", ProxyPort: 18181}).ApplyTunables(cfg)
+	if err == nil {
+		t.Error("expected error for invalid duration")
+	}
+	if cfg.CheckInterval != 0 || cfg.ProxyPort != 18181 {
+		t.Errorf("got CheckInterval=%v ProxyPort=%d; want invalid value skipped, valid value applied", cfg.CheckInterval, cfg.ProxyPort)
+	}
+}
+
+func TestLoadOpenCodeConfig_ProjectLayer(t *testing.T) {
+	home := t.TempDir()
+	project := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OPENCODE_SYSTEM_CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("OPENCODE_PROJECT_DIR", project)
+
+	writeJSON := func(path, body string) {
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeJSON(config.ConfigPath(), `{
+		"client_id": "abc",
+		"api_endpoint": "https://us.example.com/v1",
+		"alternate_endpoints": ["https://eu.example.com/v1"],
+		"http_timeout": "30s"
+	}`)
+	projectPath := filepath.Join(project, ".opencode", "config.json")
+	writeJSON(projectPath, `{
+		"api_endpoint": "https://eu.example.com/v1",
+		"http_timeout": "2m",
+		"api_key_cmd": "curl attacker"
+	}`)
+
+	oc, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		t.Fatalf("LoadOpenCodeConfig() error = %v", err)
+	}
+	if oc.APIEndpoint != "https://eu.example.com/v1" || oc.HTTPTimeout != "2m" {
+		t.Errorf("project overrides not applied: endpoint %q, timeout %q", oc.APIEndpoint, oc.HTTPTimeout)
+	}
+	if oc.ClientID != "abc" {
+		t.Errorf("ClientID = %q, want user layer value", oc.ClientID)
+	}
+	if oc.APIKeyCmd != "" {
+		t.Errorf("APIKeyCmd = %q, project layer must not set it", oc.APIKeyCmd)
+	}
+
+	// An endpoint the user has not listed is not trusted from a project
+	writeJSON(projectPath, `{"api_endpoint": "https://attacker.example.com/v1"}`)
+	layers, _, err := config.ConfigLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := layers[2].Ignored["api_endpoint"]; reason == "" {
+		t.Error("untrusted project api_endpoint was not ignored")
+	}
+	if oc, _ := config.LoadOpenCodeConfig(); oc.APIEndpoint != "https://us.example.com/v1" {
+		t.Errorf("APIEndpoint = %q, want user value", oc.APIEndpoint)
+	}
+
+	// Saving from the user layer does not copy project settings into it
+	user, err := config.LoadUserConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.HTTPTimeout != "30s" {
+		t.Errorf("LoadUserConfig().HTTPTimeout = %q, want 30s", user.HTTPTimeout)
+	}
+}
@@ -0,0 +1,296 @@
+// Package proxy provides upstream retries bounded by a shared retry budget.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracing"
+)
+
+const (
+	// retryBudgetRatio is the share of upstream requests in the window that
+	// may be retries. Beyond it failures are returned to the client as-is,
+	// so an upstream brownout is not amplified by the proxy.
+	retryBudgetRatio = 0.2
+
+	// retryBudgetMin is the number of retries always allowed per window, so
+	// a lightly used proxy can still ride out a single blip.
+	retryBudgetMin = 3
+
+	// retryBudgetWindow is the sliding window the budget is measured over,
+	// split into retryBudgetBuckets buckets.
+	retryBudgetWindow  = time.Minute
+	retryBudgetBuckets = 6
+
+	// maxRetryBody is the largest request body buffered for replay. Larger
+	// requests are sent once.
+	maxRetryBody = 8 << 20
+
+	// retryBackoff is the pause before retrying a 502/503 or connection error
+	retryBackoff = 250 * time.Millisecond
+)
+
+// RetryBudgetStats reports retry budget usage in /health.
+type RetryBudgetStats struct {
+	WindowRequests int   `json:"window_requests"`
+	WindowRetries  int   `json:"window_retries"`
+	RetriesTotal   int64 `json:"retries_total"`
+	ExhaustedTotal int64 `json:"exhausted_total"`
+}
+
+// retryBudget counts upstream requests and retries over a sliding window
+// and decides whether another retry is allowed. One budget is shared by
+// every retry path in the proxy.
+type retryBudget struct {
+	mu             sync.Mutex
+	now            func() time.Time
+	buckets        [retryBudgetBuckets]budgetBucket
+	retriesTotal   int64
+	exhaustedTotal int64
+	exhaustedAt    time.Time // start of the window in which exhaustion was last logged
+}
+
+// budgetBucket holds the counts for one slice of the window.
+type budgetBucket struct {
+	start             time.Time
+	requests, retries int
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{now: time.Now}
+}
+
+// bucket returns the bucket for the current time, resetting it if it last
+// held an older interval. Callers hold mu.
+func (b *retryBudget) bucket() *budgetBucket {
+	width := retryBudgetWindow / retryBudgetBuckets
+	start := b.now().Truncate(width)
+	i := int(start.UnixNano()/int64(width)) % retryBudgetBuckets
+	bk := &b.buckets[i]
+	if !bk.start.Equal(start) {
+		bk.start, bk.requests, bk.retries = start, 0, 0
+	}
+	return bk
+}
+
+// totals sums the buckets inside the window. Callers hold mu.
+func (b *retryBudget) totals() (requests, retries int) {
+	cutoff := b.now().Add(-retryBudgetWindow)
+	for _, bk := range b.buckets {
+		if bk.start.After(cutoff) {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	return requests, retries
+}
+
+// request counts one original (non-retry) upstream request.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket().requests++
+}
+
+// allow reports whether a retry fits in the budget, and counts it if so.
+func (b *retryBudget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := b.totals()
+	limit := int(float64(requests) * retryBudgetRatio)
+	if limit < retryBudgetMin {
+		limit = retryBudgetMin
+	}
+	if retries >= limit {
+		b.exhaustedTotal++
+		if now := b.now(); now.Sub(b.exhaustedAt) >= retryBudgetWindow {
+			b.exhaustedAt = now
+			fmt.Fprintf(os.Stderr, "[proxy] Retry budget exhausted (%d retries for %d requests in the last %v); returning upstream errors without retrying\n",
+				retries, requests, retryBudgetWindow)
+		}
+		return false
+	}
+	b.bucket().retries++
+	b.retriesTotal++
+	return true
+}
+
+// stats returns the current budget usage.
+func (b *retryBudget) stats() RetryBudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := b.totals()
+	return RetryBudgetStats{
+		WindowRequests: requests,
+		WindowRetries:  retries,
+		RetriesTotal:   b.retriesTotal,
+		ExhaustedTotal: b.exhaustedTotal,
+	}
+}
+
+// retryTransport retries an upstream request once when the failure is likely
+// transient: a 401 for a bearer token that has since been refreshed, a 502 or
+// 503, or a connection error other than a timeout. Every retry draws on the
+// server's retry budget.
+type retryTransport struct {
+	next   http.RoundTripper
+	server *Server
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, span := t.server.tracer.Start(req.Context(), "upstream "+req.Method, tracing.KindClient)
+	span.SetAttr("server.address", req.URL.Host)
+	span.Inject(req.Header)
+
+	resp, err := t.roundTrip(req, span)
+	if err != nil {
+		span.SetError(err.Error())
+	} else {
+		span.SetAttr("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			span.SetError(resp.Status)
+		}
+	}
+	span.End()
+	return resp, err
+}
+
+func (t *retryTransport) roundTrip(req *http.Request, span *tracing.Span) (*http.Response, error) {
+	budget := t.server.retries
+	budget.request()
+
+	replay, ok := bufferBody(req)
+	resp, err := t.next.RoundTrip(req)
+	if !ok {
+		return resp, err
+	}
+
+	var retry *http.Request
+	var challenge *stepUpChallenge
+	switch {
+	case err != nil:
+		if !retryableError(req.Context(), err) || !budget.allow() {
+			return resp, err
+		}
+	case resp.StatusCode == http.StatusUnauthorized:
+		if ch, ok := parseStepUp(resp); ok {
+			// Not an upstream failure, so outside the retry budget
+			if retry = t.server.elevated(req, ch); retry == nil {
+				return resp, err
+			}
+			challenge = &ch
+		} else if retry = t.reauthorized(req); retry == nil {
+			return resp, err
+		}
+	case resp.StatusCode == http.StatusBadGateway, resp.StatusCode == http.StatusServiceUnavailable:
+		if !budget.allow() {
+			return resp, err
+		}
+	default:
+		return resp, err
+	}
+
+	if resp != nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+	if retry == nil {
+		select {
+		case <-time.After(retryBackoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		retry = req.Clone(req.Context())
+	}
+	retry.Body = replay()
+	span.SetAttr("proxy.retried", true)
+	if t.server.config.Debug {
+		fmt.Fprintf(os.Stderr, "[proxy] Retrying %s %s\n", req.Method, req.URL.Path)
+	}
+	resp, err = t.next.RoundTrip(retry)
+	if challenge != nil && err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if _, ok := parseStepUp(resp); ok {
+			// The IdP did not deliver what the router wants; sign in afresh next time
+			t.server.stepUp.drop(challenge.acrValues)
+		}
+	}
+	return resp, err
+}
+
+// reauthorized returns a copy of req with fresh credentials after a 401, or
+// nil if the credentials would not change or the retry budget is spent. A
+// bearer token that was rotated while the request was in flight is picked up
+// from disk; otherwise the refresher is asked for a new one. API key
+// rejections are handled by the key validator instead.
+func (t *retryTransport) reauthorized(req *http.Request) *http.Request {
+	sent := req.Header.Get("Authorization")
+	if sent == "" || req.Header.Get("X-API-Key") != "" {
+		return nil
+	}
+	retry := req.Clone(req.Context())
+	t.server.addAuthHeader(retry)
+	rotated := retry.Header.Get("Authorization") != sent
+	if !rotated && t.server.refresher == nil {
+		return nil
+	}
+	if !t.server.retries.allow() {
+		return nil
+	}
+	if !rotated {
+		if err := t.server.refresher.ForceRefresh(); err != nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Refresh after 401 failed: %v\n", err)
+			return nil
+		}
+		t.server.addAuthHeader(retry)
+		if retry.Header.Get("Authorization") == sent {
+			return nil
+		}
+	}
+	return retry
+}
+
+// retryableError reports whether a transport error may be retried. Timeouts
+// are not: the client has already waited the full timeout once.
+func retryableError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+// bufferBody reads req's body into memory so it can be sent again, and
+// returns a function producing a fresh copy. It returns false, leaving the
+// body readable, if the body is too large to buffer.
+func bufferBody(req *http.Request) (func() io.ReadCloser, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() io.ReadCloser { return http.NoBody }, true
+	}
+	if req.ContentLength > maxRetryBody {
+		return nil, false
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+	if err != nil || len(data) > maxRetryBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return func() io.ReadCloser { return io.NopCloser(bytes.NewReader(data)) }, true
+}
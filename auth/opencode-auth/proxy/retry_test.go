@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := newRetryBudget()
+	b.now = func() time.Time { return now }
+
+	// With little traffic the minimum allowance applies
+	for i := 0; i < retryBudgetMin; i++ {
+		if !b.allow() {
+			t.Fatalf("retry %d denied, want %d retries allowed at low volume", i+1, retryBudgetMin)
+		}
+	}
+	if b.allow() {
+		t.Error("retry allowed beyond the minimum with no traffic")
+	}
+
+	// 50 requests allow 20% = 10 retries in the window
+	for i := 0; i < 50; i++ {
+		b.request()
+	}
+	allowed := 0
+	for b.allow() {
+		allowed++
+	}
+	if want := 10 - retryBudgetMin; allowed != want {
+		t.Errorf("allowed %d more retries, want %d", allowed, want)
+	}
+
+	stats := b.stats()
+	if stats.WindowRequests != 50 || stats.WindowRetries != 10 || stats.RetriesTotal != 10 || stats.ExhaustedTotal != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// The window slides: after a minute the old counts no longer apply
+	now = now.Add(retryBudgetWindow)
+	if stats := b.stats(); stats.WindowRequests != 0 || stats.WindowRetries != 0 {
+		t.Errorf("stats after window = %+v, want empty window", stats)
+	}
+	if !b.allow() {
+		t.Error("retry denied in a fresh window")
+	}
+}
+
+func retryTestServer(t *testing.T, backendURL string) (*Server, string) {
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "old-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	server, err := newServerInternal(&config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: backendURL,
+	}, 0, false)
+	if err != nil {
+		t.Fatalf("newServerInternal() error = %v", err)
+	}
+	return server, tokenPath
+}
+
+func proxyPost(server *Server, body string) *http.Response {
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	server.proxy.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestRetryTransport_RetriesUnavailable(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"model":"m"}` {
+			t.Errorf("attempt %d body = %q, want original body replayed", atomic.LoadInt32(&calls)+1, body)
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	server, _ := retryTestServer(t, backend.URL)
+	resp := proxyPost(server, `{"model":"m"}`)
+	if resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("status = %d after %d calls, want 200 after 2", resp.StatusCode, calls)
+	}
+	if stats := server.retries.stats(); stats.RetriesTotal != 1 {
+		t.Errorf("RetriesTotal = %d, want 1", stats.RetriesTotal)
+	}
+}
+
+func TestRetryTransport_BudgetExhausted(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	server, _ := retryTestServer(t, backend.URL)
+	const requests = 10
+	for i := 0; i < requests; i++ {
+		if resp := proxyPost(server, "{}"); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status = %d, want upstream 502", resp.StatusCode)
+		}
+	}
+
+	// Only the minimum allowance of retries is spent during a brownout
+	if want := int32(requests + retryBudgetMin); calls != want {
+		t.Errorf("upstream calls = %d, want %d", calls, want)
+	}
+	if stats := server.retries.stats(); stats.ExhaustedTotal != requests-retryBudgetMin {
+		t.Errorf("ExhaustedTotal = %d, want %d", stats.ExhaustedTotal, requests-retryBudgetMin)
+	}
+}
+
+func TestRetryTransport_UnauthorizedAfterRotation(t *testing.T) {
+	var tokenPath string
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer old-token" {
+			// The refresher rotates the token while the request is in flight
+			auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "new-token", ExpiresAt: time.Now().Add(time.Hour)})
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	server, path := retryTestServer(t, backend.URL)
+	tokenPath = path
+
+	resp := proxyPost(server, "{}")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 after retry with rotated token", resp.StatusCode)
+	}
+	if len(seen) != 2 || seen[1] != "Bearer new-token" {
+		t.Errorf("Authorization headers = %v, want retry with new token", seen)
+	}
+
+	// A 401 for a token that has not changed is returned without retrying
+	seen = nil
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "old-token", ExpiresAt: time.Now().Add(time.Hour)})
+	backend.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if resp := proxyPost(server, "{}"); resp.StatusCode != http.StatusUnauthorized || len(seen) != 1 {
+		t.Errorf("status = %d after %d calls, want 401 after 1", resp.StatusCode, len(seen))
+	}
+}
@@ -0,0 +1,154 @@
+// Package proxy provides handling of remote revocation: when the router
+// refuses a request with access_revoked because an administrator disabled
+// the user, the proxy stops refreshing the token and says who to contact,
+// in the error opencode shows, in /health, and in a desktop notification,
+// instead of leaving the user with 403s that look like bugs. It resumes once
+// a request gets through again.
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessRevokedCode is the router's error code for a disabled user.
+const accessRevokedCode = "access_revoked"
+
+// RevocationState is the "revocation" section of /health while the user's
+// access is revoked.
+type RevocationState struct {
+	Since   time.Time `json:"since"`
+	Contact string    `json:"contact,omitempty"`
+	Message string    `json:"message"`
+}
+
+// revocation holds the state while access is revoked.
+type revocation struct {
+	mu    sync.Mutex
+	state *RevocationState
+}
+
+// revocationNotifier shows the desktop notification. Replaced in tests.
+var revocationNotifier = notifyDesktop
+
+// revokedMessage is what the user is told, with contact if the router sent
+// one.
+func revokedMessage(contact string) string {
+	if contact == "" {
+		contact = "your administrator"
+	}
+	return "Your access was revoked by an administrator. Contact " + contact + " to restore it, then run 'opencode-auth login'."
+}
+
+func (r *revocation) get() *RevocationState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == nil {
+		return nil
+	}
+	st := *r.state
+	return &st
+}
+
+// set records a revocation and reports whether it is new.
+func (r *revocation) set(contact string) (RevocationState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	first := r.state == nil
+	if first {
+		r.state = &RevocationState{Since: time.Now()}
+	}
+	r.state.Contact = contact
+	r.state.Message = revokedMessage(contact)
+	return *r.state, first
+}
+
+// clear drops the revocation and reports whether there was one.
+func (r *revocation) clear() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	revoked := r.state != nil
+	r.state = nil
+	return revoked
+}
+
+// revocationChecked reports whether the router checks the user on
+// urlPath, so that a success there means access was restored.
+func revocationChecked(urlPath string) bool {
+	return urlPath != "/health" && urlPath != "/ready" &&
+		!strings.HasPrefix(urlPath, "/health/") && !strings.HasPrefix(urlPath, "/v1/update/")
+}
+
+// checkRevocation looks for the router's access_revoked error in resp. On
+// the first one it pauses the refresher, logs, and notifies the user; every
+// one gets the contact in its message. A later success resumes refresh.
+func (s *Server) checkRevocation(resp *http.Response) {
+	if resp.StatusCode < 300 && revocationChecked(resp.Request.URL.Path) {
+		if s.revocation.clear() {
+			fmt.Fprintf(os.Stderr, "[proxy] Access restored; resuming token refresh\n")
+			if s.refresher != nil {
+				s.refresher.SetPaused(false)
+			}
+		}
+		return
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	var errResp map[string]map[string]interface{}
+	if json.Unmarshal(body, &errResp) != nil || errResp["error"]["code"] != accessRevokedCode {
+		return
+	}
+	contact, _ := errResp["error"]["contact"].(string)
+	state, first := s.revocation.set(contact)
+
+	errResp["error"]["message"] = state.Message
+	if rewritten, err := json.Marshal(errResp); err == nil {
+		resp.Body = io.NopCloser(bytes.NewReader(rewritten))
+		resp.ContentLength = int64(len(rewritten))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	}
+
+	if !first {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\n[proxy] ACCESS REVOKED: %s\n", state.Message)
+	fmt.Fprintf(os.Stderr, "[proxy] Token refresh is paused until a request succeeds again\n\n")
+	if s.refresher != nil {
+		s.refresher.SetPaused(true)
+	}
+	s.events.publish(Event{Type: EventAccessRevoked, Reason: accessRevokedCode, Message: state.Message})
+	revocationNotifier(state.Message)
+}
+
+// notifyDesktop shows an informational desktop notification on macOS and
+// Linux (with notify-send).
+func notifyDesktop(message string) {
+	const title = "OpenCode Auth"
+	switch runtime.GOOS {
+	case "darwin":
+		go exec.Command("osascript", "-e",
+			fmt.Sprintf("display notification %q with title %q sound name \"default\"", message, title)).Run()
+	case "linux":
+		if _, err := exec.LookPath("notify-send"); err == nil {
+			go exec.Command("notify-send", "--app-name", title, title, message).Run()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestRevocation(t *testing.T) {
+	var notified []string
+	revocationNotifier = func(message string) { notified = append(notified, message) }
+	defer func() { revocationNotifier = notifyDesktop }()
+
+	revoked := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if revoked {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"message":"Your access was revoked by an administrator","type":"auth_error","code":"access_revoked","contact":"it-help@example.com"}}`))
+			return
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL}
+	s, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.refresher, _ = NewRefresher(cfg)
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, httptest.NewRequest("GET", "/v1/models", nil))
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		rec := get()
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusForbidden {
+			t.Fatalf("revoked response = %d, %v", rec.Code, err)
+		}
+		if body.Error.Code != accessRevokedCode || !strings.Contains(body.Error.Message, "it-help@example.com") {
+			t.Errorf("error = %+v, want the contact in the message", body.Error)
+		}
+	}
+	if len(notified) != 1 {
+		t.Errorf("notified %d times, want once", len(notified))
+	}
+	if st := s.revocation.get(); st == nil || st.Contact != "it-help@example.com" {
+		t.Errorf("revocation state = %+v", st)
+	}
+	if !s.refresher.paused {
+		t.Error("refresher not paused while access is revoked")
+	}
+
+	revoked = false
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Fatalf("restored response = %d", rec.Code)
+	}
+	if s.revocation.get() != nil || s.refresher.paused {
+		t.Error("a successful request did not clear the revocation")
+	}
+}
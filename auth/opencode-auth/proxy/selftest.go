@@ -0,0 +1,203 @@
+// Package proxy provides a self-test of the refresher's path to the identity
+// provider.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/netcheck"
+)
+
+const (
+	// selfTestCacheTTL limits how often the self-test contacts the identity
+	// provider, however often it is requested
+	selfTestCacheTTL = 30 * time.Second
+
+	// selfTestTimeout bounds each step
+	selfTestTimeout = 10 * time.Second
+
+	// selfTestRefreshToken is sent in place of a real refresh token. The
+	// identity provider rejects it with invalid_grant, which proves it is
+	// reachable and accepts the client without touching the real session.
+	selfTestRefreshToken = "opencode-auth-selftest"
+)
+
+// SelfTestStep is the outcome of one self-test check.
+type SelfTestStep struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail"`
+	Latency string `json:"latency,omitempty"`
+}
+
+// SelfTestResult is the response for /api/refresher/selftest.
+type SelfTestResult struct {
+	OK        bool           `json:"ok"`
+	CheckedAt time.Time      `json:"checked_at"`
+	Steps     []SelfTestStep `json:"steps"`
+}
+
+// selfTestCache holds the last result so repeated requests (doctor, status,
+// monitoring) don't hammer the identity provider.
+type selfTestCache struct {
+	mu     sync.Mutex
+	result *SelfTestResult
+}
+
+// handleRefresherSelfTest checks that the refresher can reach the identity
+// provider: OIDC discovery, then a refresh with a dummy token. It returns 503
+// if a check fails.
+func (s *Server) handleRefresherSelfTest(w http.ResponseWriter, r *http.Request) {
+	s.selfTest.mu.Lock()
+	result := s.selfTest.result
+	if result == nil || time.Since(result.CheckedAt) > selfTestCacheTTL {
+		result = s.runSelfTest(r.Context())
+		s.selfTest.result = result
+	}
+	s.selfTest.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) runSelfTest(ctx context.Context) *SelfTestResult {
+	client := &http.Client{Timeout: selfTestTimeout}
+	result := &SelfTestResult{OK: true, CheckedAt: time.Now()}
+	add := func(step SelfTestStep) {
+		result.Steps = append(result.Steps, step)
+		if !step.OK && !step.Skipped {
+			result.OK = false
+		}
+	}
+
+	if s.config.StaticAuth() {
+		add(SelfTestStep{Name: "discovery", Skipped: true, Detail: "auth_mode is static, no IdP"})
+		add(SelfTestStep{Name: "token_endpoint", Skipped: true, Detail: "auth_mode is static, no IdP"})
+		return result
+	}
+
+	tokenEndpoint := s.config.TokenEndpoint
+	if s.config.Issuer == "" {
+		add(SelfTestStep{Name: "discovery", Skipped: true, Detail: "no issuer configured"})
+	} else {
+		step, discovered := probeDiscovery(ctx, client, s.config.Issuer)
+		add(step)
+		if tokenEndpoint == "" {
+			tokenEndpoint = discovered
+		}
+	}
+
+	if tokenEndpoint == "" {
+		add(SelfTestStep{Name: "token_endpoint", Detail: "no token endpoint configured or discovered"})
+	} else {
+		add(probeTokenEndpoint(ctx, client, tokenEndpoint, s.config.ClientID))
+	}
+	return result
+}
+
+// probeDiscovery fetches the OIDC discovery document and returns the token
+// endpoint it names.
+func probeDiscovery(ctx context.Context, client *http.Client, issuer string) (SelfTestStep, string) {
+	step := SelfTestStep{Name: "discovery"}
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", discoveryURL, nil)
+	if err != nil {
+		step.Detail = err.Error()
+		return step, ""
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	step.Latency = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		step.Detail = fmt.Sprintf("GET %s: %v", discoveryURL, netcheck.Diagnose(ctx, err))
+		return step, ""
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		step.Detail = fmt.Sprintf("GET %s returned %s", discoveryURL, resp.Status)
+		return step, ""
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil || doc.TokenEndpoint == "" {
+		step.Detail = fmt.Sprintf("%s is not a valid discovery document", discoveryURL)
+		return step, ""
+	}
+	step.OK = true
+	step.Detail = "token endpoint " + doc.TokenEndpoint + tlsSummary(resp.TLS)
+	return step, doc.TokenEndpoint
+}
+
+// probeTokenEndpoint sends a refresh grant with a dummy refresh token. An
+// OAuth error about the grant means the endpoint is reachable and accepts
+// our client_id; an error about the client means client_id is wrong.
+func probeTokenEndpoint(ctx context.Context, client *http.Client, endpoint, clientID string) SelfTestStep {
+	step := SelfTestStep{Name: "token_endpoint"}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"refresh_token": {selfTestRefreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		step.Detail = err.Error()
+		return step
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	step.Latency = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		step.Detail = fmt.Sprintf("POST %s: %v", endpoint, netcheck.Diagnose(ctx, err))
+		return step
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var oauthErr struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &oauthErr)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		step.OK = true
+		step.Detail = "reachable, but the identity provider is rate limiting this client"
+	case resp.StatusCode >= 500:
+		step.Detail = fmt.Sprintf("identity provider error: %s", resp.Status)
+	case oauthErr.Error == "invalid_client" || oauthErr.Error == "unauthorized_client":
+		step.Detail = fmt.Sprintf("client_id %q rejected (%s)", clientID, oauthErr.Error)
+	case oauthErr.Error != "" || resp.StatusCode == http.StatusOK:
+		step.OK = true
+		step.Detail = "reachable, dummy refresh rejected as expected" + tlsSummary(resp.TLS)
+	default:
+		step.Detail = fmt.Sprintf("unexpected %s response, not an OAuth token endpoint", resp.Status)
+	}
+	return step
+}
+
+// tlsSummary describes the negotiated TLS session, or "" for plain HTTP.
+func tlsSummary(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	expires := state.PeerCertificates[0].NotAfter
+	return fmt.Sprintf(" (%s, certificate expires %s)", tls.VersionName(state.Version), expires.Format("2006-01-02"))
+}
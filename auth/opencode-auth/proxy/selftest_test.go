@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestRefresherSelfTest(t *testing.T) {
+	var tokenError string
+	var calls int
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"token_endpoint": idp.URL + "/token"})
+		case "/token":
+			calls++
+			r.ParseForm()
+			if r.Form.Get("refresh_token") != selfTestRefreshToken || r.Form.Get("client_id") != "test-client" {
+				t.Errorf("token request form = %v, want the dummy token and client_id", r.Form)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": tokenError})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
+	run := func(s *Server) (int, SelfTestResult) {
+		rec := httptest.NewRecorder()
+		s.handleRefresherSelfTest(rec, httptest.NewRequest("GET", "/api/refresher/selftest", nil))
+		var result SelfTestResult
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return rec.Code, result
+	}
+
+	tokenError = "invalid_grant"
+	s := &Server{config: &config.Config{Issuer: idp.URL, ClientID: "test-client"}}
+	code, result := run(s)
+	if code != http.StatusOK || !result.OK || len(result.Steps) != 2 {
+		t.Fatalf("invalid_grant: status %d, result %+v, want both steps ok", code, result)
+	}
+
+	// The result is cached, so a second request doesn't reach the IdP
+	run(s)
+	if calls != 1 {
+		t.Errorf("token endpoint called %d times, want 1 (cached)", calls)
+	}
+
+	tokenError = "invalid_client"
+	code, result = run(&Server{config: &config.Config{Issuer: idp.URL, ClientID: "test-client"}})
+	if code != http.StatusServiceUnavailable || result.OK {
+		t.Fatalf("invalid_client: status %d, result %+v, want failure", code, result)
+	}
+	if step := result.Steps[1]; step.OK || !strings.Contains(step.Detail, "client_id") {
+		t.Errorf("token_endpoint step = %+v, want client_id rejected", step)
+	}
+
+	// An unreachable identity provider fails
+	idp.Close()
+	code, result = run(&Server{config: &config.Config{Issuer: idp.URL, ClientID: "test-client"}})
+	if code != http.StatusServiceUnavailable || result.OK || result.Steps[0].OK {
+		t.Errorf("closed IdP: status %d, result %+v, want discovery failure", code, result)
+	}
+}
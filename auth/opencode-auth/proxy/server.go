@@ -6,8 +6,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -15,11 +17,18 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
 	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/hostmap"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/janitor"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracing"
 )
 
 // FileLock represents a file-based lock for proxy startup coordination
@@ -32,7 +41,6 @@ type FileLock struct {
 
 const (
 	proxyConfigFile  = "proxy.json"
-	defaultPort      = 18080 // Static port for proxy - hardcode in opencode.json
 	portCheckTimeout = 2 * time.Second
 )
 
@@ -43,6 +51,8 @@ type ProxyConfig struct {
 	Started       time.Time `json:"started"`
 	TargetURL     string    `json:"target_url"`
 	ClientVersion string    `json:"client_version,omitempty"`
+	// AdminToken authorizes /api/admin requests such as fault injection
+	AdminToken string `json:"admin_token,omitempty"`
 }
 
 // Server represents the local proxy server
@@ -52,8 +62,49 @@ type Server struct {
 	targetURL     *url.URL
 	port          int
 	server        *http.Server
+	listener      net.Listener
+	helpers       net.Listener // child tokens only, nil if not bound
 	refresher     *Refresher
+	peers         *peerChecker // nil when peer access control is disabled
+	usage         *usageStats
+	history       *requestHistory // nil in tests that build a Server directly
+	retries       *retryBudget
+	tracer        *tracing.Tracer // nil when tracing is not configured
+	selfTest      selfTestCache
+	tokenSock     tokenSocket
+	apiKey        apiKeyValidator
+	faults        faultInjector
+	session       idleSession
+	guardrails    atomic.Pointer[config.Guardrails]
+	budget        usageBudget
+	expired       expiredTokens
+	workspace     activeWorkspace
+	allowedModels atomic.Pointer[[]string]
+	authHeaders   atomic.Pointer[[]config.AuthHeader]
+	clientHeaders clientHeaderFilter
+	policy        policyPoller
+	events        *eventHub
+	watchdog      watchdog
+	device        deviceSigner
+	dedup         deduplicator
+	timeouts      upstreamTimeouts
+	deprecations  deprecations
+	rateLimits    rateLimits
+	experiments   experiments
+	annotations   annotations
+	revocation    revocation
+	ensureGate    ensureGate
+	stepUp        stepUp
+	broker        tokenBroker
+	upstreamTLS   upstreamTLS
+	hosts         *hostmap.Map  // host_overrides, nil if none
+	restart       chan struct{} // closed by the watchdog, see RestartRequested
+	restartOnce   sync.Once
+	handedOver    chan struct{} // closed by Handover
+	handoverOnce  sync.Once
+	adminToken    string // empty disables /api/admin
 	stopChan      chan struct{}
+	modelAliases  modelAliases
 	ClientVersion string // injected by main.go — sent as X-Client-Version header
 }
 
@@ -64,14 +115,15 @@ func NewServerWithPort(cfg *config.Config, port int) (*Server, error) {
 
 // NewServer creates a new proxy server instance
 func NewServer(cfg *config.Config) (*Server, error) {
-	return newServerInternal(cfg, defaultPort, true)
+	return newServerInternal(cfg, cfg.GetProxyPort(), true)
 }
 
 // newServerInternal is the internal implementation for creating a server
 func newServerInternal(cfg *config.Config, port int, checkPort bool) (*Server, error) {
-	// Check if port is available (only if checkPort is true)
-	if checkPort && !isPortAvailable(port) {
-		return nil, fmt.Errorf("port %d is not available - another proxy may be running", port)
+	// Check if port is available (only if checkPort is true). A proxy
+	// taking over from another uses that one's socket.
+	if checkPort && !InheritsListener() && !isPortAvailable(port) {
+		return nil, fmt.Errorf("%w: port %d is not available - another proxy may be running", ErrPortInUse, port)
 	}
 
 	// Parse target URL from config
@@ -86,37 +138,131 @@ func newServerInternal(cfg *config.Config, port int, checkPort bool) (*Server, e
 	}
 
 	server := &Server{
-		config:    cfg,
-		targetURL: targetURL,
-		port:      port,
-		stopChan:  make(chan struct{}),
+		config:     cfg,
+		targetURL:  targetURL,
+		port:       port,
+		usage:      newUsageStats(filepath.Join(cfg.ConfigDir, usageFile)),
+		history:    newRequestHistory(HistoryPath(cfg), cfg.RequestHistory),
+		retries:    newRetryBudget(),
+		events:     newEventHub(),
+		restart:    make(chan struct{}),
+		handedOver: make(chan struct{}),
+		stopChan:   make(chan struct{}),
+		tracer: tracing.New(tracing.Options{
+			Endpoint:       cfg.OTelEndpoint,
+			Headers:        cfg.OTelHeaders,
+			ServiceName:    "opencode-auth-proxy",
+			ServiceVersion: cfg.ClientVersion,
+		}),
 	}
+	server.adminToken = newAdminToken()
+	server.session.setTimeout(cfg.SessionIdleTimeout, time.Now())
+	server.setGuardrails(cfg.Guardrails)
+	server.budget.set(cfg.UsageBudget)
+	server.setAllowedModels(cfg.AllowedModels)
+	server.modelAliases.set(cfg.ModelAliases)
+	server.setAuthHeaders(cfg.AuthHeaders)
+	server.clientHeaders.set(cfg.ClientHeaders)
+	server.policy.setInterval(cfg.ConfigPollInterval)
+	server.watchdog.setLimits(cfg.Watchdog)
+	server.device.dir = cfg.ConfigDir
+	server.device.setMode(cfg.DeviceAssertion)
+	server.expired.setMode(cfg.ExpiredTokens)
+	server.workspace.set(cfg.Workspace)
+	server.rateLimits.setWarnPercent(cfg.QuotaWarnPercent)
+	server.experiments.set(cfg.Experiments)
+	server.annotations.set(cfg.Annotations)
+	server.dedup.setWindow(cfg.DedupWindow)
+	server.timeouts.set(cfg.GetHTTPTimeout(), cfg.StreamIdleTimeout, cfg.RouteTimeouts)
+	validateAuthHeaders(cfg.AuthHeaders)
+	validateClientHeaders(cfg.ClientHeaders)
+	validateAnnotations(cfg.Annotations)
+
+	switch cfg.ForwardedHeaders {
+	case "", ForwardedStrip, ForwardedSet:
+	default:
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: unknown proxy_forwarded_headers %q (expected %q or %q), stripping X-Forwarded-* headers\n",
+			cfg.ForwardedHeaders, ForwardedStrip, ForwardedSet)
+	}
+
+	// Host overrides pin the API to an internal address on split-horizon
+	// networks; an invalid map is ignored rather than failing startup
+	hosts, err := hostmap.New(cfg.HostOverrides)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: %v; ignoring host_overrides\n", err)
+	}
+	server.hosts = hosts
+	server.upstreamTLS.policy = cfg.TLSPolicy
 
 	// Create reverse proxy with timeout configuration
 	reverseProxy := httputil.NewSingleHostReverseProxy(targetURL)
 
-	// Set up transport with timeouts
-	reverseProxy.Transport = &http.Transport{
-		DialContext: (&net.Dialer{
+	// Set up transport with timeouts; transient upstream failures are
+	// retried within the retry budget. The header and stream idle timeouts
+	// are per route, see timeouts.go
+	reverseProxy.Transport = &retryTransport{server: server, next: &timeoutTransport{timeouts: &server.timeouts, next: &http.Transport{
+		DialContext: hosts.Dialer((&net.Dialer{
 			Timeout:   10 * time.Second,
 			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		}).DialContext),
+		TLSClientConfig:       cfg.TLSPolicy.Apply(nil),
 		TLSHandshakeTimeout:   10 * time.Second,
-		ResponseHeaderTimeout: 30 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		IdleConnTimeout:       90 * time.Second,
 		MaxIdleConns:          100,
 		MaxIdleConnsPerHost:   10,
-	}
+	}}}
 
 	// Customize the director to add auth headers
 	originalDirector := reverseProxy.Director
 	reverseProxy.Director = func(req *http.Request) {
 		originalDirector(req)
+		if dropped := server.clientHeaders.apply(req, server.targetURL.Host); len(dropped) > 0 && cfg.Debug {
+			fmt.Fprintf(os.Stderr, "[proxy] Not forwarding client headers %s for %s\n", strings.Join(dropped, ", "), req.URL.Path)
+		}
+		sanitizeHeaders(req, cfg.ForwardedHeaders)
+		server.workspace.apply(req)
+		server.annotations.applyHeaders(req)
+		for _, h := range server.currentAuthHeaders() {
+			req.Header.Del(h.Name)
+		}
+		rewriteAcceptEncoding(req, cfg.AcceptEncoding, cfg.Decompress)
+		if req.URL.Path == modelsPath && len(server.modelAliases.current()) > 0 {
+			// Aliases rename the models in the response body
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		if req.URL.Path == completionsPath && server.tracksUsage() {
+			// Budgets are tracked from the usage in the response body
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		_, span := server.tracer.Start(req.Context(), "auth.header", tracing.KindInternal)
 		server.addAuthHeader(req)
+		server.addDeviceAssertion(req)
+		span.SetAttr("auth.mode", authMode(req))
+		span.End()
 	}
 	// Intercept 426 Upgrade Required responses from server-side version gate
 	reverseProxy.ModifyResponse = func(resp *http.Response) error {
+		server.usage.record(resp.Request.URL.Path, resp.StatusCode)
+		server.upstreamTLS.observe(resp.TLS)
+		server.observeExperiment(resp)
+		if d, warn := server.deprecations.observe(resp.Request.URL.Path, resp.Header); warn {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: %s. Update with 'opencode-auth update'.\n", d.Message())
+		}
+		for _, l := range server.rateLimits.observe(resp.Request.URL.Path, resp.Header, time.Now()) {
+			message := "Upstream limit running low: " + l.Message()
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: %s\n", message)
+			server.events.publish(Event{Type: EventRateLimitLow, Message: message})
+		}
+		if cfg.Decompress {
+			if err := decompressResponse(resp); err != nil {
+				return err
+			}
+		}
+		if err := server.renameListedModels(resp); err != nil {
+			return err
+		}
+		server.checkRevocation(resp)
 		if resp.StatusCode == http.StatusUpgradeRequired {
 			body, err := io.ReadAll(resp.Body)
 			resp.Body.Close()
@@ -153,23 +299,60 @@ func newServerInternal(cfg *config.Config, port int, checkPort bool) (*Server, e
 				resp.Body = io.NopCloser(bytes.NewReader(body))
 			}
 		}
+		server.countTokens(resp)
+		traceResponse(server.tracer, resp)
 		return nil
 	}
 
+	// Same as ReverseProxy's default, plus the cause in the request history
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if e := historyEntryFrom(r.Context()); e != nil {
+			e.Error = err.Error()
+		}
+		server.experimentFailed(r.Context())
+		log.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
 	server.proxy = reverseProxy
 	server.ClientVersion = cfg.ClientVersion
 
+	// Restrict which local processes may use our credentials
+	if !cfg.NoPeerCheck {
+		server.peers = newPeerChecker(cfg.AllowedProcesses)
+	}
+	guard := func(h http.HandlerFunc) http.HandlerFunc {
+		if server.peers == nil {
+			return h
+		}
+		return server.peers.wrap(h)
+	}
+
 	// Create HTTP server
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", server.handleRequest)
+	mux.HandleFunc("/", guard(server.handleRequest))
 	mux.HandleFunc("/health", server.handleHealth)
-	mux.HandleFunc("/api/token", server.handleGetToken)
+	mux.HandleFunc("/api/token", guard(server.handleGetToken))
 	mux.HandleFunc("/api/token/status", server.handleTokenStatus)
-	mux.HandleFunc("/api/auth/ensure", server.handleEnsure)
+	mux.HandleFunc("/api/token/exchange", guard(server.handleTokenExchange))
+	mux.HandleFunc("/api/auth/ensure", guard(server.handleEnsure))
+	mux.HandleFunc("/api/usage", guard(server.handleUsage))
+	mux.HandleFunc("/api/observe", server.handleObserve)
+	mux.HandleFunc("/api/events", guard(server.handleEvents))
+	mux.HandleFunc("/api/refresher/selftest", guard(server.handleRefresherSelfTest))
+	mux.HandleFunc("/api/reauth/continue", guard(server.handleReauthContinue))
+	mux.HandleFunc("/api/config/reload", guard(server.handleConfigReload))
+	mux.HandleFunc("/api/admin/faults", guard(server.requireAdmin(server.handleFaults)))
+	mux.HandleFunc("/api/admin/handover", guard(server.requireAdmin(server.handleHandover)))
+	mux.HandleFunc("/api/admin/simulate-expiry", guard(server.requireAdmin(server.handleSimulateExpiry)))
 
 	server.server = &http.Server{
 		Addr:    fmt.Sprintf("localhost:%d", port),
-		Handler: mux,
+		Handler: server.refuseChildTokens(mux),
+	}
+	if server.peers != nil {
+		server.server.ConnContext = saveConn
+		server.server.ConnState = server.peers.forget
 	}
 
 	return server, nil
@@ -177,34 +360,103 @@ func newServerInternal(cfg *config.Config, port int, checkPort bool) (*Server, e
 
 // Start starts the proxy server and background refresher
 func (s *Server) Start() error {
-	// Check if already running
-	if existing, err := LoadProxyConfig(s.config); err == nil && IsProcessRunning(existing.PID) {
-		return fmt.Errorf("proxy already running on port %d (PID %d)", existing.Port, existing.PID)
+	// Check if already running, unless this proxy is replacing it
+	if existing, err := LoadProxyConfig(s.config); err == nil && IsProcessRunning(existing.PID) && !InheritsListener() {
+		return fmt.Errorf("%w on port %d (PID %d)", ErrAlreadyRunning, existing.Port, existing.PID)
 	}
 
-	// Create and start the token refresher
-	refresher, err := NewRefresher(s.config)
+	listener, err := s.listen()
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("%w: failed to listen on port %d: %v", ErrPortInUse, s.port, err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create token refresher: %w", err)
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
 	}
-	s.refresher = refresher
-	go s.refresher.Start()
+	s.listener = listener
 
-	// Save proxy configuration
+	if s.config.StaticAuth() {
+		// Nothing to refresh: every request carries the configured token
+		if err := s.config.ResolveStaticToken(context.Background()); err != nil {
+			listener.Close()
+			return err
+		}
+		s.tokenSock.static = s.config.StaticToken
+		fmt.Fprintf(os.Stderr, "[proxy] Using static token auth (prefix: %s)\n", StaticTokenPrefix(s.config.StaticToken))
+	} else {
+		// Resolve the API key from the keychain or an external command, if configured
+		if err := s.config.ResolveAPIKey(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: %v (falling back to JWT auth)\n", err)
+		}
+
+		// A revoked or expired key would fail every request; check it up front
+		if s.config.APIKey != "" {
+			go s.watchAPIKey()
+		}
+
+		// With token_storage memory, the refresher and the CLI use the
+		// tokens this proxy holds
+		if s.config.MemoryTokens() {
+			s.useMemoryTokens()
+			go s.serveTokenStore()
+		}
+
+		// Create and start the token refresher
+		refresher, err := NewRefresher(s.config)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to create token refresher: %w", err)
+		}
+		refresher.events = s.events
+		s.refresher = refresher
+		go s.refresher.Start()
+	}
+
+	// Save proxy configuration. A proxy handing over waits for this.
 	proxyConfig := &ProxyConfig{
 		Port:          s.port,
 		PID:           os.Getpid(),
 		Started:       time.Now(),
 		TargetURL:     s.targetURL.String(),
 		ClientVersion: s.ClientVersion,
+		AdminToken:    s.adminToken,
 	}
 	if err := SaveProxyConfig(s.config, proxyConfig); err != nil {
+		listener.Close()
 		return fmt.Errorf("failed to save proxy config: %w", err)
 	}
 
+	// The daemon's output goes to the log file; keep it bounded
+	if os.Getenv("OPENCODE_AUTH_PROXY_DAEMON") == "1" {
+		go watchLogSize(LogPath(s.config), s.stopChan)
+		go s.cleanArtifacts()
+	}
+
+	// Serve the redacted status feed, if proxy_observer_listen is set
+	go s.serveObserver()
+
+	// Serve 'opencode-auth token' from memory
+	s.tokenSock.audit.Store(s.config.TokenAudit)
+	go s.serveTokenSocket()
+
+	// Take child tokens from helper tools on their own port
+	s.listenHelpers()
+	go s.serveHelpers()
+
+	// Pick up tunable changes in config.json without a restart
+	go s.watchConfig(config.ConfigPaths())
+
+	// Sign out idle sessions, if session_idle_timeout is set
+	go s.watchSession()
+
+	// Apply fleet policy changes, if proxy_config_poll_interval is set
+	go s.watchPolicy()
+
+	// Catch goroutine, memory, and file descriptor leaks
+	go s.watchResources()
+
 	// Start the HTTP server in a goroutine
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			fmt.Fprintf(os.Stderr, "Proxy server error: %v\n", err)
 		}
 	}()
@@ -212,6 +464,18 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// cleanArtifacts removes temp files, unheld locks, and installer downloads
+// left behind by interrupted commands.
+func (s *Server) cleanArtifacts() {
+	removed, errs := janitor.Clean(janitor.Options{ConfigDir: s.config.ConfigDir})
+	for _, a := range removed {
+		fmt.Fprintf(os.Stderr, "[proxy] Removed stale %s %s\n", a.Kind, a.Path)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: cleanup failed: %v\n", err)
+	}
+}
+
 // Stop gracefully stops the proxy server
 func (s *Server) Stop() error {
 	close(s.stopChan)
@@ -221,15 +485,29 @@ func (s *Server) Stop() error {
 		s.refresher.Stop()
 	}
 
-	// Remove proxy config
-	configPath := filepath.Join(s.config.ConfigDir, proxyConfigFile)
-	os.Remove(configPath)
+	// Remove proxy config and the token socket, so clients stop using them
+	// even if the process exits before the listeners close. After a
+	// handover they belong to the replacement.
+	drainTimeout := 5 * time.Second
+	if s.isHandedOver() {
+		drainTimeout = handoverDrainTimeout
+	} else {
+		configPath := filepath.Join(s.config.ConfigDir, proxyConfigFile)
+		os.Remove(configPath)
+		for _, path := range []string{TokenSocketPath(s.config), TokenStoreSocketPath(s.config)} {
+			if path != "" {
+				os.Remove(path)
+			}
+		}
+	}
 
 	// Shutdown the HTTP server
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
 
-	return s.server.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+	s.tracer.Shutdown(ctx) // export spans of the requests just drained
+	return err
 }
 
 // Port returns the port the server is listening on
@@ -239,7 +517,46 @@ func (s *Server) Port() int {
 
 // handleRequest proxies requests to the target API with auth headers
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	s.proxy.ServeHTTP(w, r)
+	if s.tracer != nil {
+		ctx, span := s.tracer.Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+r.URL.Path, tracing.KindServer)
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		defer span.End()
+		r = r.WithContext(ctx)
+	}
+	if s.history != nil && s.history.enabled.Load() {
+		var rec *historyRecorder
+		rec, r = s.history.begin(w, r)
+		defer s.history.finish(rec)
+		w = rec
+	}
+	if s.checkChildToken(w, r) {
+		return
+	}
+	if s.checkSessionLock(w, r) {
+		return
+	}
+	if s.checkCredentials(w, r) {
+		return
+	}
+	r, handled := s.resolveAudienceToken(w, r)
+	if handled {
+		return
+	}
+	r = s.annotateBody(r)
+	s.resolveModelAlias(r)
+	if s.checkModelPolicy(w, r) {
+		return
+	}
+	if s.checkGuardrails(w, r) {
+		return
+	}
+	r = s.assignExperiment(r)
+	w, handled = s.faults.inject(w, r)
+	if handled {
+		return
+	}
+	s.dedup.serve(w, s.applyTimeouts(r), s.proxy)
 }
 
 // handleHealth returns the proxy health status
@@ -259,6 +576,15 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 			"needs_reauth":       s.refresher.GetNeedsReauth(),
 			"reauth_in_progress": s.refresher.GetReauthInProgress(),
 		}
+		if sim := s.refresher.Simulation(); sim != nil {
+			refresherStatus["simulation"] = sim
+		}
+		if prompt := s.refresher.PendingReauth(); prompt != nil {
+			refresherStatus["reauth_prompt"] = prompt
+		}
+		if dnd := s.refresher.DoNotDisturb(); dnd != nil {
+			refresherStatus["do_not_disturb"] = dnd
+		}
 
 		// Load current token info
 		if tokens, err := auth.LoadTokens(s.config.TokenPath); err == nil {
@@ -275,6 +601,86 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 		health["refresher"] = refresherStatus
 	}
+	if aliases := s.modelAliases.status(); aliases != nil {
+		health["model_aliases"] = aliases
+	}
+	if s.config.StaticAuth() {
+		health["static_auth"] = StaticAuthStatus{TokenPrefix: StaticTokenPrefix(s.config.StaticToken)}
+	}
+
+	if state := s.apiKey.get(); state != nil {
+		health["api_key"] = state
+	}
+	if st := s.clientHeaders.status(); st != nil {
+		health["client_headers"] = st
+	}
+	if budget := s.usageBudgetStatus(); budget != nil {
+		health["usage_budget"] = budget
+	}
+	if expired := s.expired.status(); expired != nil {
+		health["expired_tokens"] = expired
+	}
+	if workspace := s.workspace.current(); workspace != "" {
+		health["workspace"] = workspace
+	}
+	if revoked := s.revocation.get(); revoked != nil {
+		health["revocation"] = revoked
+	}
+	if elevated := s.stepUp.status(); elevated != nil {
+		health["step_up"] = elevated
+	}
+	if broker := s.broker.status(); broker != nil {
+		broker.HelperURL = s.helperURL()
+		health["broker"] = broker
+	}
+	if ensure := s.ensureGate.status(); ensure != nil {
+		health["ensure"] = ensure
+	}
+	if s.retries != nil {
+		health["retry_budget"] = s.retries.stats()
+	}
+	if s.tracer != nil {
+		health["tracing"] = s.tracer.Stats()
+	}
+	if faults := s.faults.snapshot(); faults != nil {
+		health["faults"] = faults
+	}
+	if session := s.session.status(); session != nil {
+		health["session"] = session
+	}
+	if policy := s.policy.status(); policy != nil {
+		health["policy"] = policy
+	}
+	if watchdog := s.watchdog.status(); watchdog != nil {
+		health["watchdog"] = watchdog
+	}
+	if device := s.device.status(); device != nil {
+		health["device"] = device
+	}
+	if dedup := s.dedup.status(); dedup != nil {
+		health["dedup"] = dedup
+	}
+	if timeouts := s.timeouts.status(); timeouts != nil {
+		health["upstream_timeouts"] = timeouts
+	}
+	if deprecations := s.deprecations.status(); deprecations != nil {
+		health["deprecations"] = deprecations
+	}
+	if experiments := s.experiments.status(); experiments != nil {
+		health["experiments"] = experiments
+	}
+	if annotations := s.annotations.status(); annotations != nil {
+		health["annotations"] = annotations
+	}
+	if rateLimits := s.rateLimits.status(); rateLimits != nil {
+		health["rate_limits"] = rateLimits
+	}
+	if hosts := s.hosts.Overrides(); hosts != nil {
+		health["host_overrides"] = hosts
+	}
+	if tlsStatus := s.upstreamTLS.status(); tlsStatus != nil {
+		health["tls"] = tlsStatus
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(health)
@@ -290,6 +696,7 @@ type TokenAPIResponse struct {
 // TokenStatusResponse is the response for /api/token/status endpoint
 type TokenStatusResponse struct {
 	Valid            bool      `json:"valid"`
+	AuthMode         string    `json:"auth_mode,omitempty"` // "static" when no IdP is used
 	ExpiresIn        string    `json:"expires_in,omitempty"`
 	Email            string    `json:"email,omitempty"`
 	NeedsReauth      bool      `json:"needs_reauth"`
@@ -299,7 +706,7 @@ type TokenStatusResponse struct {
 
 // EnsureResponse is the response for /api/auth/ensure endpoint
 type EnsureResponse struct {
-	Status           string `json:"status"` // "ok", "reauth_required", "reauth_in_progress"
+	Status           string `json:"status"` // "ok", "reauth_required", "reauth_in_progress", "rate_limited"
 	ReauthInProgress bool   `json:"reauth_in_progress,omitempty"`
 	Message          string `json:"message,omitempty"`
 }
@@ -308,6 +715,11 @@ type EnsureResponse struct {
 func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	if s.config.StaticAuth() {
+		json.NewEncoder(w).Encode(TokenAPIResponse{Token: s.config.StaticToken})
+		return
+	}
+
 	// Check if reauth is needed
 	if s.refresher != nil && s.refresher.GetNeedsReauth() {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -338,7 +750,7 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 
 	// Return valid token
 	json.NewEncoder(w).Encode(TokenAPIResponse{
-		Token:     tokens.IDToken,
+		Token:     tokens.BearerToken(),
 		ExpiresAt: tokens.ExpiresAt,
 	})
 }
@@ -346,10 +758,19 @@ func (s *Server) handleGetToken(w http.ResponseWriter, r *http.Request) {
 // handleTokenStatus returns detailed token health information
 func (s *Server) handleTokenStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.tokenStatus())
+}
 
+// tokenStatus reports the stored token and the refresher's state.
+func (s *Server) tokenStatus() TokenStatusResponse {
 	response := TokenStatusResponse{
 		Valid: false,
 	}
+	if s.config.StaticAuth() {
+		response.Valid = true
+		response.AuthMode = config.AuthModeStatic
+		return response
+	}
 
 	// Get refresher status
 	if s.refresher != nil {
@@ -360,8 +781,7 @@ func (s *Server) handleTokenStatus(w http.ResponseWriter, r *http.Request) {
 	// Load current token
 	tokens, err := auth.LoadTokens(s.config.TokenPath)
 	if err != nil {
-		json.NewEncoder(w).Encode(response)
-		return
+		return response
 	}
 
 	// Fill in token info
@@ -373,7 +793,7 @@ func (s *Server) handleTokenStatus(w http.ResponseWriter, r *http.Request) {
 		response.ExpiresIn = time.Until(tokens.ExpiresAt).Round(time.Second).String()
 	}
 
-	json.NewEncoder(w).Encode(response)
+	return response
 }
 
 // handleEnsure ensures a valid token exists, triggering refresh or reauth if needed
@@ -390,14 +810,37 @@ func (s *Server) handleEnsure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if reauth is already in progress
-	if s.refresher != nil && s.refresher.GetReauthInProgress() {
+	if ok, wait := s.ensureGate.allow(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		w.WriteHeader(http.StatusTooManyRequests)
 		json.NewEncoder(w).Encode(EnsureResponse{
+			Status:  "rate_limited",
+			Message: "too many ensure calls, retry later",
+		})
+		return
+	}
+
+	// Concurrent calls share one evaluation, so only one forces a refresh
+	resp, _ := s.ensureGate.do(s.ensure)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ensure checks the token and refreshes it or starts re-authentication as
+// needed. Called through ensureGate.
+func (s *Server) ensure() EnsureResponse {
+	if s.config.StaticAuth() {
+		return EnsureResponse{Status: "ok", Message: "static token configured"}
+	}
+
+	// Check if reauth is already in progress; a client waiting on it
+	// answers a pending prompt
+	if s.refresher != nil && s.refresher.GetReauthInProgress() {
+		s.refresher.ContinueReauth(consentEnsure)
+		return EnsureResponse{
 			Status:           "reauth_in_progress",
 			ReauthInProgress: true,
 			Message:          "re-authentication is in progress, please wait",
-		})
-		return
+		}
 	}
 
 	// Check if reauth is needed (refresh token expired)
@@ -405,32 +848,29 @@ func (s *Server) handleEnsure(w http.ResponseWriter, r *http.Request) {
 		// Check if tokens were refreshed externally (e.g., opencode-auth login)
 		if tokens, err := auth.LoadTokens(s.config.TokenPath); err == nil && !tokens.IsExpiringSoon(5*time.Minute) {
 			s.refresher.ClearNeedsReauth()
-			json.NewEncoder(w).Encode(EnsureResponse{
+			return EnsureResponse{
 				Status:  "ok",
 				Message: "token refreshed externally",
-			})
-			return
+			}
 		}
 
 		// Still needs reauth — trigger it
 		go s.refresher.TriggerReauth()
-		json.NewEncoder(w).Encode(EnsureResponse{
+		return EnsureResponse{
 			Status:           "reauth_required",
 			ReauthInProgress: true,
 			Message:          "re-authentication required, browser will open",
-		})
-		return
+		}
 	}
 
 	// Load current token
 	tokens, err := auth.LoadTokens(s.config.TokenPath)
 	if err != nil {
 		// No token at all - need full auth
-		json.NewEncoder(w).Encode(EnsureResponse{
+		return EnsureResponse{
 			Status:  "reauth_required",
 			Message: "no token found, authentication required",
-		})
-		return
+		}
 	}
 
 	// Check if token is expiring soon and force refresh
@@ -442,22 +882,21 @@ func (s *Server) handleEnsure(w http.ResponseWriter, r *http.Request) {
 				// If refresh failed and needs reauth, handle it
 				if s.refresher.GetNeedsReauth() {
 					go s.refresher.TriggerReauth()
-					json.NewEncoder(w).Encode(EnsureResponse{
+					return EnsureResponse{
 						Status:           "reauth_required",
 						ReauthInProgress: true,
 						Message:          "token refresh failed, re-authentication required",
-					})
-					return
+					}
 				}
 			}
 		}
 	}
 
 	// Token is valid (or was just refreshed)
-	json.NewEncoder(w).Encode(EnsureResponse{
+	return EnsureResponse{
 		Status:  "ok",
 		Message: "token is valid",
-	})
+	}
 }
 
 // addAuthHeader reads the current token or API key and adds it to the request
@@ -470,11 +909,24 @@ func (s *Server) addAuthHeader(req *http.Request) {
 		req.Header.Set("X-Client-Version", s.ClientVersion)
 	}
 
-	// API key management paths always use JWT (required by ALB rule)
-	isManagementPath := strings.HasPrefix(req.URL.Path, "/v1/api-keys")
+	if s.config.StaticAuth() {
+		s.setStaticAuthHeader(req)
+		return
+	}
 
-	// If an API key is configured and this is NOT a management path, use it
-	if s.config.APIKey != "" && !isManagementPath {
+	// If an API key is configured and this is NOT a management path, use it,
+	// unless the router has rejected it
+	if s.usesAPIKey(req.URL.Path) {
+		data := AuthHeaderData{APIKey: s.config.APIKey, Token: s.config.APIKey}
+		if s.config.AuthHeaderFor(s.targetURL.Host, req.URL.Path) != nil {
+			// Formats may also refer to the user's tokens
+			if tokens, err := auth.LoadTokens(s.config.TokenPath); err == nil {
+				data.IDToken, data.AccessToken, data.Email = tokens.IDToken, tokens.AccessToken, tokens.Email
+			}
+		}
+		if s.setRouteAuthHeader(req, data) {
+			return
+		}
 		req.Header.Set("X-API-Key", s.config.APIKey)
 		if s.config.Debug {
 			fmt.Fprintf(os.Stderr, "[proxy] Using API key auth (prefix: %s...)\n", s.config.APIKey[:10])
@@ -485,8 +937,8 @@ func (s *Server) addAuthHeader(req *http.Request) {
 	// Fall back to JWT auth
 	tokens, err := auth.LoadTokens(s.config.TokenPath)
 	if err != nil {
-		// Log error but don't fail - let the request go through and fail at API level
-		// This allows debugging of token issues
+		// Only reached with proxy_expired_tokens "forward" (checkCredentials
+		// refuses the request otherwise): let it fail at the API level
 		fmt.Fprintf(os.Stderr, "[proxy] Warning: failed to load tokens for auth header: %v\n", err)
 		return
 	}
@@ -513,8 +965,30 @@ func (s *Server) addAuthHeader(req *http.Request) {
 		fmt.Fprintf(os.Stderr, "[proxy] Token valid, expires in %v\n", timeUntilExpiry)
 	}
 
-	// Set the Authorization header
-	req.Header.Set("Authorization", "Bearer "+tokens.IDToken)
+	// Routes served by a separate audience need that audience's access
+	// token, which resolveAudienceToken found before the request got here.
+	// Never fall back to the primary token for them.
+	if resource := s.config.AudienceFor(s.targetURL.Host, req.URL.Path); resource != "" {
+		token, ok := req.Context().Value(audienceTokenKey{}).(string)
+		if !ok {
+			if token, ok = tokens.TokenFor(resource); !ok {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: no token for audience %s; sending %s without credentials\n", resource, req.URL.Path)
+				return
+			}
+		}
+		if s.config.Debug {
+			fmt.Fprintf(os.Stderr, "[proxy] Using %s audience token for %s\n", resource, req.URL.Path)
+		}
+		if !s.setRouteAuthHeader(req, s.authHeaderData(tokens, token)) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return
+	}
+
+	// Set the Authorization header (access token for non-OIDC providers)
+	if !s.setRouteAuthHeader(req, s.authHeaderData(tokens, tokens.BearerToken())) {
+		req.Header.Set("Authorization", "Bearer "+tokens.BearerToken())
+	}
 }
 
 // isPortAvailable checks if a port is available for use
@@ -559,7 +1033,14 @@ func SaveProxyConfig(cfg *config.Config, proxyConfig *ProxyConfig) error {
 		return fmt.Errorf("failed to marshal proxy config: %w", err)
 	}
 
-	if err := os.WriteFile(configPath, data, 0600); err != nil {
+	// Write and rename, so readers never see a partial file, even while
+	// one proxy hands over to another
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write proxy config: %w", err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to write proxy config: %w", err)
 	}
 
@@ -577,9 +1058,15 @@ func IsProcessRunning(pid int) bool {
 	return isProcessRunningOS(process)
 }
 
+// ErrNotRunning is returned when there is no proxy process to talk to.
+var ErrNotRunning = errors.New("proxy not running")
+
 // GetProxyURL returns the proxy URL if a proxy is running
 func GetProxyURL(cfg *config.Config) (string, error) {
 	proxyConfig, err := LoadProxyConfig(cfg)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotRunning
+	}
 	if err != nil {
 		return "", err
 	}
@@ -589,7 +1076,7 @@ func GetProxyURL(cfg *config.Config) (string, error) {
 		// Clean up stale config
 		configPath := filepath.Join(cfg.ConfigDir, proxyConfigFile)
 		os.Remove(configPath)
-		return "", fmt.Errorf("proxy not running")
+		return "", ErrNotRunning
 	}
 
 	// Verify it's responsive
@@ -639,6 +1126,14 @@ func StartProxy(cfg *config.Config) (*ProxyConfig, error) {
 		os.Remove(configPath)
 	}
 
+	// On Windows an installed service outlives the console; prefer it
+	if ok, err := startService(); ok {
+		if err != nil {
+			return nil, err
+		}
+		return LoadProxyConfig(cfg)
+	}
+
 	// Get the current executable path
 	binaryPath, err := os.Executable()
 	if err != nil {
@@ -651,25 +1146,44 @@ func StartProxy(cfg *config.Config) (*ProxyConfig, error) {
 		// Parent process - fork and exit
 		cmd := exec.Command(binaryPath, "proxy", "start", "--foreground")
 		cmd.Env = append(os.Environ(), "OPENCODE_AUTH_PROXY_DAEMON=1")
-		cmd.Stdout = nil
-		cmd.Stderr = nil
+		// Pin the project config layer so reloads see the directory the
+		// proxy was launched from
+		if dir := config.ProjectDir(); dir != "" {
+			cmd.Env = append(cmd.Env, "OPENCODE_PROJECT_DIR="+dir)
+		}
 		cmd.Stdin = nil
 
-		if err := cmd.Start(); err != nil {
-			return nil, fmt.Errorf("failed to start proxy daemon: %w", err)
+		// Capture refresher diagnostics and crashes in a log file; without
+		// it a background proxy that stops refreshing leaves no trace
+		logFile, err := openDaemonLog(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: proxy output will be discarded: %v\n", err)
+		} else {
+			defer logFile.Close() // The child keeps its own descriptor
+			fmt.Fprintf(logFile, "\n%s at %s ===\n", daemonLogMarker, time.Now().Format(time.RFC3339))
+			cmd.Stdout = logFile
+			cmd.Stderr = logFile
 		}
 
-		// Reap the child process in the background to prevent zombies.
-		// The daemon is long-lived, so this goroutine normally blocks until
-		// the parent process exits, but if the daemon crashes it prevents
-		// a zombie from lingering.
-		go cmd.Wait()
+		// The daemon reports on this pipe once it is serving, or why not
+		ready, readyW := readyPipe()
+		if readyW != nil {
+			cmd.ExtraFiles = []*os.File{readyW}
+			cmd.Env = append(cmd.Env, readyFDEnv+"=3")
+		}
 
-		// Give the daemon time to start and write its config
-		time.Sleep(500 * time.Millisecond)
+		err = cmd.Start()
+		if readyW != nil {
+			readyW.Close() // The child keeps its own descriptor
+		}
+		if err != nil {
+			if ready != nil {
+				ready.Close()
+			}
+			return nil, fmt.Errorf("failed to start proxy daemon: %w", err)
+		}
 
-		// Return the config
-		return LoadProxyConfig(cfg)
+		return waitStartup(cfg, cmd, ready)
 	}
 
 	// Child process - this shouldn't happen as the child calls Start() directly
@@ -679,9 +1193,13 @@ func StartProxy(cfg *config.Config) (*ProxyConfig, error) {
 
 // StopProxy stops the running proxy daemon
 func StopProxy(cfg *config.Config) error {
+	if ok, err := stopService(); ok {
+		return err
+	}
+
 	proxyConfig, err := LoadProxyConfig(cfg)
 	if err != nil {
-		return fmt.Errorf("no proxy configuration found")
+		return fmt.Errorf("%w: no proxy configuration found", ErrNotRunning)
 	}
 
 	// Find the process
@@ -710,9 +1228,17 @@ func StopProxy(cfg *config.Config) error {
 func StatusProxy(cfg *config.Config) (map[string]interface{}, error) {
 	proxyConfig, err := LoadProxyConfig(cfg)
 	if err != nil {
-		return map[string]interface{}{
+		status := map[string]interface{}{
 			"status": "not running",
-		}, nil
+		}
+		// A previous daemon's log explains why it stopped
+		if _, err := os.Stat(LogPath(cfg)); err == nil {
+			status["log"] = LogPath(cfg)
+		}
+		if state := ServiceState(); state != "" {
+			status["service"] = state
+		}
+		return status, nil
 	}
 
 	running := IsProcessRunning(proxyConfig.PID)
@@ -722,6 +1248,10 @@ func StatusProxy(cfg *config.Config) (map[string]interface{}, error) {
 		"pid":     proxyConfig.PID,
 		"started": proxyConfig.Started,
 		"target":  proxyConfig.TargetURL,
+		"log":     LogPath(cfg),
+	}
+	if state := ServiceState(); state != "" {
+		status["service"] = state
 	}
 
 	if !running {
@@ -738,6 +1268,22 @@ func StatusProxy(cfg *config.Config) (map[string]interface{}, error) {
 			status["health"] = "unresponsive"
 		} else {
 			status["health"] = "healthy"
+			var health struct {
+				APIKey      *APIKeyState      `json:"api_key"`
+				StaticAuth  *StaticAuthStatus `json:"static_auth"`
+				RetryBudget *RetryBudgetStats `json:"retry_budget"`
+			}
+			if json.NewDecoder(resp.Body).Decode(&health) == nil {
+				if health.APIKey != nil {
+					status["api_key"] = health.APIKey
+				}
+				if health.StaticAuth != nil {
+					status["static_auth"] = health.StaticAuth
+				}
+				if health.RetryBudget != nil {
+					status["retry_budget"] = health.RetryBudget
+				}
+			}
 			resp.Body.Close()
 		}
 	}
@@ -147,6 +147,86 @@ func TestServerAddAuthHeader(t *testing.T) {
 	}
 }
 
+func TestServerAddAuthHeader_AudienceRouting(t *testing.T) {
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+
+	testTokens := &auth.TokenData{
+		IDToken:   "test-id-token-12345",
+		ExpiresAt: time.Now().Add(1 * time.Hour),
+		AudienceTokens: map[string]auth.AudienceToken{
+			"https://keys.example.com": {
+				AccessToken: "keys-access-token",
+				ExpiresAt:   time.Now().Add(1 * time.Hour),
+			},
+		},
+	}
+	if err := auth.SaveTokens(tokenPath, testTokens); err != nil {
+		t.Fatalf("Failed to save test tokens: %v", err)
+	}
+
+	cfg := &config.Config{
+		ConfigDir: tempDir,
+		TokenPath: tokenPath,
+		Audiences: []config.Audience{
+			{Resource: "https://keys.example.com", PathPrefix: "/v1/api-keys"},
+			{Resource: "https://other.example.com", PathPrefix: "/v1", Host: "other.example.com"},
+		},
+	}
+	targetURL, _ := url.Parse("https://api.example.com")
+	server := &Server{config: cfg, targetURL: targetURL}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v1/api-keys", "Bearer keys-access-token"},
+		{"/v1/chat/completions", "Bearer test-id-token-12345"}, // host-scoped audience does not match
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost:8080"+tt.path, nil)
+		server.addAuthHeader(req)
+		if got := req.Header.Get("Authorization"); got != tt.want {
+			t.Errorf("%s: Authorization = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServerHandleRequest_AudienceTokenUnavailable(t *testing.T) {
+	var sent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	// No audience token and no refresh token to get one with
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "test-id-token-12345", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{
+		ConfigDir:   tempDir,
+		TokenPath:   tokenPath,
+		APIEndpoint: upstream.URL,
+		Audiences:   []config.Audience{{Resource: "https://keys.example.com", PathPrefix: "/v1/api-keys"}},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest("GET", "/v1/api-keys", nil))
+	if rec.Code != http.StatusBadGateway || sent != "" {
+		t.Errorf("status %d, upstream got Authorization %q; want 502 and no upstream request", rec.Code, sent)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest("GET", "/v1/models", nil))
+	if rec.Code != http.StatusOK || sent != "Bearer test-id-token-12345" {
+		t.Errorf("/v1/models: status %d, upstream got Authorization %q", rec.Code, sent)
+	}
+}
+
 func TestServerAddAuthHeader_NoTokens(t *testing.T) {
 	tempDir := t.TempDir()
 	cfg := &config.Config{
@@ -422,9 +502,17 @@ func TestProxyTransportTimeouts(t *testing.T) {
 		t.Error("Expected proxy.Transport to be configured, got nil")
 	}
 
-	transport, ok := server.proxy.Transport.(*http.Transport)
+	retrying, ok := server.proxy.Transport.(*retryTransport)
 	if !ok {
-		t.Fatalf("Expected *http.Transport, got %T", server.proxy.Transport)
+		t.Fatalf("Expected *retryTransport, got %T", server.proxy.Transport)
+	}
+	timeouts, ok := retrying.next.(*timeoutTransport)
+	if !ok {
+		t.Fatalf("Expected *timeoutTransport, got %T", retrying.next)
+	}
+	transport, ok := timeouts.next.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected *http.Transport, got %T", timeouts.next)
 	}
 
 	// Verify timeout settings
@@ -432,8 +520,8 @@ func TestProxyTransportTimeouts(t *testing.T) {
 		t.Errorf("TLSHandshakeTimeout = %v, want 10s", transport.TLSHandshakeTimeout)
 	}
 
-	if transport.ResponseHeaderTimeout != 30*time.Second {
-		t.Errorf("ResponseHeaderTimeout = %v, want 30s", transport.ResponseHeaderTimeout)
+	if header := timeouts.timeouts.forRequest("/v1/models", "").header; header != 30*time.Second {
+		t.Errorf("response header timeout = %v, want 30s", header)
 	}
 
 	if transport.ExpectContinueTimeout != 1*time.Second {
@@ -586,6 +674,63 @@ func TestAddAuthHeader_ExpiredToken_RefresherSucceeds(t *testing.T) {
 	t.Log("✓ Expired token was refreshed inline before setting Authorization header")
 }
 
+func TestAddAuthHeader_AccessTokenOnlyProvider(t *testing.T) {
+	// Plain OAuth providers issue no ID token: the refresher must derive
+	// expiry from expires_in and the header must carry the access token.
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+
+	if err := auth.SaveTokens(tokenPath, &auth.TokenData{
+		AccessToken:  "expired-access-token",
+		RefreshToken: "valid-refresh-token",
+		ExpiresAt:    time.Now().Add(-10 * time.Minute),
+	}); err != nil {
+		t.Fatalf("Failed to save tokens: %v", err)
+	}
+
+	mockTokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "fresh-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   1800,
+		})
+	}))
+	defer mockTokenEndpoint.Close()
+
+	cfg := &config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		ClientID:      "test-client-id",
+		TokenEndpoint: mockTokenEndpoint.URL,
+	}
+	refresher, err := NewRefresher(cfg)
+	if err != nil {
+		t.Fatalf("NewRefresher() error = %v", err)
+	}
+
+	targetURL, _ := url.Parse("https://api.example.com")
+	server := &Server{config: cfg, targetURL: targetURL, refresher: refresher}
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/v1/chat/completions", nil)
+	server.addAuthHeader(req)
+
+	if got := req.Header.Get("Authorization"); got != "Bearer fresh-access-token" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer fresh-access-token")
+	}
+
+	updated, err := auth.LoadTokens(tokenPath)
+	if err != nil {
+		t.Fatalf("Failed to load tokens: %v", err)
+	}
+	if updated.RefreshToken != "valid-refresh-token" {
+		t.Errorf("RefreshToken = %q, want the original to be kept", updated.RefreshToken)
+	}
+	if d := time.Until(updated.ExpiresAt); d < 29*time.Minute || d > 31*time.Minute {
+		t.Errorf("ExpiresAt in %v, want ~30m from expires_in", d)
+	}
+}
+
 func TestAddAuthHeader_ExpiredToken_RefresherFails(t *testing.T) {
 	// When the refresher fails, the expired token should still be used
 	// (so the request goes through and fails at the API level, not silently).
@@ -0,0 +1,35 @@
+// Package proxy provides the Windows service mode of the proxy. A forked
+// daemon dies with the console on Windows, so there the proxy can instead be
+// installed as a service that start, stop, and status go through.
+package proxy
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// ServiceName is the name 'proxy install-service' registers the proxy under,
+// with the service manager and as an event log source.
+const ServiceName = "OpencodeAuthProxy"
+
+// ErrServiceUnsupported is returned by the service functions on systems other
+// than Windows.
+var ErrServiceUnsupported = errors.New("the proxy service is only available on Windows")
+
+// serviceArgs returns the arguments the service runs the binary with. The
+// service doesn't run in the user's session, so the home directory holding
+// ~/.opencode is passed along, as are the state directory and a port set on
+// the command line.
+func serviceArgs(cfg *config.Config, home string) []string {
+	args := []string{"proxy", "run-service", "--home", home}
+	if dir := os.Getenv(config.StateDirEnv); dir != "" {
+		args = append(args, "--state-dir", dir)
+	}
+	if cfg.ProxyPort > 0 {
+		args = append(args, "--proxy-port", strconv.Itoa(cfg.ProxyPort))
+	}
+	return args
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package proxy
+
+import "github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+
+// InstallService is only available on Windows.
+func InstallService(cfg *config.Config) error {
+	return ErrServiceUnsupported
+}
+
+// UninstallService is only available on Windows.
+func UninstallService() error {
+	return ErrServiceUnsupported
+}
+
+// RunService is only available on Windows.
+func RunService(cfg *config.Config, newServer func() (*Server, error)) error {
+	return ErrServiceUnsupported
+}
+
+// ServiceState always reports that no service is installed.
+func ServiceState() string {
+	return ""
+}
+
+func startService() (bool, error) {
+	return false, nil
+}
+
+func stopService() (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestServiceArgs(t *testing.T) {
+	home := `C:\Users\dev`
+	if got, want := serviceArgs(&config.Config{}, home), []string{"proxy", "run-service", "--home", home}; !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceArgs() = %v, want %v", got, want)
+	}
+	got := serviceArgs(&config.Config{ProxyPort: 18181}, home)
+	if want := []string{"proxy", "run-service", "--home", home, "--proxy-port", "18181"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceArgs() with port = %v, want %v", got, want)
+	}
+	t.Setenv(config.StateDirEnv, `D:\opencode-state`)
+	got = serviceArgs(&config.Config{}, home)
+	if want := []string{"proxy", "run-service", "--home", home, "--state-dir", `D:\opencode-state`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceArgs() with a state directory = %v, want %v", got, want)
+	}
+}
+
+func TestService_Unsupported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("services are supported on Windows")
+	}
+	if err := InstallService(&config.Config{}); err != ErrServiceUnsupported {
+		t.Errorf("InstallService() = %v, want ErrServiceUnsupported", err)
+	}
+	if state := ServiceState(); state != "" {
+		t.Errorf("ServiceState() = %q, want none", state)
+	}
+	// Start and stop fall back to the forked daemon
+	if ok, err := startService(); ok || err != nil {
+		t.Errorf("startService() = %v, %v", ok, err)
+	}
+}
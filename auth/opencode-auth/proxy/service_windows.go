@@ -0,0 +1,287 @@
+//go:build windows
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceSDDL is the default service DACL, plus start and stop rights for
+// interactive users so 'proxy start' and 'proxy stop' work without elevation.
+const serviceSDDL = "D:(A;;CCLCSWRPWPDTLOCRRC;;;SY)(A;;CCDCLCSWRPWPDTLOCRSDRCWDWO;;;BA)(A;;CCLCSWRPWPLOCRRC;;;IU)"
+
+// serviceStateTimeout bounds how long start and stop wait for the service.
+const serviceStateTimeout = 30 * time.Second
+
+// InstallService registers the proxy as an automatically started service and
+// as an event log source. It must be run as Administrator.
+func InstallService(cfg *config.Config) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager (run as Administrator): %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(ServiceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", ServiceName)
+	}
+
+	s, err := m.CreateService(ServiceName, exe, mgr.Config{
+		DisplayName: "OpenCode authentication proxy",
+		Description: "Adds credentials to opencode's API requests and refreshes tokens before they expire.",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs(cfg, home)...)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(ServiceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %w", err)
+	}
+	if err := allowUserControl(s); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: starting and stopping the service will need Administrator: %v\n", err)
+	}
+	// Restart after a crash, as the forked daemon is restarted by the next
+	// 'oc', and after a watchdog restart, which exits with an error
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 24*60*60); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to set service recovery actions: %v\n", err)
+	} else if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to set service recovery actions: %v\n", err)
+	}
+	return nil
+}
+
+// allowUserControl applies serviceSDDL to s.
+func allowUserControl(s *mgr.Service) error {
+	sd, err := windows.SecurityDescriptorFromString(serviceSDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetSecurityInfo(s.Handle, windows.SE_SERVICE, windows.DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
+
+// UninstallService stops the service if it is running and removes it and its
+// event log source. It must be run as Administrator.
+func UninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager (run as Administrator): %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(ServiceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", ServiceName)
+	}
+	defer s.Close()
+
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		if _, err := s.Control(svc.Stop); err == nil {
+			waitServiceState(s, svc.Stopped)
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("deleting service: %w", err)
+	}
+	if err := eventlog.Remove(ServiceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to remove event log source: %v\n", err)
+	}
+	return nil
+}
+
+// ServiceState returns the state of the installed service, such as "running"
+// or "stopped", or "" if it is not installed.
+func ServiceState() string {
+	s, err := openService(windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return ""
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return "unknown"
+	}
+	switch status.State {
+	case svc.Running:
+		return "running"
+	case svc.Stopped:
+		return "stopped"
+	case svc.StartPending:
+		return "starting"
+	case svc.StopPending:
+		return "stopping"
+	default:
+		return fmt.Sprintf("state %d", status.State)
+	}
+}
+
+// openService opens the installed service with only the access needed, so
+// unelevated users can use it. mgr.Connect asks for full access.
+func openService(access uint32) (*mgr.Service, error) {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseServiceHandle(m)
+	name, err := windows.UTF16PtrFromString(ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.OpenService(m, name, access)
+	if err != nil {
+		return nil, err
+	}
+	return &mgr.Service{Name: ServiceName, Handle: h}, nil
+}
+
+// startService starts the installed service and waits until it runs. It
+// reports false, with no error, when there is no service to start.
+func startService() (bool, error) {
+	s, err := openService(windows.SERVICE_START | windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return false, nil
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return true, fmt.Errorf("querying service %s: %w", ServiceName, err)
+	}
+	if status.State != svc.Running && status.State != svc.StartPending {
+		if err := s.Start(); err != nil {
+			return true, fmt.Errorf("starting service %s: %w", ServiceName, err)
+		}
+	}
+	return true, waitServiceState(s, svc.Running)
+}
+
+// stopService stops the installed service if it is running. It reports
+// false, with no error, when there is no running service.
+func stopService() (bool, error) {
+	s, err := openService(windows.SERVICE_STOP | windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return false, nil
+	}
+	defer s.Close()
+	if status, err := s.Query(); err != nil || status.State == svc.Stopped {
+		return false, nil
+	}
+	if _, err := s.Control(svc.Stop); err != nil {
+		return true, fmt.Errorf("stopping service %s: %w", ServiceName, err)
+	}
+	return true, waitServiceState(s, svc.Stopped)
+}
+
+// waitServiceState polls s until it reaches want or serviceStateTimeout
+// passes. A service that stops while starting has failed; its reason is in
+// the event log.
+func waitServiceState(s *mgr.Service, want svc.State) error {
+	deadline := time.Now().Add(serviceStateTimeout)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("querying service %s: %w", ServiceName, err)
+		}
+		if status.State == want {
+			return nil
+		}
+		if want == svc.Running && status.State == svc.Stopped {
+			return fmt.Errorf("service %s stopped while starting (exit code %d); see the Application event log", ServiceName, status.ServiceSpecificExitCode)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service %s", ServiceName)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// RunService runs the proxy under the service manager until it is told to
+// stop. newServer loads the config and creates the server. Starts, stops,
+// and failures go to the event log; everything the proxy prints goes to
+// proxy.log, as for the forked daemon.
+func RunService(cfg *config.Config, newServer func() (*Server, error)) error {
+	elog, err := eventlog.Open(ServiceName)
+	if err != nil {
+		return fmt.Errorf("opening event log: %w", err)
+	}
+	defer elog.Close()
+
+	if logFile, err := openDaemonLog(cfg); err == nil {
+		defer logFile.Close()
+		fmt.Fprintf(logFile, "\n=== proxy service starting at %s ===\n", time.Now().Format(time.RFC3339))
+		os.Stdout, os.Stderr = logFile, logFile
+		// Panics are written to the process's stderr handle, not os.Stderr
+		windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(logFile.Fd()))
+	} else {
+		elog.Warning(1, fmt.Sprintf("Proxy output will be discarded: %v", err))
+	}
+
+	return svc.Run(ServiceName, &serviceHandler{newServer: newServer, elog: elog, logPath: LogPath(cfg)})
+}
+
+type serviceHandler struct {
+	newServer func() (*Server, error)
+	elog      *eventlog.Log
+	logPath   string
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	server, err := h.newServer()
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		h.elog.Error(1, fmt.Sprintf("Proxy failed to start: %v", err))
+		return true, 1
+	}
+	h.elog.Info(1, fmt.Sprintf("Proxy started on port %d; log: %s", server.Port(), h.logPath))
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				return false, 0
+			}
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				if err := server.Stop(); err != nil {
+					h.elog.Warning(1, fmt.Sprintf("Proxy did not stop cleanly: %v", err))
+				}
+				h.elog.Info(1, "Proxy stopped")
+				return false, 0
+			}
+		case <-server.RestartRequested():
+			// Exit with an error so the recovery action starts a fresh process
+			status <- svc.Status{State: svc.StopPending}
+			server.Stop()
+			h.elog.Warning(1, fmt.Sprintf("Proxy exceeded its resource limits and is restarting; details in %s", h.logPath))
+			return true, 2
+		}
+	}
+}
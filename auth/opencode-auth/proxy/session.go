@@ -0,0 +1,188 @@
+// Package proxy provides the idle session lock: when session_idle_timeout is
+// set, a session with no proxied requests for that long is signed out and
+// the next request has to sign in again.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+)
+
+// sessionCheckInterval is how often the proxy checks for an idle session
+// between requests, so tokens don't outlive the idle window on disk.
+const sessionCheckInterval = time.Minute
+
+// SessionStatus is the "session" section of /health.
+type SessionStatus struct {
+	IdleTimeout  string    `json:"idle_timeout"`
+	LastActivity time.Time `json:"last_activity"`
+	LocksAt      time.Time `json:"locks_at,omitempty"`
+	LockedAt     time.Time `json:"locked_at,omitempty"`
+}
+
+// idleSession tracks the last proxied request. The zero value never locks.
+type idleSession struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	last     time.Time
+	lockedAt time.Time // zero while unlocked
+}
+
+// setTimeout changes the idle window and returns the previous one. A
+// session that has already been idle longer locks at the next check.
+func (i *idleSession) setTimeout(d time.Duration, now time.Time) time.Duration {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	prev := i.timeout
+	i.timeout = d
+	if prev <= 0 {
+		// Idle time before the policy was turned on doesn't count
+		i.last = now
+	}
+	return prev
+}
+
+// idle reports whether the session has just passed its idle window, and
+// marks it locked if so.
+func (i *idleSession) idle(now time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.timeout <= 0 || !i.lockedAt.IsZero() || now.Sub(i.last) < i.timeout {
+		return false
+	}
+	i.lockedAt = now
+	return true
+}
+
+// touch records a proxied request. signedIn reports whether tokens newer
+// than the lock exist, which unlocks the session. It returns when the session
+// will lock if no other request arrives, or locked if it is still locked.
+// unlocked is set on the request that unlocks it.
+func (i *idleSession) touch(now time.Time, signedIn func(since time.Time) bool) (locksAt time.Time, locked, unlocked bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.timeout <= 0 {
+		return time.Time{}, false, false
+	}
+	if !i.lockedAt.IsZero() {
+		if !signedIn(i.lockedAt) {
+			return time.Time{}, true, false
+		}
+		i.lockedAt = time.Time{}
+		unlocked = true
+	}
+	i.last = now
+	return now.Add(i.timeout), false, unlocked
+}
+
+// status returns the health section, or nil when the policy is off.
+func (i *idleSession) status() *SessionStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.timeout <= 0 {
+		return nil
+	}
+	st := &SessionStatus{IdleTimeout: i.timeout.String(), LastActivity: i.last, LockedAt: i.lockedAt}
+	if i.lockedAt.IsZero() {
+		st.LocksAt = i.last.Add(i.timeout)
+	}
+	return st
+}
+
+// watchSession locks an idle session between requests, until the server
+// stops.
+func (s *Server) watchSession() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkSession(time.Now())
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// checkSession signs the user out if the session has been idle too long.
+func (s *Server) checkSession(now time.Time) {
+	if s.session.idle(now) {
+		s.lockSession()
+	}
+}
+
+// lockSession deletes the tokens and drops the cached copy and the child
+// tokens, so neither the proxy, 'opencode-auth token', nor a helper tool can
+// use them until the user signs in again. The refresher is paused so it
+// doesn't open a sign-in on its own; the next request starts one.
+func (s *Server) lockSession() {
+	fmt.Fprintf(os.Stderr, "[proxy] SESSION: idle for %s, signing out\n", s.session.status().IdleTimeout)
+	if s.refresher != nil {
+		s.refresher.SetPaused(true)
+	}
+	if err := auth.DeleteTokens(s.config.TokenPath); err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] ERROR: failed to delete tokens: %v\n", err)
+	}
+	s.tokenSock.mu.Lock()
+	s.tokenSock.tokens = nil
+	s.tokenSock.mu.Unlock()
+	s.broker.revokeAll()
+	s.events.publish(Event{Type: EventSessionLocked, Message: "Signed out after " + s.session.status().IdleTimeout + " idle"})
+}
+
+// signedInSince reports whether the tokens were saved after t.
+func (s *Server) signedInSince(t time.Time) bool {
+	saved, err := auth.TokensModTime(s.config.TokenPath)
+	return err == nil && saved.After(t)
+}
+
+// checkSessionLock answers requests to a locked session with 401 and starts
+// sign-in. Other responses carry the time the session locks if idle. It
+// reports whether the request was answered.
+func (s *Server) checkSessionLock(w http.ResponseWriter, r *http.Request) bool {
+	// A static token has no sign-in to return to
+	if s.config.StaticAuth() {
+		return false
+	}
+	now := time.Now()
+	// A session can pass its idle window between watcher checks
+	s.checkSession(now)
+	locksAt, locked, unlocked := s.session.touch(now, s.signedInSince)
+	if unlocked {
+		fmt.Fprintf(os.Stderr, "[proxy] SESSION: signed in again, resuming token refresh\n")
+		if s.refresher != nil {
+			// Revoked access keeps it paused until a request succeeds
+			s.refresher.SetPaused(s.revocation.get() != nil)
+		}
+	}
+	if !locked {
+		if !locksAt.IsZero() {
+			w.Header().Set("X-Opencode-Session-Locks-At", locksAt.UTC().Format(time.RFC3339))
+		}
+		return false
+	}
+
+	if s.refresher != nil && !s.refresher.GetReauthInProgress() {
+		go s.refresher.TriggerReauth()
+	}
+	status := s.session.status()
+	msg := fmt.Sprintf("Your session was signed out at %s after %s without activity. Sign in in the browser window that just opened, or run 'opencode-auth login'.",
+		status.LockedAt.Local().Format(time.Kitchen), status.IdleTimeout)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Opencode-Session", "locked")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": msg,
+			"type":    "session_locked",
+			"code":    http.StatusUnauthorized,
+		},
+	})
+	return true
+}
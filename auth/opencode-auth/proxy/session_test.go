@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestSessionIdleLock(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "proxy-token", RefreshToken: "rt", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, NoPeerCheck: true, SessionIdleTimeout: time.Hour}
+
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.refresher, _ = NewRefresher(cfg)
+	// Keep the locked request from opening a browser
+	server.refresher.reauthInProgress = true
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	get := func() *http.Response {
+		t.Helper()
+		resp, err := http.Get(front.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Opencode-Session-Locks-At") == "" {
+		t.Fatalf("active session: status %d, locks-at %q", resp.StatusCode, resp.Header.Get("X-Opencode-Session-Locks-At"))
+	}
+
+	idleFor := func(d time.Duration) {
+		server.session.mu.Lock()
+		server.session.last = time.Now().Add(-d)
+		server.session.mu.Unlock()
+		server.checkSession(time.Now())
+	}
+
+	// Not idle long enough yet
+	idleFor(59 * time.Minute)
+	if _, err := os.Stat(tokenPath); err != nil {
+		t.Fatalf("tokens removed before the idle window passed: %v", err)
+	}
+
+	// Idle past the window: tokens are gone and requests are refused
+	idleFor(61 * time.Minute)
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Errorf("tokens still on disk after idle lock: %v", err)
+	}
+	if tokens := server.tokenSock.current(tokenPath); tokens != nil {
+		t.Error("token socket still serves a token after idle lock")
+	}
+	if !server.refresher.paused {
+		t.Error("refresher not paused while the session is locked")
+	}
+
+	resp, err = http.Get(front.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || body.Error.Type != "session_locked" {
+		t.Errorf("locked session: status %d, error type %q", resp.StatusCode, body.Error.Type)
+	}
+	if st := server.session.status(); st == nil || st.LockedAt.IsZero() {
+		t.Errorf("health session = %+v", st)
+	}
+
+	// Signing in again unlocks the session
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "new-token", ExpiresAt: time.Now().Add(time.Hour)})
+	if resp := get(); resp.StatusCode != http.StatusOK {
+		t.Errorf("after sign-in: status %d", resp.StatusCode)
+	}
+	if server.refresher.paused {
+		t.Error("refresher still paused after sign-in")
+	}
+}
+
+func TestSessionIdleLock_Disabled(t *testing.T) {
+	var s idleSession
+	if s.idle(time.Now().Add(1000*time.Hour)) || s.status() != nil {
+		t.Error("zero idleSession locked")
+	}
+
+	// Turning the policy on starts the idle window from now
+	start := time.Now()
+	s.setTimeout(time.Hour, start)
+	if s.idle(start.Add(30 * time.Minute)) {
+		t.Error("locked inside the idle window")
+	}
+	if !s.idle(start.Add(2 * time.Hour)) {
+		t.Error("did not lock after the idle window")
+	}
+}
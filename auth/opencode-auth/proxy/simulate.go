@@ -0,0 +1,112 @@
+// Package proxy provides simulated token expiry, so the refresh and re-auth
+// pipeline can be watched live without editing the token file.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+)
+
+// ExpirySimulation makes the refresher treat the token as expiring at
+// ExpiresAt (if that is earlier than the real expiry) until a refresh or
+// re-authentication succeeds.
+type ExpirySimulation struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	// FailRefresh makes the next refresh fail with invalid_grant, which
+	// starts browser re-authentication
+	FailRefresh bool `json:"fail_refresh,omitempty"`
+}
+
+// SimulateExpiryRequest is the body of POST /api/admin/simulate-expiry.
+type SimulateExpiryRequest struct {
+	In          string `json:"in"` // duration, e.g. "2m"
+	FailRefresh bool   `json:"fail_refresh,omitempty"`
+}
+
+// SimulateExpiry starts a simulation and runs a check right away, so the
+// refresh starts without waiting for the next tick when in is within the
+// refresh threshold.
+func (r *Refresher) SimulateExpiry(in time.Duration, failRefresh bool) ExpirySimulation {
+	sim := ExpirySimulation{ExpiresAt: r.clock.Now().Add(in), FailRefresh: failRefresh}
+	r.mu.Lock()
+	r.simulation = &sim
+	r.mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "[proxy] SIMULATION: treating token as expiring at %s (in %v), fail refresh: %v\n",
+		sim.ExpiresAt.Format(time.RFC3339), in, failRefresh)
+	go r.checkAndRefresh()
+	return sim
+}
+
+// EndSimulation stops a running simulation. It reports whether one was
+// running.
+func (r *Refresher) EndSimulation(reason string) bool {
+	r.mu.Lock()
+	running := r.simulation != nil
+	r.simulation = nil
+	r.mu.Unlock()
+
+	if running {
+		fmt.Fprintf(os.Stderr, "[proxy] SIMULATION: ended (%s)\n", reason)
+	}
+	return running
+}
+
+// Simulation returns the running simulation, or nil.
+func (r *Refresher) Simulation() *ExpirySimulation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.simulation == nil {
+		return nil
+	}
+	sim := *r.simulation
+	return &sim
+}
+
+// simulatedFailure returns the refresh error to simulate, if any.
+func (r *Refresher) simulatedFailure() error {
+	if sim := r.Simulation(); sim != nil && sim.FailRefresh {
+		return fmt.Errorf("%w: invalid_grant: refresh token expired (simulated by 'proxy simulate-expiry --fail-refresh')", auth.ErrRefreshTokenInvalid)
+	}
+	return nil
+}
+
+// handleSimulateExpiry starts (POST) or ends (DELETE) a simulated expiry.
+// It needs the admin token: a simulated failure starts browser
+// re-authentication, which no other local process should be able to trigger.
+func (s *Server) handleSimulateExpiry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.refresher == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "refresher not running"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req SimulateExpiryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+		in, err := time.ParseDuration(req.In)
+		if err != nil || in < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid duration %q", req.In)})
+			return
+		}
+		json.NewEncoder(w).Encode(s.refresher.SimulateExpiry(in, req.FailRefresh))
+	case http.MethodDelete:
+		json.NewEncoder(w).Encode(map[string]bool{"ended": s.refresher.EndSimulation("cancelled")})
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestSimulateExpiry(t *testing.T) {
+	mockTokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token":     "refreshed-id-token",
+			"access_token": "refreshed-access-token",
+			"expires_in":   3600,
+		})
+	}))
+	defer mockTokenEndpoint.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	tokens := &auth.TokenData{IDToken: "old-id-token", RefreshToken: "rt", ExpiresAt: time.Now().Add(time.Hour)}
+	auth.SaveTokens(tokenPath, tokens)
+
+	refresher, _ := NewRefresher(&config.Config{
+		ConfigDir:     tempDir,
+		TokenPath:     tokenPath,
+		ClientID:      "test-client-id",
+		TokenEndpoint: mockTokenEndpoint.URL,
+	})
+	s := &Server{refresher: refresher}
+	call := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleSimulateExpiry(rec, httptest.NewRequest(method, "/api/admin/simulate-expiry", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := call("POST", `{"in":"soon"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid duration: status %d, want 400", rec.Code)
+	}
+
+	// A simulated expiry only ever moves the expiry earlier
+	refresher.mu.Lock()
+	refresher.simulation = &ExpirySimulation{ExpiresAt: time.Now().Add(2 * time.Hour)}
+	refresher.mu.Unlock()
+	if refresher.expiringWithin(tokens, 30*time.Minute) {
+		t.Error("a later simulated expiry made the token expire sooner")
+	}
+	if rec := call("DELETE", ""); !strings.Contains(rec.Body.String(), `"ended":true`) {
+		t.Errorf("DELETE = %s, want ended", rec.Body.String())
+	}
+
+	// Simulating expiry within the refresh threshold refreshes right away and
+	// ends the simulation
+	if rec := call("POST", `{"in":"2m"}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST: status %d: %s", rec.Code, rec.Body.String())
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if refresher.Simulation() == nil {
+			break
+		}
+	}
+	if sim := refresher.Simulation(); sim != nil {
+		t.Fatalf("simulation still running: %+v", sim)
+	}
+	if saved, _ := auth.LoadTokens(tokenPath); saved == nil || saved.IDToken != "refreshed-id-token" {
+		t.Errorf("token not refreshed: %+v", saved)
+	}
+
+	// --fail-refresh turns the refresh into a permanent failure
+	refresher.mu.Lock()
+	refresher.simulation = &ExpirySimulation{ExpiresAt: time.Now(), FailRefresh: true}
+	refresher.mu.Unlock()
+	if err := refresher.simulatedFailure(); err == nil || !isPermanentRefreshError(err) {
+		t.Errorf("simulatedFailure() = %v, want a permanent refresh error", err)
+	}
+}
@@ -0,0 +1,283 @@
+// Package proxy provides the startup handshake of a background proxy. The
+// process that starts it waits until the proxy reports that it is serving,
+// or why it could not start, instead of sleeping and hoping proxy.json
+// exists. On Unix the proxy reports over a pipe; Windows can't pass one, so
+// there the parent polls /health. Either way it notices a proxy that exits
+// early and gives up after startupTimeout.
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// readyFDEnv passes the write end of the readiness pipe to a background
+	// proxy. ExtraFiles start at descriptor 3.
+	readyFDEnv = "OPENCODE_PROXY_READY_FD"
+
+	// startupTimeout bounds how long StartProxy waits for the proxy to
+	// report, covering a slow disk or OIDC discovery
+	startupTimeout = 15 * time.Second
+
+	// startupPollInterval is how often StartProxy checks /health where
+	// there is no readiness pipe
+	startupPollInterval = 100 * time.Millisecond
+
+	// logTailSize is how much of proxy.log is searched for the last error
+	// of a proxy that exited
+	logTailSize = 4096
+)
+
+// Kinds of StartupError.
+const (
+	StartupPortInUse      = "port_in_use"
+	StartupAlreadyRunning = "already_running"
+	StartupConfigInvalid  = "config_invalid"
+	StartupFailed         = "failed"
+	StartupExited         = "exited"
+	StartupTimeout        = "timeout"
+)
+
+var (
+	// ErrPortInUse means the proxy port is taken by another process.
+	ErrPortInUse = errors.New("port in use")
+	// ErrAlreadyRunning means another proxy is serving this config directory.
+	ErrAlreadyRunning = errors.New("proxy already running")
+	// ErrConfigInvalid means the proxy could not load its configuration.
+	ErrConfigInvalid = errors.New("invalid proxy configuration")
+)
+
+// StartupError is why a background proxy did not start. errors.Is matches
+// ErrPortInUse, ErrAlreadyRunning, and ErrConfigInvalid for those kinds.
+type StartupError struct {
+	Kind    string
+	Message string
+	// Log is the proxy log, which has the details
+	Log string
+}
+
+func (e *StartupError) Error() string {
+	msg := "proxy did not start: " + e.Message
+	if e.Log != "" {
+		msg += " (see " + e.Log + ")"
+	}
+	return msg
+}
+
+func (e *StartupError) Unwrap() error {
+	switch e.Kind {
+	case StartupPortInUse:
+		return ErrPortInUse
+	case StartupAlreadyRunning:
+		return ErrAlreadyRunning
+	case StartupConfigInvalid:
+		return ErrConfigInvalid
+	}
+	return nil
+}
+
+// startupReport is written to the readiness pipe, once.
+type startupReport struct {
+	Ready bool   `json:"ready"`
+	Kind  string `json:"kind,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var reportOnce sync.Once
+
+// ReportStartup tells the process that started this background proxy that
+// it is serving (err == nil) or why it failed. Only the first call counts,
+// and it does nothing in a proxy that was not started by StartProxy.
+func ReportStartup(err error) {
+	reportOnce.Do(func() {
+		fd := os.Getenv(readyFDEnv)
+		if fd == "" {
+			return
+		}
+		// A proxy this one starts later gets its own pipe, if any
+		os.Unsetenv(readyFDEnv)
+		n, convErr := strconv.Atoi(fd)
+		if convErr != nil {
+			return
+		}
+		f := os.NewFile(uintptr(n), "proxy-ready")
+		defer f.Close()
+
+		report := startupReport{Ready: err == nil}
+		if err != nil {
+			report.Kind, report.Error = startupKind(err), err.Error()
+		}
+		json.NewEncoder(f).Encode(report)
+	})
+}
+
+// startupKind classifies a startup failure for StartupError.
+func startupKind(err error) string {
+	switch {
+	case errors.Is(err, ErrPortInUse):
+		return StartupPortInUse
+	case errors.Is(err, ErrAlreadyRunning):
+		return StartupAlreadyRunning
+	case errors.Is(err, ErrConfigInvalid):
+		return StartupConfigInvalid
+	}
+	return StartupFailed
+}
+
+// readyPipe returns a pipe for the proxy to report on, or nils where
+// descriptors can't be passed to a child.
+func readyPipe() (r, w *os.File) {
+	if runtime.GOOS == "windows" {
+		return nil, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil
+	}
+	return r, w
+}
+
+// waitStartup waits for the proxy started as cmd to report through ready,
+// or, without a pipe, to answer /health as the process recorded in
+// proxy.json. The child is reaped in the background whatever the outcome,
+// so a daemon that crashes later doesn't linger as a zombie.
+func waitStartup(cfg *config.Config, cmd *exec.Cmd, ready *os.File) (*ProxyConfig, error) {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Closed without a report when the proxy exits before reporting
+	var reports chan startupReport
+	if ready != nil {
+		reports = make(chan startupReport, 1)
+		go func() {
+			defer close(reports)
+			defer ready.Close()
+			var report startupReport
+			if json.NewDecoder(ready).Decode(&report) == nil {
+				reports <- report
+			}
+		}()
+	}
+	var poll <-chan time.Time
+	if ready == nil {
+		ticker := time.NewTicker(startupPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	deadline := time.NewTimer(startupTimeout)
+	defer deadline.Stop()
+
+	pid := cmd.Process.Pid
+	for {
+		select {
+		case report, ok := <-reports:
+			if !ok {
+				// The proxy exited; exited says how
+				reports = nil
+				continue
+			}
+			return startupResult(cfg, report)
+		case err := <-exited:
+			// A report written just before exiting is still in the pipe
+			if reports != nil {
+				if report, ok := <-reports; ok {
+					return startupResult(cfg, report)
+				}
+			}
+			return nil, exitedError(cfg, err)
+		case <-poll:
+			if serving(cfg, pid) {
+				return LoadProxyConfig(cfg)
+			}
+		case <-deadline.C:
+			cmd.Process.Kill()
+			return nil, &StartupError{
+				Kind:    StartupTimeout,
+				Message: fmt.Sprintf("not ready after %s", startupTimeout),
+				Log:     LogPath(cfg),
+			}
+		}
+	}
+}
+
+// startupResult turns the proxy's report into StartProxy's result. A proxy
+// that lost a race with another one returns that one.
+func startupResult(cfg *config.Config, report startupReport) (*ProxyConfig, error) {
+	if report.Ready {
+		return LoadProxyConfig(cfg)
+	}
+	if report.Kind == StartupAlreadyRunning {
+		if existing, err := LoadProxyConfig(cfg); err == nil && IsProcessRunning(existing.PID) {
+			return existing, nil
+		}
+	}
+	return nil, &StartupError{Kind: report.Kind, Message: report.Error, Log: LogPath(cfg)}
+}
+
+// exitedError describes a proxy that exited before it was ready, with the
+// last error it logged.
+func exitedError(cfg *config.Config, err error) *StartupError {
+	msg := "exited"
+	if err != nil {
+		msg = err.Error()
+	}
+	if line := lastLogError(LogPath(cfg)); line != "" {
+		msg += ": " + line
+	}
+	return &StartupError{Kind: StartupExited, Message: msg, Log: LogPath(cfg)}
+}
+
+// lastLogError returns the last line starting with "Error:", as cobra
+// prints a failed command, that the latest daemon wrote near the end of the
+// log.
+func lastLogError(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > logTailSize {
+		f.Seek(-logTailSize, io.SeekEnd)
+	}
+	tail, _ := io.ReadAll(f)
+	if i := bytes.LastIndex(tail, []byte(daemonLogMarker)); i >= 0 {
+		tail = tail[i:]
+	}
+	lines := bytes.Split(tail, []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(string(lines[i])); strings.HasPrefix(line, "Error:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Error:"))
+		}
+	}
+	return ""
+}
+
+// serving reports whether the proxy with pid has written proxy.json and
+// answers /health.
+func serving(cfg *config.Config, pid int) bool {
+	current, err := LoadProxyConfig(cfg)
+	if err != nil || current.PID != pid {
+		return false
+	}
+	client := &http.Client{Timeout: portCheckTimeout}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/health", current.Port))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
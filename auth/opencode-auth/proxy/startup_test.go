@@ -0,0 +1,87 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// TestStartupChild stands in for a background proxy when run by
+// TestWaitStartup.
+func TestStartupChild(t *testing.T) {
+	switch os.Getenv("STARTUP_CHILD") {
+	case "":
+		t.Skip("run by TestWaitStartup")
+	case "ready":
+		SaveProxyConfig(&config.Config{ConfigDir: os.Getenv("STARTUP_DIR")}, &ProxyConfig{Port: 18080, PID: os.Getpid()})
+		ReportStartup(nil)
+	case "port":
+		ReportStartup(fmt.Errorf("%w: port 18080 is not available", ErrPortInUse))
+		os.Exit(1)
+	case "crash":
+		fmt.Fprintln(os.Stderr, "Error: failed to create proxy server: boom")
+		os.Exit(1)
+	}
+}
+
+func TestWaitStartup(t *testing.T) {
+	start := func(t *testing.T, mode string) (*config.Config, *ProxyConfig, error) {
+		t.Helper()
+		cfg := &config.Config{ConfigDir: t.TempDir()}
+		log, err := openDaemonLog(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer log.Close()
+		fmt.Fprintf(log, "Error: from an earlier daemon\n%s at now ===\n", daemonLogMarker)
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStartupChild$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "STARTUP_CHILD="+mode, "STARTUP_DIR="+cfg.ConfigDir, readyFDEnv+"=3")
+		cmd.Stdout, cmd.Stderr = log, log
+		ready, readyW := readyPipe()
+		cmd.ExtraFiles = []*os.File{readyW}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		readyW.Close()
+		pc, err := waitStartup(cfg, cmd, ready)
+		return cfg, pc, err
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		_, pc, err := start(t, "ready")
+		if err != nil || pc == nil || pc.Port != 18080 {
+			t.Fatalf("waitStartup = %+v, %v", pc, err)
+		}
+	})
+
+	t.Run("port in use", func(t *testing.T) {
+		cfg, _, err := start(t, "port")
+		var serr *StartupError
+		if !errors.As(err, &serr) || serr.Kind != StartupPortInUse || !errors.Is(err, ErrPortInUse) {
+			t.Fatalf("waitStartup error = %v, want %s", err, StartupPortInUse)
+		}
+		if serr.Log != filepath.Join(cfg.ConfigDir, proxyLogFile) {
+			t.Errorf("Log = %q", serr.Log)
+		}
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		_, _, err := start(t, "crash")
+		var serr *StartupError
+		if !errors.As(err, &serr) || serr.Kind != StartupExited {
+			t.Fatalf("waitStartup error = %v, want %s", err, StartupExited)
+		}
+		if !strings.Contains(serr.Message, "failed to create proxy server: boom") || strings.Contains(serr.Message, "earlier") {
+			t.Errorf("Message = %q, want the latest daemon's error", serr.Message)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+// Package proxy provides static credentials mode (auth_mode "static"), for
+// pilots against a router that takes fixed bearer tokens and has no IdP.
+// The proxy sends the configured token on every request; there is no
+// tokens.json, refresher, or re-authentication.
+package proxy
+
+import "net/http"
+
+// StaticAuthStatus is the "static_auth" section of /health.
+type StaticAuthStatus struct {
+	TokenPrefix string `json:"token_prefix"`
+}
+
+// StaticTokenPrefix returns the start of a static token, enough to tell
+// tokens apart without revealing them.
+func StaticTokenPrefix(token string) string {
+	if len(token) < 16 {
+		return "***"
+	}
+	return token[:6] + "..."
+}
+
+// setStaticAuthHeader sets the static token on req, in the route's auth
+// header if proxy_auth_headers configures one.
+func (s *Server) setStaticAuthHeader(req *http.Request) {
+	token := s.config.StaticToken
+	if !s.setRouteAuthHeader(req, AuthHeaderData{Token: token}) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
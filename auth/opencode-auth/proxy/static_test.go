@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestStaticAuth(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	// No tokens.json: static mode never reads it
+	tempDir := t.TempDir()
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: filepath.Join(tempDir, "tokens.json"), APIEndpoint: backend.URL,
+		AuthMode: config.AuthModeStatic, StaticToken: "poc-static-token-0123456789"}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer smuggled")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || got.Get("Authorization") != "Bearer poc-static-token-0123456789" {
+		t.Errorf("status %d, Authorization = %q", resp.StatusCode, got.Get("Authorization"))
+	}
+
+	if status := server.tokenStatus(); !status.Valid || status.AuthMode != config.AuthModeStatic || status.NeedsReauth {
+		t.Errorf("tokenStatus() = %+v", status)
+	}
+	if r := server.ensure(); r.Status != "ok" {
+		t.Errorf("ensure() = %+v", r)
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		StaticAuth *StaticAuthStatus `json:"static_auth"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil || health.StaticAuth == nil || health.StaticAuth.TokenPrefix != "poc-st..." {
+		t.Errorf("health static_auth = %+v, %v: %s", health.StaticAuth, err, rec.Body)
+	}
+}
+
+func TestStaticTokenPrefix(t *testing.T) {
+	for token, want := range map[string]string{"short": "***", "0123456789abcdef": "012345..."} {
+		if got := StaticTokenPrefix(token); got != want {
+			t.Errorf("StaticTokenPrefix(%q) = %q, want %q", token, got, want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Package proxy provides step-up authentication (RFC 9470) for paths the
+// router protects with a stronger sign-in, such as admin endpoints. When the
+// router answers 401 insufficient_authentication, the proxy runs a browser
+// sign-in with the acr_values it asked for and retries the request with the
+// resulting token. The elevated token is kept in memory, apart from the
+// regular one, is only sent on retries of challenged requests, and is
+// dropped after proxy_step_up_ttl.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+)
+
+// DefaultStepUpTTL is how long an elevated token is used when the config
+// sets no proxy_step_up_ttl.
+const DefaultStepUpTTL = 10 * time.Minute
+
+// Error codes that ask for a step-up sign-in: the router's, and RFC 9470's
+// WWW-Authenticate error.
+const (
+	stepUpCode    = "insufficient_authentication"
+	stepUpRFCCode = "insufficient_user_authentication"
+)
+
+// StepUpStatus is one entry of the "step_up" section of /health.
+type StepUpStatus struct {
+	ACRValues string    `json:"acr_values,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	AuthTime  time.Time `json:"auth_time"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// stepUpChallenge is the authentication the router asked for.
+type stepUpChallenge struct {
+	acrValues string
+	maxAge    time.Duration // 0 if any sign-in age will do
+}
+
+// elevatedToken is a token from a step-up sign-in.
+type elevatedToken struct {
+	StepUpStatus
+	bearer string
+}
+
+// stepUp holds elevated tokens by acr_values.
+type stepUp struct {
+	mu     sync.Mutex
+	tokens map[string]*elevatedToken
+	login  sync.Mutex // one step-up sign-in at a time
+	now    func() time.Time
+}
+
+func (s *stepUp) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// get returns an elevated token that satisfies ch, if one is held.
+func (s *stepUp) get(ch stepUpChallenge) *elevatedToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tokens[ch.acrValues]
+	now := s.clock()
+	if t == nil || !now.Add(30*time.Second).Before(t.ExpiresAt) {
+		return nil
+	}
+	if ch.maxAge > 0 && now.Sub(t.AuthTime) > ch.maxAge {
+		return nil
+	}
+	return t
+}
+
+func (s *stepUp) put(t *elevatedToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = make(map[string]*elevatedToken)
+	}
+	s.tokens[t.ACRValues] = t
+}
+
+// drop forgets the token for acrValues, e.g. after the router refused it.
+func (s *stepUp) drop(acrValues string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, acrValues)
+}
+
+// status returns the elevated tokens still valid, or nil if none.
+func (s *stepUp) status() []StepUpStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []StepUpStatus
+	now := s.clock()
+	for _, t := range s.tokens {
+		if now.Before(t.ExpiresAt) {
+			out = append(out, t.StepUpStatus)
+		}
+	}
+	return out
+}
+
+// parseStepUp reports whether resp, a 401, asks for a step-up sign-in, and
+// what for. It looks at WWW-Authenticate, then at the router's JSON error;
+// resp.Body stays readable.
+func parseStepUp(resp *http.Response) (stepUpChallenge, bool) {
+	for _, v := range resp.Header.Values("WWW-Authenticate") {
+		params := authParams(v)
+		if code := params["error"]; code == stepUpRFCCode || code == stepUpCode {
+			ch := stepUpChallenge{acrValues: params["acr_values"]}
+			if secs, err := strconv.Atoi(params["max_age"]); err == nil && secs > 0 {
+				ch.maxAge = time.Duration(secs) * time.Second
+			}
+			return ch, true
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil {
+		return stepUpChallenge{}, false
+	}
+	var errResp struct {
+		Error struct {
+			Code      string `json:"code"`
+			ACRValues string `json:"acr_values"`
+			MaxAge    int    `json:"max_age"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) != nil {
+		return stepUpChallenge{}, false
+	}
+	if code := errResp.Error.Code; code != stepUpCode && code != stepUpRFCCode {
+		return stepUpChallenge{}, false
+	}
+	return stepUpChallenge{acrValues: errResp.Error.ACRValues, maxAge: time.Duration(errResp.Error.MaxAge) * time.Second}, true
+}
+
+// authParams parses the auth-params of a Bearer challenge, e.g.
+// `Bearer error="insufficient_user_authentication", acr_values="mfa"`.
+func authParams(challenge string) map[string]string {
+	params := map[string]string{}
+	if i := strings.IndexByte(challenge, ' '); i >= 0 && !strings.Contains(challenge[:i], "=") {
+		challenge = challenge[i+1:]
+	}
+	for challenge != "" {
+		challenge = strings.TrimLeft(challenge, " ,")
+		eq := strings.IndexByte(challenge, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(challenge[:eq]))
+		rest := challenge[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			val, challenge = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			val, challenge = strings.TrimSpace(rest[:comma]), rest[comma+1:]
+		} else {
+			val, challenge = strings.TrimSpace(rest), ""
+		}
+		params[key] = val
+	}
+	return params
+}
+
+// elevated returns a copy of req carrying an elevated token for ch, signing
+// in again if no held token satisfies it. It returns nil if the step-up
+// sign-in failed or no refresher is running.
+func (s *Server) elevated(req *http.Request, ch stepUpChallenge) *http.Request {
+	t := s.stepUp.get(ch)
+	if t == nil {
+		if s.refresher == nil {
+			return nil
+		}
+		s.stepUp.login.Lock()
+		if t = s.stepUp.get(ch); t == nil {
+			tokens, err := s.refresher.StepUp(req.Context(), ch.acrValues, ch.maxAge)
+			if err != nil {
+				s.stepUp.login.Unlock()
+				fmt.Fprintf(os.Stderr, "[proxy] Step-up sign-in failed: %v\n", err)
+				return nil
+			}
+			ttl := s.config.StepUpTTL
+			if ttl <= 0 {
+				ttl = DefaultStepUpTTL
+			}
+			now := s.stepUp.clock()
+			t = &elevatedToken{
+				StepUpStatus: StepUpStatus{ACRValues: ch.acrValues, Email: tokens.Email, AuthTime: now, ExpiresAt: now.Add(ttl)},
+				bearer:       tokens.BearerToken(),
+			}
+			if tokens.ExpiresAt.Before(t.ExpiresAt) {
+				t.ExpiresAt = tokens.ExpiresAt
+			}
+			s.stepUp.put(t)
+			fmt.Fprintf(os.Stderr, "[proxy] Step-up sign-in complete; elevated token valid until %s\n", t.ExpiresAt.Local().Format(time.Kitchen))
+		}
+		s.stepUp.login.Unlock()
+	}
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", "Bearer "+t.bearer)
+	return retry
+}
+
+// StepUp runs a browser sign-in asking the IdP for acrValues, and a login no
+// older than maxAge if set, and returns the tokens without saving them. The
+// regular tokens are left alone.
+func (r *Refresher) StepUp(ctx context.Context, acrValues string, maxAge time.Duration) (*auth.TokenData, error) {
+	pkce, err := auth.GeneratePKCE()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PKCE: %w", err)
+	}
+	state, err := auth.GenerateState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate state: %w", err)
+	}
+	callbackServer, err := auth.NewCallbackServer(r.config, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start callback server: %w", err)
+	}
+	callbackServer.Start()
+	defer callbackServer.Shutdown(context.Background())
+
+	message := "A stronger sign-in is required for this request; complete it in the browser"
+	fmt.Fprintf(os.Stderr, "[proxy] %s (acr_values %q)\n", message, acrValues)
+	r.events.publish(Event{Type: EventStepUpRequired, Reason: acrValues, Message: message})
+	authURL := auth.StepUpAuthURL(r.config, callbackServer.RedirectURI(), pkce, state, acrValues, maxAge)
+	if err := auth.OpenBrowser(authURL); err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Please open this URL manually:\n%s\n\n", authURL)
+	}
+
+	result, err := callbackServer.WaitForCallback(ctx, ReauthTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	tokenResp, err := auth.ExchangeCodeForTokens(ctx, r.config, result.Code, callbackServer.RedirectURI(), pkce)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", auth.ErrTokenExchange, err)
+	}
+	tokens := &auth.TokenData{
+		IDToken:     tokenResp.IDToken,
+		AccessToken: tokenResp.AccessToken,
+		ExpiresAt:   tokenResp.ExpiresAt(r.clock.Now()),
+		Email:       tokenResp.Email(),
+	}
+	if err := auth.VerifyAccount(r.config, tokens.Email); err != nil {
+		return nil, err
+	}
+	if tokens.BearerToken() == "" {
+		return nil, errors.New("the step-up sign-in returned no token")
+	}
+	return tokens, nil
+}
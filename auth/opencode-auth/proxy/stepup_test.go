@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestParseStepUp(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		body   string
+		want   stepUpChallenge
+		ok     bool
+	}{
+		{"rfc 9470", `Bearer error="insufficient_user_authentication", error_description="A different authentication level is required", acr_values="mfa phr", max_age=300`, "", stepUpChallenge{"mfa phr", 5 * time.Minute}, true},
+		{"router", "", `{"error":{"message":"Step-up required","type":"auth_error","code":"insufficient_authentication","acr_values":"mfa"}}`, stepUpChallenge{acrValues: "mfa"}, true},
+		{"expired token", `Bearer error="invalid_token"`, `{"error":{"code":"token_expired"}}`, stepUpChallenge{}, false},
+		{"not json", "", "Unauthorized", stepUpChallenge{}, false},
+	} {
+		resp := &http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tc.body))}
+		if tc.header != "" {
+			resp.Header.Set("WWW-Authenticate", tc.header)
+		}
+		got, ok := parseStepUp(resp)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: parseStepUp = %+v, %v; want %+v, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != tc.body {
+			t.Errorf("%s: body after parseStepUp = %q", tc.name, body)
+		}
+	}
+}
+
+func TestStepUpRetry(t *testing.T) {
+	var accept string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/admin/users" && r.Header.Get("Authorization") != accept {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_user_authentication", acr_values="mfa"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := newServerInternal(&config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	// No elevated token and no refresher to sign in with
+	accept = "Bearer elevated"
+	if rec := get("/v1/admin/users"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without a step-up sign-in: %d, want 401", rec.Code)
+	}
+
+	s.stepUp.put(&elevatedToken{StepUpStatus: StepUpStatus{ACRValues: "mfa", AuthTime: time.Now(), ExpiresAt: time.Now().Add(DefaultStepUpTTL)}, bearer: "elevated"})
+	if rec := get("/v1/admin/users"); rec.Code != http.StatusOK || rec.Body.String() != "Bearer elevated" {
+		t.Errorf("challenged request = %d %q, want a retry with the elevated token", rec.Code, rec.Body.String())
+	}
+	if rec := get("/v1/models"); rec.Body.String() != "Bearer id-token" {
+		t.Errorf("other request sent %q, want the regular token", rec.Body.String())
+	}
+	if st := s.stepUp.status(); len(st) != 1 || st[0].ACRValues != "mfa" {
+		t.Errorf("step-up status = %+v", st)
+	}
+
+	// The router refuses the elevated token too: it is dropped
+	accept = "Bearer stronger"
+	if rec := get("/v1/admin/users"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refused elevated token: %d, want 401", rec.Code)
+	}
+	if s.stepUp.status() != nil {
+		t.Error("a refused elevated token was kept")
+	}
+}
@@ -0,0 +1,330 @@
+// Package proxy provides the stream tap: with request history on, the proxy
+// also keeps the most recent streaming (SSE) response it returned, so
+// 'opencode-auth proxy tap' can show where a stream stopped.
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// streamFile holds the captured stream inside the config directory
+	streamFile = "proxy-stream.sse"
+
+	// streamCaptureMax caps the captured body; later bytes are counted only
+	streamCaptureMax = 4 << 20
+
+	// The captured stream is valid SSE: the proxy's own lines are comments,
+	// which SSE clients ignore
+	streamStartMark = ": tap "
+	streamTimeMark  = ": +"
+	streamEndMark   = ": end "
+)
+
+// StreamInfo describes a captured stream. It is the first line of the file.
+type StreamInfo struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Model  string    `json:"model,omitempty"`
+	Status int       `json:"status"`
+}
+
+// StreamEnd is the last line of a stream the proxy finished returning. A
+// capture without one is still streaming, or was replaced by a newer one
+// before it ended.
+type StreamEnd struct {
+	DurationMS int64 `json:"duration_ms"`
+	Bytes      int64 `json:"bytes"`
+	// Truncated is set when the body outgrew the capture limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// StreamPath returns the captured stream file for cfg.
+func StreamPath(cfg *config.Config) string {
+	return filepath.Join(cfg.ConfigDir, streamFile)
+}
+
+// streamTap writes the newest streaming response to its file. A stream that
+// starts while another is running replaces it; the older one stops writing.
+type streamTap struct {
+	path string
+
+	mu  sync.Mutex
+	seq uint64
+	f   *os.File
+}
+
+// streamCapture is one response being written by a streamTap.
+type streamCapture struct {
+	tap       *streamTap
+	seq       uint64
+	start     time.Time
+	bytes     int64
+	written   int64
+	lineStart bool
+}
+
+// begin starts capturing a response described by info. It replaces the
+// file rather than truncating it, so 'proxy tap' can tell a new stream from
+// the old one it has open.
+func (t *streamTap) begin(info StreamInfo) *streamCapture {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+	t.seq++
+	c := &streamCapture{tap: t, seq: t.seq, start: time.Now(), lineStart: true}
+
+	os.Remove(t.path)
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: could not capture stream: %v\n", err)
+		return c
+	}
+	data, _ := json.Marshal(info)
+	f.WriteString(streamStartMark + string(data) + "\n")
+	t.f = f
+	return c
+}
+
+// write appends part of the response body, preceded by the time since the
+// headers when it starts a line.
+func (c *streamCapture) write(p []byte) {
+	t := c.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.bytes += int64(len(p))
+	if c.seq != t.seq || t.f == nil || len(p) == 0 || c.written >= streamCaptureMax {
+		return
+	}
+	if c.lineStart {
+		fmt.Fprintf(t.f, "%s%dms\n", streamTimeMark, time.Since(c.start).Milliseconds())
+	}
+	if room := streamCaptureMax - c.written; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, _ := t.f.Write(p)
+	c.written += int64(n)
+	c.lineStart = p[len(p)-1] == '\n'
+}
+
+// end marks the stream finished, unless a newer one replaced it.
+func (c *streamCapture) end() {
+	t := c.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.seq != t.seq || t.f == nil {
+		return
+	}
+	if !c.lineStart {
+		// A stream cut mid-line; the mark still needs a line of its own
+		t.f.WriteString("\n")
+	}
+	data, _ := json.Marshal(StreamEnd{
+		DurationMS: time.Since(c.start).Milliseconds(),
+		Bytes:      c.bytes,
+		Truncated:  c.bytes > c.written,
+	})
+	t.f.WriteString(streamEndMark + string(data) + "\n")
+	t.f.Close()
+	t.f = nil
+}
+
+// StreamEvent is one SSE event of a captured stream.
+type StreamEvent struct {
+	// At is when the event's first line reached the client, after the
+	// response headers
+	At    time.Duration
+	Event string // the "event:" field; empty for plain data events
+	Data  string
+}
+
+// StreamParser decodes a captured stream one line at a time, so it can
+// follow a stream that is still being written.
+type StreamParser struct {
+	Info *StreamInfo
+	End  *StreamEnd
+
+	at      time.Duration
+	pending *StreamEvent
+}
+
+// Line parses one line, without its line ending. It returns the event the
+// line completes, if any.
+func (p *StreamParser) Line(line string) *StreamEvent {
+	switch {
+	case strings.HasPrefix(line, streamStartMark):
+		var info StreamInfo
+		if json.Unmarshal([]byte(line[len(streamStartMark):]), &info) == nil {
+			p.Info = &info
+		}
+		return nil
+	case strings.HasPrefix(line, streamEndMark):
+		var end StreamEnd
+		if json.Unmarshal([]byte(line[len(streamEndMark):]), &end) == nil {
+			p.End = &end
+		}
+		return p.Flush()
+	case strings.HasPrefix(line, streamTimeMark):
+		var ms int64
+		if _, err := fmt.Sscanf(line[len(streamTimeMark):], "%dms", &ms); err == nil {
+			p.at = time.Duration(ms) * time.Millisecond
+		}
+		return nil
+	case line == "":
+		return p.Flush()
+	case strings.HasPrefix(line, ":"):
+		return nil // upstream comment, e.g. a keep-alive
+	}
+
+	field, value, _ := strings.Cut(line, ":")
+	value = strings.TrimPrefix(value, " ")
+	if p.pending == nil {
+		p.pending = &StreamEvent{At: p.at}
+	}
+	switch field {
+	case "event":
+		p.pending.Event = value
+	case "data":
+		if p.pending.Data != "" {
+			p.pending.Data += "\n"
+		}
+		p.pending.Data += value
+	}
+	return nil
+}
+
+// Flush returns an event whose blank line has not arrived, as when the
+// stream was cut partway through it.
+func (p *StreamParser) Flush() *StreamEvent {
+	ev := p.pending
+	p.pending = nil
+	return ev
+}
+
+// ParseStream reads a whole captured stream.
+func ParseStream(path string) (*StreamParser, []StreamEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	p := &StreamParser{}
+	var events []StreamEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), streamCaptureMax)
+	for scanner.Scan() {
+		if ev := p.Line(strings.TrimSuffix(scanner.Text(), "\r")); ev != nil {
+			events = append(events, *ev)
+		}
+	}
+	if ev := p.Flush(); ev != nil {
+		events = append(events, *ev)
+	}
+	return p, events, scanner.Err()
+}
+
+// StreamChunk is the part of an OpenAI chat completion chunk 'proxy tap'
+// shows.
+type StreamChunk struct {
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role             string `json:"role"`
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+	} `json:"error"`
+}
+
+// StreamSummary tallies a stream's events, to say how it ended.
+type StreamSummary struct {
+	Chunks       int
+	Content      int // characters of content
+	ToolCalls    int
+	FinishReason string
+	Usage        bool
+	Done         bool // the "data: [DONE]" event arrived
+	Errors       []string
+}
+
+// Add counts ev and returns its chunk, or nil when ev is [DONE] or not a
+// JSON chunk.
+func (s *StreamSummary) Add(ev StreamEvent) *StreamChunk {
+	if ev.Data == "[DONE]" {
+		s.Done = true
+		return nil
+	}
+	var chunk StreamChunk
+	if json.Unmarshal([]byte(ev.Data), &chunk) != nil {
+		return nil
+	}
+	s.Chunks++
+	for _, choice := range chunk.Choices {
+		s.Content += len(choice.Delta.Content)
+		for _, call := range choice.Delta.ToolCalls {
+			if call.ID != "" || call.Function.Name != "" {
+				s.ToolCalls++
+			}
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			s.FinishReason = *choice.FinishReason
+		}
+	}
+	if chunk.Usage != nil {
+		s.Usage = true
+	}
+	if chunk.Error != nil {
+		s.Errors = append(s.Errors, chunk.Error.Message)
+	}
+	return &chunk
+}
+
+// Problems lists why a stream that ended looks cut off, most telling first.
+func (s *StreamSummary) Problems() []string {
+	var problems []string
+	for _, msg := range s.Errors {
+		problems = append(problems, "the stream carried an error: "+msg)
+	}
+	if s.FinishReason == "" {
+		problems = append(problems, "no chunk had a finish_reason, so the answer was cut off before the model finished")
+	} else if s.FinishReason == "length" {
+		problems = append(problems, "finish_reason is length: the model hit max_tokens")
+	}
+	if !s.Done {
+		problems = append(problems, "no [DONE] event: the stream was cut before it ended")
+	}
+	return problems
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestStreamTap(t *testing.T) {
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+		`[DONE]`,
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if r.URL.Query().Get("cut") != "" {
+			// Ends inside an event, as when the connection drops
+			fmt.Fprintf(w, "data: %s\n\ndata: {\"choi", chunks[0])
+			return
+		}
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "proxy-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL, RequestHistory: true}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	stream := func(query string) (*StreamParser, []StreamEvent) {
+		t.Helper()
+		body := `{"model":"claude-sonnet","stream":true}`
+		resp, err := http.Post(front.URL+"/v1/chat/completions"+query, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// The tap writes its end record after the client has the last
+		// byte; wait for it
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			p, events, err := ParseStream(StreamPath(cfg))
+			if err == nil && p.End != nil {
+				return p, events
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("no end record in the captured stream: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	p, events := stream("")
+	if p.Info == nil || p.Info.Model != "claude-sonnet" || p.Info.Path != "/v1/chat/completions" || p.Info.Status != 200 {
+		t.Errorf("info = %+v", p.Info)
+	}
+	if p.End == nil || p.End.Truncated {
+		t.Errorf("end = %+v", p.End)
+	}
+	if len(events) != len(chunks) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(chunks), events)
+	}
+	var summary StreamSummary
+	for i, ev := range events {
+		if ev.Data != chunks[i] {
+			t.Errorf("event %d = %q, want %q", i, ev.Data, chunks[i])
+		}
+		summary.Add(ev)
+	}
+	if summary.Chunks != 3 || summary.Content != 5 || summary.FinishReason != "stop" || !summary.Usage || !summary.Done {
+		t.Errorf("summary = %+v", summary)
+	}
+	if problems := summary.Problems(); len(problems) != 0 {
+		t.Errorf("complete stream has problems: %v", problems)
+	}
+
+	// A cut stream replaces the last one and shows what was missing
+	p, events = stream("?cut=1")
+	if p.End == nil || len(events) != 2 || events[1].Data != `{"choi` {
+		t.Fatalf("cut stream: end %+v, events %+v", p.End, events)
+	}
+	summary = StreamSummary{}
+	for _, ev := range events {
+		summary.Add(ev)
+	}
+	if problems := summary.Problems(); len(problems) != 2 {
+		t.Errorf("cut stream problems = %v", problems)
+	}
+
+	// Other responses leave the capture alone
+	resp, _ := http.Get(front.URL + "/v1/models")
+	resp.Body.Close()
+	if p, _, _ := ParseStream(StreamPath(cfg)); p.Info == nil || p.Info.Status != 200 {
+		t.Error("non-stream response replaced the capture")
+	}
+	if err := ClearHistory(HistoryPath(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(StreamPath(cfg)); !os.IsNotExist(err) {
+		t.Errorf("ClearHistory() left the captured stream: %v", err)
+	}
+}
+
+func TestStreamTap_Replaced(t *testing.T) {
+	tap := &streamTap{path: filepath.Join(t.TempDir(), streamFile)}
+	older := tap.begin(StreamInfo{Path: "/v1/chat/completions", Status: 200})
+	older.write([]byte("data: old\n\n"))
+	newer := tap.begin(StreamInfo{Path: "/v1/chat/completions", Status: 200})
+	older.write([]byte("data: old again\n\n"))
+	older.end()
+	newer.write([]byte("data: new\n\n"))
+
+	p, events, err := ParseStream(tap.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Data != "new" || p.End != nil {
+		t.Errorf("events = %+v, end = %+v", events, p.End)
+	}
+	newer.end()
+	if p, _, _ := ParseStream(tap.path); p.End == nil {
+		t.Error("newer stream not ended")
+	}
+}
@@ -0,0 +1,207 @@
+// Package proxy provides upstream timeouts: how long to wait for response
+// headers, and how long a response body, e.g. a stream, may go without
+// data. Both can be overridden per route, so a reasoning model can think for
+// minutes before its first byte while other requests still fail fast.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// TimeoutStatus is the "upstream_timeouts" section of /health.
+type TimeoutStatus struct {
+	Header     string                `json:"header"`
+	StreamIdle string                `json:"stream_idle,omitempty"`
+	Routes     []config.RouteTimeout `json:"routes,omitempty"`
+}
+
+// upstreamTimeouts holds the global timeouts and the route overrides.
+type upstreamTimeouts struct {
+	mu     sync.RWMutex
+	header time.Duration
+	idle   time.Duration
+	routes []config.RouteTimeout
+}
+
+// requestTimeouts are the timeouts picked for one request.
+type requestTimeouts struct {
+	header, idle time.Duration
+}
+
+type requestTimeoutsKey struct{}
+
+// set replaces the timeouts and reports whether they changed.
+func (u *upstreamTimeouts) set(header, idle time.Duration, routes []config.RouteTimeout) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	changed := header != u.header || idle != u.idle || !reflect.DeepEqual(routes, u.routes)
+	u.header, u.idle, u.routes = header, idle, routes
+	return changed
+}
+
+// status returns the health section, or nil when only the header timeout
+// is set.
+func (u *upstreamTimeouts) status() *TimeoutStatus {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.idle == 0 && len(u.routes) == 0 {
+		return nil
+	}
+	st := &TimeoutStatus{Header: u.header.String(), Routes: u.routes}
+	if u.idle > 0 {
+		st.StreamIdle = u.idle.String()
+	}
+	return st
+}
+
+// needsModel reports whether a route matches on the request's model.
+func (u *upstreamTimeouts) needsModel() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, rt := range u.routes {
+		if rt.Model != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// forRequest returns the timeouts for a request to urlPath for model ("" if
+// unknown). The first matching route overrides the global settings.
+func (u *upstreamTimeouts) forRequest(urlPath, model string) requestTimeouts {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	t := requestTimeouts{header: u.header, idle: u.idle}
+	for _, rt := range u.routes {
+		if ok, _ := path.Match(rt.Path, urlPath); rt.Path != "" && !ok {
+			continue
+		}
+		if ok, _ := path.Match(rt.Model, model); rt.Model != "" && (model == "" || !ok) {
+			continue
+		}
+		if d, err := time.ParseDuration(rt.HeaderTimeout); err == nil {
+			t.header = d
+		}
+		if d, err := time.ParseDuration(rt.StreamIdleTimeout); err == nil {
+			t.idle = d
+		}
+		break
+	}
+	return t
+}
+
+// applyTimeouts picks r's upstream timeouts and stores them in its context.
+// Routes matching on the model need a chat completion's body read.
+func (s *Server) applyTimeouts(r *http.Request) *http.Request {
+	model := ""
+	if s.timeouts.needsModel() && r.Method == http.MethodPost && r.URL.Path == completionsPath && r.Body != nil && r.Header.Get("Content-Encoding") == "" {
+		body, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		setBody(r, body)
+		model = sniffModel(body)
+	}
+	t := s.timeouts.forRequest(r.URL.Path, model)
+	return r.WithContext(context.WithValue(r.Context(), requestTimeoutsKey{}, t))
+}
+
+// timeoutError is a timeout the proxy enforces. It is a net.Error so the
+// retry transport does not retry it.
+type timeoutError struct{ msg string }
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return false }
+
+// timeoutTransport applies the request's header and idle timeouts to each
+// upstream attempt.
+type timeoutTransport struct {
+	next     http.RoundTripper
+	timeouts *upstreamTimeouts
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt, ok := req.Context().Value(requestTimeoutsKey{}).(requestTimeouts)
+	if !ok {
+		rt = t.timeouts.forRequest(req.URL.Path, "")
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(rt.header, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && timedOut.Load() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, &timeoutError{fmt.Sprintf("timeout awaiting response headers after %v", rt.header)}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The upgraded connection's body must stay writable
+		return resp, nil
+	}
+
+	body := &idleBody{ReadCloser: resp.Body, cancel: cancel, idle: rt.idle, path: req.URL.Path}
+	if rt.idle > 0 {
+		body.timer = time.AfterFunc(rt.idle, func() {
+			body.timedOut.Store(true)
+			cancel()
+		})
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// idleBody ends a response body that sends no data for idle.
+type idleBody struct {
+	io.ReadCloser
+	cancel   context.CancelFunc
+	idle     time.Duration
+	path     string
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timer == nil {
+		return n, err
+	}
+	if b.timedOut.Load() {
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "[proxy] Upstream sent no data for %v; ending the response to %s\n", b.idle, b.path)
+			err = &timeoutError{fmt.Sprintf("upstream sent no data for %v", b.idle)}
+		}
+		return n, err
+	}
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cancel()
+	return b.ReadCloser.Close()
+}
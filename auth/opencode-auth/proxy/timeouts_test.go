@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestUpstreamTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := func(d time.Duration) {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+			}
+		}
+		switch r.URL.Path {
+		case "/v1/stream":
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			wait(2 * time.Second)
+			w.Write([]byte("late"))
+		default:
+			wait(300 * time.Millisecond)
+			w.Write([]byte("done"))
+		}
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "id-token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: tokenPath, APIEndpoint: backend.URL,
+		HTTPTimeout: 100 * time.Millisecond, StreamIdleTimeout: 200 * time.Millisecond,
+		RouteTimeouts: []config.RouteTimeout{
+			{Model: "deep-*", HeaderTimeout: "2s"},
+			{Path: "/v1/slow/*", HeaderTimeout: "2s"},
+		}}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, front.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"global timeout", "POST", completionsPath, `{"model":"fast"}`, http.StatusBadGateway},
+		{"model route", "POST", completionsPath, `{"model":"deep-r1"}`, http.StatusOK},
+		{"path route", "GET", "/v1/slow/models", "", http.StatusOK},
+		{"unmatched path", "GET", "/v1/models", "", http.StatusBadGateway},
+	} {
+		if status, _ := do(tc.method, tc.path, tc.body); status != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.name, status, tc.status)
+		}
+	}
+
+	// A stream that stops sending data is ended after the idle timeout
+	start := time.Now()
+	if _, body := do("GET", "/v1/stream", ""); body != "first" {
+		t.Errorf("stalled stream body = %q, want %q", body, "first")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled stream took %v to end", elapsed)
+	}
+
+	if st := server.timeouts.status(); st == nil || st.StreamIdle != "200ms" || len(st.Routes) != 2 {
+		t.Errorf("status() = %+v", st)
+	}
+	if !server.timeouts.set(time.Second, 0, nil) || server.timeouts.status() != nil {
+		t.Error("set() did not replace the timeouts")
+	}
+}
@@ -0,0 +1,172 @@
+// Package proxy provides a unix socket that hands out the current token, so
+// 'opencode-auth token' can answer without loading config or reading the
+// token file itself.
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// tokenSocketFile is created in the config directory (mode 0600), so
+	// only the owning user can connect
+	tokenSocketFile = "proxy.sock"
+
+	// tokenSocketTimeout bounds a fast-path lookup; on timeout the caller
+	// takes the regular path
+	tokenSocketTimeout = 100 * time.Millisecond
+)
+
+// TokenSocketResponse is written to each connection on the token socket.
+// Token is empty when there is no valid token; the caller then falls back
+// to the regular path, which reports why.
+type TokenSocketResponse struct {
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	// Audit tells the caller to record itself in the token audit log
+	Audit bool `json:"audit,omitempty"`
+}
+
+// TokenSocketPath returns the token socket path, or "" where the fast path
+// is not supported. Windows does not restrict unix socket access by file
+// mode, so it always uses the regular path.
+func TokenSocketPath(cfg *config.Config) string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	return filepath.Join(cfg.ConfigDir, tokenSocketFile)
+}
+
+// tokenSocket serves the token from memory, re-reading the token file only
+// when its size or modification time changes.
+type tokenSocket struct {
+	audit atomic.Bool
+	// static is the token handed out with auth_mode static, set before
+	// the socket is served
+	static string
+
+	mu      sync.Mutex
+	tokens  *auth.TokenData
+	size    int64
+	modTime time.Time
+}
+
+// serveTokenSocket listens on the token socket until the server stops.
+// Failure only disables the fast path.
+func (s *Server) serveTokenSocket() {
+	path := TokenSocketPath(s.config)
+	if path == "" {
+		return
+	}
+	// A socket left by a crashed proxy would make Listen fail; Start has
+	// already checked that no other proxy is running
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: token socket disabled: %v\n", err)
+		return
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: token socket disabled: %v\n", err)
+		return
+	}
+
+	go func() {
+		<-s.stopChan
+		if s.isHandedOver() {
+			// The path is the replacement proxy's socket now
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		listener.Close() // also removes the socket file
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: token socket: %v\n", err)
+			}
+			return
+		}
+		go s.tokenSock.answer(conn, s.config.TokenPath, s.refresher)
+	}
+}
+
+func (t *tokenSocket) answer(conn net.Conn, tokenPath string, refresher *Refresher) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+	resp := TokenSocketResponse{Audit: t.audit.Load()}
+	if t.static != "" {
+		resp.Token = t.static
+	} else if refresher == nil || !refresher.GetNeedsReauth() {
+		if tokens := t.current(tokenPath); tokens != nil && !tokens.IsExpired() {
+			resp.Token = tokens.BearerToken()
+			resp.ExpiresAt = tokens.ExpiresAt
+		}
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// current returns the cached tokens, reloading them if the file changed.
+// Tokens kept in memory are not cached again.
+func (t *tokenSocket) current(tokenPath string) *auth.TokenData {
+	if auth.TokensInMemory() {
+		tokens, err := auth.LoadTokens(tokenPath)
+		if err != nil {
+			return nil
+		}
+		return tokens
+	}
+	info, err := os.Stat(tokenPath)
+	if err != nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil || info.Size() != t.size || !info.ModTime().Equal(t.modTime) {
+		tokens, err := auth.LoadTokens(tokenPath)
+		if err != nil {
+			return nil
+		}
+		t.tokens, t.size, t.modTime = tokens, info.Size(), info.ModTime()
+	}
+	return t.tokens
+}
+
+// ReadTokenSocket asks a running proxy for the current token. Any error
+// means the caller should take the regular path.
+func ReadTokenSocket(path string) (*TokenSocketResponse, error) {
+	if path == "" {
+		return nil, fmt.Errorf("token socket not supported")
+	}
+	conn, err := net.DialTimeout("unix", path, tokenSocketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(tokenSocketTimeout))
+
+	var resp TokenSocketResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Token == "" {
+		return nil, fmt.Errorf("no valid token")
+	}
+	return &resp, nil
+}
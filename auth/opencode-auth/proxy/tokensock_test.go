@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestTokenSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("token socket is not used on Windows")
+	}
+	// Unix socket paths are limited to ~100 bytes, which t.TempDir can exceed
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenPath := filepath.Join(dir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "first", ExpiresAt: time.Now().Add(time.Hour)})
+	s := &Server{
+		config:   &config.Config{ConfigDir: dir, TokenPath: tokenPath},
+		stopChan: make(chan struct{}),
+	}
+	s.tokenSock.audit.Store(true)
+	done := make(chan struct{})
+	go func() {
+		s.serveTokenSocket()
+		close(done)
+	}()
+
+	path := TokenSocketPath(s.config)
+	var resp *TokenSocketResponse
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = ReadTokenSocket(path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("ReadTokenSocket: %v", err)
+	}
+	if resp.Token != "first" || !resp.Audit {
+		t.Errorf("response = %+v, want token \"first\" with audit", resp)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+
+	// A refreshed token file is picked up
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "second-token", ExpiresAt: time.Now().Add(time.Hour)})
+	if resp, err = ReadTokenSocket(path); err != nil || resp.Token != "second-token" {
+		t.Errorf("after refresh: %+v, %v, want second-token", resp, err)
+	}
+
+	// An expired token is not served, so the caller takes the regular path
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	if _, err = ReadTokenSocket(path); err == nil {
+		t.Error("expired token was served")
+	}
+
+	close(s.stopChan)
+	<-done
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Error("socket not removed on stop")
+}
@@ -0,0 +1,232 @@
+// Package proxy keeps the tokens of token_storage "memory" in the proxy and
+// serves them to the CLI over a unix socket, so a login, 'token', or
+// 'status' in another process never reads or writes a tokens file.
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// tokenStoreSocketFile is created in the config directory (mode 0600),
+	// so only the owning user can connect
+	tokenStoreSocketFile = "token-store.sock"
+
+	// tokenStoreTimeout bounds one request on the token store socket
+	tokenStoreTimeout = 5 * time.Second
+)
+
+// Operations on the token store socket.
+const (
+	tokenStoreLoad   = "load"
+	tokenStoreSave   = "save"
+	tokenStoreDelete = "delete"
+	// tokenStoreHandover loads the tokens for a replacement proxy and
+	// holds this proxy's refresher, so they stay the current ones
+	tokenStoreHandover = "handover"
+)
+
+// tokenStoreRequest is read from each connection on the token store socket.
+type tokenStoreRequest struct {
+	Op     string          `json:"op"`
+	Tokens *auth.TokenData `json:"tokens,omitempty"`
+}
+
+// tokenStoreResponse answers a tokenStoreRequest.
+type tokenStoreResponse struct {
+	Tokens      *auth.TokenData `json:"tokens,omitempty"`
+	NotLoggedIn bool            `json:"not_logged_in,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// TokenStoreSocketPath returns the token store socket path, or "" where it
+// is not supported: Windows does not restrict unix socket access by file
+// mode.
+func TokenStoreSocketPath(cfg *config.Config) string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	return filepath.Join(cfg.ConfigDir, tokenStoreSocketFile)
+}
+
+// useMemoryTokens switches this process to tokens in memory. A proxy taking
+// over from another first copies that one's tokens, so the handover keeps
+// the session. The other proxy stops refreshing before the copy, so it
+// can't rotate the refresh token the copy has.
+func (s *Server) useMemoryTokens() {
+	memory := &auth.MemoryTokens{}
+	if InheritsListener() {
+		if tokens, err := NewRemoteTokens(s.config).handover(); err == nil {
+			memory.Save(tokens)
+		}
+	}
+	auth.UseTokenStore(memory)
+	if _, err := os.Stat(s.config.TokenPath); err == nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: token_storage is memory, but %s exists; delete it unless another configuration uses it\n", s.config.TokenPath)
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] Keeping tokens in memory only; a restart needs a new sign-in\n")
+}
+
+// serveTokenStore listens on the token store socket until the server stops.
+func (s *Server) serveTokenStore() {
+	path := TokenStoreSocketPath(s.config)
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: token_storage memory: other commands can't reach the tokens on %s\n", runtime.GOOS)
+		return
+	}
+	// A socket left by a crashed proxy would make Listen fail, and one from
+	// a proxy handing over has served its tokens by now
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: token store socket disabled: %v\n", err)
+		return
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: token store socket disabled: %v\n", err)
+		return
+	}
+
+	go func() {
+		<-s.stopChan
+		if s.isHandedOver() {
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "[proxy] Warning: token store socket: %v\n", err)
+			}
+			return
+		}
+		go s.answerTokenStore(conn)
+	}
+}
+
+func (s *Server) answerTokenStore(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tokenStoreTimeout))
+
+	var req tokenStoreRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	var resp tokenStoreResponse
+	var err error
+	switch req.Op {
+	case tokenStoreLoad:
+		resp.Tokens, err = auth.LoadTokens(s.config.TokenPath)
+	case tokenStoreSave:
+		if req.Tokens == nil {
+			err = errors.New("no tokens to save")
+			break
+		}
+		if err = auth.SaveTokens(s.config.TokenPath, req.Tokens); err == nil {
+			fmt.Fprintf(os.Stderr, "[proxy] Tokens for %s saved in memory\n", req.Tokens.Email)
+		}
+	case tokenStoreDelete:
+		err = auth.DeleteTokens(s.config.TokenPath)
+	case tokenStoreHandover:
+		if s.refresher != nil {
+			s.refresher.Hold()
+			fmt.Fprintf(os.Stderr, "[proxy] Handing the tokens over; not refreshing them any more\n")
+		}
+		resp.Tokens, err = auth.LoadTokens(s.config.TokenPath)
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		resp.NotLoggedIn = errors.Is(err, auth.ErrNotLoggedIn)
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// RemoteTokens is the auth.TokenStore of the other processes with
+// token_storage memory: the tokens in the running proxy's memory.
+type RemoteTokens struct {
+	path string
+}
+
+// NewRemoteTokens returns the tokens of the proxy cfg runs.
+func NewRemoteTokens(cfg *config.Config) *RemoteTokens {
+	return &RemoteTokens{path: TokenStoreSocketPath(cfg)}
+}
+
+// Load returns the proxy's tokens. With no proxy running there are none,
+// and the error wraps auth.ErrNotLoggedIn.
+func (r *RemoteTokens) Load() (*auth.TokenData, error) {
+	resp, err := r.do(tokenStoreRequest{Op: tokenStoreLoad})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tokens, nil
+}
+
+// handover loads the proxy's tokens for its replacement, and stops the
+// proxy refreshing them.
+func (r *RemoteTokens) handover() (*auth.TokenData, error) {
+	resp, err := r.do(tokenStoreRequest{Op: tokenStoreHandover})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tokens, nil
+}
+
+func (r *RemoteTokens) Save(tokens *auth.TokenData) error {
+	_, err := r.do(tokenStoreRequest{Op: tokenStoreSave, Tokens: tokens})
+	return err
+}
+
+func (r *RemoteTokens) Delete() error {
+	_, err := r.do(tokenStoreRequest{Op: tokenStoreDelete})
+	if errors.Is(err, ErrNotRunning) {
+		return nil // the tokens went with the proxy
+	}
+	return err
+}
+
+func (r *RemoteTokens) do(req tokenStoreRequest) (*tokenStoreResponse, error) {
+	if r.path == "" {
+		return nil, fmt.Errorf("token_storage memory is not supported on %s", runtime.GOOS)
+	}
+	conn, err := net.DialTimeout("unix", r.path, tokenStoreTimeout)
+	if err != nil {
+		if req.Op == tokenStoreSave {
+			return nil, fmt.Errorf("%w: token_storage memory keeps tokens in the proxy; start it with 'opencode-auth proxy start'", ErrNotRunning)
+		}
+		return nil, fmt.Errorf("%w: %w: token_storage memory keeps tokens in the proxy, and none is running", auth.ErrNotLoggedIn, ErrNotRunning)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tokenStoreTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("token store socket: %w", err)
+	}
+	var resp tokenStoreResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("token store socket: %w", err)
+	}
+	if resp.NotLoggedIn {
+		return nil, fmt.Errorf("%w: the proxy keeps no tokens in memory", auth.ErrNotLoggedIn)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestTokenStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("token store socket is not used on Windows")
+	}
+	// Unix socket paths are limited to ~100 bytes, which t.TempDir can exceed
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{ConfigDir: dir, TokenPath: filepath.Join(dir, "tokens.json"), TokenStorage: config.TokenStorageMemory, ClientID: "cli"}
+	remote := NewRemoteTokens(cfg)
+	if _, err := remote.Load(); !errors.Is(err, auth.ErrNotLoggedIn) || !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Load() with no proxy = %v, want not logged in and not running", err)
+	}
+	if err := remote.Save(&auth.TokenData{IDToken: "lost"}); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Save() with no proxy = %v, want not running", err)
+	}
+
+	s := &Server{config: cfg, stopChan: make(chan struct{})}
+	s.useMemoryTokens()
+	defer auth.UseTokenStore(nil)
+	done := make(chan struct{})
+	go func() {
+		s.serveTokenStore()
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err = remote.Load(); !errors.Is(err, ErrNotRunning) {
+			break
+		}
+	}
+	if !errors.Is(err, auth.ErrNotLoggedIn) || errors.Is(err, ErrNotRunning) {
+		t.Fatalf("Load() before login = %v, want not logged in", err)
+	}
+
+	if err := remote.Save(&auth.TokenData{IDToken: "id", RefreshToken: "rt", Email: "dev@example.com", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	tokens, err := remote.Load()
+	if err != nil || tokens.IDToken != "id" || tokens.Email != "dev@example.com" {
+		t.Errorf("Load() = %+v, %v", tokens, err)
+	}
+	if _, err := os.Stat(cfg.TokenPath); !os.IsNotExist(err) {
+		t.Errorf("tokens file written: %v", err)
+	}
+	if !s.signedInSince(time.Now().Add(-time.Minute)) {
+		t.Error("signedInSince() = false after Save")
+	}
+
+	// A replacement taking the tokens stops this proxy refreshing them
+	if s.refresher, err = NewRefresher(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, err := remote.handover(); err != nil || tokens.RefreshToken != "rt" {
+		t.Fatalf("handover() = %+v, %v", tokens, err)
+	}
+	if err := s.refresher.refreshToken(context.Background(), tokens); !errors.Is(err, errRefreshHeld) {
+		t.Errorf("refreshToken() after handover = %v, want held", err)
+	}
+	if _, err := s.refresher.EnsureAudienceToken("https://api.example.com"); !errors.Is(err, errRefreshHeld) {
+		t.Errorf("EnsureAudienceToken() after handover = %v, want held", err)
+	}
+	s.refresher = nil
+
+	if err := remote.Delete(); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if _, err := auth.LoadTokens(cfg.TokenPath); !errors.Is(err, auth.ErrNotLoggedIn) {
+		t.Errorf("LoadTokens() after Delete = %v, want not logged in", err)
+	}
+
+	close(s.stopChan)
+	<-done
+	if _, err := os.Stat(TokenStoreSocketPath(cfg)); !os.IsNotExist(err) {
+		t.Errorf("socket left after stop: %v", err)
+	}
+	if err := remote.Delete(); err != nil {
+		t.Errorf("Delete() with no proxy = %v, want nil", err)
+	}
+}
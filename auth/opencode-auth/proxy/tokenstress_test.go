@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// The stress tests write "generation n" token sets: every field carries n,
+// so a reader can tell a consistent file from a torn or mixed one, and the
+// refresh token doubles as a counter of rotations.
+
+var stressBase = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func stressTokens(n int) *auth.TokenData {
+	return &auth.TokenData{
+		IDToken:      fmt.Sprintf("id-%d", n),
+		AccessToken:  fmt.Sprintf("at-%d", n),
+		RefreshToken: fmt.Sprintf("rt-%d", n),
+		ExpiresAt:    stressBase.Add(time.Duration(n) * time.Second),
+		Email:        "stress@example.com",
+	}
+}
+
+// stressGeneration returns the generation of tokens, or an error if its
+// fields disagree.
+func stressGeneration(tokens *auth.TokenData) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(tokens.RefreshToken, "rt-"))
+	if err != nil {
+		return 0, fmt.Errorf("bad refresh token %q", tokens.RefreshToken)
+	}
+	want := stressTokens(n)
+	if tokens.IDToken != want.IDToken || tokens.AccessToken != want.AccessToken || !tokens.ExpiresAt.Equal(want.ExpiresAt) {
+		return 0, fmt.Errorf("mixed generations: %+v", tokens)
+	}
+	return n, nil
+}
+
+// rotate is one refresh: it replaces the tokens with the next generation.
+func rotate(path string) error {
+	return auth.UpdateTokens(path, func(tokens *auth.TokenData) error {
+		n, err := stressGeneration(tokens)
+		if err != nil {
+			return err
+		}
+		*tokens = *stressTokens(n + 1)
+		return nil
+	})
+}
+
+// TestTokenStressChild is run in subprocesses by TestTokenFile_MultiProcess.
+func TestTokenStressChild(t *testing.T) {
+	path := os.Getenv("TOKEN_STRESS_PATH")
+	if path == "" {
+		t.Skip("only run as a subprocess")
+	}
+	rotations, _ := strconv.Atoi(os.Getenv("TOKEN_STRESS_ROTATIONS"))
+	for i := 0; i < rotations; i++ {
+		if err := rotate(path); err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := auth.LoadTokens(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stressGeneration(tokens); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTokenFile_ConcurrentReadWrite(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "tokens.json")
+	if err := auth.SaveTokens(path, stressTokens(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{ConfigDir: tempDir, TokenPath: path, APIEndpoint: "https://api.example.com"}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, readers, rounds = 16, 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+2*readers)
+	var maxWait time.Duration
+	var waitMu sync.Mutex
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				start := time.Now()
+				var err error
+				// Alternate full saves with read-modify-write rotations
+				if i%2 == 0 {
+					err = auth.SaveTokens(path, stressTokens(1000*(w+1)+i))
+				} else {
+					err = rotate(path)
+				}
+				waitMu.Lock()
+				maxWait = max(maxWait, time.Since(start))
+				waitMu.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	stop := make(chan struct{})
+	var readerWG sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readerWG.Add(2)
+		go func() {
+			defer readerWG.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tokens, err := auth.LoadTokens(path)
+				if err != nil {
+					errs <- fmt.Errorf("torn read: %w", err)
+					return
+				}
+				if _, err := stressGeneration(tokens); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer readerWG.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("POST", "http://localhost/v1/chat/completions", nil)
+				server.addAuthHeader(req)
+				bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer id-")
+				if _, err := strconv.Atoi(bearer); err != nil {
+					errs <- fmt.Errorf("addAuthHeader set %q", req.Header.Get("Authorization"))
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readerWG.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if maxWait > 5*time.Second {
+		t.Errorf("slowest write took %v", maxWait)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+func TestTokenFile_NoLostRotations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := auth.SaveTokens(path, stressTokens(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines, rotations = 32, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rotations; i++ {
+				if err := rotate(path); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	tokens, err := auth.LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := stressGeneration(tokens); err != nil || n != goroutines*rotations {
+		t.Errorf("generation = %d, %v; want %d (rotations lost)", n, err, goroutines*rotations)
+	}
+}
+
+func TestTokenFile_MultiProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns subprocesses")
+	}
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := auth.SaveTokens(path, stressTokens(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	const processes, rotations = 6, 30
+	var wg sync.WaitGroup
+	outputs := make([][]byte, processes)
+	errs := make([]error, processes)
+	for p := 0; p < processes; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestTokenStressChild$", "-test.count=1")
+			cmd.Env = append(os.Environ(),
+				"TOKEN_STRESS_PATH="+path,
+				"TOKEN_STRESS_ROTATIONS="+strconv.Itoa(rotations))
+			outputs[p], errs[p] = cmd.CombinedOutput()
+		}(p)
+	}
+	// Rotate from this process too while the children run
+	for i := 0; i < rotations; i++ {
+		if err := rotate(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	for p, err := range errs {
+		if err != nil {
+			t.Fatalf("child %d: %v\n%s", p, err, outputs[p])
+		}
+	}
+
+	tokens, err := auth.LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := (processes + 1) * rotations
+	if n, err := stressGeneration(tokens); err != nil || n != want {
+		t.Errorf("generation = %d, %v; want %d (rotations lost)", n, err, want)
+	}
+}
+
+func TestTokenFile_LockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := auth.SaveTokens(path, stressTokens(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d time.Duration) { auth.TokenLockTimeout = d }(auth.TokenLockTimeout)
+	auth.TokenLockTimeout = 200 * time.Millisecond
+
+	// Hold the lock inside an update until released
+	held, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- auth.UpdateTokens(path, func(*auth.TokenData) error {
+			close(held)
+			<-release
+			return errors.New("abandoned")
+		})
+	}()
+	<-held
+
+	start := time.Now()
+	err := auth.SaveTokens(path, stressTokens(1))
+	if !errors.Is(err, auth.ErrLockTimeout) {
+		t.Errorf("err = %v, want ErrLockTimeout", err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("waited %v for a held lock", waited)
+	}
+
+	close(release)
+	if err := <-done; err == nil || err.Error() != "abandoned" {
+		t.Errorf("update err = %v", err)
+	}
+	// A failed update leaves the file as it was, and the lock is free again
+	if tokens, _ := auth.LoadTokens(path); tokens.RefreshToken != "rt-0" {
+		t.Errorf("tokens after failed update = %+v", tokens)
+	}
+	if err := auth.SaveTokens(path, stressTokens(2)); err != nil {
+		t.Errorf("save after release: %v", err)
+	}
+}
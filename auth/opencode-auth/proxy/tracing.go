@@ -0,0 +1,66 @@
+// Package proxy provides request tracing hooks for the reverse proxy.
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracing"
+)
+
+// authMode names the credential addAuthHeader attached to req.
+func authMode(req *http.Request) string {
+	switch {
+	case req.Header.Get("X-API-Key") != "":
+		return "api_key"
+	case req.Header.Get("Authorization") != "":
+		return "jwt"
+	default:
+		return "none"
+	}
+}
+
+// traceResponse records the status on the request span and starts a span
+// covering delivery of the response body, which for streamed completions is
+// most of the request's duration.
+func traceResponse(tracer *tracing.Tracer, resp *http.Response) {
+	if tracer == nil {
+		return
+	}
+	ctx := resp.Request.Context()
+	if root := tracing.SpanFromContext(ctx); root != nil {
+		root.SetAttr("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			root.SetError(resp.Status)
+		}
+	}
+	_, span := tracer.Start(ctx, "response.stream", tracing.KindInternal)
+	span.SetAttr("proxy.streaming", resp.Header.Get("Content-Type") == "text/event-stream")
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+}
+
+// tracedBody ends its span when the body is fully read or closed.
+type tracedBody struct {
+	io.ReadCloser
+	span  *tracing.Span
+	bytes int64
+	once  sync.Once
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		b.span.SetError(err.Error())
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.once.Do(func() {
+		b.span.SetAttr("http.response.body.size", b.bytes)
+		b.span.End()
+	})
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestProxyTracing(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID string `json:"traceId"`
+						Name    string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, span := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+			if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("span %s in trace %s, want the client's trace", span.Name, span.TraceID)
+			}
+			names = append(names, span.Name)
+		}
+	}))
+	defer collector.Close()
+
+	var upstreamParent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+	tokenPath := filepath.Join(tempDir, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "test-token", ExpiresAt: time.Now().Add(time.Hour)})
+	server, err := newServerInternal(&config.Config{
+		ConfigDir:    tempDir,
+		TokenPath:    tokenPath,
+		APIEndpoint:  backend.URL,
+		OTelEndpoint: collector.URL,
+	}, 0, false)
+	if err != nil {
+		t.Fatalf("newServerInternal() error = %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/v1/models", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	server.handleRequest(rec, req)
+	io.ReadAll(rec.Result().Body)
+
+	if !strings.HasPrefix(upstreamParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(upstreamParent, "00f067aa0ba902b7") {
+		t.Errorf("upstream traceparent = %q, want the client's trace with the proxy's span", upstreamParent)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.tracer.Flush(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]bool{"GET /v1/models": true, "auth.header": true, "upstream GET": true, "response.stream": true}
+	if len(names) != len(want) {
+		t.Errorf("exported spans %v, want %d", names, len(want))
+	}
+	for _, name := range names {
+		if !want[name] {
+			t.Errorf("unexpected span %q", name)
+		}
+	}
+}
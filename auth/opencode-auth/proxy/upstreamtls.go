@@ -0,0 +1,60 @@
+// Package proxy reports the TLS of the upstream connections in /health:
+// the configured tls_min_version and tls_cipher_suites, and what the last
+// upstream response was actually negotiated with, so an operator can
+// confirm a TLS 1.3-only mandate is in effect.
+package proxy
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tlspolicy"
+)
+
+// UpstreamTLSStatus is the "tls" section of /health.
+type UpstreamTLSStatus struct {
+	Policy *tlspolicy.Status `json:"policy,omitempty"`
+	// Version and CipherSuite were negotiated for the last upstream
+	// response, at LastSeen
+	Version     string    `json:"version,omitempty"`
+	CipherSuite string    `json:"cipher_suite,omitempty"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+}
+
+// upstreamTLS records the TLS negotiated with the upstream.
+type upstreamTLS struct {
+	mu       sync.Mutex
+	policy   *tlspolicy.Policy
+	version  uint16
+	suite    uint16
+	lastSeen time.Time
+}
+
+// observe records the connection state of an upstream response; nil (plain
+// HTTP) is ignored.
+func (u *upstreamTLS) observe(state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	u.mu.Lock()
+	u.version, u.suite, u.lastSeen = state.Version, state.CipherSuite, time.Now()
+	u.mu.Unlock()
+}
+
+// status returns the /health section, or nil with no policy and no TLS
+// response yet.
+func (u *upstreamTLS) status() *UpstreamTLSStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.policy == nil && u.version == 0 {
+		return nil
+	}
+	st := &UpstreamTLSStatus{Policy: u.policy.Status()}
+	if u.version != 0 {
+		st.Version = tls.VersionName(u.version)
+		st.CipherSuite = tls.CipherSuiteName(u.suite)
+		st.LastSeen = u.lastSeen
+	}
+	return st
+}
@@ -0,0 +1,207 @@
+// Package proxy provides per-day request accounting for the proxy.
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// recentUsage is how many completions /api/usage lists in "recent".
+	recentUsage = 20
+
+	// usageFile holds today's counts in the config directory, so the daily
+	// budgets survive a proxy restart.
+	usageFile = "usage-today.json"
+)
+
+// UsageResponse is the response for the /api/usage endpoint.
+type UsageResponse struct {
+	Date             string `json:"date"` // local date, YYYY-MM-DD
+	Requests         int    `json:"requests"`
+	Completions      int    `json:"completions"`
+	Errors           int    `json:"errors"`
+	Tokens           int    `json:"tokens"` // prompt plus completion tokens reported
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TokenBudget      int    `json:"token_budget,omitempty"` // proxy_guardrails daily_token_budget
+	UsageBudget      int    `json:"usage_budget,omitempty"` // soft budget, notified only
+	// Models has today's tokens by model, for pricing
+	Models map[string]ModelUsage `json:"models,omitempty"`
+	// Recent is the usage of the last completions, oldest first
+	Recent []RequestUsage `json:"recent,omitempty"`
+}
+
+// ModelUsage is one model's entry in UsageResponse.Models.
+type ModelUsage struct {
+	Completions      int `json:"completions"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// RequestUsage is the usage one chat completion reported. It is sent as the
+// "usage" event on /api/events as soon as the response ends.
+type RequestUsage struct {
+	Time             time.Time `json:"time"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	Streamed         bool      `json:"streamed"`
+}
+
+// usageStats counts requests proxied today, and the tokens they used. Counts
+// reset at local midnight. With a path, they are saved there whenever a
+// completion reports usage and loaded again when the proxy starts, so a
+// restart doesn't reset the daily budgets.
+type usageStats struct {
+	mu    sync.Mutex
+	today UsageResponse
+	// lastHour holds the completions of the last hour, for the burn rate
+	lastHour []RequestUsage
+	now      func() time.Time
+	path     string // "" keeps the counts in memory only
+}
+
+// newUsageStats returns the counts saved at path, if any; those of another
+// day are dropped at the first rollover.
+func newUsageStats(path string) *usageStats {
+	u := &usageStats{now: time.Now, path: path}
+	if path == "" {
+		return u
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		var saved UsageResponse
+		if json.Unmarshal(data, &saved) == nil {
+			u.today = saved
+		}
+	}
+	return u
+}
+
+// save writes today's counts to path. A failed write only costs the counts
+// on the next restart. Callers hold mu.
+func (u *usageStats) save() {
+	if u.path == "" {
+		return
+	}
+	data, err := json.Marshal(u.today)
+	if err != nil {
+		return
+	}
+	tmpPath := u.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmpPath, u.path); err != nil {
+		os.Remove(tmpPath)
+	}
+}
+
+// record counts one proxied response.
+func (u *usageStats) record(path string, status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	u.today.Requests++
+	if path == "/v1/chat/completions" {
+		u.today.Completions++
+	}
+	if status >= 400 {
+		u.today.Errors++
+	}
+}
+
+// addUsage counts the tokens a completion reported.
+func (u *usageStats) addUsage(r RequestUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	u.today.Tokens += r.TotalTokens
+	u.today.PromptTokens += r.PromptTokens
+	u.today.CompletionTokens += r.CompletionTokens
+	if r.Model != "" {
+		if u.today.Models == nil {
+			u.today.Models = map[string]ModelUsage{}
+		}
+		m := u.today.Models[r.Model]
+		m.Completions++
+		m.PromptTokens += r.PromptTokens
+		m.CompletionTokens += r.CompletionTokens
+		u.today.Models[r.Model] = m
+	}
+	u.today.Recent = append(u.today.Recent, r)
+	if len(u.today.Recent) > recentUsage {
+		u.today.Recent = u.today.Recent[len(u.today.Recent)-recentUsage:]
+	}
+	u.lastHour = append(u.lastHour, r)
+	u.pruneLastHour()
+	u.save()
+}
+
+// burnRate returns the tokens completions reported in the last hour.
+func (u *usageStats) burnRate() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pruneLastHour()
+	tokens := 0
+	for _, r := range u.lastHour {
+		tokens += r.TotalTokens
+	}
+	return tokens
+}
+
+// pruneLastHour drops completions older than an hour. Callers hold mu.
+func (u *usageStats) pruneLastHour() {
+	cutoff := u.now().Add(-time.Hour)
+	i := 0
+	for i < len(u.lastHour) && !u.lastHour[i].Time.After(cutoff) {
+		i++
+	}
+	u.lastHour = u.lastHour[i:]
+}
+
+// snapshot returns today's counts.
+func (u *usageStats) snapshot() UsageResponse {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	today := u.today
+	if today.Models != nil {
+		today.Models = make(map[string]ModelUsage, len(u.today.Models))
+		for model, m := range u.today.Models {
+			today.Models[model] = m
+		}
+	}
+	today.Recent = append([]RequestUsage(nil), u.today.Recent...)
+	return today
+}
+
+// rollover resets the counts when the local date changes. Callers hold mu.
+func (u *usageStats) rollover() {
+	date := u.now().Format("2006-01-02")
+	if u.today.Date != date {
+		u.today = UsageResponse{Date: date}
+	}
+}
+
+// recordUsage counts a completion's usage and publishes it on /api/events,
+// so companion tools can show the session's cost as it grows.
+func (s *Server) recordUsage(r RequestUsage) {
+	r.Time = time.Now().UTC()
+	s.usage.addUsage(r)
+	s.events.publish(Event{Type: EventUsage, Time: r.Time, Usage: &r})
+	s.checkUsageBudget()
+}
+
+// handleUsage returns request and token counts for today
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	usage := s.usage.snapshot()
+	usage.TokenBudget = s.currentGuardrails().DailyTokenBudget
+	usage.UsageBudget = s.budget.get()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageStats_CountsAndRollsOver(t *testing.T) {
+	now := time.Date(2025, 3, 1, 23, 59, 0, 0, time.Local)
+	u := newUsageStats("")
+	u.now = func() time.Time { return now }
+
+	u.record("/v1/chat/completions", 200)
+	u.record("/v1/models", 200)
+	u.record("/v1/chat/completions", 500)
+
+	got := u.snapshot()
+	want := UsageResponse{Date: "2025-03-01", Requests: 3, Completions: 2, Errors: 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() = %+v, want %+v", got, want)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if got := u.snapshot(); !reflect.DeepEqual(got, UsageResponse{Date: "2025-03-02"}) {
+		t.Errorf("snapshot() after midnight = %+v, want empty counts", got)
+	}
+}
+
+func TestUsageStats_Persisted(t *testing.T) {
+	now := time.Date(2025, 3, 1, 22, 0, 0, 0, time.Local)
+	path := filepath.Join(t.TempDir(), usageFile)
+	u := newUsageStats(path)
+	u.now = func() time.Time { return now }
+	u.addUsage(RequestUsage{Time: now, Model: "claude-sonnet", PromptTokens: 300, CompletionTokens: 200, TotalTokens: 500})
+
+	// A restarted proxy picks up today's tokens
+	restarted := newUsageStats(path)
+	restarted.now = func() time.Time { return now.Add(time.Hour) }
+	if got := restarted.snapshot(); got.Date != "2025-03-01" || got.Tokens != 500 || got.Models["claude-sonnet"].PromptTokens != 300 {
+		t.Errorf("snapshot() after restart = %+v, want today's 500 tokens", got)
+	}
+	// but not yesterday's
+	restarted.now = func() time.Time { return now.Add(3 * time.Hour) }
+	if got := restarted.snapshot(); got.Date != "2025-03-02" || got.Tokens != 0 {
+		t.Errorf("snapshot() the next day = %+v, want no tokens", got)
+	}
+}
+
+func TestRecordUsage_Streaming(t *testing.T) {
+	s := &Server{usage: newUsageStats(""), events: newEventHub()}
+	events, _ := s.events.subscribe(0)
+
+	// The usage event goes out at [DONE], while the stream is still open
+	pr, pw := io.Pipe()
+	c := &tokenCounter{ReadCloser: pr, sse: true, add: s.recordUsage}
+	go io.Copy(io.Discard, c)
+	io.WriteString(pw, "data: {\"model\":\"claude-sonnet\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+	io.WriteString(pw, "data: {\"model\":\"claude-sonnet\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3}}\n\n")
+	io.WriteString(pw, "data: [DONE]\n\n")
+	select {
+	case e := <-events:
+		want := RequestUsage{Time: e.Usage.Time, Model: "claude-sonnet", PromptTokens: 7, CompletionTokens: 3, TotalTokens: 10, Streamed: true}
+		if e.Type != EventUsage || *e.Usage != want {
+			t.Errorf("event = %+v %+v, want usage %+v", e, e.Usage, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no usage event before the stream ended")
+	}
+	pw.Close()
+	c.Close()
+
+	// A non-streamed completion, then two more streamed ones
+	s.recordUsage(RequestUsage{Model: "claude-haiku", PromptTokens: 100, CompletionTokens: 20, TotalTokens: 120})
+	for i := 0; i < 2; i++ {
+		c := &tokenCounter{ReadCloser: io.NopCloser(strings.NewReader("data: {\"model\":\"claude-sonnet\",\"usage\":{\"prompt_tokens\":1,\"completion_tokens\":1,\"total_tokens\":2}}\n")), sse: true, add: s.recordUsage}
+		io.Copy(io.Discard, c)
+		c.Close()
+	}
+
+	got := s.usage.snapshot()
+	if got.Tokens != 134 || got.PromptTokens != 109 || got.CompletionTokens != 25 || len(got.Recent) != 4 {
+		t.Errorf("snapshot() = %+v", got)
+	}
+	if m := got.Models["claude-sonnet"]; m != (ModelUsage{Completions: 3, PromptTokens: 9, CompletionTokens: 5}) {
+		t.Errorf("claude-sonnet usage = %+v", m)
+	}
+	if len(events) != 3 {
+		t.Errorf("%d more usage events, want 3", len(events))
+	}
+}
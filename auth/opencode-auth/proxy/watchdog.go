@@ -0,0 +1,184 @@
+// Package proxy provides the resource watchdog: the proxy samples its own
+// goroutine count, heap, and open files, reports them in /health, logs when
+// a limit is exceeded, and can ask its supervisor for a clean restart, so a
+// leak in a long-lived proxy is caught before it takes the machine down.
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+const (
+	// watchdogInterval is how often the proxy samples its resources.
+	watchdogInterval = time.Minute
+
+	// watchdogStrikes is how many samples in a row must exceed a limit
+	// before the proxy restarts, so a burst of requests doesn't trigger one.
+	watchdogStrikes = 3
+)
+
+// Default watchdog limits, far above what a healthy proxy uses.
+const (
+	DefaultWatchdogMaxGoroutines = 10000
+	DefaultWatchdogMaxHeapMB     = 1024
+	DefaultWatchdogMaxOpenFiles  = 1000
+)
+
+// WatchdogStatus is the "watchdog" section of /health.
+type WatchdogStatus struct {
+	Goroutines int    `json:"goroutines"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+	// OpenFiles is omitted where it can't be counted (Windows)
+	OpenFiles int             `json:"open_files,omitempty"`
+	Limits    config.Watchdog `json:"limits"`
+	Exceeded  []string        `json:"exceeded,omitempty"`
+	SampledAt time.Time       `json:"sampled_at"`
+}
+
+// watchdog keeps the limits and the last sample.
+type watchdog struct {
+	mu      sync.Mutex
+	limits  config.Watchdog
+	last    *WatchdogStatus
+	strikes int
+}
+
+// watchdogLimits fills zero fields of l with the defaults.
+func watchdogLimits(l config.Watchdog) config.Watchdog {
+	if l.MaxGoroutines == 0 {
+		l.MaxGoroutines = DefaultWatchdogMaxGoroutines
+	}
+	if l.MaxHeapMB == 0 {
+		l.MaxHeapMB = DefaultWatchdogMaxHeapMB
+	}
+	if l.MaxOpenFiles == 0 {
+		l.MaxOpenFiles = DefaultWatchdogMaxOpenFiles
+	}
+	return l
+}
+
+// setLimits changes the limits and returns the previous ones. Zero fields
+// take the defaults.
+func (w *watchdog) setLimits(l config.Watchdog) config.Watchdog {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prev := w.limits
+	w.limits = watchdogLimits(l)
+	return prev
+}
+
+// record checks a sample against the limits. It returns the limits exceeded,
+// how many samples in a row have exceeded one, and whether the proxy should
+// restart.
+func (w *watchdog) record(sample WatchdogStatus) (exceeded []string, strikes int, restart bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l := w.limits
+	if sample.Goroutines > l.MaxGoroutines {
+		exceeded = append(exceeded, fmt.Sprintf("goroutines %d > %d", sample.Goroutines, l.MaxGoroutines))
+	}
+	if heapMB := sample.HeapBytes >> 20; heapMB > uint64(l.MaxHeapMB) {
+		exceeded = append(exceeded, fmt.Sprintf("heap %d MB > %d MB", heapMB, l.MaxHeapMB))
+	}
+	if sample.OpenFiles > l.MaxOpenFiles {
+		exceeded = append(exceeded, fmt.Sprintf("open files %d > %d", sample.OpenFiles, l.MaxOpenFiles))
+	}
+	if len(exceeded) > 0 {
+		w.strikes++
+	} else {
+		w.strikes = 0
+	}
+	sample.Limits = l
+	sample.Exceeded = exceeded
+	w.last = &sample
+	return exceeded, w.strikes, l.Restart && w.strikes >= watchdogStrikes
+}
+
+// status returns the health section, or nil before the first sample.
+func (w *watchdog) status() *WatchdogStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.last == nil {
+		return nil
+	}
+	status := *w.last
+	return &status
+}
+
+// sampleResources measures this process.
+func sampleResources(now time.Time) WatchdogStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return WatchdogStatus{
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		OpenFiles:  countOpenFiles(),
+		SampledAt:  now.UTC(),
+	}
+}
+
+// countOpenFiles returns the number of open file descriptors, or 0 where
+// they can't be listed.
+func countOpenFiles() int {
+	dir := "/proc/self/fd"
+	if runtime.GOOS == "darwin" {
+		dir = "/dev/fd"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	// Reading the directory opened one more
+	return len(entries) - 1
+}
+
+// watchResources samples the proxy's resources until it stops.
+func (s *Server) watchResources() {
+	s.checkResources(time.Now())
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkResources(time.Now())
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// checkResources takes a sample, logs limits as they are crossed, and asks
+// for a restart when one has stayed exceeded. A restart waits while a
+// browser re-authentication is in progress.
+func (s *Server) checkResources(now time.Time) {
+	exceeded, strikes, restart := s.watchdog.record(sampleResources(now))
+	switch {
+	case len(exceeded) == 0:
+		return
+	case strikes == 1:
+		fmt.Fprintf(os.Stderr, "[proxy] WATCHDOG: over limit: %s\n", strings.Join(exceeded, ", "))
+		if strings.HasPrefix(exceeded[0], "goroutines") {
+			// Show where they are stuck, once, for the bug report
+			pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+		}
+	}
+	if !restart || (s.refresher != nil && s.refresher.GetReauthInProgress()) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[proxy] WATCHDOG: over limit for %d checks (%s), restarting\n", strikes, strings.Join(exceeded, ", "))
+	s.restartOnce.Do(func() { close(s.restart) })
+}
+
+// RestartRequested is closed when the watchdog wants the proxy restarted.
+// Whatever runs the server should then stop it and start a fresh one.
+func (s *Server) RestartRequested() <-chan struct{} {
+	return s.restart
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestWatchdog_Record(t *testing.T) {
+	var w watchdog
+	w.setLimits(config.Watchdog{MaxGoroutines: 100, Restart: true})
+	if got := w.status(); got != nil {
+		t.Errorf("status before first sample = %+v", got)
+	}
+
+	over := WatchdogStatus{Goroutines: 150, HeapBytes: 10 << 20}
+	for i := 1; i <= watchdogStrikes; i++ {
+		exceeded, strikes, restart := w.record(over)
+		if len(exceeded) != 1 || strikes != i || restart != (i == watchdogStrikes) {
+			t.Fatalf("sample %d: exceeded %v, strikes %d, restart %v", i, exceeded, strikes, restart)
+		}
+	}
+	status := w.status()
+	if status.Limits.MaxHeapMB != DefaultWatchdogMaxHeapMB || len(status.Exceeded) != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	// A sample under the limits resets the count
+	if _, strikes, _ := w.record(WatchdogStatus{Goroutines: 50}); strikes != 0 {
+		t.Errorf("strikes after recovery = %d", strikes)
+	}
+
+	// Without restart, limits are only logged
+	w.setLimits(config.Watchdog{MaxGoroutines: 100})
+	for i := 0; i < watchdogStrikes+1; i++ {
+		if _, _, restart := w.record(over); restart {
+			t.Fatal("restart requested with restart off")
+		}
+	}
+}
+
+func TestCheckResources_RequestsRestart(t *testing.T) {
+	tempDir := t.TempDir()
+	server, err := newServerInternal(&config.Config{
+		ConfigDir: tempDir,
+		TokenPath: tempDir + "/tokens.json",
+		Watchdog:  config.Watchdog{MaxGoroutines: 1, Restart: true},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < watchdogStrikes; i++ {
+		select {
+		case <-server.RestartRequested():
+			t.Fatalf("restart requested after %d checks", i)
+		default:
+		}
+		server.checkResources(now)
+	}
+	select {
+	case <-server.RestartRequested():
+	default:
+		t.Fatal("no restart requested")
+	}
+	server.checkResources(now) // must not close the channel twice
+
+	rec := httptest.NewRecorder()
+	server.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Watchdog *WatchdogStatus `json:"watchdog"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil || health.Watchdog == nil || health.Watchdog.Goroutines < 2 {
+		t.Errorf("health watchdog = %+v, %v", health.Watchdog, err)
+	}
+}
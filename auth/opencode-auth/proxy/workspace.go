@@ -0,0 +1,68 @@
+// Package proxy provides the active workspace. The proxy sends it upstream as
+// X-OpenCode-Workspace so the router attributes usage to it, and
+// 'opencode-auth workspace use' switches it through /api/config/reload
+// without waiting for the config watcher.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+// WorkspaceHeader carries the active workspace upstream.
+const WorkspaceHeader = "X-OpenCode-Workspace"
+
+// activeWorkspace holds the workspace requests are billed to.
+type activeWorkspace struct {
+	name atomic.Value // string
+}
+
+// set replaces the workspace and returns the previous one.
+func (a *activeWorkspace) set(name string) string {
+	prev, _ := a.name.Swap(name).(string)
+	return prev
+}
+
+func (a *activeWorkspace) current() string {
+	name, _ := a.name.Load().(string)
+	return name
+}
+
+// apply sets X-OpenCode-Workspace on an upstream request. Without an active
+// workspace the client's header, if the route forwards it, is left alone.
+func (a *activeWorkspace) apply(req *http.Request) {
+	if name := a.current(); name != "" {
+		req.Header.Set(WorkspaceHeader, name)
+	}
+}
+
+// ReloadResponse is the response of /api/config/reload.
+type ReloadResponse struct {
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// handleConfigReload applies config.json now rather than at the next config
+// watcher tick (POST).
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	oc, err := config.LoadOpenCodeConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[proxy] Warning: config reload failed: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	s.reloadTunables(oc)
+	json.NewEncoder(w).Encode(ReloadResponse{Workspace: s.workspace.current()})
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/auth"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+)
+
+func TestWorkspace(t *testing.T) {
+	var upstream []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = append(upstream, r.Header.Get(WorkspaceHeader))
+	}))
+	defer backend.Close()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OPENCODE_SYSTEM_CONFIG", filepath.Join(home, "none.json"))
+	tokenPath := filepath.Join(home, "tokens.json")
+	auth.SaveTokens(tokenPath, &auth.TokenData{IDToken: "token", ExpiresAt: time.Now().Add(time.Hour)})
+	cfg := &config.Config{ConfigDir: home, TokenPath: tokenPath, APIEndpoint: backend.URL, Workspace: "team-a"}
+	server, err := newServerInternal(cfg, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer front.Close()
+
+	send := func(clientWorkspace string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", front.URL+"/v1/models", nil)
+		if clientWorkspace != "" {
+			req.Header.Set(WorkspaceHeader, clientWorkspace)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// The active workspace replaces the client's
+	send("")
+	send("team-b")
+
+	// Switching through the reload endpoint applies to the next request
+	writeConfig := func(oc map[string]interface{}) {
+		t.Helper()
+		data, _ := json.Marshal(oc)
+		os.MkdirAll(filepath.Join(home, ".opencode"), 0o700)
+		if err := os.WriteFile(filepath.Join(home, ".opencode", "config.json"), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func() (int, ReloadResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		server.handleConfigReload(rec, httptest.NewRequest("POST", "/api/config/reload", nil))
+		var resp ReloadResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	writeConfig(map[string]interface{}{"client_id": "x", "workspace": "team-c"})
+	if code, resp := reload(); code != http.StatusOK || resp.Workspace != "team-c" {
+		t.Fatalf("reload = %d, %+v", code, resp)
+	}
+	send("")
+
+	// An unlisted workspace is not sent, nor by default the client's
+	writeConfig(map[string]interface{}{"client_id": "x", "workspace": "team-c", "workspaces": []map[string]string{{"name": "team-a"}}})
+	if code, resp := reload(); code != http.StatusOK || resp.Workspace != "" {
+		t.Fatalf("reload with an unlisted workspace = %d, %+v", code, resp)
+	}
+	send("")
+	send("team-b")
+
+	want := []string{"team-a", "team-a", "team-c", "", ""}
+	if len(upstream) != len(want) {
+		t.Fatalf("upstream got %q, want %q", upstream, want)
+	}
+	for i := range want {
+		if upstream[i] != want[i] {
+			t.Errorf("upstream got %q, want %q", upstream, want)
+			break
+		}
+	}
+}
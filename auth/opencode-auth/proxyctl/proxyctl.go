@@ -0,0 +1,301 @@
+// Package proxyctl controls the local auth proxy from other programs: it
+// starts the proxy or restarts a stale one, and asks it for a valid token.
+// The 'oc' launcher and 'opencode-auth token' are built on it.
+//
+// This package is part of the module's stable API; see docs/LOCAL-PROXY.md
+// ("Embedding in Go tools").
+package proxyctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxy"
+)
+
+// Statuses returned by EnsureAuth.
+const (
+	StatusOK               = "ok"
+	StatusReauthRequired   = "reauth_required"
+	StatusReauthInProgress = "reauth_in_progress"
+)
+
+// ensureAttempts is how often EnsureAuth asks again while the proxy rate
+// limits it.
+const ensureAttempts = 3
+
+// startupDelay gives a freshly started proxy time to initialize its refresher.
+const startupDelay = 500 * time.Millisecond
+
+// Proxy describes the running proxy after Ensure.
+type Proxy struct {
+	URL     string
+	Started bool
+	// Restarted is why a running proxy was replaced, or empty
+	Restarted string
+}
+
+// Health is the health status response from the proxy.
+type Health struct {
+	Status    string `json:"status"`
+	Port      int    `json:"port"`
+	Target    string `json:"target"`
+	Timestamp string `json:"timestamp"`
+	Refresher *struct {
+		Running          bool      `json:"running"`
+		LastRefresh      time.Time `json:"last_refresh"`
+		RetryCount       int       `json:"retry_count"`
+		NeedsReauth      bool      `json:"needs_reauth"`
+		ReauthInProgress bool      `json:"reauth_in_progress"`
+	} `json:"refresher,omitempty"`
+	StaticAuth   *proxy.StaticAuthStatus   `json:"static_auth,omitempty"`
+	APIKey       *proxy.APIKeyState        `json:"api_key,omitempty"`
+	Revocation   *proxy.RevocationState    `json:"revocation,omitempty"`
+	UsageBudget  *proxy.UsageBudgetStatus  `json:"usage_budget,omitempty"`
+	Workspace    string                    `json:"workspace,omitempty"`
+	Deprecations []proxy.DeprecationStatus `json:"deprecations,omitempty"`
+	RateLimits   *proxy.RateLimitsStatus   `json:"rate_limits,omitempty"`
+	Experiments  []proxy.ExperimentStatus  `json:"experiments,omitempty"`
+}
+
+// EnsureResponse is the response from the /api/auth/ensure endpoint.
+type EnsureResponse struct {
+	Status           string `json:"status"`
+	ReauthInProgress bool   `json:"reauth_in_progress,omitempty"`
+	Message          string `json:"message,omitempty"`
+}
+
+// TokenStatus is the response from the /api/token/status endpoint.
+type TokenStatus struct {
+	Valid            bool      `json:"valid"`
+	AuthMode         string    `json:"auth_mode,omitempty"`
+	ExpiresIn        string    `json:"expires_in,omitempty"`
+	Email            string    `json:"email,omitempty"`
+	NeedsReauth      bool      `json:"needs_reauth"`
+	ReauthInProgress bool      `json:"reauth_in_progress"`
+	ExpiresAt        time.Time `json:"expires_at,omitempty"`
+}
+
+// Ensure makes sure a proxy for the installed configuration is running.
+// See EnsureConfig.
+func Ensure(ctx context.Context) (*Proxy, error) {
+	cfg, err := config.Load()
+	if cfg == nil {
+		return nil, err
+	}
+	return EnsureConfig(ctx, cfg)
+}
+
+// EnsureConfig starts the proxy for cfg if none is running. A running proxy
+// with another target, or started by another client version
+// (cfg.ClientVersion), is restarted.
+func EnsureConfig(ctx context.Context, cfg *config.Config) (*Proxy, error) {
+	proxyURL, err := proxy.GetProxyURL(cfg)
+	if err != nil {
+		proxyConfig, err := proxy.StartProxy(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start proxy: %w", err)
+		}
+		if err := sleep(ctx, startupDelay); err != nil {
+			return nil, err
+		}
+		return &Proxy{URL: fmt.Sprintf("http://localhost:%d", proxyConfig.Port), Started: true}, nil
+	}
+
+	// Verify proxy config matches current config (catches stale proxy after update)
+	p := &Proxy{URL: proxyURL}
+	running, err := proxy.LoadProxyConfig(cfg)
+	if err != nil {
+		return p, nil
+	}
+	expectedTarget := strings.TrimSuffix(cfg.APIEndpoint, "/v1")
+	if running.TargetURL != expectedTarget {
+		p.Restarted = fmt.Sprintf("Proxy target changed (%s → %s)", running.TargetURL, expectedTarget)
+	} else if running.ClientVersion != "" && cfg.ClientVersion != "" && running.ClientVersion != cfg.ClientVersion {
+		p.Restarted = fmt.Sprintf("Proxy version changed (v%s → v%s)", running.ClientVersion, cfg.ClientVersion)
+	}
+	if p.Restarted == "" {
+		return p, nil
+	}
+
+	// A new version can take over without dropping requests. The old proxy
+	// starts its own executable, which an update has replaced in place. A
+	// new target may come from this process's environment, which the
+	// replacement would not see.
+	if running.TargetURL == expectedTarget && runtime.GOOS != "windows" {
+		replaced, err := proxy.HandoverProxy(cfg)
+		if err == nil && replaced.ClientVersion == cfg.ClientVersion {
+			p.URL = fmt.Sprintf("http://localhost:%d", replaced.Port)
+			return p, nil
+		}
+	}
+
+	proxy.StopProxy(cfg)
+	if err := sleep(ctx, startupDelay); err != nil {
+		return nil, err
+	}
+	restarted, err := proxy.StartProxy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restart proxy: %w", err)
+	}
+	p.URL = fmt.Sprintf("http://localhost:%d", restarted.Port)
+	return p, sleep(ctx, startupDelay)
+}
+
+// CheckHealth queries the proxy health endpoint.
+func CheckHealth(ctx context.Context, proxyURL string) (*Health, error) {
+	var health Health
+	if err := getJSON(ctx, "GET", proxyURL+"/health", &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// EnsureAuth asks the proxy to make sure it has a valid token, refreshing
+// it or starting browser sign-in as needed.
+// A rate-limited call is retried after the proxy's Retry-After.
+func EnsureAuth(ctx context.Context, proxyURL string) (*EnsureResponse, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", proxyURL+"/api/auth/ensure", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var ensureResp EnsureResponse
+		err = json.NewDecoder(resp.Body).Decode(&ensureResp)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < ensureAttempts {
+			wait := time.Second
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 && secs <= 10 {
+				wait = time.Duration(secs) * time.Second
+			}
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &ensureResp, nil
+	}
+}
+
+// ReloadConfig makes the proxy apply config.json now instead of at its next
+// config check.
+func ReloadConfig(ctx context.Context, proxyURL string) (*proxy.ReloadResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", proxyURL+"/api/config/reload", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return nil, fmt.Errorf("proxy returned %s: %s", resp.Status, errResp.Error)
+	}
+	var reload proxy.ReloadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reload); err != nil {
+		return nil, err
+	}
+	return &reload, nil
+}
+
+// ExchangeToken asks the proxy for a child token scoped to req, for a helper
+// tool that should not see the user's tokens.
+func ExchangeToken(ctx context.Context, proxyURL string, req proxy.ExchangeRequest) (*proxy.ExchangeResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", proxyURL+"/api/token/exchange", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var exchange proxy.ExchangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&exchange); err != nil {
+		return nil, fmt.Errorf("proxy returned %s (restart it if it predates token exchange)", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy returned %s: %s", resp.Status, exchange.Error)
+	}
+	return &exchange, nil
+}
+
+// WaitForReauth polls the proxy until re-authentication completes, fails,
+// or timeout passes.
+func WaitForReauth(ctx context.Context, proxyURL string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	pollInterval := 2 * time.Second
+
+	for time.Now().Before(deadline) {
+		var status TokenStatus
+		if err := getJSON(ctx, "GET", proxyURL+"/api/token/status", &status); err == nil {
+			// If valid, reauth succeeded
+			if status.Valid {
+				return nil
+			}
+			// If not in progress and needs reauth, something went wrong
+			if !status.ReauthInProgress && status.NeedsReauth {
+				return fmt.Errorf("re-authentication failed")
+			}
+		}
+		if err := sleep(ctx, pollInterval); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("re-authentication timed out after %v", timeout)
+}
+
+// getJSON sends a request without a body and decodes the JSON response.
+func getJSON(ctx context.Context, method, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sleep waits for d, returning ctx's error if it is cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
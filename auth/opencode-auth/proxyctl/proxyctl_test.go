@@ -0,0 +1,86 @@
+package proxyctl
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/proxy"
+)
+
+func TestEnsureConfig_Running(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "healthy", "target": "https://api.example.com"})
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	cfg := &config.Config{ConfigDir: t.TempDir(), APIEndpoint: "https://api.example.com/v1", ClientVersion: "1.2.0"}
+	proxy.SaveProxyConfig(cfg, &proxy.ProxyConfig{Port: port, PID: os.Getpid(), TargetURL: "https://api.example.com", ClientVersion: "1.2.0"})
+
+	p, err := EnsureConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Started || p.Restarted != "" || p.URL == "" {
+		t.Errorf("proxy = %+v, want the running proxy reused", p)
+	}
+
+	health, err := CheckHealth(context.Background(), p.URL)
+	if err != nil || health.Status != "healthy" {
+		t.Errorf("CheckHealth = %+v, %v", health, err)
+	}
+}
+
+func TestWaitForReauth(t *testing.T) {
+	var polls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		json.NewEncoder(w).Encode(TokenStatus{Valid: polls > 1, ReauthInProgress: true})
+	}))
+	defer srv.Close()
+
+	if err := WaitForReauth(context.Background(), srv.URL, 10*time.Second); err != nil {
+		t.Errorf("WaitForReauth: %v", err)
+	}
+
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TokenStatus{NeedsReauth: true})
+	}))
+	defer failed.Close()
+	if err := WaitForReauth(context.Background(), failed.URL, 10*time.Second); err == nil {
+		t.Error("WaitForReauth succeeded after a failed reauth")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WaitForReauth(ctx, srv.URL, 10*time.Second); err == nil {
+		t.Error("WaitForReauth ignored a cancelled context")
+	}
+}
+
+func TestEnsureAuthRateLimited(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(EnsureResponse{Status: "rate_limited"})
+			return
+		}
+		json.NewEncoder(w).Encode(EnsureResponse{Status: StatusOK})
+	}))
+	defer srv.Close()
+
+	resp, err := EnsureAuth(context.Background(), srv.URL)
+	if err != nil || resp.Status != StatusOK || calls != 2 {
+		t.Errorf("EnsureAuth = %+v, %v after %d calls; want ok after 2", resp, err, calls)
+	}
+}
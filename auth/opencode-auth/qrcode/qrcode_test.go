@@ -0,0 +1,80 @@
+package qrcode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	// Checked against a reference encoder
+	golden := []string{
+		"111111100100101111111",
+		"100000101001001000001",
+		"101110100100001011101",
+		"101110101001001011101",
+		"101110100011101011101",
+		"100000101110101000001",
+		"111111101010101111111",
+		"000000000011100000000",
+		"111110111100110101010",
+		"101001000010100100001",
+		"010001110011010011110",
+		"111101010000000110100",
+		"101011100101010010101",
+		"000000001011111001001",
+		"111111101000101100010",
+		"100000100111111001001",
+		"101110101010100100100",
+		"101110101100100100100",
+		"101110101001010011100",
+		"100000101100000110100",
+		"111111101111010011110",
+	}
+	c, err := Encode("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != 1 || c.Size() != 21 {
+		t.Fatalf("Encode(\"hi\") version %d size %d, want 1 and 21", c.Version, c.Size())
+	}
+	for y, row := range golden {
+		for x, m := range row {
+			if c.Dark(x, y) != (m == '1') {
+				t.Fatalf("module (%d, %d) = %v, want %c", x, y, c.Dark(x, y), m)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		length, version int
+	}{
+		{17, 1},
+		{18, 2},
+		{330, 12}, // a typical sign-in URL
+		{2953, 40},
+	} {
+		c, err := Encode(strings.Repeat("x", tc.length))
+		if err != nil || c.Version != tc.version || c.Size() != 4*tc.version+17 {
+			t.Errorf("Encode(%d bytes) = version %v, %v; want %d", tc.length, c, err, tc.version)
+		}
+	}
+	if _, err := Encode(strings.Repeat("x", 2954)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Encode(2954 bytes) error = %v, want ErrTooLong", err)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	c, _ := Encode("hi")
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	// 21 modules plus a quiet zone of 2 on each side, two rows per line
+	if len(lines) != 13 {
+		t.Fatalf("Terminal() has %d lines, want 13", len(lines))
+	}
+	if first := lines[0]; !strings.HasPrefix(first, "\033[30;47m") || strings.Count(first, " ") != 25 {
+		t.Errorf("quiet zone line = %q", first)
+	}
+	if !strings.Contains(lines[1], "█▀▀▀▀▀█") {
+		t.Errorf("finder top edge missing: %q", lines[1])
+	}
+}
@@ -0,0 +1,181 @@
+package secret
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// SealedPrefix marks a config value encrypted with Seal. The rest is
+	// unpadded standard base64 of
+	//
+	//	ephemeral X25519 public key (32 bytes)
+	//	AES-256-GCM nonce (12 bytes)
+	//	AES-256-GCM ciphertext and tag of the value (len(value)+16 bytes)
+	//
+	// The AES key is HKDF-SHA256 (RFC 5869) of the X25519 shared secret,
+	// with salt ephemeral public key || recipient public key and info
+	// sealInfo. The field name, e.g. "api_key", is the additional data.
+	SealedPrefix = "enc:v1:"
+
+	// ConfigKeyAccount is the keychain account holding the private key that
+	// decrypts sealed config values.
+	ConfigKeyAccount = "config-key"
+
+	// sealInfo separates these keys from any other use of the shared secret
+	sealInfo = "opencode-auth config v1"
+)
+
+// IsSealed reports whether value was produced by Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, SealedPrefix)
+}
+
+// GenerateConfigKey returns a new private key for sealing config values.
+func GenerateConfigKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodeKey returns the base64 form of a key, as stored in the keychain
+// (private) and config.json (public).
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodePublicKey parses a recipient written by EncodeKey.
+func DecodePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+func decodePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid config key: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// Seal encrypts the value of field (e.g. "api_key") to recipient in the
+// format described at SealedPrefix, in the manner of age: a fresh ephemeral
+// key agrees a secret with the recipient, HKDF turns it into an AES-256-GCM
+// key, and the field name is authenticated so a value can't be moved to
+// another field. Writers only need the public key, which is stored in
+// config.json; the private key stays in the keychain.
+func Seal(recipient *ecdh.PublicKey, field, value string) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	aead, err := sealCipher(shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	out = aead.Seal(out, nonce, []byte(value), []byte(field))
+	return SealedPrefix + base64.RawStdEncoding.EncodeToString(out), nil
+}
+
+// Open decrypts a value Seal encrypted for field.
+func Open(key *ecdh.PrivateKey, field, sealed string) (string, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(sealed, SealedPrefix))
+	if !IsSealed(sealed) || err != nil || len(raw) < 32 {
+		return "", fmt.Errorf("%s is not a sealed value", field)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(raw[:32])
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", field, err)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", field, err)
+	}
+	aead, err := sealCipher(shared, ephemeral, key.PublicKey())
+	if err != nil {
+		return "", err
+	}
+	rest := raw[32:]
+	if len(rest) < aead.NonceSize() {
+		return "", fmt.Errorf("%s is not a sealed value", field)
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("%s could not be decrypted with the keychain's config key", field)
+	}
+	return string(plain), nil
+}
+
+// sealCipher derives the AES-GCM cipher from the X25519 shared secret with
+// HKDF-SHA256, salted with both public keys as in age.
+func sealCipher(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(sealInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var configKey struct {
+	mu  sync.Mutex
+	key *ecdh.PrivateKey
+}
+
+// ConfigKey returns the private key in the keychain, caching it for the
+// life of the process.
+func ConfigKey(ctx context.Context) (*ecdh.PrivateKey, error) {
+	configKey.mu.Lock()
+	defer configKey.mu.Unlock()
+	if configKey.key != nil {
+		return configKey.key, nil
+	}
+	value, err := KeychainGet(ctx, ConfigKeyAccount)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodePrivateKey(value)
+	if err != nil {
+		return nil, err
+	}
+	configKey.key = key
+	return key, nil
+}
+
+// StoreConfigKey saves key in the keychain as the config key. KeychainSet
+// hands it to the keychain on stdin, so it never appears in a process list.
+func StoreConfigKey(ctx context.Context, key *ecdh.PrivateKey) error {
+	if err := KeychainSet(ctx, ConfigKeyAccount, EncodeKey(key.Bytes())); err != nil {
+		return err
+	}
+	configKey.mu.Lock()
+	configKey.key = key
+	configKey.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,63 @@
+package secret
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := GenerateConfigKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := DecodePublicKey(EncodeKey(key.PublicKey().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := Seal(recipient, "api_key", "oc_secret_value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, "oc_secret_value") {
+		t.Fatalf("Seal() = %q", sealed)
+	}
+	if got, err := Open(key, "api_key", sealed); err != nil || got != "oc_secret_value" {
+		t.Errorf("Open() = %q, %v", got, err)
+	}
+
+	// Each seal uses a fresh ephemeral key
+	if again, _ := Seal(recipient, "api_key", "oc_secret_value"); again == sealed {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+
+	other, _ := GenerateConfigKey()
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+	for name, open := range map[string]func() (string, error){
+		"other field": func() (string, error) { return Open(key, "otel_headers", sealed) },
+		"other key":   func() (string, error) { return Open(other, "api_key", sealed) },
+		"tampered":    func() (string, error) { return Open(key, "api_key", tampered) },
+		"plaintext":   func() (string, error) { return Open(key, "api_key", "oc_plain") },
+		"truncated":   func() (string, error) { return Open(key, "api_key", SealedPrefix+"AAAA") },
+	} {
+		if got, err := open(); err == nil {
+			t.Errorf("%s: Open() = %q, want error", name, got)
+		}
+	}
+}
+
+// TestOpenV1 opens a value sealed by an earlier release, so the format
+// documented at SealedPrefix stays readable.
+func TestOpenV1(t *testing.T) {
+	key, err := decodePrivateKey("HPQ/1y4AjbBdcQgJW8C7lLJ753FfoR/iqLHSV+RO/Cw=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := "enc:v1:ADjS3d0nyL0kfAxPA1MoDFwX4QMpBR9NOKINAkkq1CnTs5fuL36U6ijna3eLWUBokg+WR4vBcn2RV8OjXnZGokK0HsPjyEgw"
+	if got, err := Open(key, "api_key", sealed); err != nil || got != "oc_vector123" {
+		t.Errorf("Open() = %q, %v", got, err)
+	}
+}
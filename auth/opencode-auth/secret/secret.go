@@ -0,0 +1,177 @@
+// Package secret resolves secrets (such as the API key) from backends other
+// than plaintext config: the OS keychain or an external command.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// KeychainService is the service name used for keychain entries.
+	KeychainService = "opencode-auth"
+
+	// KeychainPrefix marks a config reference as a keychain account name,
+	// e.g. "keychain:api-key".
+	KeychainPrefix = "keychain:"
+
+	// commandTimeout bounds how long an external secret command may run.
+	commandTimeout = 10 * time.Second
+)
+
+// ParseRef splits a secret reference into backend and name.
+// Only the "keychain" backend is currently supported.
+func ParseRef(ref string) (backend, name string, err error) {
+	if strings.HasPrefix(ref, KeychainPrefix) {
+		name = strings.TrimPrefix(ref, KeychainPrefix)
+		if name == "" {
+			return "", "", fmt.Errorf("empty keychain account in reference %q", ref)
+		}
+		return "keychain", name, nil
+	}
+	return "", "", fmt.Errorf("unsupported secret reference %q (expected %s<account>)", ref, KeychainPrefix)
+}
+
+// Resolve returns the secret for a reference such as "keychain:api-key".
+func Resolve(ctx context.Context, ref string) (string, error) {
+	backend, name, err := ParseRef(ref)
+	if err != nil {
+		return "", err
+	}
+	switch backend {
+	case "keychain":
+		return KeychainGet(ctx, name)
+	}
+	return "", fmt.Errorf("unsupported secret backend %q", backend)
+}
+
+// RunCommand runs a shell command and returns its trimmed stdout as the secret.
+// The command must exit 0 and print a non-empty value.
+func RunCommand(ctx context.Context, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/c", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("secret command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	value := strings.TrimSpace(stdout.String())
+	if value == "" {
+		return "", fmt.Errorf("secret command produced no output")
+	}
+	return value, nil
+}
+
+// KeychainGet reads a secret from the OS keychain.
+// Supports macOS (security) and Linux (secret-tool from libsecret).
+func KeychainGet(ctx context.Context, account string) (string, error) {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "security", "find-generic-password",
+			"-s", KeychainService, "-a", account, "-w")
+	case "linux":
+		cmd = exec.CommandContext(ctx, "secret-tool", "lookup",
+			"service", KeychainService, "account", account)
+	default:
+		return "", fmt.Errorf("keychain not supported on %s; use api_key_cmd instead", runtime.GOOS)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keychain lookup for %q failed: %w", account, err)
+	}
+	value := strings.TrimSpace(string(out))
+	if value == "" {
+		return "", fmt.Errorf("keychain entry %q is empty", account)
+	}
+	return value, nil
+}
+
+// KeychainSet stores a secret in the OS keychain, replacing any existing entry.
+// The secret is written to the helper's stdin, never put on its command
+// line, where other processes could read it.
+func KeychainSet(ctx context.Context, account, value string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		// security -i reads the command, password included, from stdin
+		line, err := addGenericPasswordLine(account, value)
+		if err != nil {
+			return err
+		}
+		cmd = exec.CommandContext(ctx, "security", "-i")
+		cmd.Stdin = strings.NewReader(line)
+	case "linux":
+		// secret-tool reads the secret from stdin
+		cmd = exec.CommandContext(ctx, "secret-tool", "store",
+			"--label", "OpenCode Auth ("+account+")",
+			"service", KeychainService, "account", account)
+		cmd.Stdin = strings.NewReader(value)
+	default:
+		return fmt.Errorf("keychain not supported on %s", runtime.GOOS)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("keychain store for %q failed: %w: %s", account, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// addGenericPasswordLine returns the security -i command storing value.
+// -U updates the entry if it already exists.
+func addGenericPasswordLine(account, value string) (string, error) {
+	if strings.ContainsAny(account+value, "\r\n") {
+		return "", fmt.Errorf("keychain entry %q can't contain a line break", account)
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -w \"%s\"\n",
+		quote.Replace(KeychainService), quote.Replace(account), quote.Replace(value)), nil
+}
+
+// KeychainDelete removes a secret from the OS keychain. A missing entry is
+// not an error.
+func KeychainDelete(ctx context.Context, account string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "security", "delete-generic-password",
+			"-s", KeychainService, "-a", account)
+	case "linux":
+		// secret-tool clear succeeds when nothing matches
+		cmd = exec.CommandContext(ctx, "secret-tool", "clear",
+			"service", KeychainService, "account", account)
+	default:
+		return fmt.Errorf("keychain not supported on %s", runtime.GOOS)
+	}
+
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	// security exits with 44 when the item could not be found
+	if runtime.GOOS == "darwin" && errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keychain delete for %q failed: %w: %s", account, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package secret
+
+import (
+	"context"
+	"runtime"
+	"testing"
+)
+
+func TestParseRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		backend string
+		name    string
+		wantErr bool
+	}{
+		{"keychain:api-key", "keychain", "api-key", false},
+		{"keychain:", "", "", true},
+		{"vault:secret/api-key", "", "", true},
+		{"", "", "", true},
+	}
+
+	for _, tt := range tests {
+		backend, name, err := ParseRef(tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRef(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			continue
+		}
+		if backend != tt.backend || name != tt.name {
+			t.Errorf("ParseRef(%q) = (%q, %q), want (%q, %q)", tt.ref, backend, name, tt.backend, tt.name)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+
+	got, err := RunCommand(context.Background(), "echo '  oc_secret123  '")
+	if err != nil {
+		t.Fatalf("RunCommand() error = %v", err)
+	}
+	if got != "oc_secret123" {
+		t.Errorf("RunCommand() = %q, want %q", got, "oc_secret123")
+	}
+}
+
+func TestRunCommand_Failure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+
+	if _, err := RunCommand(context.Background(), "exit 3"); err == nil {
+		t.Error("RunCommand() expected error for non-zero exit")
+	}
+	if _, err := RunCommand(context.Background(), "true"); err == nil {
+		t.Error("RunCommand() expected error for empty output")
+	}
+}
+
+func TestAddGenericPasswordLine(t *testing.T) {
+	got, err := addGenericPasswordLine("api-key", `oc_a"b\c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `add-generic-password -U -s "opencode-auth" -a "api-key" -w "oc_a\"b\\c"` + "\n"; got != want {
+		t.Errorf("addGenericPasswordLine() = %q, want %q", got, want)
+	}
+	if _, err := addGenericPasswordLine("api-key", "oc_a\nquit"); err == nil {
+		t.Error("addGenericPasswordLine() accepted a line break")
+	}
+}
@@ -0,0 +1,141 @@
+// Package smoke implements an end-to-end round trip through the local proxy
+// and router, used to validate a new deployment.
+package smoke
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultModel is a cheap, fast model alias used for the completion step.
+const DefaultModel = "glm-4-flash"
+
+// Result is the outcome of a single smoke test step.
+type Result struct {
+	Name     string
+	Duration time.Duration
+	Detail   string
+	Err      error
+}
+
+// Step runs fn and records its latency and outcome.
+func Step(name string, fn func() (string, error)) Result {
+	start := time.Now()
+	detail, err := fn()
+	return Result{Name: name, Duration: time.Since(start), Detail: detail, Err: err}
+}
+
+// CheckHealth calls the proxy /health endpoint and returns its status.
+func CheckHealth(ctx context.Context, proxyURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", proxyURL+"/health", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("health request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var health struct {
+		Status string `json:"status"`
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return "", fmt.Errorf("parsing health response: %w", err)
+	}
+	if health.Status != "healthy" {
+		return "", fmt.Errorf("proxy status %q", health.Status)
+	}
+	return "target " + health.Target, nil
+}
+
+// StreamCompletion sends a minimal streaming chat completion through the
+// proxy and verifies that at least one content chunk and the [DONE] marker
+// arrive. It returns the time to first token as detail.
+func StreamCompletion(ctx context.Context, proxyURL, model string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":      model,
+		"stream":     true,
+		"max_tokens": 8,
+		"messages": []map[string]string{
+			{"role": "user", "content": "Reply with the single word: ok"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", proxyURL+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("completion request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("completion returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var firstToken time.Duration
+	var content strings.Builder
+	done := false
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("invalid stream chunk: %w", err)
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta.Content != "" && firstToken == 0 {
+				firstToken = time.Since(start)
+			}
+			content.WriteString(c.Delta.Content)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading stream: %w", err)
+	}
+
+	if content.Len() == 0 {
+		return "", fmt.Errorf("stream contained no content")
+	}
+	if !done {
+		return "", fmt.Errorf("stream ended without [DONE]")
+	}
+
+	return fmt.Sprintf("model %s, first token after %s, reply %q",
+		model, firstToken.Round(time.Millisecond), strings.TrimSpace(content.String())), nil
+}
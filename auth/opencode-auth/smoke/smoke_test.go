@@ -0,0 +1,71 @@
+package smoke
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sseServer(t *testing.T, chunks ...string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, c := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", c)
+		}
+	}))
+}
+
+func TestStreamCompletion_Success(t *testing.T) {
+	srv := sseServer(t,
+		`{"choices":[{"delta":{"role":"assistant"}}]}`,
+		`{"choices":[{"delta":{"content":"ok"}}]}`,
+		"[DONE]",
+	)
+	defer srv.Close()
+
+	detail, err := StreamCompletion(context.Background(), srv.URL, DefaultModel)
+	if err != nil {
+		t.Fatalf("StreamCompletion() error = %v", err)
+	}
+	if !strings.Contains(detail, `"ok"`) {
+		t.Errorf("detail = %q, want it to contain the reply", detail)
+	}
+}
+
+func TestStreamCompletion_MissingDone(t *testing.T) {
+	srv := sseServer(t, `{"choices":[{"delta":{"content":"ok"}}]}`)
+	defer srv.Close()
+
+	if _, err := StreamCompletion(context.Background(), srv.URL, DefaultModel); err == nil {
+		t.Error("expected error when stream ends without [DONE]")
+	}
+}
+
+func TestStreamCompletion_NoContent(t *testing.T) {
+	srv := sseServer(t, `{"choices":[{"delta":{}}]}`, "[DONE]")
+	defer srv.Close()
+
+	if _, err := StreamCompletion(context.Background(), srv.URL, DefaultModel); err == nil {
+		t.Error("expected error for empty stream")
+	}
+}
+
+func TestStreamCompletion_HTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "unauthorized"}`))
+	}))
+	defer srv.Close()
+
+	_, err := StreamCompletion(context.Background(), srv.URL, DefaultModel)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+}
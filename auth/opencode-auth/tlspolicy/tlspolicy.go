@@ -0,0 +1,131 @@
+// Package tlspolicy applies an organization's minimum TLS version and
+// cipher suites to the connections this program makes: the proxy's
+// upstream transport, the sign-in and token refresh, and discovery. Go's
+// defaults (TLS 1.2 and up, its own suite order) apply when no policy is
+// set.
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/tracelog"
+)
+
+// versions are the tls_min_version values, by name.
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Policy is a minimum TLS version and the cipher suites allowed below
+// TLS 1.3. A nil *Policy leaves Go's defaults.
+type Policy struct {
+	MinVersion   uint16
+	CipherSuites []uint16
+}
+
+// Status describes a policy for diagnostics.
+type Status struct {
+	MinVersion   string   `json:"min_version,omitempty"`
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+}
+
+// New checks a minimum version ("1.2", "1.3") and cipher suite names (as
+// in crypto/tls, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"), and returns
+// them as a Policy, or nil when both are empty. TLS 1.3 suites are not
+// configurable, so naming one, or any suite with a 1.3 minimum, is an
+// error.
+func New(minVersion string, cipherSuites []string) (*Policy, error) {
+	if minVersion == "" && len(cipherSuites) == 0 {
+		return nil, nil
+	}
+	p := &Policy{}
+	if minVersion != "" {
+		v, ok := versions[strings.TrimSpace(minVersion)]
+		if !ok {
+			return nil, fmt.Errorf("tls_min_version %q is not one of 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		p.MinVersion = v
+	}
+	if len(cipherSuites) > 0 && p.MinVersion == tls.VersionTLS13 {
+		return nil, fmt.Errorf("tls_cipher_suites has no effect with tls_min_version 1.3: TLS 1.3 suites are not configurable")
+	}
+	for _, name := range cipherSuites {
+		id, err := suiteID(name)
+		if err != nil {
+			return nil, err
+		}
+		p.CipherSuites = append(p.CipherSuites, id)
+	}
+	return p, nil
+}
+
+// suiteID returns the ID of a secure TLS 1.2 cipher suite.
+func suiteID(name string) (uint16, error) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name != name {
+			continue
+		}
+		for _, v := range s.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return s.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("tls_cipher_suites: %s is a TLS 1.3 suite, which is not configurable", name)
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		if s.Name == name {
+			return 0, fmt.Errorf("tls_cipher_suites: %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("tls_cipher_suites: unknown cipher suite %q", name)
+}
+
+// Apply sets the policy on c, creating it if nil, and returns it.
+func (p *Policy) Apply(c *tls.Config) *tls.Config {
+	if p == nil {
+		return c
+	}
+	if c == nil {
+		c = &tls.Config{}
+	}
+	if p.MinVersion != 0 {
+		c.MinVersion = p.MinVersion
+	}
+	if len(p.CipherSuites) > 0 {
+		c.CipherSuites = append([]uint16(nil), p.CipherSuites...)
+	}
+	return c
+}
+
+// Status returns the policy for diagnostics, or nil.
+func (p *Policy) Status() *Status {
+	if p == nil {
+		return nil
+	}
+	st := &Status{}
+	if p.MinVersion != 0 {
+		st.MinVersion = tls.VersionName(p.MinVersion)
+	}
+	for _, id := range p.CipherSuites {
+		st.CipherSuites = append(st.CipherSuites, tls.CipherSuiteName(id))
+	}
+	return st
+}
+
+// Install applies p to http.DefaultTransport, used by the sign-in, token
+// refresh, discovery and other plain HTTP clients. Transports cloned from
+// it afterwards keep the policy.
+func Install(p *Policy) {
+	if p == nil {
+		return
+	}
+	if t, ok := tracelog.Unwrap(http.DefaultTransport).(*http.Transport); ok {
+		t.TLSClientConfig = p.Apply(t.TLSClientConfig)
+	}
+}
@@ -0,0 +1,69 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		suites     []string
+		wantErr    string
+	}{
+		{"tls 1.3", "1.3", nil, ""},
+		{"tls 1.2 with suites", "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, ""},
+		{"unknown version", "1.4", nil, `tls_min_version "1.4"`},
+		{"suites with tls 1.3", "1.3", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, "no effect with tls_min_version 1.3"},
+		{"tls 1.3 suite", "", []string{"TLS_AES_128_GCM_SHA256"}, "is a TLS 1.3 suite"},
+		{"insecure suite", "", []string{"TLS_RSA_WITH_RC4_128_SHA"}, "is insecure"},
+		{"unknown suite", "", []string{"TLS_NULL"}, `unknown cipher suite "TLS_NULL"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.minVersion, tt.suites)
+			if tt.wantErr == "" {
+				if err != nil || p == nil {
+					t.Errorf("New() = %v, %v", p, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if p, err := New("", nil); p != nil || err != nil {
+		t.Errorf("New() with no policy = %v, %v, want nil", p, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	p, err := New("1.3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = p.Apply(transport.TLSClientConfig)
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Error("a TLS 1.2 server was accepted with tls_min_version 1.3")
+	}
+
+	var nilPolicy *Policy
+	if c := nilPolicy.Apply(nil); c != nil {
+		t.Errorf("nil Apply(nil) = %v, want nil", c)
+	}
+	if st := p.Status(); st.MinVersion != "TLS 1.3" {
+		t.Errorf("Status() = %+v", st)
+	}
+}
@@ -0,0 +1,332 @@
+// Package tokenverify checks a JWT the way the API's load balancer does
+// before a request reaches the router: the signature against the issuer's
+// JWKS, the issuer, a single-string aud equal to the CLI client ID, and the
+// expiry. 'opencode-auth token verify' uses it to debug rejected tokens from
+// end-user tickets.
+package tokenverify
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSize bounds the discovery document and JWKS fetched from the issuer
+const maxSize = 1 << 20
+
+// Token is a decoded, not yet verified, JWT.
+type Token struct {
+	Header Header
+	Claims map[string]interface{}
+
+	signingInput string
+	signature    []byte
+}
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// JWKS is an issuer's set of signing keys.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is one public key of a JWKS. RSA keys use N and E, EC keys Crv, X and Y.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Parse decodes a compact JWT without verifying it.
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(strings.TrimSpace(raw), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT: expected 3 dot-separated parts, got %d", len(parts))
+	}
+	t := &Token{signingInput: parts[0] + "." + parts[1]}
+	if err := decodePart(parts[0], &t.Header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if err := decodePart(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature encoding: %w", err)
+	}
+	t.signature = sig
+	return t, nil
+}
+
+func decodePart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// String returns the claim name as a string, or "" if it is not one.
+func (t *Token) String(name string) string {
+	s, _ := t.Claims[name].(string)
+	return s
+}
+
+// Time returns the numeric date claim name, or the zero time.
+func (t *Token) Time(name string) time.Time {
+	if n, ok := t.Claims[name].(float64); ok {
+		return time.Unix(int64(n), 0)
+	}
+	return time.Time{}
+}
+
+// Verify checks the token's signature with the key of keys its kid names.
+func (t *Token) Verify(keys *JWKS) error {
+	var key *JWK
+	for i := range keys.Keys {
+		if keys.Keys[i].Kid == t.Header.Kid {
+			key = &keys.Keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("no key with kid %q in the issuer's JWKS", t.Header.Kid)
+	}
+	if key.Alg != "" && key.Alg != t.Header.Alg {
+		return fmt.Errorf("token alg %s does not match key alg %s", t.Header.Alg, key.Alg)
+	}
+
+	var hash crypto.Hash
+	switch t.Header.Alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", t.Header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(t.signingInput))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(t.Header.Alg, "RS") && key.Kty == "RSA":
+		pub, err := key.rsaKey()
+		if err != nil {
+			return err
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, t.signature); err != nil {
+			return errors.New("signature does not verify")
+		}
+	case strings.HasPrefix(t.Header.Alg, "ES") && key.Kty == "EC":
+		pub, err := key.ecKey()
+		if err != nil {
+			return err
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errors.New("signature does not verify")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature does not verify")
+		}
+	default:
+		return fmt.Errorf("key %q is %s, not usable for %s", key.Kid, key.Kty, t.Header.Alg)
+	}
+	return nil
+}
+
+func (k *JWK) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSA key %q: %w", k.Kid, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid RSA key %q exponent", k.Kid)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (k *JWK) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q for key %q", k.Crv, k.Kid)
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil {
+		return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("invalid EC key %q: point is not on the curve", k.Kid)
+	}
+	return pub, nil
+}
+
+// Check is the result of one acceptance check.
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// Accepted reports whether every check passed.
+func Accepted(checks []Check) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks runs the load balancer's acceptance checks on t. sigErr is the
+// result of Verify, or of fetching the keys for it.
+func (t *Token) Checks(issuer, clientID string, sigErr error, now time.Time) []Check {
+	var checks []Check
+	add := func(name string, ok bool, detail string) {
+		checks = append(checks, Check{Name: name, OK: ok, Detail: detail})
+	}
+
+	if sigErr != nil {
+		add("signature", false, sigErr.Error())
+	} else {
+		add("signature", true, fmt.Sprintf("%s, key %s", t.Header.Alg, t.Header.Kid))
+	}
+
+	iss := t.String("iss")
+	switch {
+	case issuer == "":
+		add("issuer", false, fmt.Sprintf("%q; no issuer configured to compare with", iss))
+	case iss != issuer:
+		add("issuer", false, fmt.Sprintf("%q, want %q", iss, issuer))
+	default:
+		add("issuer", true, iss)
+	}
+
+	// The load balancer requires aud to be a single string equal to the
+	// CLI client ID
+	switch aud := t.Claims["aud"].(type) {
+	case string:
+		switch {
+		case clientID == "":
+			add("audience", false, fmt.Sprintf("%q; no client ID configured to compare with", aud))
+		case aud != clientID:
+			add("audience", false, fmt.Sprintf("%q, want %q", aud, clientID))
+		default:
+			add("audience", true, fmt.Sprintf("%q", aud))
+		}
+	case []interface{}:
+		add("audience", false, fmt.Sprintf("%v is a list; the load balancer only accepts a single string", aud))
+	case nil:
+		detail := "no aud claim"
+		if t.String("token_use") == "access" {
+			detail += "; this is an access token, send the ID token instead"
+		}
+		add("audience", false, detail)
+	default:
+		add("audience", false, fmt.Sprintf("unexpected aud %v", aud))
+	}
+	if azp := t.String("azp"); azp != "" {
+		add("authorized party", azp == clientID, fmt.Sprintf("azp %q", azp))
+	}
+
+	exp := t.Time("exp")
+	switch {
+	case exp.IsZero():
+		add("expiry", false, "no exp claim")
+	case !now.Before(exp):
+		add("expiry", false, fmt.Sprintf("expired %s ago at %s", now.Sub(exp).Round(time.Second), exp.UTC().Format(time.RFC3339)))
+	default:
+		add("expiry", true, fmt.Sprintf("expires in %s at %s", exp.Sub(now).Round(time.Second), exp.UTC().Format(time.RFC3339)))
+	}
+	if nbf := t.Time("nbf"); !nbf.IsZero() && now.Before(nbf) {
+		add("not before", false, fmt.Sprintf("not valid until %s", nbf.UTC().Format(time.RFC3339)))
+	}
+	return checks
+}
+
+// FetchJWKS downloads the issuer's keys, from jwksURL or, when it is empty,
+// the jwks_uri of the issuer's OIDC discovery document.
+func FetchJWKS(ctx context.Context, issuer, jwksURL string) (*JWKS, error) {
+	if jwksURL == "" {
+		if issuer == "" {
+			return nil, errors.New("no issuer configured to fetch signing keys from")
+		}
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OIDC discovery response has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var keys JWKS
+	if err := getJSON(ctx, jwksURL, &keys); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	return &keys, nil
+}
+
+// ParseJWKS decodes a JWKS document, e.g. one saved from the issuer.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var keys JWKS
+	if err := json.Unmarshal(data, &keys); err != nil || keys.Keys == nil {
+		return nil, errors.New("not a JWKS document")
+	}
+	return &keys, nil
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxSize)).Decode(v)
+}
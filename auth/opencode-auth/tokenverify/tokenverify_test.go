@@ -0,0 +1,147 @@
+package tokenverify
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding.EncodeToString
+
+func sign(t *testing.T, header, claims map[string]interface{}, signer func(digest []byte) []byte) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(input))
+	return input + "." + b64(signer(digest[:]))
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := &JWKS{Keys: []JWK{
+		{Kty: "RSA", Kid: "rsa1", Alg: "RS256", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec1", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}}
+	signRSA := func(digest []byte) []byte {
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		return sig
+	}
+	signEC := func(digest []byte) []byte {
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	claims := map[string]interface{}{"iss": "https://idp.example.com", "aud": "client"}
+
+	for _, tc := range []struct {
+		name   string
+		kid    string
+		alg    string
+		signer func([]byte) []byte
+		ok     bool
+	}{
+		{"rsa", "rsa1", "RS256", signRSA, true},
+		{"ec", "ec1", "ES256", signEC, true},
+		{"wrong key", "rsa1", "RS256", signEC, false},
+		{"unknown kid", "rsa2", "RS256", signRSA, false},
+		{"alg mismatch", "rsa1", "ES256", signEC, false},
+	} {
+		tok, err := Parse(sign(t, map[string]interface{}{"alg": tc.alg, "kid": tc.kid}, claims, tc.signer))
+		if err != nil {
+			t.Fatalf("%s: Parse() error = %v", tc.name, err)
+		}
+		if err := tok.Verify(keys); (err == nil) != tc.ok {
+			t.Errorf("%s: Verify() error = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+
+	if _, err := Parse("not.a-jwt"); err == nil {
+		t.Error("Parse() accepted a malformed token")
+	}
+}
+
+func TestChecks(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	check := func(claims map[string]interface{}) map[string]Check {
+		data, _ := json.Marshal(claims)
+		tok, err := Parse(b64([]byte(`{"alg":"RS256","kid":"k"}`)) + "." + b64(data) + ".c2ln")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checks := map[string]Check{}
+		for _, c := range tok.Checks("https://idp.example.com", "client", nil, now) {
+			checks[c.Name] = c
+		}
+		return checks
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "https://idp.example.com", "aud": "client", "exp": now.Add(time.Hour).Unix()}
+	}
+
+	data, _ := json.Marshal(valid())
+	tok, _ := Parse(b64([]byte(`{"alg":"RS256","kid":"k"}`)) + "." + b64(data) + ".c2ln")
+	if checks := tok.Checks("https://idp.example.com", "client", nil, now); !Accepted(checks) {
+		t.Errorf("valid token rejected: %+v", checks)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(map[string]interface{})
+		failed string
+		detail string
+	}{
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://other.example.com" }, "issuer", "want"},
+		{"other client", func(c map[string]interface{}) { c["aud"] = "other" }, "audience", "want"},
+		{"aud list", func(c map[string]interface{}) { c["aud"] = []string{"client"} }, "audience", "single string"},
+		{"access token", func(c map[string]interface{}) { delete(c, "aud"); c["token_use"] = "access" }, "audience", "ID token"},
+		{"azp", func(c map[string]interface{}) { c["azp"] = "other" }, "authorized party", "other"},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }, "expiry", "expired 1m0s ago"},
+		{"not yet valid", func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }, "not before", "not valid until"},
+	} {
+		claims := valid()
+		tc.change(claims)
+		c := check(claims)[tc.failed]
+		if c.OK || !strings.Contains(c.Detail, tc.detail) {
+			t.Errorf("%s: %s check = %+v", tc.name, tc.failed, c)
+		}
+	}
+}
+
+func TestFetchJWKS(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": srv.URL + "/keys"})
+		case "/keys":
+			w.Write([]byte(`{"keys":[{"kty":"RSA","kid":"k1","n":"AQAB","e":"AQAB"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	keys, err := FetchJWKS(context.Background(), srv.URL, "")
+	if err != nil || len(keys.Keys) != 1 || keys.Keys[0].Kid != "k1" {
+		t.Fatalf("FetchJWKS() = %+v, %v", keys, err)
+	}
+	if _, err := FetchJWKS(context.Background(), srv.URL, srv.URL+"/missing"); err == nil {
+		t.Error("FetchJWKS() succeeded for a missing JWKS")
+	}
+	if _, err := ParseJWKS([]byte(`{"issuer":"x"}`)); err == nil {
+		t.Error("ParseJWKS() accepted a document without keys")
+	}
+}
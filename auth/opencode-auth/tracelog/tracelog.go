@@ -0,0 +1,150 @@
+// Package tracelog writes the --trace log: every HTTP request the CLI makes
+// (method, URL, status, duration, headers) and the decisions it takes on the
+// way, such as which config layer set a value or why a token was or wasn't
+// refreshed. Secrets are redacted, so the log can be attached to a support
+// ticket as is.
+package tracelog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	mu    sync.Mutex
+	out   io.Writer
+	start time.Time
+)
+
+// sensitiveParts mark header and query parameter names whose values are
+// redacted.
+var sensitiveParts = []string{"auth", "token", "secret", "password", "key", "cookie", "assertion", "credential", "signature", "code", "verifier"}
+
+// Enable starts the trace on w and traces requests made through
+// http.DefaultTransport from then on.
+func Enable(w io.Writer) {
+	mu.Lock()
+	out, start = w, time.Now()
+	mu.Unlock()
+	http.DefaultTransport = Wrap(http.DefaultTransport)
+}
+
+// Enabled reports whether the trace is on.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return out != nil
+}
+
+// Printf writes one trace line, stamped with the time since the trace
+// started. It does nothing when the trace is off.
+func Printf(format string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+	fmt.Fprintf(out, "[trace +%.3fs] %s\n", time.Since(start).Seconds(), fmt.Sprintf(format, args...))
+}
+
+// Transport traces the requests it passes to Base.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+// Wrap returns rt tracing its requests while the trace is on, or rt itself.
+func Wrap(rt http.RoundTripper) http.RoundTripper {
+	if _, ok := rt.(*Transport); ok || !Enabled() {
+		return rt
+	}
+	return &Transport{Base: rt}
+}
+
+// Unwrap returns the transport under a Transport, e.g. to configure the
+// *http.Transport that http.DefaultTransport normally is.
+func Unwrap(rt http.RoundTripper) http.RoundTripper {
+	if t, ok := rt.(*Transport); ok {
+		return t.Base
+	}
+	return rt
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	began := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	elapsed := time.Since(began).Round(time.Millisecond)
+	if err != nil {
+		Printf("http %s %s failed after %s: %v", req.Method, RedactURL(req.URL), elapsed, err)
+	} else {
+		Printf("http %s %s -> %d (%s)", req.Method, RedactURL(req.URL), resp.StatusCode, elapsed)
+	}
+	Printf("  request headers: %s", Headers(req.Header))
+	if resp != nil {
+		Printf("  response headers: %s", Headers(resp.Header))
+	}
+	return resp, err
+}
+
+// RedactURL returns u with the values of secret-looking query parameters
+// and any user info replaced.
+func RedactURL(u *url.URL) string {
+	c := *u
+	if c.User != nil {
+		c.User = url.User(redacted)
+	}
+	if c.RawQuery != "" {
+		q := c.Query()
+		for name := range q {
+			if sensitive(name) {
+				q[name] = []string{redacted}
+			}
+		}
+		c.RawQuery = q.Encode()
+	}
+	return c.String()
+}
+
+// Headers formats h on one line, sorted, with secret values redacted. An
+// Authorization value keeps its scheme.
+func Headers(h http.Header) string {
+	if len(h) == 0 {
+		return "(none)"
+	}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if sensitive(name) {
+			scheme, _, found := strings.Cut(value, " ")
+			if found && !strings.ContainsAny(scheme, "=;,") {
+				value = scheme + " " + redacted
+			} else {
+				value = redacted
+			}
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package tracelog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer eyJsecret")
+	h.Set("X-Api-Key", "oc_secret")
+	h.Set("Cookie", "session=secret; theme=dark")
+	h.Set("Content-Type", "application/json")
+	got := Headers(h)
+	want := "Authorization: Bearer [REDACTED]; Content-Type: application/json; Cookie: [REDACTED]; X-Api-Key: [REDACTED]"
+	if got != want {
+		t.Errorf("Headers() = %q, want %q", got, want)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	u, _ := url.Parse("https://user:pw@idp.example.com/token?client_id=abc&code=secret&refresh_token=secret")
+	got := RedactURL(u)
+	if strings.Contains(got, "secret") || strings.Contains(got, "pw") || !strings.Contains(got, "client_id=abc") {
+		t.Errorf("RedactURL() = %q", got)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var buf bytes.Buffer
+	mu.Lock()
+	out = &buf
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		out = nil
+		mu.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: Wrap(http.DefaultTransport)}
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/models?api_key=secret", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	log := buf.String()
+	if !strings.Contains(log, "http GET "+srv.URL+"/v1/models?api_key=%5BREDACTED%5D -> 418") {
+		t.Errorf("trace has no request line:\n%s", log)
+	}
+	if strings.Contains(log, "secret") {
+		t.Errorf("trace leaks a secret:\n%s", log)
+	}
+	if Unwrap(client.Transport) != http.DefaultTransport {
+		t.Error("Unwrap did not return the base transport")
+	}
+}
@@ -0,0 +1,325 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queueSize bounds the spans waiting for export; more are dropped so a
+	// slow or absent collector never backs up proxied requests.
+	queueSize = 2048
+
+	// batchSize and flushInterval control how often spans are sent.
+	batchSize     = 256
+	flushInterval = 5 * time.Second
+
+	// exportTimeout bounds each OTLP request.
+	exportTimeout = 10 * time.Second
+)
+
+// Options configures a Tracer.
+type Options struct {
+	// Endpoint is the collector's OTLP/HTTP base URL (e.g.
+	// "http://localhost:4318"); "/v1/traces" is appended unless present.
+	Endpoint string
+	// Headers are added to every export request, e.g. for collector auth.
+	Headers        map[string]string
+	ServiceName    string
+	ServiceVersion string
+}
+
+// Stats reports export counts.
+type Stats struct {
+	Endpoint string `json:"endpoint"`
+	Exported int64  `json:"exported"`
+	Dropped  int64  `json:"dropped"`
+	Failed   int64  `json:"failed"`
+}
+
+// Tracer creates spans and exports them in batches from a background
+// goroutine. A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	opts   Options
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	queue    chan *Span
+	flush    chan chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	exported, dropped, failed atomic.Int64
+	warnOnce                  sync.Once
+}
+
+// New returns a Tracer exporting to opts.Endpoint, or nil if no endpoint is
+// set.
+func New(opts Options) *Tracer {
+	if opts.Endpoint == "" {
+		return nil
+	}
+	url := strings.TrimSuffix(opts.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	t := &Tracer{
+		opts:   opts,
+		url:    url,
+		client: &http.Client{Timeout: exportTimeout},
+		now:    time.Now,
+		queue:  make(chan *Span, queueSize),
+		flush:  make(chan chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Stats returns the export counts.
+func (t *Tracer) Stats() Stats {
+	return Stats{
+		Endpoint: t.url,
+		Exported: t.exported.Load(),
+		Dropped:  t.dropped.Load(),
+		Failed:   t.failed.Load(),
+	}
+}
+
+// Flush exports the queued spans and waits until they have been sent.
+func (t *Tracer) Flush(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+		select {
+		case <-ack:
+		case <-ctx.Done():
+		}
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown exports the queued spans and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = nil
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-t.flush:
+			drain()
+			send()
+			close(ack)
+		case <-t.stop:
+			drain()
+			send()
+			return
+		}
+	}
+}
+
+// export sends one batch. Failures are counted, and the first is logged.
+func (t *Tracer) export(batch []*Span) {
+	body, err := json.Marshal(t.payload(batch))
+	if err != nil {
+		t.failed.Add(int64(len(batch)))
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		t.failed.Add(int64(len(batch)))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		t.failed.Add(int64(len(batch)))
+		t.warnOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "[proxy] Warning: trace export to %s failed: %v\n", t.url, err)
+		})
+		return
+	}
+	t.exported.Add(int64(len(batch)))
+}
+
+// OTLP/JSON request body. IDs are hex strings and timestamps are decimal
+// strings, per the OTLP JSON mapping.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              Kind       `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr `json:"attributes,omitempty"`
+		Status            otlpStatus `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 2 = error
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+func (t *Tracer) payload(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	resource := []otlpAttr{attr("service.name", t.opts.ServiceName)}
+	if t.opts.ServiceVersion != "" {
+		resource = append(resource, attr("service.version", t.opts.ServiceVersion))
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "opencode-auth/proxy", Version: t.opts.ServiceVersion},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out.Attributes = append(out.Attributes, attr(k, s.attrs[k]))
+	}
+	if s.errMsg != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	return out
+}
+
+// attr encodes an attribute value as an OTLP AnyValue.
+func attr(key string, v interface{}) otlpAttr {
+	var value map[string]interface{}
+	switch v := v.(type) {
+	case bool:
+		value = map[string]interface{}{"boolValue": v}
+	case int:
+		value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]interface{}{"doubleValue": v}
+	default:
+		value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttr{Key: key, Value: value}
+}
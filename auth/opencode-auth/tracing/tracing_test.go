@@ -0,0 +1,126 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	if !ok || !sc.Sampled {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", header, sc, ok)
+	}
+	if got := sc.Traceparent(); got != header {
+		t.Errorf("Traceparent() = %q, want %q", got, header)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) accepted an invalid header", bad)
+		}
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "op", KindInternal)
+	span.SetAttr("k", "v")
+	span.SetError("boom")
+	span.Inject(http.Header{})
+	span.End()
+	if ctx == nil || span != nil {
+		t.Error("nil tracer should return the context and a nil span")
+	}
+	tracer.Flush(ctx)
+	tracer.Shutdown(ctx)
+	if New(Options{}) != nil {
+		t.Error("New() without an endpoint should return nil")
+	}
+}
+
+func TestExport(t *testing.T) {
+	var mu sync.Mutex
+	var got otlpRequest
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("export path = %q, want /v1/traces", r.URL.Path)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer collector.Close()
+
+	tracer := New(Options{
+		Endpoint:    collector.URL,
+		Headers:     map[string]string{"Authorization": "Basic abc"},
+		ServiceName: "test-service",
+	})
+
+	// The first span continues a remote trace; the second is its child
+	remote := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+	ctx, root := tracer.Start(Extract(context.Background(), remote), "GET /v1/models", KindServer)
+	root.SetAttr("http.response.status_code", 200)
+	_, child := tracer.Start(ctx, "upstream GET", KindClient)
+	child.SetError("connection reset")
+	child.End()
+	root.End()
+	root.End() // ending twice exports once
+
+	// Spans from an unsampled trace are not exported
+	unsampled := http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}}
+	_, skipped := tracer.Start(Extract(context.Background(), unsampled), "skipped", KindServer)
+	skipped.End()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracer.Flush(flushCtx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if auth != "Basic abc" {
+		t.Errorf("export Authorization = %q, want configured header", auth)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected payload shape: %+v", got)
+	}
+	if svc := got.ResourceSpans[0].Resource.Attributes[0]; svc.Key != "service.name" || svc.Value["stringValue"] != "test-service" {
+		t.Errorf("resource attribute = %+v, want service.name", svc)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	upstream, server := spans[0], spans[1]
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span trace %s parent %s, want the remote trace", server.TraceID, server.ParentSpanID)
+	}
+	if upstream.TraceID != server.TraceID || upstream.ParentSpanID != server.SpanID {
+		t.Errorf("upstream span is not a child of the server span: %+v", upstream)
+	}
+	if upstream.Status.Code != 2 || upstream.Status.Message != "connection reset" {
+		t.Errorf("upstream status = %+v, want error", upstream.Status)
+	}
+	if a := server.Attributes[0]; a.Key != "http.response.status_code" || a.Value["intValue"] != "200" {
+		t.Errorf("server attribute = %+v", a)
+	}
+	if stats := tracer.Stats(); stats.Exported != 2 || stats.Failed != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	tracer.Shutdown(flushCtx)
+}
@@ -0,0 +1,350 @@
+package update
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// partialSuffix marks an unfinished download kept for resuming, and
+	// etagSuffix the file holding the ETag it was downloaded with.
+	partialSuffix = ".part"
+	etagSuffix    = ".etag"
+
+	// downloadAttempts is how many times a download is started or resumed
+	// before DownloadZipWith gives up.
+	downloadAttempts = 5
+)
+
+// DownloadOptions controls DownloadZipWith.
+type DownloadOptions struct {
+	// OnProgress receives the bytes downloaded so far, including any resumed
+	// from an earlier attempt, and the expected total (-1 if unknown).
+	OnProgress func(done, total int64)
+	// LimitRate caps the download speed in bytes per second (0 is unlimited).
+	LimitRate int64
+	// Dir holds the download and its partial cache (default opencode-auth
+	// in the user's cache directory). It is created 0700 and must not be
+	// writable by other users.
+	Dir string
+	// SHA256 is the installer's published digest, in hex. A finished
+	// download that doesn't match it is discarded.
+	SHA256 string
+	// Transport fetches the zip, e.g. mirror.Transport for a file://
+	// mirror (default http.DefaultTransport).
+	Transport http.RoundTripper
+}
+
+// DownloadZip downloads the installer zip from the presigned URL to a temp file.
+func DownloadZip(ctx context.Context, downloadURL string) (string, error) {
+	return DownloadZipWith(ctx, downloadURL, DownloadOptions{})
+}
+
+// DownloadZipWithProgress is DownloadZip reporting bytes written and the
+// expected total (-1 if unknown) to onProgress as the download proceeds.
+func DownloadZipWithProgress(ctx context.Context, downloadURL string, onProgress func(done, total int64)) (string, error) {
+	return DownloadZipWith(ctx, downloadURL, DownloadOptions{OnProgress: onProgress})
+}
+
+// DownloadZipWith downloads the installer zip and returns the file's path.
+// When the connection drops, the download resumes with an HTTP Range request
+// where it stopped. An interrupted download is also kept, and a later call
+// for the same object resumes it if the server still reports the same ETag.
+// Presigned URLs for one object differ only in their query, so the partial
+// file is keyed by the URL without it.
+func DownloadZipWith(ctx context.Context, downloadURL string, opts DownloadOptions) (string, error) {
+	dir := opts.Dir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("finding the download directory: %w", err)
+		}
+		dir = filepath.Join(cache, "opencode-auth")
+	}
+	if err := privateDir(dir); err != nil {
+		return "", err
+	}
+	zipPath := filepath.Join(dir, "opencode-installer-"+cacheKey(downloadURL)+".zip")
+	partPath := zipPath + partialSuffix
+
+	client := &http.Client{Timeout: 5 * time.Minute, Transport: opts.Transport}
+	var lastErr error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, time.Duration(attempt)*time.Second); err != nil {
+				return "", fmt.Errorf("downloading installer: %w", err)
+			}
+		}
+		retry, err := downloadPart(ctx, client, downloadURL, partPath, opts)
+		if err == nil && opts.SHA256 != "" {
+			if err = verifySHA256(partPath, opts.SHA256); err != nil {
+				// Resuming would only append to the bad file
+				os.Remove(partPath)
+				os.Remove(partPath + etagSuffix)
+				return "", err
+			}
+		}
+		if err == nil {
+			os.Remove(partPath + etagSuffix)
+			if err := os.Rename(partPath, zipPath); err != nil {
+				return "", fmt.Errorf("saving installer zip: %w", err)
+			}
+			return zipPath, nil
+		}
+		if !retry || ctx.Err() != nil {
+			return "", err
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("%w (gave up after %d attempts)", lastErr, downloadAttempts)
+}
+
+// downloadPart downloads the rest of the object into partPath, or all of it
+// when there is nothing to resume. It reports whether a failure is worth
+// retrying.
+func downloadPart(ctx context.Context, client *http.Client, downloadURL, partPath string, opts DownloadOptions) (retry bool, err error) {
+	for _, path := range []string{partPath, partPath + etagSuffix} {
+		if err := checkOwnFile(path); err != nil {
+			return false, err
+		}
+	}
+	var offset int64
+	etag := ""
+	if info, err := os.Stat(partPath); err == nil {
+		if data, err := os.ReadFile(partPath + etagSuffix); err == nil {
+			offset, etag = info.Size(), strings.TrimSpace(string(data))
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("creating download request: %w", err)
+	}
+	if offset > 0 && etag != "" {
+		// If-Range makes the server send the whole object if it has changed
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
+	} else {
+		offset = 0
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("downloading installer: %w", err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	total := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			os.Remove(partPath)
+			return true, fmt.Errorf("download resumed at the wrong offset")
+		}
+		flags |= os.O_APPEND
+		if total >= 0 {
+			total += offset
+		}
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+		if err := os.WriteFile(partPath+etagSuffix, []byte(resp.Header.Get("ETag")), 0600); err != nil {
+			return false, fmt.Errorf("saving download state: %w", err)
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is not a prefix of the current object
+		os.Remove(partPath)
+		return true, fmt.Errorf("partial download does not match the installer")
+	default:
+		return false, fmt.Errorf("download returned status %d", resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(partPath, flags, 0600)
+	if err != nil {
+		return false, fmt.Errorf("creating download file: %w", err)
+	}
+	defer f.Close()
+
+	var body io.Reader = resp.Body
+	if opts.LimitRate > 0 {
+		body = &rateLimitedReader{ctx: ctx, r: body, rate: opts.LimitRate, start: time.Now()}
+	}
+	if opts.OnProgress != nil {
+		opts.OnProgress(offset, total)
+		body = &progressReader{r: body, done: offset, total: total, onProgress: opts.OnProgress}
+	}
+	written, err := io.Copy(f, body)
+	if err != nil {
+		return true, fmt.Errorf("writing installer zip: %w", err)
+	}
+	if total >= 0 && offset+written != total {
+		return true, fmt.Errorf("download ended after %d of %d bytes", offset+written, total)
+	}
+	return false, nil
+}
+
+// privateDir creates dir if needed and checks that it belongs to the current
+// user and that no one else can write to it, so no one else can plant a
+// partial download in it.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating download directory: %w", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("checking download directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("download directory %s is not a directory", dir)
+	}
+	if err := checkOwner(dir, info); err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("download directory %s is writable by other users (mode %v); run 'chmod 700 %s'", dir, info.Mode().Perm(), dir)
+	}
+	return nil
+}
+
+// checkOwnFile refuses a partial download or ETag file that is not a
+// regular file of the current user's. A missing file is fine.
+func checkOwnFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing %s: not a regular file", path)
+	}
+	return checkOwner(path, info)
+}
+
+// verifySHA256 checks the file at path against a hex SHA-256 digest.
+func verifySHA256(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("verifying installer zip: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("verifying installer zip: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, strings.TrimSpace(want)) {
+		return fmt.Errorf("installer zip has SHA-256 %s, but %s was published; not installing it", got, want)
+	}
+	return nil
+}
+
+// contentRangeStart returns the first byte position of a Content-Range
+// header such as "bytes 100-199/200".
+func contentRangeStart(header string) (int64, bool) {
+	rest, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
+
+// cacheKey identifies the object behind a download URL, ignoring the query
+// that carries a presigned URL's signature and expiry.
+func cacheKey(downloadURL string) string {
+	if u, err := url.Parse(downloadURL); err == nil {
+		u.RawQuery, u.Fragment = "", ""
+		downloadURL = u.String()
+	}
+	sum := sha256.Sum256([]byte(downloadURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseRate parses a download speed limit in bytes per second, with an
+// optional k, m, or g suffix (powers of 1024) as in curl's --limit-rate.
+func ParseRate(s string) (int64, error) {
+	num := strings.ToLower(strings.TrimSpace(s))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(num, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(num, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(num, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q (use e.g. 500k or 2m)", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// progressReader reports cumulative bytes read to onProgress.
+type progressReader struct {
+	r          io.Reader
+	done       int64
+	total      int64
+	onProgress func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	p.onProgress(p.done, p.total)
+	return n, err
+}
+
+// rateLimitedReader reads at most rate bytes per second on average.
+type rateLimitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (l *rateLimitedReader) Read(b []byte) (int, error) {
+	// Small reads keep the rate even within a second
+	if chunk := l.rate/4 + 1; int64(len(b)) > chunk {
+		b = b[:chunk]
+	}
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	due := time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second))
+	if wait := due - time.Since(l.start); wait > 0 {
+		if err := sleep(l.ctx, wait); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// sleep waits for d, returning ctx's error if it is cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package update
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkOwner refuses a file that belongs to another user.
+func checkOwner(path string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("refusing %s: owned by uid %d, not the current user", path, st.Uid)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package update
+
+import "os"
+
+// checkOwner is a no-op on Windows, where the download directory is under
+// the user's profile and its ACL already keeps other users out.
+func checkOwner(path string, info os.FileInfo) error {
+	return nil
+}
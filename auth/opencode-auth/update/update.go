@@ -5,6 +5,7 @@ package update
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,56 +25,45 @@ type DownloadURLResponse struct {
 }
 
 // GetDownloadURL fetches a presigned download URL from the API via the proxy.
-func GetDownloadURL(proxyURL string) (*DownloadURLResponse, error) {
+func GetDownloadURL(ctx context.Context, proxyURL string) (*DownloadURLResponse, error) {
+	return getPresignedURL(ctx, proxyURL+"/v1/update/download-url", "download URL")
+}
+
+// GetManifestURL fetches a presigned URL for the version manifest via the proxy.
+// Used when the public manifest URL is not reachable without authentication.
+func GetManifestURL(ctx context.Context, proxyURL string) (*DownloadURLResponse, error) {
+	return getPresignedURL(ctx, proxyURL+"/v1/update/manifest", "manifest URL")
+}
+
+// getPresignedURL requests a presigned URL from an update endpoint.
+func getPresignedURL(ctx context.Context, endpoint, what string) (*DownloadURLResponse, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(proxyURL + "/v1/update/download-url")
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s request: %w", what, err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("fetching download URL: %w", err)
+		return nil, fmt.Errorf("fetching %s: %w", what, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("download URL returned status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("%s returned status %d: %s", what, resp.StatusCode, string(body))
 	}
 
 	var dlResp DownloadURLResponse
 	if err := json.NewDecoder(resp.Body).Decode(&dlResp); err != nil {
-		return nil, fmt.Errorf("parsing download URL response: %w", err)
+		return nil, fmt.Errorf("parsing %s response: %w", what, err)
 	}
 
 	return &dlResp, nil
 }
 
-// DownloadZip downloads the installer zip from the presigned URL to a temp file.
-func DownloadZip(downloadURL string) (string, error) {
-	client := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := client.Get(downloadURL)
-	if err != nil {
-		return "", fmt.Errorf("downloading installer: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("download returned status %d", resp.StatusCode)
-	}
-
-	tmpFile, err := os.CreateTemp("", "opencode-installer-*.zip")
-	if err != nil {
-		return "", fmt.Errorf("creating temp file: %w", err)
-	}
-	defer tmpFile.Close()
-
-	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
-		os.Remove(tmpFile.Name())
-		return "", fmt.Errorf("writing installer zip: %w", err)
-	}
-
-	return tmpFile.Name(), nil
-}
-
 // ExtractAndInstall extracts the zip and runs install.sh.
-func ExtractAndInstall(zipPath string) error {
+// Cancelling ctx kills install.sh if it is still running.
+func ExtractAndInstall(ctx context.Context, zipPath string) error {
 	if runtime.GOOS == "windows" {
 		return fmt.Errorf("self-update is not supported on Windows; please download and install manually")
 	}
@@ -96,7 +86,7 @@ func ExtractAndInstall(zipPath string) error {
 		return fmt.Errorf("install.sh not found in update package")
 	}
 
-	cmd := exec.Command("bash", installScript)
+	cmd := exec.CommandContext(ctx, "bash", installScript)
 	cmd.Dir = tmpDir
 	cmd.Stdout = os.Stderr // install.sh output goes to stderr
 	cmd.Stderr = os.Stderr
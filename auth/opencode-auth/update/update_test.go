@@ -2,13 +2,20 @@ package update
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetDownloadURL_Success(t *testing.T) {
@@ -24,7 +31,7 @@ func TestGetDownloadURL_Success(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	resp, err := GetDownloadURL(srv.URL)
+	resp, err := GetDownloadURL(context.Background(), srv.URL)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -43,7 +50,7 @@ func TestGetDownloadURL_ServerError(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	_, err := GetDownloadURL(srv.URL)
+	_, err := GetDownloadURL(context.Background(), srv.URL)
 	if err == nil {
 		t.Error("expected error for 500 response")
 	}
@@ -56,19 +63,53 @@ func TestGetDownloadURL_Unauthorized(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	_, err := GetDownloadURL(srv.URL)
+	_, err := GetDownloadURL(context.Background(), srv.URL)
 	if err == nil {
 		t.Error("expected error for 401 response")
 	}
 }
 
 func TestGetDownloadURL_UnreachableServer(t *testing.T) {
-	_, err := GetDownloadURL("http://127.0.0.1:1")
+	_, err := GetDownloadURL(context.Background(), "http://127.0.0.1:1")
 	if err == nil {
 		t.Error("expected error for unreachable server")
 	}
 }
 
+func TestGetManifestURL_Success(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/update/manifest" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DownloadURLResponse{
+			DownloadURL: "https://example.com/version.json",
+			ExpiresIn:   300,
+		})
+	}))
+	defer srv.Close()
+
+	resp, err := GetManifestURL(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.DownloadURL != "https://example.com/version.json" {
+		t.Errorf("DownloadURL = %q, want %q", resp.DownloadURL, "https://example.com/version.json")
+	}
+}
+
+func TestGetManifestURL_NotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	_, err := GetManifestURL(context.Background(), srv.URL)
+	if err == nil {
+		t.Error("expected error for 404 response (older router without manifest endpoint)")
+	}
+}
+
 func TestDownloadZip_Success(t *testing.T) {
 	// Serve a small valid zip file
 	zipContent := createTestZip(t, map[string]string{
@@ -81,7 +122,7 @@ func TestDownloadZip_Success(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	path, err := DownloadZip(srv.URL)
+	path, err := DownloadZip(context.Background(), srv.URL)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -97,18 +138,226 @@ func TestDownloadZip_Success(t *testing.T) {
 	}
 }
 
+func TestDownloadZipWithProgress(t *testing.T) {
+	zipContent := createTestZip(t, map[string]string{
+		"install.sh": "#!/bin/bash\necho hello",
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(zipContent)))
+		w.Write(zipContent)
+	}))
+	defer srv.Close()
+	isolateCache(t)
+
+	var lastDone, lastTotal int64
+	path, err := DownloadZipWithProgress(context.Background(), srv.URL, func(done, total int64) {
+		lastDone, lastTotal = done, total
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(path)
+
+	if lastDone != int64(len(zipContent)) || lastTotal != int64(len(zipContent)) {
+		t.Errorf("final progress = %d/%d, want %d/%d", lastDone, lastTotal, len(zipContent), len(zipContent))
+	}
+}
+
 func TestDownloadZip_ServerError(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusForbidden)
 	}))
 	defer srv.Close()
+	isolateCache(t)
 
-	_, err := DownloadZip(srv.URL)
+	_, err := DownloadZip(context.Background(), srv.URL)
 	if err == nil {
 		t.Error("expected error for 403 response")
 	}
 }
 
+func TestDownloadZip_Cancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	isolateCache(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := DownloadZip(ctx, srv.URL)
+	if err == nil {
+		t.Error("expected error for cancelled context")
+	}
+}
+
+func TestDownloadZip_ResumesAfterDrop(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if len(ranges) == 1 {
+			// Drop the connection halfway through
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:4000])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	var lastDone int64
+	path, err := DownloadZipWith(context.Background(), srv.URL+"/installer.zip?X-Amz-Signature=1", DownloadOptions{
+		Dir:        t.TempDir(),
+		OnProgress: func(done, total int64) { lastDone = done },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) || lastDone != int64(len(content)) {
+		t.Errorf("downloaded %d bytes (progress %d), want %d", len(got), lastDone, len(content))
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes=4000-" {
+		t.Errorf("Range headers = %q, want a resume from byte 4000", ranges)
+	}
+}
+
+func TestDownloadZip_ResumesPartialFile(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 500)
+	for _, tt := range []struct {
+		etag     string
+		wantSent int
+	}{
+		{etag: `"v1"`, wantSent: 3000}, // same object: only the rest is sent
+		{etag: `"v2"`, wantSent: 5000}, // object changed: sent in full
+	} {
+		var sent int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := httptest.NewRecorder()
+			rec.Header().Set("ETag", tt.etag)
+			http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader(content))
+			sent = rec.Body.Len()
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+		}))
+
+		// A presigned URL with another signature for the same object
+		dir := t.TempDir()
+		partPath := filepath.Join(dir, "opencode-installer-"+cacheKey(srv.URL+"/installer.zip")+".zip.part")
+		os.WriteFile(partPath, content[:2000], 0600)
+		os.WriteFile(partPath+".etag", []byte(`"v1"`), 0600)
+
+		path, err := DownloadZipWith(context.Background(), srv.URL+"/installer.zip?X-Amz-Signature=2", DownloadOptions{Dir: dir})
+		srv.Close()
+		if err != nil {
+			t.Fatalf("etag %s: unexpected error: %v", tt.etag, err)
+		}
+		got, _ := os.ReadFile(path)
+		if !bytes.Equal(got, content) || sent != tt.wantSent {
+			t.Errorf("etag %s: downloaded %d bytes with %d sent, want %d sent", tt.etag, len(got), sent, tt.wantSent)
+		}
+		if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+			t.Errorf("etag %s: partial file left behind", tt.etag)
+		}
+	}
+}
+
+func TestDownloadZip_VerifiesSHA256(t *testing.T) {
+	content := []byte("installer")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(content)
+	dir := t.TempDir()
+	if _, err := DownloadZipWith(context.Background(), srv.URL, DownloadOptions{Dir: dir, SHA256: hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("matching digest: %v", err)
+	}
+	if _, err := DownloadZipWith(context.Background(), srv.URL, DownloadOptions{Dir: dir, SHA256: strings.Repeat("0", 64)}); err == nil {
+		t.Fatal("expected an error for a digest mismatch")
+	}
+	// Nothing is left to resume from
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "*.zip.*")); len(leftovers) != 0 {
+		t.Errorf("left behind %v", leftovers)
+	}
+}
+
+func TestDownloadZip_RefusesSharedCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes and symlinks differ on Windows")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("installer"))
+	}))
+	defer srv.Close()
+
+	shared := t.TempDir()
+	os.Chmod(shared, 0777)
+	if _, err := DownloadZipWith(context.Background(), srv.URL, DownloadOptions{Dir: shared}); err == nil {
+		t.Error("expected an error for a directory writable by other users")
+	}
+
+	// A partial file someone planted as a symlink is not followed
+	dir := t.TempDir()
+	target := filepath.Join(t.TempDir(), "target")
+	os.WriteFile(target, []byte("x"), 0600)
+	partPath := filepath.Join(dir, "opencode-installer-"+cacheKey(srv.URL)+".zip.part")
+	os.Symlink(target, partPath)
+	if _, err := DownloadZipWith(context.Background(), srv.URL, DownloadOptions{Dir: dir}); err == nil {
+		t.Error("expected an error for a symlinked partial download")
+	}
+	if got, _ := os.ReadFile(target); string(got) != "x" {
+		t.Errorf("symlink target was overwritten with %q", got)
+	}
+}
+
+func TestDownloadZip_LimitRate(t *testing.T) {
+	content := make([]byte, 2000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	if _, err := DownloadZipWith(context.Background(), srv.URL, DownloadOptions{Dir: t.TempDir(), LimitRate: 4000}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("2000 bytes at 4000 B/s took %v", elapsed)
+	}
+}
+
+// isolateCache points the default download directory at a temp directory.
+func isolateCache(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("LocalAppData", dir)
+}
+
+func TestParseRate(t *testing.T) {
+	for in, want := range map[string]int64{"1000": 1000, "500k": 500 << 10, "2M": 2 << 20, "1.5m": 3 << 19, "1g": 1 << 30} {
+		if got, err := ParseRate(in); err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "k", "-5", "fast", "10x"} {
+		if _, err := ParseRate(in); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", in)
+		}
+	}
+}
+
 func TestExtractZip_ValidZip(t *testing.T) {
 	zipContent := createTestZip(t, map[string]string{
 		"file1.txt": "hello",
@@ -158,7 +407,7 @@ func TestExtractAndInstall_MissingInstallSh(t *testing.T) {
 	tmpFile.Write(zipContent)
 	tmpFile.Close()
 
-	err = ExtractAndInstall(tmpFile.Name())
+	err = ExtractAndInstall(context.Background(), tmpFile.Name())
 	if err == nil {
 		t.Error("expected error when install.sh is missing")
 	}
@@ -172,7 +421,7 @@ func TestExtractAndInstall_WindowsUnsupported(t *testing.T) {
 		t.Skip("this test only runs on Windows")
 	}
 
-	err := ExtractAndInstall("/tmp/nonexistent.zip")
+	err := ExtractAndInstall(context.Background(), "/tmp/nonexistent.zip")
 	if err == nil {
 		t.Error("expected error on Windows")
 	}
@@ -0,0 +1,105 @@
+//go:build darwin
+
+package urlscheme
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	plistBuddy = "/usr/libexec/PlistBuddy"
+	lsregister = "/System/Library/Frameworks/CoreServices.framework/Frameworks/LaunchServices.framework/Support/lsregister"
+)
+
+// appPath returns the applet that handles scheme. macOS delivers a URL to an
+// application bundle as an Apple event rather than an argument, so the
+// applet receives it and runs opencode-auth.
+func appPath(scheme string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Applications", "OpenCode Auth Sign-in ("+scheme+").app"), nil
+}
+
+// appleString quotes s as an AppleScript string literal.
+func appleString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func register(scheme, exe string) (string, error) {
+	app, err := appPath(scheme)
+	if err != nil {
+		return "", err
+	}
+	script := fmt.Sprintf("on open location theURL\n\tdo shell script quoted form of %s & %s & quoted form of theURL\nend open location\n",
+		appleString(exe), appleString(" "+strings.Join(HandleArgs, " ")+" "))
+	src, err := os.CreateTemp("", "opencode-auth-*.applescript")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(src.Name())
+	if _, err := src.WriteString(script); err != nil {
+		src.Close()
+		return "", err
+	}
+	src.Close()
+
+	os.RemoveAll(app)
+	if err := os.MkdirAll(filepath.Dir(app), 0755); err != nil {
+		return "", err
+	}
+	if out, err := exec.Command("osacompile", "-o", app, src.Name()).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("osacompile: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	plist := filepath.Join(app, "Contents", "Info.plist")
+	for _, key := range []string{"CFBundleIdentifier", "CFBundleURLTypes", "LSUIElement"} {
+		exec.Command(plistBuddy, "-c", "Delete :"+key, plist).Run()
+	}
+	for _, cmd := range []string{
+		"Add :CFBundleIdentifier string com.opencode-auth.url-scheme." + scheme,
+		"Add :LSUIElement bool true",
+		"Add :CFBundleURLTypes array",
+		"Add :CFBundleURLTypes:0 dict",
+		"Add :CFBundleURLTypes:0:CFBundleURLName string " + scheme,
+		"Add :CFBundleURLTypes:0:CFBundleURLSchemes array",
+		"Add :CFBundleURLTypes:0:CFBundleURLSchemes:0 string " + scheme,
+	} {
+		if out, err := exec.Command(plistBuddy, "-c", cmd, plist).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("PlistBuddy %q: %v: %s", cmd, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if out, err := exec.Command(lsregister, "-f", app).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("lsregister: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return app, nil
+}
+
+func unregister(scheme string) error {
+	app, err := appPath(scheme)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(app); err != nil {
+		return ErrNotRegistered
+	}
+	exec.Command(lsregister, "-u", app).Run()
+	return os.RemoveAll(app)
+}
+
+func handler(scheme string) (string, error) {
+	app, err := appPath(scheme)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(plistBuddy, "-c", "Print :CFBundleURLTypes:0:CFBundleURLSchemes:0", filepath.Join(app, "Contents", "Info.plist")).Output()
+	if err != nil || strings.TrimSpace(string(out)) != scheme {
+		return "", ErrNotRegistered
+	}
+	return app, nil
+}
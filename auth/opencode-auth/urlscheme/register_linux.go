@@ -0,0 +1,101 @@
+//go:build linux
+
+package urlscheme
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// desktopFile returns the desktop entry that handles scheme, in
+// $XDG_DATA_HOME/applications.
+func desktopFile(scheme string) (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "applications", "opencode-auth-"+scheme+".desktop"), nil
+}
+
+// desktopQuote quotes an Exec argument as the Desktop Entry spec requires.
+func desktopQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`).Replace(arg) + `"`
+}
+
+func register(scheme, exe string) (string, error) {
+	path, err := desktopFile(scheme)
+	if err != nil {
+		return "", err
+	}
+	entry := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=OpenCode Auth sign-in (%s)
+Exec=%s %s %%u
+MimeType=x-scheme-handler/%s;
+NoDisplay=true
+Terminal=false
+`, scheme, desktopQuote(exe), strings.Join(HandleArgs, " "), scheme)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(entry), 0644); err != nil {
+		return "", err
+	}
+
+	if _, err := exec.LookPath("update-desktop-database"); err == nil {
+		exec.Command("update-desktop-database", filepath.Dir(path)).Run()
+	}
+	if _, err := exec.LookPath("xdg-mime"); err != nil {
+		return path, fmt.Errorf("wrote %s, but xdg-mime was not found: make it the handler for x-scheme-handler/%s in your desktop settings", path, scheme)
+	}
+	if out, err := exec.Command("xdg-mime", "default", filepath.Base(path), "x-scheme-handler/"+scheme).CombinedOutput(); err != nil {
+		return path, fmt.Errorf("xdg-mime default: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return path, nil
+}
+
+func unregister(scheme string) error {
+	path, err := desktopFile(scheme)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotRegistered
+		}
+		return err
+	}
+	if _, err := exec.LookPath("update-desktop-database"); err == nil {
+		exec.Command("update-desktop-database", filepath.Dir(path)).Run()
+	}
+	return nil
+}
+
+func handler(scheme string) (string, error) {
+	path, err := desktopFile(scheme)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrNotRegistered
+	}
+	// Without xdg-mime the desktop entry is all there is to check
+	if _, err := exec.LookPath("xdg-mime"); err != nil {
+		return path, nil
+	}
+	out, err := exec.Command("xdg-mime", "query", "default", "x-scheme-handler/"+scheme).Output()
+	if got := strings.TrimSpace(string(out)); err == nil && got != filepath.Base(path) {
+		if got == "" {
+			got = "nothing"
+		}
+		return "", fmt.Errorf("%w: x-scheme-handler/%s opens %s, not %s", ErrNotRegistered, scheme, got, filepath.Base(path))
+	}
+	return path, nil
+}
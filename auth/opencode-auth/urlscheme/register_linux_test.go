@@ -0,0 +1,46 @@
+//go:build linux
+
+package urlscheme
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRegister_DesktopEntry(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	// Without xdg-mime the desktop entry is written but not made the default
+	t.Setenv("PATH", "")
+
+	if _, err := Handler("opencode-auth"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("Handler before Register: %v", err)
+	}
+	path, err := Register("opencode-auth", `/opt/open code/opencode-auth`)
+	if err == nil || !strings.Contains(err.Error(), "xdg-mime was not found") {
+		t.Errorf("Register without xdg-mime: %v", err)
+	}
+	entry, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`Exec="/opt/open code/opencode-auth" url-scheme handle %u`, "MimeType=x-scheme-handler/opencode-auth;"} {
+		if !strings.Contains(string(entry), want) {
+			t.Errorf("desktop entry lacks %q:\n%s", want, entry)
+		}
+	}
+	if got, err := Handler("opencode-auth"); err != nil || got != path {
+		t.Errorf("Handler = %q, %v", got, err)
+	}
+
+	if err := Unregister("opencode-auth"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unregister("opencode-auth"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("second Unregister: %v", err)
+	}
+	if _, err := Register("https", "/bin/true"); err == nil {
+		t.Error("registered https")
+	}
+}
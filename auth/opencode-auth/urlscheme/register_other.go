@@ -0,0 +1,15 @@
+//go:build !darwin && !linux && !windows
+
+package urlscheme
+
+func register(scheme, exe string) (string, error) {
+	return "", ErrUnsupported
+}
+
+func unregister(scheme string) error {
+	return ErrUnsupported
+}
+
+func handler(scheme string) (string, error) {
+	return "", ErrUnsupported
+}
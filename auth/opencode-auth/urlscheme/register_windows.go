@@ -0,0 +1,69 @@
+//go:build windows
+
+package urlscheme
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// classesKey is where per-user URL protocols are registered; it needs no
+// elevation.
+const classesKey = `Software\Classes\`
+
+func register(scheme, exe string) (string, error) {
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, classesKey+scheme, registry.SET_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer key.Close()
+	if err := key.SetStringValue("", "URL:"+scheme+" Protocol"); err != nil {
+		return "", err
+	}
+	if err := key.SetStringValue("URL Protocol", ""); err != nil {
+		return "", err
+	}
+
+	cmd, _, err := registry.CreateKey(registry.CURRENT_USER, classesKey+scheme+`\shell\open\command`, registry.SET_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer cmd.Close()
+	command := fmt.Sprintf(`"%s" %s "%%1"`, exe, strings.Join(HandleArgs, " "))
+	if err := cmd.SetStringValue("", command); err != nil {
+		return "", err
+	}
+	return `HKEY_CURRENT_USER\` + classesKey + scheme, nil
+}
+
+func unregister(scheme string) error {
+	// Keys are deleted from the innermost out
+	for _, sub := range []string{`\shell\open\command`, `\shell\open`, `\shell`, ""} {
+		if err := registry.DeleteKey(registry.CURRENT_USER, classesKey+scheme+sub); err != nil {
+			if errors.Is(err, registry.ErrNotExist) {
+				if sub == "" {
+					return ErrNotRegistered
+				}
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func handler(scheme string) (string, error) {
+	key, err := registry.OpenKey(registry.CURRENT_USER, classesKey+scheme+`\shell\open\command`, registry.QUERY_VALUE)
+	if err != nil {
+		return "", ErrNotRegistered
+	}
+	defer key.Close()
+	command, _, err := key.GetStringValue("")
+	if err != nil || command == "" {
+		return "", ErrNotRegistered
+	}
+	return command, nil
+}
@@ -0,0 +1,186 @@
+// Package urlscheme receives login callbacks through a private-use URI
+// scheme, e.g. opencode-auth://callback (RFC 8252 section 7.1), for IdPs that
+// don't allow loopback redirect URIs. The scheme is registered with the OS to
+// run 'opencode-auth url-scheme handle <url>', which hands the redirect to the
+// waiting login over a unix socket in the config directory.
+package urlscheme
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// SocketFile is created in the config directory (mode 0600) while a
+	// login waits for a scheme redirect
+	SocketFile = "callback.sock"
+
+	// forwardTimeout bounds handing a redirect to the waiting login
+	forwardTimeout = 5 * time.Second
+)
+
+// HandleArgs are the arguments the OS runs opencode-auth with, followed by
+// the redirect.
+var HandleArgs = []string{"url-scheme", "handle"}
+
+var (
+	// ErrNotRegistered is returned for a scheme without a handler
+	ErrNotRegistered = errors.New("the URL scheme is not registered")
+	// ErrUnsupported is returned where registering schemes isn't supported
+	ErrUnsupported = errors.New("URL schemes can only be registered on macOS, Linux and Windows")
+)
+
+// schemeSyntax is RFC 3986's scheme syntax, lowercased.
+var schemeSyntax = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// reservedSchemes are handled by the browser or other applications.
+var reservedSchemes = map[string]bool{
+	"http": true, "https": true, "file": true, "ftp": true, "data": true, "blob": true,
+	"javascript": true, "about": true, "mailto": true, "ws": true, "wss": true,
+}
+
+// Scheme returns the lowercased scheme of a private-use redirect URI, or ""
+// for any other URI.
+func Scheme(redirectURI string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return ""
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if CheckScheme(scheme) != nil {
+		return ""
+	}
+	return scheme
+}
+
+// CheckScheme returns an error if scheme can't be registered.
+func CheckScheme(scheme string) error {
+	if !schemeSyntax.MatchString(scheme) {
+		return fmt.Errorf("%q is not a URL scheme: use lowercase letters, digits, '+', '.' or '-', starting with a letter", scheme)
+	}
+	if reservedSchemes[scheme] {
+		return fmt.Errorf("%q is not a private-use scheme", scheme)
+	}
+	return nil
+}
+
+// Register makes the OS open scheme's URLs with exe. It returns where the
+// handler was registered.
+func Register(scheme, exe string) (string, error) {
+	if err := CheckScheme(scheme); err != nil {
+		return "", err
+	}
+	return register(scheme, exe)
+}
+
+// Unregister removes the handler Register added for scheme.
+func Unregister(scheme string) error {
+	if err := CheckScheme(scheme); err != nil {
+		return err
+	}
+	return unregister(scheme)
+}
+
+// Handler returns where scheme's handler is registered, or an error wrapping
+// ErrNotRegistered if it is not.
+func Handler(scheme string) (string, error) {
+	if err := CheckScheme(scheme); err != nil {
+		return "", err
+	}
+	return handler(scheme)
+}
+
+// SocketPath returns the socket a waiting login listens on.
+func SocketPath(configDir string) string {
+	return filepath.Join(configDir, SocketFile)
+}
+
+// request is what the handler sends over the socket, reply what it gets back.
+type request struct {
+	URL string `json:"url"`
+}
+
+type reply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Listen listens on the socket at path, unless another login already waits
+// on it.
+func Listen(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, errors.New("another sign-in is waiting for a callback")
+	}
+	// A socket left by a crashed login would make Listen fail
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Windows does not restrict unix sockets by file mode; the socket
+	// inherits the config directory's ACL
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// Serve passes each redirect forwarded to l to handle, until l is closed.
+// handle returns the error to report to the handler, or "" on success.
+func Serve(l net.Listener, handle func(u *url.URL) string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(forwardTimeout))
+			var req request
+			var resp reply
+			if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+				resp.Error = "malformed request"
+			} else if u, err := url.Parse(req.URL); err != nil {
+				resp.Error = "not a URL"
+			} else {
+				resp.Error = handle(u)
+			}
+			json.NewEncoder(conn).Encode(resp)
+		}()
+	}
+}
+
+// Forward hands a redirect to the login waiting on the socket at path.
+func Forward(path, redirect string) error {
+	conn, err := net.DialTimeout("unix", path, forwardTimeout)
+	if err != nil {
+		return errors.New("no sign-in is waiting for this response; start it again with 'opencode-auth login'")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	if err := json.NewEncoder(conn).Encode(request{URL: redirect}); err != nil {
+		return err
+	}
+	var resp reply
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("the waiting sign-in did not answer: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
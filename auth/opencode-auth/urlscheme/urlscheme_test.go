@@ -0,0 +1,57 @@
+package urlscheme
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScheme(t *testing.T) {
+	for uri, want := range map[string]string{
+		"opencode-auth://callback":             "opencode-auth",
+		"com.example.OpenCode:/oauth2redirect": "com.example.opencode",
+		"http://localhost:19876/callback":      "",
+		"HTTPS://example.com/cb":               "",
+		"javascript:alert(1)":                  "",
+		"not a uri":                            "",
+	} {
+		if got := Scheme(uri); got != want {
+			t.Errorf("Scheme(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SocketFile)
+	if err := Forward(path, "opencode-auth://callback?code=abc"); err == nil || !strings.Contains(err.Error(), "no sign-in is waiting") {
+		t.Errorf("Forward without a listener: %v", err)
+	}
+
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := Listen(path); err == nil {
+		t.Error("a second Listen succeeded while the first waits")
+	}
+
+	got := make(chan string, 2)
+	go Serve(l, func(u *url.URL) string {
+		got <- u.Query().Get("code")
+		if u.Query().Get("code") != "abc" {
+			return "wrong code"
+		}
+		return ""
+	})
+	if err := Forward(path, "opencode-auth://callback?code=abc"); err != nil {
+		t.Errorf("Forward: %v", err)
+	}
+	if err := Forward(path, "opencode-auth://callback?code=xyz"); err == nil || err.Error() != "wrong code" {
+		t.Errorf("Forward with a refused redirect: %v", err)
+	}
+	if a, b := <-got, <-got; a != "abc" || b != "xyz" {
+		t.Errorf("handled %q, %q", a, b)
+	}
+}
@@ -14,9 +14,15 @@ type Manifest struct {
 	ConfigVersion int    `json:"config_version"`
 	Released      string `json:"released"`
 	DownloadURL   string `json:"download_url"`
-	ChangelogURL  string `json:"changelog_url"`
-	Critical      bool   `json:"critical"`
-	Message       string `json:"message"`
+	// InstallerSHA256 is the hex SHA-256 of the installer zip published
+	// with this manifest; the updater refuses a download that differs
+	InstallerSHA256 string `json:"installer_sha256,omitempty"`
+	ChangelogURL    string `json:"changelog_url"`
+	Critical        bool   `json:"critical"`
+	Message         string `json:"message"`
+	// Compatibility lists opencode releases known to misbehave with some
+	// opencode-auth versions
+	Compatibility []Compatibility `json:"compatibility,omitempty"`
 }
 
 // UpdateInfo contains information about an available update.
@@ -34,11 +40,19 @@ type UpdateInfo struct {
 // Returns nil if the current version is "dev" or if no update is available.
 // The check uses a short timeout to avoid blocking startup.
 func CheckForUpdate(currentVersion, manifestURL string) (*UpdateInfo, *Manifest, error) {
+	return CheckForUpdateWith(currentVersion, func() (*Manifest, error) {
+		return FetchManifest(manifestURL)
+	})
+}
+
+// CheckForUpdateWith is like CheckForUpdate but obtains the manifest from
+// fetch, e.g. via the authenticated proxy with a public URL fallback.
+func CheckForUpdateWith(currentVersion string, fetch func() (*Manifest, error)) (*UpdateInfo, *Manifest, error) {
 	if IsDev(currentVersion) {
 		return nil, nil, nil
 	}
 
-	manifest, err := FetchManifest(manifestURL)
+	manifest, err := fetch()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -77,7 +91,13 @@ func CheckForUpdate(currentVersion, manifestURL string) (*UpdateInfo, *Manifest,
 // FetchManifest fetches and parses the version manifest from the given URL.
 // Uses a 3-second timeout to avoid blocking.
 func FetchManifest(manifestURL string) (*Manifest, error) {
-	client := &http.Client{Timeout: 3 * time.Second}
+	return FetchManifestWith(manifestURL, nil)
+}
+
+// FetchManifestWith is FetchManifest through transport, e.g. a mirror's;
+// nil means http.DefaultTransport.
+func FetchManifestWith(manifestURL string, transport http.RoundTripper) (*Manifest, error) {
+	client := &http.Client{Timeout: 3 * time.Second, Transport: transport}
 
 	resp, err := client.Get(manifestURL)
 	if err != nil {
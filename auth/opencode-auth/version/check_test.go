@@ -160,6 +160,31 @@ func TestCheckForUpdate_NoMinimumSet(t *testing.T) {
 	}
 }
 
+func TestCheckForUpdateWith_CustomFetcher(t *testing.T) {
+	fetch := func() (*Manifest, error) {
+		return &Manifest{Latest: "2.0.0", Minimum: "1.0.0"}, nil
+	}
+
+	info, _, err := CheckForUpdateWith("1.5.0", fetch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info == nil || !info.Available || info.Latest != "2.0.0" {
+		t.Errorf("expected update to 2.0.0, got %+v", info)
+	}
+}
+
+func TestCheckForUpdateWith_DevSkipsFetch(t *testing.T) {
+	fetch := func() (*Manifest, error) {
+		t.Error("fetch should not be called for dev version")
+		return nil, nil
+	}
+
+	if _, _, err := CheckForUpdateWith("dev", fetch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func TestFetchManifest_Success(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,121 @@
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Compatibility statuses.
+const (
+	// CompatBroken means the combination does not work; run refuses to
+	// launch opencode
+	CompatBroken = "broken"
+	// CompatWarn means the combination works with known problems
+	CompatWarn = "warn"
+)
+
+// Compatibility is one entry of the manifest's compatibility matrix: a range
+// of opencode-auth versions, a range of opencode releases, and how well they
+// work together. A range is space-separated comparisons that must all hold,
+// e.g. ">=0.4.0 <0.5.2"; a bare version means exactly that version, and an
+// empty range matches every version.
+type Compatibility struct {
+	Client   string `json:"client,omitempty"`
+	OpenCode string `json:"opencode,omitempty"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	// Upgrade is the suggested way out, e.g. "upgrade opencode to 0.5.2 or later"
+	Upgrade string `json:"upgrade,omitempty"`
+}
+
+// IncompatibleError is returned when the installed opencode is known not to
+// work with this opencode-auth.
+type IncompatibleError struct {
+	Client   string
+	OpenCode string
+	Entry    Compatibility
+}
+
+func (e *IncompatibleError) Error() string {
+	msg := fmt.Sprintf("opencode %s does not work with opencode-auth %s", e.OpenCode, e.Client)
+	if e.Entry.Message != "" {
+		msg += ": " + e.Entry.Message
+	}
+	if e.Entry.Upgrade != "" {
+		msg += "; " + e.Entry.Upgrade
+	}
+	return msg
+}
+
+var semverPattern = regexp.MustCompile(`v?\d+\.\d+\.\d+(?:[-+][0-9A-Za-z.-]+)?`)
+
+// OpenCodeVersion extracts the version from the output of
+// 'opencode --version', e.g. "opencode 0.5.1" or "v0.5.1". Returns "" when
+// there is none.
+func OpenCodeVersion(output string) string {
+	return strings.TrimPrefix(semverPattern.FindString(output), "v")
+}
+
+// CheckCompatibility returns the matrix entry for this opencode-auth and
+// the installed opencode, preferring a broken entry over a warning, or nil
+// when the combination is not listed. Entries with a client range don't
+// apply to development builds, and entries with a range that doesn't parse
+// are skipped.
+func CheckCompatibility(m *Manifest, client, openCode string) *Compatibility {
+	if m == nil || openCode == "" {
+		return nil
+	}
+	var warn *Compatibility
+	for i := range m.Compatibility {
+		entry := &m.Compatibility[i]
+		if entry.Client != "" && IsDev(client) {
+			continue
+		}
+		if !inRange(client, entry.Client) || !inRange(openCode, entry.OpenCode) {
+			continue
+		}
+		switch entry.Status {
+		case CompatBroken:
+			return entry
+		case CompatWarn:
+			if warn == nil {
+				warn = entry
+			}
+		}
+	}
+	return warn
+}
+
+// inRange reports whether v satisfies every comparison in spec.
+func inRange(v, spec string) bool {
+	for _, cond := range strings.Fields(spec) {
+		n := len(cond) - len(strings.TrimLeft(cond, "<>=!"))
+		op := cond[:n]
+		cmp, err := Compare(v, cond[n:])
+		if err != nil {
+			return false
+		}
+		var ok bool
+		switch op {
+		case "", "=", "==":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package version
+
+import "testing"
+
+func TestOpenCodeVersion(t *testing.T) {
+	for output, want := range map[string]string{
+		"0.5.1":                 "0.5.1",
+		"opencode v0.5.1":       "0.5.1",
+		"opencode 1.2.0-beta.1": "1.2.0-beta.1",
+		"opencode dev":          "",
+	} {
+		if got := OpenCodeVersion(output); got != want {
+			t.Errorf("OpenCodeVersion(%q) = %q, want %q", output, got, want)
+		}
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	m := &Manifest{Compatibility: []Compatibility{
+		{OpenCode: ">=0.6.0", Status: CompatWarn, Message: "slow streaming"},
+		{Client: "<1.4.0", OpenCode: ">=0.6.0 <0.7.0", Status: CompatBroken, Upgrade: "upgrade opencode-auth to 1.4.0"},
+		{Client: "1.4.0", OpenCode: "0.6.1", Status: CompatBroken},
+		{OpenCode: "~0.8", Status: CompatBroken},
+	}}
+	for _, tc := range []struct {
+		client, openCode, want string
+	}{
+		{"1.3.9", "0.5.9", ""},
+		{"1.3.9", "0.6.0", CompatBroken},
+		{"1.4.0", "0.6.0", CompatWarn},
+		{"1.4.0", "0.6.1", CompatBroken},
+		{"1.3.9", "0.7.0", CompatWarn},
+		{"dev", "0.6.1", CompatWarn},
+		{"1.4.0", "", ""},
+	} {
+		got := CheckCompatibility(m, tc.client, tc.openCode)
+		status := ""
+		if got != nil {
+			status = got.Status
+		}
+		if status != tc.want {
+			t.Errorf("CheckCompatibility(%s, %s) = %q, want %q", tc.client, tc.openCode, status, tc.want)
+		}
+	}
+}
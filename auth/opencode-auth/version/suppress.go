@@ -1,10 +1,14 @@
 package version
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/aws-samples/sample-opencode-with-bedrock/auth/opencode-auth/config"
 )
 
 // SuppressionState tracks notification dismissal and config patch state.
@@ -13,6 +17,24 @@ type SuppressionState struct {
 	DismissedAt       string `json:"dismissed_at,omitempty"`
 	CheckDisabled     bool   `json:"check_disabled,omitempty"`
 	LastConfigVersion int    `json:"last_config_version,omitempty"`
+
+	// LastProxyConfigVersion is the last config patch version the proxy
+	// polled, tracked apart from LastConfigVersion because the proxy only
+	// applies the proxy-scoped part of a patch.
+	LastProxyConfigVersion int `json:"last_proxy_config_version,omitempty"`
+
+	// MachineID is a random identifier used to place this client in config
+	// patch rollout cohorts; ConfigCohort records the latest placement.
+	MachineID    string        `json:"machine_id,omitempty"`
+	ConfigCohort *ConfigCohort `json:"config_cohort,omitempty"`
+}
+
+// ConfigCohort records where this client fell in a config patch rollout.
+type ConfigCohort struct {
+	ConfigVersion int     `json:"config_version"`
+	Bucket        float64 `json:"bucket"`
+	Percentage    float64 `json:"percentage"`
+	Included      bool    `json:"included"`
 }
 
 const (
@@ -22,11 +44,11 @@ const (
 
 // suppressionPath returns the path to the suppression state file.
 func suppressionPath() string {
-	home, err := os.UserHomeDir()
+	dir, err := config.StateDir()
 	if err != nil {
 		return filepath.Join(".opencode", suppressionFileName)
 	}
-	return filepath.Join(home, ".opencode", suppressionFileName)
+	return filepath.Join(dir, suppressionFileName)
 }
 
 // LoadSuppression loads the suppression state from disk.
@@ -121,3 +143,34 @@ func RecordConfigVersion(configVersion int) error {
 	state.LastConfigVersion = configVersion
 	return SaveSuppression(state)
 }
+
+// RecordProxyConfigVersion updates the last config version the proxy polled.
+func RecordProxyConfigVersion(configVersion int) error {
+	state := LoadSuppression()
+	state.LastProxyConfigVersion = configVersion
+	return SaveSuppression(state)
+}
+
+// MachineID returns this client's stable rollout identifier, generating and
+// saving one on first use.
+func MachineID() string {
+	state := LoadSuppression()
+	if state.MachineID != "" {
+		return state.MachineID
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	state.MachineID = hex.EncodeToString(b)
+	_ = SaveSuppression(state)
+	return state.MachineID
+}
+
+// RecordConfigCohort saves this client's placement in a config patch rollout.
+func RecordConfigCohort(cohort ConfigCohort) error {
+	state := LoadSuppression()
+	state.ConfigCohort = &cohort
+	return SaveSuppression(state)
+}
@@ -252,3 +252,38 @@ func TestLoadSuppression_NoFile(t *testing.T) {
 		t.Error("LoadSuppression() should return zero-value state when file doesn't exist")
 	}
 }
+
+func TestMachineID_GeneratedOnceAndPersisted(t *testing.T) {
+	withTempSuppressionDir(t)
+
+	id := MachineID()
+	if len(id) != 32 {
+		t.Fatalf("MachineID() = %q, want 32 hex chars", id)
+	}
+	if again := MachineID(); again != id {
+		t.Errorf("MachineID() changed: %q then %q", id, again)
+	}
+	if LoadSuppression().MachineID != id {
+		t.Error("machine ID was not saved")
+	}
+}
+
+func TestRecordConfigCohort(t *testing.T) {
+	withTempSuppressionDir(t)
+	if err := RecordConfigVersion(3); err != nil {
+		t.Fatal(err)
+	}
+
+	cohort := ConfigCohort{ConfigVersion: 4, Bucket: 42.5, Percentage: 5}
+	if err := RecordConfigCohort(cohort); err != nil {
+		t.Fatal(err)
+	}
+
+	state := LoadSuppression()
+	if state.ConfigCohort == nil || *state.ConfigCohort != cohort {
+		t.Errorf("ConfigCohort = %+v, want %+v", state.ConfigCohort, cohort)
+	}
+	if state.LastConfigVersion != 3 {
+		t.Errorf("LastConfigVersion = %d, want 3 (excluded cohort must not advance it)", state.LastConfigVersion)
+	}
+}
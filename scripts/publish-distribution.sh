@@ -13,8 +13,10 @@ ENVIRONMENT="${ENVIRONMENT:-dev}"
 VERSION="${VERSION:-dev}"
 MINIMUM_VERSION=""
 CONFIG_VERSION=""
+ROLLOUT_PERCENT=""
 CRITICAL="false"
 MESSAGE=""
+BOOTSTRAP_KEYS="${BOOTSTRAP_KEYS:-}"
 
 # Colors for output
 RED='\033[0;31m'
@@ -41,8 +43,10 @@ Options:
     --version VERSION              Version string (default: dev)
     --minimum-version VERSION      Minimum supported client version (for version enforcement)
     --config-version N             Config patch version number (integer)
+    --rollout-percent N            Apply the config patch to only N% of clients (canary)
     --critical                     Mark this release as critical (security fix)
     --message MESSAGE              Release message shown to users
+    --bootstrap-keys KEYS          Comma-separated public keys 'opencode-auth init --from' trusts
     --help                         Show this help message
 
 Examples:
@@ -60,6 +64,10 @@ while [[ $# -gt 0 ]]; do
             PROFILE="$2"
             shift 2
             ;;
+        --bootstrap-keys)
+            BOOTSTRAP_KEYS="$2"
+            shift 2
+            ;;
         --region)
             REGION="$2"
             shift 2
@@ -80,6 +88,10 @@ while [[ $# -gt 0 ]]; do
             CONFIG_VERSION="$2"
             shift 2
             ;;
+        --rollout-percent)
+            ROLLOUT_PERCENT="$2"
+            shift 2
+            ;;
         --critical)
             CRITICAL="true"
             shift
@@ -128,6 +140,7 @@ build_binaries() {
 
     local go_dir="$PROJECT_ROOT/auth/opencode-auth"
     local ldflags="-s -w -X main.version=${VERSION}"
+    [[ -n "$BOOTSTRAP_KEYS" ]] && ldflags="$ldflags -X main.bootstrapKeys=${BOOTSTRAP_KEYS}"
 
     local targets=(
         "darwin:amd64"
@@ -284,8 +297,11 @@ unzip -l "$ZIP_PATH" | tail -n +4 | sed '$d' | sed '$d' | while read -r line; do
 done
 
 ZIP_SIZE=$(du -h "$ZIP_PATH" | cut -f1)
+# opencode-auth update refuses an installer that doesn't match this digest
+ZIP_SHA256=$(shasum -a 256 "$ZIP_PATH" | awk '{print $1}')
 echo ""
 echo "  Created: $ZIP_PATH ($ZIP_SIZE)"
+echo "  SHA-256: $ZIP_SHA256"
 echo ""
 
 # Step 2: Upload to S3
@@ -378,6 +394,10 @@ if '$OIDC_ISSUER' and '$OIDC_ISSUER' != 'None':
 if '$WEB_DOMAIN' and '$WEB_DOMAIN' != 'None':
     config_set['version_check_url'] = 'https://$WEB_DOMAIN/version.json'
 
+# Canary: clients outside the cohort skip this patch and re-check later
+if '$ROLLOUT_PERCENT':
+    patch['rollout'] = {'percentage': float('$ROLLOUT_PERCENT')}
+
 print(json.dumps(patch, indent=2))
 ")
 
@@ -388,6 +408,9 @@ echo "$CONFIG_PATCH_JSON" | aws s3 cp - "s3://$BUCKET/downloads/config-patch.jso
 
 MODEL_COUNT=$(echo "$CONFIG_PATCH_JSON" | python3 -c "import sys,json; p=json.load(sys.stdin); print(len([k for k in p['patches']['opencode.json']['set_deep'] if k.startswith('provider.') and '.models.' in k]))" 2>/dev/null || echo "?")
 echo "  config-patch.json uploaded (config_version: $CONFIG_VERSION, models: $MODEL_COUNT)"
+if [ -n "$ROLLOUT_PERCENT" ]; then
+    echo "  Rolling out to ${ROLLOUT_PERCENT}% of clients"
+fi
 echo ""
 
 # Step 4: Generate and upload version.json manifest
@@ -427,6 +450,7 @@ manifest = {
     'config_version': int('${CONFIG_VERSION}'),
     'released': '${RELEASE_DATE}',
     'download_url': '${DOWNLOAD_URL}',
+    'installer_sha256': '${ZIP_SHA256}',
     'changelog_url': '',
     'critical': $( [ "${CRITICAL}" = "true" ] && echo "True" || echo "False" ),
     'message': '${MESSAGE}'
@@ -444,6 +468,7 @@ print(json.dumps(manifest, indent=2))
     echo "    latest:         $VERSION"
     echo "    minimum:        $MINIMUM_VERSION"
     echo "    config_version: $CONFIG_VERSION"
+    echo "    installer sha:  $ZIP_SHA256"
     echo "    critical:       $CRITICAL"
     if [[ -n "$MESSAGE" ]]; then
         echo "    message:        $MESSAGE"
@@ -458,6 +483,8 @@ else
 import sys, json
 m = json.load(sys.stdin)
 m['config_version'] = int('$CONFIG_VERSION')
+# The installer zip was replaced above
+m['installer_sha256'] = '$ZIP_SHA256'
 print(json.dumps(m, indent=2))
 ")
         echo "$UPDATED_MANIFEST" | aws s3 cp - "s3://$BUCKET/downloads/version.json" \
@@ -161,6 +161,10 @@ cp "$SCRIPT_DIR/opencode.json" "$CONFIG_DIR/opencode.json"
 chmod 600 "$CONFIG_DIR/config.json"
 chmod 600 "$CONFIG_DIR/opencode.json"
 
+# Create this machine's device key pair (kept across reinstalls); it is
+# registered with the router the first time 'oc' signs in
+"$INSTALL_DIR/opencode-auth" device init >/dev/null 2>&1 || true
+
 # Detect shell and profile file
 detect_shell_profile() {
     local shell_name profile
@@ -3,14 +3,19 @@
 
 import asyncio
 import base64
+import fnmatch
 import hashlib
+import hmac
 import json
 import logging
 import os
+import re
 import secrets
 import signal
 import sys
 import time
+import urllib.parse
+import urllib.request
 import uuid
 from concurrent.futures import ThreadPoolExecutor
 from datetime import datetime, timedelta, timezone
@@ -781,6 +786,7 @@ async def handle_anthropic_streaming(body, request_id, request):
                             "cache_write_tokens": cache_write,
                             "user_sub": request.get("user_sub", ""),
                             "user_email": request.get("user_email", ""),
+                            "workspace": request.get("workspace", ""),
                         },
                     )
 
@@ -856,6 +862,13 @@ MAX_KEYS_PER_USER = 10
 DEFAULT_EXPIRY_DAYS = 90
 MIN_EXPIRY_DAYS = 1
 MAX_EXPIRY_DAYS = 365
+# Project keys ('opencode-auth env --project') are minted per repository for
+# hooks and scripts and live for hours, not days
+MAX_PROJECT_KEY_HOURS = 24
+MAX_PROJECT_NAME_LENGTH = 128
+# What an API key may do: call the model API. Key and device management
+# always need the user's JWT.
+API_KEY_SCOPES = ["inference"]
 API_KEYS_TABLE_NAME = os.environ.get("API_KEYS_TABLE_NAME", "")
 
 _dynamodb_table = None
@@ -871,6 +884,29 @@ def generate_api_key():
     return API_KEY_PREFIX + secrets.token_urlsafe(32)
 
 
+def valid_idempotency_token(token):
+    """An Idempotency-Key is 32 to 128 base64url characters."""
+    return (
+        32 <= len(token) <= 128
+        and token.isascii()
+        and token.replace("-", "").replace("_", "").isalnum()
+    )
+
+
+def idempotent_api_key(token, user_sub):
+    """Derive the key for a create sent with an Idempotency-Key.
+
+    Each retry of a create sends the same token and so gets the same key,
+    stored under the same key_hash, instead of a second key. The client
+    draws the token from 32 random bytes; mixing in the user keeps one
+    user's token from naming another's key.
+    """
+    digest = hmac.new(
+        token.encode("utf-8"), user_sub.encode("utf-8"), hashlib.sha256
+    ).digest()
+    return API_KEY_PREFIX + base64.urlsafe_b64encode(digest).rstrip(b"=").decode("ascii")
+
+
 def decode_jwt_payload(token):
     """Decode JWT payload without signature verification (ALB already validated)."""
     parts = token.split(".")
@@ -957,8 +993,11 @@ async def api_key_auth_middleware(request, handler):
         request["auth_source"] = "api_key"
         request["user_sub"] = cached["user_sub"]
         request["user_email"] = cached["user_email"]
+        request["api_key_project"] = cached["project"]
         # Fire-and-forget last_used_at update
-        asyncio.get_event_loop().run_in_executor(_executor, _update_last_used, key_hash)
+        asyncio.get_event_loop().run_in_executor(
+            _executor, _update_last_used, key_hash, _client_ip(request)
+        )
         return await handler(request)
 
     # Validate against DynamoDB
@@ -1021,15 +1060,19 @@ async def api_key_auth_middleware(request, handler):
     _api_key_cache[key_hash] = {
         "user_sub": item["user_sub"],
         "user_email": item.get("user_email", ""),
+        "project": item.get("project", ""),
         "cache_expires": now + _API_KEY_CACHE_TTL,
     }
 
     request["auth_source"] = "api_key"
     request["user_sub"] = item["user_sub"]
     request["user_email"] = item.get("user_email", "")
+    request["api_key_project"] = item.get("project", "")
 
     # Fire-and-forget last_used_at update
-    asyncio.get_event_loop().run_in_executor(_executor, _update_last_used, key_hash)
+    asyncio.get_event_loop().run_in_executor(
+        _executor, _update_last_used, key_hash, _client_ip(request)
+    )
 
     return await handler(request)
 
@@ -1041,14 +1084,19 @@ def _lookup_api_key(key_hash):
     return resp.get("Item")
 
 
-def _update_last_used(key_hash):
-    """Synchronous fire-and-forget update of last_used_at."""
+def _update_last_used(key_hash, client_ip=""):
+    """Synchronous fire-and-forget update of last_used_at, last_used_ip, and
+    the key's request count."""
     try:
         table = get_dynamodb_table()
         table.update_item(
             Key={"key_hash": key_hash},
-            UpdateExpression="SET last_used_at = :now",
-            ExpressionAttributeValues={":now": datetime.now(timezone.utc).isoformat()},
+            UpdateExpression="SET last_used_at = :now, last_used_ip = :ip ADD request_count :one",
+            ExpressionAttributeValues={
+                ":now": datetime.now(timezone.utc).isoformat(),
+                ":ip": client_ip,
+                ":one": 1,
+            },
         )
     except Exception as e:
         log.warning("Failed to update last_used_at", extra={"error": str(e)})
@@ -1059,6 +1107,16 @@ def _update_last_used(key_hash):
 # ---------------------------------------------------------------------------
 
 
+def _client_ip(request):
+    """The caller's address: the last X-Forwarded-For entry, which the ALB
+    appends (earlier entries come from the client and can be forged), or the
+    peer address without a load balancer."""
+    forwarded = request.headers.get("X-Forwarded-For", "")
+    if forwarded:
+        return forwarded.split(",")[-1].strip()
+    return request.remote or ""
+
+
 def _extract_jwt_identity(request):
     """Extract user identity from JWT Bearer token (ALB already validated)."""
     auth_header = request.headers.get("Authorization", "")
@@ -1088,23 +1146,86 @@ async def create_api_key(request):
 
     description = body.get("description", "")
     expires_in_days = body.get("expires_in_days", DEFAULT_EXPIRY_DAYS)
-
-    # Validate expiry
-    try:
-        expires_in_days = int(expires_in_days)
-    except (ValueError, TypeError):
-        expires_in_days = DEFAULT_EXPIRY_DAYS
-    if expires_in_days < MIN_EXPIRY_DAYS or expires_in_days > MAX_EXPIRY_DAYS:
+    project = body.get("project") or ""
+    if not isinstance(project, str) or len(project) > MAX_PROJECT_NAME_LENGTH:
         return web.json_response(
             {
-                "error": f"expires_in_days must be between {MIN_EXPIRY_DAYS} and {MAX_EXPIRY_DAYS}"
+                "error": f"project must be a string of at most {MAX_PROJECT_NAME_LENGTH} characters"
             },
             status=400,
             headers={"X-Request-ID": request_id},
         )
 
-    # Check max keys per user
+    # Validate expiry: a project key gives its lifetime in hours
+    if project:
+        try:
+            lifetime = timedelta(hours=int(body.get("expires_in_hours", 0)))
+        except (ValueError, TypeError):
+            lifetime = timedelta(0)
+        if not timedelta(hours=1) <= lifetime <= timedelta(hours=MAX_PROJECT_KEY_HOURS):
+            return web.json_response(
+                {"error": f"expires_in_hours must be between 1 and {MAX_PROJECT_KEY_HOURS}"},
+                status=400,
+                headers={"X-Request-ID": request_id},
+            )
+    else:
+        try:
+            expires_in_days = int(expires_in_days)
+        except (ValueError, TypeError):
+            expires_in_days = DEFAULT_EXPIRY_DAYS
+        if expires_in_days < MIN_EXPIRY_DAYS or expires_in_days > MAX_EXPIRY_DAYS:
+            return web.json_response(
+                {
+                    "error": f"expires_in_days must be between {MIN_EXPIRY_DAYS} and {MAX_EXPIRY_DAYS}"
+                },
+                status=400,
+                headers={"X-Request-ID": request_id},
+            )
+        lifetime = timedelta(days=expires_in_days)
+
     loop = asyncio.get_event_loop()
+
+    # A retried create (same Idempotency-Key) gets the key the first attempt
+    # created, with 200 instead of 201
+    idempotency_token = request.headers.get("Idempotency-Key", "")
+    if idempotency_token:
+        if not valid_idempotency_token(idempotency_token):
+            return web.json_response(
+                {"error": "Idempotency-Key must be 32 to 128 base64url characters"},
+                status=400,
+                headers={"X-Request-ID": request_id},
+            )
+        raw_key = idempotent_api_key(idempotency_token, user_sub)
+        try:
+            existing = await loop.run_in_executor(
+                _executor, _lookup_api_key, hash_api_key(raw_key)
+            )
+        except Exception as e:
+            log.error(
+                "Failed to look up idempotent API key",
+                extra={"error": str(e), "request_id": request_id},
+            )
+            return web.json_response(
+                {"error": "Internal error"},
+                status=500,
+                headers={"X-Request-ID": request_id},
+            )
+        if existing and existing.get("user_sub") == user_sub:
+            log.info(
+                "API key create repeated",
+                extra={
+                    "request_id": request_id,
+                    "user_sub": user_sub,
+                    "key_prefix": existing.get("key_prefix"),
+                },
+            )
+            return web.json_response(
+                _created_key_response(raw_key, existing),
+                status=200,
+                headers={"X-Request-ID": request_id},
+            )
+
+    # Check max keys per user
     try:
         existing_keys = await loop.run_in_executor(_executor, _list_user_keys, user_sub)
     except Exception as e:
@@ -1118,7 +1239,15 @@ async def create_api_key(request):
             headers={"X-Request-ID": request_id},
         )
 
-    active_keys = [k for k in existing_keys if k.get("status") == "active"]
+    # Expired keys stay "active" until TTL cleanup; only live ones count, so
+    # short-lived project keys do not use up the quota
+    now = datetime.now(timezone.utc)
+    active_keys = [
+        k
+        for k in existing_keys
+        if k.get("status") == "active"
+        and datetime.fromisoformat(k.get("expires_at", now.isoformat())) > now
+    ]
     if len(active_keys) >= MAX_KEYS_PER_USER:
         return web.json_response(
             {"error": f"Maximum of {MAX_KEYS_PER_USER} active API keys per user"},
@@ -1127,13 +1256,16 @@ async def create_api_key(request):
         )
 
     # Generate key
-    raw_key = generate_api_key()
+    raw_key = (
+        idempotent_api_key(idempotency_token, user_sub)
+        if idempotency_token
+        else generate_api_key()
+    )
     key_hash = hash_api_key(raw_key)
     key_prefix = raw_key[:10]  # "oc_" + first 7 chars of random part
-    now = datetime.now(timezone.utc)
-    expires_at = now + timedelta(days=expires_in_days)
-    # TTL: 30 days after expiry for DynamoDB auto-cleanup
-    ttl_value = int(expires_at.timestamp()) + (30 * 86400)
+    expires_at = now + lifetime
+    # TTL: 30 days after expiry for DynamoDB auto-cleanup (1 day for project keys)
+    ttl_value = int(expires_at.timestamp()) + (86400 if project else 30 * 86400)
 
     item = {
         "key_hash": key_hash,
@@ -1143,9 +1275,13 @@ async def create_api_key(request):
         "description": description,
         "status": "active",
         "created_at": now.isoformat(),
+        "created_ip": _client_ip(request),
+        "created_by": user_email or user_sub,
         "expires_at": expires_at.isoformat(),
         "ttl": ttl_value,
     }
+    if project:
+        item["project"] = project
 
     try:
         await loop.run_in_executor(_executor, _put_api_key, item)
@@ -1166,23 +1302,36 @@ async def create_api_key(request):
             "request_id": request_id,
             "user_sub": user_sub,
             "key_prefix": key_prefix,
+            "project": project,
         },
     )
 
     return web.json_response(
-        {
-            "key": raw_key,
-            "key_prefix": key_prefix,
-            "description": description,
-            "status": "active",
-            "created_at": now.isoformat(),
-            "expires_at": expires_at.isoformat(),
-        },
+        _created_key_response(raw_key, item),
         status=201,
         headers={"X-Request-ID": request_id},
     )
 
 
+def _created_key_response(raw_key, item):
+    """Response body for a created key, also for a repeated create."""
+    response = {
+        "key": raw_key,
+        "key_prefix": item["key_prefix"],
+        "description": item.get("description", ""),
+        "status": item.get("status", "active"),
+        "created_at": item["created_at"],
+        "expires_at": item["expires_at"],
+    }
+    if item.get("project"):
+        lifetime = datetime.fromisoformat(item["expires_at"]) - datetime.fromisoformat(
+            item["created_at"]
+        )
+        response["project"] = item["project"]
+        response["expires_in"] = int(lifetime.total_seconds())
+    return response
+
+
 async def list_api_keys(request):
     """GET /v1/api-keys — list user's API keys (never returns full key)."""
     request_id = request.get("request_id", str(uuid.uuid4()))
@@ -1217,6 +1366,7 @@ async def list_api_keys(request):
                 "created_at": item.get("created_at", ""),
                 "expires_at": item.get("expires_at", ""),
                 "last_used_at": item.get("last_used_at", None),
+                "project": item.get("project", ""),
             }
         )
 
@@ -1226,6 +1376,76 @@ async def list_api_keys(request):
     )
 
 
+async def get_api_key(request):
+    """GET /v1/api-keys/{key_prefix} — one key's full metadata (never the key)."""
+    request_id = request.get("request_id", str(uuid.uuid4()))
+    user_sub, _ = _extract_jwt_identity(request)
+    if not user_sub:
+        return web.json_response(
+            {"error": "Authentication required"},
+            status=401,
+            headers={"X-Request-ID": request_id},
+        )
+
+    key_prefix = request.match_info.get("key_prefix", "")
+    loop = asyncio.get_event_loop()
+    try:
+        items = await loop.run_in_executor(_executor, _list_user_keys, user_sub)
+    except Exception as e:
+        log.error(
+            "Failed to list keys for describe",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response(
+            {"error": "Internal error"},
+            status=500,
+            headers={"X-Request-ID": request_id},
+        )
+
+    target = _find_key(items, key_prefix)
+    if not target:
+        return web.json_response(
+            {"error": "API key not found"},
+            status=404,
+            headers={"X-Request-ID": request_id},
+        )
+
+    return web.json_response(
+        _key_detail(target),
+        headers={"X-Request-ID": request_id},
+    )
+
+
+def _find_key(items, key_prefix):
+    """The user's key with key_prefix, or None."""
+    for item in items:
+        if key_prefix and item.get("key_prefix") == key_prefix:
+            return item
+    return None
+
+
+def _key_detail(item):
+    """Response body for GET /v1/api-keys/{key_prefix}. Keys created before
+    a field was recorded leave it empty."""
+    return {
+        "key_prefix": item.get("key_prefix", ""),
+        "description": item.get("description", ""),
+        "status": item.get("status", ""),
+        "created_at": item.get("created_at", ""),
+        "created_ip": item.get("created_ip", ""),
+        "created_by": item.get("created_by", "") or item.get("user_email", ""),
+        "expires_at": item.get("expires_at", ""),
+        "revoked_at": item.get("revoked_at", None),
+        "last_used_at": item.get("last_used_at", None),
+        "last_used_ip": item.get("last_used_ip", ""),
+        # DynamoDB returns numbers as Decimal
+        "request_count": int(item.get("request_count", 0)),
+        "scopes": list(item.get("scopes", API_KEY_SCOPES)),
+        "project": item.get("project", ""),
+        "federated_issuer": item.get("federated_issuer", ""),
+    }
+
+
 async def revoke_api_key(request):
     """DELETE /v1/api-keys/{key_prefix} — revoke a key."""
     request_id = request.get("request_id", str(uuid.uuid4()))
@@ -1260,12 +1480,7 @@ async def revoke_api_key(request):
             headers={"X-Request-ID": request_id},
         )
 
-    target = None
-    for item in items:
-        if item.get("key_prefix") == key_prefix:
-            target = item
-            break
-
+    target = _find_key(items, key_prefix)
     if not target:
         return web.json_response(
             {"error": "API key not found"},
@@ -1348,145 +1563,1064 @@ def _revoke_api_key(key_hash, user_sub):
     )
 
 
-# Health check endpoints
-async def health(request):
-    """Basic health check for ALB."""
-    return web.json_response(
-        {
-            "status": "healthy",
-            "service": "bedrock-router",
-            "version": SERVICE_VERSION,
-            "timestamp": datetime.now(timezone.utc).isoformat().replace("+00:00", "Z"),
-        }
-    )
+# ---------------------------------------------------------------------------
+# Federated token exchange — CI pipelines trade their own OIDC token (e.g.
+# GitHub Actions) for a short-lived API key, so they need no long-lived key
+# in their secrets. Follows the RFC 8693 token exchange grant.
+# ---------------------------------------------------------------------------
+
+TOKEN_EXCHANGE_GRANT = "urn:ietf:params:oauth:grant-type:token-exchange"
+SUBJECT_TOKEN_TYPES = (
+    "urn:ietf:params:oauth:token-type:jwt",
+    "urn:ietf:params:oauth:token-type:id_token",
+)
+DEFAULT_FEDERATED_TTL = 3600  # 1 hour
+MAX_FEDERATED_TTL = 12 * 3600
+MAX_FEDERATED_KEYS_PER_SUBJECT = 25
+_FEDERATED_CLOCK_SKEW = 60
+_JWKS_CACHE_TTL = 3600
+_JWKS_MIN_REFETCH = 60  # unknown kid: refetch at most once a minute
 
+# DER prefix of a SHA-256 DigestInfo (RFC 8017 section 9.2)
+_SHA256_DIGEST_INFO = bytes.fromhex("3031300d060960864801650304020105000420")
 
-async def ready(request):
-    """Deep health check - validates token can be generated."""
+
+class FederatedTokenError(Exception):
+    """A federated token was rejected; the message is safe to return."""
+
+
+def _load_federated_issuers():
+    """Parse FEDERATED_ISSUERS, a JSON list of trusted CI issuers:
+
+    [{"name": "github", "issuer": "https://token.actions.githubusercontent.com",
+      "audience": "opencode", "subjects": ["repo:my-org/*:ref:refs/heads/main"],
+      "max_ttl": 3600}]
+
+    issuer, audience and subjects (fnmatch patterns on the sub claim) are
+    required; name, jwks_uri (default: OIDC discovery) and max_ttl (seconds)
+    are optional. Invalid entries are logged and skipped.
+    """
+    raw = os.environ.get("FEDERATED_ISSUERS", "").strip()
+    if not raw:
+        return []
     try:
-        # Try to get a token to ensure IAM permissions are working
-        token = get_token()
-        if token:
-            return web.json_response(
-                {
-                    "status": "ready",
-                    "service": "bedrock-router",
-                    "version": SERVICE_VERSION,
-                    "token_status": "valid",
-                    "timestamp": datetime.now(timezone.utc)
-                    .isoformat()
-                    .replace("+00:00", "Z"),
-                }
+        entries = json.loads(raw)
+    except json.JSONDecodeError as e:
+        log.error("Invalid FEDERATED_ISSUERS", extra={"error": str(e)})
+        return []
+    if not isinstance(entries, list):
+        log.error("Invalid FEDERATED_ISSUERS", extra={"error": "expected a list"})
+        return []
+
+    issuers = []
+    for entry in entries:
+        if not isinstance(entry, dict):
+            continue
+        issuer = str(entry.get("issuer", "")).rstrip("/")
+        subjects = entry.get("subjects") or []
+        if not issuer.startswith("https://") or not entry.get("audience") or not subjects:
+            log.error(
+                "Skipping federated issuer: issuer (https), audience and subjects are required",
+                extra={"issuer": issuer},
             )
-    except Exception as e:
-        log.error("Readiness check failed", extra={"error": str(e)})
-        return web.json_response(
-            {"status": "not_ready", "error": "Token generation failed"}, status=503
+            continue
+        try:
+            max_ttl = int(entry.get("max_ttl", DEFAULT_FEDERATED_TTL))
+        except (ValueError, TypeError):
+            max_ttl = DEFAULT_FEDERATED_TTL
+        issuers.append(
+            {
+                "name": entry.get("name") or urllib.parse.urlparse(issuer).hostname,
+                "issuer": issuer,
+                "audience": str(entry["audience"]),
+                "subjects": [str(s) for s in subjects],
+                "jwks_uri": entry.get("jwks_uri", ""),
+                "max_ttl": max(60, min(max_ttl, MAX_FEDERATED_TTL)),
+            }
         )
+    return issuers
 
 
-async def models(request):
-    """List available models."""
-    data = [
-        {"id": k, "object": "model", "owned_by": "bedrock"} for k in get_model_map()
-    ]
-    return web.json_response({"object": "list", "data": data})
+FEDERATED_ISSUERS = _load_federated_issuers()
 
+# {issuer: {"keys": {kid: jwk}, "fetched_at": epoch}}
+_jwks_cache = {}
 
-@web.middleware
-async def request_logging_middleware(request, handler):
-    """Add request ID and log all requests."""
-    # Skip logging for health check endpoints to reduce log noise
-    path = request.path
-    if path in ("/health", "/ready") or path.startswith("/health/"):
-        request["request_id"] = request.headers.get("X-Request-ID", str(uuid.uuid4()))
-        response = await handler(request)
-        response.headers["X-Request-ID"] = request["request_id"]
-        return response
 
-    request_id = request.headers.get("X-Request-ID", str(uuid.uuid4()))
-    request["request_id"] = request_id
+def _b64url_decode(data):
+    """Decode unpadded base64url."""
+    return base64.urlsafe_b64decode(data + "=" * (-len(data) % 4))
 
-    start_time = time.time()
 
-    log.info(
-        "Request started",
-        extra={
-            "request_id": request_id,
-            "method": request.method,
-            "path": request.path,
-            "user_agent": request.headers.get("User-Agent", "unknown"),
-            "auth_source": request.get("auth_source", ""),
-            "user_sub": request.get("user_sub", ""),
-            "user_email": request.get("user_email", ""),
-        },
-    )
+def _http_get_json(url):
+    """Synchronous GET of a JSON document (runs in executor)."""
+    req = urllib.request.Request(url, headers={"Accept": "application/json"})
+    with urllib.request.urlopen(req, timeout=5) as resp:
+        return json.loads(resp.read(1 << 20))
 
-    try:
-        response = await handler(request)
-        duration_ms = int((time.time() - start_time) * 1000)
 
-        log.info(
-            "Request completed",
-            extra={
-                "request_id": request_id,
-                "method": request.method,
-                "path": request.path,
-                "status": response.status,
-                "duration_ms": duration_ms,
-                "auth_source": request.get("auth_source", ""),
-                "user_sub": request.get("user_sub", ""),
-                "user_email": request.get("user_email", ""),
-            },
+def _fetch_jwks(issuer_cfg):
+    """Fetch an issuer's signing keys, via OIDC discovery unless jwks_uri is set."""
+    jwks_uri = issuer_cfg.get("jwks_uri")
+    if not jwks_uri:
+        discovery = _http_get_json(
+            issuer_cfg["issuer"] + "/.well-known/openid-configuration"
         )
+        jwks_uri = discovery.get("jwks_uri", "")
+        if not jwks_uri.startswith("https://"):
+            raise FederatedTokenError("issuer discovery returned no https jwks_uri")
+    keys = _http_get_json(jwks_uri).get("keys", [])
+    return {k["kid"]: k for k in keys if k.get("kty") == "RSA" and "kid" in k}
 
-        # Add request ID to response headers
-        response.headers["X-Request-ID"] = request_id
-        return response
 
+def _signing_key(issuer_cfg, kid):
+    """Return the JWK for kid, refetching the JWKS on a miss (key rotation)."""
+    now = time.time()
+    cached = _jwks_cache.get(issuer_cfg["issuer"])
+    if cached and kid in cached["keys"] and now - cached["fetched_at"] < _JWKS_CACHE_TTL:
+        return cached["keys"][kid]
+    if cached and kid not in cached["keys"] and now - cached["fetched_at"] < _JWKS_MIN_REFETCH:
+        return None
+
+    try:
+        keys = _fetch_jwks(issuer_cfg)
+    except FederatedTokenError:
+        raise
     except Exception as e:
-        duration_ms = int((time.time() - start_time) * 1000)
         log.error(
-            "Request failed",
-            extra={
-                "request_id": request_id,
-                "method": request.method,
-                "path": request.path,
-                "error": str(e),
-                "duration_ms": duration_ms,
-                "auth_source": request.get("auth_source", ""),
-                "user_sub": request.get("user_sub", ""),
-                "user_email": request.get("user_email", ""),
-            },
+            "Failed to fetch federated issuer keys",
+            extra={"issuer": issuer_cfg["issuer"], "error": str(e)},
         )
-        raise
-
+        raise FederatedTokenError("could not fetch the issuer's signing keys")
+    _jwks_cache[issuer_cfg["issuer"]] = {"keys": keys, "fetched_at": now}
+    return keys.get(kid)
+
+
+def _verify_rs256(signing_input, signature, jwk):
+    """Verify an RS256 (RSASSA-PKCS1-v1_5 with SHA-256) signature."""
+    n = int.from_bytes(_b64url_decode(jwk["n"]), "big")
+    e = int.from_bytes(_b64url_decode(jwk["e"]), "big")
+    if n.bit_length() < 2048:
+        return False
+    k = (n.bit_length() + 7) // 8
+    if len(signature) != k:
+        return False
+    em = pow(int.from_bytes(signature, "big"), e, n).to_bytes(k, "big")
+    digest_info = _SHA256_DIGEST_INFO + hashlib.sha256(signing_input).digest()
+    expected = b"\x00\x01" + b"\xff" * (k - len(digest_info) - 3) + b"\x00" + digest_info
+    return hmac.compare_digest(em, expected)
+
+
+def validate_federated_token(token, now=None):
+    """Verify a CI-issued OIDC token against FEDERATED_ISSUERS.
+
+    Returns (issuer_cfg, claims). Raises FederatedTokenError when the token is
+    malformed, from an untrusted issuer, badly signed, expired, for another
+    audience, or for a subject no pattern allows. Runs in the executor: the
+    first token from an issuer fetches its keys.
+    """
+    now = time.time() if now is None else now
+    parts = token.split(".")
+    if len(parts) != 3:
+        raise FederatedTokenError("subject_token is not a JWT")
+    try:
+        header = json.loads(_b64url_decode(parts[0]))
+        claims = json.loads(_b64url_decode(parts[1]))
+        signature = _b64url_decode(parts[2])
+    except Exception:
+        raise FederatedTokenError("subject_token is not a JWT")
+    if not isinstance(header, dict) or not isinstance(claims, dict):
+        raise FederatedTokenError("subject_token is not a JWT")
+
+    iss = str(claims.get("iss", "")).rstrip("/")
+    issuer_cfg = next((i for i in FEDERATED_ISSUERS if i["issuer"] == iss), None)
+    if not issuer_cfg:
+        raise FederatedTokenError(f"issuer {iss!r} is not trusted")
+
+    if header.get("alg") != "RS256":
+        raise FederatedTokenError("unsupported signing algorithm (RS256 required)")
+    jwk = _signing_key(issuer_cfg, header.get("kid", ""))
+    if not jwk or not _verify_rs256(
+        (parts[0] + "." + parts[1]).encode("ascii"), signature, jwk
+    ):
+        raise FederatedTokenError("invalid token signature")
 
-async def chat_completions(request):
-    """Handle chat completion requests — routes to Converse API or Mantle proxy."""
+    try:
+        exp = float(claims["exp"])
+    except (KeyError, ValueError, TypeError):
+        raise FederatedTokenError("token has no expiry")
+    if exp < now - _FEDERATED_CLOCK_SKEW:
+        raise FederatedTokenError("token has expired")
+    for claim in ("nbf", "iat"):
+        if claim in claims and float(claims[claim]) > now + _FEDERATED_CLOCK_SKEW:
+            raise FederatedTokenError(f"token {claim} is in the future")
+
+    aud = claims.get("aud", [])
+    audiences = aud if isinstance(aud, list) else [aud]
+    if issuer_cfg["audience"] not in audiences:
+        raise FederatedTokenError("token audience does not match")
+
+    sub = str(claims.get("sub", ""))
+    if not sub or not any(fnmatch.fnmatchcase(sub, p) for p in issuer_cfg["subjects"]):
+        raise FederatedTokenError(f"subject {sub!r} is not allowed")
+    return issuer_cfg, claims
+
+
+async def exchange_federated_token(request):
+    """POST /v1/api-keys/exchange — trade a CI OIDC token for a short-lived key.
+
+    No JWT from the company IdP is involved: the ALB forwards this path
+    unauthenticated and the subject token is verified here.
+    """
     request_id = request.get("request_id", str(uuid.uuid4()))
+    headers = {"X-Request-ID": request_id}
+    if not FEDERATED_ISSUERS:
+        return web.json_response(
+            {"error": "Token exchange is not configured"}, status=404, headers=headers
+        )
 
     try:
-        body = await request.json()
-    except json.JSONDecodeError:
-        return web.json_response({"error": "Invalid JSON in request body"}, status=400)
+        if request.content_type == "application/x-www-form-urlencoded":
+            body = dict(await request.post())
+        else:
+            body = await request.json()
+    except (json.JSONDecodeError, Exception):
+        body = {}
+    if not isinstance(body, dict):
+        body = {}
 
-    model_map = get_model_map()
-    requested = body.get("model", "")
+    if body.get("grant_type") != TOKEN_EXCHANGE_GRANT:
+        return web.json_response(
+            {"error": f"grant_type must be {TOKEN_EXCHANGE_GRANT}"},
+            status=400,
+            headers=headers,
+        )
+    subject_token = body.get("subject_token", "")
+    token_type = body.get("subject_token_type", SUBJECT_TOKEN_TYPES[0])
+    if not subject_token or token_type not in SUBJECT_TOKEN_TYPES:
+        return web.json_response(
+            {"error": "subject_token must be a JWT"}, status=400, headers=headers
+        )
 
-    # Map model name if needed
-    if requested in model_map:
-        body["model"] = model_map[requested]
-        log.info(
-            "Model mapped",
-            extra={
-                "request_id": request_id,
-                "requested_model": requested,
-                "mapped_model": body["model"],
-            },
+    loop = asyncio.get_event_loop()
+    try:
+        issuer_cfg, claims = await loop.run_in_executor(
+            _executor, validate_federated_token, subject_token
+        )
+    except FederatedTokenError as e:
+        log.warning(
+            "Federated token rejected",
+            extra={"request_id": request_id, "reason": str(e)},
         )
+        return web.json_response({"error": str(e)}, status=401, headers=headers)
 
-    mapped_model = body.get("model", "")
+    try:
+        ttl = int(body.get("expires_in", DEFAULT_FEDERATED_TTL))
+    except (ValueError, TypeError):
+        ttl = DEFAULT_FEDERATED_TTL
+    ttl = max(60, min(ttl, issuer_cfg["max_ttl"]))
+
+    user_sub = f"federated:{issuer_cfg['name']}:{claims['sub']}"
+    now = datetime.now(timezone.utc)
+    try:
+        existing_keys = await loop.run_in_executor(_executor, _list_user_keys, user_sub)
+    except Exception as e:
+        log.error(
+            "Failed to list user keys",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response({"error": "Internal error"}, status=500, headers=headers)
+
+    # Expired keys stay "active" until TTL cleanup; only live ones count
+    live_keys = [
+        k
+        for k in existing_keys
+        if k.get("status") == "active"
+        and datetime.fromisoformat(k.get("expires_at", now.isoformat())) > now
+    ]
+    if len(live_keys) >= MAX_FEDERATED_KEYS_PER_SUBJECT:
+        return web.json_response(
+            {
+                "error": f"Maximum of {MAX_FEDERATED_KEYS_PER_SUBJECT} live API keys per federated subject"
+            },
+            status=409,
+            headers=headers,
+        )
+
+    raw_key = generate_api_key()
+    key_hash = hash_api_key(raw_key)
+    key_prefix = raw_key[:10]
+    expires_at = now + timedelta(seconds=ttl)
+    description = body.get("description") or f"{issuer_cfg['name']}: {claims['sub']}"
+    item = {
+        "key_hash": key_hash,
+        "key_prefix": key_prefix,
+        "user_sub": user_sub,
+        "user_email": claims.get("email", ""),
+        "description": description,
+        "status": "active",
+        "created_at": now.isoformat(),
+        "created_ip": _client_ip(request),
+        "created_by": f"{issuer_cfg['name']}: {claims['sub']}",
+        "expires_at": expires_at.isoformat(),
+        "federated_issuer": issuer_cfg["issuer"],
+        # TTL: 1 day after expiry for DynamoDB auto-cleanup
+        "ttl": int(expires_at.timestamp()) + 86400,
+    }
+
+    try:
+        await loop.run_in_executor(_executor, _put_api_key, item)
+    except Exception as e:
+        log.error(
+            "Failed to create API key",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response(
+            {"error": "Failed to create API key"}, status=500, headers=headers
+        )
+
+    log.info(
+        "Federated API key issued",
+        extra={
+            "request_id": request_id,
+            "user_sub": user_sub,
+            "key_prefix": key_prefix,
+            "issuer": issuer_cfg["issuer"],
+            "expires_in": ttl,
+        },
+    )
+
+    return web.json_response(
+        {
+            "key": raw_key,
+            "key_prefix": key_prefix,
+            "description": description,
+            "status": "active",
+            "created_at": now.isoformat(),
+            "expires_at": expires_at.isoformat(),
+            "expires_in": ttl,
+        },
+        status=201,
+        headers=headers,
+    )
+
+
+# ---------------------------------------------------------------------------
+# Device identity — each machine registers an RSA public key, and the local
+# proxy signs a short-lived X-Device-Assertion (an RS256 JWT) with the private
+# key. DEVICE_POSTURE=audit logs requests without a valid assertion;
+# DEVICE_POSTURE=enforce refuses them, so only managed devices get through.
+# ---------------------------------------------------------------------------
+
+DEVICES_TABLE_NAME = os.environ.get("DEVICES_TABLE_NAME", "")
+DEVICE_POSTURE = os.environ.get("DEVICE_POSTURE", "off").strip().lower()
+DEVICE_ID_PREFIX = "dev_"
+MAX_DEVICES_PER_USER = 10
+MAX_DEVICE_ASSERTION_TTL = 3600  # "session" assertions; "request" ones last 5 minutes
+_DEVICE_CLOCK_SKEW = 60
+_DEVICE_CACHE_TTL = 300  # 5 minutes
+_DEVICE_ID_CHARS = frozenset(
+    "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+_devices_table = None
+
+# In-memory cache of device items: {device_id: {"item": item or None, "cache_expires": epoch}}
+_device_cache = {}
+
+
+class DeviceAssertionError(Exception):
+    """A device assertion was rejected; the message is safe to return."""
+
+
+def get_devices_table():
+    """Lazy-init the devices DynamoDB Table resource."""
+    global _devices_table
+    if _devices_table is None:
+        if not DEVICES_TABLE_NAME:
+            raise RuntimeError("DEVICES_TABLE_NAME not configured")
+        region = os.environ.get("AWS_REGION", "us-east-1")
+        dynamodb = boto3.resource("dynamodb", region_name=region)
+        _devices_table = dynamodb.Table(DEVICES_TABLE_NAME)
+    return _devices_table
+
+
+def _valid_device_id(device_id):
+    """Device IDs are dev_ followed by 16 to 64 base64url characters."""
+    if not isinstance(device_id, str) or not device_id.startswith(DEVICE_ID_PREFIX):
+        return False
+    rest = device_id[len(DEVICE_ID_PREFIX):]
+    return 16 <= len(rest) <= 64 and set(rest) <= _DEVICE_ID_CHARS
+
+
+def _parse_device_key(jwk):
+    """Return the registrable form of an RSA public JWK, or raise ValueError."""
+    if not isinstance(jwk, dict) or jwk.get("kty") != "RSA":
+        raise ValueError("public_key must be an RSA JWK")
+    try:
+        n = int.from_bytes(_b64url_decode(str(jwk["n"])), "big")
+        e = int.from_bytes(_b64url_decode(str(jwk["e"])), "big")
+    except (KeyError, ValueError):
+        raise ValueError("public_key must have base64url n and e")
+    if n.bit_length() < 2048 or e < 3 or e % 2 == 0:
+        raise ValueError("public_key must be at least 2048 bits")
+    return {"kty": "RSA", "n": str(jwk["n"]), "e": str(jwk["e"])}
+
+
+def jwk_thumbprint(jwk):
+    """RFC 7638 thumbprint of an RSA JWK, as 'opencode-auth device status' shows it."""
+    canonical = json.dumps(
+        {"e": jwk["e"], "kty": jwk["kty"], "n": jwk["n"]}, separators=(",", ":")
+    )
+    digest = hashlib.sha256(canonical.encode("utf-8")).digest()
+    return base64.urlsafe_b64encode(digest).rstrip(b"=").decode("ascii")
+
+
+def _device_assertion_kid(assertion):
+    """Return the device ID an assertion claims to come from."""
+    parts = assertion.split(".")
+    if len(parts) != 3:
+        raise DeviceAssertionError("device assertion is not a JWT")
+    try:
+        header = json.loads(_b64url_decode(parts[0]))
+    except Exception:
+        raise DeviceAssertionError("device assertion is not a JWT")
+    if not isinstance(header, dict) or not _valid_device_id(header.get("kid")):
+        raise DeviceAssertionError("device assertion has no device ID")
+    return header["kid"]
+
+
+def validate_device_assertion(assertion, device, method, path, now=None):
+    """Verify an X-Device-Assertion against the registered device item.
+
+    The assertion must be signed with the device's current key, unexpired,
+    and issued for at most MAX_DEVICE_ASSERTION_TTL. One bound to a request
+    (htm and htu claims) must match this request's method and path. Returns
+    the claims; raises DeviceAssertionError otherwise.
+    """
+    now = time.time() if now is None else now
+    parts = assertion.split(".")
+    if len(parts) != 3:
+        raise DeviceAssertionError("device assertion is not a JWT")
+    try:
+        header = json.loads(_b64url_decode(parts[0]))
+        claims = json.loads(_b64url_decode(parts[1]))
+        signature = _b64url_decode(parts[2])
+    except Exception:
+        raise DeviceAssertionError("device assertion is not a JWT")
+    if not isinstance(header, dict) or not isinstance(claims, dict):
+        raise DeviceAssertionError("device assertion is not a JWT")
+
+    if header.get("alg") != "RS256":
+        raise DeviceAssertionError("unsupported signing algorithm (RS256 required)")
+    jwk = json.loads(device["public_key"])
+    if not _verify_rs256((parts[0] + "." + parts[1]).encode("ascii"), signature, jwk):
+        raise DeviceAssertionError("invalid device assertion signature")
+    if claims.get("iss") != device["device_id"]:
+        raise DeviceAssertionError("device assertion issuer does not match")
+
+    try:
+        iat, exp = float(claims["iat"]), float(claims["exp"])
+    except (KeyError, ValueError, TypeError):
+        raise DeviceAssertionError("device assertion has no lifetime")
+    if exp < now - _DEVICE_CLOCK_SKEW:
+        raise DeviceAssertionError("device assertion has expired")
+    if iat > now + _DEVICE_CLOCK_SKEW:
+        raise DeviceAssertionError("device assertion iat is in the future")
+    if exp - iat > MAX_DEVICE_ASSERTION_TTL:
+        raise DeviceAssertionError("device assertion lifetime is too long")
+
+    if "htm" in claims or "htu" in claims:
+        if claims.get("htm") != method or claims.get("htu") != path:
+            raise DeviceAssertionError("device assertion was issued for another request")
+    return claims
+
+
+def _device_posture_exempt(request):
+    """Paths and callers device posture does not apply to."""
+    path = request.path
+    return (
+        path in ("/health", "/ready")
+        or path.startswith("/health/")
+        # Registration has to work before a device can assert anything
+        or path.startswith("/v1/devices")
+        or path.startswith("/v1/api-keys")
+        or path.startswith("/v1/update/")
+        # CI pipelines are vouched for by their own OIDC issuer
+        or request.get("user_sub", "").startswith("federated:")
+    )
+
+
+async def _get_device(device_id):
+    """Look up a device, through the cache."""
+    now = time.time()
+    cached = _device_cache.get(device_id)
+    if cached and now < cached["cache_expires"]:
+        return cached["item"]
+    loop = asyncio.get_event_loop()
+    item = await loop.run_in_executor(_executor, _lookup_device, device_id)
+    _device_cache[device_id] = {"item": item, "cache_expires": now + _DEVICE_CACHE_TTL}
+    return item
+
+
+@web.middleware
+async def device_posture_middleware(request, handler):
+    """Check X-Device-Assertion when DEVICE_POSTURE is audit or enforce."""
+    if DEVICE_POSTURE not in ("audit", "enforce") or _device_posture_exempt(request):
+        return await handler(request)
+
+    request_id = request.get("request_id", "")
+    assertion = request.headers.get("X-Device-Assertion", "")
+    try:
+        if not assertion:
+            raise DeviceAssertionError("no device assertion; run 'opencode-auth device register'")
+        device_id = _device_assertion_kid(assertion)
+        try:
+            device = await _get_device(device_id)
+        except Exception as e:
+            log.error("Device lookup failed", extra={"error": str(e), "request_id": request_id})
+            raise DeviceAssertionError("device could not be verified")
+        if not device or device.get("status") != "active":
+            raise DeviceAssertionError("device is not registered")
+        if device.get("user_sub") != request.get("user_sub"):
+            raise DeviceAssertionError("device is registered to another user")
+        validate_device_assertion(assertion, device, request.method, request.path)
+    except DeviceAssertionError as e:
+        log.warning(
+            "Device assertion rejected",
+            extra={
+                "request_id": request_id,
+                "user_sub": request.get("user_sub", ""),
+                "reason": str(e),
+                "posture": DEVICE_POSTURE,
+            },
+        )
+        if DEVICE_POSTURE == "enforce":
+            return web.json_response(
+                {
+                    "error": {
+                        "message": f"Device check failed: {e}",
+                        "type": "auth_error",
+                        "code": "device_not_trusted",
+                    }
+                },
+                status=403,
+            )
+        return await handler(request)
+
+    request["device_id"] = device_id
+    # Fire-and-forget last_seen_at update
+    asyncio.get_event_loop().run_in_executor(_executor, _update_device_last_seen, device_id)
+    return await handler(request)
+
+
+def _device_summary(item):
+    """The fields of a device item returned to its owner."""
+    return {
+        "device_id": item.get("device_id", ""),
+        "name": item.get("name", ""),
+        "platform": item.get("platform", ""),
+        "status": item.get("status", ""),
+        "key_thumbprint": item.get("key_thumbprint", ""),
+        "created_at": item.get("created_at", ""),
+        "rotated_at": item.get("rotated_at", None),
+        "last_seen_at": item.get("last_seen_at", None),
+    }
+
+
+async def register_device(request):
+    """POST /v1/devices — register a device's public key, or rotate it."""
+    request_id = request.get("request_id", str(uuid.uuid4()))
+    headers = {"X-Request-ID": request_id}
+    user_sub, user_email = _extract_jwt_identity(request)
+    if not user_sub:
+        return web.json_response(
+            {"error": "Authentication required"}, status=401, headers=headers
+        )
+
+    try:
+        body = await request.json()
+    except (json.JSONDecodeError, Exception):
+        body = {}
+    if not isinstance(body, dict):
+        body = {}
+
+    device_id = body.get("device_id", "")
+    if not _valid_device_id(device_id):
+        return web.json_response(
+            {"error": "device_id must be dev_ followed by 16-64 base64url characters"},
+            status=400,
+            headers=headers,
+        )
+    try:
+        public_key = _parse_device_key(body.get("public_key"))
+    except ValueError as e:
+        return web.json_response({"error": str(e)}, status=400, headers=headers)
+    name = str(body.get("name", ""))[:100]
+    platform = str(body.get("platform", ""))[:50]
+
+    loop = asyncio.get_event_loop()
+    try:
+        existing = await loop.run_in_executor(_executor, _lookup_device, device_id)
+        user_devices = await loop.run_in_executor(_executor, _list_user_devices, user_sub)
+    except Exception as e:
+        log.error(
+            "Failed to look up devices",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response({"error": "Internal error"}, status=500, headers=headers)
+
+    if existing and existing.get("user_sub") != user_sub:
+        return web.json_response(
+            {"error": "Device is registered to another user"}, status=409, headers=headers
+        )
+    rotating = existing is not None and existing.get("status") == "active"
+    active = [d for d in user_devices if d.get("status") == "active"]
+    if not rotating and len(active) >= MAX_DEVICES_PER_USER:
+        return web.json_response(
+            {"error": f"Maximum of {MAX_DEVICES_PER_USER} registered devices per user"},
+            status=409,
+            headers=headers,
+        )
+
+    now = datetime.now(timezone.utc).isoformat()
+    item = {
+        "device_id": device_id,
+        "user_sub": user_sub,
+        "user_email": user_email,
+        "name": name,
+        "platform": platform,
+        "public_key": json.dumps(public_key),
+        "key_thumbprint": jwk_thumbprint(public_key),
+        "status": "active",
+        "created_at": existing["created_at"] if rotating else now,
+    }
+    if rotating:
+        item["rotated_at"] = now
+
+    try:
+        await loop.run_in_executor(_executor, _put_device, item, user_sub)
+    except Exception as e:
+        log.error(
+            "Failed to register device",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response(
+            {"error": "Failed to register device"}, status=500, headers=headers
+        )
+
+    # The old key must stop working here at once; other tasks within 5 minutes
+    _device_cache.pop(device_id, None)
+
+    log.info(
+        "Device key rotated" if rotating else "Device registered",
+        extra={
+            "request_id": request_id,
+            "user_sub": user_sub,
+            "device_id": device_id,
+            "key_thumbprint": item["key_thumbprint"],
+        },
+    )
+
+    return web.json_response(
+        _device_summary(item), status=200 if rotating else 201, headers=headers
+    )
+
+
+async def list_devices(request):
+    """GET /v1/devices — list the user's devices."""
+    request_id = request.get("request_id", str(uuid.uuid4()))
+    headers = {"X-Request-ID": request_id}
+    user_sub, _ = _extract_jwt_identity(request)
+    if not user_sub:
+        return web.json_response(
+            {"error": "Authentication required"}, status=401, headers=headers
+        )
+
+    loop = asyncio.get_event_loop()
+    try:
+        items = await loop.run_in_executor(_executor, _list_user_devices, user_sub)
+    except Exception as e:
+        log.error(
+            "Failed to list devices", extra={"error": str(e), "request_id": request_id}
+        )
+        return web.json_response({"error": "Internal error"}, status=500, headers=headers)
+
+    return web.json_response(
+        {"devices": [_device_summary(item) for item in items]}, headers=headers
+    )
+
+
+async def deregister_device(request):
+    """DELETE /v1/devices/{device_id} — deregister one of the user's devices."""
+    request_id = request.get("request_id", str(uuid.uuid4()))
+    headers = {"X-Request-ID": request_id}
+    user_sub, _ = _extract_jwt_identity(request)
+    if not user_sub:
+        return web.json_response(
+            {"error": "Authentication required"}, status=401, headers=headers
+        )
+
+    device_id = request.match_info.get("device_id", "")
+    loop = asyncio.get_event_loop()
+    try:
+        item = await loop.run_in_executor(_executor, _lookup_device, device_id)
+    except Exception as e:
+        log.error(
+            "Failed to look up device",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response({"error": "Internal error"}, status=500, headers=headers)
+
+    # Another user's device is reported as missing, not as forbidden
+    if not item or item.get("user_sub") != user_sub or item.get("status") != "active":
+        return web.json_response(
+            {"error": "Device not found"}, status=404, headers=headers
+        )
+
+    try:
+        await loop.run_in_executor(_executor, _deregister_device, device_id, user_sub)
+    except Exception as e:
+        log.error(
+            "Failed to deregister device",
+            extra={"error": str(e), "request_id": request_id},
+        )
+        return web.json_response(
+            {"error": "Failed to deregister device"}, status=500, headers=headers
+        )
+
+    _device_cache.pop(device_id, None)
+
+    log.info(
+        "Device deregistered",
+        extra={"request_id": request_id, "user_sub": user_sub, "device_id": device_id},
+    )
+
+    return web.json_response(
+        {"status": "deregistered", "device_id": device_id}, headers=headers
+    )
+
+
+def _lookup_device(device_id):
+    """Synchronous DynamoDB get_item (runs in executor)."""
+    table = get_devices_table()
+    resp = table.get_item(Key={"device_id": device_id})
+    return resp.get("Item")
+
+
+def _list_user_devices(user_sub):
+    """Synchronous DynamoDB query on user-sub-index (runs in executor)."""
+    table = get_devices_table()
+    resp = table.query(
+        IndexName="user-sub-index",
+        KeyConditionExpression="user_sub = :sub",
+        ExpressionAttributeValues={":sub": user_sub},
+    )
+    return resp.get("Items", [])
+
+
+def _put_device(item, user_sub):
+    """Synchronous DynamoDB put_item that never takes over another user's device."""
+    table = get_devices_table()
+    table.put_item(
+        Item=item,
+        ConditionExpression="attribute_not_exists(device_id) OR user_sub = :sub",
+        ExpressionAttributeValues={":sub": user_sub},
+    )
+
+
+def _deregister_device(device_id, user_sub):
+    """Synchronous DynamoDB update to deregister a device (runs in executor)."""
+    table = get_devices_table()
+    table.update_item(
+        Key={"device_id": device_id},
+        UpdateExpression="SET #s = :deregistered, deregistered_at = :now",
+        ConditionExpression="user_sub = :sub",
+        ExpressionAttributeNames={"#s": "status"},
+        ExpressionAttributeValues={
+            ":deregistered": "deregistered",
+            ":now": datetime.now(timezone.utc).isoformat(),
+            ":sub": user_sub,
+        },
+    )
+
+
+def _update_device_last_seen(device_id):
+    """Synchronous fire-and-forget update of last_seen_at."""
+    try:
+        table = get_devices_table()
+        table.update_item(
+            Key={"device_id": device_id},
+            UpdateExpression="SET last_seen_at = :now",
+            ExpressionAttributeValues={":now": datetime.now(timezone.utc).isoformat()},
+        )
+    except Exception as e:
+        log.warning("Failed to update device last_seen_at", extra={"error": str(e)})
+
+
+# ---------------------------------------------------------------------------
+# User status — with a Cognito user pool (USER_POOL_ID), JWT requests from a
+# user an administrator disabled or deleted are refused with access_revoked.
+# The ALB keeps accepting their token until it expires, so without this a
+# disabled user keeps working for up to an hour. ACCESS_CONTACT is who to ask.
+# ---------------------------------------------------------------------------
+
+USER_POOL_ID = os.environ.get("USER_POOL_ID", "")
+ACCESS_CONTACT = os.environ.get("ACCESS_CONTACT", "")
+_USER_STATUS_CACHE_TTL = 300  # 5 minutes
+
+_cognito_client = None
+
+# In-memory cache of user status: {username: {"enabled": bool, "cache_expires": epoch}}
+_user_status_cache = {}
+
+
+def get_cognito_client():
+    """Lazy-init the Cognito identity provider client."""
+    global _cognito_client
+    if _cognito_client is None:
+        region = os.environ.get("AWS_REGION", "us-east-1")
+        _cognito_client = boto3.client("cognito-idp", region_name=region)
+    return _cognito_client
+
+
+def access_revoked_error(contact=""):
+    """The error body for a revoked user. Clients match on the code."""
+    error = {
+        "message": "Your access was revoked by an administrator",
+        "type": "auth_error",
+        "code": "access_revoked",
+    }
+    if contact:
+        error["contact"] = contact
+    return {"error": error}
+
+
+def _cognito_username(claims):
+    """The Cognito user name from ID token or access token claims."""
+    return claims.get("cognito:username") or claims.get("username") or ""
+
+
+def _user_enabled(username):
+    """Synchronous Cognito lookup (runs in executor). Deleted users count as disabled."""
+    client = get_cognito_client()
+    try:
+        user = client.admin_get_user(UserPoolId=USER_POOL_ID, Username=username)
+    except client.exceptions.UserNotFoundException:
+        return False
+    return user.get("Enabled", True)
+
+
+async def _get_user_enabled(username):
+    """Look up whether a user is enabled, through the cache."""
+    now = time.time()
+    cached = _user_status_cache.get(username)
+    if cached and now < cached["cache_expires"]:
+        return cached["enabled"]
+    loop = asyncio.get_event_loop()
+    enabled = await loop.run_in_executor(_executor, _user_enabled, username)
+    _user_status_cache[username] = {
+        "enabled": enabled,
+        "cache_expires": now + _USER_STATUS_CACHE_TTL,
+    }
+    return enabled
+
+
+@web.middleware
+async def user_status_middleware(request, handler):
+    """Refuse JWT requests from disabled users when USER_POOL_ID is set."""
+    path = request.path
+    if (
+        not USER_POOL_ID
+        or request.get("auth_source") != "jwt"
+        or path in ("/health", "/ready")
+        or path.startswith("/health/")
+        or path.startswith("/v1/update/")
+    ):
+        return await handler(request)
+
+    claims = decode_jwt_payload(request.headers.get("Authorization", "")[7:]) or {}
+    username = _cognito_username(claims)
+    if not username:
+        return await handler(request)
+    try:
+        enabled = await _get_user_enabled(username)
+    except Exception as e:
+        # Fail open: the ALB has already validated the token
+        log.error(
+            "User status lookup failed",
+            extra={"error": str(e), "request_id": request.get("request_id", "")},
+        )
+        return await handler(request)
+    if enabled:
+        return await handler(request)
+
+    log.warning(
+        "Request from revoked user refused",
+        extra={
+            "request_id": request.get("request_id", ""),
+            "user_sub": request.get("user_sub", ""),
+            "path": path,
+        },
+    )
+    return web.json_response(access_revoked_error(ACCESS_CONTACT), status=403)
+
+
+# Health check endpoints
+async def health(request):
+    """Basic health check for ALB."""
+    return web.json_response(
+        {
+            "status": "healthy",
+            "service": "bedrock-router",
+            "version": SERVICE_VERSION,
+            "timestamp": datetime.now(timezone.utc).isoformat().replace("+00:00", "Z"),
+        }
+    )
+
+
+async def ready(request):
+    """Deep health check - validates token can be generated."""
+    try:
+        # Try to get a token to ensure IAM permissions are working
+        token = get_token()
+        if token:
+            return web.json_response(
+                {
+                    "status": "ready",
+                    "service": "bedrock-router",
+                    "version": SERVICE_VERSION,
+                    "token_status": "valid",
+                    "timestamp": datetime.now(timezone.utc)
+                    .isoformat()
+                    .replace("+00:00", "Z"),
+                }
+            )
+    except Exception as e:
+        log.error("Readiness check failed", extra={"error": str(e)})
+        return web.json_response(
+            {"status": "not_ready", "error": "Token generation failed"}, status=503
+        )
+
+
+async def models(request):
+    """List available models."""
+    data = [
+        {"id": k, "object": "model", "owned_by": "bedrock"} for k in get_model_map()
+    ]
+    return web.json_response({"object": "list", "data": data})
+
+
+# Header opencode-auth sets to the active workspace, so usage is attributed
+# to the right workspace or account of a user who belongs to several
+WORKSPACE_HEADER = "X-OpenCode-Workspace"
+_WORKSPACE_NAME = re.compile(r"[A-Za-z0-9][A-Za-z0-9._-]{0,63}")
+
+
+def workspace_name(value):
+    """The workspace a request names, or "" if none or malformed."""
+    value = (value or "").strip()
+    return value if _WORKSPACE_NAME.fullmatch(value) else ""
+
+
+@web.middleware
+async def request_logging_middleware(request, handler):
+    """Add request ID and log all requests."""
+    # Skip logging for health check endpoints to reduce log noise
+    path = request.path
+    if path in ("/health", "/ready") or path.startswith("/health/"):
+        request["request_id"] = request.headers.get("X-Request-ID", str(uuid.uuid4()))
+        response = await handler(request)
+        response.headers["X-Request-ID"] = request["request_id"]
+        return response
+
+    request_id = request.headers.get("X-Request-ID", str(uuid.uuid4()))
+    request["request_id"] = request_id
+    request["workspace"] = workspace_name(request.headers.get(WORKSPACE_HEADER))
+
+    start_time = time.time()
+
+    log.info(
+        "Request started",
+        extra={
+            "request_id": request_id,
+            "method": request.method,
+            "path": request.path,
+            "user_agent": request.headers.get("User-Agent", "unknown"),
+            "auth_source": request.get("auth_source", ""),
+            "user_sub": request.get("user_sub", ""),
+            "user_email": request.get("user_email", ""),
+        },
+    )
+
+    try:
+        response = await handler(request)
+        duration_ms = int((time.time() - start_time) * 1000)
+
+        log.info(
+            "Request completed",
+            extra={
+                "request_id": request_id,
+                "method": request.method,
+                "path": request.path,
+                "status": response.status,
+                "duration_ms": duration_ms,
+                "auth_source": request.get("auth_source", ""),
+                "user_sub": request.get("user_sub", ""),
+                "user_email": request.get("user_email", ""),
+                "device_id": request.get("device_id", ""),
+                "api_key_project": request.get("api_key_project", ""),
+                "workspace": request.get("workspace", ""),
+            },
+        )
+
+        # Add request ID to response headers
+        response.headers["X-Request-ID"] = request_id
+        return response
+
+    except Exception as e:
+        duration_ms = int((time.time() - start_time) * 1000)
+        log.error(
+            "Request failed",
+            extra={
+                "request_id": request_id,
+                "method": request.method,
+                "path": request.path,
+                "error": str(e),
+                "duration_ms": duration_ms,
+                "auth_source": request.get("auth_source", ""),
+                "user_sub": request.get("user_sub", ""),
+                "user_email": request.get("user_email", ""),
+            },
+        )
+        raise
+
+
+async def chat_completions(request):
+    """Handle chat completion requests — routes to Converse API or Mantle proxy."""
+    request_id = request.get("request_id", str(uuid.uuid4()))
+
+    try:
+        body = await request.json()
+    except json.JSONDecodeError:
+        return web.json_response({"error": "Invalid JSON in request body"}, status=400)
+
+    model_map = get_model_map()
+    requested = body.get("model", "")
+
+    # Map model name if needed
+    if requested in model_map:
+        body["model"] = model_map[requested]
+        log.info(
+            "Model mapped",
+            extra={
+                "request_id": request_id,
+                "requested_model": requested,
+                "mapped_model": body["model"],
+            },
+        )
+
+    mapped_model = body.get("model", "")
 
     log.info(
         "Routing decision",
@@ -1699,6 +2833,51 @@ async def update_download_url(request):
         )
 
 
+async def update_manifest_url(request):
+    """Return a presigned S3 URL for the version.json manifest.
+
+    Used by clients when the public /version.json route requires auth.
+    """
+    if not DISTRIBUTION_BUCKET:
+        return web.json_response(
+            {
+                "error": {
+                    "message": "Distribution bucket not configured",
+                    "type": "server_error",
+                }
+            },
+            status=500,
+        )
+
+    loop = asyncio.get_event_loop()
+    try:
+
+        def _generate():
+            s3 = boto3.client("s3", config=BotoConfig(signature_version="s3v4"))
+            return s3.generate_presigned_url(
+                "get_object",
+                Params={
+                    "Bucket": DISTRIBUTION_BUCKET,
+                    "Key": "downloads/version.json",
+                },
+                ExpiresIn=300,
+            )
+
+        url = await loop.run_in_executor(_executor, _generate)
+        return web.json_response({"download_url": url, "expires_in": 300})
+    except Exception as e:
+        log.error("Failed to generate manifest URL", extra={"error": str(e)})
+        return web.json_response(
+            {
+                "error": {
+                    "message": "Failed to generate manifest URL",
+                    "type": "server_error",
+                }
+            },
+            status=500,
+        )
+
+
 async def update_config(request):
     """Return the config patch for clients to apply."""
     if not DISTRIBUTION_BUCKET:
@@ -1754,6 +2933,8 @@ app = web.Application(
         version_gate_middleware,
         api_key_auth_middleware,
         request_logging_middleware,
+        user_status_middleware,
+        device_posture_middleware,
     ]
 )
 app.router.add_get("/health", health)
@@ -1763,9 +2944,17 @@ app.router.add_post("/v1/chat/completions", chat_completions)
 # API key management endpoints (JWT-protected via ALB rule)
 app.router.add_post("/v1/api-keys", create_api_key)
 app.router.add_get("/v1/api-keys", list_api_keys)
+app.router.add_get("/v1/api-keys/{key_prefix}", get_api_key)
 app.router.add_delete("/v1/api-keys/{key_prefix}", revoke_api_key)
+# CI token exchange (no ALB auth; the subject token is verified by the router)
+app.router.add_post("/v1/api-keys/exchange", exchange_federated_token)
+# Device registration for posture checks (JWT-protected via ALB rule)
+app.router.add_post("/v1/devices", register_device)
+app.router.add_get("/v1/devices", list_devices)
+app.router.add_delete("/v1/devices/{device_id}", deregister_device)
 # Update management endpoints (JWT-protected via ALB rule)
 app.router.add_get("/v1/update/download-url", update_download_url)
+app.router.add_get("/v1/update/manifest", update_manifest_url)
 app.router.add_get("/v1/update/config", update_config)
 app.on_shutdown.append(on_shutdown)
 
@@ -452,3 +452,375 @@ class TestBuildUsage:
         )
         assert result["usage"]["cache_read_input_tokens"] == 80
         assert result["usage"]["prompt_tokens_details"]["cached_tokens"] == 80
+
+
+def _rsa_test_key(bits=2048):
+    """Generate a throwaway RSA key (n, e, d) for signing test tokens."""
+    import random
+
+    rng = random.Random(2657)
+
+    def is_prime(n):
+        if n % 2 == 0:
+            return False
+        d, r = n - 1, 0
+        while d % 2 == 0:
+            d, r = d // 2, r + 1
+        for _ in range(20):
+            x = pow(rng.randrange(2, n - 1), d, n)
+            if x in (1, n - 1):
+                continue
+            for _ in range(r - 1):
+                x = pow(x, 2, n)
+                if x == n - 1:
+                    break
+            else:
+                return False
+        return True
+
+    def prime():
+        while True:
+            p = rng.getrandbits(bits // 2) | (3 << (bits // 2 - 2)) | 1
+            if is_prime(p) and (p - 1) % 65537:
+                return p
+
+    p, q = prime(), prime()
+    e = 65537
+    return p * q, e, pow(e, -1, (p - 1) * (q - 1))
+
+
+class TestFederatedTokenExchange:
+    """Verify CI OIDC tokens are checked before they can mint API keys."""
+
+    ISSUER = "https://token.actions.githubusercontent.com"
+
+    @classmethod
+    def setup_class(cls):
+        import base64
+
+        cls.n, cls.e, cls.d = _rsa_test_key()
+
+        def b64(i):
+            raw = i.to_bytes((i.bit_length() + 7) // 8, "big")
+            return base64.urlsafe_b64encode(raw).rstrip(b"=").decode()
+
+        cls.jwk = {"kty": "RSA", "kid": "k1", "n": b64(cls.n), "e": b64(cls.e)}
+
+    def _token(self, alg="RS256", kid="k1", **overrides):
+        import base64
+        import hashlib
+
+        import main
+
+        def enc(obj):
+            return base64.urlsafe_b64encode(json.dumps(obj).encode()).rstrip(b"=").decode()
+
+        claims = {
+            "iss": self.ISSUER,
+            "aud": "opencode",
+            "sub": "repo:my-org/app:ref:refs/heads/main",
+            "iat": int(time.time()),
+            "exp": int(time.time()) + 300,
+        }
+        claims.update(overrides)
+        signing_input = enc({"alg": alg, "kid": kid}) + "." + enc(claims)
+        k = (self.n.bit_length() + 7) // 8
+        digest_info = main._SHA256_DIGEST_INFO + hashlib.sha256(signing_input.encode()).digest()
+        em = b"\x00\x01" + b"\xff" * (k - len(digest_info) - 3) + b"\x00" + digest_info
+        sig = pow(int.from_bytes(em, "big"), self.d, self.n).to_bytes(k, "big")
+        return signing_input + "." + base64.urlsafe_b64encode(sig).rstrip(b"=").decode()
+
+    def _validate(self, token):
+        import main
+
+        issuers = [
+            {
+                "name": "github",
+                "issuer": self.ISSUER,
+                "audience": "opencode",
+                "subjects": ["repo:my-org/*:ref:refs/heads/main"],
+                "jwks_uri": "",
+                "max_ttl": 3600,
+            }
+        ]
+        with patch.object(main, "FEDERATED_ISSUERS", issuers), patch.object(
+            main, "_jwks_cache", {}
+        ), patch("main._fetch_jwks", return_value={"k1": self.jwk}):
+            return main.validate_federated_token(token)
+
+    def test_valid_token(self):
+        """A correctly signed token for an allowed subject is accepted."""
+        issuer_cfg, claims = self._validate(self._token())
+        assert issuer_cfg["name"] == "github"
+        assert claims["sub"] == "repo:my-org/app:ref:refs/heads/main"
+
+    def test_rejected_tokens(self):
+        """Each failed check rejects the token."""
+        import main
+
+        # Signature of one token on the claims of another
+        other = self._token(sub="repo:my-org/app:ref:refs/heads/release").split(".")
+        tampered = ".".join(other[:2] + [self._token().split(".")[2]])
+        cases = {
+            "not trusted": self._token(iss="https://evil.example.com"),
+            "signature": tampered,
+            "RS256 required": self._token(alg="none"),
+            "expired": self._token(exp=int(time.time()) - 3600),
+            "audience": self._token(aud="someone-else"),
+            "not allowed": self._token(sub="repo:my-org/app:ref:refs/heads/feature"),
+            "not a JWT": "abc.def",
+        }
+        for reason, token in cases.items():
+            with pytest.raises(main.FederatedTokenError, match=reason):
+                self._validate(token)
+
+    def test_unknown_kid_rejected(self):
+        """A token signed with a key the issuer does not publish is rejected."""
+        import main
+
+        with pytest.raises(main.FederatedTokenError, match="signature"):
+            self._validate(self._token(kid="other"))
+
+    def test_load_federated_issuers(self):
+        """Entries missing required fields are skipped and max_ttl is capped."""
+        import main
+
+        raw = json.dumps(
+            [
+                {"issuer": self.ISSUER + "/", "audience": "opencode", "subjects": ["repo:*"], "max_ttl": 999999},
+                {"issuer": "http://insecure.example.com", "audience": "x", "subjects": ["*"]},
+                {"issuer": self.ISSUER, "subjects": ["*"]},
+            ]
+        )
+        with patch.dict("os.environ", {"FEDERATED_ISSUERS": raw}):
+            issuers = main._load_federated_issuers()
+        assert len(issuers) == 1
+        assert issuers[0]["issuer"] == self.ISSUER
+        assert issuers[0]["name"] == "token.actions.githubusercontent.com"
+        assert issuers[0]["max_ttl"] == main.MAX_FEDERATED_TTL
+
+
+class TestDeviceAssertion:
+    """Verify X-Device-Assertion is checked against the registered device key."""
+
+    DEVICE_ID = "dev_AAAAAAAAAAAAAAAAAAAAAA"
+
+    @classmethod
+    def setup_class(cls):
+        import base64
+
+        cls.n, cls.e, cls.d = _rsa_test_key()
+
+        def b64(i):
+            raw = i.to_bytes((i.bit_length() + 7) // 8, "big")
+            return base64.urlsafe_b64encode(raw).rstrip(b"=").decode()
+
+        cls.jwk = {"kty": "RSA", "n": b64(cls.n), "e": b64(cls.e)}
+        cls.device = {
+            "device_id": cls.DEVICE_ID,
+            "status": "active",
+            "public_key": json.dumps(cls.jwk),
+        }
+
+    def _assertion(self, ttl=300, **overrides):
+        import base64
+        import hashlib
+
+        import main
+
+        def enc(obj):
+            return base64.urlsafe_b64encode(json.dumps(obj).encode()).rstrip(b"=").decode()
+
+        now = int(time.time())
+        claims = {
+            "iss": self.DEVICE_ID,
+            "iat": now,
+            "exp": now + ttl,
+            "htm": "POST",
+            "htu": "/v1/chat/completions",
+        }
+        claims.update(overrides)
+        claims = {k: v for k, v in claims.items() if v is not None}
+        header = {"alg": "RS256", "typ": "device+jwt", "kid": self.DEVICE_ID}
+        signing_input = enc(header) + "." + enc(claims)
+        k = (self.n.bit_length() + 7) // 8
+        digest_info = main._SHA256_DIGEST_INFO + hashlib.sha256(signing_input.encode()).digest()
+        em = b"\x00\x01" + b"\xff" * (k - len(digest_info) - 3) + b"\x00" + digest_info
+        sig = pow(int.from_bytes(em, "big"), self.d, self.n).to_bytes(k, "big")
+        return signing_input + "." + base64.urlsafe_b64encode(sig).rstrip(b"=").decode()
+
+    def _validate(self, assertion):
+        import main
+
+        return main.validate_device_assertion(
+            assertion, self.device, "POST", "/v1/chat/completions"
+        )
+
+    def test_valid_assertions(self):
+        """Request-bound and session assertions from the device key are accepted."""
+        import main
+
+        assert self._validate(self._assertion())["iss"] == self.DEVICE_ID
+        session = self._assertion(ttl=3600, htm=None, htu=None)
+        assert "htu" not in self._validate(session)
+        assert main._device_assertion_kid(session) == self.DEVICE_ID
+
+    def test_rejected_assertions(self):
+        """Each failed check rejects the assertion."""
+        import main
+
+        other = self._assertion(htu="/v1/models").split(".")
+        tampered = ".".join(other[:2] + [self._assertion().split(".")[2]])
+        cases = {
+            "signature": tampered,
+            "expired": self._assertion(iat=int(time.time()) - 7200, exp=int(time.time()) - 3600),
+            "too long": self._assertion(ttl=86400),
+            "another request": self._assertion(htu="/v1/models"),
+            "issuer": self._assertion(iss="dev_BBBBBBBBBBBBBBBBBBBBBB"),
+            "not a JWT": "abc.def",
+        }
+        for reason, assertion in cases.items():
+            with pytest.raises(main.DeviceAssertionError, match=reason):
+                self._validate(assertion)
+
+    def test_device_key_checks(self):
+        """Only RSA keys of at least 2048 bits are registrable, with a stable thumbprint."""
+        import main
+
+        key = main._parse_device_key(self.jwk)
+        assert key == self.jwk
+        assert main.jwk_thumbprint(key) == main.jwk_thumbprint(dict(key))
+        for bad in ({"kty": "EC"}, {"kty": "RSA", "n": "AQAB", "e": "AQAB"}, "key"):
+            with pytest.raises(ValueError):
+                main._parse_device_key(bad)
+        assert main._valid_device_id(self.DEVICE_ID)
+        assert not main._valid_device_id("dev_short")
+        assert not main._valid_device_id("oc_AAAAAAAAAAAAAAAAAAAAAA")
+
+
+class TestIdempotentCreate:
+    """Verify a retried create with the same Idempotency-Key yields the same key."""
+
+    TOKEN = "A" * 43
+
+    def test_same_token_same_key(self):
+        import main
+
+        key = main.idempotent_api_key(self.TOKEN, "user-1")
+        assert key == main.idempotent_api_key(self.TOKEN, "user-1")
+        assert key.startswith(main.API_KEY_PREFIX)
+        assert len(key) == len(main.generate_api_key())
+        assert key != main.idempotent_api_key(self.TOKEN, "user-2")
+        assert key != main.idempotent_api_key("B" * 43, "user-1")
+
+    def test_token_validation(self):
+        import main
+
+        assert main.valid_idempotency_token(self.TOKEN)
+        assert main.valid_idempotency_token("a-b_c" * 8)
+        for bad in ("short", "A" * 129, "A" * 42 + "=", "A" * 42 + "é"):
+            assert not main.valid_idempotency_token(bad)
+
+    def test_repeated_response(self):
+        import main
+
+        item = {
+            "key_prefix": "oc_abcdefg",
+            "description": "ci",
+            "status": "active",
+            "created_at": "2026-10-17T10:00:00+00:00",
+            "expires_at": "2026-10-17T18:00:00+00:00",
+            "project": "app",
+        }
+        response = main._created_key_response("oc_key", item)
+        assert response["key"] == "oc_key"
+        assert response["project"] == "app"
+        assert response["expires_in"] == 8 * 3600
+
+
+class TestAPIKeyDetail:
+    """Verify the describe response and the client address keys record."""
+
+    def test_detail(self):
+        from decimal import Decimal
+
+        import main
+
+        item = {
+            "key_hash": "secret-hash",
+            "key_prefix": "oc_abcdefg",
+            "user_sub": "user-1",
+            "user_email": "jane@example.com",
+            "status": "active",
+            "created_at": "2026-10-17T10:00:00+00:00",
+            "created_ip": "203.0.113.7",
+            "expires_at": "2027-01-15T10:00:00+00:00",
+            "request_count": Decimal(42),
+        }
+        detail = main._key_detail(item)
+        assert "key_hash" not in detail and "user_sub" not in detail
+        assert detail["request_count"] == 42
+        assert detail["created_by"] == "jane@example.com"
+        assert detail["scopes"] == main.API_KEY_SCOPES
+        assert detail["last_used_at"] is None
+        json.dumps(detail)
+
+        assert main._find_key([item], "oc_abcdefg") is item
+        assert main._find_key([item], "oc_other00") is None
+        assert main._find_key([item], "") is None
+
+    def test_client_ip(self):
+        import main
+
+        request = MagicMock()
+        request.headers = {"X-Forwarded-For": "10.0.0.1, 198.51.100.4"}
+        assert main._client_ip(request) == "198.51.100.4"
+        request.headers = {}
+        request.remote = "127.0.0.1"
+        assert main._client_ip(request) == "127.0.0.1"
+
+
+class TestWorkspace:
+    """Verify only well-formed workspace names are logged."""
+
+    def test_workspace_name(self):
+        import main
+
+        assert main.workspace_name("team-a") == "team-a"
+        assert main.workspace_name(" acct_123.prod ") == "acct_123.prod"
+        for bad in (None, "", "-lead", "a b", "x" * 65, "ws\nforged"):
+            assert main.workspace_name(bad) == ""
+
+
+class TestUserStatus:
+    """Verify disabled users get the access_revoked error clients recognize."""
+
+    def test_error_shape(self):
+        import main
+
+        error = main.access_revoked_error("it-help@example.com")["error"]
+        assert error["code"] == "access_revoked"
+        assert error["contact"] == "it-help@example.com"
+        assert "contact" not in main.access_revoked_error()["error"]
+
+    def test_username_claim(self):
+        import main
+
+        assert main._cognito_username({"cognito:username": "okta_jane"}) == "okta_jane"
+        assert main._cognito_username({"username": "jane"}) == "jane"
+        assert main._cognito_username({"sub": "abc"}) == ""
+
+    def test_user_enabled(self):
+        import main
+
+        client = MagicMock()
+        client.exceptions.UserNotFoundException = type(
+            "UserNotFoundException", (Exception,), {}
+        )
+        with patch("main.get_cognito_client", return_value=client):
+            client.admin_get_user.return_value = {"Username": "jane", "Enabled": True}
+            assert main._user_enabled("jane")
+            client.admin_get_user.return_value = {"Username": "jane", "Enabled": False}
+            assert not main._user_enabled("jane")
+            client.admin_get_user.side_effect = client.exceptions.UserNotFoundException()
+            assert not main._user_enabled("jane")
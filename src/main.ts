@@ -102,6 +102,10 @@ const apiStack = new ApiStack(app, `OpenCodeApi-${environment}`, {
   hostedZoneName,
   domainName: apiDomain,
   webDomain,
+  federatedIssuers: app.node.tryGetContext('federatedIssuers') || undefined,
+  devicePosture: app.node.tryGetContext('devicePosture') || undefined,
+  checkUserStatus: authProvider === 'cognito',
+  accessContact: app.node.tryGetContext('accessContact') || undefined,
 });
 
 // ============================================
@@ -19,6 +19,14 @@ export interface ApiStackProps extends cdk.StackProps {
   hostedZoneName: string;
   domainName: string;  // e.g., "oc.example.com"
   webDomain?: string;  // e.g., "downloads.oc.example.com" — passed to router as DISTRIBUTION_DOMAIN
+  // Trusted CI OIDC issuers for API key token exchange — passed to router as FEDERATED_ISSUERS
+  federatedIssuers?: Array<Record<string, unknown>>;
+  // Device posture check on X-Device-Assertion: 'off' (default), 'audit' or 'enforce' — passed to router as DEVICE_POSTURE
+  devicePosture?: string;
+  // Refuse JWT requests from disabled Cognito users — passes the user pool from SSM to router as USER_POOL_ID
+  checkUserStatus?: boolean;
+  // Who users should contact when their access is revoked — passed to router as ACCESS_CONTACT
+  accessContact?: string;
 }
 
 export class ApiStack extends cdk.Stack {
@@ -175,6 +183,32 @@ export class ApiStack extends cdk.Stack {
       description: 'API Keys DynamoDB Table Name',
     });
 
+    // ============================================
+    // DynamoDB — Devices table (public keys for device posture checks)
+    // ============================================
+    const devicesTable = new dynamodb.Table(this, 'DevicesTable', {
+      tableName: `opencode-devices-${props.environment}`,
+      partitionKey: { name: 'device_id', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: true },
+      removalPolicy: props.environment === 'prod'
+        ? cdk.RemovalPolicy.RETAIN
+        : cdk.RemovalPolicy.DESTROY,
+    });
+
+    devicesTable.addGlobalSecondaryIndex({
+      indexName: 'user-sub-index',
+      partitionKey: { name: 'user_sub', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'created_at', type: dynamodb.AttributeType.STRING },
+      projectionType: dynamodb.ProjectionType.ALL,
+    });
+
+    new ssm.StringParameter(this, 'DevicesTableNameParam', {
+      parameterName: `/opencode/${props.environment}/dynamodb/devices-table-name`,
+      stringValue: devicesTable.tableName,
+      description: 'Devices DynamoDB Table Name',
+    });
+
     // ============================================
     // ALB (merged from JwtAlbStack)
     // ============================================
@@ -362,6 +396,25 @@ export class ApiStack extends cdk.Stack {
 
     // Grant DynamoDB permissions for API key validation
     apiKeysTable.grantReadWriteData(taskRole);
+    devicesTable.grantReadWriteData(taskRole);
+
+    // Grant Cognito user lookups so the router can refuse disabled users
+    let userPoolId: string | undefined;
+    if (props.checkUserStatus) {
+      userPoolId = ssm.StringParameter.valueForStringParameter(
+        this,
+        `/opencode/${props.environment}/cognito/user-pool-id`
+      );
+      const userPoolArn = ssm.StringParameter.valueForStringParameter(
+        this,
+        `/opencode/${props.environment}/cognito/user-pool-arn`
+      );
+      taskRole.addToPolicy(new iam.PolicyStatement({
+        effect: iam.Effect.ALLOW,
+        actions: ['cognito-idp:AdminGetUser'],
+        resources: [userPoolArn],
+      }));
+    }
 
     // Grant S3 read access to distribution bucket for version policy and download URLs
     const distributionBucketName = ssm.StringParameter.valueFromLookup(
@@ -418,8 +471,13 @@ export class ApiStack extends cdk.Stack {
         SERVICE_VERSION: '1.0.0',
         AWS_REGION: cdk.Aws.REGION,
         API_KEYS_TABLE_NAME: apiKeysTable.tableName,
+        DEVICES_TABLE_NAME: devicesTable.tableName,
         DISTRIBUTION_BUCKET: distributionBucketName,
         ...(props.webDomain ? { DISTRIBUTION_DOMAIN: props.webDomain } : {}),
+        ...(props.federatedIssuers?.length ? { FEDERATED_ISSUERS: JSON.stringify(props.federatedIssuers) } : {}),
+        ...(props.devicePosture ? { DEVICE_POSTURE: props.devicePosture } : {}),
+        ...(userPoolId ? { USER_POOL_ID: userPoolId } : {}),
+        ...(props.accessContact ? { ACCESS_CONTACT: props.accessContact } : {}),
       },
       healthCheck: {
         command: ['CMD-SHELL', 'python -c "import urllib.request; urllib.request.urlopen(\'http://localhost:8080/health\')" || exit 1'],
@@ -525,6 +583,36 @@ export class ApiStack extends cdk.Stack {
       ],
     });
 
+    // API key token exchange rule (Priority 4) - No ALB auth, only when CI issuers are trusted.
+    // CI pipelines have no token from our IdP; the router verifies their OIDC token itself.
+    // Requests carrying a Bearer header already matched priority 3.
+    const apiKeyExchangeRule = props.federatedIssuers?.length
+      ? new elbv2.CfnListenerRule(this, 'ApiKeyExchangeRule', {
+        listenerArn: this.listener.listenerArn,
+        priority: 4,
+        conditions: [
+          {
+            field: 'path-pattern',
+            pathPatternConfig: {
+              values: ['/v1/api-keys/exchange'],
+            },
+          },
+          {
+            field: 'http-request-method',
+            httpRequestMethodConfig: {
+              values: ['POST'],
+            },
+          },
+        ],
+        actions: [
+          {
+            type: 'forward',
+            targetGroupArn: this.targetGroup.targetGroupArn,
+          },
+        ],
+      })
+      : undefined;
+
     // JWT Validation rule (Priority 5) - Bearer token required
     const jwtValidationRule = new elbv2.CfnListenerRule(this, 'JwtValidationRule', {
       listenerArn: this.listener.listenerArn,
@@ -629,6 +717,9 @@ export class ApiStack extends cdk.Stack {
     // Add dependency on listener rules to ensure target group is associated with ALB first
     this.service.node.addDependency(healthCheckRule);
     this.service.node.addDependency(apiKeyManagementRule);
+    if (apiKeyExchangeRule) {
+      this.service.node.addDependency(apiKeyExchangeRule);
+    }
     this.service.node.addDependency(jwtValidationRule);
     this.service.node.addDependency(apiKeyPassthroughRule);
 
@@ -689,6 +780,7 @@ export class ApiStack extends cdk.Stack {
         reason: 'DynamoDB grantReadWriteData() generates index/* wildcard for GSI query access — this is CDK standard behavior',
         appliesTo: [
           `Resource::<ApiKeysTable9F4DC7E7.Arn>/index/*`,
+          `Resource::<DevicesTableD0A940EE.Arn>/index/*`,
         ],
       },
     ], true);
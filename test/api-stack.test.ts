@@ -1,6 +1,6 @@
 import * as cdk from 'aws-cdk-lib';
-import { Template } from 'aws-cdk-lib/assertions';
-import { ApiStack } from '../src/stacks/api-stack';
+import { Match, Template } from 'aws-cdk-lib/assertions';
+import { ApiStack, ApiStackProps } from '../src/stacks/api-stack';
 
 const testEnv = {
   account: '123456789012',
@@ -53,7 +53,7 @@ function createTestContext(): Record<string, string> {
   };
 }
 
-function createTemplate(): Template {
+function createTemplate(extraProps: Partial<ApiStackProps> = {}): Template {
   const context = createTestContext();
   const app = new cdk.App({ context });
   const stack = new ApiStack(app, 'TestApi', {
@@ -62,6 +62,7 @@ function createTemplate(): Template {
     hostedZoneName: 'example.com',
     domainName: 'oc.example.com',
     env: testEnv,
+    ...extraProps,
   });
   return Template.fromStack(stack);
 }
@@ -101,8 +102,8 @@ test('ApiStack creates an ECR Repository', () => {
   template.resourceCountIs('AWS::ECR::Repository', 1);
 });
 
-test('ApiStack creates a DynamoDB table with PAY_PER_REQUEST billing', () => {
-  template.resourceCountIs('AWS::DynamoDB::Table', 1);
+test('ApiStack creates DynamoDB tables with PAY_PER_REQUEST billing', () => {
+  template.resourceCountIs('AWS::DynamoDB::Table', 2);
   template.hasResourceProperties('AWS::DynamoDB::Table', {
     BillingMode: 'PAY_PER_REQUEST',
     KeySchema: [
@@ -112,6 +113,15 @@ test('ApiStack creates a DynamoDB table with PAY_PER_REQUEST billing', () => {
       },
     ],
   });
+  template.hasResourceProperties('AWS::DynamoDB::Table', {
+    BillingMode: 'PAY_PER_REQUEST',
+    KeySchema: [
+      {
+        AttributeName: 'device_id',
+        KeyType: 'HASH',
+      },
+    ],
+  });
 });
 
 test('ApiStack creates 2 security groups (ALB + service)', () => {
@@ -131,6 +141,46 @@ test('ApiStack creates 5 listener rules', () => {
   template.resourceCountIs('AWS::ElasticLoadBalancingV2::ListenerRule', 5);
 });
 
-test('ApiStack creates 15 SSM parameters', () => {
-  template.resourceCountIs('AWS::SSM::Parameter', 15);
+test('ApiStack adds an unauthenticated token exchange rule when CI issuers are trusted', () => {
+  const federated = createTemplate({
+    federatedIssuers: [{
+      issuer: 'https://token.actions.githubusercontent.com',
+      audience: 'opencode',
+      subjects: ['repo:my-org/*:ref:refs/heads/main'],
+    }],
+  });
+  federated.resourceCountIs('AWS::ElasticLoadBalancingV2::ListenerRule', 6);
+  federated.hasResourceProperties('AWS::ElasticLoadBalancingV2::ListenerRule', {
+    Priority: 4,
+    Conditions: [
+      { Field: 'path-pattern', PathPatternConfig: { Values: ['/v1/api-keys/exchange'] } },
+      { Field: 'http-request-method', HttpRequestMethodConfig: { Values: ['POST'] } },
+    ],
+    Actions: [{ Type: 'forward' }],
+  });
+});
+
+test('ApiStack lets the router look up Cognito users when checkUserStatus is set', () => {
+  const checked = createTemplate({ checkUserStatus: true, accessContact: 'it-help@example.com' });
+  checked.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: Match.arrayWith([
+        Match.objectLike({ Action: 'cognito-idp:AdminGetUser', Effect: 'Allow' }),
+      ]),
+    },
+  });
+  checked.hasResourceProperties('AWS::ECS::TaskDefinition', {
+    ContainerDefinitions: [
+      Match.objectLike({
+        Environment: Match.arrayWith([
+          Match.objectLike({ Name: 'USER_POOL_ID' }),
+          { Name: 'ACCESS_CONTACT', Value: 'it-help@example.com' },
+        ]),
+      }),
+    ],
+  });
+});
+
+test('ApiStack creates 16 SSM parameters', () => {
+  template.resourceCountIs('AWS::SSM::Parameter', 16);
 });